@@ -1,6 +1,6 @@
 // FUSE service loop, for servers that wish to use it.
 
-package fs // import "bazil.org/fuse/fs"
+package fs // import "github.com/keybase/kbfs/fuse/fs"
 
 import (
 	"encoding/binary"
@@ -20,8 +20,8 @@ import (
 import (
 	"bytes"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fuseutil"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fuseutil"
 )
 
 const (
@@ -270,8 +270,6 @@ func nodeAttr(ctx context.Context, n Node, attr *fuse.Attr) error {
 // Other FUSE requests can be handled by implementing methods from the
 // Handle* interfaces. The most common to implement are HandleReader,
 // HandleReadDirer, and HandleWriter.
-//
-// TODO implement methods: Getlk, Setlk, Setlkw
 type Handle interface {
 }
 
@@ -282,6 +280,35 @@ type HandleFlusher interface {
 	Flush(ctx context.Context, req *fuse.FlushRequest) error
 }
 
+type HandleLseeker interface {
+	// Lseek finds the next data or hole in the file, at or after
+	// req.Offset, for SEEK_DATA and SEEK_HOLE.  If not implemented,
+	// the kernel treats the whole file as data.
+	Lseek(ctx context.Context, req *fuse.LseekRequest, resp *fuse.LseekResponse) error
+}
+
+type HandleFallocater interface {
+	// Fallocate allocates or deallocates space for a range of the
+	// file, for fallocate(2).  If not implemented, fallocate fails
+	// with EOPNOTSUPP.
+	Fallocate(ctx context.Context, req *fuse.FallocateRequest) error
+}
+
+type HandleGetlker interface {
+	// Getlk finds a lock that would conflict with req.Lock, for
+	// fcntl(2) F_GETLK, and sets resp.Lock to it, or to a lock of
+	// type fuse.LockUnlock if there is none.
+	Getlk(ctx context.Context, req *fuse.GetlkRequest, resp *fuse.GetlkResponse) error
+}
+
+type HandleSetlker interface {
+	// Setlk takes, changes or releases an fcntl(2) or flock(2)
+	// lock.  If req.Wait is false and the lock can't be taken, it
+	// should return EAGAIN; otherwise it should block until the
+	// lock can be taken or ctx is canceled.
+	Setlk(ctx context.Context, req *fuse.SetlkRequest) error
+}
+
 type HandleReadAller interface {
 	ReadAll(ctx context.Context) ([]byte, error)
 }
@@ -1287,6 +1314,72 @@ func (c *Server) handleRequest(ctx context.Context, node Node, snode *serveNode,
 		r.Respond()
 		return nil
 
+	case *fuse.LseekRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleLseeker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		s := &fuse.LseekResponse{}
+		if err := h.Lseek(ctx, r, s); err != nil {
+			return err
+		}
+		done(s)
+		r.Respond(s)
+		return nil
+
+	case *fuse.FallocateRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleFallocater)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		if err := h.Fallocate(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
+	case *fuse.GetlkRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleGetlker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		s := &fuse.GetlkResponse{}
+		if err := h.Getlk(ctx, r, s); err != nil {
+			return err
+		}
+		done(s)
+		r.Respond(s)
+		return nil
+
+	case *fuse.SetlkRequest:
+		shandle := c.getHandle(r.Handle)
+		if shandle == nil {
+			return fuse.ESTALE
+		}
+		h, ok := shandle.handle.(HandleSetlker)
+		if !ok {
+			return fuse.ENOSYS
+		}
+		if err := h.Setlk(ctx, r); err != nil {
+			return err
+		}
+		done(nil)
+		r.Respond()
+		return nil
+
 	case *fuse.ReleaseRequest:
 		shandle := c.getHandle(r.Handle)
 		if shandle == nil {
@@ -98,7 +98,7 @@
 // Behavior and metadata of the mounted file system can be changed by
 // passing MountOption values to Mount.
 //
-package fuse // import "bazil.org/fuse"
+package fuse // import "github.com/keybase/kbfs/fuse"
 
 import (
 	"bytes"
@@ -870,6 +870,31 @@ loop:
 			Flags:  in.FsyncFlags,
 		}
 
+	case opLseek:
+		in := (*lseekIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &LseekRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Whence: int(in.Whence),
+		}
+
+	case opFallocate:
+		in := (*fallocateIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &FallocateRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Length: int64(in.Length),
+			Mode:   FallocateMode(in.Mode),
+		}
+
 	case opSetxattr:
 		in := (*setxattrIn)(m.data())
 		if m.len() < unsafe.Sizeof(*in) {
@@ -957,12 +982,39 @@ loop:
 			Flags:        InitFlags(in.Flags),
 		}
 
-	case opGetlk:
-		panic("opGetlk")
-	case opSetlk:
-		panic("opSetlk")
-	case opSetlkw:
-		panic("opSetlkw")
+	case opGetlk, opSetlk, opSetlkw:
+		in := (*lkIn)(m.data())
+		if m.len() < lkInSize(c.proto) {
+			goto corrupt
+		}
+		lock := Lock{
+			Start: in.Lk.Start,
+			End:   in.Lk.End,
+			Type:  LockType(in.Lk.Type),
+			PID:   in.Lk.Pid,
+		}
+		var flags LockFlags
+		if c.proto.GE(Protocol{7, 9}) {
+			flags = LockFlags(in.LkFlags)
+		}
+		if m.hdr.Opcode == opGetlk {
+			req = &GetlkRequest{
+				Header:    m.Header(),
+				Handle:    HandleID(in.Fh),
+				LockOwner: in.Owner,
+				Lock:      lock,
+				Flags:     flags,
+			}
+		} else {
+			req = &SetlkRequest{
+				Header:    m.Header(),
+				Handle:    HandleID(in.Fh),
+				LockOwner: in.Owner,
+				Lock:      lock,
+				Flags:     flags,
+				Wait:      m.hdr.Opcode == opSetlkw,
+			}
+		}
 
 	case opAccess:
 		in := (*accessIn)(m.data())
@@ -1794,7 +1846,7 @@ type ReleaseRequest struct {
 	Handle       HandleID
 	Flags        OpenFlags // flags from OpenRequest
 	ReleaseFlags ReleaseFlags
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 var _ = Request(&ReleaseRequest{})
@@ -2260,6 +2312,181 @@ func (r *FsyncRequest) Respond() {
 	r.respond(buf)
 }
 
+// Whence values of an LseekRequest.
+const (
+	SeekData = 3 // the next data at or after Offset
+	SeekHole = 4 // the next hole at or after Offset
+)
+
+// An LseekRequest asks to find the next data or hole in an open file,
+// at or after Offset.  The kernel handles other seeks itself.
+type LseekRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	Offset int64
+	Whence int
+}
+
+var _ = Request(&LseekRequest{})
+
+func (r *LseekRequest) String() string {
+	return fmt.Sprintf("Lseek [%s] %v off=%d whence=%d", &r.Header, r.Handle, r.Offset, r.Whence)
+}
+
+// Respond replies to the request with the offset that was found.
+func (r *LseekRequest) Respond(resp *LseekResponse) {
+	buf := newBuffer(unsafe.Sizeof(lseekOut{}))
+	out := (*lseekOut)(buf.alloc(unsafe.Sizeof(lseekOut{})))
+	out.Offset = uint64(resp.Offset)
+	r.respond(buf)
+}
+
+// An LseekResponse is the response to an LseekRequest.
+type LseekResponse struct {
+	Offset int64
+}
+
+func (r *LseekResponse) String() string {
+	return fmt.Sprintf("Lseek %d", r.Offset)
+}
+
+// A FallocateMode is the mode of a FallocateRequest.
+type FallocateMode uint32
+
+// The FallocateModes, which have the values of the fallocate(2)
+// constants.
+const (
+	FallocateKeepSize  FallocateMode = 0x1 // FALLOC_FL_KEEP_SIZE
+	FallocatePunchHole FallocateMode = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+// A FallocateRequest asks to allocate or deallocate space for a
+// range of an open file, for fallocate(2).
+type FallocateRequest struct {
+	Header `json:"-"`
+	Handle HandleID
+	Offset int64
+	Length int64
+	Mode   FallocateMode
+}
+
+var _ = Request(&FallocateRequest{})
+
+func (r *FallocateRequest) String() string {
+	return fmt.Sprintf("Fallocate [%s] %v off=%d len=%d mode=%#x", &r.Header, r.Handle, r.Offset, r.Length, r.Mode)
+}
+
+// Respond replies to the request, indicating that the space was
+// allocated or deallocated.
+func (r *FallocateRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
+// A LockType is the type of a file lock.
+type LockType uint32
+
+// The LockTypes, which have the values of the fcntl(2) constants on
+// each platform.
+const (
+	LockRead   LockType = syscall.F_RDLCK
+	LockWrite  LockType = syscall.F_WRLCK
+	LockUnlock LockType = syscall.F_UNLCK
+)
+
+func (t LockType) String() string {
+	switch t {
+	case LockRead:
+		return "read"
+	case LockWrite:
+		return "write"
+	case LockUnlock:
+		return "unlock"
+	}
+	return fmt.Sprintf("LockType(%d)", uint32(t))
+}
+
+// A Lock is a lock on the byte range Start through End (inclusive)
+// of a file.
+type Lock struct {
+	Start uint64
+	End   uint64
+	Type  LockType
+	PID   uint32
+}
+
+func (l Lock) String() string {
+	return fmt.Sprintf("%v [%d-%d] pid=%d", l.Type, l.Start, l.End, l.PID)
+}
+
+// A GetlkRequest asks whether Lock could be taken by LockOwner,
+// for fcntl(2) F_GETLK.  The kernel only sends these if the file
+// system was mounted with the LockingPOSIX option.
+type GetlkRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      Lock
+	Flags     LockFlags
+}
+
+var _ = Request(&GetlkRequest{})
+
+func (r *GetlkRequest) String() string {
+	return fmt.Sprintf("Getlk [%s] %v owner=%#x %v fl=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.Flags)
+}
+
+// Respond replies to the request with a lock that conflicts with
+// the requested one, or a lock of type LockUnlock if there is none.
+func (r *GetlkRequest) Respond(resp *GetlkResponse) {
+	buf := newBuffer(unsafe.Sizeof(lkOut{}))
+	out := (*lkOut)(buf.alloc(unsafe.Sizeof(lkOut{})))
+	out.Lk = fileLock{
+		Start: resp.Lock.Start,
+		End:   resp.Lock.End,
+		Type:  uint32(resp.Lock.Type),
+		Pid:   resp.Lock.PID,
+	}
+	r.respond(buf)
+}
+
+// A GetlkResponse is the response to a GetlkRequest.
+type GetlkResponse struct {
+	Lock Lock
+}
+
+func (r *GetlkResponse) String() string {
+	return fmt.Sprintf("Getlk %v", r.Lock)
+}
+
+// A SetlkRequest asks to take, change or (with LockUnlock) release
+// Lock for LockOwner, for fcntl(2) or, if Flags has LockFlock,
+// flock(2).  If Wait is true, the request should block until the
+// lock can be taken; otherwise it should fail with EAGAIN.  The
+// kernel only sends these if the file system was mounted with the
+// LockingPOSIX or LockingFlock options.
+type SetlkRequest struct {
+	Header    `json:"-"`
+	Handle    HandleID
+	LockOwner uint64
+	Lock      Lock
+	Flags     LockFlags
+	Wait      bool
+}
+
+var _ = Request(&SetlkRequest{})
+
+func (r *SetlkRequest) String() string {
+	return fmt.Sprintf("Setlk [%s] %v owner=%#x %v fl=%v wait=%v", &r.Header, r.Handle, r.LockOwner, r.Lock, r.Flags, r.Wait)
+}
+
+// Respond replies to the request, indicating that the lock was
+// changed.
+func (r *SetlkRequest) Respond() {
+	buf := newBuffer(0)
+	r.respond(buf)
+}
+
 // An InterruptRequest is a request to interrupt another pending request. The
 // response to that request should return an error status of EINTR.
 type InterruptRequest struct {
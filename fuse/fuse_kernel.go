@@ -336,7 +336,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1 // release flock(2) locks of LockOwner
 )
 
 func (fl ReleaseFlags) String() string {
@@ -345,6 +346,7 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
 }
 
 // Opcodes
@@ -387,6 +389,8 @@ const (
 	opDestroy     = 38
 	opIoctl       = 39 // Linux?
 	opPoll        = 40 // Linux?
+	opFallocate   = 43 // Linux
+	opLseek       = 46 // Linux
 
 	// OS X
 	opSetvolname = 61
@@ -546,7 +550,7 @@ type releaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type flushIn struct {
@@ -645,6 +649,25 @@ type fsyncIn struct {
 	Padding    uint32
 }
 
+type lseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type lseekOut struct {
+	Offset uint64
+}
+
+type fallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	Padding uint32
+}
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -689,6 +712,21 @@ type lkOut struct {
 	Lk fileLock
 }
 
+// The LockFlags are used in the Getlk and Setlk exchanges.
+type LockFlags uint32
+
+const (
+	LockFlock LockFlags = 1 << 0 // the lock was taken by flock(2)
+)
+
+func (fl LockFlags) String() string {
+	return flagString(uint32(fl), lockFlagNames)
+}
+
+var lockFlagNames = []flagName{
+	{uint32(LockFlock), "LockFlock"},
+}
+
 type accessIn struct {
 	Mask    uint32
 	Padding uint32
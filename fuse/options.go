@@ -209,6 +209,16 @@ func AsyncRead() MountOption {
 	}
 }
 
+// AutoInvalData makes the kernel drop the pages it has cached for a
+// file whenever it notices that the file's size or modification time
+// have changed, such as when it refreshes the file's attributes.
+func AutoInvalData() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitAutoInvalData
+		return nil
+	}
+}
+
 // WritebackCache enables the kernel to buffer writes before sending
 // them to the FUSE server. Without this, writethrough caching is
 // used.
@@ -219,6 +229,26 @@ func WritebackCache() MountOption {
 	}
 }
 
+// LockingPOSIX makes the kernel send fcntl(2) byte-range locks to
+// the FUSE server, as GetlkRequests and SetlkRequests.  Without
+// this, the kernel only enforces them among local processes.
+func LockingPOSIX() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitPosixLocks
+		return nil
+	}
+}
+
+// LockingFlock makes the kernel send flock(2) locks to the FUSE
+// server, as SetlkRequests with the LockFlock flag.  Without this,
+// the kernel only enforces them among local processes.
+func LockingFlock() MountOption {
+	return func(conf *mountConfig) error {
+		conf.initFlags |= InitFlockLocks
+		return nil
+	}
+}
+
 // OSXFUSEPaths describes the paths used by an installed OSXFUSE
 // version. See OSXFUSELocationV3 for typical values.
 type OSXFUSEPaths struct {
@@ -0,0 +1,79 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func archiveHelper(ctx context.Context, config libkbfs.Config, args []string) (err error) {
+	flags := flag.NewFlagSet("kbfs archive", flag.ContinueOnError)
+	formatStr := flags.String("format", "tar", "Archive format: tar or zip.")
+	outPath := flags.String("o", "", "Write the archive to this file instead of stdout.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errExactlyOnePath
+	}
+
+	format, err := libfs.ParseArchiveFormat(*formatStr)
+	if err != nil {
+		return err
+	}
+
+	p, err := makeKbfsPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if p.pathType != tlfPath {
+		return fmt.Errorf("Cannot archive %s", p)
+	}
+	n, _, err := p.getNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	name := p.tlfName
+	if len(p.tlfComponents) > 0 {
+		name = p.tlfComponents[len(p.tlfComponents)-1]
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	err = libfs.WriteArchive(ctx, config.KBFSOps(), n, name, format, w)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func archive(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := archiveHelper(ctx, config, args)
+	if err != nil {
+		printError("archive", err)
+		exitStatus = 1
+	}
+	return
+}
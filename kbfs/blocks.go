@@ -0,0 +1,293 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// getBlock fetches the block ptr points to from the block server,
+// and decrypts it.
+func getBlock(ctx context.Context, config libkbfs.Config,
+	md *libkbfs.RootMetadata, ptr libkbfs.BlockPointer, isDir bool) (
+	libkbfs.Block, error) {
+	var block libkbfs.Block
+	if isDir {
+		block = libkbfs.NewDirBlock()
+	} else {
+		block = libkbfs.NewFileBlock()
+	}
+	err := config.BlockOps().Get(ctx, md, ptr, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// lookupBlockEntry returns the entry with the given name in the
+// directory whose top block ptr points to.
+func lookupBlockEntry(ctx context.Context, config libkbfs.Config,
+	md *libkbfs.RootMetadata, ptr libkbfs.BlockPointer, name string) (
+	libkbfs.DirEntry, error) {
+	block, err := getBlock(ctx, config, md, ptr, true)
+	if err != nil {
+		return libkbfs.DirEntry{}, err
+	}
+	dblock := block.(*libkbfs.DirBlock)
+	if !dblock.IsInd {
+		de, ok := dblock.Children[name]
+		if !ok {
+			return libkbfs.DirEntry{}, libkbfs.NoSuchNameError{Name: name}
+		}
+		return de, nil
+	}
+	// The entry can only be under the last block whose range
+	// starts at or before it.
+	for i := len(dblock.IPtrs) - 1; i >= 0; i-- {
+		if dblock.IPtrs[i].Off <= name {
+			return lookupBlockEntry(
+				ctx, config, md, dblock.IPtrs[i].BlockPointer, name)
+		}
+	}
+	return libkbfs.DirEntry{}, libkbfs.NoSuchNameError{Name: name}
+}
+
+// getBlockEntry returns the latest merged metadata of the top-level
+// folder of p, and the entry of p as of that metadata.  Unlike the
+// rest of the commands, it goes around the KBFSOps interface, so it
+// sees only what has been synced to the servers.
+func getBlockEntry(ctx context.Context, config libkbfs.Config,
+	p kbfsPath) (*libkbfs.RootMetadata, libkbfs.DirEntry, error) {
+	if p.pathType != tlfPath {
+		return nil, libkbfs.DirEntry{},
+			fmt.Errorf("%s isn't in a top-level folder", p)
+	}
+	n, _, err := p.getNode(ctx, config)
+	if err != nil {
+		return nil, libkbfs.DirEntry{}, err
+	}
+	md, err := config.MDOps().GetForTLF(ctx, n.GetFolderBranch().Tlf)
+	if err != nil {
+		return nil, libkbfs.DirEntry{}, err
+	}
+	de := md.Data().Dir
+	for _, name := range p.tlfComponents {
+		if de.Type != libkbfs.Dir {
+			return nil, libkbfs.DirEntry{},
+				fmt.Errorf("%s is not a dir, but a %s", p, de.Type)
+		}
+		de, err = lookupBlockEntry(ctx, config, md, de.BlockPointer, name)
+		if err != nil {
+			return nil, libkbfs.DirEntry{}, err
+		}
+	}
+	if de.Type == libkbfs.Sym {
+		return nil, libkbfs.DirEntry{},
+			fmt.Errorf("%s is a symlink, which has no blocks", p)
+	}
+	return md, de, nil
+}
+
+// blockVisitor is called by walkBlocks for each block, with the
+// offset of the block within its parent (empty for the top block),
+// and the block's level of indirection below the top block.
+type blockVisitor func(info libkbfs.BlockInfo, off string, holes bool,
+	block libkbfs.Block, level int) error
+
+// walkBlocks fetches the block info points to, and all the blocks
+// under it if it's indirect, calling visit for each of them, parents
+// first.  It returns how many levels of indirect blocks there are
+// below the given block.
+func walkBlocks(ctx context.Context, config libkbfs.Config,
+	md *libkbfs.RootMetadata, info libkbfs.BlockInfo, off string,
+	holes bool, isDir bool, level int, visit blockVisitor) (int, error) {
+	block, err := getBlock(ctx, config, md, info.BlockPointer, isDir)
+	if err != nil {
+		return 0, err
+	}
+	err = visit(info, off, holes, block, level)
+	if err != nil {
+		return 0, err
+	}
+
+	depth := 0
+	walkChild := func(childInfo libkbfs.BlockInfo, childOff string,
+		childHoles bool) error {
+		childDepth, err := walkBlocks(ctx, config, md, childInfo,
+			childOff, childHoles, isDir, level+1, visit)
+		if err != nil {
+			return err
+		}
+		if childDepth+1 > depth {
+			depth = childDepth + 1
+		}
+		return nil
+	}
+	switch b := block.(type) {
+	case *libkbfs.DirBlock:
+		if b.IsInd {
+			for _, iptr := range b.IPtrs {
+				err := walkChild(iptr.BlockInfo, fmt.Sprintf("%q", iptr.Off),
+					false)
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+	case *libkbfs.FileBlock:
+		if b.IsInd {
+			for _, iptr := range b.IPtrs {
+				err := walkChild(iptr.BlockInfo, fmt.Sprintf("%d", iptr.Off),
+					iptr.Holes)
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return depth, nil
+}
+
+func blockStatNode(ctx context.Context, config libkbfs.Config,
+	nodePathStr string) error {
+	p, err := makeKbfsPath(nodePathStr)
+	if err != nil {
+		return err
+	}
+
+	md, de, err := getBlockEntry(ctx, config, p)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	depth, err := walkBlocks(ctx, config, md, de.BlockInfo, "", false,
+		de.Type == libkbfs.Dir, 0,
+		func(info libkbfs.BlockInfo, off string, holes bool,
+			block libkbfs.Block, level int) error {
+			var offStr, holesStr, contentsStr string
+			if off != "" {
+				offStr = fmt.Sprintf("Off: %s, ", off)
+			}
+			if holes {
+				holesStr = ", Holes: true"
+			}
+			if fblock, ok := block.(*libkbfs.FileBlock); ok && !fblock.IsInd {
+				contentsStr = fmt.Sprintf(", Contents: %s",
+					byteCountStr(len(fblock.Contents)))
+			}
+			lines = append(lines, fmt.Sprintf(
+				"%s{ID: %s, %sEncodedSize: %d, KeyGen: %d, DataVer: %d, "+
+					"Creator: %s, RefNonce: %s%s%s}",
+				strings.Repeat("  ", level+1), info.ID, offStr,
+				block.GetEncodedSize(), info.KeyGen, info.DataVer,
+				info.Creator, info.RefNonce, holesStr, contentsStr))
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: {Type: %s, Size: %d, Revision: %d, Depth: %d}\n",
+		p, de.Type, de.Size, md.Revision, depth)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func blockStat(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs blockstat", flag.ContinueOnError)
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		printError("blockstat", errAtLeastOnePath)
+		exitStatus = 1
+		return
+	}
+
+	for _, nodePath := range nodePaths {
+		err := blockStatNode(ctx, config, nodePath)
+		if err != nil {
+			printError("blockstat", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
+
+func blockDumpHelper(ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs blockdump", flag.ContinueOnError)
+	contents := flags.Bool("contents", false,
+		"Dump only the contents of a direct file block.")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("a path and a block ID must be specified")
+	}
+
+	p, err := makeKbfsPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	id, err := libkbfs.BlockIDFromString(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	md, de, err := getBlockEntry(ctx, config, p)
+	if err != nil {
+		return err
+	}
+
+	var found libkbfs.Block
+	_, err = walkBlocks(ctx, config, md, de.BlockInfo, "", false,
+		de.Type == libkbfs.Dir, 0,
+		func(info libkbfs.BlockInfo, _ string, _ bool,
+			block libkbfs.Block, _ int) error {
+			if found == nil && info.ID == id {
+				found = block
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return fmt.Errorf("block %s isn't one of %s's", id, p)
+	}
+
+	var buf []byte
+	if *contents {
+		fblock, ok := found.(*libkbfs.FileBlock)
+		if !ok || fblock.IsInd {
+			return fmt.Errorf("block %s isn't a direct file block", id)
+		}
+		buf = fblock.Contents
+	} else {
+		buf, err = config.Codec().Encode(found)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func blockDump(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := blockDumpHelper(ctx, config, args)
+	if err != nil {
+		printError("blockdump", err)
+		exitStatus = 1
+	}
+	return
+}
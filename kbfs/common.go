@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
@@ -26,6 +27,21 @@ func byteCountStr(n int) string {
 	return fmt.Sprintf("%d bytes", n)
 }
 
+// jsonError is how errors are printed with -json.
+type jsonError struct {
+	Command string
+	Error   string
+}
+
 func printError(prefix string, err error) {
+	if *jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(jsonError{prefix, err.Error()})
+		return
+	}
 	fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, err)
 }
+
+// printJSON prints v to stdout as JSON, on a line of its own.
+func printJSON(v interface{}) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
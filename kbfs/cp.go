@@ -0,0 +1,438 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// copyChunkBytes is how much file data is read and written at
+	// once, which is the default block size.
+	copyChunkBytes = 512 * 1024
+	// copySyncBytes is how much file data is written between two
+	// syncs of a file being copied, so that an interrupted copy
+	// can be resumed from the last sync.
+	copySyncBytes = 32 * 1024 * 1024
+	// copyParallelismDefault is how many chunks of a file are read
+	// at once by default.
+	copyParallelismDefault = 4
+)
+
+// copyTarget is where a source of cp or mv goes.
+type copyTarget struct {
+	dir  libkbfs.Node
+	name string
+	p    kbfsPath
+}
+
+// getCopyTargets returns where each of srcs goes when it's copied or
+// moved to dstPathStr: into it, if it's an existing directory, or
+// else to it, if there's only one source.
+func getCopyTargets(ctx context.Context, config libkbfs.Config,
+	srcs []kbfsPath, dstPathStr string) ([]copyTarget, error) {
+	dst, err := makeKbfsPath(dstPathStr)
+	if err != nil {
+		return nil, err
+	}
+	if dst.pathType != tlfPath {
+		return nil, cannotWriteErr{dstPathStr, nil}
+	}
+
+	dstNode, dstEI, err := dst.getNode(ctx, config)
+	if err == nil && dstEI.Type == libkbfs.Dir {
+		targets := make([]copyTarget, 0, len(srcs))
+		for _, src := range srcs {
+			_, name, err := src.dirAndBasename()
+			if err != nil {
+				return nil, err
+			}
+			p, err := dst.join(name)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, copyTarget{dstNode, name, p})
+		}
+		return targets, nil
+	}
+	if _, ok := err.(libkbfs.NoSuchNameError); err != nil && !ok {
+		return nil, err
+	}
+
+	if len(srcs) > 1 {
+		return nil, fmt.Errorf("%s is not a directory", dst)
+	}
+	dir, name, err := dst.dirAndBasename()
+	if err != nil {
+		return nil, err
+	}
+	if dir.pathType != tlfPath {
+		return nil, cannotWriteErr{dstPathStr, nil}
+	}
+	dirNode, err := dir.getDirNode(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return []copyTarget{{dirNode, name, dst}}, nil
+}
+
+// getSources returns the paths, nodes and entry infos of the given
+// sources.
+func getSources(ctx context.Context, config libkbfs.Config,
+	srcPathStrs []string) ([]kbfsPath, []libkbfs.Node,
+	[]libkbfs.EntryInfo, error) {
+	var ps []kbfsPath
+	var nodes []libkbfs.Node
+	var eis []libkbfs.EntryInfo
+	for _, srcPathStr := range srcPathStrs {
+		p, err := makeKbfsPath(srcPathStr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if p.pathType != tlfPath || len(p.tlfComponents) == 0 {
+			return nil, nil, nil, fmt.Errorf("cannot copy or move %s", p)
+		}
+		n, ei, err := p.getNode(ctx, config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ps = append(ps, p)
+		nodes = append(nodes, n)
+		eis = append(eis, ei)
+	}
+	return ps, nodes, eis, nil
+}
+
+// copier copies files and directories within KBFS.
+type copier struct {
+	ctx     context.Context
+	kbfsOps libkbfs.KBFSOps
+	// resume makes the copy skip destination files that are as
+	// big as their sources, and finish those that are smaller.
+	resume      bool
+	verbose     bool
+	parallelism int
+
+	progress libkbfs.MoveProgress
+	printer  *progressPrinter
+}
+
+// measureTree adds the files and bytes under the given entry to the
+// totals of the copy's progress.
+func (c *copier) measureTree(node libkbfs.Node, ei libkbfs.EntryInfo) error {
+	switch ei.Type {
+	case libkbfs.File, libkbfs.Exec:
+		c.progress.TotalFiles++
+		c.progress.TotalBytes += int64(ei.Size)
+	case libkbfs.Dir:
+		names, err := sortedChildren(c.ctx, c.kbfsOps, node)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			child, childEI, err := c.kbfsOps.Lookup(c.ctx, node, name)
+			if err != nil {
+				return err
+			}
+			if err := c.measureTree(child, childEI); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readFull reads len(buf) bytes of from, starting at off, unless the
+// file ends first.
+func (c *copier) readFull(ctx context.Context, from libkbfs.Node,
+	buf []byte, off int64) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := c.kbfsOps.Read(ctx, from, buf[read:], off+int64(read))
+		if err != nil {
+			return read, err
+		}
+		if n == 0 {
+			break
+		}
+		read += int(n)
+	}
+	return read, nil
+}
+
+// readChunk is a chunk of a file being copied.  done is closed once
+// the chunk has been read.
+type readChunk struct {
+	off  int64
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// copyFileData copies the data of from, starting at off, into to.
+// Up to c.parallelism chunks are read at once, so that the blocks
+// they're in are fetched in parallel, but they're written in order.
+func (c *copier) copyFileData(from, to libkbfs.Node, off, size int64) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, c.parallelism)
+	chunks := make(chan *readChunk, c.parallelism)
+	go func() {
+		defer close(chunks)
+		for chunkOff := off; chunkOff < size; chunkOff += copyChunkBytes {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			n := int64(copyChunkBytes)
+			if size-chunkOff < n {
+				n = size - chunkOff
+			}
+			rc := &readChunk{
+				off:  chunkOff,
+				buf:  make([]byte, n),
+				done: make(chan struct{}),
+			}
+			go func() {
+				defer close(rc.done)
+				read, err := c.readFull(ctx, from, rc.buf, rc.off)
+				rc.buf, rc.err = rc.buf[:read], err
+			}()
+			select {
+			case chunks <- rc:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var unsynced int64
+	for rc := range chunks {
+		<-rc.done
+		if rc.err != nil {
+			return rc.err
+		}
+		err := c.kbfsOps.Write(ctx, to, rc.buf, rc.off)
+		if err != nil {
+			return err
+		}
+		<-sem
+		c.progress.Bytes += int64(len(rc.buf))
+		c.printer.update(c.progress)
+
+		unsynced += int64(len(rc.buf))
+		if unsynced >= copySyncBytes {
+			if err := c.kbfsOps.Sync(ctx, to); err != nil {
+				return err
+			}
+			unsynced = 0
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.kbfsOps.Sync(ctx, to)
+}
+
+// copyFile copies the file from, whose entry info is ei, to the given
+// name in toDir.
+func (c *copier) copyFile(from libkbfs.Node, ei libkbfs.EntryInfo,
+	toDir libkbfs.Node, toName string, toP kbfsPath) error {
+	to, toEI, err := c.kbfsOps.Lookup(c.ctx, toDir, toName)
+	var off int64
+	switch err.(type) {
+	case nil:
+		switch {
+		case toEI.Type == libkbfs.Dir:
+			return fmt.Errorf("cannot overwrite directory %s", toP)
+		case toEI.Type == libkbfs.Sym:
+			err := c.kbfsOps.RemoveEntry(c.ctx, toDir, toName)
+			if err != nil {
+				return err
+			}
+			to, _, err = c.kbfsOps.CreateFile(
+				c.ctx, toDir, toName, ei.Type == libkbfs.Exec)
+			if err != nil {
+				return err
+			}
+		case c.resume && toEI.Size <= ei.Size:
+			off = int64(toEI.Size)
+		default:
+			err := c.kbfsOps.Truncate(c.ctx, to, 0)
+			if err != nil {
+				return err
+			}
+		}
+	case libkbfs.NoSuchNameError:
+		to, _, err = c.kbfsOps.CreateFile(
+			c.ctx, toDir, toName, ei.Type == libkbfs.Exec)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	c.progress.Bytes += off
+	if off < int64(ei.Size) || off == 0 {
+		err = c.copyFileData(from, to, off, int64(ei.Size))
+		if err != nil {
+			return err
+		}
+	}
+	c.progress.Files++
+	c.printer.update(c.progress)
+	return nil
+}
+
+// copyTree copies the entry from, whose path is fromP, and everything
+// under it, to the given name in toDir.
+func (c *copier) copyTree(from libkbfs.Node, ei libkbfs.EntryInfo,
+	fromP kbfsPath, toDir libkbfs.Node, toName string, toP kbfsPath) error {
+	var err error
+	switch ei.Type {
+	case libkbfs.Sym:
+		_, toEI, lookupErr := c.kbfsOps.Lookup(c.ctx, toDir, toName)
+		switch lookupErr.(type) {
+		case nil:
+			if toEI.Type == libkbfs.Sym && toEI.SymPath == ei.SymPath {
+				return nil
+			}
+			if toEI.Type == libkbfs.Dir {
+				return fmt.Errorf("cannot overwrite directory %s", toP)
+			}
+			err := c.kbfsOps.RemoveEntry(c.ctx, toDir, toName)
+			if err != nil {
+				return err
+			}
+		case libkbfs.NoSuchNameError:
+		default:
+			return lookupErr
+		}
+		_, err = c.kbfsOps.CreateLink(c.ctx, toDir, toName, ei.SymPath)
+	case libkbfs.File, libkbfs.Exec:
+		err = c.copyFile(from, ei, toDir, toName, toP)
+	case libkbfs.Dir:
+		to, toEI, lookupErr := c.kbfsOps.Lookup(c.ctx, toDir, toName)
+		switch lookupErr.(type) {
+		case nil:
+			if toEI.Type != libkbfs.Dir {
+				return fmt.Errorf("cannot overwrite %s with a directory", toP)
+			}
+		case libkbfs.NoSuchNameError:
+			to, _, err = c.kbfsOps.CreateDir(c.ctx, toDir, toName)
+			if err != nil {
+				return err
+			}
+		default:
+			return lookupErr
+		}
+		names, err := sortedChildren(c.ctx, c.kbfsOps, from)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			child, childEI, err := c.kbfsOps.Lookup(c.ctx, from, name)
+			if err != nil {
+				return err
+			}
+			childFromP, err := fromP.join(name)
+			if err != nil {
+				return err
+			}
+			childToP, err := toP.join(name)
+			if err != nil {
+				return err
+			}
+			err = c.copyTree(child, childEI, childFromP, to, name, childToP)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot copy %s of type %s", fromP, ei.Type)
+	}
+	if err == nil && c.verbose {
+		fmt.Fprintf(os.Stderr, "cp: '%s' -> '%s'\n", fromP, toP)
+	}
+	return err
+}
+
+func cpHelper(ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs cp", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "Copy directories and their contents.")
+	resume := flags.Bool("resume", false,
+		"Skip destination files that are already as big as their sources, "+
+			"and finish the ones that are smaller, e.g. to resume an "+
+			"interrupted copy.")
+	parallelism := flags.Int("j", copyParallelismDefault,
+		"How many chunks of a file to read at once.")
+	progress := flags.Bool("progress", false,
+		"Print how much has been copied so far.")
+	verbose := flags.Bool("v", false, "Print each copied path.")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		return errTooFewArgs
+	}
+	if *parallelism < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
+
+	srcs, nodes, eis, err := getSources(ctx, config, flags.Args()[:flags.NArg()-1])
+	if err != nil {
+		return err
+	}
+	for i, ei := range eis {
+		if ei.Type == libkbfs.Dir && !*recursive {
+			return fmt.Errorf("%s is a directory (not copied)", srcs[i])
+		}
+	}
+	targets, err := getCopyTargets(ctx, config, srcs, flags.Arg(flags.NArg()-1))
+	if err != nil {
+		return err
+	}
+
+	c := &copier{
+		ctx:         ctx,
+		kbfsOps:     config.KBFSOps(),
+		resume:      *resume,
+		verbose:     *verbose,
+		parallelism: *parallelism,
+		printer:     newProgressPrinter("cp", *progress),
+	}
+	if *progress {
+		for i, node := range nodes {
+			if err := c.measureTree(node, eis[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i, node := range nodes {
+		t := targets[i]
+		err := c.copyTree(node, eis[i], srcs[i], t.dir, t.name, t.p)
+		if err != nil {
+			return err
+		}
+	}
+	c.printer.done(c.progress)
+	return nil
+}
+
+func cp(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := cpHelper(ctx, config, args)
+	if err != nil {
+		printError("cp", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -12,6 +12,7 @@ import (
 var errExactlyOnePath = errors.New("exactly one path must be specified")
 var errAtLeastOnePath = errors.New("at least one path must be specified")
 var errCannotSplit = errors.New("cannot split path")
+var errTooFewArgs = errors.New("at least one source and a destination must be specified")
 
 type invalidKbfsPathErr struct {
 	pathStr string
@@ -7,6 +7,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/keybase/kbfs/libkbfs"
@@ -14,9 +15,57 @@ import (
 )
 
 func printHeader(p kbfsPath) {
+	if *jsonOutput {
+		// Each path is printed as an object of its own.
+		return
+	}
 	fmt.Printf("%s:\n", p)
 }
 
+// jsonLsEntry is how ls prints an entry with -json.  Size, Mtime and
+// SymPath are only set with -l.
+type jsonLsEntry struct {
+	Name    string
+	Type    string
+	Size    *uint64    `json:",omitempty"`
+	Mtime   *time.Time `json:",omitempty"`
+	SymPath string     `json:",omitempty"`
+}
+
+type jsonLsEntriesByName []jsonLsEntry
+
+func (s jsonLsEntriesByName) Len() int           { return len(s) }
+func (s jsonLsEntriesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s jsonLsEntriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// jsonLs is how ls prints the entries of a path with -json.
+type jsonLs struct {
+	Path    string
+	Entries []jsonLsEntry
+}
+
+func makeJSONLsEntry(ctx context.Context, config libkbfs.Config,
+	dir kbfsPath, name string, entryType libkbfs.EntryType,
+	longFormat bool) (jsonLsEntry, error) {
+	entry := jsonLsEntry{Name: name, Type: entryType.String()}
+	if !longFormat {
+		return entry, nil
+	}
+	p, err := dir.join(name)
+	if err != nil {
+		return jsonLsEntry{}, err
+	}
+	_, de, err := p.getNode(ctx, config)
+	if err != nil {
+		return jsonLsEntry{}, err
+	}
+	mtime := time.Unix(0, de.Mtime)
+	entry.Size = &de.Size
+	entry.Mtime = &mtime
+	entry.SymPath = de.SymPath
+	return entry, nil
+}
+
 func computeModeStr(entryType libkbfs.EntryType) string {
 	var typeStr string
 	switch entryType {
@@ -166,16 +215,33 @@ func lsHelper(ctx context.Context, config libkbfs.Config, p kbfsPath, hasMultipl
 
 func lsOne(ctx context.Context, config libkbfs.Config, p kbfsPath, longFormat, useSigil, recursive, hasMultiple bool, errorFn func(error)) {
 	var children []string
+	entries := make([]jsonLsEntry, 0)
 	handleEntry := func(name string, entryType libkbfs.EntryType) {
 		if recursive && entryType == libkbfs.Dir {
 			children = append(children, name)
 		}
+		if *jsonOutput {
+			entry, err := makeJSONLsEntry(
+				ctx, config, p, name, entryType, longFormat)
+			if err != nil {
+				errorFn(err)
+				return
+			}
+			entries = append(entries, entry)
+			return
+		}
 		printEntry(ctx, config, p, name, entryType, longFormat, useSigil)
 	}
 	err := lsHelper(ctx, config, p, hasMultiple || recursive, handleEntry)
 	if err != nil {
 		errorFn(err)
 		// Fall-through.
+	} else if *jsonOutput {
+		sort.Sort(jsonLsEntriesByName(entries))
+		err := printJSON(jsonLs{Path: p.String(), Entries: entries})
+		if err != nil {
+			errorFn(err)
+		}
 	}
 
 	if recursive {
@@ -186,7 +252,9 @@ func lsOne(ctx context.Context, config libkbfs.Config, p kbfsPath, longFormat, u
 				continue
 			}
 
-			fmt.Print("\n")
+			if !*jsonOutput {
+				fmt.Print("\n")
+			}
 			lsOne(ctx, config, childPath, longFormat, useSigil, true, true, errorFn)
 		}
 	}
@@ -215,7 +283,7 @@ func ls(ctx context.Context, config libkbfs.Config, args []string) (exitStatus i
 			continue
 		}
 
-		if i > 0 {
+		if i > 0 && !*jsonOutput {
 			fmt.Print("\n")
 		}
 
@@ -17,25 +17,37 @@ import (
 )
 
 var version = flag.Bool("version", false, "Print version")
+var jsonOutput = flag.Bool("json", false, "Print output and errors as JSON, one value per line")
 
 const usageFormatStr = `Usage:
   kbfs -version
 
 To run against remote KBFS servers:
-  kbfs [-debug] [-cpuprofile=path/to/dir] [-bserver=%s] [-mdserver=%s]
-    <command> [<args>]
+  kbfs [-debug] [-json] [-cpuprofile=path/to/dir] [-bserver=%s]
+    [-mdserver=%s] <command> [<args>]
 
 To run in a local testing environment:
-  kbfs [-debug] [-cpuprofile=path/to/dir]
+  kbfs [-debug] [-json] [-cpuprofile=path/to/dir]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     <command> [<args>]
 
+With -json, stat, ls, status and usage print one JSON object per path, and
+errors and progress are printed to stderr as JSON objects.
+
 The possible commands are:
+  status	Display the status of KBFS or of folders
+  usage		Display how much of the quota each folder uses
   stat		Display file status
   ls		List directory contents
   mkdir		Make directories
   read		Dump file to stdout
+  archive	Stream a directory to stdout as a tar or zip archive
   write		Write stdin to file
+  cp		Copy files and directories
+  mv		Move files and directories
+  rm		Remove files and directories
+  blockstat	Display the blocks of a file or directory
+  blockdump	Dump a decrypted block of a file or directory to stdout
 
 `
 
@@ -88,6 +100,10 @@ func realMain() (exitStatus int) {
 	ctx := context.Background()
 
 	switch cmd {
+	case "status":
+		return status(ctx, config, args)
+	case "usage":
+		return folderUsage(ctx, config, args)
 	case "stat":
 		return stat(ctx, config, args)
 	case "ls":
@@ -96,8 +112,20 @@ func realMain() (exitStatus int) {
 		return mkdir(ctx, config, args)
 	case "read":
 		return read(ctx, config, args)
+	case "archive":
+		return archive(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "cp":
+		return cp(ctx, config, args)
+	case "mv":
+		return mv(ctx, config, args)
+	case "rm":
+		return rm(ctx, config, args)
+	case "blockstat":
+		return blockStat(ctx, config, args)
+	case "blockdump":
+		return blockDump(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
@@ -0,0 +1,82 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func mvHelper(ctx context.Context, config libkbfs.Config, args []string) error {
+	flags := flag.NewFlagSet("kbfs mv", flag.ContinueOnError)
+	progress := flags.Bool("progress", false,
+		"Print how much has been copied so far, for moves between "+
+			"top-level folders.")
+	verbose := flags.Bool("v", false, "Print each moved path.")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		return errTooFewArgs
+	}
+
+	srcs, _, _, err := getSources(ctx, config, flags.Args()[:flags.NArg()-1])
+	if err != nil {
+		return err
+	}
+	targets, err := getCopyTargets(ctx, config, srcs, flags.Arg(flags.NArg()-1))
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := config.KBFSOps()
+	for i, src := range srcs {
+		dir, name, err := src.dirAndBasename()
+		if err != nil {
+			return err
+		}
+		dirNode, err := dir.getDirNode(ctx, config)
+		if err != nil {
+			return err
+		}
+
+		t := targets[i]
+		if dirNode.GetFolderBranch() == t.dir.GetFolderBranch() {
+			err = kbfsOps.Rename(ctx, dirNode, name, t.dir, t.name)
+		} else {
+			// Moves between top-level folders copy everything
+			// over, which can take a while.
+			printer := newProgressPrinter("mv", *progress)
+			var last libkbfs.MoveProgress
+			err = kbfsOps.MoveAcrossFolders(ctx, dirNode, name, t.dir,
+				t.name, func(p libkbfs.MoveProgress) {
+					last = p
+					printer.update(p)
+				})
+			if err == nil {
+				printer.done(last)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "mv: '%s' -> '%s'\n", src, t.p)
+		}
+	}
+	return nil
+}
+
+func mv(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	err := mvHelper(ctx, config, args)
+	if err != nil {
+		printError("mv", err)
+		exitStatus = 1
+	}
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// progressInterval is the least time between two progress lines.
+const progressInterval = time.Second
+
+// progressPrinter prints how far a copy or a move has gotten to
+// stderr.  A nil *progressPrinter prints nothing.
+type progressPrinter struct {
+	prefix string
+	last   time.Time
+	// lastP is the last progress printed.
+	lastP libkbfs.MoveProgress
+}
+
+func newProgressPrinter(prefix string, enabled bool) *progressPrinter {
+	if !enabled {
+		return nil
+	}
+	return &progressPrinter{prefix: prefix}
+}
+
+// jsonProgress is how progress is printed with -json.
+type jsonProgress struct {
+	Command string
+	libkbfs.MoveProgress
+}
+
+func (pp *progressPrinter) print(p libkbfs.MoveProgress) {
+	pp.lastP = p
+	if *jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(jsonProgress{pp.prefix, p})
+		return
+	}
+	percent := 100
+	if p.TotalBytes > 0 {
+		percent = int(p.Bytes * 100 / p.TotalBytes)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d/%d files, %d/%s (%d%%)\n",
+		pp.prefix, p.Files, p.TotalFiles, p.Bytes,
+		byteCountStr(int(p.TotalBytes)), percent)
+}
+
+// update prints p, unless the last line was printed too recently.
+func (pp *progressPrinter) update(p libkbfs.MoveProgress) {
+	if pp == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(pp.last) < progressInterval {
+		return
+	}
+	pp.last = now
+	pp.print(p)
+}
+
+// done prints p, which is the final progress, unless it was the last
+// line printed.
+func (pp *progressPrinter) done(p libkbfs.MoveProgress) {
+	if pp == nil || (!pp.last.IsZero() && p == pp.lastP) {
+		return
+	}
+	pp.print(p)
+}
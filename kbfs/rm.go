@@ -0,0 +1,122 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// sortedChildren returns the names of the children of dir, sorted.
+func sortedChildren(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	dir libkbfs.Node) ([]string, error) {
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// removeTree removes the entry of dir with the given name, whose
+// path is p, and everything under it.
+func removeTree(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	dir libkbfs.Node, name string, p kbfsPath, verbose bool) error {
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.Dir {
+		names, err := sortedChildren(ctx, kbfsOps, node)
+		if err != nil {
+			return err
+		}
+		for _, child := range names {
+			childP, err := p.join(child)
+			if err != nil {
+				return err
+			}
+			err = removeTree(ctx, kbfsOps, node, child, childP, verbose)
+			if err != nil {
+				return err
+			}
+		}
+		err = kbfsOps.RemoveDir(ctx, dir, name)
+	} else {
+		err = kbfsOps.RemoveEntry(ctx, dir, name)
+	}
+	if err == nil && verbose {
+		fmt.Fprintf(os.Stderr, "rm: removed '%s'\n", p)
+	}
+	return err
+}
+
+func rmOne(ctx context.Context, config libkbfs.Config, nodePathStr string,
+	recursive, force, verbose bool) error {
+	p, err := makeKbfsPath(nodePathStr)
+	if err != nil {
+		return err
+	}
+	if p.pathType != tlfPath || len(p.tlfComponents) == 0 {
+		return fmt.Errorf("cannot remove %s", p)
+	}
+
+	dir, name, err := p.dirAndBasename()
+	if err != nil {
+		return err
+	}
+	parentNode, err := dir.getDirNode(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := config.KBFSOps()
+	_, ei, err := kbfsOps.Lookup(ctx, parentNode, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok && force {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.Dir && !recursive {
+		return fmt.Errorf("cannot remove %s: is a directory", p)
+	}
+
+	// Removing a tree entry by entry makes this resumable: if it
+	// gets interrupted, running it again picks up with what's left.
+	return removeTree(ctx, kbfsOps, parentNode, name, p, verbose)
+}
+
+func rm(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "Remove directories and their contents.")
+	force := flags.Bool("f", false, "Ignore paths that don't exist.")
+	verbose := flags.Bool("v", false, "Print each removed path.")
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		printError("rm", errAtLeastOnePath)
+		exitStatus = 1
+		return
+	}
+
+	for _, nodePath := range nodePaths {
+		err := rmOne(ctx, config, nodePath, *recursive, *force, *verbose)
+		if err != nil {
+			printError("rm", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -13,6 +13,16 @@ import (
 	"golang.org/x/net/context"
 )
 
+// jsonStat is how stat prints an entry with -json.
+type jsonStat struct {
+	Path    string
+	Type    string
+	Size    uint64
+	SymPath string `json:",omitempty"`
+	Mtime   time.Time
+	Ctime   time.Time
+}
+
 func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) error {
 	p, err := makeKbfsPath(nodePathStr)
 	if err != nil {
@@ -35,6 +45,17 @@ func statNode(ctx context.Context, config libkbfs.Config, nodePathStr string) er
 		}
 	}
 
+	if *jsonOutput {
+		return printJSON(jsonStat{
+			Path:    p.String(),
+			Type:    ei.Type.String(),
+			Size:    ei.Size,
+			SymPath: ei.SymPath,
+			Mtime:   time.Unix(0, ei.Mtime),
+			Ctime:   time.Unix(0, ei.Ctime),
+		})
+	}
+
 	var symPathStr string
 	if ei.Type == libkbfs.Sym {
 		symPathStr = fmt.Sprintf("SymPath: %s, ", ei.SymPath)
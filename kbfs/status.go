@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// jsonFolderStatus is how status prints a folder with -json.
+type jsonFolderStatus struct {
+	Path string
+	libkbfs.FolderBranchStatus
+}
+
+func printKBFSStatus(ctx context.Context, config libkbfs.Config) error {
+	status, _, err := config.KBFSOps().Status(ctx)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(status)
+	}
+
+	fmt.Printf("{User: %s, Connected: %t, Usage: %d, Limit: %d}\n",
+		status.CurrentUser, status.IsConnected, status.UsageBytes,
+		status.LimitBytes)
+	services := make([]string, 0, len(status.FailingServices))
+	for service := range status.FailingServices {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		fmt.Printf("  failing: %s: %s\n",
+			service, status.FailingServices[service])
+	}
+	return nil
+}
+
+func printFolderStatus(ctx context.Context, config libkbfs.Config,
+	nodePathStr string) error {
+	p, err := makeKbfsPath(nodePathStr)
+	if err != nil {
+		return err
+	}
+	if p.pathType != tlfPath {
+		return fmt.Errorf("%s isn't in a top-level folder", p)
+	}
+	n, _, err := p.getNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	status, _, err := config.KBFSOps().FolderStatus(
+		ctx, n.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(jsonFolderStatus{p.String(), status})
+	}
+
+	var writeBackStr string
+	if status.WriteBack != nil {
+		writeBackStr = fmt.Sprintf(", WriteBack: %d entries",
+			status.WriteBack.Entries)
+		if status.WriteBack.SetAside > 0 {
+			writeBackStr += fmt.Sprintf(" (%d set aside)",
+				status.WriteBack.SetAside)
+		}
+	}
+	fmt.Printf("%s: {Staged: %t, HeadWriter: %s, DiskUsage: %d, "+
+		"RekeyPending: %t, SyncMode: %s%s}\n", p, status.Staged,
+		status.HeadWriter, status.DiskUsage, status.RekeyPending,
+		status.SyncMode, writeBackStr)
+	if len(status.DirtyPaths) > 0 {
+		fmt.Printf("  dirty: %s\n", strings.Join(status.DirtyPaths, ", "))
+	}
+	return nil
+}
+
+func status(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs status", flag.ContinueOnError)
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		err := printKBFSStatus(ctx, config)
+		if err != nil {
+			printError("status", err)
+			exitStatus = 1
+		}
+		return
+	}
+
+	for _, nodePath := range nodePaths {
+		err := printFolderStatus(ctx, config, nodePath)
+		if err != nil {
+			printError("status", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// jsonFolderUsage is how usage prints a folder with -json.
+type jsonFolderUsage struct {
+	Path string
+	libkbfs.FolderUsage
+}
+
+type folderUsagesByBytes []jsonFolderUsage
+
+func (u folderUsagesByBytes) Len() int {
+	return len(u)
+}
+
+func (u folderUsagesByBytes) Less(i, j int) bool {
+	bi := u[i].LiveBytes + u[i].ArchivedBytes
+	bj := u[j].LiveBytes + u[j].ArchivedBytes
+	if bi != bj {
+		return bi > bj
+	}
+	return u[i].Path < u[j].Path
+}
+
+func (u folderUsagesByBytes) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+
+func getFolderUsage(ctx context.Context, config libkbfs.Config,
+	nodePathStr string) (jsonFolderUsage, error) {
+	p, err := makeKbfsPath(nodePathStr)
+	if err != nil {
+		return jsonFolderUsage{}, err
+	}
+	if p.pathType != tlfPath {
+		return jsonFolderUsage{},
+			fmt.Errorf("%s isn't in a top-level folder", p)
+	}
+	n, _, err := p.getNode(ctx, config)
+	if err != nil {
+		return jsonFolderUsage{}, err
+	}
+	usage, err := config.KBFSOps().FolderUsage(ctx, n.GetFolderBranch())
+	if err != nil {
+		return jsonFolderUsage{}, err
+	}
+	return jsonFolderUsage{p.String(), usage}, nil
+}
+
+func printFolderUsage(u jsonFolderUsage) error {
+	if *jsonOutput {
+		return printJSON(u)
+	}
+	fmt.Printf("%s: {Live: %d, Archived: %d, Pending: %d}\n",
+		u.Path, u.LiveBytes, u.ArchivedBytes, u.PendingBytes)
+	return nil
+}
+
+// favoritePaths returns the paths of the current user's favorite
+// folders.
+func favoritePaths(ctx context.Context, config libkbfs.Config) (
+	[]string, error) {
+	favs, err := config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(favs))
+	for _, fav := range favs {
+		visibility := privateName
+		if fav.Public {
+			visibility = publicName
+		}
+		paths = append(paths, path.Join("/", topName, visibility, fav.Name))
+	}
+	return paths, nil
+}
+
+func folderUsage(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs usage", flag.ContinueOnError)
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) > 0 {
+		for _, nodePath := range nodePaths {
+			u, err := getFolderUsage(ctx, config, nodePath)
+			if err == nil {
+				err = printFolderUsage(u)
+			}
+			if err != nil {
+				printError("usage", err)
+				exitStatus = 1
+			}
+		}
+		return
+	}
+
+	// With no paths, show every favorite folder, biggest first.
+	nodePaths, err := favoritePaths(ctx, config)
+	if err != nil {
+		printError("usage", err)
+		return 1
+	}
+	var usages []jsonFolderUsage
+	for _, nodePath := range nodePaths {
+		u, err := getFolderUsage(ctx, config, nodePath)
+		if err != nil {
+			printError("usage", err)
+			exitStatus = 1
+			continue
+		}
+		usages = append(usages, u)
+	}
+	sort.Sort(folderUsagesByBytes(usages))
+	for _, u := range usages {
+		if err := printFolderUsage(u); err != nil {
+			printError("usage", err)
+			exitStatus = 1
+		}
+	}
+	return
+}
@@ -23,6 +23,8 @@ var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "r
 var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
 var mountType = flag.String("mount-type", defaultMountType, "mount type: default, force")
 var version = flag.Bool("version", false, "Print version")
+var escapeReservedNames = flag.Bool("escape-reserved-names", true, "show entries with names Windows doesn't allow, like CON or a:b, under escaped names")
+var disambiguateCase = flag.Bool("disambiguate-case", true, "show entries whose names differ only by case under escaped names")
 
 const usageFormatStr = `Usage:
   kbfsdokan -version
@@ -31,6 +33,7 @@ To run against remote KBFS servers:
   kbfsdokan [-debug] [-cpuprofile=path/to/dir]
     [-bserver=%s] [-mdserver=%s]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
+    [-escape-reserved-names=false] [-disambiguate-case=false]
     [-log-to-file] [-log-file=path/to/file]
     /path/to/mountpoint
 
@@ -38,6 +41,7 @@ To run in a local testing environment:
   kbfsdokan [-debug] [-cpuprofile=path/to/dir]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
+    [-escape-reserved-names=false] [-disambiguate-case=false]
     [-log-to-file] [-log-file=path/to/file]
     /path/to/mountpoint
 
@@ -88,6 +92,10 @@ func start() *libfs.Error {
 		KbfsParams: *kbfsParams,
 		RuntimeDir: *runtimeDir,
 		Label:      *label,
+		NameMangler: libfs.NameMangler{
+			EscapeReserved:   *escapeReservedNames,
+			DisambiguateCase: *disambiguateCase,
+		},
 	}
 
 	return libdokan.Start(mounter, options, ctx)
@@ -11,7 +11,7 @@ import (
 	"fmt"
 	"os"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/env"
@@ -24,6 +24,8 @@ var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "r
 var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
 var mountType = flag.String("mount-type", defaultMountType, "mount type: default, force")
 var version = flag.Bool("version", false, "Print version")
+var httpGatewayAddr = flag.String("http-gateway-addr", "", "if non-empty, serve public folders read-only over HTTP on this address (e.g., 127.0.0.1:8089)")
+var takeover = flag.Bool("takeover", false, "ask any running KBFS instance using the same runtime directory to shut down, instead of failing")
 
 const usageFormatStr = `Usage:
   kbfsfuse -version
@@ -32,6 +34,8 @@ To run against remote KBFS servers:
   kbfsfuse [-debug] [-cpuprofile=path/to/dir]
     [-bserver=%s] [-mdserver=%s]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
+    [-takeover] [-http-gateway-addr=host:port]
+    %s
     [-log-to-file] [-log-file=path/to/file]]
     %s/path/to/mountpoint
 
@@ -39,6 +43,8 @@ To run in a local testing environment:
   kbfsfuse [-debug] [-cpuprofile=path/to/dir]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
+    [-takeover]
+    %s
     [-log-to-file] [-log-file=path/to/file]]
     %s/path/to/mountpoint
 
@@ -54,9 +60,11 @@ func getUsageStr(ctx libkbfs.Context) string {
 		defaultMDServer = "host:port"
 	}
 	platformUsageString := libfuse.GetPlatformUsageString()
+	mountUsageString := libfuse.GetMountUsageString()
 	return fmt.Sprintf(
 		usageFormatStr, defaultBServer, defaultMDServer,
-		platformUsageString, platformUsageString)
+		mountUsageString, platformUsageString,
+		mountUsageString, platformUsageString)
 }
 
 func start() *libfs.Error {
@@ -64,6 +72,7 @@ func start() *libfs.Error {
 
 	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
 	platformParams := libfuse.AddPlatformFlags(flag.CommandLine)
+	mountOptions := libfuse.AddMountFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -93,15 +102,21 @@ func start() *libfs.Error {
 	mountpoint := flag.Arg(0)
 	var mounter libfuse.Mounter
 	if *mountType == "force" {
-		mounter = libfuse.NewForceMounter(mountpoint, *platformParams)
+		mounter = libfuse.NewForceMounter(
+			mountpoint, *platformParams, *mountOptions)
 	} else {
-		mounter = libfuse.NewDefaultMounter(mountpoint, *platformParams)
+		mounter = libfuse.NewDefaultMounter(
+			mountpoint, *platformParams, *mountOptions)
 	}
 
 	options := libfuse.StartOptions{
 		KbfsParams: *kbfsParams,
 		RuntimeDir: *runtimeDir,
 		Label:      *label,
+		Takeover:   *takeover,
+
+		HTTPGatewayAddr: *httpGatewayAddr,
+		MountOptions:    *mountOptions,
 	}
 
 	return libfuse.Start(mounter, options, ctx)
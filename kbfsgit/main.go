@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Git remote helper for repositories kept in KBFS
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libgit"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+var version = flag.Bool("version", false, "Print version")
+
+const usageFormatStr = `Usage:
+  git-remote-keybase -version
+
+Run by git for keybase:// remotes, as:
+  git-remote-keybase [-debug] [-bserver=%s] [-mdserver=%s]
+    [-log-to-file] [-log-file=path/to/file] <remote> <url>
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() error {
+	ctx := env.NewContext()
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) != 2 {
+		fmt.Fprint(os.Stderr, getUsageStr(ctx))
+		return fmt.Errorf("expected a remote and a URL")
+	}
+	url := flag.Arg(1)
+
+	// git tells remote helpers where the local repository is.
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		return fmt.Errorf("GIT_DIR isn't set; this should be run by git")
+	}
+
+	// InitLog errors are non-fatal and are ignored.
+	log, _ := libkbfs.InitLog(*kbfsParams, ctx)
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(ctx, *kbfsParams, libkbfs.Shutdown, log)
+	if err != nil {
+		return err
+	}
+
+	defer libkbfs.Shutdown()
+
+	runner, err := libgit.NewRunner(config, url, gitDir, os.Stdin, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return runner.Run(context.Background())
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "git-remote-keybase error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Tool for adding users and devices to a KBFS keyring
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var keyringFile = flag.String("keyring", "", "keyring file to update (created if it doesn't exist)")
+var user = flag.String("user", "", "user to add the device to (added if not in the keyring yet)")
+var device = flag.String("device", "", "name of the new device")
+var secretsFile = flag.String("secrets", "", "file to write the new device's secret keys to")
+var asserts = flag.String("asserts", "", "comma-separated other names for a new user, like alice@github")
+
+const usageStr = `Usage:
+  kbfskeyring -keyring path/to/keyring.json -user name -device name
+    -secrets path/to/secrets.json [-asserts a,b,...]
+
+Adds a device with freshly-generated keys to a user in a KBFS keyring,
+adding the user first if needed, and writes the device's secret keys
+to a new file.  Copy the keyring to every device, and the secrets only
+to the new one, then run KBFS with -keyring and -keyring-secrets to
+use the keyring instead of the Keybase service.
+
+`
+
+func writeJSON(path string, v interface{}, perm os.FileMode,
+	exclusive bool) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(buf, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func addDevice() error {
+	if *keyringFile == "" || *user == "" || *device == "" ||
+		*secretsFile == "" {
+		return errors.New("-keyring, -user, -device and -secrets are required")
+	}
+	var keyring libkbfs.Keyring
+	if _, err := os.Stat(*keyringFile); err == nil {
+		keyring, err = libkbfs.ReadKeyring(*keyringFile)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	name := libkb.NewNormalizedUsername(*user)
+	var ku *libkbfs.KeyringUser
+	for i := range keyring.Users {
+		if libkb.NewNormalizedUsername(keyring.Users[i].Name) == name {
+			ku = &keyring.Users[i]
+			break
+		}
+	}
+	if ku == nil {
+		uid, err := libkbfs.MakeRandomKeyringUID()
+		if err != nil {
+			return err
+		}
+		newUser := libkbfs.KeyringUser{Name: string(name), UID: uid.String()}
+		if *asserts != "" {
+			for _, a := range strings.Split(*asserts, ",") {
+				newUser.Asserts = append(
+					newUser.Asserts, strings.TrimSpace(a))
+			}
+		}
+		keyring.Users = append(keyring.Users, newUser)
+		ku = &keyring.Users[len(keyring.Users)-1]
+	}
+	for _, d := range ku.Devices {
+		if d.Name == *device {
+			return fmt.Errorf("%s already has a device named %s",
+				name, *device)
+		}
+	}
+
+	kd, secrets, err := libkbfs.MakeRandomKeyringDevice(name, *device)
+	if err != nil {
+		return err
+	}
+	ku.Devices = append(ku.Devices, kd)
+	// Make sure the result is still a valid keyring.
+	if _, _, err := keyring.LocalUsers(&secrets); err != nil {
+		return err
+	}
+
+	// Write the secrets first, so that a device is never in the
+	// keyring without them.
+	if err := writeJSON(*secretsFile, secrets, 0600, true); err != nil {
+		return err
+	}
+	if err := writeJSON(*keyringFile, keyring, 0644, false); err != nil {
+		return err
+	}
+	fmt.Printf("Added device %s (%s) to %s\n", *device, kd.VerifyingKey,
+		name)
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usageStr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(flag.Args()) != 0 {
+		fmt.Fprint(os.Stderr, usageStr)
+		os.Exit(1)
+	}
+	if err := addDevice(); err != nil {
+		fmt.Fprintf(os.Stderr, "kbfskeyring error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Standalone verifier for exported KBFS MD chains
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var verbose = flag.Bool("v", false, "print every revision, not just the keys that signed them")
+
+const usageStr = `Usage:
+  kbfsmdverify [-v] [path/to/.kbfs_md_chain]
+
+Checks the signatures and the hash chain of an MD chain exported from
+a KBFS folder (e.g., by reading the .kbfs_md_chain file in it), read
+from the given file or from standard input.  It needs no Keybase
+service or KBFS client, and contacts no servers.  On success, it lists
+the keys that signed each writer's changes; check those against the
+writers' Keybase sigchains.
+
+`
+
+func readChain(r io.Reader) (libkbfs.MDChain, error) {
+	var chain libkbfs.MDChain
+	err := json.NewDecoder(r).Decode(&chain)
+	return chain, err
+}
+
+func verify() error {
+	var r io.Reader = os.Stdin
+	switch len(flag.Args()) {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	default:
+		fmt.Fprint(os.Stderr, usageStr)
+		return fmt.Errorf("extra arguments specified (flags go before the first argument)")
+	}
+
+	chain, err := readChain(r)
+	if err != nil {
+		return err
+	}
+	codec := libkbfs.NewCodecMsgpack()
+	crypto := libkbfs.MakeCryptoCommon(codec, logger.NewNull())
+	if err := libkbfs.VerifyMDChain(codec, crypto, chain); err != nil {
+		return err
+	}
+
+	// Collect the keys each writer has used.
+	keys := make(map[string]map[string]bool)
+	addKey := func(uid, kid string) {
+		if keys[uid] == nil {
+			keys[uid] = make(map[string]bool)
+		}
+		keys[uid][kid] = true
+	}
+	for _, entry := range chain.Entries {
+		if *verbose {
+			fmt.Printf("%d\t%s\twriter=%s\twriter-kid=%s\tsigner-kid=%s"+
+				"\tkeys=%s\tusage=%d\n", entry.Revision, entry.MdID,
+				entry.Writer, entry.WriterKID, entry.SignerKID,
+				entry.KeyBundleDigest, entry.DiskUsage)
+		}
+		addKey(entry.Writer, entry.WriterKID)
+	}
+
+	fmt.Printf("%s (%s): %d revisions verified\n", chain.Folder,
+		chain.TlfID, len(chain.Entries))
+	uids := make([]string, 0, len(keys))
+	for uid := range keys {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		kids := make([]string, 0, len(keys[uid]))
+		for kid := range keys[uid] {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		for _, kid := range kids {
+			fmt.Printf("writer %s signed with key %s\n", uid, kid)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usageStr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := verify(); err != nil {
+		fmt.Fprintf(os.Stderr, "kbfsmdverify error: %v\n", err)
+		os.Exit(1)
+	}
+}
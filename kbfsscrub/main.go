@@ -0,0 +1,75 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Scrubber for erasure-coded, self-hosted KBFS block servers
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var serverRoot = flag.String("server-root", "", "the -server-root of the block server")
+var shards = flag.String("server-root-shards", "", "the -server-root-shards of the block server")
+var rebuild = flag.Bool("rebuild", false, "write missing or corrupt shards again from the intact ones")
+
+const usageStr = `Usage:
+  kbfsscrub [-rebuild] -server-root=path/to/dir
+    -server-root-shards=path/to/shard1,path/to/shard2,...
+
+Checks every shard of every block stored by a KBFS instance run with
+-server-root and -server-root-shards, and reports the blocks with
+missing or corrupt shards.  With -rebuild, it also writes those
+shards again, e.g. onto a replacement disk, and shards the blocks
+stored before -server-root-shards was used.  The KBFS instance must
+not be running.
+
+`
+
+func scrub() error {
+	if len(flag.Args()) > 0 || *serverRoot == "" || *shards == "" {
+		fmt.Fprint(os.Stderr, usageStr)
+		return fmt.Errorf("-server-root and -server-root-shards are required")
+	}
+
+	result, err := libkbfs.ScrubServerRootShards(
+		*serverRoot, strings.Split(*shards, ","), *rebuild)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d blocks checked, %d damaged, %d unsharded, %d rebuilt\n",
+		result.Blocks, result.DamagedBlocks, result.Unsharded, result.Rebuilt)
+	dirs := make([]string, 0, len(result.DamagedShards))
+	for dir := range result.DamagedShards {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		fmt.Printf("%s: %d damaged shards\n", dir, result.DamagedShards[dir])
+	}
+	for _, id := range result.Lost {
+		fmt.Printf("lost: %s\n", id)
+	}
+	if len(result.Lost) > 0 {
+		return fmt.Errorf("%d blocks can't be recovered", len(result.Lost))
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	err := scrub()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfsscrub error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
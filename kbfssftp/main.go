@@ -0,0 +1,141 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system over SFTP
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libsftp"
+)
+
+var version = flag.Bool("version", false, "Print version")
+var listenAddr = flag.String("listen", "127.0.0.1:8022", "loopback address to serve SFTP on")
+var stdio = flag.Bool("stdio", false, "serve one SFTP session on standard input and output, as an sshd subsystem, instead of listening")
+
+const usageFormatStr = `Usage:
+  kbfssftp -version
+
+To run against remote KBFS servers:
+  kbfssftp [-debug] [-cpuprofile=path/to/dir]
+    [-bserver=%s] [-mdserver=%s]
+    [-listen=127.0.0.1:port | -stdio]
+    [-log-to-file] [-log-file=path/to/file]
+
+To run in a local testing environment:
+  kbfssftp [-debug] [-cpuprofile=path/to/dir]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-listen=127.0.0.1:port | -stdio]
+    [-log-to-file] [-log-file=path/to/file]
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+// checkLoopback makes sure the given address is only reachable from
+// this machine, since connections aren't authenticated.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func start() error {
+	ctx := env.NewContext()
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Fprint(os.Stderr, getUsageStr(ctx))
+		return fmt.Errorf("extra arguments specified (flags go before the first argument)")
+	}
+
+	// InitLog errors are non-fatal and are ignored.
+	log, _ := libkbfs.InitLog(*kbfsParams, ctx)
+
+	var listener net.Listener
+	if !*stdio {
+		if err := checkLoopback(*listenAddr); err != nil {
+			return err
+		}
+		var err error
+		listener, err = net.Listen("tcp", *listenAddr)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+	}
+
+	onInterruptFn := func() {
+		if listener != nil {
+			listener.Close()
+		}
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(ctx, *kbfsParams, onInterruptFn, log)
+	if err != nil {
+		return err
+	}
+
+	defer libkbfs.Shutdown()
+
+	server := libsftp.NewServer(config)
+	if *stdio {
+		return server.ServeConn(stdioConn{os.Stdin, os.Stdout})
+	}
+	log.Debug("Serving SFTP on %s", listener.Addr())
+	// Serve only returns once the listener is closed.
+	err = server.Serve(listener)
+	log.Debug("Ending: %v", err)
+	return nil
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfssftp error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
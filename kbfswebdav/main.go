@@ -0,0 +1,121 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system over WebDAV
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libwebdav"
+)
+
+var version = flag.Bool("version", false, "Print version")
+var listenAddr = flag.String("listen", "127.0.0.1:8700", "address to serve WebDAV on")
+var prefix = flag.String("prefix", "", "URL path to serve the folders under (default: a random one)")
+
+const usageFormatStr = `Usage:
+  kbfswebdav -version
+
+To run against remote KBFS servers:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir]
+    [-bserver=%s] [-mdserver=%s]
+    [-listen=host:port] [-prefix=/path]
+    [-log-to-file] [-log-file=path/to/file]
+
+To run in a local testing environment:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-listen=host:port] [-prefix=/path]
+    [-log-to-file] [-log-file=path/to/file]
+
+Anyone who can reach the address and knows the prefix can read and
+write all of the user's folders, so don't listen on a public address.
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() error {
+	ctx := env.NewContext()
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Print(getUsageStr(ctx))
+		return fmt.Errorf("extra arguments specified (flags go before the first argument)")
+	}
+
+	davPrefix := *prefix
+	if davPrefix == "" {
+		// Make the URL hard to guess, so that web pages the user
+		// visits can't get at their folders.
+		token, err := libkbfs.MakeRandomRequestID()
+		if err != nil {
+			return err
+		}
+		davPrefix = "/" + token
+	}
+
+	// InitLog errors are non-fatal and are ignored.
+	log, _ := libkbfs.InitLog(*kbfsParams, ctx)
+
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	onInterruptFn := func() {
+		listener.Close()
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(ctx, *kbfsParams, onInterruptFn, log)
+	if err != nil {
+		return err
+	}
+
+	defer libkbfs.Shutdown()
+
+	fmt.Printf("Serving KBFS at http://%s%s/\n", listener.Addr(), davPrefix)
+	// Serve only returns once the listener is closed.
+	err = http.Serve(listener, libwebdav.NewHandler(config, davPrefix))
+	log.Debug("Ending: %v", err)
+	return nil
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfswebdav error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// BandwidthScheduleFile represents a write-only file where writing a
+// schedule, like "09:00-17:00 up=1m down=1m", replaces the caps on
+// the traffic to and from the servers.  Writing an empty line
+// removes them.  It can only be reached from the top-level FS mount.
+type BandwidthScheduleFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *BandwidthScheduleFile) WriteFile(fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	ctx, cancel := NewContextWithOpID(f.fs, "BandwidthScheduleFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err, cancel) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	schedule, err := libkbfs.ParseBandwidthSchedule(string(bs))
+	if err != nil {
+		return 0, err
+	}
+	err = f.fs.config.KBFSOps().SetBandwidthSchedule(ctx, schedule)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
@@ -193,15 +193,23 @@ func (d *Dir) GetFileInformation(*dokan.FileInfo) (st *dokan.Stat, err error) {
 	ctx, cancel := NewContextWithOpID(d.folder.fs, "Dir GetFileInformation")
 	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err, cancel) }()
 
-	return eiToStat(d.folder.fs.config.KBFSOps().Stat(ctx, d.node))
+	st, err = eiToStat(d.folder.fs.config.KBFSOps().Stat(ctx, d.node))
+	if err != nil {
+		return nil, err
+	}
+	err = addDosAttributes(ctx, d.folder.fs, d.node, st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
 }
 
 // SetFileAttributes for Dokan.
-func (d *Dir) SetFileAttributes(fi *dokan.FileInfo, fileAttributes uint32) error {
-	_, cancel := NewContextWithOpID(d.folder.fs, "Dir SetFileAttributes")
-	cancel()
-	// TODO handle attributes for real.
-	return nil
+func (d *Dir) SetFileAttributes(fi *dokan.FileInfo, fileAttributes uint32) (err error) {
+	ctx, cancel := NewContextWithOpID(d.folder.fs, "Dir SetFileAttributes")
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err, cancel) }()
+
+	return setDosAttributes(ctx, d.folder.fs, d.node, fileAttributes)
 }
 
 // isNoSuchNameError checks for libkbfs.NoSuchNameError.
@@ -252,6 +260,18 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 		}
 		return child, false, nil
 
+	case libfs.PinFileName:
+		child := &PinFile{
+			folder: d.folder,
+		}
+		return child, false, nil
+
+	case libfs.SyncModeFileName:
+		child := &SyncModeFile{
+			folder: d.folder,
+		}
+		return child, false, nil
+
 	case libfs.ReclaimQuotaFileName:
 		child := &ReclaimQuotaFile{
 			folder: d.folder,
@@ -424,12 +444,18 @@ func (d *Dir) FindFiles(fi *dokan.FileInfo, callback func(*dokan.NamedStat) erro
 		return err
 	}
 
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	mangled := d.folder.fs.mangler.MangleNames(names)
+
 	empty := true
 	var ns dokan.NamedStat
 	ns.NumberOfLinks = 1
 	for name, de := range children {
 		empty = false
-		ns.Name = name
+		ns.Name = mangled[name]
 		// TODO perhaps resolve symlinks here?
 		fillStat(&ns.Stat, &de)
 		err = callback(&ns)
@@ -33,6 +33,9 @@ func (f *File) GetFileInformation(*dokan.FileInfo) (a *dokan.Stat, err error) {
 	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err, cancel) }()
 
 	a, err = eiToStat(f.folder.fs.config.KBFSOps().Stat(ctx, f.node))
+	if err == nil {
+		err = addDosAttributes(ctx, f.folder.fs, f.node, a)
+	}
 	if a != nil {
 		f.folder.fs.log.CDebugf(ctx, "File GetFileInformation node=%v => %v", f.node, *a)
 	} else {
@@ -137,9 +140,9 @@ func (f *File) SetAllocationSize(fi *dokan.FileInfo, newSize int64) (err error)
 }
 
 // SetFileAttributes for Dokan.
-func (f *File) SetFileAttributes(fi *dokan.FileInfo, fileAttributes uint32) error {
-	_, cancel := NewContextWithOpID(f.folder.fs, "File SetFileAttributes")
-	cancel()
-	// TODO handle attributes for real.
-	return nil
+func (f *File) SetFileAttributes(fi *dokan.FileInfo, fileAttributes uint32) (err error) {
+	ctx, cancel := NewContextWithOpID(f.folder.fs, "File SetFileAttributes")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err, cancel) }()
+
+	return setDosAttributes(ctx, f.folder.fs, f.node, fileAttributes)
 }
@@ -36,6 +36,10 @@ type FS struct {
 
 	// remoteStatus is the current status of remote connections.
 	remoteStatus libfs.RemoteStatus
+
+	// mangler maps entry names that Windows can't handle to ones
+	// it can, and back.
+	mangler libfs.NameMangler
 }
 
 // NewFS creates an FS
@@ -208,7 +212,7 @@ func (f *FS) CreateFile(fi *dokan.FileInfo, cd *dokan.CreateData) (dokan.File, b
 
 // openRaw is a wrapper between CreateFile/CreateDirectory/OpenDirectory and open
 func (f *FS) openRaw(ctx context.Context, fi *dokan.FileInfo, caf *dokan.CreateData) (dokan.File, bool, error) {
-	ps, err := windowsPathSplit(fi.Path())
+	ps, err := f.splitPath(fi.Path())
 	if err != nil {
 		return nil, false, err
 	}
@@ -236,6 +240,8 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return NewStatusFile(f.root.private.fs, nil), false, nil
 	case libfs.ResetCachesFileName == ps[0]:
 		return &ResetCachesFile{fs: f.root.private.fs}, false, nil
+	case libfs.BandwidthScheduleFileName == ps[0]:
+		return &BandwidthScheduleFile{fs: f.root.private.fs}, false, nil
 	// TODO
 	// Unfortunately sometimes we end up in this case while using
 	// reparse points.
@@ -276,6 +282,19 @@ func windowsPathSplit(raw string) ([]string, error) {
 	return strings.Split(raw[1:], `\`), nil
 }
 
+// splitPath splits a path we get from Dokan, and unmangles its
+// components into KBFS names.
+func (f *FS) splitPath(raw string) ([]string, error) {
+	ps, err := windowsPathSplit(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range ps {
+		ps[i] = f.mangler.UnmangleName(p)
+	}
+	return ps, nil
+}
+
 // MoveFile tries to move a file.
 func (f *FS) MoveFile(source *dokan.FileInfo, targetPath string, replaceExisting bool) (err error) {
 	// User checking is handled by the opening of the source file
@@ -292,7 +311,7 @@ func (f *FS) MoveFile(source *dokan.FileInfo, targetPath string, replaceExisting
 	defer src.Cleanup(nil)
 
 	// Source directory
-	srcDirPath, err := windowsPathSplit(source.Path())
+	srcDirPath, err := f.splitPath(source.Path())
 	if err != nil {
 		return err
 	}
@@ -308,7 +327,7 @@ func (f *FS) MoveFile(source *dokan.FileInfo, targetPath string, replaceExisting
 	defer srcDir.Cleanup(nil)
 
 	// Destination directory, not the destination file
-	dstPath, err := windowsPathSplit(targetPath)
+	dstPath, err := f.splitPath(targetPath)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// PinFile represents a write-only file where writing "always",
+// "never" or "auto" overrides whether the folder's blocks are pinned
+// in the block cache.
+type PinFile struct {
+	folder *Folder
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *PinFile) WriteFile(fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	ctx, cancel := NewContextWithOpID(f.folder.fs, "PinFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err, cancel) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	pinning, err := libkbfs.ParseFolderPinning(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.folder.fs.config.KBFSOps().SetFolderPinning(
+		ctx, f.folder.getFolderBranch(), pinning)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
@@ -21,6 +21,10 @@ type StartOptions struct {
 	KbfsParams libkbfs.InitParams
 	RuntimeDir string
 	Label      string
+	// NameMangler maps entry names that Windows can't handle, like
+	// reserved device names or names that only differ by case, to
+	// ones it can.
+	NameMangler libfs.NameMangler
 }
 
 // Start the filesystem
@@ -57,6 +61,7 @@ func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.
 	if err != nil {
 		return libfs.InitError(err.Error())
 	}
+	fs.mangler = options.NameMangler
 
 	if newFolderNameErr != nil {
 		log.CWarningf(fs.context, "Error guessing new folder name: %v", newFolderNameErr)
@@ -0,0 +1,40 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// SyncModeFile represents a write-only file where writing "full" or
+// "on-demand" changes how much of the folder is kept on this device.
+type SyncModeFile struct {
+	folder *Folder
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *SyncModeFile) WriteFile(fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	ctx, cancel := NewContextWithOpID(f.folder.fs, "SyncModeFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err, cancel) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	mode, err := libkbfs.ParseTlfSyncMode(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.folder.fs.config.KBFSOps().SetTlfSyncMode(
+		ctx, f.folder.getFolderBranch(), mode)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
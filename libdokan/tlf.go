@@ -133,16 +133,11 @@ func (tlf *TLF) SetFileTime(fi *dokan.FileInfo, creation time.Time, lastAccess t
 	return dir.SetFileTime(fi, creation, lastAccess, lastWrite)
 }
 
-// SetFileAttributes for Dokan.
+// SetFileAttributes for Dokan.  The root of a TLF has no directory
+// entry to keep the attributes in, so they are ignored.
 func (tlf *TLF) SetFileAttributes(fi *dokan.FileInfo, fileAttributes uint32) error {
-	ctx, cancel := NewContextWithOpID(tlf.folder.fs, "TLF SetFileAttributes")
-	defer cancel()
-	dir, _, err := tlf.loadDirHelper(ctx, "TLF SetFileAttributes", false)
-	if err != nil {
-		return err
-	}
-	return dir.SetFileAttributes(fi, fileAttributes)
-
+	_, cancel := NewContextWithOpID(tlf.folder.fs, "TLF SetFileAttributes")
+	cancel()
 	return nil
 }
 
@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package libdokan
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// dosAttributesXattr is the extended attribute that holds the DOS
+// attributes set on an entry through Dokan, as a little-endian
+// uint32.  Windows has no other use for extended attributes, but
+// keeping these in one lets them survive a trip through other
+// platforms.
+const dosAttributesXattr = "user.kbfs.dosattrib"
+
+// settableDosAttributes are the DOS attributes that are kept in
+// dosAttributesXattr.  All others are derived from the entry type.
+const settableDosAttributes = syscall.FILE_ATTRIBUTE_READONLY |
+	syscall.FILE_ATTRIBUTE_HIDDEN | syscall.FILE_ATTRIBUTE_SYSTEM |
+	syscall.FILE_ATTRIBUTE_ARCHIVE
+
+// setDosAttributes stores the settable bits of fileAttributes on
+// the given node.
+func setDosAttributes(ctx context.Context, fs *FS, node libkbfs.Node,
+	fileAttributes uint32) error {
+	attrs := fileAttributes & settableDosAttributes
+	if attrs == 0 {
+		err := fs.config.KBFSOps().RemoveXattr(ctx, node, dosAttributesXattr)
+		if _, ok := err.(libkbfs.NoSuchXattrError); ok {
+			return nil
+		}
+		return err
+	}
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], attrs)
+	return fs.config.KBFSOps().SetXattr(ctx, node, dosAttributesXattr,
+		buf[:], libkbfs.XattrCreateOrReplace)
+}
+
+// addDosAttributes adds any stored DOS attributes of the given node
+// to st.
+func addDosAttributes(ctx context.Context, fs *FS, node libkbfs.Node,
+	st *dokan.Stat) error {
+	value, err := fs.config.KBFSOps().GetXattr(ctx, node, dosAttributesXattr)
+	if _, ok := err.(libkbfs.NoSuchXattrError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(value) != 4 {
+		fs.log.CDebugf(ctx, "Ignoring malformed DOS attributes %v", value)
+		return nil
+	}
+	attrs := binary.LittleEndian.Uint32(value) & settableDosAttributes
+	if attrs != 0 {
+		// FILE_ATTRIBUTE_NORMAL is only valid on its own.
+		st.FileAttributes &^= fileAttributeNormal
+		st.FileAttributes |= attrs
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchiveFormat is a format in which WriteArchive can stream a
+// directory.
+type ArchiveFormat int
+
+const (
+	// ArchiveTar is an uncompressed tar archive.
+	ArchiveTar ArchiveFormat = iota
+	// ArchiveZip is a zip archive, with its files deflated.
+	ArchiveZip
+)
+
+// ParseArchiveFormat returns the ArchiveFormat with the given name,
+// "tar" or "zip".
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	switch s {
+	case "tar":
+		return ArchiveTar, nil
+	case "zip":
+		return ArchiveZip, nil
+	default:
+		return 0, fmt.Errorf("Unknown archive format %q", s)
+	}
+}
+
+func (f ArchiveFormat) String() string {
+	switch f {
+	case ArchiveTar:
+		return "tar"
+	case ArchiveZip:
+		return "zip"
+	default:
+		return fmt.Sprintf("ArchiveFormat(%d)", int(f))
+	}
+}
+
+// ContentType returns the MIME type of archives in this format.
+func (f ArchiveFormat) ContentType() string {
+	if f == ArchiveZip {
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// archiveWriter adds entries to an archive in some format.
+type archiveWriter interface {
+	addDir(name string, ei libkbfs.EntryInfo) error
+	addSymlink(name string, ei libkbfs.EntryInfo) error
+	// addFile adds a file, whose contents r must return.
+	addFile(name string, ei libkbfs.EntryInfo, r io.Reader) error
+	Close() error
+}
+
+func fileMode(ei libkbfs.EntryInfo) os.FileMode {
+	switch ei.Type {
+	case libkbfs.Dir:
+		return os.ModeDir | 0755
+	case libkbfs.Sym:
+		return os.ModeSymlink | 0777
+	case libkbfs.Exec:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+type tarArchiveWriter struct {
+	w *tar.Writer
+}
+
+func (t tarArchiveWriter) header(name string, ei libkbfs.EntryInfo,
+	typeflag byte) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Mode:     int64(fileMode(ei).Perm()),
+		ModTime:  time.Unix(0, ei.Mtime),
+		Typeflag: typeflag,
+	}
+}
+
+func (t tarArchiveWriter) addDir(name string, ei libkbfs.EntryInfo) error {
+	return t.w.WriteHeader(t.header(name+"/", ei, tar.TypeDir))
+}
+
+func (t tarArchiveWriter) addSymlink(
+	name string, ei libkbfs.EntryInfo) error {
+	hdr := t.header(name, ei, tar.TypeSymlink)
+	hdr.Linkname = ei.SymPath
+	return t.w.WriteHeader(hdr)
+}
+
+func (t tarArchiveWriter) addFile(
+	name string, ei libkbfs.EntryInfo, r io.Reader) error {
+	hdr := t.header(name, ei, tar.TypeReg)
+	hdr.Size = int64(ei.Size)
+	if err := t.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The header promised exactly this many bytes.
+	n, err := io.CopyN(t.w, r, hdr.Size)
+	if err == io.EOF {
+		return fmt.Errorf("%s shrank to %d bytes while being archived",
+			name, n)
+	}
+	return err
+}
+
+func (t tarArchiveWriter) Close() error {
+	return t.w.Close()
+}
+
+type zipArchiveWriter struct {
+	w *zip.Writer
+}
+
+func (z zipArchiveWriter) create(name string, ei libkbfs.EntryInfo,
+	method uint16) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:   name,
+		Method: method,
+	}
+	hdr.SetModTime(time.Unix(0, ei.Mtime))
+	hdr.SetMode(fileMode(ei))
+	return z.w.CreateHeader(hdr)
+}
+
+func (z zipArchiveWriter) addDir(name string, ei libkbfs.EntryInfo) error {
+	_, err := z.create(name+"/", ei, zip.Store)
+	return err
+}
+
+func (z zipArchiveWriter) addSymlink(
+	name string, ei libkbfs.EntryInfo) error {
+	// By convention, the contents of a symlink entry are its
+	// target.
+	w, err := z.create(name, ei, zip.Store)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, ei.SymPath)
+	return err
+}
+
+func (z zipArchiveWriter) addFile(
+	name string, ei libkbfs.EntryInfo, r io.Reader) error {
+	w, err := z.create(name, ei, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	// Zip entries don't record their size up front, so the file
+	// may have changed size since it was looked up.
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (z zipArchiveWriter) Close() error {
+	return z.w.Close()
+}
+
+func writeArchiveEntry(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	aw archiveWriter, node libkbfs.Node, name string,
+	ei libkbfs.EntryInfo) error {
+	switch ei.Type {
+	case libkbfs.Sym:
+		return aw.addSymlink(name, ei)
+	case libkbfs.File, libkbfs.Exec:
+		stream, err := kbfsOps.ReadStream(ctx, node, 0)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		return aw.addFile(name, ei, stream)
+	}
+
+	if err := aw.addDir(name, ei); err != nil {
+		return err
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for childName := range children {
+		names = append(names, childName)
+	}
+	sort.Strings(names)
+	for _, childName := range names {
+		// Look the child up for a node, and for entry info
+		// that's as fresh as possible, since a file's size
+		// must be known before its contents are read.
+		childNode, childEI, err := kbfsOps.Lookup(ctx, node, childName)
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			// Removed since the listing.
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = writeArchiveEntry(ctx, kbfsOps, aw, childNode,
+			path.Join(name, childName), childEI)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteArchive streams the directory tree under the given node to w,
+// as an archive in the given format whose entries are all under
+// name.  Files are read with KBFSOps.ReadStream, so nothing is staged
+// on disk and the archive starts coming out as soon as the first
+// blocks are decrypted.  Symlinks are archived as symlinks, and
+// aren't followed.  If node is a file, the archive holds just that
+// file.
+func WriteArchive(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, name string, format ArchiveFormat,
+	w io.Writer) error {
+	ei, err := kbfsOps.Stat(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	var aw archiveWriter
+	switch format {
+	case ArchiveTar:
+		aw = tarArchiveWriter{tar.NewWriter(w)}
+	case ArchiveZip:
+		aw = zipArchiveWriter{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("Unknown archive format %s", format)
+	}
+	if err := writeArchiveEntry(ctx, kbfsOps, aw, node, name, ei); err != nil {
+		return err
+	}
+	return aw.Close()
+}
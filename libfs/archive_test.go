@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestWriteArchiveTar(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "alice")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+	kbfsOps := config.KBFSOps()
+
+	rootNode := libkbfs.GetRootNodeOrBust(t, config, "alice", false)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "run", true)
+	require.NoError(t, err)
+	data := []byte("#!/bin/sh\necho hi\n")
+	require.NoError(t, kbfsOps.Write(ctx, fileNode, data, 0))
+	require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "link", "run")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteArchive(ctx, kbfsOps, dirNode, "d", ArchiveTar, &buf))
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "d/", hdr.Name)
+	require.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+	hdr, err = tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "d/link", hdr.Name)
+	require.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+	require.Equal(t, "run", hdr.Linkname)
+	hdr, err = tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "d/run", hdr.Name)
+	require.Equal(t, int64(0755), hdr.Mode)
+	got, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+}
@@ -38,3 +38,53 @@ const EnableUpdatesFileName = ".kbfs_enable_updates"
 
 // ResetCachesFileName is the name of the KBFS unstaging file.
 const ResetCachesFileName = ".kbfs_reset_caches"
+
+// BandwidthScheduleFileName is the name of the KBFS bandwidth
+// schedule file -- it can be reached from any KBFS directory.
+// Writing a schedule to it, in the form parsed by
+// libkbfs.ParseBandwidthSchedule, replaces the caps on the traffic
+// to and from the servers, on all of the user's devices.
+const BandwidthScheduleFileName = ".kbfs_bandwidth_schedule"
+
+// PinFileName is the name of the KBFS folder-pinning file -- it can
+// be reached anywhere within a top-level folder.  Writing "always",
+// "never" or "auto" to it overrides whether the folder is pinned in
+// the block cache.
+const PinFileName = ".kbfs_pin"
+
+// SyncModeFileName is the name of the KBFS sync-mode file -- it can
+// be reached anywhere within a top-level folder.  Writing "full" to
+// it keeps the whole folder on this device for offline use, and
+// writing "on-demand" goes back to fetching blocks as needed.
+const SyncModeFileName = ".kbfs_sync_mode"
+
+// UnfreezeFileName is the name of the KBFS unfreezing file -- it can
+// be reached anywhere within a top-level folder.  Writing to it lets
+// a folder that was frozen after suspicious activity be written to
+// again, and applies the updates that were held back.
+const UnfreezeFileName = ".kbfs_unfreeze"
+
+// ArchiveFileName is the name of the KBFS archiving file -- it can be
+// reached anywhere within a top-level folder.  Writing "archive" to
+// it permanently makes the folder read-only, for every device.
+const ArchiveFileName = ".kbfs_archive"
+
+// QuotaFileName is the name of the KBFS folder quota file -- it can
+// be reached anywhere within a top-level folder.  Writing a number of
+// bytes to it limits how much the folder may use, for every writer,
+// and writing 0 removes the limit.
+const QuotaFileName = ".kbfs_quota"
+
+// RestoreFileName is the name of the KBFS trash-restoring file -- it
+// can be reached anywhere within a top-level folder.  Writing the
+// path of a removed entry, relative to the folder's .kbfs_trash
+// directory, to it moves the entry back to where it was removed
+// from.
+const RestoreFileName = ".kbfs_restore"
+
+// TrashRetentionFileName is the name of the KBFS trash retention
+// file -- it can be reached anywhere within a top-level folder.
+// Writing a duration, like "720h", to it makes removed entries stay
+// in the folder's .kbfs_trash directory for that long, for every
+// writer, and writing 0 turns the trash off.
+const TrashRetentionFileName = ".kbfs_trash_retention"
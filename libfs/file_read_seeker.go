@@ -0,0 +1,87 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"errors"
+	"io"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FileReadSeeker reads a KBFS file as an io.ReadSeeker, e.g. for
+// http.ServeContent.  Reads come from a KBFSOps.ReadStream, so
+// blocks are fetched ahead of the reader; the stream is only
+// restarted when the reader seeks, e.g. to serve a range request.
+type FileReadSeeker struct {
+	ctx     context.Context
+	kbfsOps libkbfs.KBFSOps
+	node    libkbfs.Node
+	size    int64
+
+	off    int64
+	stream io.ReadCloser
+}
+
+// NewFileReadSeeker returns a FileReadSeeker for the given file,
+// which is size bytes long.  The caller must close it when done.
+func NewFileReadSeeker(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, size int64) *FileReadSeeker {
+	return &FileReadSeeker{
+		ctx:     ctx,
+		kbfsOps: kbfsOps,
+		node:    node,
+		size:    size,
+	}
+}
+
+// Read implements the io.Reader interface for FileReadSeeker.
+func (f *FileReadSeeker) Read(p []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if f.stream == nil {
+		stream, err := f.kbfsOps.ReadStream(f.ctx, f.node, f.off)
+		if err != nil {
+			return 0, err
+		}
+		f.stream = stream
+	}
+	n, err := f.stream.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+// Seek implements the io.Seeker interface for FileReadSeeker.
+func (f *FileReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = f.off + offset
+	case io.SeekEnd:
+		off = f.size + offset
+	default:
+		return f.off, errors.New("Bad whence")
+	}
+	if off < 0 {
+		return f.off, errors.New("Negative offset")
+	}
+	if off != f.off {
+		f.Close()
+		f.off = off
+	}
+	return off, nil
+}
+
+// Close stops any stream being read.
+func (f *FileReadSeeker) Close() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream = nil
+	}
+}
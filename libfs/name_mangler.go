@@ -0,0 +1,163 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// escapeBase is added to an ASCII character to escape it, as
+	// Cygwin does for characters Windows doesn't allow in names.
+	// The result is in the Unicode private use area.
+	escapeBase = 0xf000
+	// escapeLiteral marks that the rune after it is a literal one
+	// from the escape range, rather than an escaped character.
+	escapeLiteral = 0xf0ff
+)
+
+// windowsReservedNames are the device names that Windows doesn't let
+// files have, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// NameMangler maps the names of KBFS entries to names that can be
+// used on platforms whose file systems are more restrictive, like
+// Windows, and back.  Mangled names map back exactly to the original
+// ones, so that entries created through a mangled name have the
+// expected name on other platforms.
+//
+// Characters are escaped by mapping them into the Unicode private
+// use area, starting at U+F000; names that already contain
+// characters from that part of the area have them escaped too.  The
+// zero value doesn't change any names.
+type NameMangler struct {
+	// EscapeReserved escapes names that Windows doesn't allow:
+	// device names like CON or PRN, with or without an extension,
+	// names ending with a dot or a space, and names containing
+	// control characters or any of <>:"\|?*.
+	EscapeReserved bool
+	// DisambiguateCase escapes the upper-case ASCII letters in
+	// names that only differ from another name in the same
+	// directory by case, so that all of them can be told apart on
+	// case-insensitive file systems.  Names that differ only by
+	// the case of non-ASCII letters still collide.
+	DisambiguateCase bool
+}
+
+func (m NameMangler) enabled() bool {
+	return m.EscapeReserved || m.DisambiguateCase
+}
+
+func isEscapeRune(r rune) bool {
+	return r >= escapeBase && r <= escapeLiteral
+}
+
+func isWindowsReservedRune(r rune) bool {
+	if r < 0x20 {
+		return true
+	}
+	return strings.ContainsRune(`<>:"\|?*`, r)
+}
+
+// isWindowsReservedName returns whether the given name, or its part
+// before the first dot, is a Windows device name.
+func isWindowsReservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(name)]
+}
+
+// mangleName mangles a single name.  If escapeUpper is true, it also
+// escapes the upper-case ASCII letters in it.
+func (m NameMangler) mangleName(name string, escapeUpper bool) string {
+	if !m.enabled() {
+		return name
+	}
+	reserved := m.EscapeReserved && isWindowsReservedName(name)
+	var trailing int
+	if m.EscapeReserved {
+		trailing = len(name) - len(strings.TrimRight(name, ". "))
+	}
+	var b []rune
+	for i, r := range name {
+		escape := false
+		switch {
+		case isEscapeRune(r):
+			b = append(b, escapeLiteral, r)
+			continue
+		case reserved && i == 0:
+			escape = true
+		case m.EscapeReserved && isWindowsReservedRune(r):
+			escape = true
+		case i >= len(name)-trailing:
+			escape = true
+		case escapeUpper && r >= 'A' && r <= 'Z':
+			escape = true
+		}
+		if escape {
+			r += escapeBase
+		}
+		b = append(b, r)
+	}
+	return string(b)
+}
+
+// MangleName returns the mangled version of the name of an entry,
+// ignoring any other entries in its directory.
+func (m NameMangler) MangleName(name string) string {
+	return m.mangleName(name, false)
+}
+
+// MangleNames returns the mangled versions of the given names of all
+// the entries in a directory, keyed by the original names.
+func (m NameMangler) MangleNames(names []string) map[string]string {
+	var folds map[string]int
+	if m.DisambiguateCase {
+		folds = make(map[string]int, len(names))
+		for _, name := range names {
+			folds[strings.ToLower(name)]++
+		}
+	}
+	mangled := make(map[string]string, len(names))
+	for _, name := range names {
+		mangled[name] = m.mangleName(
+			name, folds[strings.ToLower(name)] > 1)
+	}
+	return mangled
+}
+
+// UnmangleName returns the original name for a mangled one.  Names
+// that weren't mangled are returned as they are.
+func (m NameMangler) UnmangleName(name string) string {
+	if !m.enabled() {
+		return name
+	}
+	if strings.IndexFunc(name, isEscapeRune) < 0 {
+		return name
+	}
+	var b []rune
+	literal := false
+	for _, r := range name {
+		switch {
+		case literal:
+			literal = false
+		case r == escapeLiteral:
+			literal = true
+			continue
+		case r >= escapeBase && r < escapeBase+utf8.RuneSelf:
+			r -= escapeBase
+		}
+		b = append(b, r)
+	}
+	return string(b)
+}
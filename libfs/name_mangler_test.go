@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameManglerEscapeReserved(t *testing.T) {
+	m := NameMangler{EscapeReserved: true}
+	for name, expected := range map[string]string{
+		"file.txt":   "file.txt",
+		"CON":        "\uf043ON",
+		"con.tar.gz": "\uf063on.tar.gz",
+		"console":    "console",
+		"LPT1":       "\uf04cPT1",
+		"a:b":        "a\uf03ab",
+		`x\y*?`:      "x\uf05cy\uf02a\uf03f",
+		"dots..":     "dots\uf02e\uf02e",
+		"space ":     "space\uf020",
+		".hidden":    ".hidden",
+		"\uf041":     "\uf0ff\uf041",
+	} {
+		mangled := m.MangleName(name)
+		require.Equal(t, expected, mangled, name)
+		require.Equal(t, name, m.UnmangleName(mangled), name)
+	}
+}
+
+func TestNameManglerDisambiguateCase(t *testing.T) {
+	m := NameMangler{DisambiguateCase: true}
+	names := []string{"foo", "Foo", "FOO", "bar", "Baz"}
+	mangled := m.MangleNames(names)
+	require.Equal(t, map[string]string{
+		"foo": "foo",
+		"Foo": "\uf046oo",
+		"FOO": "\uf046\uf04f\uf04f",
+		"bar": "bar",
+		"Baz": "Baz",
+	}, mangled)
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		folded := strings.ToLower(mangled[name])
+		require.False(t, seen[folded], "%s collides", mangled[name])
+		seen[folded] = true
+		require.Equal(t, name, m.UnmangleName(mangled[name]))
+	}
+}
+
+func TestNameManglerDisabled(t *testing.T) {
+	var m NameMangler
+	for _, name := range []string{"CON", "a:b", "\uf041"} {
+		require.Equal(t, name, m.MangleName(name))
+		require.Equal(t, name, m.UnmangleName(name))
+	}
+}
@@ -40,6 +40,13 @@ func FilterTLFEarlyExitError(ctx context.Context, err error, log logger.Logger,
 			name)
 		return true, nil
 
+	case libkbfs.ReadOnlyBranchError:
+		// Read-only replicas can't create TLFs either.
+		log.CDebugf(ctx,
+			"Can't write to %s on this device, so pretending it's empty",
+			name)
+		return true, nil
+
 	default:
 		// Some other error.
 		return true, err
@@ -7,8 +7,8 @@ package libfuse
 import (
 	"os"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"golang.org/x/net/context"
 )
 
@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// archiveFileConfirmation is what has to be written to an
+// ArchiveFile, so that the folder can't be archived by accident.
+const archiveFileConfirmation = "archive"
+
+// ArchiveFile represents a write-only file where writing "archive"
+// permanently makes the folder read-only.
+type ArchiveFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*ArchiveFile)(nil)
+
+// Attr implements the fs.Node interface for ArchiveFile.
+func (f *ArchiveFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*ArchiveFile)(nil)
+
+var _ fs.HandleWriter = (*ArchiveFile)(nil)
+
+// Write implements the fs.HandleWriter interface for ArchiveFile.
+func (f *ArchiveFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "ArchiveFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	if strings.TrimSpace(string(req.Data)) != archiveFileConfirmation {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	err = f.folder.fs.config.KBFSOps().
+		ArchiveFolder(ctx, f.folder.getFolderBranch())
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthScheduleFile represents a write-only file where writing a
+// schedule, like "09:00-17:00 up=1m down=1m", replaces the caps on
+// the traffic to and from the servers.  Writing an empty line
+// removes them.  It can be reached from any directory under the FUSE
+// mountpoint.
+type BandwidthScheduleFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*BandwidthScheduleFile)(nil)
+
+// Attr implements the fs.Node interface for BandwidthScheduleFile.
+func (f *BandwidthScheduleFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*BandwidthScheduleFile)(nil)
+
+var _ fs.HandleWriter = (*BandwidthScheduleFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// BandwidthScheduleFile.
+func (f *BandwidthScheduleFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "BandwidthScheduleFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	schedule, err := libkbfs.ParseBandwidthSchedule(string(req.Data))
+	if err != nil {
+		return err
+	}
+	err = f.fs.config.KBFSOps().SetBandwidthSchedule(ctx, schedule)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ChangeFeedFileName is the name of the file holding the URL from
+// which applications can stream the changes to a top-level folder --
+// it can be reached anywhere within a top-level folder, when KBFS is
+// serving a change feed.
+const ChangeFeedFileName = ".kbfs_change_feed"
+
+// NewChangeFeedFile returns a special read file that contains the
+// URL of the given change feed for the current TLF.  The mount is
+// only accessible to the user, which keeps the secret in the URL safe.
+func NewChangeFeedFile(folder *Folder, feed libkbfs.ChangeFeed,
+	resp *fuse.LookupResponse) *SpecialReadFile {
+	resp.EntryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			url := feed.SubscribeURL(folder.getFolderBranch().Tlf)
+			return []byte(url + "\n"), time.Time{}, nil
+		},
+	}
+}
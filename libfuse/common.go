@@ -7,7 +7,7 @@ package libfuse
 import (
 	"time"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 	"github.com/keybase/kbfs/libkbfs"
 )
 
@@ -35,10 +35,13 @@ const (
 
 // fillAttr sets attributes based on the entry info. It only handles fields
 // common to all entryinfo types.
-func fillAttr(ei *libkbfs.EntryInfo, a *fuse.Attr) {
-	a.Valid = 1 * time.Minute
+func (f *FS) fillAttr(ei *libkbfs.EntryInfo, a *fuse.Attr) {
+	a.Valid = f.mountOptions.AttrTimeout
 
 	a.Size = ei.Size
 	a.Mtime = time.Unix(0, ei.Mtime)
 	a.Ctime = time.Unix(0, ei.Ctime)
+	if f.mountOptions.NoAtime {
+		a.Atime = a.Mtime
+	}
 }
@@ -12,8 +12,8 @@ import (
 	"syscall"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
@@ -42,6 +42,14 @@ type Folder struct {
 	// Children must call folder.forgetChildLocked on receiving the
 	// FUSE Forget request.
 	nodes map[libkbfs.NodeID]fs.Node
+	// staleData counts, for each file in nodes, the notifications
+	// queued to make the kernel drop the file's cached data, after
+	// a new MD revision or a change made outside this mount, that
+	// haven't been sent yet.  A failed notification is never
+	// counted off, so the file isn't opened with the kernel's cache
+	// kept again until the kernel forgets it.  Protected by
+	// nodesMu.
+	staleData map[libkbfs.NodeID]int
 
 	// Protects the updateChan.
 	updateMu sync.Mutex
@@ -57,6 +65,8 @@ func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
 		list:  fl,
 		h:     h,
 		nodes: map[libkbfs.NodeID]fs.Node{},
+
+		staleData: map[libkbfs.NodeID]int{},
 	}
 	return f
 }
@@ -125,6 +135,7 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 	defer f.nodesMu.Unlock()
 
 	delete(f.nodes, node.GetID())
+	delete(f.staleData, node.GetID())
 	if len(f.nodes) == 0 {
 		ctx := context.Background()
 		f.unsetFolderBranch(ctx)
@@ -132,6 +143,48 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 	}
 }
 
+// markDataStale notes that a notification to drop the kernel's
+// cached data for node is about to be queued, and returns false if
+// the kernel doesn't know about the node, and so has nothing cached.
+func (f *Folder) markDataStale(node libkbfs.Node) bool {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	if _, ok := f.nodes[node.GetID()]; !ok {
+		return false
+	}
+	f.staleData[node.GetID()]++
+	return true
+}
+
+// dataInvalidated notes that a notification counted by markDataStale
+// has been sent.
+func (f *Folder) dataInvalidated(node libkbfs.Node) {
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	if n := f.staleData[node.GetID()]; n > 1 {
+		f.staleData[node.GetID()] = n - 1
+	} else {
+		delete(f.staleData, node.GetID())
+	}
+}
+
+// canKeepDataCache returns whether the kernel can keep the pages it
+// has cached for the given file when the file is opened, rather than
+// reading it all from KBFS again.  That's only safe if every change
+// to the file since the kernel cached its data has invalidated it.
+func (f *Folder) canKeepDataCache(node libkbfs.Node) bool {
+	if !f.fs.mountOptions.KeepCache {
+		return false
+	} else if f.fs.isSnapshot() {
+		return true
+	} else if !f.fs.conn.Protocol().HasInvalidate() {
+		return false
+	}
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	return f.staleData[node.GetID()] == 0
+}
+
 var _ libkbfs.Observer = (*Folder)(nil)
 
 // invalidateNodeDataRange notifies the kernel to invalidate cached data for node.
@@ -175,13 +228,17 @@ func (f *Folder) LocalChange(ctx context.Context, node libkbfs.Node, write libkb
 		return
 	}
 
+	stale := f.markDataStale(node)
+
 	// Handle in the background because we shouldn't lock during the
 	// notification.
-	f.fs.queueNotification(func() { f.localChangeInvalidate(ctx, node, write) })
+	f.fs.queueNotification(func() {
+		f.localChangeInvalidate(ctx, node, write, stale)
+	})
 }
 
 func (f *Folder) localChangeInvalidate(ctx context.Context, node libkbfs.Node,
-	write libkbfs.WriteRange) {
+	write libkbfs.WriteRange, stale bool) {
 	f.nodesMu.Lock()
 	n, ok := f.nodes[node.GetID()]
 	f.nodesMu.Unlock()
@@ -192,6 +249,8 @@ func (f *Folder) localChangeInvalidate(ctx context.Context, node libkbfs.Node,
 	if err := f.invalidateNodeDataRange(n, write); err != nil && err != fuse.ErrNotCached {
 		// TODO we have no mechanism to do anything about this
 		f.fs.log.CErrorf(ctx, "FUSE invalidate error: %v", err)
+	} else if stale {
+		f.dataInvalidated(node)
 	}
 }
 
@@ -208,15 +267,29 @@ func (f *Folder) BatchChanges(ctx context.Context, changes []libkbfs.NodeChange)
 	if v := ctx.Value(libkbfs.CtxBackgroundSyncKey); v != nil {
 		return
 	}
+	if f.fs.isSnapshot() {
+		// Snapshots never change, so never make the kernel drop
+		// what it has cached.
+		return
+	}
+
+	stale := make([]bool, len(changes))
+	for i, v := range changes {
+		if len(v.DirUpdated) == 0 && len(v.FileUpdated) > 0 {
+			stale[i] = f.markDataStale(v.Node)
+		}
+	}
 
 	// Handle in the background because we shouldn't lock during the
 	// notification.
-	f.fs.queueNotification(func() { f.batchChangesInvalidate(ctx, changes) })
+	f.fs.queueNotification(func() {
+		f.batchChangesInvalidate(ctx, changes, stale)
+	})
 }
 
 func (f *Folder) batchChangesInvalidate(ctx context.Context,
-	changes []libkbfs.NodeChange) {
-	for _, v := range changes {
+	changes []libkbfs.NodeChange, stale []bool) {
+	for i, v := range changes {
 		f.nodesMu.Lock()
 		n, ok := f.nodes[v.Node.GetID()]
 		f.nodesMu.Unlock()
@@ -240,12 +313,17 @@ func (f *Folder) batchChangesInvalidate(ctx context.Context,
 			}
 
 		case len(v.FileUpdated) > 0:
+			invalidated := true
 			for _, write := range v.FileUpdated {
 				if err := f.invalidateNodeDataRange(n, write); err != nil && err != fuse.ErrNotCached {
 					// TODO we have no mechanism to do anything about this
 					f.fs.log.CErrorf(ctx, "FUSE invalidate error: %v", err)
+					invalidated = false
 				}
 			}
+			if invalidated && stale[i] {
+				f.dataInvalidated(v.Node)
+			}
 
 		default:
 			// just the attributes
@@ -333,7 +411,7 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		}
 		return err
 	}
-	fillAttr(&de, a)
+	d.folder.fs.fillAttr(&de, a)
 
 	a.Mode = os.ModeDir | 0700
 	if d.folder.list.public {
@@ -347,6 +425,13 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	d.folder.fs.log.CDebugf(ctx, "Dir Lookup %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
 
+	resp.EntryValid = d.folder.fs.mountOptions.EntryTimeout
+	if d.folder.fs.isSnapshot() {
+		// Snapshots hold only the folder's own entries, since the
+		// special files change or act on the folder.
+		return d.lookupEntry(ctx, req.Name)
+	}
+
 	specialNode := handleSpecialFile(req.Name, d.folder.fs, resp)
 	if specialNode != nil {
 		return specialNode, nil
@@ -360,6 +445,17 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	case UpdateHistoryFileName:
 		return NewUpdateHistoryFile(d.folder, resp), nil
 
+	case KeyHistoryFileName:
+		return NewKeyHistoryFile(d.folder, resp), nil
+
+	case MDChainFileName:
+		return NewMDChainFile(d.folder, resp), nil
+
+	case ChangeFeedFileName:
+		if feed := d.folder.fs.config.ChangeFeed(); feed != nil {
+			return NewChangeFeedFile(d.folder, feed, resp), nil
+		}
+
 	case libfs.UnstageFileName:
 		resp.EntryValid = 0
 		child := &UnstageFile{
@@ -367,6 +463,41 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		}
 		return child, nil
 
+	case libfs.UnfreezeFileName:
+		resp.EntryValid = 0
+		child := &UnfreezeFile{
+			folder: d.folder,
+		}
+		return child, nil
+
+	case libfs.ArchiveFileName:
+		resp.EntryValid = 0
+		child := &ArchiveFile{
+			folder: d.folder,
+		}
+		return child, nil
+
+	case libfs.QuotaFileName:
+		resp.EntryValid = 0
+		child := &QuotaFile{
+			folder: d.folder,
+		}
+		return child, nil
+
+	case libfs.RestoreFileName:
+		resp.EntryValid = 0
+		child := &RestoreFile{
+			folder: d.folder,
+		}
+		return child, nil
+
+	case libfs.TrashRetentionFileName:
+		resp.EntryValid = 0
+		child := &TrashRetentionFile{
+			folder: d.folder,
+		}
+		return child, nil
+
 	case libfs.DisableUpdatesFileName:
 		resp.EntryValid = 0
 		child := &UpdatesFile{
@@ -389,6 +520,20 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		}
 		return child, nil
 
+	case libfs.PinFileName:
+		resp.EntryValid = 0
+		child := &PinFile{
+			folder: d.folder,
+		}
+		return child, nil
+
+	case libfs.SyncModeFileName:
+		resp.EntryValid = 0
+		child := &SyncModeFile{
+			folder: d.folder,
+		}
+		return child, nil
+
 	case libfs.ReclaimQuotaFileName:
 		resp.EntryValid = 0
 		child := &ReclaimQuotaFile{
@@ -404,7 +549,12 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return child, nil
 	}
 
-	newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, req.Name)
+	return d.lookupEntry(ctx, req.Name)
+}
+
+// lookupEntry returns the node for the entry with the given name.
+func (d *Dir) lookupEntry(ctx context.Context, name string) (fs.Node, error) {
+	newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, name)
 	if err != nil {
 		if _, ok := err.(libkbfs.NoSuchNameError); ok {
 			return nil, fuse.ENOENT
@@ -445,7 +595,7 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	case libkbfs.Sym:
 		child := &Symlink{
 			parent: d,
-			name:   req.Name,
+			name:   name,
 		}
 		// a Symlink is never included in Folder.nodes, as it doesn't
 		// have a libkbfs.Node to keep track of renames.
@@ -465,6 +615,7 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		return nil, nil, err
 	}
 
+	resp.EntryValid = d.folder.fs.mountOptions.EntryTimeout
 	child := &File{
 		folder: d.folder,
 		node:   newNode,
@@ -513,6 +664,28 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return child, nil
 }
 
+// Link implements the fs.NodeLinker interface for Dir.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (
+	node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Link %s", req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	file, ok := old.(*File)
+	if !ok {
+		// Only files can have more than one name.
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	if d.folder != file.folder {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+
+	if err := d.folder.fs.config.KBFSOps().CreateHardLink(
+		ctx, d.node, req.NewName, file.node); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 // Rename implements the fs.NodeRenamer interface for Dir.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) (err error) {
@@ -671,6 +844,50 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Getxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return getxattr(ctx, d.folder, d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Listxattr")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return listxattr(ctx, d.folder, d.node, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Setxattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return setxattr(ctx, d.folder, d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Removexattr %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return removexattr(ctx, d.folder, d.node, req)
+}
+
 // TLF represents the root directory of a TLF. It wraps a lazy-loaded
 // Dir.
 type TLF struct {
@@ -841,6 +1058,16 @@ func (tlf *TLF) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return dir.Symlink(ctx, req)
 }
 
+// Link implements the fs.NodeLinker interface for TLF.
+func (tlf *TLF) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (fs.Node, error) {
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dir.Link(ctx, req, old)
+}
+
 // Rename implements the fs.NodeRenamer interface for TLF.
 func (tlf *TLF) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) error {
@@ -5,7 +5,7 @@
 package libfuse
 
 import (
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 	"github.com/keybase/kbfs/libfs"
 )
 
@@ -5,8 +5,10 @@
 package libfuse
 
 import (
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"syscall"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -15,6 +17,7 @@ import (
 type File struct {
 	folder *Folder
 	node   libkbfs.Node
+	locks  lockOwners
 }
 
 var _ fs.Node = (*File)(nil)
@@ -36,7 +39,7 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	fillAttr(&de, a)
+	f.folder.fs.fillAttr(&de, a)
 	a.Mode = 0644
 	if de.Type == libkbfs.Exec {
 		a.Mode |= 0111
@@ -62,6 +65,18 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 	return f.sync(ctx)
 }
 
+var _ fs.NodeOpener = (*File)(nil)
+
+// Open implements the fs.NodeOpener interface for File.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+	f.folder.fs.log.CDebugf(ctx, "File Open")
+	if f.folder.canKeepDataCache(f.node) {
+		resp.Flags |= fuse.OpenKeepCache
+	}
+	return f, nil
+}
+
 var _ fs.Handle = (*File)(nil)
 
 var _ fs.HandleReader = (*File)(nil)
@@ -81,6 +96,54 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest,
 	return nil
 }
 
+var _ fs.HandleLseeker = (*File)(nil)
+
+// Lseek implements the fs.HandleLseeker interface for File, to
+// support SEEK_DATA and SEEK_HOLE.
+func (f *File) Lseek(ctx context.Context, req *fuse.LseekRequest,
+	resp *fuse.LseekResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Lseek off=%d whence=%d",
+		req.Offset, req.Whence)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	var hole bool
+	switch req.Whence {
+	case fuse.SeekData:
+	case fuse.SeekHole:
+		hole = true
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	off, err := f.folder.fs.config.KBFSOps().SeekHoleOrData(
+		ctx, f.node, req.Offset, hole)
+	if err != nil {
+		return err
+	}
+	resp.Offset = off
+	return nil
+}
+
+var _ fs.HandleFallocater = (*File)(nil)
+
+// Fallocate implements the fs.HandleFallocater interface for File.
+// KBFS doesn't preallocate space, so only punching holes is
+// supported.
+func (f *File) Fallocate(ctx context.Context,
+	req *fuse.FallocateRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Fallocate off=%d len=%d mode=%#x",
+		req.Offset, req.Length, req.Mode)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if req.Mode != fuse.FallocatePunchHole|fuse.FallocateKeepSize {
+		return fuse.Errno(syscall.EOPNOTSUPP)
+	}
+	if req.Offset < 0 || req.Length <= 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return f.folder.fs.config.KBFSOps().PunchHole(
+		ctx, f.node, req.Offset, req.Length)
+}
+
 var _ fs.HandleWriter = (*File)(nil)
 
 // Write implements the fs.HandleWriter interface for File.
@@ -105,7 +168,49 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
 	// I'm not sure about the guarantees from KBFSOps, so we don't
 	// differentiate between Flush and Fsync.
 	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
-	return f.sync(ctx)
+	err = f.sync(ctx)
+	if err != nil {
+		return err
+	}
+	// Closing any descriptor of a file releases the POSIX locks its
+	// owner holds on it.
+	return releaseLocks(ctx, f.folder, f.node, &f.locks, req.LockOwner, false)
+}
+
+var _ fs.HandleReleaser = (*File)(nil)
+
+// Release implements the fs.HandleReleaser interface for File.
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) (
+	err error) {
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock == 0 {
+		return nil
+	}
+	f.folder.fs.log.CDebugf(ctx, "File Release")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+	return releaseLocks(ctx, f.folder, f.node, &f.locks, req.LockOwner, true)
+}
+
+var _ fs.HandleGetlker = (*File)(nil)
+
+// Getlk implements the fs.HandleGetlker interface for File.
+func (f *File) Getlk(ctx context.Context, req *fuse.GetlkRequest,
+	resp *fuse.GetlkResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getlk %v", req.Lock)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return getlk(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.HandleSetlker = (*File)(nil)
+
+// Setlk implements the fs.HandleSetlker interface for File.
+func (f *File) Setlk(ctx context.Context, req *fuse.SetlkRequest) (
+	err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setlk %v wait=%t", req.Lock,
+		req.Wait)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return setlk(ctx, f.folder, f.node, &f.locks, req)
 }
 
 var _ fs.NodeSetattrer = (*File)(nil)
@@ -186,6 +291,60 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Getxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	if ok, err := f.finderGetxattr(ctx, req, resp); ok || err != nil {
+		return err
+	}
+	return getxattr(ctx, f.folder, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Listxattr")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	if err := f.finderListxattr(ctx, resp); err != nil {
+		return err
+	}
+	return listxattr(ctx, f.folder, f.node, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(ctx context.Context,
+	req *fuse.SetxattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Setxattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if f.folder.fs.mountOptions.FinderProgress &&
+		req.Name == finderInfoXattr {
+		req.Xattr = finderInfoWithoutBusy(req.Xattr)
+	}
+	return setxattr(ctx, f.folder, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(ctx context.Context,
+	req *fuse.RemovexattrRequest) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "File Removexattr %s", req.Name)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return removexattr(ctx, f.folder, f.node, req)
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
@@ -0,0 +1,137 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strconv"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// finderProgressXattr is the extended attribute that Finder
+	// reads to draw a progress bar over a file's icon, as it does
+	// for downloads in progress.  Its value is the fraction of the
+	// file that's done, as a decimal string.
+	finderProgressXattr = "com.apple.progress.fractionCompleted"
+	// finderInfoXattr holds a file's classic Finder info, which
+	// starts with its four-character type and creator codes.
+	finderInfoXattr = "com.apple.FinderInfo"
+	finderInfoSize  = 32
+)
+
+// finderBusyCodes are the type and creator codes that Finder gives
+// files it's still copying, which it shows as busy until they're
+// done.
+var finderBusyCodes = [8]byte{'b', 'r', 'o', 'k', 'M', 'A', 'C', 'S'}
+
+// syncedFraction returns the fraction of a file of the given size
+// that's on the servers, given how many of its bytes aren't yet.
+// It's always less than 1, since the file isn't fully synced yet,
+// even if only its metadata is left.
+func syncedFraction(size uint64, unsyncedBytes int64) float64 {
+	const max = 0.99
+	if size == 0 {
+		return 0
+	}
+	fraction := 1 - float64(unsyncedBytes)/float64(size)
+	switch {
+	case fraction < 0:
+		return 0
+	case fraction > max:
+		return max
+	}
+	return fraction
+}
+
+// finderInfoWithBusy returns a copy of info, which may be empty,
+// marked as busy.
+func finderInfoWithBusy(info []byte) []byte {
+	busy := make([]byte, finderInfoSize)
+	copy(busy, info)
+	copy(busy, finderBusyCodes[:])
+	return busy
+}
+
+// finderInfoWithoutBusy returns info without the busy marking that
+// finderInfoWithBusy adds, so that Finder can't store it for good by
+// writing back the Finder info it read from a busy file.
+func finderInfoWithoutBusy(info []byte) []byte {
+	if len(info) < len(finderBusyCodes) ||
+		string(info[:len(finderBusyCodes)]) != string(finderBusyCodes[:]) {
+		return info
+	}
+	cleared := make([]byte, len(info))
+	copy(cleared[len(finderBusyCodes):], info[len(finderBusyCodes):])
+	return cleared
+}
+
+// finderUnsyncedChange returns the unsynced changes to f, if Finder
+// should show their progress, or nil.
+func (f *File) finderUnsyncedChange(
+	ctx context.Context) (*libkbfs.UnsyncedChange, error) {
+	if !f.folder.fs.mountOptions.FinderProgress {
+		return nil, nil
+	}
+	return f.folder.fs.config.KBFSOps().GetUnsyncedChange(ctx, f.node)
+}
+
+// finderGetxattr fills in resp with the value Finder should see for
+// the attribute requested by req while f still has unsynced changes,
+// and returns whether it did.
+func (f *File) finderGetxattr(ctx context.Context,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (
+	bool, error) {
+	if req.Name != finderProgressXattr && req.Name != finderInfoXattr {
+		return false, nil
+	}
+	change, err := f.finderUnsyncedChange(ctx)
+	if err != nil || change == nil {
+		return false, err
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	if req.Name == finderProgressXattr {
+		de, err := kbfsOps.Stat(ctx, f.node)
+		if err != nil {
+			return true, err
+		}
+		resp.Xattr = []byte(strconv.FormatFloat(
+			syncedFraction(de.Size, change.Bytes), 'f', 2, 64))
+		return true, nil
+	}
+	info, err := kbfsOps.GetXattr(ctx, f.node, finderInfoXattr)
+	if _, ok := err.(libkbfs.NoSuchXattrError); ok {
+		info = nil
+	} else if err != nil {
+		return true, err
+	}
+	resp.Xattr = finderInfoWithBusy(info)
+	return true, nil
+}
+
+// finderListxattr adds the names of the attributes that Finder
+// should see while f still has unsynced changes to resp.
+func (f *File) finderListxattr(ctx context.Context,
+	resp *fuse.ListxattrResponse) error {
+	change, err := f.finderUnsyncedChange(ctx)
+	if err != nil || change == nil {
+		return err
+	}
+	names, err := f.folder.fs.config.KBFSOps().ListXattr(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	resp.Append(finderProgressXattr)
+	for _, name := range names {
+		if name == finderInfoXattr {
+			return nil
+		}
+	}
+	resp.Append(finderInfoXattr)
+	return nil
+}
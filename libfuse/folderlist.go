@@ -10,8 +10,8 @@ import (
 	"sync"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -105,6 +105,7 @@ func (fl *FolderList) Lookup(ctx context.Context, req *fuse.LookupRequest, resp
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
 
+	resp.EntryValid = fl.fs.mountOptions.EntryTimeout
 	specialNode := handleSpecialFile(req.Name, fl.fs, resp)
 	if specialNode != nil {
 		return specialNode, nil
@@ -10,9 +10,9 @@ import (
 	"strings"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
@@ -31,13 +31,22 @@ type FS struct {
 	// remoteStatus is the current status of remote connections.
 	remoteStatus libfs.RemoteStatus
 
+	// mountOptions tune the kernel's caching of attributes and
+	// lookups.
+	mountOptions MountOptions
+
+	// snapshot, if non-nil, is the frozen folder served as the
+	// root; see MountOptions.Snapshot.
+	snapshot *TLF
+
 	// this is like time.AfterFunc, except that in some tests this can be
 	// overridden to execute f without any delay.
 	execAfterDelay func(d time.Duration, f func())
 }
 
 // NewFS creates an FS
-func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool) *FS {
+func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool,
+	mountOptions MountOptions) *FS {
 	log := config.MakeLogger("kbfsfuse")
 	// We need extra depth for errors, so that we can report the line
 	// number for the caller of reportErr, not reportErr itself.
@@ -54,6 +63,7 @@ func NewFS(config libkbfs.Config, conn *fuse.Conn, debug bool) *FS {
 		log:           log,
 		errLog:        errLog,
 		notifications: libfs.NewFSNotifications(log),
+		mountOptions:  mountOptions,
 	}
 	fs.execAfterDelay = func(d time.Duration, f func()) {
 		time.AfterFunc(d, f)
@@ -152,6 +162,9 @@ func (f *FS) reportErr(ctx context.Context,
 
 // Root implements the fs.FS interface for FS.
 func (f *FS) Root() (fs.Node, error) {
+	if f.snapshot != nil {
+		return f.snapshot, nil
+	}
 	n := &Root{
 		private: &FolderList{
 			fs:      f,
@@ -204,6 +217,7 @@ func (r *Root) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.L
 	r.private.fs.log.CDebugf(ctx, "FS Lookup %s", req.Name)
 	defer func() { r.private.fs.reportErr(ctx, libkbfs.ReadMode, err) }()
 
+	resp.EntryValid = r.private.fs.mountOptions.EntryTimeout
 	specialNode := handleSpecialFile(req.Name, r.private.fs, resp)
 	if specialNode != nil {
 		return specialNode, nil
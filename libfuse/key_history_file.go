@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/kbfs/fuse"
+	"golang.org/x/net/context"
+)
+
+// KeyHistoryFileName is the name of the KBFS key history -- it
+// can be reached anywhere within a top-level folder.
+const KeyHistoryFileName = ".kbfs_key_history"
+
+func getEncodedKeyHistory(ctx context.Context, folder *Folder) (
+	data []byte, t time.Time, err error) {
+	history, err := folder.fs.config.KeyManager().GetTLFCryptKeyHistory(
+		ctx, folder.getFolderBranch().Tlf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = json.Marshal(history)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data = append(data, '\n')
+	return data, time.Time{}, err
+}
+
+// NewKeyHistoryFile returns a special read file that contains a text
+// representation of the key history of the current TLF.
+func NewKeyHistoryFile(folder *Folder,
+	resp *fuse.LookupResponse) *SpecialReadFile {
+	resp.EntryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return getEncodedKeyHistory(ctx, folder)
+		},
+	}
+}
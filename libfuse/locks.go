@@ -0,0 +1,149 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"math"
+	"sync"
+	"syscall"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// lockOwners keeps track of the owners that hold locks on a file,
+// so that their locks can be released when they close it, as POSIX
+// requires.
+type lockOwners struct {
+	lock  sync.Mutex
+	posix map[uint64]bool
+	flock map[uint64]bool
+}
+
+func (lo *lockOwners) add(owner uint64, flock bool) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	if flock {
+		if lo.flock == nil {
+			lo.flock = make(map[uint64]bool)
+		}
+		lo.flock[owner] = true
+	} else {
+		if lo.posix == nil {
+			lo.posix = make(map[uint64]bool)
+		}
+		lo.posix[owner] = true
+	}
+}
+
+// remove returns true if the given owner held any locks.
+func (lo *lockOwners) remove(owner uint64, flock bool) bool {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	owners := lo.posix
+	if flock {
+		owners = lo.flock
+	}
+	if !owners[owner] {
+		return false
+	}
+	delete(owners, owner)
+	return true
+}
+
+func lockFromFuse(lock fuse.Lock, owner uint64, flags fuse.LockFlags) (
+	libkbfs.FileLock, error) {
+	var t libkbfs.FileLockType
+	switch lock.Type {
+	case fuse.LockRead:
+		t = libkbfs.FileLockRead
+	case fuse.LockWrite:
+		t = libkbfs.FileLockWrite
+	case fuse.LockUnlock:
+		t = libkbfs.FileLockUnlock
+	default:
+		return libkbfs.FileLock{}, fuse.Errno(syscall.EINVAL)
+	}
+	return libkbfs.FileLock{
+		Type:  t,
+		Start: lock.Start,
+		End:   lock.End,
+		Flock: flags&fuse.LockFlock != 0,
+		Owner: owner,
+		PID:   lock.PID,
+	}, nil
+}
+
+// getlk fills in resp with a lock that conflicts with the requested
+// one, if there is any.
+func getlk(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetlkRequest, resp *fuse.GetlkResponse) error {
+	lock, err := lockFromFuse(req.Lock, req.LockOwner, req.Flags)
+	if err != nil {
+		return err
+	}
+	held, conflict, err := folder.fs.config.KBFSOps().GetFileLock(
+		ctx, node, lock)
+	if err != nil {
+		return err
+	}
+	if !conflict {
+		resp.Lock = req.Lock
+		resp.Lock.Type = fuse.LockUnlock
+		return nil
+	}
+	resp.Lock = fuse.Lock{
+		Start: held.Start,
+		End:   held.End,
+		Type:  fuse.LockRead,
+		PID:   held.PID,
+	}
+	if held.Type == libkbfs.FileLockWrite {
+		resp.Lock.Type = fuse.LockWrite
+	}
+	return nil
+}
+
+// setlk takes, changes or releases the requested lock, and records
+// its owner in owners.
+func setlk(ctx context.Context, folder *Folder, node libkbfs.Node,
+	owners *lockOwners, req *fuse.SetlkRequest) error {
+	lock, err := lockFromFuse(req.Lock, req.LockOwner, req.Flags)
+	if err != nil {
+		return err
+	}
+	err = folder.fs.config.KBFSOps().SetFileLock(ctx, node, lock, req.Wait)
+	if err == context.Canceled {
+		return fuse.EINTR
+	} else if err != nil {
+		return err
+	}
+	if lock.Type != libkbfs.FileLockUnlock {
+		owners.add(req.LockOwner, lock.Flock)
+	} else if lock.Flock {
+		// flock(2) locks always cover the whole file, so there's
+		// nothing left to release on close.
+		owners.remove(req.LockOwner, true)
+	}
+	return nil
+}
+
+// releaseLocks releases all the locks of the given kind that owner
+// holds on node, if it holds any.
+func releaseLocks(ctx context.Context, folder *Folder, node libkbfs.Node,
+	owners *lockOwners, owner uint64, flock bool) error {
+	if !owners.remove(owner, flock) {
+		return nil
+	}
+	return folder.fs.config.KBFSOps().SetFileLock(ctx, node,
+		libkbfs.FileLock{
+			Type:  libkbfs.FileLockUnlock,
+			Start: 0,
+			End:   math.MaxUint64,
+			Flock: flock,
+			Owner: owner,
+		}, false)
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/kbfs/fuse"
+	"golang.org/x/net/context"
+)
+
+// MDChainFileName is the name of the KBFS MD chain export -- it can
+// be reached anywhere within a top-level folder.
+const MDChainFileName = ".kbfs_md_chain"
+
+func getEncodedMDChain(ctx context.Context, folder *Folder) (
+	data []byte, t time.Time, err error) {
+	chain, err := folder.fs.config.KBFSOps().ExportMDChain(
+		ctx, folder.getFolderBranch())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = json.Marshal(chain)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data = append(data, '\n')
+	return data, time.Time{}, err
+}
+
+// NewMDChainFile returns a special read file that contains the MD
+// chain of the current TLF, for checking with kbfsmdverify.
+func NewMDChainFile(folder *Folder,
+	resp *fuse.LookupResponse) *SpecialReadFile {
+	resp.EntryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return getEncodedMDChain(ctx, folder)
+		},
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fuse"
+)
+
+const (
+	// attrTimeoutDefault is how long the kernel caches attributes
+	// by default.
+	attrTimeoutDefault = 1 * time.Minute
+	// entryTimeoutDefault is how long the kernel caches lookups by
+	// default.
+	entryTimeoutDefault = 1 * time.Minute
+	// finderProgressDefault is whether Finder is shown the sync
+	// progress of files by default.
+	finderProgressDefault = runtime.GOOS == "darwin"
+	// keepCacheDefault is whether the kernel keeps the data it has
+	// cached for a file when it's opened again by default.
+	keepCacheDefault = true
+)
+
+// MountOptions tune how the kernel caches and reads from a KBFS
+// mount.  They apply on every platform, unlike PlatformParams.
+type MountOptions struct {
+	// AllowOther lets users other than the one running KBFS access
+	// the mount.  On Linux, /etc/fuse.conf must have
+	// user_allow_other for this to work.
+	AllowOther bool
+	// MaxReadahead, if non-zero, caps how many bytes the kernel
+	// reads ahead of sequential reads.
+	MaxReadahead uint32
+	// AttrTimeout is how long the kernel may cache the attributes
+	// of files and directories.  Remote changes to an attribute
+	// can be invisible for this long, but lower values mean more
+	// requests to KBFS.
+	AttrTimeout time.Duration
+	// EntryTimeout is how long the kernel may cache the result of
+	// looking up a name in a directory, with the same tradeoff as
+	// AttrTimeout.
+	EntryTimeout time.Duration
+	// NoAtime reports each entry's mtime as its access time.  KBFS
+	// doesn't keep access times, and otherwise reports none.
+	NoAtime bool
+	// Snapshot, if non-empty, names a top-level folder, like
+	// "private/alice", to mount by itself, read-only, as it was
+	// when mounted.  Updates from other devices aren't applied and
+	// the kernel's caches are never invalidated, and since inode
+	// numbers are derived from paths, they stay the same across
+	// mounts of the same folder.  That makes the mount usable as
+	// an overlayfs lower directory.
+	Snapshot string
+	// FinderProgress gives files with changes that haven't been
+	// synced to the servers yet, including those still in the
+	// write-back journal, the extended attributes that make the
+	// macOS Finder show them as busy, with a progress bar, instead
+	// of as done.
+	FinderProgress bool
+	// KeepCache lets the kernel keep the pages it has cached for a
+	// file when the file is opened again, rather than reading it
+	// all from KBFS again, unless the file might have changed in a
+	// way the kernel hasn't been told about.  The kernel is told
+	// to drop the pages of files changed by new MD revisions from
+	// other devices and by other mounts, and it drops them itself
+	// when it notices a file's size or modification time changed.
+	// This makes memory-mapped and repeated reads, as done by git
+	// or program loaders, much faster.
+	KeepCache bool
+}
+
+// DefaultMountOptions returns the MountOptions used when none are
+// given.
+func DefaultMountOptions() MountOptions {
+	return MountOptions{
+		AttrTimeout:    attrTimeoutDefault,
+		EntryTimeout:   entryTimeoutDefault,
+		FinderProgress: finderProgressDefault,
+		KeepCache:      keepCacheDefault,
+	}
+}
+
+// parseSnapshot splits a Snapshot value into whether it names a
+// public folder and the folder's name.
+func parseSnapshot(snapshot string) (public bool, name string, err error) {
+	parts := strings.Split(strings.Trim(snapshot, "/"), "/")
+	if len(parts) == 2 && parts[1] != "" {
+		switch parts[0] {
+		case PrivateName:
+			return false, parts[1], nil
+		case PublicName:
+			return true, parts[1], nil
+		}
+	}
+	return false, "", fmt.Errorf(
+		"Snapshot %q isn't of the form %s/name or %s/name",
+		snapshot, PrivateName, PublicName)
+}
+
+// uint32Value is a flag.Value for a uint32.
+type uint32Value uint32
+
+func (v *uint32Value) String() string {
+	return strconv.FormatUint(uint64(*v), 10)
+}
+
+func (v *uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return err
+	}
+	*v = uint32Value(n)
+	return nil
+}
+
+// GetMountUsageString returns a string to be included in a usage
+// string corresponding to the flags added by AddMountFlags.
+func GetMountUsageString() string {
+	return "[-allow-other] [-max-readahead=bytes] [-noatime]\n" +
+		"    [-attr-timeout=duration] [-entry-timeout=duration]\n" +
+		"    [-snapshot=private/name|public/name] [-finder-progress]\n" +
+		"    [-keep-cache]"
+}
+
+// AddMountFlags adds flags for the mount options to the given
+// FlagSet and returns a MountOptions object that will be filled in
+// when the given FlagSet is parsed.
+func AddMountFlags(flags *flag.FlagSet) *MountOptions {
+	options := DefaultMountOptions()
+	flags.BoolVar(&options.AllowOther, "allow-other", false,
+		"let other users access the mount")
+	flags.Var((*uint32Value)(&options.MaxReadahead), "max-readahead",
+		"max number of bytes the kernel reads ahead (0 for the kernel default)")
+	flags.DurationVar(&options.AttrTimeout, "attr-timeout",
+		attrTimeoutDefault,
+		"how long the kernel caches file and directory attributes")
+	flags.DurationVar(&options.EntryTimeout, "entry-timeout",
+		entryTimeoutDefault,
+		"how long the kernel caches name lookups")
+	flags.BoolVar(&options.NoAtime, "noatime", false,
+		"report each entry's mtime as its access time")
+	flags.StringVar(&options.Snapshot, "snapshot", "",
+		"if non-empty, mount only this folder (e.g., private/alice), "+
+			"read-only and frozen as of the mount, e.g. for use as an "+
+			"overlayfs lower directory")
+	flags.BoolVar(&options.FinderProgress, "finder-progress",
+		finderProgressDefault,
+		"show the macOS Finder which files aren't synced yet")
+	flags.BoolVar(&options.KeepCache, "keep-cache", keepCacheDefault,
+		"let the kernel keep cached file data across opens, "+
+			"until the file changes")
+	return &options
+}
+
+// fuseOptions returns the FUSE mount options corresponding to o.
+func (o MountOptions) fuseOptions() ([]fuse.MountOption, error) {
+	if o.AttrTimeout < 0 || o.EntryTimeout < 0 {
+		return nil, errors.New("Mount timeouts can't be negative")
+	}
+	var options []fuse.MountOption
+	if o.Snapshot != "" {
+		if _, _, err := parseSnapshot(o.Snapshot); err != nil {
+			return nil, err
+		}
+		options = append(options, fuse.ReadOnly())
+	}
+	if o.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if o.MaxReadahead != 0 {
+		options = append(options, fuse.MaxReadahead(o.MaxReadahead))
+	}
+	if o.KeepCache {
+		options = append(options, fuse.AutoInvalData())
+	}
+	return options, nil
+}
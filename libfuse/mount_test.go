@@ -19,10 +19,10 @@ import (
 	"testing"
 	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fs/fstestutil"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/fuse/fs/fstestutil"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
@@ -31,6 +31,11 @@ import (
 
 func makeFS(t testing.TB, config *libkbfs.ConfigLocal) (
 	*fstestutil.Mount, *FS, func()) {
+	return makeFSWithOptions(t, config, DefaultMountOptions())
+}
+
+func makeFSWithOptions(t testing.TB, config *libkbfs.ConfigLocal,
+	mountOptions MountOptions) (*fstestutil.Mount, *FS, func()) {
 	log := logger.NewTestLogger(t)
 	debugLog := log.CloneWithAddedDepth(1)
 	fuse.Debug = func(msg interface{}) {
@@ -43,16 +48,28 @@ func makeFS(t testing.TB, config *libkbfs.ConfigLocal) (
 		log:           log,
 		errLog:        log,
 		notifications: libfs.NewFSNotifications(log),
+		mountOptions:  mountOptions,
 	}
 	filesys.execAfterDelay = func(d time.Duration, f func()) {
 		time.AfterFunc(d, f)
 	}
+	if filesys.isSnapshot() {
+		err := filesys.loadSnapshot(filesys.WithContext(context.Background()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 	fn := func(mnt *fstestutil.Mount) fs.FS {
 		filesys.fuse = mnt.Server
 		filesys.conn = mnt.Conn
 		return filesys
 	}
 	options := GetPlatformSpecificMountOptionsForTest()
+	tuningOptions, err := mountOptions.fuseOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options = append(options, tuningOptions...)
 	mnt, err := fstestutil.MountedFuncT(t, fn, &fs.Config{
 		WithContext: func(ctx context.Context, req fuse.Request) context.Context {
 			return filesys.WithContext(ctx)
@@ -2224,6 +2241,44 @@ func TestInvalidateDataOnLocalWrite(t *testing.T) {
 	}
 }
 
+// Test that a file reopened after a change made through another
+// mount doesn't show the kernel's stale cached data, even though the
+// kernel keeps its cache across opens.
+func TestKeepCacheInvalidatedAcrossOpens(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt1, _, cancelFn1 := makeFS(t, config)
+	defer mnt1.Close()
+	defer cancelFn1()
+	mnt2, fs2, cancelFn2 := makeFS(t, config)
+	defer mnt2.Close()
+	defer cancelFn2()
+
+	if !mnt2.Conn.Protocol().HasInvalidate() {
+		t.Skip("Old FUSE protocol")
+	}
+
+	myfile1 := path.Join(mnt1.Dir, PrivateName, "jdoe", "myfile")
+	myfile2 := path.Join(mnt2.Dir, PrivateName, "jdoe", "myfile")
+	for _, input := range []string{"input round one", "input round two"} {
+		if err := ioutil.WriteFile(myfile1, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		syncFolderToServer(t, "jdoe", fs2)
+
+		// Read it twice, the second time from the kernel's cache.
+		for i := 0; i < 2; i++ {
+			buf, err := ioutil.ReadFile(myfile2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := string(buf), input; g != e {
+				t.Errorf("wrong content: %q != %q", g, e)
+			}
+		}
+	}
+}
+
 func TestInvalidateEntryOnDelete(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe", "wsmith")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -3242,3 +3297,183 @@ func TestSimpleCRConflictOnOpenMergedFile(t *testing.T) {
 		t.Errorf("wrong content: %q != %q", g, e)
 	}
 }
+
+func TestLocksAcrossUsers(t *testing.T) {
+	config1 := libkbfs.MakeTestConfigOrBust(t, "u1", "u2")
+	defer libkbfs.CheckConfigAndShutdown(t, config1)
+	mnt1, _, cancelFn1 := makeFS(t, config1)
+	defer mnt1.Close()
+	defer cancelFn1()
+
+	config2 := libkbfs.ConfigAsUser(config1, "u2")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+	mnt2, fs2, cancelFn2 := makeFS(t, config2)
+	defer mnt2.Close()
+	defer cancelFn2()
+
+	p1 := path.Join(mnt1.Dir, PrivateName, "u1,u2", "myfile")
+	if err := ioutil.WriteFile(p1, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFolderToServer(t, "u1,u2", fs2)
+	p2 := path.Join(mnt2.Dir, PrivateName, "u1,u2", "myfile")
+
+	f1, err := os.Open(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	// flock(2) locks.
+	if err := unix.Flock(int(f1.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		t.Fatalf("Couldn't take exclusive lock: %v", err)
+	}
+	err = unix.Flock(int(f2.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	if g, e := err, unix.EWOULDBLOCK; g != e {
+		t.Fatalf("wrong error for conflicting lock: %v != %v", g, e)
+	}
+	if err := unix.Flock(int(f1.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatalf("Couldn't unlock: %v", err)
+	}
+	if err := unix.Flock(int(f2.Fd()), unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		t.Fatalf("Couldn't take shared lock after unlock: %v", err)
+	}
+	if err := unix.Flock(int(f2.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatalf("Couldn't unlock: %v", err)
+	}
+
+	// fcntl(2) locks on byte ranges.
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0, Start: 0, Len: 10}
+	if err := unix.FcntlFlock(f1.Fd(), unix.F_SETLK, &lk); err != nil {
+		t.Fatalf("Couldn't take write lock: %v", err)
+	}
+	other := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0, Start: 10, Len: 10}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_SETLK, &other); err != nil {
+		t.Fatalf("Couldn't take non-overlapping write lock: %v", err)
+	}
+	conflict := unix.Flock_t{Type: unix.F_RDLCK, Whence: 0, Start: 5, Len: 1}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_GETLK, &conflict); err != nil {
+		t.Fatalf("Couldn't get lock: %v", err)
+	}
+	if g, e := conflict.Type, int16(unix.F_WRLCK); g != e {
+		t.Errorf("wrong conflicting lock type: %v != %v", g, e)
+	}
+	err = unix.FcntlFlock(f2.Fd(), unix.F_SETLK, &conflict)
+	if err != unix.EAGAIN && err != unix.EACCES {
+		t.Fatalf("Unexpected error for conflicting lock: %v", err)
+	}
+
+	// Closing the file releases its POSIX locks.
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conflict = unix.Flock_t{Type: unix.F_RDLCK, Whence: 0, Start: 5, Len: 1}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_SETLK, &conflict); err != nil {
+		t.Fatalf("Couldn't take read lock after close: %v", err)
+	}
+}
+
+func TestSnapshotMount(t *testing.T) {
+	config1 := libkbfs.MakeTestConfigOrBust(t, "user1", "user2")
+	defer libkbfs.CheckConfigAndShutdown(t, config1)
+	mnt1, _, cancelFn1 := makeFS(t, config1)
+	defer mnt1.Close()
+	defer cancelFn1()
+
+	myfile1 := path.Join(mnt1.Dir, PrivateName, "user1,user2", "myfile")
+	if err := ioutil.WriteFile(myfile1, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config2 := libkbfs.ConfigAsUser(config1, "user2")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+	mountOptions := DefaultMountOptions()
+	mountOptions.Snapshot = "private/user2,user1"
+	mnt2, _, cancelFn2 := makeFSWithOptions(t, config2, mountOptions)
+	defer mnt2.Close()
+	defer cancelFn2()
+
+	myfile2 := path.Join(mnt2.Dir, "myfile")
+	var st1 unix.Stat_t
+	if err := unix.Stat(myfile2, &st1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes from other devices don't show up in the snapshot.
+	if err := ioutil.WriteFile(myfile1, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(myfile2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), "old"; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+	checkDir(t, mnt2.Dir, map[string]fileInfoCheck{
+		"myfile": nil,
+	})
+
+	// Neither do special files, and it can't be written.
+	if _, err := os.Stat(path.Join(mnt2.Dir, libfs.StatusFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected ENOENT for the status file, got: %v", err)
+	}
+	err = ioutil.WriteFile(myfile2, []byte("mine"), 0644)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EROFS {
+		t.Errorf("Expected EROFS writing to a snapshot, got: %v", err)
+	}
+
+	// Inode numbers are derived from paths.
+	var st2 unix.Stat_t
+	if err := unix.Stat(myfile2, &st2); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := st2.Ino, fs.GenerateDynamicInode(1, "myfile"); g != e || st1.Ino != e {
+		t.Errorf("wrong inode: %d, %d != %d", st1.Ino, g, e)
+	}
+}
+
+func TestFinderProgressXattrValues(t *testing.T) {
+	for _, c := range []struct {
+		size     uint64
+		unsynced int64
+		expected float64
+	}{
+		{0, 0, 0},
+		{100, 100, 0},
+		{100, 25, 0.75},
+		{100, 0, 0.99},
+		{100, 200, 0},
+	} {
+		if g := syncedFraction(c.size, c.unsynced); g != c.expected {
+			t.Errorf("syncedFraction(%d, %d) = %v, expected %v",
+				c.size, c.unsynced, g, c.expected)
+		}
+	}
+
+	info := make([]byte, finderInfoSize)
+	copy(info, "TEXTttxt")
+	info[8] = 1
+	busy := finderInfoWithBusy(info)
+	if g, e := string(busy[:8]), "brokMACS"; g != e {
+		t.Errorf("Busy Finder info has codes %q, expected %q", g, e)
+	}
+	if busy[8] != 1 || string(info[:8]) != "TEXTttxt" {
+		t.Errorf("Marking Finder info busy changed too much")
+	}
+	if g := finderInfoWithBusy(nil); len(g) != finderInfoSize {
+		t.Errorf("Busy Finder info has %d bytes", len(g))
+	}
+	cleared := finderInfoWithoutBusy(busy)
+	if string(cleared[:8]) != string(make([]byte, 8)) || cleared[8] != 1 {
+		t.Errorf("Busy codes weren't cleared: %v", cleared)
+	}
+	if g := finderInfoWithoutBusy(info); string(g) != string(info) {
+		t.Errorf("Finder info without busy codes changed: %v", g)
+	}
+}
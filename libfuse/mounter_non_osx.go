@@ -6,15 +6,17 @@
 
 package libfuse
 
-import "bazil.org/fuse"
+import "github.com/keybase/kbfs/fuse"
 
 func getPlatformSpecificMountOptions(dir string, platformParams PlatformParams) ([]fuse.MountOption, error) {
-	return []fuse.MountOption{}, nil
+	// Have the kernel pass locks to KBFS, so other devices honor
+	// them.
+	return []fuse.MountOption{fuse.LockingPOSIX(), fuse.LockingFlock()}, nil
 }
 
 // GetPlatformSpecificMountOptionsForTest makes cross-platform tests work
 func GetPlatformSpecificMountOptionsForTest() []fuse.MountOption {
-	return []fuse.MountOption{}
+	return []fuse.MountOption{fuse.LockingPOSIX(), fuse.LockingFlock()}
 }
 
 func translatePlatformSpecificError(err error, platformParams PlatformParams) error {
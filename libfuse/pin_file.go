@@ -0,0 +1,56 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// PinFile represents a write-only file where writing "always",
+// "never" or "auto" overrides whether the folder's blocks are pinned
+// in the block cache.
+type PinFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*PinFile)(nil)
+
+// Attr implements the fs.Node interface for PinFile.
+func (f *PinFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*PinFile)(nil)
+
+var _ fs.HandleWriter = (*PinFile)(nil)
+
+// Write implements the fs.HandleWriter interface for PinFile.
+func (f *PinFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "PinFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	pinning, err := libkbfs.ParseFolderPinning(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = f.folder.fs.config.KBFSOps().SetFolderPinning(
+		ctx, f.folder.getFolderBranch(), pinning)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -8,8 +8,8 @@ import (
 	"os"
 	"runtime/pprof"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libfs"
 
 	"golang.org/x/net/context"
@@ -0,0 +1,56 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// QuotaFile represents a write-only file where writing a number of
+// bytes limits how much the folder may use.
+type QuotaFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*QuotaFile)(nil)
+
+// Attr implements the fs.Node interface for QuotaFile.
+func (f *QuotaFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*QuotaFile)(nil)
+
+var _ fs.HandleWriter = (*QuotaFile)(nil)
+
+// Write implements the fs.HandleWriter interface for QuotaFile.
+func (f *QuotaFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "QuotaFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(req.Data)), 10, 64)
+	if err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	err = f.folder.fs.config.KBFSOps().
+		SetFolderQuota(ctx, f.folder.getFolderBranch(), limit)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
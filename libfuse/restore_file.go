@@ -0,0 +1,51 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// RestoreFile represents a write-only file where writing the path of
+// an entry in the folder's trash, relative to the trash directory,
+// moves the entry back to where it was removed from.
+type RestoreFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*RestoreFile)(nil)
+
+// Attr implements the fs.Node interface for RestoreFile.
+func (f *RestoreFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*RestoreFile)(nil)
+
+var _ fs.HandleWriter = (*RestoreFile)(nil)
+
+// Write implements the fs.HandleWriter interface for RestoreFile.
+func (f *RestoreFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "RestoreFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = f.folder.fs.config.KBFSOps().RestoreFromTrash(ctx,
+		f.folder.getFolderBranch(), strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
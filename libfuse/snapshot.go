@@ -0,0 +1,65 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// isSnapshot returns whether f serves a frozen top-level folder, as
+// set by MountOptions.Snapshot.
+func (f *FS) isSnapshot() bool {
+	return f.mountOptions.Snapshot != ""
+}
+
+// loadSnapshot loads the top-level folder named by
+// MountOptions.Snapshot, and stops it from applying updates from
+// other devices or resolving conflicts, so that it stays as it is
+// now for as long as it's mounted.  Root then returns the folder
+// instead of the usual root.  It must be called before serving.
+func (f *FS) loadSnapshot(ctx context.Context) error {
+	public, name, err := parseSnapshot(f.mountOptions.Snapshot)
+	if err != nil {
+		return err
+	}
+	h, err := libkbfs.ParseTlfHandle(ctx, f.config.KBPKI(), name, public)
+	if nonCanon, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		h, err = libkbfs.ParseTlfHandle(
+			ctx, f.config.KBPKI(), nonCanon.NameToTry, public)
+	}
+	if err != nil {
+		return err
+	}
+
+	fl := &FolderList{
+		fs:      f,
+		public:  public,
+		folders: make(map[string]*TLF),
+	}
+	tlf := newTLF(fl, h)
+	fl.folders[string(h.GetCanonicalName())] = tlf
+	dir, err := tlf.loadDir(ctx)
+	if err != nil {
+		return err
+	}
+
+	folderBranch := dir.node.GetFolderBranch()
+	tlf.folder.updateMu.Lock()
+	defer tlf.folder.updateMu.Unlock()
+	tlf.folder.updateChan, err =
+		libkbfs.DisableUpdatesForTesting(f.config, folderBranch)
+	if err != nil {
+		return err
+	}
+	err = libkbfs.DisableCRForTesting(f.config, folderBranch)
+	if err != nil {
+		return err
+	}
+
+	f.log.CDebugf(ctx, "Serving a snapshot of %s", tlf.folder.name())
+	f.snapshot = tlf
+	return nil
+}
@@ -5,8 +5,8 @@
 package libfuse
 
 import (
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 )
@@ -21,6 +21,8 @@ func handleSpecialFile(name string, fs *FS, resp *fuse.LookupResponse) fs.Node {
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
 		return &ResetCachesFile{fs}
+	case libfs.BandwidthScheduleFileName:
+		return &BandwidthScheduleFile{fs}
 	}
 
 	return nil
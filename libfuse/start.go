@@ -5,11 +5,14 @@
 package libfuse
 
 import (
+	"errors"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libhttpserver"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -19,13 +22,82 @@ type StartOptions struct {
 	KbfsParams libkbfs.InitParams
 	RuntimeDir string
 	Label      string
+	// Takeover, if true, asks any other KBFS process using the same
+	// state directory to shut down and hand it over, instead of
+	// failing to start.
+	Takeover bool
+	// HTTPGatewayAddr, if non-empty, is the address on which to
+	// serve public folders read-only over HTTP (see
+	// libhttpserver.Server).
+	HTTPGatewayAddr string
+	// MountOptions tune the kernel's caching of the mount.  They
+	// should match the ones given to the Mounter.
+	MountOptions MountOptions
 }
 
+// errTakenOver is returned internally by Start when another process
+// takes over the state directory before the config is initialized.
+var errTakenOver = errors.New("Taken over by another process")
+
 // Start the filesystem
 func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
 	// InitLog errors are non-fatal and are ignored.
 	log, _ := libkbfs.InitLog(options.KbfsParams, kbCtx)
 
+	// Make sure no other KBFS process is using our state.
+	lockDir := options.RuntimeDir
+	if lockDir == "" {
+		lockDir = options.KbfsParams.ServerRootDir
+	}
+	takenOver := make(chan struct{})
+	// A takeover may come at any point, so the config is shut
+	// down for it under configLock, and only once.  configLock is
+	// held while the config is initialized, so that a takeover
+	// can't hand over the lock in the middle of that.
+	var configLock sync.Mutex
+	var config libkbfs.Config
+	configShutDown := false
+	shutdownForTakeover := func() {
+		configLock.Lock()
+		defer configLock.Unlock()
+		if config == nil || configShutDown {
+			return
+		}
+		configShutDown = true
+		// Flush everything before releasing the lock to the
+		// new instance.
+		log.Debug("Shutting down for takeover")
+		if err := config.Shutdown(); err != nil {
+			log.Warning("Error shutting down for takeover: %v", err)
+		}
+	}
+	if lockDir != "" {
+		var lock *libkbfs.InstanceLock
+		lockAcquired := make(chan struct{})
+		var err error
+		lock, err = libkbfs.AcquireInstanceLock(context.Background(),
+			log, lockDir, options.Takeover, func() {
+				close(takenOver)
+				// Unmounting makes Serve return below, and
+				// the deferred Release hands over the lock.
+				if err := mounter.Unmount(); err != nil {
+					// Serve won't return, so flush
+					// and hand over the lock now
+					// rather than leave the new
+					// instance waiting.
+					log.Warning("Couldn't unmount for takeover: %v", err)
+					<-lockAcquired
+					shutdownForTakeover()
+					lock.Release()
+				}
+			})
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		close(lockAcquired)
+		defer lock.Release()
+	}
+
 	if options.RuntimeDir != "" {
 		info := libkb.NewServiceInfo(libkbfs.Version, libkbfs.PrereleaseBuild, options.Label, os.Getpid())
 		err := info.WriteFile(path.Join(options.RuntimeDir, "kbfs.info"))
@@ -61,21 +133,61 @@ func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.
 
 	log.Debug("Initializing")
 
-	config, err := libkbfs.Init(kbCtx, options.KbfsParams, onInterruptFn, log)
-	if err != nil {
+	err = func() error {
+		configLock.Lock()
+		defer configLock.Unlock()
+		select {
+		case <-takenOver:
+			return errTakenOver
+		default:
+		}
+		var err error
+		config, err = libkbfs.Init(
+			kbCtx, options.KbfsParams, onInterruptFn, log)
+		return err
+	}()
+	if err == errTakenOver {
+		log.Debug("Taken over before initializing")
+		return nil
+	} else if err != nil {
 		return libfs.InitError(err.Error())
 	}
 
 	defer libkbfs.Shutdown()
 
+	if options.HTTPGatewayAddr != "" {
+		gateway, err := libhttpserver.NewServer(
+			config, options.HTTPGatewayAddr)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		defer gateway.Shutdown()
+		log.Debug("Serving public folders over HTTP on %s", gateway.Addr())
+	}
+
 	log.Debug("Creating filesystem")
-	fs := NewFS(config, c, options.KbfsParams.Debug)
+	fs := NewFS(config, c, options.KbfsParams.Debug, options.MountOptions)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	ctx = context.WithValue(ctx, CtxAppIDKey, fs)
+	if options.MountOptions.Snapshot != "" {
+		if err := fs.loadSnapshot(fs.WithContext(ctx)); err != nil {
+			if err := mounter.Unmount(); err != nil {
+				log.Warning("Couldn't unmount: %v", err)
+			}
+			return libfs.InitError(err.Error())
+		}
+	}
 	log.Debug("Serving filesystem")
 	fs.Serve(ctx)
 
+	select {
+	case <-takenOver:
+		shutdownForTakeover()
+		return nil
+	default:
+	}
+
 	<-c.Ready
 	err = c.MountError
 	if err != nil {
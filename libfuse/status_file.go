@@ -7,7 +7,7 @@ package libfuse
 import (
 	"time"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 	"golang.org/x/net/context"
 
 	"github.com/keybase/kbfs/libfs"
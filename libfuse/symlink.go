@@ -8,8 +8,8 @@ import (
 	"os"
 	"syscall"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -41,7 +41,7 @@ func (s *Symlink) Attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	fillAttr(&de, a)
+	s.parent.folder.fs.fillAttr(&de, a)
 	a.Mode = os.ModeSymlink | 0777
 	return nil
 }
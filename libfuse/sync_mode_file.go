@@ -0,0 +1,55 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncModeFile represents a write-only file where writing "full" or
+// "on-demand" changes how much of the folder is kept on this device.
+type SyncModeFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*SyncModeFile)(nil)
+
+// Attr implements the fs.Node interface for SyncModeFile.
+func (f *SyncModeFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*SyncModeFile)(nil)
+
+var _ fs.HandleWriter = (*SyncModeFile)(nil)
+
+// Write implements the fs.HandleWriter interface for SyncModeFile.
+func (f *SyncModeFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "SyncModeFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	mode, err := libkbfs.ParseTlfSyncMode(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = f.folder.fs.config.KBFSOps().SetTlfSyncMode(
+		ctx, f.folder.getFolderBranch(), mode)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// UnfreezeFile represents a write-only file where any write of at
+// least one byte unfreezes a folder that was frozen after suspicious
+// activity.
+type UnfreezeFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*UnfreezeFile)(nil)
+
+// Attr implements the fs.Node interface for UnfreezeFile.
+func (f *UnfreezeFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*UnfreezeFile)(nil)
+
+var _ fs.HandleWriter = (*UnfreezeFile)(nil)
+
+// Write implements the fs.HandleWriter interface for UnfreezeFile.
+func (f *UnfreezeFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "UnfreezeFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = f.folder.fs.config.KBFSOps().
+		UnfreezeFolder(ctx, f.folder.getFolderBranch())
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
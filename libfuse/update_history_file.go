@@ -8,7 +8,7 @@ import (
 	"encoding/json"
 	"time"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 	"golang.org/x/net/context"
 )
 
@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"syscall"
+
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// These are the flags setxattr(2) takes, which have the same values
+// on Linux and OS X.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// getxattr fills in resp with the value of the requested extended
+// attribute of node.
+func getxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, err := folder.fs.config.KBFSOps().GetXattr(ctx, node, req.Name)
+	if err != nil {
+		return err
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// listxattr fills in resp with the names of all the extended
+// attributes of node.
+func listxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	resp *fuse.ListxattrResponse) error {
+	names, err := folder.fs.config.KBFSOps().ListXattr(ctx, node)
+	if err != nil {
+		return err
+	}
+	resp.Append(names...)
+	return nil
+}
+
+// setxattr sets the requested extended attribute of node.
+func setxattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.SetxattrRequest) error {
+	var mode libkbfs.XattrSetMode
+	switch req.Flags {
+	case 0:
+		mode = libkbfs.XattrCreateOrReplace
+	case xattrCreate:
+		mode = libkbfs.XattrCreateOnly
+	case xattrReplace:
+		mode = libkbfs.XattrReplaceOnly
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return folder.fs.config.KBFSOps().SetXattr(
+		ctx, node, req.Name, req.Xattr, mode)
+}
+
+// removexattr removes the requested extended attribute of node.
+func removexattr(ctx context.Context, folder *Folder, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) error {
+	return folder.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+}
@@ -0,0 +1,637 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libgit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// RepoDirName is the hidden directory, at the root of a
+	// top-level folder, that holds the folder's git repositories.
+	RepoDirName = ".keybase_git"
+
+	headFileName       = "HEAD"
+	configFileName     = "config"
+	packedRefsFileName = "packed-refs"
+	lockFileName       = "LOCK"
+	packSuffix         = ".pack"
+	idxSuffix          = ".idx"
+
+	// defaultHead is what HEAD points to in a new repository.
+	defaultHead = "refs/heads/master"
+	// bareConfig is the config of every repository, so that git
+	// can use them directly through a mount.
+	bareConfig = "[core]\n\trepositoryformatversion = 0\n\tbare = true\n"
+
+	// lockPollPeriod is how often Lock checks whether someone
+	// else's lock has been released, or whether conflict
+	// resolution has settled who got it.
+	lockPollPeriod = time.Second
+	// lockStaleAge is how long a lock has to go without being
+	// refreshed before it's assumed that its holder died without
+	// releasing it.
+	lockStaleAge = 10 * time.Minute
+	// lockRefreshPeriod is how often the holder of a lock refreshes
+	// it, to show that it's still alive.
+	lockRefreshPeriod = lockStaleAge / 4
+	// writeChunkSize is how much of a pack is written to KBFS at
+	// a time.
+	writeChunkSize = 1 << 20
+)
+
+// packDirPath is where a repository's packs are kept, as in any bare
+// git repository.
+var packDirPath = []string{"objects", "pack"}
+
+// Ref is a git reference, and the hash of the object it points to.
+type Ref struct {
+	Name string
+	Hash string
+}
+
+// InvalidRepoNameError indicates that a repository name can't be
+// used.
+type InvalidRepoNameError struct {
+	Name string
+}
+
+// Error implements the error interface for InvalidRepoNameError.
+func (e InvalidRepoNameError) Error() string {
+	return fmt.Sprintf("Invalid repository name %q", e.Name)
+}
+
+// Repo is a bare git repository kept in a KBFS top-level folder, at
+// .keybase_git/<name>.  It has the same layout as any other bare
+// repository, with all of its objects in packs and all of its refs
+// in packed-refs, so git can also read it through a mount.
+//
+// Repo only ever adds packs and rewrites packed-refs, and the latter
+// only while holding the repository's lock (see Lock), so that
+// collaborators pushing at the same time can't lose each other's
+// updates.
+type Repo struct {
+	config libkbfs.Config
+	log    logger.Logger
+	name   string
+	dir    libkbfs.Node
+}
+
+func getRootNode(ctx context.Context, config libkbfs.Config,
+	tlfName string, public bool) (libkbfs.Node, error) {
+	th, err := libkbfs.ParseTlfHandle(ctx, config.KBPKI(), tlfName, public)
+	if nonCanon, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		th, err = libkbfs.ParseTlfHandle(
+			ctx, config.KBPKI(), nonCanon.NameToTry, public)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, _, err := config.KBFSOps().GetOrCreateRootNode(
+		ctx, th, libkbfs.MasterBranch)
+	return root, err
+}
+
+// lookupDir returns the given subdirectory of dir, creating it first
+// if create is true and it doesn't exist.
+func lookupDir(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	dir libkbfs.Node, name string, create bool) (libkbfs.Node, error) {
+	node, _, err := kbfsOps.Lookup(ctx, dir, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok && create {
+		node, _, err = kbfsOps.CreateDir(ctx, dir, name)
+	}
+	return node, err
+}
+
+// OpenRepo returns the repository with the given name in the given
+// top-level folder.  If create is true, the repository is created if
+// it doesn't exist yet; otherwise a libkbfs.NoSuchNameError is
+// returned.
+func OpenRepo(ctx context.Context, config libkbfs.Config, tlfName string,
+	public bool, name string, create bool) (*Repo, error) {
+	if name == "" || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, "/\\") {
+		return nil, InvalidRepoNameError{name}
+	}
+	root, err := getRootNode(ctx, config, tlfName, public)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := config.KBFSOps()
+	reposDir, err := lookupDir(ctx, kbfsOps, root, RepoDirName, create)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := lookupDir(ctx, kbfsOps, reposDir, name, create)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{
+		config: config,
+		log:    config.MakeLogger(""),
+		name:   name,
+		dir:    dir,
+	}
+	if create {
+		if err := r.init(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// init fills in whatever is missing from the layout of a bare
+// repository.
+func (r *Repo) init(ctx context.Context) error {
+	kbfsOps := r.config.KBFSOps()
+	children, err := kbfsOps.GetDirChildren(ctx, r.dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := children[headFileName]; !ok {
+		err := r.writeFile(ctx, r.dir, headFileName,
+			[]byte("ref: "+defaultHead+"\n"))
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := children[configFileName]; !ok {
+		err := r.writeFile(ctx, r.dir, configFileName, []byte(bareConfig))
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range [][]string{packDirPath, {"refs", "heads"},
+		{"refs", "tags"}} {
+		dir := r.dir
+		for _, name := range p {
+			dir, err = lookupDir(ctx, kbfsOps, dir, name, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the repository.
+func (r *Repo) Name() string {
+	return r.name
+}
+
+func (r *Repo) packDir(ctx context.Context, create bool) (
+	libkbfs.Node, error) {
+	dir := r.dir
+	for _, name := range packDirPath {
+		var err error
+		dir, err = lookupDir(ctx, r.config.KBFSOps(), dir, name, create)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dir, nil
+}
+
+// readFile returns the contents of the given file in dir, or nil if
+// there is no such file.
+func (r *Repo) readFile(ctx context.Context, dir libkbfs.Node,
+	name string) ([]byte, error) {
+	kbfsOps := r.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ei.Size)
+	n, err := kbfsOps.Read(ctx, node, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// syncFile flushes the given file to the KBFS servers, even in
+// write-back mode, so that it's visible to other collaborators.
+func (r *Repo) syncFile(ctx context.Context, node libkbfs.Node) error {
+	kbfsOps := r.config.KBFSOps()
+	if err := kbfsOps.Sync(ctx, node); err != nil {
+		return err
+	}
+	return kbfsOps.WaitForWriteBack(ctx, node.GetFolderBranch())
+}
+
+// writeFile replaces the contents of the given file in dir, creating
+// it if needed, and syncs it.
+func (r *Repo) writeFile(ctx context.Context, dir libkbfs.Node,
+	name string, data []byte) error {
+	return r.copyToFile(ctx, dir, name, bytes.NewReader(data))
+}
+
+// copyToFile replaces the contents of the given file in dir with
+// everything read from src, creating it if needed, and syncs it.
+func (r *Repo) copyToFile(ctx context.Context, dir libkbfs.Node,
+	name string, src io.Reader) error {
+	kbfsOps := r.config.KBFSOps()
+	node, _, err := kbfsOps.Lookup(ctx, dir, name)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		node, _, err = kbfsOps.CreateFile(ctx, dir, name, false)
+	}
+	if err != nil {
+		return err
+	}
+	if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+		return err
+	}
+	var off int64
+	for {
+		buf := make([]byte, writeChunkSize)
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if err := kbfsOps.Write(ctx, node, buf[:n], off); err != nil {
+				return err
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return r.syncFile(ctx, node)
+}
+
+// Refs returns the repository's refs, sorted by name, and the name
+// of the ref its HEAD points to.
+func (r *Repo) Refs(ctx context.Context) (refs []Ref, head string,
+	err error) {
+	buf, err := r.readFile(ctx, r.dir, packedRefsFileName)
+	if err != nil {
+		return nil, "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Skip the header, and the peeled values of tags.
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("Bad line in %s: %q",
+				packedRefsFileName, line)
+		}
+		refs = append(refs, Ref{Name: fields[1], Hash: fields[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	sort.Sort(refsByName(refs))
+
+	buf, err = r.readFile(ctx, r.dir, headFileName)
+	if err != nil {
+		return nil, "", err
+	}
+	head = strings.TrimPrefix(strings.TrimSpace(string(buf)), "ref: ")
+	return refs, head, nil
+}
+
+type refsByName []Ref
+
+func (s refsByName) Len() int           { return len(s) }
+func (s refsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s refsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SetRefs replaces all of the repository's refs, and points its
+// HEAD at the given ref.  The caller must hold the repository's
+// lock, and must have read the refs it's replacing after taking it.
+func (r *Repo) SetRefs(ctx context.Context, refs []Ref, head string) error {
+	sorted := append([]Ref(nil), refs...)
+	sort.Sort(refsByName(sorted))
+	var buf bytes.Buffer
+	buf.WriteString("# pack-refs with: sorted\n")
+	for _, ref := range sorted {
+		fmt.Fprintf(&buf, "%s %s\n", ref.Hash, ref.Name)
+	}
+	err := r.writeFile(ctx, r.dir, packedRefsFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	headData := []byte("ref: " + head + "\n")
+	oldHeadData, err := r.readFile(ctx, r.dir, headFileName)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(headData, oldHeadData) {
+		return nil
+	}
+	return r.writeFile(ctx, r.dir, headFileName, headData)
+}
+
+// Packs returns the names, like "pack-<hash>", of the repository's
+// complete packs, i.e. those with both a pack file and an index.
+func (r *Repo) Packs(ctx context.Context) ([]string, error) {
+	dir, err := r.packDir(ctx, false)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	children, err := r.config.KBFSOps().GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var packs []string
+	for name := range children {
+		if !strings.HasSuffix(name, packSuffix) {
+			continue
+		}
+		pack := strings.TrimSuffix(name, packSuffix)
+		if _, ok := children[pack+idxSuffix]; ok {
+			packs = append(packs, pack)
+		}
+	}
+	sort.Strings(packs)
+	return packs, nil
+}
+
+// AddPack stores a pack and its index in the repository.  The index
+// is written last, so that git never sees an incomplete pack.
+func (r *Repo) AddPack(ctx context.Context, pack string,
+	packData, idxData io.Reader) error {
+	dir, err := r.packDir(ctx, true)
+	if err != nil {
+		return err
+	}
+	if err := r.copyToFile(ctx, dir, pack+packSuffix, packData); err != nil {
+		return err
+	}
+	return r.copyToFile(ctx, dir, pack+idxSuffix, idxData)
+}
+
+// ReadPack copies the given pack and its index from the repository
+// to the given writers.
+func (r *Repo) ReadPack(ctx context.Context, pack string,
+	packW, idxW io.Writer) error {
+	dir, err := r.packDir(ctx, false)
+	if err != nil {
+		return err
+	}
+	kbfsOps := r.config.KBFSOps()
+	for _, f := range []struct {
+		name string
+		w    io.Writer
+	}{{pack + packSuffix, packW}, {pack + idxSuffix, idxW}} {
+		node, _, err := kbfsOps.Lookup(ctx, dir, f.name)
+		if err != nil {
+			return err
+		}
+		stream, err := kbfsOps.ReadStream(ctx, node, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f.w, stream)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock takes the repository's lock, waiting until whoever holds it
+// releases it or ctx is canceled, and returns a function that
+// releases it.
+//
+// The lock is a symlink, whose target is a token made up for each
+// attempt, and whose creation is itself the lock: the MD server only
+// takes the MD write that creates it if no one else's write got in
+// first, and otherwise the write ends up on an unmerged branch, and
+// conflict resolution moves it aside.  Unlike empty files, symlinks
+// created at the same time are never merged into one, so once
+// conflict resolution is done, whoever's token the lock has holds
+// it, and, since its write was the successor of the latest head,
+// also sees the latest refs.  The loser removes the copy that was
+// moved aside.
+//
+// While it holds the lock, the holder refreshes it every
+// lockRefreshPeriod, and a lock that hasn't been refreshed in
+// lockStaleAge is assumed to have been left behind by a holder that
+// died, and is broken.
+func (r *Repo) Lock(ctx context.Context) (unlock func() error, err error) {
+	kbfsOps := r.config.KBFSOps()
+	for {
+		token, err := makeLockToken()
+		if err != nil {
+			return nil, err
+		}
+		_, err = kbfsOps.CreateLink(ctx, r.dir, lockFileName, token)
+		switch err.(type) {
+		case nil:
+			held, err := r.settleLock(ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			if held {
+				return r.hold(ctx, token), nil
+			}
+			r.log.CDebugf(ctx, "Lost the race for the lock of %s", r.name)
+		case libkbfs.NameExistsError:
+			if err := r.breakStaleLock(ctx); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+
+		if err := waitLockPoll(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func makeLockToken() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+func waitLockPoll(ctx context.Context) error {
+	select {
+	case <-time.After(lockPollPeriod):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// settleLock waits until the write of the lock with the given token
+// is merged, by conflict resolution if need be, and returns whether
+// that lock is the one that was taken.  If it isn't, the copy that
+// conflict resolution moved aside is removed.
+func (r *Repo) settleLock(ctx context.Context, token string) (bool, error) {
+	kbfsOps := r.config.KBFSOps()
+	fb := r.dir.GetFolderBranch()
+	for {
+		if err := kbfsOps.WaitForWriteBack(ctx, fb); err != nil {
+			return false, err
+		}
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		if err != nil {
+			return false, err
+		}
+		if !status.Staged {
+			break
+		}
+		if err := waitLockPoll(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	children, err := kbfsOps.GetDirChildren(ctx, r.dir)
+	if err != nil {
+		return false, err
+	}
+	held := false
+	for name, ei := range children {
+		if ei.Type != libkbfs.Sym || ei.SymPath != token {
+			continue
+		}
+		if name == lockFileName {
+			held = true
+			continue
+		}
+		err := kbfsOps.RemoveEntry(ctx, r.dir, name)
+		if _, ok := err.(libkbfs.NoSuchNameError); !ok && err != nil {
+			return false, err
+		}
+	}
+	if held {
+		return true, nil
+	}
+	return false, kbfsOps.WaitForWriteBack(ctx, fb)
+}
+
+// hold starts refreshing the lock with the given token, and returns
+// the function that stops doing so and releases the lock.  The
+// refreshing doesn't use ctx, which may well end before the lock is
+// released.
+func (r *Repo) hold(ctx context.Context, token string) func() error {
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lockRefreshPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-refreshCtx.Done():
+				return
+			}
+			if err := r.refreshLock(refreshCtx, token); err != nil {
+				if refreshCtx.Err() == nil {
+					r.log.CWarningf(refreshCtx,
+						"Couldn't refresh the lock of %s: %v", r.name, err)
+				}
+			}
+		}
+	}()
+	return func() error {
+		cancel()
+		<-done
+		return r.unlock(ctx, token)
+	}
+}
+
+// lockHeld returns whether the lock has the given token.
+func (r *Repo) lockHeld(ctx context.Context, token string) (bool, error) {
+	_, ei, err := r.config.KBFSOps().Lookup(ctx, r.dir, lockFileName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return ei.Type == libkbfs.Sym && ei.SymPath == token, nil
+}
+
+// refreshLock resets the age of the lock with the given token, by
+// renaming a new symlink with the same token over it, in a single
+// MD write.
+func (r *Repo) refreshLock(ctx context.Context, token string) error {
+	held, err := r.lockHeld(ctx, token)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("The lock of %s was broken", r.name)
+	}
+	kbfsOps := r.config.KBFSOps()
+	tmpName := lockFileName + "." + token
+	_, err = kbfsOps.CreateLink(ctx, r.dir, tmpName, token)
+	if _, ok := err.(libkbfs.NameExistsError); !ok && err != nil {
+		return err
+	}
+	err = kbfsOps.Rename(ctx, r.dir, tmpName, r.dir, lockFileName)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.WaitForWriteBack(ctx, r.dir.GetFolderBranch())
+}
+
+// breakStaleLock removes the lock if its holder seems to have died.
+func (r *Repo) breakStaleLock(ctx context.Context) error {
+	kbfsOps := r.config.KBFSOps()
+	_, ei, err := kbfsOps.Lookup(ctx, r.dir, lockFileName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	age := r.config.Clock().Now().Sub(time.Unix(0, ei.Mtime))
+	if age < lockStaleAge {
+		return nil
+	}
+	r.log.CDebugf(ctx, "Breaking the lock of %s, last refreshed %s ago",
+		r.name, age)
+	err = kbfsOps.RemoveEntry(ctx, r.dir, lockFileName)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return nil
+	}
+	return err
+}
+
+// unlock removes the lock with the given token, unless it was broken
+// in the meantime and someone else has taken it.
+func (r *Repo) unlock(ctx context.Context, token string) error {
+	held, err := r.lockHeld(ctx, token)
+	if err != nil {
+		return err
+	}
+	if !held {
+		r.log.CWarningf(ctx, "The lock of %s was broken", r.name)
+		return nil
+	}
+	kbfsOps := r.config.KBFSOps()
+	if err := kbfsOps.RemoveEntry(ctx, r.dir, lockFileName); err != nil {
+		return err
+	}
+	return kbfsOps.WaitForWriteBack(ctx, r.dir.GetFolderBranch())
+}
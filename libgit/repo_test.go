@@ -0,0 +1,187 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libgit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseURL(t *testing.T) {
+	tlfName, public, repo, err := ParseURL("keybase://private/alice,bob/project")
+	require.NoError(t, err)
+	require.Equal(t, "alice,bob", tlfName)
+	require.False(t, public)
+	require.Equal(t, "project", repo)
+
+	_, public, _, err = ParseURL("keybase://public/alice/project")
+	require.NoError(t, err)
+	require.True(t, public)
+
+	for _, bad := range []string{"https://private/alice/project",
+		"keybase://secret/alice/project", "keybase://private/alice",
+		"keybase://private/alice/project/more"} {
+		_, _, _, err = ParseURL(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestRepoRefsAndPacks(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "alice")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	_, err := OpenRepo(ctx, config, "alice", false, "project", false)
+	require.IsType(t, libkbfs.NoSuchNameError{}, err)
+	_, err = OpenRepo(ctx, config, "alice", false, ".hidden", true)
+	require.IsType(t, InvalidRepoNameError{}, err)
+
+	repo, err := OpenRepo(ctx, config, "alice", false, "project", true)
+	require.NoError(t, err)
+	refs, head, err := repo.Refs(ctx)
+	require.NoError(t, err)
+	require.Len(t, refs, 0)
+	require.Equal(t, defaultHead, head)
+
+	newRefs := []Ref{
+		{Name: "refs/tags/v1", Hash: strings.Repeat("2", 40)},
+		{Name: "refs/heads/main", Hash: strings.Repeat("1", 40)},
+	}
+	require.NoError(t, repo.SetRefs(ctx, newRefs, "refs/heads/main"))
+	require.NoError(t, repo.AddPack(ctx, "pack-1",
+		bytes.NewReader([]byte("pack")), bytes.NewReader([]byte("idx"))))
+
+	// Another device sees the same repository.
+	config2 := libkbfs.ConfigAsUser(config, "alice")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+	repo2, err := OpenRepo(ctx, config2, "alice", false, "project", false)
+	require.NoError(t, err)
+	refs, head, err = repo2.Refs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Ref{newRefs[1], newRefs[0]}, refs)
+	require.Equal(t, "refs/heads/main", head)
+	packs, err := repo2.Packs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pack-1"}, packs)
+	var pack, idx bytes.Buffer
+	require.NoError(t, repo2.ReadPack(ctx, "pack-1", &pack, &idx))
+	require.Equal(t, "pack", pack.String())
+	require.Equal(t, "idx", idx.String())
+}
+
+func TestRepoLock(t *testing.T) {
+	ctx := context.Background()
+	config1 := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config1)
+	config2 := libkbfs.ConfigAsUser(config1, "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+
+	repo1, err := OpenRepo(ctx, config1, "alice,bob", false, "project", true)
+	require.NoError(t, err)
+	repo2, err := OpenRepo(ctx, config2, "alice,bob", false, "project", false)
+	require.NoError(t, err)
+
+	unlock, err := repo1.Lock(ctx)
+	require.NoError(t, err)
+
+	// bob can't take the lock while alice holds it.
+	ctx2, cancel := context.WithTimeout(ctx, 3*lockPollPeriod)
+	defer cancel()
+	_, err = repo2.Lock(ctx2)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, unlock())
+	unlock, err = repo2.Lock(ctx)
+	require.NoError(t, err)
+	require.NoError(t, unlock())
+
+	// bob lost the race for the lock, and his copy of it that
+	// conflict resolution moved aside is gone.
+	children, err := config2.KBFSOps().GetDirChildren(ctx, repo2.dir)
+	require.NoError(t, err)
+	for name := range children {
+		require.False(t, strings.HasPrefix(name, lockFileName), name)
+	}
+}
+
+func TestRepoLockRefresh(t *testing.T) {
+	ctx := context.Background()
+	config1 := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config1)
+	clock := &libkbfs.TestClock{}
+	clock.Set(time.Now())
+	config1.SetClock(clock)
+	config2 := libkbfs.ConfigAsUser(config1, "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config2)
+
+	repo1, err := OpenRepo(ctx, config1, "alice,bob", false, "project", true)
+	require.NoError(t, err)
+	repo2, err := OpenRepo(ctx, config2, "alice,bob", false, "project", false)
+	require.NoError(t, err)
+
+	token, err := makeLockToken()
+	require.NoError(t, err)
+	_, err = config1.KBFSOps().CreateLink(
+		ctx, repo1.dir, lockFileName, token)
+	require.NoError(t, err)
+	held, err := repo1.settleLock(ctx, token)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	// A lock that's been refreshed isn't stale, however long ago it
+	// was taken.
+	clock.Add(lockStaleAge - time.Minute)
+	require.NoError(t, repo1.refreshLock(ctx, token))
+	clock.Add(2 * time.Minute)
+	require.NoError(t, config2.KBFSOps().SyncFromServerForTesting(
+		ctx, repo2.dir.GetFolderBranch()))
+	require.NoError(t, repo2.breakStaleLock(ctx))
+	held, err = repo1.lockHeld(ctx, token)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	// Once its holder stops refreshing it, it's broken.
+	clock.Add(lockStaleAge)
+	require.NoError(t, repo2.breakStaleLock(ctx))
+	require.NoError(t, config1.KBFSOps().SyncFromServerForTesting(
+		ctx, repo1.dir.GetFolderBranch()))
+	held, err = repo1.lockHeld(ctx, token)
+	require.NoError(t, err)
+	require.False(t, held)
+	require.Error(t, repo1.refreshLock(ctx, token))
+}
+
+func TestRunnerList(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "alice")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	run := func(input string) string {
+		var output bytes.Buffer
+		r, err := NewRunner(config, "keybase://private/alice/project", "",
+			strings.NewReader(input), &output)
+		require.NoError(t, err)
+		require.NoError(t, r.Run(ctx))
+		return output.String()
+	}
+
+	require.Equal(t, "fetch\npush\n\n", run("capabilities\n"))
+	// A repository that doesn't exist yet has no refs.
+	require.Equal(t, "\n", run("list for-push\n"))
+
+	repo, err := OpenRepo(ctx, config, "alice", false, "project", true)
+	require.NoError(t, err)
+	hash := strings.Repeat("1", 40)
+	require.NoError(t, repo.SetRefs(ctx,
+		[]Ref{{Name: defaultHead, Hash: hash}}, defaultHead))
+	require.Equal(t, hash+" "+defaultHead+"\n@"+defaultHead+" HEAD\n\n",
+		run("list\n\n"))
+}
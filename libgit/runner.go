@@ -0,0 +1,495 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libgit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// URLScheme is the scheme of the URLs of repositories kept in KBFS,
+// which look like keybase://private/alice,bob/repo.
+const URLScheme = "keybase"
+
+// packHeaderSize is the size of a pack's header: a signature, a
+// version and the number of objects in it.
+const packHeaderSize = 12
+
+// ParseURL returns the top-level folder and repository named by a
+// keybase:// URL.
+func ParseURL(rawurl string) (tlfName string, public bool, repo string,
+	err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", false, "", err
+	}
+	if u.Scheme != URLScheme {
+		return "", false, "", fmt.Errorf("Not a %s URL: %s", URLScheme, rawurl)
+	}
+	switch u.Host {
+	case "private":
+	case "public":
+		public = true
+	default:
+		return "", false, "", fmt.Errorf(
+			"%s doesn't start with private or public", rawurl)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false, "", fmt.Errorf(
+			"%s doesn't name a folder and a repository", rawurl)
+	}
+	return parts[0], public, parts[1], nil
+}
+
+// Runner speaks git's remote helper protocol (see
+// gitremote-helpers(7)) for one keybase:// remote, as
+// git-remote-keybase.  It reads git's commands from its input and
+// answers on its output.
+//
+// The local side of each transfer is done by running git itself:
+// pushes send a pack of everything the remote is missing, made by
+// git pack-objects, and fetches copy the remote's packs straight into
+// the local repository.
+type Runner struct {
+	config  libkbfs.Config
+	log     logger.Logger
+	tlfName string
+	public  bool
+	name    string
+	gitDir  string
+	input   *bufio.Reader
+	output  io.Writer
+
+	repo *Repo
+}
+
+// NewRunner returns a Runner for the remote at the given URL, for
+// the local repository at gitDir.
+func NewRunner(config libkbfs.Config, rawurl string, gitDir string,
+	input io.Reader, output io.Writer) (*Runner, error) {
+	tlfName, public, name, err := ParseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{
+		config:  config,
+		log:     config.MakeLogger("GIT"),
+		tlfName: tlfName,
+		public:  public,
+		name:    name,
+		gitDir:  gitDir,
+		input:   bufio.NewReader(input),
+		output:  output,
+	}, nil
+}
+
+// getRepo returns the remote repository.  If it doesn't exist yet,
+// it returns nil unless create is true, in which case it's created.
+func (r *Runner) getRepo(ctx context.Context, create bool) (*Repo, error) {
+	if r.repo != nil {
+		return r.repo, nil
+	}
+	repo, err := OpenRepo(ctx, r.config, r.tlfName, r.public, r.name, create)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok && !create {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.repo = repo
+	return repo, nil
+}
+
+func (r *Runner) readLine() (string, error) {
+	line, err := r.input.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// readBatch returns the given first line of a batch of commands, and
+// the rest of the lines up to the blank one that ends it.
+func (r *Runner) readBatch(first string) ([]string, error) {
+	batch := []string{first}
+	for {
+		line, err := r.readLine()
+		if err == io.EOF || line == "" {
+			return batch, nil
+		} else if err != nil {
+			return nil, err
+		}
+		batch = append(batch, line)
+	}
+}
+
+// Run answers git's commands until git closes the input or sends a
+// blank line.
+func (r *Runner) Run(ctx context.Context) error {
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r.log.CDebugf(ctx, "Command: %q", line)
+		cmd := strings.Fields(line)
+		if len(cmd) == 0 {
+			return nil
+		}
+		switch cmd[0] {
+		case "capabilities":
+			_, err = io.WriteString(r.output, "fetch\npush\n\n")
+		case "list":
+			err = r.handleList(ctx)
+		case "fetch":
+			var batch []string
+			batch, err = r.readBatch(line)
+			if err == nil {
+				err = r.handleFetch(ctx, batch)
+			}
+		case "push":
+			var batch []string
+			batch, err = r.readBatch(line)
+			if err == nil {
+				err = r.handlePush(ctx, batch)
+			}
+		default:
+			err = fmt.Errorf("Unsupported command: %s", cmd[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleList lists the remote's refs, and its HEAD if it points to
+// one of them.
+func (r *Runner) handleList(ctx context.Context) error {
+	repo, err := r.getRepo(ctx, false)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if repo != nil {
+		refs, head, err := repo.Refs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			fmt.Fprintf(&buf, "%s %s\n", ref.Hash, ref.Name)
+			if ref.Name == head {
+				fmt.Fprintf(&buf, "@%s HEAD\n", head)
+			}
+		}
+	}
+	buf.WriteString("\n")
+	_, err = r.output.Write(buf.Bytes())
+	return err
+}
+
+// git runs git on the local repository, with the given input, and
+// returns what it printed.
+func (r *Runner) git(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", r.gitDir},
+		args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// hasObject returns true if the local repository has the given
+// object.
+func (r *Runner) hasObject(hash string) bool {
+	_, err := r.git(nil, "cat-file", "-e", hash)
+	return err == nil
+}
+
+// handleFetch copies every remote pack that the local repository
+// doesn't have yet into it.  Packs are never changed once they're
+// written, and their names are hashes of their contents, so a pack
+// with the same name is the same pack.
+func (r *Runner) handleFetch(ctx context.Context, batch []string) error {
+	repo, err := r.getRepo(ctx, false)
+	if err != nil {
+		return err
+	}
+	if repo == nil {
+		return fmt.Errorf("No repository named %s in %s", r.name, r.tlfName)
+	}
+	packs, err := repo.Packs(ctx)
+	if err != nil {
+		return err
+	}
+	localPackDir := filepath.Join(r.gitDir, "objects", "pack")
+	if err := os.MkdirAll(localPackDir, 0755); err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		packPath := filepath.Join(localPackDir, pack+packSuffix)
+		if _, err := os.Stat(packPath); err == nil {
+			continue
+		}
+		r.log.CDebugf(ctx, "Fetching %s", pack)
+		if err := r.fetchPack(ctx, repo, pack, localPackDir); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(r.output, "\n")
+	return err
+}
+
+// fetchPack copies one pack into the given local directory, moving
+// the pack and then its index into place only once both are
+// complete.
+func (r *Runner) fetchPack(ctx context.Context, repo *Repo, pack string,
+	localPackDir string) (err error) {
+	packFile, err := ioutil.TempFile(localPackDir, "tmp_kbfs_pack_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+	idxFile, err := ioutil.TempFile(localPackDir, "tmp_kbfs_idx_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(idxFile.Name())
+	defer idxFile.Close()
+
+	if err := repo.ReadPack(ctx, pack, packFile, idxFile); err != nil {
+		return err
+	}
+	if err := packFile.Close(); err != nil {
+		return err
+	}
+	if err := idxFile.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(packFile.Name(), filepath.Join(localPackDir,
+		pack+packSuffix))
+	if err != nil {
+		return err
+	}
+	return os.Rename(idxFile.Name(), filepath.Join(localPackDir,
+		pack+idxSuffix))
+}
+
+// refUpdate is one ref that git asked to push.
+type refUpdate struct {
+	src   string
+	dst   string
+	force bool
+	// hash is what src resolves to locally, or empty if dst is
+	// being deleted.
+	hash string
+}
+
+func parsePush(line string) (refUpdate, error) {
+	spec := strings.TrimPrefix(line, "push ")
+	var u refUpdate
+	if strings.HasPrefix(spec, "+") {
+		u.force = true
+		spec = spec[1:]
+	}
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return refUpdate{}, fmt.Errorf("Bad refspec: %s", spec)
+	}
+	u.src, u.dst = spec[:i], spec[i+1:]
+	return u, nil
+}
+
+// handlePush sends the objects the remote is missing as one new
+// pack, and then, holding the remote's lock, updates its refs.  Each
+// ref is reported as ok, or as an error if it would lose commits
+// and wasn't forced.
+func (r *Runner) handlePush(ctx context.Context, batch []string) error {
+	var updates []refUpdate
+	for _, line := range batch {
+		u, err := parsePush(line)
+		if err != nil {
+			return err
+		}
+		if u.src != "" {
+			out, err := r.git(nil, "rev-parse", "--verify", u.src)
+			if err != nil {
+				return err
+			}
+			u.hash = strings.TrimSpace(string(out))
+		}
+		updates = append(updates, u)
+	}
+
+	repo, err := r.getRepo(ctx, true)
+	if err != nil {
+		return err
+	}
+	unlock, err := repo.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := unlock(); unlockErr != nil {
+			r.log.CDebugf(ctx, "Couldn't unlock %s: %v", r.name, unlockErr)
+		}
+	}()
+
+	refs, head, err := repo.Refs(ctx)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		current[ref.Name] = ref.Hash
+	}
+
+	results := make(map[string]string)
+	var wants []string
+	for _, u := range updates {
+		if msg := r.checkUpdate(u, current[u.dst]); msg != "" {
+			results[u.dst] = msg
+			continue
+		}
+		if u.hash != "" {
+			wants = append(wants, u.hash)
+		}
+	}
+
+	if len(wants) > 0 {
+		if err := r.sendPack(ctx, repo, wants, refs); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range updates {
+		if _, ok := results[u.dst]; ok {
+			continue
+		}
+		if u.hash == "" {
+			delete(current, u.dst)
+		} else {
+			current[u.dst] = u.hash
+		}
+	}
+	newRefs := make([]Ref, 0, len(current))
+	for name, hash := range current {
+		newRefs = append(newRefs, Ref{Name: name, Hash: hash})
+	}
+	if _, ok := current[head]; !ok {
+		// Point a new repository's HEAD at the first branch
+		// pushed to it.
+		for _, u := range updates {
+			if u.hash != "" && strings.HasPrefix(u.dst, "refs/heads/") {
+				head = u.dst
+				break
+			}
+		}
+	}
+	if err := repo.SetRefs(ctx, newRefs, head); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, u := range updates {
+		if msg, ok := results[u.dst]; ok {
+			fmt.Fprintf(&buf, "error %s %s\n", u.dst, msg)
+		} else {
+			fmt.Fprintf(&buf, "ok %s\n", u.dst)
+		}
+	}
+	buf.WriteString("\n")
+	_, err = r.output.Write(buf.Bytes())
+	return err
+}
+
+// checkUpdate returns why the given update can't be made to a ref
+// currently pointing at old, or "" if it can.
+func (r *Runner) checkUpdate(u refUpdate, old string) string {
+	if !strings.HasPrefix(u.dst, "refs/") {
+		return "invalid ref name"
+	}
+	if u.force || old == "" || u.hash == "" || old == u.hash {
+		return ""
+	}
+	if !r.hasObject(old) {
+		return "fetch first"
+	}
+	_, err := r.git(nil, "merge-base", "--is-ancestor", old, u.hash)
+	if err != nil {
+		return "non-fast-forward"
+	}
+	return ""
+}
+
+// sendPack packs every object reachable from wants that isn't
+// reachable from the remote's current refs, and adds the pack to the
+// remote repository.
+func (r *Runner) sendPack(ctx context.Context, repo *Repo, wants []string,
+	haves []Ref) error {
+	dir, err := ioutil.TempDir("", "kbfsgit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var revs bytes.Buffer
+	for _, want := range wants {
+		fmt.Fprintf(&revs, "%s\n", want)
+	}
+	for _, have := range haves {
+		// Refs that the local repository hasn't fetched can't
+		// be used to leave objects out.
+		if r.hasObject(have.Hash) {
+			fmt.Fprintf(&revs, "^%s\n", have.Hash)
+		}
+	}
+	packData, err := r.git(&revs, "pack-objects", "--revs", "--stdout")
+	if err != nil {
+		return err
+	}
+	if len(packData) < packHeaderSize ||
+		binary.BigEndian.Uint32(packData[8:packHeaderSize]) == 0 {
+		r.log.CDebugf(ctx, "The remote already has every object")
+		return nil
+	}
+
+	packPath := filepath.Join(dir, "tmp"+packSuffix)
+	if err := ioutil.WriteFile(packPath, packData, 0600); err != nil {
+		return err
+	}
+	out, err := r.git(nil, "index-pack", packPath)
+	if err != nil {
+		return err
+	}
+	pack := "pack-" + strings.TrimSpace(string(out))
+	idxData, err := ioutil.ReadFile(filepath.Join(dir, "tmp"+idxSuffix))
+	if err != nil {
+		return err
+	}
+	r.log.CDebugf(ctx, "Sending %s", pack)
+	return repo.AddPack(ctx, pack, bytes.NewReader(packData),
+		bytes.NewReader(idxData))
+}
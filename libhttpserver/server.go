@@ -0,0 +1,325 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// CtxHTTPTagKey is the type used for unique context tags within
+// libhttpserver.
+type CtxHTTPTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxHTTPTagKey = iota
+)
+
+// CtxOpID is the display name for the unique operation HTTP ID tag.
+const CtxOpID = "HTTPID"
+
+// publicPrefix is the URL path under which public top-level folders
+// are served, by their names.
+const publicPrefix = "/public/"
+
+// Server is a read-only HTTP gateway to public top-level folders.  A
+// GET of /public/<folder>/<path> returns the file at that path, with
+// support for range requests and a content type detected from the
+// file's name or contents, or an HTML listing if the path is a
+// directory.  This lets browsers and media apps stream from KBFS
+// without a mount.  Adding ?archive=zip (or tar) to a directory's
+// URL downloads the whole directory as an archive instead.
+//
+// Private folders are never served, since anything on the machine
+// can make requests to the gateway.
+type Server struct {
+	config   libkbfs.Config
+	log      logger.Logger
+	listener net.Listener
+}
+
+// NewServer starts serving public folders of the given config on
+// the given address (e.g., "127.0.0.1:0").
+func NewServer(config libkbfs.Config, addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:   config,
+		log:      config.MakeLogger("HTTP"),
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(publicPrefix, s.servePublic)
+	go func() {
+		// Serve only returns once the listener is closed.
+		err := http.Serve(listener, mux)
+		s.log.CDebugf(nil, "HTTP gateway on %s stopped: %v", s.Addr(), err)
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// URL returns the URL under which the public folder with the given
+// name is served.
+func (s *Server) URL(tlfName string) string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   s.Addr(),
+		Path:   publicPrefix + tlfName + "/",
+	}).String()
+}
+
+// Shutdown stops the server.  Requests being served may still
+// finish.
+func (s *Server) Shutdown() {
+	s.listener.Close()
+}
+
+func (s *Server) withContext(ctx context.Context) context.Context {
+	logTags := make(logger.CtxLogTags)
+	logTags[CtxIDKey] = CtxOpID
+	ctx = logger.NewContextWithLogTags(ctx, logTags)
+	id, err := libkbfs.MakeRandomRequestID()
+	if err != nil {
+		s.log.Errorf("Couldn't make request ID: %v", err)
+	} else {
+		ctx = context.WithValue(ctx, CtxIDKey, id)
+	}
+	return ctx
+}
+
+func (s *Server) servePublic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := s.withContext(r.Context())
+	s.log.CDebugf(ctx, "%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+	// Clean the path, but keep any trailing slash, which says
+	// whether the client expects a directory.
+	p := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(p+"/", publicPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	names := strings.Split(strings.TrimPrefix(p+"/", publicPrefix), "/")
+	names = names[:len(names)-1]
+	if len(names) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	wantDir := strings.HasSuffix(r.URL.Path, "/")
+
+	kbfsOps := s.config.KBFSOps()
+	h, err := libkbfs.ParseTlfHandle(ctx, s.config.KBPKI(), names[0], true)
+	if nonCanon, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		// Send the client to the folder's canonical name.
+		target := publicPrefix + nonCanon.NameToTry + "/" +
+			strings.Join(names[1:], "/")
+		if wantDir && len(names) > 1 {
+			target += "/"
+		}
+		redirect(w, r, target, http.StatusFound)
+		return
+	} else if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+	node, ei, err := kbfsOps.GetOrCreateRootNode(ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+	for i, name := range names[1:] {
+		node, ei, err = kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			s.writeError(ctx, w, err)
+			return
+		}
+		if ei.Type == libkbfs.Sym {
+			s.serveSymlink(w, r, names[:i+1], ei.SymPath, names[i+2:])
+			return
+		}
+	}
+
+	if ei.Type == libkbfs.Dir {
+		if !wantDir {
+			redirect(w, r, p+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveDir(ctx, w, r, node, p)
+		return
+	}
+	if wantDir {
+		redirect(w, r, p, http.StatusMovedPermanently)
+		return
+	}
+	f := libfs.NewFileReadSeeker(ctx, kbfsOps, node, int64(ei.Size))
+	defer f.Close()
+	http.ServeContent(w, r, names[len(names)-1], time.Unix(0, ei.Mtime), f)
+}
+
+// redirect sends the client to the given unescaped path.
+func redirect(w http.ResponseWriter, r *http.Request, p string, code int) {
+	http.Redirect(w, r, (&url.URL{Path: p}).String(), code)
+}
+
+// serveSymlink redirects the client to the target of the symlink in
+// the directory given by dirNames, with the rest of the requested
+// path, rest, appended.  Symlinks in KBFS must stay within their
+// folder, so absolute targets aren't followed.
+func (s *Server) serveSymlink(w http.ResponseWriter, r *http.Request,
+	dirNames []string, symPath string, rest []string) {
+	if path.IsAbs(symPath) {
+		http.NotFound(w, r)
+		return
+	}
+	target := path.Join(publicPrefix+strings.Join(dirNames, "/"), symPath)
+	if !strings.HasPrefix(target+"/", publicPrefix+dirNames[0]+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	if len(rest) > 0 {
+		target = path.Join(target, strings.Join(rest, "/"))
+	}
+	if strings.HasSuffix(r.URL.Path, "/") {
+		target += "/"
+	}
+	redirect(w, r, target, http.StatusFound)
+}
+
+type dirListingEntry struct {
+	Name string
+	Href string
+	Size uint64
+	Time time.Time
+}
+
+var dirListingTemplate = template.Must(template.New("dir").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<p><a href="?archive=zip">Download as zip</a></p>
+<table>
+{{if .Parent}}<tr><td><a href="../">../</a></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (s *Server) serveDir(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, node libkbfs.Node, p string) {
+	if formatStr := r.URL.Query().Get("archive"); formatStr != "" {
+		s.serveArchive(ctx, w, r, node, p, formatStr)
+		return
+	}
+
+	children, err := s.config.KBFSOps().GetDirChildren(ctx, node)
+	if err != nil {
+		s.writeError(ctx, w, err)
+		return
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]dirListingEntry, 0, len(names))
+	for _, name := range names {
+		ei := children[name]
+		if ei.Type == libkbfs.Dir {
+			name += "/"
+		}
+		entries = append(entries, dirListingEntry{
+			Name: name,
+			Href: (&url.URL{Path: name}).String(),
+			Size: ei.Size,
+			Time: time.Unix(0, ei.Mtime),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	err = dirListingTemplate.Execute(w, struct {
+		Path    string
+		Parent  bool
+		Entries []dirListingEntry
+	}{
+		Path:    "/keybase" + p + "/",
+		Parent:  strings.Count(p, "/") > 2,
+		Entries: entries,
+	})
+	if err != nil {
+		s.log.CDebugf(ctx, "Couldn't send listing of %s: %v", p, err)
+	}
+}
+
+// serveArchive streams the directory at p as an archive in the
+// format with the given name.
+func (s *Server) serveArchive(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, node libkbfs.Node, p string, formatStr string) {
+	format, err := libfs.ParseArchiveFormat(formatStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := path.Base(p)
+	disposition := mime.FormatMediaType("attachment",
+		map[string]string{"filename": name + "." + format.String()})
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", disposition)
+	if r.Method == "HEAD" {
+		return
+	}
+	// Once the archive has started, there's no way to report an
+	// error other than cutting it short.
+	err = libfs.WriteArchive(ctx, s.config.KBFSOps(), node, name, format, w)
+	if err != nil {
+		s.log.CDebugf(ctx, "Couldn't send archive of %s: %v", p, err)
+	}
+}
+
+func (s *Server) writeError(
+	ctx context.Context, w http.ResponseWriter, err error) {
+	s.log.CDebugf(ctx, "Request failed: %v", err)
+	code := http.StatusInternalServerError
+	switch err.(type) {
+	case libkbfs.NoSuchNameError, libkbfs.BadTLFNameError,
+		libkbfs.NoSuchUserError:
+		code = http.StatusNotFound
+	case libkbfs.ReadAccessError:
+		code = http.StatusForbidden
+	}
+	http.Error(w, fmt.Sprintf("%d %s", code, http.StatusText(code)), code)
+}
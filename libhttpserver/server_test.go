@@ -0,0 +1,117 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func getOrBust(t *testing.T, url string, header http.Header) (
+	*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestServerPublic(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+	kbfsOps := config.KBFSOps()
+
+	rootNode := libkbfs.GetRootNodeOrBust(t, config, "alice", true)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "a b.html", false)
+	require.NoError(t, err)
+	data := []byte("<html><body>hello</body></html>")
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "link", "d")
+	require.NoError(t, err)
+
+	s, err := NewServer(config, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Shutdown()
+	base := s.URL("alice")
+
+	resp, body := getOrBust(t, base+"d/a%20b.html", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, string(data), body)
+	require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	resp, body = getOrBust(t, base+"d/a%20b.html",
+		http.Header{"Range": {"bytes=6-11"}})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, string(data[6:12]), body)
+
+	// Directories are listed, and must end with a slash.
+	resp, _ = getOrBust(t, base+"d", nil)
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, "/public/alice/d/", resp.Header.Get("Location"))
+	resp, body = getOrBust(t, base, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.Contains(body, `<a href="d/">d/</a>`), body)
+	require.True(t, strings.Contains(body, `<a href="link">link</a>`), body)
+	resp, body = getOrBust(t, base+"d/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.Contains(body, `<a href="a%20b.html">`), body)
+
+	// Directories can be downloaded as archives.
+	resp, body = getOrBust(t, base+"d/?archive=zip", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	require.Equal(t, `attachment; filename=d.zip`,
+		resp.Header.Get("Content-Disposition"))
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	require.Equal(t, "d/", zr.File[0].Name)
+	require.Equal(t, "d/a b.html", zr.File[1].Name)
+	resp, _ = getOrBust(t, base+"d/?archive=rar", nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Symlinks redirect to their targets.
+	resp, _ = getOrBust(t, base+"link/a%20b.html", nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/public/alice/d/a%20b.html", resp.Header.Get("Location"))
+
+	// Non-canonical names redirect to canonical ones.
+	resp, _ = getOrBust(t, s.URL("bob,alice"), nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/public/alice,bob/", resp.Header.Get("Location"))
+
+	resp, _ = getOrBust(t, base+"missing", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Private folders aren't served.
+	resp, _ = getOrBust(
+		t, strings.Replace(base, "/public/", "/private/", 1), nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Nothing can be written.
+	resp, err = http.Post(base+"new", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// activityWindowDefault is how far back ActivityMonitor adds up each
+// writer's activity in a folder, by default.
+const activityWindowDefault = 5 * time.Minute
+
+// ActivityAnomaly describes a burst of activity by one writer in a
+// shared folder that looks like the work of malware on that writer's
+// machine.
+type ActivityAnomaly struct {
+	Writer keybase1.UID
+	// Deletions is how many entries the writer deleted recently,
+	// and Rewrites is how many existing files it rewrote from the
+	// start, or renamed to a different extension.
+	Deletions int
+	Rewrites  int
+	// Since is the first revision that's part of the burst.
+	Since MetadataRevision
+}
+
+// ActivityLimits are the limits past which an ActivityMonitor
+// considers one writer's activity in a folder anomalous.
+type ActivityLimits struct {
+	// Deletions and Rewrites are how many entries one writer may
+	// delete, and how many existing files one writer may rewrite,
+	// within Window.  Zero means no limit.
+	Deletions int
+	Rewrites  int
+	// Window is how far back activity is added up.  Zero means
+	// activityWindowDefault.
+	Window time.Duration
+}
+
+type activityRecord struct {
+	when      time.Time
+	rev       MetadataRevision
+	deletions int
+	rewrites  int
+}
+
+// folderActivity is the recent activity in one folder.
+type folderActivity struct {
+	writers map[keybase1.UID][]activityRecord
+	// created holds the current pointers of recently-created files,
+	// and rewritten those of files that have already been counted
+	// as rewritten, so that writing to them doesn't count (again).
+	created   map[BlockPointer]time.Time
+	rewritten map[BlockPointer]time.Time
+}
+
+// ActivityMonitor is an AnomalyDetector that adds up how many entries
+// each writer has recently deleted from a shared folder, and how many
+// existing files it has rewritten from the start (which is what
+// ransomware encrypting files in place looks like), and reports an
+// anomaly once either goes past its limits.  Only the folder's MD is
+// inspected, never the file contents.
+type ActivityMonitor struct {
+	limits ActivityLimits
+	clock  Clock
+
+	lock    sync.Mutex
+	folders map[TlfID]*folderActivity
+}
+
+var _ AnomalyDetector = (*ActivityMonitor)(nil)
+
+// NewActivityMonitor returns an ActivityMonitor with the given limits.
+func NewActivityMonitor(limits ActivityLimits, clock Clock) *ActivityMonitor {
+	if limits.Window == 0 {
+		limits.Window = activityWindowDefault
+	}
+	return &ActivityMonitor{
+		limits:  limits,
+		clock:   clock,
+		folders: make(map[TlfID]*folderActivity),
+	}
+}
+
+// forgetOldLocked forgets everything in fa from before the window
+// ending at now.
+func (m *ActivityMonitor) forgetOldLocked(fa *folderActivity, now time.Time) {
+	for writer, records := range fa.writers {
+		var kept []activityRecord
+		for _, r := range records {
+			if now.Sub(r.when) < m.limits.Window {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(fa.writers, writer)
+		} else {
+			fa.writers[writer] = kept
+		}
+	}
+	for _, ptrs := range []map[BlockPointer]time.Time{
+		fa.created, fa.rewritten} {
+		for ptr, when := range ptrs {
+			if now.Sub(when) >= m.limits.Window {
+				delete(ptrs, ptr)
+			}
+		}
+	}
+}
+
+// isRewrite returns true if the given sync rewrote the file from the
+// start.
+func isRewrite(so *syncOp) bool {
+	for _, w := range so.Writes {
+		if w.Off == 0 && !w.isTruncate() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUpdate implements the AnomalyDetector interface for
+// ActivityMonitor.
+func (m *ActivityMonitor) CheckUpdate(ctx context.Context, tlf TlfID,
+	md *RootMetadata) *ActivityAnomaly {
+	now := m.clock.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fa, ok := m.folders[tlf]
+	if !ok {
+		fa = &folderActivity{
+			writers:   make(map[keybase1.UID][]activityRecord),
+			created:   make(map[BlockPointer]time.Time),
+			rewritten: make(map[BlockPointer]time.Time),
+		}
+		m.folders[tlf] = fa
+	}
+	m.forgetOldLocked(fa, now)
+
+	record := activityRecord{when: now, rev: md.Revision}
+	for _, op := range md.data.Changes.Ops {
+		switch realOp := op.(type) {
+		case *createOp:
+			for _, ptr := range realOp.Refs() {
+				fa.created[ptr] = now
+			}
+		case *rmOp:
+			record.deletions++
+		case *renameOp:
+			if filepath.Ext(realOp.OldName) !=
+				filepath.Ext(realOp.NewName) {
+				record.rewrites++
+			}
+		case *syncOp:
+			file := realOp.File
+			if _, ok := fa.created[file.Unref]; ok {
+				delete(fa.created, file.Unref)
+				fa.created[file.Ref] = now
+			} else if _, ok := fa.rewritten[file.Unref]; ok {
+				delete(fa.rewritten, file.Unref)
+				fa.rewritten[file.Ref] = now
+			} else if isRewrite(realOp) {
+				fa.rewritten[file.Ref] = now
+				record.rewrites++
+			}
+		}
+	}
+	if record.deletions == 0 && record.rewrites == 0 {
+		return nil
+	}
+
+	writer := md.LastModifyingWriter
+	fa.writers[writer] = append(fa.writers[writer], record)
+	anomaly := ActivityAnomaly{Writer: writer, Since: record.rev}
+	for _, r := range fa.writers[writer] {
+		anomaly.Deletions += r.deletions
+		anomaly.Rewrites += r.rewrites
+		if r.rev < anomaly.Since {
+			anomaly.Since = r.rev
+		}
+	}
+	if (m.limits.Deletions > 0 && anomaly.Deletions > m.limits.Deletions) ||
+		(m.limits.Rewrites > 0 && anomaly.Rewrites > m.limits.Rewrites) {
+		return &anomaly
+	}
+	return nil
+}
+
+// ResetFolder implements the AnomalyDetector interface for
+// ActivityMonitor.
+func (m *ActivityMonitor) ResetFolder(tlf TlfID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.folders, tlf)
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeActivityMD(rev MetadataRevision, writer keybase1.UID,
+	ops ...op) *RootMetadata {
+	md := &RootMetadata{}
+	md.Revision = rev
+	md.LastModifyingWriter = writer
+	for _, o := range ops {
+		md.AddOp(o)
+	}
+	return md
+}
+
+func makeActivitySyncOp(from, to byte) *syncOp {
+	so := newSyncOp(BlockPointer{ID: fakeBlockID(from)})
+	so.File.Ref = BlockPointer{ID: fakeBlockID(to)}
+	so.Writes = []WriteRange{{Off: 0, Len: 10}}
+	return so
+}
+
+func TestActivityMonitorDeletions(t *testing.T) {
+	clock := newTestClockNow()
+	m := NewActivityMonitor(ActivityLimits{Deletions: 2}, clock)
+	ctx := context.Background()
+	tlf := FakeTlfID(1, false)
+	u1, u2 := keybase1.MakeTestUID(1), keybase1.MakeTestUID(2)
+	dir := BlockPointer{ID: fakeBlockID(1)}
+
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(1, u1, newRmOp("a", dir))))
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(2, u1, newRmOp("b", dir))))
+	// Other writers are counted separately.
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(3, u2, newRmOp("c", dir))))
+	anomaly := m.CheckUpdate(ctx, tlf,
+		makeActivityMD(4, u1, newRmOp("d", dir)))
+	require.Equal(t, &ActivityAnomaly{u1, 3, 0, 1}, anomaly)
+
+	// Old activity is forgotten.
+	clock.Add(activityWindowDefault)
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(5, u1, newRmOp("e", dir))))
+
+	m.ResetFolder(tlf)
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(6, u1, newRmOp("f", dir), newRmOp("g", dir))))
+}
+
+func TestActivityMonitorRewrites(t *testing.T) {
+	m := NewActivityMonitor(ActivityLimits{Rewrites: 1}, newTestClockNow())
+	ctx := context.Background()
+	tlf := FakeTlfID(1, false)
+	u1 := keybase1.MakeTestUID(1)
+	dir := BlockPointer{ID: fakeBlockID(1)}
+
+	// Writing new files doesn't count.
+	co := newCreateOp("new", dir, File)
+	co.AddRefBlock(BlockPointer{ID: fakeBlockID(10)})
+	require.Nil(t, m.CheckUpdate(ctx, tlf, makeActivityMD(1, u1, co)))
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(2, u1, makeActivitySyncOp(10, 11))))
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(3, u1, makeActivitySyncOp(11, 12))))
+
+	// Rewriting an existing file counts once, however many times
+	// it's written.
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(4, u1, makeActivitySyncOp(20, 21))))
+	require.Nil(t, m.CheckUpdate(ctx, tlf,
+		makeActivityMD(5, u1, makeActivitySyncOp(21, 22))))
+
+	// Appending doesn't count.
+	so := makeActivitySyncOp(30, 31)
+	so.Writes = []WriteRange{{Off: 100, Len: 10}}
+	require.Nil(t, m.CheckUpdate(ctx, tlf, makeActivityMD(6, u1, so)))
+
+	// Neither does renaming a file without changing its extension.
+	require.Nil(t, m.CheckUpdate(ctx, tlf, makeActivityMD(7, u1,
+		newRenameOp("a.doc", dir, "b.doc", dir, BlockPointer{}, File))))
+	anomaly := m.CheckUpdate(ctx, tlf, makeActivityMD(8, u1,
+		newRenameOp("a.doc", dir, "a.doc.locked", dir, BlockPointer{},
+			File)))
+	require.Equal(t, &ActivityAnomaly{u1, 0, 2, 4}, anomaly)
+}
@@ -0,0 +1,267 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// bandwidthBurst is how far ahead of its cap the traffic in either
+// direction may get, e.g. after being idle.
+const bandwidthBurst = time.Second
+
+// BandwidthWindow caps the traffic to and from the servers during a
+// daily window of local time.
+type BandwidthWindow struct {
+	// Start and End are the offsets of the window from midnight.
+	// A window with an End before its Start wraps past midnight,
+	// and one with an End equal to its Start lasts all day.
+	Start time.Duration
+	End   time.Duration
+	// UpBytesPerSec and DownBytesPerSec are the caps on uploads
+	// and downloads during the window.  Zero means no cap.
+	UpBytesPerSec   int64
+	DownBytesPerSec int64
+}
+
+func (w BandwidthWindow) contains(offset time.Duration) bool {
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	} else if w.Start > w.End {
+		return offset >= w.Start || offset < w.End
+	}
+	return true
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", d/time.Hour, (d%time.Hour)/time.Minute)
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String implements the fmt.Stringer interface for BandwidthWindow.
+func (w BandwidthWindow) String() string {
+	s := formatTimeOfDay(w.Start) + "-" + formatTimeOfDay(w.End)
+	if w.UpBytesPerSec > 0 {
+		s += " up=" + SizeFlag{&w.UpBytesPerSec}.String()
+	}
+	if w.DownBytesPerSec > 0 {
+		s += " down=" + SizeFlag{&w.DownBytesPerSec}.String()
+	}
+	return s
+}
+
+// BandwidthSchedule is a list of BandwidthWindows, of which the first
+// one holding the current time of day applies.  There's no cap
+// outside of all of them.
+type BandwidthSchedule []BandwidthWindow
+
+// ParseBandwidthSchedule parses a comma-separated list of windows,
+// each given as "HH:MM-HH:MM [up=SIZE] [down=SIZE]", where the sizes
+// are in bytes per second, e.g. "09:00-17:00 up=1m down=4m".  An
+// empty string means no cap at all.
+func ParseBandwidthSchedule(s string) (BandwidthSchedule, error) {
+	var schedule BandwidthSchedule
+	for _, str := range strings.Split(s, ",") {
+		fields := strings.Fields(str)
+		if len(fields) == 0 {
+			continue
+		}
+		times := strings.SplitN(fields[0], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Bandwidth window %q doesn't start "+
+				"with HH:MM-HH:MM", str)
+		}
+		var w BandwidthWindow
+		var err error
+		w.Start, err = parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		w.End, err = parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Unknown bandwidth cap %q", field)
+			}
+			switch kv[0] {
+			case "up":
+				err = SizeFlag{&w.UpBytesPerSec}.Set(kv[1])
+			case "down":
+				err = SizeFlag{&w.DownBytesPerSec}.Set(kv[1])
+			default:
+				err = fmt.Errorf("Unknown bandwidth cap %q", field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+// String implements the fmt.Stringer interface for
+// BandwidthSchedule, in the form parsed by ParseBandwidthSchedule.
+func (s BandwidthSchedule) String() string {
+	strs := make([]string, len(s))
+	for i, w := range s {
+		strs[i] = w.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// caps returns the upload and download caps in effect at the given
+// time.
+func (s BandwidthSchedule) caps(t time.Time) (up, down int64) {
+	h, m, sec := t.Clock()
+	offset := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second
+	for _, w := range s {
+		if w.contains(offset) {
+			return w.UpBytesPerSec, w.DownBytesPerSec
+		}
+	}
+	return 0, 0
+}
+
+// bandwidthBucket paces the traffic in one direction.
+type bandwidthBucket struct {
+	// next is when the traffic reserved so far would be done at
+	// the current cap.
+	next time.Time
+}
+
+// reserve claims n bytes of traffic at the given cap, and returns
+// how long the caller must wait before sending or receiving any
+// more.
+func (b *bandwidthBucket) reserve(
+	now time.Time, n int, bytesPerSec int64) time.Duration {
+	if bytesPerSec <= 0 {
+		b.next = time.Time{}
+		return 0
+	}
+	if b.next.Before(now) {
+		b.next = now
+	}
+	var delay time.Duration
+	if ahead := b.next.Sub(now) - bandwidthBurst; ahead > 0 {
+		delay = ahead
+	}
+	b.next = b.next.Add(
+		time.Duration(int64(n) * int64(time.Second) / bytesPerSec))
+	return delay
+}
+
+// BandwidthSchedulerStandard implements the BandwidthScheduler
+// interface, pacing the traffic in each direction with a token
+// bucket whose rate follows the schedule.
+type BandwidthSchedulerStandard struct {
+	config Config
+
+	lock     sync.Mutex
+	schedule BandwidthSchedule
+	up       bandwidthBucket
+	down     bandwidthBucket
+}
+
+var _ BandwidthScheduler = (*BandwidthSchedulerStandard)(nil)
+
+// NewBandwidthSchedulerStandard returns a new
+// BandwidthSchedulerStandard with no caps.
+func NewBandwidthSchedulerStandard(config Config) *BandwidthSchedulerStandard {
+	return &BandwidthSchedulerStandard{config: config}
+}
+
+// Schedule implements the BandwidthScheduler interface for
+// BandwidthSchedulerStandard.
+func (b *BandwidthSchedulerStandard) Schedule() BandwidthSchedule {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.schedule
+}
+
+// SetSchedule implements the BandwidthScheduler interface for
+// BandwidthSchedulerStandard.
+func (b *BandwidthSchedulerStandard) SetSchedule(
+	schedule BandwidthSchedule) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.schedule = schedule
+}
+
+// reserve claims n bytes of traffic in the given direction, and
+// returns how long the caller must wait.
+func (b *BandwidthSchedulerStandard) reserve(n int, up bool) time.Duration {
+	now := b.config.Clock().Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	upCap, downCap := b.schedule.caps(now)
+	if up {
+		return b.up.reserve(now, n, upCap)
+	}
+	return b.down.reserve(now, n, downCap)
+}
+
+func (b *BandwidthSchedulerStandard) wait(
+	ctx context.Context, n int, up bool) error {
+	delay := b.reserve(n, up)
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitToSend implements the BandwidthScheduler interface for
+// BandwidthSchedulerStandard.
+func (b *BandwidthSchedulerStandard) WaitToSend(
+	ctx context.Context, n int) error {
+	return b.wait(ctx, n, true)
+}
+
+// WaitToReceive implements the BandwidthScheduler interface for
+// BandwidthSchedulerStandard.
+func (b *BandwidthSchedulerStandard) WaitToReceive(
+	ctx context.Context, n int) error {
+	return b.wait(ctx, n, false)
+}
+
+// waitToSend waits on config's BandwidthScheduler, if any, before n
+// bytes are sent to a server.
+func waitToSend(ctx context.Context, config Config, n int) error {
+	if bw := config.BandwidthScheduler(); bw != nil {
+		return bw.WaitToSend(ctx, n)
+	}
+	return nil
+}
+
+// waitToReceive waits on config's BandwidthScheduler, if any, after n
+// bytes are received from a server.
+func waitToReceive(ctx context.Context, config Config, n int) error {
+	if bw := config.BandwidthScheduler(); bw != nil {
+		return bw.WaitToReceive(ctx, n)
+	}
+	return nil
+}
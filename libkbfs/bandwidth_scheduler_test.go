@@ -0,0 +1,101 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule(
+		"09:00-17:30 up=1m down=2mi, 22:00-06:00 down=500k,")
+	require.NoError(t, err)
+	require.Equal(t, BandwidthSchedule{
+		{
+			Start:           9 * time.Hour,
+			End:             17*time.Hour + 30*time.Minute,
+			UpBytesPerSec:   1000 * 1000,
+			DownBytesPerSec: 2 * 1024 * 1024,
+		},
+		{
+			Start:           22 * time.Hour,
+			End:             6 * time.Hour,
+			DownBytesPerSec: 500 * 1000,
+		},
+	}, schedule)
+	require.Equal(t, "09:00-17:30 up=1m down=2mi, 22:00-06:00 down=500k",
+		schedule.String())
+
+	schedule, err = ParseBandwidthSchedule("")
+	require.NoError(t, err)
+	require.Nil(t, schedule)
+
+	for _, bad := range []string{
+		"09:00 up=1m",
+		"09:00-25:00 up=1m",
+		"09:00-17:00 sideways=1m",
+		"09:00-17:00 up=fast",
+	} {
+		_, err := ParseBandwidthSchedule(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestBandwidthScheduleCaps(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule(
+		"09:00-17:00 up=1m down=2m, 22:00-06:00 up=3m")
+	require.NoError(t, err)
+	at := func(h, m int) time.Time {
+		return time.Date(2016, 11, 1, h, m, 0, 0, time.Local)
+	}
+	check := func(t0 time.Time, up, down int64) {
+		actualUp, actualDown := schedule.caps(t0)
+		require.Equal(t, up, actualUp, "%s", t0)
+		require.Equal(t, down, actualDown, "%s", t0)
+	}
+	check(at(8, 59), 0, 0)
+	check(at(9, 0), 1000*1000, 2000*1000)
+	check(at(16, 59), 1000*1000, 2000*1000)
+	check(at(17, 0), 0, 0)
+	check(at(23, 0), 3000*1000, 0)
+	check(at(5, 59), 3000*1000, 0)
+}
+
+func TestBandwidthSchedulerReserve(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	clock := &TestClock{}
+	clock.Set(time.Date(2016, 11, 1, 12, 0, 0, 0, time.Local))
+	config.SetClock(clock)
+
+	b := NewBandwidthSchedulerStandard(config)
+	// Nothing is capped without a schedule.
+	require.Equal(t, time.Duration(0), b.reserve(1<<30, true))
+
+	schedule, err := ParseBandwidthSchedule("09:00-17:00 up=1k down=2k")
+	require.NoError(t, err)
+	b.SetSchedule(schedule)
+
+	// The first second's worth goes through right away.
+	require.Equal(t, time.Duration(0), b.reserve(1000, true))
+	require.Equal(t, time.Duration(0), b.reserve(1000, true))
+	require.Equal(t, time.Second, b.reserve(1000, true))
+	require.Equal(t, 2*time.Second, b.reserve(500, true))
+	// Downloads are paced separately.
+	require.Equal(t, time.Duration(0), b.reserve(4000, false))
+	require.Equal(t, time.Second, b.reserve(2000, false))
+
+	// The cap catches up with time.
+	clock.Add(10 * time.Second)
+	require.Equal(t, time.Duration(0), b.reserve(1000, true))
+
+	// Outside of the window, nothing is capped.
+	clock.Set(time.Date(2016, 11, 1, 18, 0, 0, 0, time.Local))
+	require.Equal(t, time.Duration(0), b.reserve(1<<30, true))
+	require.Equal(t, time.Duration(0), b.reserve(1<<30, true))
+}
@@ -9,8 +9,14 @@ import (
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
+// blockCacheMaxTransientEntries is the most transient entries a
+// BlockCacheStandard can ever be allowed to hold.
+const blockCacheMaxTransientEntries = 1 << 24
+
 type idCacheKey struct {
 	tlf           TlfID
 	plaintextHash RawDefaultHash
@@ -19,20 +25,83 @@ type idCacheKey struct {
 // BlockCacheStandard implements the BlockCache interface by storing
 // blocks in an in-memory LRU cache.  Clean blocks are identified
 // internally by just their block ID (since blocks are immutable and
-// content-addressable).
+// content-addressable), and each ID has at most one entry across all
+// of the partitions below, so that every branch or revision that
+// reads a block shares the same copy.
 type BlockCacheStandard struct {
 	config             Config
 	cleanBytesCapacity uint64
 
 	ids *lru.Cache
 
-	cleanTransient *lru.Cache
+	// transientLock protects cleanTransient and the admission
+	// window.
+	transientLock       sync.Mutex
+	cleanTransient      *simplelru.LRU
+	transientTotalBytes uint64
 
 	cleanLock      sync.RWMutex
 	cleanPermanent map[BlockID]Block
+	// transientTlfs holds the TLF of each permanent block that is
+	// also being read as a transient one, so that it goes back to
+	// being transient once it's no longer permanent.
+	transientTlfs map[BlockID]TlfID
 
 	bytesLock       sync.Mutex
 	cleanTotalBytes uint64
+
+	// transientCapacity is the number of entries the cache was
+	// created with, and transientLimit (protected by
+	// transientLock) is the number it's currently allowed to hold.
+	transientCapacity int
+	transientLimit    int
+
+	// Transient blocks of pinned TLFs live in their own partition,
+	// so that they don't get evicted by traffic to other TLFs.
+	// Its bytes come out of the cache's clean bytes capacity.
+	pinLock             sync.Mutex
+	pinnedTlfs          map[TlfID]bool
+	pinnedBytesCapacity uint64
+	pinnedTotalBytes    uint64
+	cleanPinned         *simplelru.LRU
+
+	// admission is nil unless admission control is enabled, in
+	// which case blocks that aren't admitted into a full
+	// cleanTransient go in window instead.
+	admission           *blockCacheAdmission
+	window              *simplelru.LRU
+	windowBytesCapacity uint64
+	windowTotalBytes    uint64
+
+	// Transient directory blocks and indirect file blocks live in
+	// their own partition when it's enabled, so that reading lots
+	// of file data can't evict the blocks needed to browse
+	// directories and find file contents.
+	metaLock          sync.Mutex
+	metaBytesCapacity uint64
+	metaTotalBytes    uint64
+	cleanMetadata     *simplelru.LRU
+
+	// Transient blocks pinned with PinBlock live outside of the
+	// LRUs until they're unpinned as many times as they were
+	// pinned.  blockPins also counts the pins of blocks that
+	// aren't cached yet.
+	blockPinLock      sync.Mutex
+	blockPins         map[BlockID]int
+	pinnedBlocks      map[BlockID]pinnedCacheEntry
+	pinnedBlocksBytes uint64
+
+	// limitsLock serializes the changes to how the clean bytes
+	// capacity is split between the partitions.
+	limitsLock sync.Mutex
+
+	hits   metrics.Counter
+	misses metrics.Counter
+}
+
+type pinnedCacheEntry struct {
+	tlf   TlfID
+	block Block
 }
 
 // NewBlockCacheStandard constructs a new BlockCacheStandard instance
@@ -47,6 +116,13 @@ func NewBlockCacheStandard(config Config, transientCapacity int,
 		config:             config,
 		cleanBytesCapacity: cleanBytesCapacity,
 		cleanPermanent:     make(map[BlockID]Block),
+		transientTlfs:      make(map[BlockID]TlfID),
+		blockPins:          make(map[BlockID]int),
+		pinnedBlocks:       make(map[BlockID]pinnedCacheEntry),
+		transientCapacity:  transientCapacity,
+		transientLimit:     transientCapacity,
+		hits:               metrics.NewCounter(),
+		misses:             metrics.NewCounter(),
 	}
 
 	if transientCapacity > 0 {
@@ -57,7 +133,10 @@ func NewBlockCacheStandard(config Config, transientCapacity int,
 			return nil
 		}
 
-		b.cleanTransient, err = lru.NewWithEvict(transientCapacity, b.onEvict)
+		// The number of entries is limited by putTransient
+		// instead, so that SetCacheLimits can change it.
+		b.cleanTransient, err = simplelru.NewLRU(
+			blockCacheMaxTransientEntries, b.onEvict)
 		if err != nil {
 			return nil
 		}
@@ -65,19 +144,131 @@ func NewBlockCacheStandard(config Config, transientCapacity int,
 	return b
 }
 
+func newBlockCacheCounter(name string, r metrics.Registry) metrics.Counter {
+	if r == nil {
+		return metrics.NewCounter()
+	}
+	return metrics.GetOrRegisterCounter(name, r)
+}
+
+// registerMetrics makes this cache count its hits and misses in the
+// given registry.  Since the counters are shared by name, the counts
+// carry over to any cache that replaces this one.  This must be
+// called before the cache is used.
+func (b *BlockCacheStandard) registerMetrics(r metrics.Registry) {
+	b.hits = newBlockCacheCounter("BlockCache.Hits", r)
+	b.misses = newBlockCacheCounter("BlockCache.Misses", r)
+}
+
+// EnableAdmissionControl turns on admission control for the
+// transient entries of this cache: once the cache is full, a block
+// only gets in if it has been used at least as often as the block it
+// would evict (see blockCacheAdmission).  Blocks that don't get in
+// are kept in a small window on the side, taking 1% of the cache's
+// clean bytes capacity, so a block that's read a piece at a time
+// isn't fetched again for every piece.  Blocks written by this
+// device (see TransientLocalEntry) always get in.  If r is non-nil,
+// the admission stats are registered with it.  This must be called
+// before the cache is used.
+func (b *BlockCacheStandard) EnableAdmissionControl(r metrics.Registry) {
+	if b.transientCapacity <= 0 {
+		return
+	}
+	b.admission = newBlockCacheAdmission(b.transientCapacity, r)
+	windowCapacity := b.transientCapacity / 100
+	if windowCapacity < 1 {
+		windowCapacity = 1
+	}
+	// This can only fail for a non-positive size.
+	b.window, _ = simplelru.NewLRU(windowCapacity, b.onEvictWindow)
+	b.windowBytesCapacity = b.cleanBytesCapacity / 100
+	b.cleanBytesCapacity -= b.windowBytesCapacity
+}
+
+// EnableMetadataPartition reserves bytesCapacity bytes of this
+// cache's clean bytes capacity for transient directory blocks and
+// indirect file blocks, which then only compete with each other for
+// space.  This must be called before the cache is used.
+func (b *BlockCacheStandard) EnableMetadataPartition(bytesCapacity uint64) {
+	if b.transientCapacity <= 0 || bytesCapacity == 0 {
+		return
+	}
+	if bytesCapacity > b.cleanBytesCapacity {
+		bytesCapacity = b.cleanBytesCapacity
+	}
+	b.cleanBytesCapacity -= bytesCapacity
+	b.metaBytesCapacity = bytesCapacity
+	// This can only fail for a non-positive size.
+	b.cleanMetadata, _ = simplelru.NewLRU(
+		b.transientCapacity, b.onEvictMetadata)
+}
+
+// AdmissionStats returns the stats of this cache's admission
+// control, and false if admission control isn't enabled.
+func (b *BlockCacheStandard) AdmissionStats() (
+	BlockCacheAdmissionStats, bool) {
+	if b.admission == nil {
+		return BlockCacheAdmissionStats{}, false
+	}
+	stats := b.admission.stats()
+	stats.Hits = b.hits.Count()
+	stats.Misses = b.misses.Count()
+	return stats, true
+}
+
+func (b *BlockCacheStandard) getTransient(id BlockID) (Block, bool, error) {
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	tmp, ok := b.cleanTransient.Get(id)
+	if !ok && b.window != nil {
+		tmp, ok = b.window.Get(id)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	block, ok := tmp.(Block)
+	if !ok {
+		return nil, false, BadDataError{id}
+	}
+	return block, true, nil
+}
+
 // Get implements the BlockCache interface for BlockCacheStandard.
-func (b *BlockCacheStandard) Get(ptr BlockPointer) (Block, error) {
+func (b *BlockCacheStandard) Get(ptr BlockPointer) (block Block, err error) {
+	defer func() {
+		if err == nil {
+			b.hits.Inc(1)
+		} else {
+			b.misses.Inc(1)
+		}
+		if b.admission != nil {
+			b.admission.access(ptr.ID)
+		}
+	}()
+
 	if b.cleanTransient != nil {
-		if tmp, ok := b.cleanTransient.Get(ptr.ID); ok {
-			block, ok := tmp.(Block)
-			if !ok {
-				return nil, BadDataError{ptr.ID}
-			}
+		block, ok, err := b.getTransient(ptr.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
 			return block, nil
 		}
 	}
 
-	block := func() Block {
+	if block, ok := b.getMetadata(ptr.ID); ok {
+		return block, nil
+	}
+
+	if block, ok := b.getPinned(ptr.ID); ok {
+		return block, nil
+	}
+
+	if block, ok := b.getPinnedBlock(ptr.ID); ok {
+		return block, nil
+	}
+
+	block = func() Block {
 		b.cleanLock.RLock()
 		defer b.cleanLock.RUnlock()
 		return b.cleanPermanent[ptr.ID]
@@ -110,9 +301,21 @@ func (b *BlockCacheStandard) onEvict(key interface{}, value interface{}) {
 		return
 	}
 
+	// Called with transientLock held.
+	size := uint64(getCachedBlockSize(block))
+	b.transientTotalBytes -= size
 	b.bytesLock.Lock()
 	defer b.bytesLock.Unlock()
-	b.cleanTotalBytes -= uint64(getCachedBlockSize(block))
+	b.cleanTotalBytes -= size
+}
+
+func (b *BlockCacheStandard) onEvictWindow(key interface{}, value interface{}) {
+	block, ok := value.(Block)
+	if !ok {
+		return
+	}
+	// Called with transientLock held.
+	b.windowTotalBytes -= uint64(getCachedBlockSize(block))
 }
 
 // CheckForKnownPtr implements the BlockCache interface for BlockCacheStandard.
@@ -141,11 +344,30 @@ func (b *BlockCacheStandard) CheckForKnownPtr(tlf TlfID, block *FileBlock) (
 	return ptr, nil
 }
 
+// admitLocked returns whether the given block should evict the
+// least-recently-used transient entry.
+func (b *BlockCacheStandard) admitLocked(candidate BlockID) bool {
+	victim, _, ok := b.cleanTransient.GetOldest()
+	if !ok {
+		return true
+	}
+	return b.admission.admit(candidate, victim.(BlockID))
+}
+
 func (b *BlockCacheStandard) makeRoomForSize(size uint64) bool {
 	if b.cleanTransient == nil {
 		return false
 	}
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	return b.makeRoomForSizeLocked(size, nil)
+}
 
+// makeRoomForSizeLocked evicts transient entries until there's room
+// for size more bytes, and then counts them.  If candidate is
+// non-nil, each eviction must be allowed by admission control.
+func (b *BlockCacheStandard) makeRoomForSizeLocked(
+	size uint64, candidate *BlockID) bool {
 	doUnlock := true
 	b.bytesLock.Lock()
 	defer func() {
@@ -160,6 +382,9 @@ func (b *BlockCacheStandard) makeRoomForSize(size uint64) bool {
 	for b.cleanTotalBytes+size > b.cleanBytesCapacity &&
 		oldLen != b.cleanTransient.Len() {
 		oldLen = b.cleanTransient.Len()
+		if candidate != nil && !b.admitLocked(*candidate) {
+			return false
+		}
 		// Unlock while removing, since onEvict needs the lock.
 		b.bytesLock.Unlock()
 		doUnlock = false
@@ -177,12 +402,77 @@ func (b *BlockCacheStandard) makeRoomForSize(size uint64) bool {
 	return true
 }
 
+// putTransient caches the given block as a transient entry, if
+// there's room for it.  If useAdmission is true and admission control
+// is enabled, the block can only evict other entries if admission
+// control allows it; otherwise it goes in the admission window.
+func (b *BlockCacheStandard) putTransient(
+	id BlockID, block Block, size uint64, useAdmission bool) {
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	if b.cleanTransient.Contains(id) {
+		// Another reader of the same block, maybe on another
+		// branch, cached it already, and its bytes are already
+		// counted; just mark it as recently used.
+		b.cleanTransient.Get(id)
+		return
+	}
+	var candidate *BlockID
+	if useAdmission && b.admission != nil {
+		candidate = &id
+	}
+	if candidate != nil &&
+		b.cleanTransient.Len() >= b.transientLimit &&
+		!b.admitLocked(id) {
+		b.putWindowLocked(id, block, size)
+		return
+	}
+	if !b.makeRoomForSizeLocked(size, candidate) {
+		if candidate != nil {
+			b.putWindowLocked(id, block, size)
+		}
+		return
+	}
+	b.evictToLimitLocked(b.transientLimit - 1)
+	b.cleanTransient.Add(id, block)
+	b.transientTotalBytes += size
+	if b.window != nil {
+		b.window.Remove(id)
+	}
+}
+
+// evictToLimitLocked evicts the least-recently-used transient entries
+// until at most limit are left.
+func (b *BlockCacheStandard) evictToLimitLocked(limit int) {
+	for b.cleanTransient.Len() > limit {
+		if _, _, ok := b.cleanTransient.RemoveOldest(); !ok {
+			break
+		}
+	}
+}
+
+func (b *BlockCacheStandard) putWindowLocked(
+	id BlockID, block Block, size uint64) {
+	if size > b.windowBytesCapacity {
+		return
+	}
+	b.window.Remove(id)
+	for b.windowTotalBytes+size > b.windowBytesCapacity {
+		if _, _, ok := b.window.RemoveOldest(); !ok {
+			break
+		}
+	}
+	b.windowTotalBytes += size
+	b.window.Add(id, block)
+}
+
 // Put implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) Put(
 	ptr BlockPointer, tlf TlfID, block Block, lifetime BlockCacheLifetime) error {
 	// If it's the right type of block and lifetime, store the
 	// hash -> ID mapping.
-	if fBlock, ok := block.(*FileBlock); b.ids != nil && lifetime == TransientEntry && ok && !fBlock.IsInd {
+	transient := lifetime == TransientEntry || lifetime == TransientLocalEntry
+	if fBlock, ok := block.(*FileBlock); b.ids != nil && transient && ok && !fBlock.IsInd {
 		if fBlock.hash == nil {
 			_, hash := DoRawDefaultHash(fBlock.Contents)
 			fBlock.hash = &hash
@@ -195,39 +485,123 @@ func (b *BlockCacheStandard) Put(
 	}
 
 	switch lifetime {
-	case TransientEntry:
-		// Cache it later, once we know there's room
+	case TransientEntry, TransientLocalEntry:
+		isPermanent := func() bool {
+			b.cleanLock.Lock()
+			defer b.cleanLock.Unlock()
+			if _, ok := b.cleanPermanent[ptr.ID]; !ok {
+				return false
+			}
+			b.transientTlfs[ptr.ID] = tlf
+			return true
+		}()
+		if isPermanent {
+			// It's already cached for now.
+			return nil
+		}
+		b.putTransientEntry(ptr.ID, tlf, block,
+			lifetime == TransientEntry)
 
 	case PermanentEntry:
-		func() {
+		wasTransient := b.removeUnpinned(ptr.ID)
+		if _, ok := b.removePinned(ptr.ID); ok {
+			wasTransient = true
+		}
+		if _, ok := b.removePinnedBlock(ptr.ID); ok {
+			wasTransient = true
+		}
+		isNew := func() bool {
 			b.cleanLock.Lock()
 			defer b.cleanLock.Unlock()
+			_, ok := b.cleanPermanent[ptr.ID]
 			b.cleanPermanent[ptr.ID] = block
+			if wasTransient {
+				b.transientTlfs[ptr.ID] = tlf
+			}
+			return !ok
 		}()
+		if isNew {
+			b.makeRoomForSize(uint64(getCachedBlockSize(block)))
+		}
 
 	default:
 		return fmt.Errorf("Unknown lifetime %v", lifetime)
 	}
+	return nil
+}
 
+// putTransientEntry caches the given block in whichever transient
+// partition it belongs in, and removes it from the others.  If
+// useAdmission is false, the block gets into the main transient
+// cache without going through admission control.
+func (b *BlockCacheStandard) putTransientEntry(
+	id BlockID, tlf TlfID, block Block, useAdmission bool) {
+	// Hold the pin lock throughout, so the block can't get pinned
+	// after it's been checked and before it's been cached.
+	b.blockPinLock.Lock()
+	defer b.blockPinLock.Unlock()
+	if b.blockPins[id] > 0 {
+		if _, ok := b.pinnedBlocks[id]; !ok {
+			b.pinnedBlocks[id] = pinnedCacheEntry{tlf, block}
+			b.pinnedBlocksBytes += uint64(getCachedBlockSize(block))
+		}
+		return
+	}
+	if b.putPinned(id, tlf, block) {
+		b.removeUnpinned(id)
+		return
+	}
+	if b.cleanTransient == nil {
+		return
+	}
 	size := uint64(getCachedBlockSize(block))
-	madeRoom := b.makeRoomForSize(size)
-	if madeRoom && lifetime == TransientEntry && b.cleanTransient != nil {
-		b.cleanTransient.Add(ptr.ID, block)
+	if b.putMetadata(id, block, size) {
+		b.removeTransient(id)
+		return
 	}
-	return nil
+	b.putTransient(id, block, size, useAdmission)
+}
+
+// removeUnpinned removes any transient entry for the given ID
+// outside of the pinned partition, i.e. from the main transient
+// cache, the admission window and the metadata partition, and
+// returns whether there was one.
+func (b *BlockCacheStandard) removeUnpinned(id BlockID) bool {
+	found := false
+	if b.cleanTransient != nil {
+		// The only error is for an entry that isn't a block,
+		// which is removed anyway.
+		block, _ := b.removeTransient(id)
+		found = block != nil
+	}
+	if _, ok := b.removeMetadata(id); ok {
+		found = true
+	}
+	return found
 }
 
 // DeletePermanent implements the BlockCache interface for
 // BlockCacheStandard.
 func (b *BlockCacheStandard) DeletePermanent(id BlockID) error {
-	b.cleanLock.Lock()
-	defer b.cleanLock.Unlock()
-	block, ok := b.cleanPermanent[id]
-	if ok {
+	block, tlf, wasTransient := func() (Block, TlfID, bool) {
+		b.cleanLock.Lock()
+		defer b.cleanLock.Unlock()
+		block, ok := b.cleanPermanent[id]
+		if !ok {
+			return nil, TlfID{}, false
+		}
 		delete(b.cleanPermanent, id)
+		tlf, wasTransient := b.transientTlfs[id]
+		delete(b.transientTlfs, id)
 		b.bytesLock.Lock()
 		defer b.bytesLock.Unlock()
 		b.cleanTotalBytes -= uint64(getCachedBlockSize(block))
+		return block, tlf, wasTransient
+	}()
+	if wasTransient {
+		// It was cached as a transient entry before it became
+		// permanent, so it doesn't need admitting again.
+		b.putTransientEntry(id, tlf, block, false)
 	}
 	return nil
 }
@@ -241,25 +615,52 @@ func (b *BlockCacheStandard) DeleteTransient(
 
 	// If the block is cached and a file block, delete the known
 	// pointer as well.
-	if tmp, ok := b.cleanTransient.Get(ptr.ID); ok {
-		block, ok := tmp.(Block)
-		if !ok {
-			return BadDataError{ptr.ID}
-		}
-
-		// Remove the key if it exists
-		if fBlock, ok := block.(*FileBlock); b.ids != nil && ok &&
-			!fBlock.IsInd {
-			_, hash := DoRawDefaultHash(fBlock.Contents)
-			key := idCacheKey{tlf, hash}
-			b.ids.Remove(key)
-		}
+	block, err := b.removeTransient(ptr.ID)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		block, _ = b.removeMetadata(ptr.ID)
+	}
+	if block == nil {
+		block, _ = b.removePinned(ptr.ID)
+	}
+	if block == nil {
+		block, _ = b.removePinnedBlock(ptr.ID)
+	}
 
-		b.cleanTransient.Remove(ptr.ID)
+	// Remove the key if it exists
+	if fBlock, ok := block.(*FileBlock); b.ids != nil && ok &&
+		!fBlock.IsInd {
+		_, hash := DoRawDefaultHash(fBlock.Contents)
+		key := idCacheKey{tlf, hash}
+		b.ids.Remove(key)
 	}
 	return nil
 }
 
+func (b *BlockCacheStandard) removeTransient(id BlockID) (Block, error) {
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	tmp, ok := b.cleanTransient.Peek(id)
+	if ok {
+		b.cleanTransient.Remove(id)
+	} else if b.window != nil {
+		tmp, ok = b.window.Peek(id)
+		if ok {
+			b.window.Remove(id)
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+	block, ok := tmp.(Block)
+	if !ok {
+		return nil, BadDataError{id}
+	}
+	return block, nil
+}
+
 // DeleteKnownPtr implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) DeleteKnownPtr(tlf TlfID, block *FileBlock) error {
 	if block.IsInd {
@@ -275,3 +676,445 @@ func (b *BlockCacheStandard) DeleteKnownPtr(tlf TlfID, block *FileBlock) error {
 	b.ids.Remove(key)
 	return nil
 }
+
+func (b *BlockCacheStandard) onEvictPinned(key interface{}, value interface{}) {
+	entry, ok := value.(pinnedCacheEntry)
+	if !ok {
+		return
+	}
+	// Called with pinLock held.
+	b.pinnedTotalBytes -= uint64(getCachedBlockSize(entry.block))
+}
+
+func (b *BlockCacheStandard) getPinned(id BlockID) (Block, bool) {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if b.cleanPinned == nil {
+		return nil, false
+	}
+	tmp, ok := b.cleanPinned.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return tmp.(pinnedCacheEntry).block, true
+}
+
+func (b *BlockCacheStandard) removePinned(id BlockID) (Block, bool) {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if b.cleanPinned == nil {
+		return nil, false
+	}
+	tmp, ok := b.cleanPinned.Peek(id)
+	if !ok {
+		return nil, false
+	}
+	b.cleanPinned.Remove(id)
+	return tmp.(pinnedCacheEntry).block, true
+}
+
+// numTransientEntries returns the number of transient entries in
+// the main cache and the metadata partition.
+func (b *BlockCacheStandard) numTransientEntries() int {
+	n := func() int {
+		b.transientLock.Lock()
+		defer b.transientLock.Unlock()
+		return b.cleanTransient.Len()
+	}()
+	b.metaLock.Lock()
+	defer b.metaLock.Unlock()
+	if b.cleanMetadata != nil {
+		n += b.cleanMetadata.Len()
+	}
+	return n
+}
+
+// isMetadataBlock returns whether the given block belongs in the
+// metadata partition.
+func isMetadataBlock(block Block) bool {
+	switch b := block.(type) {
+	case *DirBlock:
+		return true
+	case *FileBlock:
+		return b.IsInd
+	default:
+		return false
+	}
+}
+
+func (b *BlockCacheStandard) onEvictMetadata(
+	key interface{}, value interface{}) {
+	block, ok := value.(Block)
+	if !ok {
+		return
+	}
+	// Called with metaLock held.
+	b.metaTotalBytes -= uint64(getCachedBlockSize(block))
+}
+
+func (b *BlockCacheStandard) getMetadata(id BlockID) (Block, bool) {
+	b.metaLock.Lock()
+	defer b.metaLock.Unlock()
+	if b.cleanMetadata == nil {
+		return nil, false
+	}
+	tmp, ok := b.cleanMetadata.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return tmp.(Block), true
+}
+
+func (b *BlockCacheStandard) removeMetadata(id BlockID) (Block, bool) {
+	b.metaLock.Lock()
+	defer b.metaLock.Unlock()
+	if b.cleanMetadata == nil {
+		return nil, false
+	}
+	tmp, ok := b.cleanMetadata.Peek(id)
+	if !ok {
+		return nil, false
+	}
+	b.cleanMetadata.Remove(id)
+	return tmp.(Block), true
+}
+
+// putMetadata caches the given block in the metadata partition, if
+// it's enabled and the block belongs there.  It returns false if the
+// block should be cached normally instead.
+func (b *BlockCacheStandard) putMetadata(
+	id BlockID, block Block, size uint64) bool {
+	if !isMetadataBlock(block) {
+		return false
+	}
+	b.metaLock.Lock()
+	defer b.metaLock.Unlock()
+	if b.cleanMetadata == nil {
+		return false
+	}
+	if b.cleanMetadata.Contains(id) {
+		return true
+	}
+	if size > b.metaBytesCapacity {
+		// Too big for the partition; let it take its chances
+		// with the rest of the cache.
+		return false
+	}
+	for b.metaTotalBytes+size > b.metaBytesCapacity {
+		if _, _, ok := b.cleanMetadata.RemoveOldest(); !ok {
+			break
+		}
+	}
+	b.metaTotalBytes += size
+	b.cleanMetadata.Add(id, block)
+	return true
+}
+
+// putPinned caches the given block in the pinned partition, if its
+// TLF is pinned and it fits in the pinned budget.  It returns false
+// if the block should be cached normally instead.
+func (b *BlockCacheStandard) putPinned(
+	id BlockID, tlf TlfID, block Block) bool {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if b.cleanPinned == nil || !b.pinnedTlfs[tlf] {
+		return false
+	}
+	if b.cleanPinned.Contains(id) {
+		return true
+	}
+	size := uint64(getCachedBlockSize(block))
+	if size > b.pinnedBytesCapacity {
+		return false
+	}
+	for b.pinnedTotalBytes+size > b.pinnedBytesCapacity {
+		if _, _, ok := b.cleanPinned.RemoveOldest(); !ok {
+			break
+		}
+	}
+	b.pinnedTotalBytes += size
+	b.cleanPinned.Add(id, pinnedCacheEntry{tlf, block})
+	return true
+}
+
+// setPinnedBytesLocked moves bytes between the cache's clean bytes
+// capacity and the pinned partition, so that the partition gets
+// pinnedBytesCapacity bytes, but at most half of the two together,
+// so that pinned folders can't crowd out all the others.  It returns
+// the partition's new capacity, and evicts transient entries right
+// away if the rest of the cache is now over its capacity.
+// limitsLock must be held by the caller.
+func (b *BlockCacheStandard) setPinnedBytesLocked(
+	pinnedBytesCapacity uint64) uint64 {
+	oldPinned := func() uint64 {
+		b.pinLock.Lock()
+		defer b.pinLock.Unlock()
+		return b.pinnedBytesCapacity
+	}()
+
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	func() {
+		b.bytesLock.Lock()
+		defer b.bytesLock.Unlock()
+		total := b.cleanBytesCapacity + oldPinned
+		if pinnedBytesCapacity > total/2 {
+			pinnedBytesCapacity = total / 2
+		}
+		b.cleanBytesCapacity = total - pinnedBytesCapacity
+	}()
+	b.makeRoomForSizeLocked(0, nil)
+	return pinnedBytesCapacity
+}
+
+// SetPinnedTlfs implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) SetPinnedTlfs(
+	tlfs map[TlfID]bool, pinnedBytesCapacity uint64) {
+	if b.transientCapacity <= 0 {
+		return
+	}
+	b.limitsLock.Lock()
+	defer b.limitsLock.Unlock()
+	pinnedBytesCapacity = b.setPinnedBytesLocked(pinnedBytesCapacity)
+
+	// Blocks of TLFs that are no longer pinned go back to the
+	// regular transient cache.
+	demoted := func() map[BlockID]pinnedCacheEntry {
+		b.pinLock.Lock()
+		defer b.pinLock.Unlock()
+		b.pinnedTlfs = make(map[TlfID]bool, len(tlfs))
+		for tlf, pinned := range tlfs {
+			if pinned {
+				b.pinnedTlfs[tlf] = true
+			}
+		}
+		b.pinnedBytesCapacity = pinnedBytesCapacity
+		if b.cleanPinned == nil {
+			// This can only fail for a non-positive size.
+			b.cleanPinned, _ = simplelru.NewLRU(
+				b.transientCapacity, b.onEvictPinned)
+			return nil
+		}
+
+		demoted := make(map[BlockID]pinnedCacheEntry)
+		for _, key := range b.cleanPinned.Keys() {
+			tmp, _ := b.cleanPinned.Peek(key)
+			entry := tmp.(pinnedCacheEntry)
+			if !b.pinnedTlfs[entry.tlf] {
+				id := key.(BlockID)
+				demoted[id] = entry
+				b.cleanPinned.Remove(id)
+			}
+		}
+		for b.pinnedTotalBytes > b.pinnedBytesCapacity {
+			if _, _, ok := b.cleanPinned.RemoveOldest(); !ok {
+				break
+			}
+		}
+		return demoted
+	}()
+
+	for id, entry := range demoted {
+		size := uint64(getCachedBlockSize(entry.block))
+		if !b.putMetadata(id, entry.block, size) {
+			b.putTransient(id, entry.block, size, false)
+		}
+	}
+}
+
+// SetCacheLimits implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) SetCacheLimits(
+	transientCapacity int, cleanBytesCapacity uint64) {
+	if b.cleanTransient == nil || transientCapacity <= 0 {
+		return
+	}
+	if transientCapacity > blockCacheMaxTransientEntries {
+		transientCapacity = blockCacheMaxTransientEntries
+	}
+	b.limitsLock.Lock()
+	defer b.limitsLock.Unlock()
+
+	// The pinned partition keeps its bytes, as long as they're
+	// still at most half of the total.
+	cleanBytesCapacity = func() uint64 {
+		b.pinLock.Lock()
+		defer b.pinLock.Unlock()
+		if b.pinnedBytesCapacity > cleanBytesCapacity/2 {
+			b.pinnedBytesCapacity = cleanBytesCapacity / 2
+			for b.pinnedTotalBytes > b.pinnedBytesCapacity {
+				if _, _, ok := b.cleanPinned.RemoveOldest(); !ok {
+					break
+				}
+			}
+		}
+		return cleanBytesCapacity - b.pinnedBytesCapacity
+	}()
+
+	// The metadata partition keeps its share of the rest.
+	cleanBytes := func() uint64 {
+		b.transientLock.Lock()
+		defer b.transientLock.Unlock()
+		b.bytesLock.Lock()
+		defer b.bytesLock.Unlock()
+		return b.cleanBytesCapacity + b.windowBytesCapacity
+	}()
+	cleanBytesCapacity = func() uint64 {
+		b.metaLock.Lock()
+		defer b.metaLock.Unlock()
+		if b.cleanMetadata == nil || cleanBytes+b.metaBytesCapacity == 0 {
+			return cleanBytesCapacity
+		}
+		b.metaBytesCapacity = uint64(float64(cleanBytesCapacity) *
+			float64(b.metaBytesCapacity) /
+			float64(cleanBytes+b.metaBytesCapacity))
+		for b.metaTotalBytes > b.metaBytesCapacity {
+			if _, _, ok := b.cleanMetadata.RemoveOldest(); !ok {
+				break
+			}
+		}
+		return cleanBytesCapacity - b.metaBytesCapacity
+	}()
+
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	b.transientLimit = transientCapacity
+	b.evictToLimitLocked(transientCapacity)
+	if b.window != nil {
+		// The admission window takes 1% of the rest.
+		b.windowBytesCapacity = cleanBytesCapacity / 100
+		cleanBytesCapacity -= b.windowBytesCapacity
+		for b.windowTotalBytes > b.windowBytesCapacity {
+			if _, _, ok := b.window.RemoveOldest(); !ok {
+				break
+			}
+		}
+	}
+	func() {
+		b.bytesLock.Lock()
+		defer b.bytesLock.Unlock()
+		b.cleanBytesCapacity = cleanBytesCapacity
+	}()
+	b.makeRoomForSizeLocked(0, nil)
+}
+
+func (b *BlockCacheStandard) getPinnedBlock(id BlockID) (Block, bool) {
+	b.blockPinLock.Lock()
+	defer b.blockPinLock.Unlock()
+	entry, ok := b.pinnedBlocks[id]
+	return entry.block, ok
+}
+
+// removePinnedBlock removes the cached block pinned under the given
+// ID, if any, but leaves it pinned.
+func (b *BlockCacheStandard) removePinnedBlock(id BlockID) (Block, bool) {
+	b.blockPinLock.Lock()
+	defer b.blockPinLock.Unlock()
+	entry, ok := b.pinnedBlocks[id]
+	if !ok {
+		return nil, false
+	}
+	delete(b.pinnedBlocks, id)
+	b.pinnedBlocksBytes -= uint64(getCachedBlockSize(entry.block))
+	return entry.block, true
+}
+
+// PinBlock implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) PinBlock(ptr BlockPointer, tlf TlfID) {
+	b.blockPinLock.Lock()
+	defer b.blockPinLock.Unlock()
+	b.blockPins[ptr.ID]++
+	if b.blockPins[ptr.ID] > 1 {
+		return
+	}
+
+	// Take any transient entry out of reach of eviction.
+	var block Block
+	if b.cleanTransient != nil {
+		// The only error is for an entry that isn't a block,
+		// which is removed anyway.
+		block, _ = b.removeTransient(ptr.ID)
+	}
+	if block == nil {
+		block, _ = b.removeMetadata(ptr.ID)
+	}
+	if block == nil {
+		block, _ = b.removePinned(ptr.ID)
+	}
+	if block != nil {
+		b.pinnedBlocks[ptr.ID] = pinnedCacheEntry{tlf, block}
+		b.pinnedBlocksBytes += uint64(getCachedBlockSize(block))
+	}
+}
+
+// UnpinBlock implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) UnpinBlock(ptr BlockPointer) {
+	entry, ok := func() (pinnedCacheEntry, bool) {
+		b.blockPinLock.Lock()
+		defer b.blockPinLock.Unlock()
+		switch n := b.blockPins[ptr.ID]; n {
+		case 0:
+			return pinnedCacheEntry{}, false
+		case 1:
+			delete(b.blockPins, ptr.ID)
+		default:
+			b.blockPins[ptr.ID] = n - 1
+			return pinnedCacheEntry{}, false
+		}
+		entry, ok := b.pinnedBlocks[ptr.ID]
+		if ok {
+			delete(b.pinnedBlocks, ptr.ID)
+			b.pinnedBlocksBytes -= uint64(getCachedBlockSize(entry.block))
+		}
+		return entry, ok
+	}()
+	if ok {
+		// Back to being an ordinary transient entry.  This can
+		// only fail for an unknown lifetime.
+		_ = b.Put(ptr, entry.tlf, entry.block, TransientEntry)
+	}
+}
+
+// BlockCacheUsage describes what a BlockCacheStandard holds, by how
+// it can be evicted.
+type BlockCacheUsage struct {
+	// PinnedBlocks is the number of blocks pinned with PinBlock,
+	// including those not cached, and PinnedBytes is the size of
+	// those that are cached.  They can't be evicted until they're
+	// unpinned.
+	PinnedBlocks int
+	PinnedBytes  uint64
+	// PinnedTlfBytes is the size of the transient entries of the
+	// pinned TLFs, which can only be evicted by each other.
+	PinnedTlfBytes uint64
+	// EvictableBytes is the size of all other transient entries.
+	EvictableBytes uint64
+}
+
+// Usage returns what this cache holds, by how it can be evicted.
+func (b *BlockCacheStandard) Usage() BlockCacheUsage {
+	var usage BlockCacheUsage
+	func() {
+		b.blockPinLock.Lock()
+		defer b.blockPinLock.Unlock()
+		usage.PinnedBlocks = len(b.blockPins)
+		usage.PinnedBytes = b.pinnedBlocksBytes
+	}()
+	func() {
+		b.pinLock.Lock()
+		defer b.pinLock.Unlock()
+		usage.PinnedTlfBytes = b.pinnedTotalBytes
+	}()
+	func() {
+		b.transientLock.Lock()
+		defer b.transientLock.Unlock()
+		usage.EvictableBytes = b.transientTotalBytes + b.windowTotalBytes
+	}()
+	b.metaLock.Lock()
+	defer b.metaLock.Unlock()
+	usage.EvictableBytes += b.metaTotalBytes
+	return usage
+}
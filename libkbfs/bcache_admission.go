@@ -0,0 +1,152 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"hash/fnv"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// admissionSketchDepth is the number of rows in the frequency
+	// sketch.  Each block ID maps to one counter per row, and its
+	// estimated frequency is the smallest of them.
+	admissionSketchDepth = 4
+	// admissionMaxCount is the largest value a sketch counter can
+	// hold.  Frequencies past this don't make a block any more
+	// likely to be admitted.
+	admissionMaxCount = 15
+	// admissionSampleFactor is how many accesses per sketch column
+	// happen before all counters are halved, so that blocks that
+	// were popular a long time ago fade out.
+	admissionSampleFactor = 10
+	// admissionSketchWidthFactor is the number of counters per row
+	// of the sketch for each entry in the cache.
+	admissionSketchWidthFactor = 4
+)
+
+// BlockCacheAdmissionStats describes how well the admission control
+// of a BlockCacheStandard is working.
+type BlockCacheAdmissionStats struct {
+	// Hits and Misses count all block cache lookups.
+	Hits   int64
+	Misses int64
+	// Admitted counts blocks that replaced a colder block in a
+	// full cache, and Rejected counts blocks that were kept out
+	// of the main cache because it held hotter blocks.
+	Admitted int64
+	Rejected int64
+}
+
+// blockCacheAdmission decides whether a block is worth evicting
+// another block from a full cache, TinyLFU-style: it keeps an
+// approximate count of recent accesses to every block ID in a
+// count-min sketch, and only admits a block that has been accessed
+// at least as often as the block it would evict.  That keeps
+// single-pass reads of lots of data (like backups or media scans)
+// from flushing out the blocks that are used over and over.
+type blockCacheAdmission struct {
+	lock      sync.Mutex
+	counts    [admissionSketchDepth][]uint8
+	mask      uint64
+	additions uint64
+	resetAt   uint64
+
+	admitted metrics.Counter
+	rejected metrics.Counter
+}
+
+// newBlockCacheAdmission makes a blockCacheAdmission suitable for a
+// cache holding up to capacity entries.  If r is non-nil, the
+// admission stats are registered with it.
+func newBlockCacheAdmission(
+	capacity int, r metrics.Registry) *blockCacheAdmission {
+	// Several counters per entry keep collisions between the
+	// blocks in the cache, and the ones passing through it, rare.
+	width := uint64(64)
+	for width < admissionSketchWidthFactor*uint64(capacity) {
+		width *= 2
+	}
+	a := &blockCacheAdmission{
+		mask:     width - 1,
+		resetAt:  width * admissionSampleFactor,
+		admitted: newBlockCacheCounter("BlockCache.Admitted", r),
+		rejected: newBlockCacheCounter("BlockCache.Rejected", r),
+	}
+	for i := range a.counts {
+		a.counts[i] = make([]uint8, width)
+	}
+	return a
+}
+
+// indexes returns the counter of id in each row, using double
+// hashing.
+func (a *blockCacheAdmission) indexes(
+	id BlockID) (idx [admissionSketchDepth]uint64) {
+	h := fnv.New64a()
+	h.Write(id.Bytes())
+	sum := h.Sum64()
+	lo, hi := sum&0xffffffff, sum>>32
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & a.mask
+	}
+	return idx
+}
+
+func (a *blockCacheAdmission) estimateLocked(id BlockID) uint8 {
+	min := uint8(admissionMaxCount)
+	for i, j := range a.indexes(id) {
+		if c := a.counts[i][j]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// access records an access to the given block.
+func (a *blockCacheAdmission) access(id BlockID) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, j := range a.indexes(id) {
+		if a.counts[i][j] < admissionMaxCount {
+			a.counts[i][j]++
+		}
+	}
+	a.additions++
+	if a.additions < a.resetAt {
+		return
+	}
+	for i := range a.counts {
+		for j := range a.counts[i] {
+			a.counts[i][j] /= 2
+		}
+	}
+	a.additions /= 2
+}
+
+// admit returns whether candidate should replace victim in the
+// cache.
+func (a *blockCacheAdmission) admit(candidate, victim BlockID) bool {
+	admit := func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.estimateLocked(candidate) >= a.estimateLocked(victim)
+	}()
+	if admit {
+		a.admitted.Inc(1)
+	} else {
+		a.rejected.Inc(1)
+	}
+	return admit
+}
+
+func (a *blockCacheAdmission) stats() BlockCacheAdmissionStats {
+	return BlockCacheAdmissionStats{
+		Admitted: a.admitted.Count(),
+		Rejected: a.rejected.Count(),
+	}
+}
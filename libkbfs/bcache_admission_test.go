@@ -0,0 +1,45 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCacheAdmissionSketch(t *testing.T) {
+	a := newBlockCacheAdmission(16, nil)
+	hot := fakeBlockID(1)
+	cold := fakeBlockID(2)
+
+	for i := 0; i < 3; i++ {
+		a.access(hot)
+	}
+	a.access(cold)
+	require.Equal(t, uint8(3), a.estimateLocked(hot))
+	require.True(t, a.admit(hot, cold))
+	require.False(t, a.admit(cold, hot))
+	// Ties are admitted.
+	require.True(t, a.admit(hot, hot))
+
+	// Counters saturate.
+	for i := 0; i < 2*admissionMaxCount; i++ {
+		a.access(hot)
+	}
+	require.Equal(t, uint8(admissionMaxCount), a.estimateLocked(hot))
+
+	// Enough accesses halve all the counters.
+	for a.additions < a.resetAt-1 {
+		a.access(fakeBlockID(3))
+	}
+	a.access(fakeBlockID(3))
+	require.Equal(t, uint8(admissionMaxCount/2), a.estimateLocked(hot))
+
+	require.Equal(t, BlockCacheAdmissionStats{
+		Admitted: 2,
+		Rejected: 1,
+	}, a.stats())
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The block cache is sized to 1/blockCacheAutoSizeDivisor of
+	// the system's memory, but never below blockCacheAutoSizeMinBytes.
+	blockCacheAutoSizeDivisor  = 8
+	blockCacheAutoSizeMinBytes = 64 * 1024 * 1024
+	// blockCacheAutoSizeBytesPerEntry is how many bytes of capacity
+	// come with each transient entry, matching the fixed defaults
+	// of 10K entries for 512MiB.
+	blockCacheAutoSizeBytesPerEntry = MaxBlockSizeBytesDefault * 1024 / 10000
+	// When less than the low watermark fraction of the system's
+	// memory is available, the block cache shrinks by half; it only
+	// grows back once more than the high watermark fraction is.
+	blockCacheLowWatermark  = 0.05
+	blockCacheHighWatermark = 0.15
+	// blockCacheAutoSizePeriod is how often the available memory
+	// is checked.
+	blockCacheAutoSizePeriod = 10 * time.Second
+)
+
+// systemMemoryFunc returns the total and the currently available
+// number of bytes of the system's memory.
+type systemMemoryFunc func() (total, available uint64, err error)
+
+// blockCacheAutoSizer sizes the block cache of a Config to the
+// memory of the system it runs on, and shrinks it when the system
+// is short on memory.
+type blockCacheAutoSizer struct {
+	config    Config
+	memory    systemMemoryFunc
+	log       logger.Logger
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+	limitLock sync.Mutex
+	// limit is the current bytes capacity of the block cache, or 0
+	// if it hasn't been sized yet.
+	limit uint64
+}
+
+func newBlockCacheAutoSizer(
+	config Config, memory systemMemoryFunc) *blockCacheAutoSizer {
+	return &blockCacheAutoSizer{
+		config: config,
+		memory: memory,
+		log:    config.MakeLogger(""),
+	}
+}
+
+// blockCacheLimitsForBytes returns the block cache limits for the
+// given bytes capacity.
+func blockCacheLimitsForBytes(bytes uint64) (int, uint64) {
+	entries := bytes / blockCacheAutoSizeBytesPerEntry
+	if entries < 1 {
+		entries = 1
+	}
+	return int(entries), bytes
+}
+
+// limits returns the current block cache limits, and false if the
+// cache hasn't been sized yet.
+func (s *blockCacheAutoSizer) limits() (int, uint64, bool) {
+	s.limitLock.Lock()
+	defer s.limitLock.Unlock()
+	if s.limit == 0 {
+		return 0, 0, false
+	}
+	entries, bytes := blockCacheLimitsForBytes(s.limit)
+	return entries, bytes, true
+}
+
+// resize checks the system's memory, and applies the resulting limits
+// to the block cache.
+func (s *blockCacheAutoSizer) resize() error {
+	total, available, err := s.memory()
+	if err != nil {
+		return err
+	}
+	target := total / blockCacheAutoSizeDivisor
+	if target < blockCacheAutoSizeMinBytes {
+		target = blockCacheAutoSizeMinBytes
+	}
+
+	shrunk := false
+	limit := func() uint64 {
+		s.limitLock.Lock()
+		defer s.limitLock.Unlock()
+		switch {
+		case s.limit == 0:
+			s.limit = target
+		case float64(available) < blockCacheLowWatermark*float64(total):
+			s.limit /= 2
+			if s.limit < blockCacheAutoSizeMinBytes {
+				s.limit = blockCacheAutoSizeMinBytes
+			}
+			shrunk = true
+		case float64(available) > blockCacheHighWatermark*float64(total):
+			if s.limit < target {
+				s.limit *= 2
+			}
+			if s.limit > target {
+				s.limit = target
+			}
+		}
+		return s.limit
+	}()
+
+	s.config.BlockCache().SetCacheLimits(blockCacheLimitsForBytes(limit))
+	if shrunk {
+		s.log.Debug("Shrank the block cache to %d bytes, with "+
+			"only %d of %d bytes of memory available",
+			limit, available, total)
+		// Hand the evicted blocks back to the system now, rather
+		// than whenever the runtime gets around to it.
+		debug.FreeOSMemory()
+	}
+	return nil
+}
+
+// start sizes the block cache, and then keeps resizing it in the
+// background until shutdown is called.
+func (s *blockCacheAutoSizer) start() error {
+	if err := s.resize(); err != nil {
+		return err
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	s.doneCh = make(chan struct{})
+	go func() {
+		defer close(s.doneCh)
+		ticker := time.NewTicker(blockCacheAutoSizePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.resize(); err != nil {
+					s.log.Debug("Couldn't resize the block "+
+						"cache: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// shutdown stops resizing the block cache.
+func (s *blockCacheAutoSizer) shutdown() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.doneCh
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package libkbfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getSystemMemory is a systemMemoryFunc that reads /proc/meminfo.
+func getSystemMemory() (total, available uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines look like "MemTotal:       16316412 kB".
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(parts) > 2 && parts[2] == "kB" {
+			n *= 1024
+		}
+		fields[strings.TrimSuffix(parts[0], ":")] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	total, ok := fields["MemTotal"]
+	if !ok {
+		return 0, 0, fmt.Errorf("No MemTotal in /proc/meminfo")
+	}
+	available, ok = fields["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 don't estimate it, so approximate it
+		// the way they used to.
+		available = fields["MemFree"] + fields["Buffers"] +
+			fields["Cached"]
+	}
+	return total, available, nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package libkbfs
+
+import "errors"
+
+// getSystemMemory is a systemMemoryFunc that always fails, since the
+// system's memory isn't known on this platform.
+func getSystemMemory() (total, available uint64, err error) {
+	return 0, 0, errors.New("The system's memory isn't known " +
+		"on this platform")
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCacheAutoSizer(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	b := NewBlockCacheStandard(config, 10, 1<<30)
+	config.SetBlockCache(b)
+
+	const gb = 1024 * 1024 * 1024
+	total, available := uint64(8*gb), uint64(4*gb)
+	s := newBlockCacheAutoSizer(config,
+		func() (uint64, uint64, error) { return total, available, nil })
+	checkLimit := func(expected uint64) {
+		entries, bytes, ok := s.limits()
+		require.True(t, ok)
+		require.Equal(t, expected, bytes)
+		require.Equal(t,
+			int(expected/blockCacheAutoSizeBytesPerEntry), entries)
+		b.bytesLock.Lock()
+		defer b.bytesLock.Unlock()
+		require.Equal(t, expected, b.cleanBytesCapacity)
+	}
+
+	// The cache starts out at its share of the system's memory.
+	_, _, ok := s.limits()
+	require.False(t, ok)
+	require.NoError(t, s.resize())
+	checkLimit(gb)
+
+	// It shrinks by half each time memory runs low...
+	available = total / 100
+	require.NoError(t, s.resize())
+	checkLimit(gb / 2)
+	require.NoError(t, s.resize())
+	checkLimit(gb / 4)
+
+	// ...stays put between the watermarks...
+	available = total / 10
+	require.NoError(t, s.resize())
+	checkLimit(gb / 4)
+
+	// ...and grows back once there's plenty of memory again.
+	available = total / 2
+	require.NoError(t, s.resize())
+	checkLimit(gb / 2)
+	require.NoError(t, s.resize())
+	checkLimit(gb)
+	require.NoError(t, s.resize())
+	checkLimit(gb)
+
+	// It never shrinks below the minimum.
+	available = 0
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.resize())
+	}
+	checkLimit(blockCacheAutoSizeMinBytes)
+}
@@ -383,3 +383,436 @@ func TestPutNoHashCalculation(t *testing.T) {
 		t.Errorf("Put() is calculating hash")
 	}
 }
+
+func TestBcachePinnedTlfSurvivesEviction(t *testing.T) {
+	config := blockCacheTestInit(t, 2, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	bcache := config.BlockCache()
+	pinnedTlf := FakeTlfID(1, false)
+	otherTlf := FakeTlfID(2, false)
+	bcache.SetPinnedTlfs(map[TlfID]bool{pinnedTlf: true}, 1<<30)
+
+	pinnedID := fakeBlockID(1)
+	err := bcache.Put(BlockPointer{ID: pinnedID}, pinnedTlf,
+		NewFileBlock(), TransientEntry)
+	if err != nil {
+		t.Fatalf("Got error on Put: %v", err)
+	}
+
+	// Fill the regular transient cache well past its capacity.
+	for i := 2; i < 6; i++ {
+		err := bcache.Put(BlockPointer{ID: fakeBlockID(byte(i))}, otherTlf,
+			NewFileBlock(), TransientEntry)
+		if err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+	testExpectedMissing(t, fakeBlockID(2), bcache)
+
+	// The pinned block is still there.
+	if _, err := bcache.Get(BlockPointer{ID: pinnedID}); err != nil {
+		t.Errorf("Got unexpected error on get: %v", err)
+	}
+
+	// Once unpinned, it's just another transient block.
+	bcache.SetPinnedTlfs(nil, 1<<30)
+	if _, err := bcache.Get(BlockPointer{ID: pinnedID}); err != nil {
+		t.Errorf("Got unexpected error on get: %v", err)
+	}
+	for i := 6; i < 8; i++ {
+		err := bcache.Put(BlockPointer{ID: fakeBlockID(byte(i))}, otherTlf,
+			NewFileBlock(), TransientEntry)
+		if err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+	testExpectedMissing(t, pinnedID, bcache)
+}
+
+func TestBcachePinnedBytesCapacity(t *testing.T) {
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	bcache := config.BlockCache()
+	tlf := FakeTlfID(1, false)
+	// Only room for two of the blocks below.
+	bcache.SetPinnedTlfs(map[TlfID]bool{tlf: true}, 10)
+
+	for i := 1; i <= 3; i++ {
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = []byte{1, 2, 3, 4, byte(i)}
+		err := bcache.Put(BlockPointer{ID: fakeBlockID(byte(i))}, tlf,
+			block, TransientEntry)
+		if err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+
+	b := bcache.(*BlockCacheStandard)
+	if b.pinnedTotalBytes != 10 {
+		t.Errorf("Pinned %d bytes, expected 10", b.pinnedTotalBytes)
+	}
+	if b.cleanPinned.Contains(fakeBlockID(1)) {
+		t.Errorf("Oldest pinned block wasn't evicted")
+	}
+}
+
+func TestBcachePinnedBytesWithinCapacity(t *testing.T) {
+	config := blockCacheTestInit(t, 100, 20)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	tlf := FakeTlfID(1, false)
+	otherTlf := FakeTlfID(2, false)
+	checkBytes := func(name string, got, expected uint64) {
+		if got != expected {
+			t.Errorf("%s is %d bytes, expected %d", name, got, expected)
+		}
+	}
+
+	// The pinned partition can take at most half of the bytes.
+	b.SetPinnedTlfs(map[TlfID]bool{tlf: true}, 1<<30)
+	checkBytes("Pinned capacity", b.pinnedBytesCapacity, 10)
+	checkBytes("Clean capacity", b.cleanBytesCapacity, 10)
+
+	for i := byte(1); i <= 3; i++ {
+		for _, p := range []struct {
+			id  BlockID
+			tlf TlfID
+		}{{fakeBlockID(i), tlf}, {fakeBlockID(10 + i), otherTlf}} {
+			block := NewFileBlock().(*FileBlock)
+			block.Contents = []byte{1, 2, 3, 4, i}
+			err := b.Put(BlockPointer{ID: p.id}, p.tlf, block,
+				TransientEntry)
+			if err != nil {
+				t.Fatalf("Got error on Put: %v", err)
+			}
+		}
+	}
+	checkBytes("Pinned total", b.pinnedTotalBytes, 10)
+	checkBytes("Clean total", b.cleanTotalBytes, 10)
+
+	// Shrinking the cache shrinks the pinned partition too.
+	b.SetCacheLimits(100, 10)
+	checkBytes("Pinned capacity", b.pinnedBytesCapacity, 5)
+	checkBytes("Pinned total", b.pinnedTotalBytes, 5)
+	checkBytes("Clean total", b.cleanTotalBytes, 5)
+
+	// Unpinning gives the bytes back.
+	b.SetPinnedTlfs(nil, 0)
+	checkBytes("Clean capacity", b.cleanBytesCapacity, 10)
+}
+
+func TestBcacheMetadataPartition(t *testing.T) {
+	config := blockCacheTestInit(t, 3, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	// Room for two of the metadata blocks below.
+	b.EnableMetadataPartition(20)
+	tlf := FakeTlfID(1, false)
+
+	for i := byte(1); i <= 3; i++ {
+		block := NewDirBlock()
+		block.SetEncodedSize(10)
+		testBcachePutWithBlock(t, fakeBlockID(i), b, TransientEntry, block)
+	}
+	indBlock := NewFileBlock().(*FileBlock)
+	indBlock.IsInd = true
+	testBcachePutWithBlock(t, fakeBlockID(4), b, TransientEntry, indBlock)
+
+	// Churn through lots of file data.
+	for i := byte(5); i < 15; i++ {
+		err := b.Put(BlockPointer{ID: fakeBlockID(i)}, tlf,
+			NewFileBlock(), TransientEntry)
+		if err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+	testExpectedMissing(t, fakeBlockID(5), b)
+
+	// Only the oldest metadata block was evicted, to make room for
+	// the newer ones.
+	testExpectedMissing(t, fakeBlockID(1), b)
+	for i := byte(2); i <= 4; i++ {
+		if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+			t.Errorf("Got unexpected error on get: %v", err)
+		}
+	}
+	if b.metaTotalBytes != 20 {
+		t.Errorf("Partition holds %d bytes, expected 20", b.metaTotalBytes)
+	}
+
+	if err := b.DeleteTransient(
+		BlockPointer{ID: fakeBlockID(2)}, tlf); err != nil {
+		t.Fatalf("Got error on DeleteTransient: %v", err)
+	}
+	testExpectedMissing(t, fakeBlockID(2), b)
+}
+
+func TestBcacheAdmissionKeepsHotBlocks(t *testing.T) {
+	config := blockCacheTestInit(t, 10, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	b.EnableAdmissionControl(nil)
+
+	// Blocks 1 through 10 are used over and over.
+	for i := byte(1); i <= 10; i++ {
+		testBcachePut(t, fakeBlockID(i), b, TransientEntry)
+		for j := 0; j < 2; j++ {
+			if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+				t.Errorf("Got unexpected error on get: %v", err)
+			}
+		}
+	}
+
+	// A scan reads each of blocks 11 through 30 once.
+	for i := byte(11); i <= 30; i++ {
+		id := fakeBlockID(i)
+		testExpectedMissing(t, id, b)
+		testBcachePut(t, id, b, TransientEntry)
+	}
+
+	for i := byte(1); i <= 10; i++ {
+		if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+			t.Errorf("Hot block %d was evicted: %v", i, err)
+		}
+	}
+	// Only the latest scanned block is left, in the admission
+	// window.
+	testExpectedMissing(t, fakeBlockID(29), b)
+
+	stats, ok := b.AdmissionStats()
+	if !ok {
+		t.Fatal("No admission stats")
+	}
+	if stats.Admitted != 0 || stats.Rejected != 20 {
+		t.Errorf("Unexpected admission stats: %+v", stats)
+	}
+
+	// A block that's used more often than the hot ones gets in.
+	id := fakeBlockID(31)
+	for i := 0; i < 6; i++ {
+		testExpectedMissing(t, id, b)
+	}
+	testBcachePut(t, id, b, TransientEntry)
+	if !b.cleanTransient.Contains(id) {
+		t.Errorf("Frequently-used block wasn't admitted")
+	}
+}
+
+func TestBcacheAdmissionLocalBlocks(t *testing.T) {
+	config := blockCacheTestInit(t, 10, 1000)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	b.EnableAdmissionControl(nil)
+	// The admission window comes out of the cache's capacity.
+	if b.windowBytesCapacity != 10 || b.cleanBytesCapacity != 990 {
+		t.Errorf("Window has %d bytes and cache has %d, expected 10 "+
+			"and 990", b.windowBytesCapacity, b.cleanBytesCapacity)
+	}
+
+	for i := byte(1); i <= 10; i++ {
+		testBcachePut(t, fakeBlockID(i), b, TransientEntry)
+		for j := 0; j < 2; j++ {
+			if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+				t.Errorf("Got unexpected error on get: %v", err)
+			}
+		}
+	}
+
+	// A block this device just wrote gets in, even though it's
+	// colder than all the others.
+	id := fakeBlockID(11)
+	testBcachePut(t, id, b, TransientLocalEntry)
+	if !b.cleanTransient.Contains(id) {
+		t.Errorf("Locally written block wasn't cached")
+	}
+	stats, ok := b.AdmissionStats()
+	if !ok {
+		t.Fatal("No admission stats")
+	}
+	if stats.Rejected != 0 {
+		t.Errorf("Unexpected admission stats: %+v", stats)
+	}
+}
+
+// Test that reading the same block through several pointers, as
+// different branches or revisions of a folder do, keeps just one
+// copy of it.
+func TestBcacheSharedAcrossReaders(t *testing.T) {
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	tlf := FakeTlfID(1, false)
+
+	id := fakeBlockID(1)
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = []byte{1, 2, 3, 4, 5}
+	for i := byte(0); i < 3; i++ {
+		ptr := BlockPointer{
+			ID:           id,
+			BlockContext: BlockContext{RefNonce: BlockRefNonce{i}},
+		}
+		if err := b.Put(ptr, tlf, block, TransientEntry); err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+
+	if n := b.numTransientEntries(); n != 1 {
+		t.Errorf("%d transient entries, expected 1", n)
+	}
+	if b.cleanTotalBytes != 5 {
+		t.Errorf("Cached %d bytes, expected 5", b.cleanTotalBytes)
+	}
+}
+
+// Test that a block put into a different partition than the one
+// it's already in moves there, rather than being cached twice.
+func TestBcacheOneEntryPerBlockID(t *testing.T) {
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	tlf := FakeTlfID(1, false)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = []byte{1, 2, 3, 4, 5}
+	testBcachePutWithBlock(t, fakeBlockID(1), b, TransientEntry, block)
+	testBcachePutWithBlock(t, fakeBlockID(1), b, PermanentEntry, block)
+	testBcachePutWithBlock(t, fakeBlockID(1), b, TransientEntry, block)
+	if n := b.numTransientEntries(); n != 0 {
+		t.Errorf("%d transient entries, expected 0", n)
+	}
+	if b.cleanTotalBytes != 5 {
+		t.Errorf("Cached %d bytes, expected 5", b.cleanTotalBytes)
+	}
+
+	// A block that's cached before its folder is pinned moves to
+	// the pinned partition the next time it's read.
+	testBcachePutWithBlock(t, fakeBlockID(2), b, TransientEntry, block)
+	b.SetPinnedTlfs(map[TlfID]bool{tlf: true}, 1<<30)
+	testBcachePutWithBlock(t, fakeBlockID(2), b, TransientEntry, block)
+	if n := b.numTransientEntries(); n != 0 {
+		t.Errorf("%d transient entries, expected 0", n)
+	}
+	if b.cleanTotalBytes != 5 {
+		t.Errorf("Cached %d bytes, expected 5", b.cleanTotalBytes)
+	}
+	if b.pinnedTotalBytes != 5 {
+		t.Errorf("Pinned %d bytes, expected 5", b.pinnedTotalBytes)
+	}
+}
+
+func TestBcacheSetCacheLimits(t *testing.T) {
+	config := blockCacheTestInit(t, 10, 10)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	tlf := FakeTlfID(1, false)
+	for i := byte(0); i < 8; i++ {
+		block := &FileBlock{
+			Contents: make([]byte, 1),
+		}
+		testBcachePutWithBlock(t, fakeBlockID(i), b, TransientEntry, block)
+	}
+
+	// Lowering the count limit evicts the oldest blocks right away.
+	b.SetCacheLimits(6, 10)
+	for i := byte(0); i < 2; i++ {
+		testExpectedMissing(t, fakeBlockID(i), b)
+	}
+	if n := b.numTransientEntries(); n != 6 {
+		t.Errorf("Cache holds %d entries, expected 6", n)
+	}
+
+	// So does lowering the bytes limit.
+	b.SetCacheLimits(6, 4)
+	for i := byte(2); i < 4; i++ {
+		testExpectedMissing(t, fakeBlockID(i), b)
+	}
+	if b.cleanTotalBytes != 4 {
+		t.Errorf("Cache holds %d bytes, expected 4", b.cleanTotalBytes)
+	}
+
+	// Raising the limits makes room for more blocks than the cache
+	// was created with.
+	b.SetCacheLimits(20, 20)
+	for i := byte(8); i < 20; i++ {
+		block := &FileBlock{
+			Contents: make([]byte, 1),
+		}
+		if err := b.Put(BlockPointer{ID: fakeBlockID(i)}, tlf, block,
+			TransientEntry); err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+	if n := b.numTransientEntries(); n != 16 {
+		t.Errorf("Cache holds %d entries, expected 16", n)
+	}
+	for i := byte(4); i < 20; i++ {
+		if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+			t.Errorf("Got unexpected error on get: %v", err)
+		}
+	}
+}
+
+func TestBcachePinBlock(t *testing.T) {
+	config := blockCacheTestInit(t, 2, 1<<30)
+	defer CheckConfigAndShutdown(t, config)
+	b := config.BlockCache().(*BlockCacheStandard)
+	tlf := FakeTlfID(1, false)
+	putBlock := func(i byte) {
+		block := &FileBlock{
+			Contents: make([]byte, 1),
+		}
+		if err := b.Put(BlockPointer{ID: fakeBlockID(i)}, tlf, block,
+			TransientEntry); err != nil {
+			t.Fatalf("Got error on Put: %v", err)
+		}
+	}
+
+	// Pin a cached block, and one that isn't cached yet, twice.
+	putBlock(1)
+	ptr1 := BlockPointer{ID: fakeBlockID(1)}
+	ptr2 := BlockPointer{ID: fakeBlockID(2)}
+	b.PinBlock(ptr1, tlf)
+	b.PinBlock(ptr2, tlf)
+	b.PinBlock(ptr2, tlf)
+	putBlock(2)
+
+	// Neither gets evicted by lots of other blocks.
+	for i := byte(3); i < 10; i++ {
+		putBlock(i)
+	}
+	for i := byte(1); i <= 2; i++ {
+		if _, err := b.Get(BlockPointer{ID: fakeBlockID(i)}); err != nil {
+			t.Errorf("Got unexpected error on get: %v", err)
+		}
+	}
+	testExpectedMissing(t, fakeBlockID(3), b)
+	usage := b.Usage()
+	if usage != (BlockCacheUsage{
+		PinnedBlocks: 2, PinnedBytes: 2, EvictableBytes: 2}) {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+
+	// Once unpinned, blocks are evictable again.
+	b.UnpinBlock(ptr1)
+	b.UnpinBlock(ptr2)
+	usage = b.Usage()
+	if usage != (BlockCacheUsage{
+		PinnedBlocks: 1, PinnedBytes: 1, EvictableBytes: 2}) {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+	putBlock(10)
+	putBlock(11)
+	testExpectedMissing(t, fakeBlockID(1), b)
+	if _, err := b.Get(ptr2); err != nil {
+		t.Errorf("Got unexpected error on get: %v", err)
+	}
+
+	b.UnpinBlock(ptr2)
+	putBlock(12)
+	putBlock(13)
+	testExpectedMissing(t, fakeBlockID(2), b)
+	if usage := b.Usage(); usage != (BlockCacheUsage{
+		EvictableBytes: 2}) {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+}
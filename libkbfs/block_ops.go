@@ -20,7 +20,13 @@ var _ BlockOps = (*BlockOpsStandard)(nil)
 
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
-	blockPtr BlockPointer, block Block) error {
+	blockPtr BlockPointer, block Block) (err error) {
+	// Blocks found in the caches never get here, so each of these
+	// spans is a cache miss.
+	ctx, span := startTraceSpan(ctx, b.config, "BlockOps.Get")
+	defer func() { span.finish(err) }()
+	span.setTag("block", blockPtr.ID.String())
+
 	bserv := b.config.BlockServer()
 	buf, blockServerHalf, err := bserv.Get(ctx, blockPtr.ID, md.ID, blockPtr.BlockContext)
 	if err != nil {
@@ -34,6 +40,9 @@ func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
 		return err
 	}
 
+	ctx, cryptoSpan := startTraceSpan(ctx, b.config, "Crypto.DecryptBlock")
+	defer func() { cryptoSpan.finish(err) }()
+
 	crypto := b.config.Crypto()
 	if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
 		return err
@@ -45,6 +54,16 @@ func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
 		return err
 	}
 
+	return decryptBlock(b.config.Codec(), crypto, buf, blockServerHalf,
+		tlfCryptKey, block)
+}
+
+// decryptBlock decodes and decrypts the given buffer, as returned by
+// the block server, into the given block.  buf is untrusted, but must
+// already have been checked against the block's ID.
+func decryptBlock(codec Codec, crypto cryptoPure, buf []byte,
+	blockServerHalf BlockCryptKeyServerHalf, tlfCryptKey TLFCryptKey,
+	block Block) error {
 	// construct the block crypt key
 	blockCryptKey, err := crypto.UnmaskBlockCryptKey(
 		blockServerHalf, tlfCryptKey)
@@ -53,7 +72,7 @@ func (b *BlockOpsStandard) Get(ctx context.Context, md *RootMetadata,
 	}
 
 	var encryptedBlock EncryptedBlock
-	err = b.config.Codec().Decode(buf, &encryptedBlock)
+	err = codec.Decode(buf, &encryptedBlock)
 	if err != nil {
 		return err
 	}
@@ -80,6 +99,9 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, md *RootMetadata,
 		}
 	}()
 
+	ctx, span := startTraceSpan(ctx, b.config, "Crypto.EncryptBlock")
+	defer func() { span.finish(err) }()
+
 	crypto := b.config.Crypto()
 
 	tlfCryptKey, err := b.config.KeyManager().
@@ -0,0 +1,106 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// blockPutPool runs the block puts of a single folder-branch on a
+// bounded set of worker goroutines.  Workers are started on demand,
+// and are shared by all the syncs of the folder-branch, so that the
+// puts of different blocks and files are pipelined behind each other
+// rather than each sync starting (and tearing down) its own workers.
+type blockPutPool struct {
+	maxWorkers int
+	jobs       chan func()
+	shutdownCh chan struct{}
+
+	lock       sync.Mutex
+	numWorkers int
+	// isShutdown is set, under lock, when the pool is shut down,
+	// so that no new worker can start afterwards.
+	isShutdown bool
+}
+
+func newBlockPutPool(maxWorkers int) *blockPutPool {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	return &blockPutPool{
+		maxWorkers: maxWorkers,
+		jobs:       make(chan func()),
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+func (p *blockPutPool) worker(job func()) {
+	for {
+		job()
+		select {
+		case job = <-p.jobs:
+		case <-p.shutdownCh:
+			return
+		}
+	}
+}
+
+// maybeStartWorker starts a new worker running job, and returns
+// true, unless the pool is already at its maximum number of workers.
+// It returns errShutdownHappened if the pool has been shut down.
+func (p *blockPutPool) maybeStartWorker(job func()) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isShutdown {
+		return false, errShutdownHappened
+	}
+	if p.numWorkers >= p.maxWorkers {
+		return false, nil
+	}
+	p.numWorkers++
+	go p.worker(job)
+	return true, nil
+}
+
+// submit runs job on one of the pool's workers, starting a new worker
+// if all the existing ones are busy and there's room for more.  It
+// blocks until a worker picks up the job, ctx is canceled, or the
+// pool is shut down.
+func (p *blockPutPool) submit(ctx context.Context, job func()) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+	}
+
+	if started, err := p.maybeStartWorker(job); err != nil {
+		return err
+	} else if started {
+		return nil
+	}
+
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.shutdownCh:
+		return errShutdownHappened
+	}
+}
+
+// shutdown stops all idle workers, and makes busy ones exit once
+// their current job is done.
+func (p *blockPutPool) shutdown() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isShutdown {
+		return
+	}
+	p.isShutdown = true
+	close(p.shutdownCh)
+}
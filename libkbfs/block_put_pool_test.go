@@ -0,0 +1,97 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestBlockPutPoolBoundsWorkers(t *testing.T) {
+	p := newBlockPutPool(2)
+	defer p.shutdown()
+	ctx := context.Background()
+
+	started := make(chan struct{}, 5)
+	unblock := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(5)
+	job := func() {
+		defer wg.Done()
+		started <- struct{}{}
+		<-unblock
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := p.submit(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	<-started
+
+	// Both workers are busy, so the next submit can't go through
+	// until one of them is free.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := p.submit(canceledCtx, job); err != context.Canceled {
+		t.Fatalf("Unexpected submit error: %v", err)
+	}
+
+	errCh := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errCh <- p.submit(ctx, job) }()
+	}
+	close(unblock)
+	for i := 0; i < 3; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.numWorkers != 2 {
+		t.Errorf("Pool started %d workers, expected 2", p.numWorkers)
+	}
+}
+
+func TestBlockPutPoolShutdown(t *testing.T) {
+	p := newBlockPutPool(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	if err := p.submit(ctx, func() { <-unblock }); err != nil {
+		t.Fatal(err)
+	}
+	defer close(unblock)
+
+	p.shutdown()
+	if err := p.submit(ctx, func() {}); err != errShutdownHappened {
+		t.Fatalf("Unexpected submit error: %v", err)
+	}
+}
+
+func TestBlockPutPoolNoWorkersAfterShutdown(t *testing.T) {
+	p := newBlockPutPool(2)
+	p.shutdown()
+	ran := make(chan struct{}, 1)
+	err := p.submit(context.Background(), func() { ran <- struct{}{} })
+	if err != errShutdownHappened {
+		t.Fatalf("Unexpected submit error: %v", err)
+	}
+	if p.numWorkers != 0 {
+		t.Errorf("Pool started %d workers after shutdown", p.numWorkers)
+	}
+	select {
+	case <-ran:
+		t.Error("Job ran after shutdown")
+	default:
+	}
+	// Shutting down again is harmless.
+	p.shutdown()
+}
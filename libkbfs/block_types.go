@@ -13,6 +13,9 @@ type IndirectDirPtr struct {
 	// field is non-zero.
 	BlockInfo
 	Off string `codec:"o"`
+	// The plaintext size of a leaf block, so that the leaf can be
+	// kept without encoding it again.
+	Size uint64 `codec:"s,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -70,6 +73,12 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// dirtyNames holds the names of the entries that have changed
+	// since the block was copied for writing, or nil if they aren't
+	// tracked.  It lets a split directory keep the leaf blocks that
+	// hold none of them without comparing any entries.
+	dirtyNames map[string]bool
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -79,6 +88,35 @@ func NewDirBlock() Block {
 	}
 }
 
+// DataVersion returns data version for this block.
+func (db *DirBlock) DataVersion() DataVer {
+	if db.IsInd {
+		return IndirectDirsDataVer
+	}
+	for _, de := range db.Children {
+		if len(de.Xattrs) > 0 {
+			return XattrsDataVer
+		}
+	}
+	return FirstValidDataVer
+}
+
+// setEntry sets the entry for the given name.
+func (db *DirBlock) setEntry(name string, de DirEntry) {
+	db.Children[name] = de
+	if db.dirtyNames != nil {
+		db.dirtyNames[name] = true
+	}
+}
+
+// removeEntry removes the entry for the given name.
+func (db *DirBlock) removeEntry(name string) {
+	delete(db.Children, name)
+	if db.dirtyNames != nil {
+		db.dirtyNames[name] = true
+	}
+}
+
 // DeepCopy makes a complete copy of a DirBlock
 func (db DirBlock) DeepCopy(codec Codec) (*DirBlock, error) {
 	var dirBlockCopy DirBlock
@@ -53,6 +53,7 @@ func makeFakeIndirectDirPtrFuture(t *testing.T) indirectDirPtrFuture {
 		indirectDirPtrCurrent{
 			makeFakeBlockInfo(t),
 			"offset",
+			100,
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("IndirectDirPtr", t),
@@ -132,6 +133,7 @@ func makeFakeDirBlockFuture(t *testing.T) dirBlockFuture {
 			},
 			nil,
 			nil,
+			nil,
 		},
 		map[string]dirEntryFuture{
 			"child1": makeFakeDirEntryFuture(t),
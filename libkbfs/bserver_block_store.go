@@ -0,0 +1,490 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// erasureParityShards is the number of parity shards of each
+	// block in an erasure-coded bserverBlockStore, i.e. how many
+	// of its shard directories can be lost without losing any
+	// blocks.
+	erasureParityShards = 2
+	// shardHeaderSize is the size of the header of each shard file:
+	// the size of the block, and a CRC of the shard.
+	shardHeaderSize = 12
+)
+
+var shardCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errShardCorrupt indicates that a shard doesn't match its CRC.
+var errShardCorrupt = errors.New("Shard is corrupt")
+
+// bserverBlockStore stores block data in flat files on disk, keyed by
+// block ID.  Since a block ID is the hash of the block's encrypted
+// contents, identical blocks put by different TLFs have the same ID,
+// so a single bserverBlockStore shared by several TLFs stores each
+// of them only once.  The store keeps track of which TLFs reference
+// each block, and deletes the data once the last of them releases
+// it.
+//
+// The directory layout looks like:
+//
+// dir/0100/0...01/data
+// dir/0100/0...01/tlfs/<TLF ID>
+// ...
+// dir/01ff/f...ff/data
+// dir/01ff/f...ff/tlfs/<TLF ID>
+//
+// which means that a store rooted in the blocks directory of a
+// bserverTlfJournal uses the same location for block data as the
+// journal itself did before stores existed.
+//
+// An erasure-coded store keeps only the tlfs directories in dir.
+// The data of each block is instead split, with a Reed-Solomon code,
+// into one shard per shard directory, each of which should be on a
+// different disk:
+//
+// shardDir/0100/0...01
+// ...
+//
+// Any erasureParityShards of the shard directories can be lost
+// without losing any blocks; scrub finds and rewrites damaged shards.
+// Blocks put before the store was erasure-coded are still read from
+// their data files, until scrub shards them.
+type bserverBlockStore struct {
+	dir       string
+	shardDirs []string
+	// code is nil unless the store is erasure-coded.
+	code *erasureCode
+
+	// Protects all IO operations in dir.
+	lock sync.Mutex
+}
+
+func makeBserverBlockStore(dir string) *bserverBlockStore {
+	return &bserverBlockStore{dir: dir}
+}
+
+// makeErasureCodedBserverBlockStore returns a store keeping its block
+// data in shards, one per given directory.  There must be more shard
+// directories than erasureParityShards.
+func makeErasureCodedBserverBlockStore(dir string, shardDirs []string) (
+	*bserverBlockStore, error) {
+	if len(shardDirs) <= erasureParityShards {
+		return nil, fmt.Errorf("Need more than %d shard directories, "+
+			"got %d", erasureParityShards, len(shardDirs))
+	}
+	code, err := newErasureCode(
+		len(shardDirs)-erasureParityShards, erasureParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &bserverBlockStore{
+		dir:       dir,
+		shardDirs: shardDirs,
+		code:      code,
+	}, nil
+}
+
+func (s *bserverBlockStore) blockPath(id BlockID) string {
+	idStr := id.String()
+	return filepath.Join(s.dir, idStr[:4], idStr[4:])
+}
+
+func (s *bserverBlockStore) dataPath(id BlockID) string {
+	return filepath.Join(s.blockPath(id), "data")
+}
+
+func (s *bserverBlockStore) tlfsPath(id BlockID) string {
+	return filepath.Join(s.blockPath(id), "tlfs")
+}
+
+func (s *bserverBlockStore) shardPath(shard int, id BlockID) string {
+	idStr := id.String()
+	return filepath.Join(s.shardDirs[shard], idStr[:4], idStr[4:])
+}
+
+func (s *bserverBlockStore) writeShardLocked(shard int, id BlockID,
+	size int, data []byte) error {
+	buf := make([]byte, shardHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(size))
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(data, shardCRCTable))
+	copy(buf[shardHeaderSize:], data)
+	path := s.shardPath(shard, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0600)
+}
+
+// readShardLocked returns the given shard of a block, and the size of
+// the block.  It returns errShardCorrupt if the shard doesn't match
+// its CRC.
+func (s *bserverBlockStore) readShardLocked(shard int, id BlockID) (
+	[]byte, int64, error) {
+	buf, err := ioutil.ReadFile(s.shardPath(shard, id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < shardHeaderSize {
+		return nil, 0, errShardCorrupt
+	}
+	data := buf[shardHeaderSize:]
+	if binary.BigEndian.Uint32(buf[8:]) !=
+		crc32.Checksum(data, shardCRCTable) {
+		return nil, 0, errShardCorrupt
+	}
+	return data, int64(binary.BigEndian.Uint64(buf)), nil
+}
+
+// readShardsLocked returns every shard of the given block, with nil
+// for the ones that are missing or damaged, whose indices are
+// returned in bad.  It returns BServerErrorBlockNonExistent if none
+// of the shards exist.
+func (s *bserverBlockStore) readShardsLocked(id BlockID) (
+	shards [][]byte, size int64, bad []int, err error) {
+	shards = make([][]byte, len(s.shardDirs))
+	first := -1
+	exist := false
+	for i := range shards {
+		shard, shardSize, err := s.readShardLocked(i, id)
+		if !os.IsNotExist(err) {
+			exist = true
+		}
+		if err != nil {
+			bad = append(bad, i)
+			continue
+		}
+		// Shards that disagree with the first intact one about
+		// the block can't be trusted either.
+		if first >= 0 &&
+			(shardSize != size || len(shard) != len(shards[first])) {
+			bad = append(bad, i)
+			continue
+		}
+		if first < 0 {
+			first = i
+			size = shardSize
+		}
+		shards[i] = shard
+	}
+	if !exist {
+		return nil, 0, nil, BServerErrorBlockNonExistent{}
+	}
+	return shards, size, bad, nil
+}
+
+// getShardedLocked returns the data of the given block, reconstructed
+// from its shards.
+func (s *bserverBlockStore) getShardedLocked(id BlockID) ([]byte, error) {
+	shards, size, bad, err := s.readShardsLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(bad) > 0 {
+		if err := s.code.reconstruct(shards); err != nil {
+			return nil, fmt.Errorf("Block %s has only %d intact shards: %v",
+				id, len(shards)-len(bad), err)
+		}
+	}
+	return s.code.join(shards, int(size)), nil
+}
+
+// putShardedLocked writes every shard of the given block's data.
+func (s *bserverBlockStore) putShardedLocked(id BlockID, buf []byte) error {
+	for i, shard := range s.code.encode(buf) {
+		if err := s.writeShardLocked(i, id, len(buf), shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasAllShardsLocked returns true if every shard of the given block
+// exists.
+func (s *bserverBlockStore) hasAllShardsLocked(id BlockID) (bool, error) {
+	for i := range s.shardDirs {
+		_, err := os.Stat(s.shardPath(i, id))
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *bserverBlockStore) removeShardsLocked(id BlockID) error {
+	for i := range s.shardDirs {
+		err := os.Remove(s.shardPath(i, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores the data for the given block, unless it's already
+// stored, and records that tlfID references it.  The caller must
+// have already checked that buf hashes to id.
+func (s *bserverBlockStore) put(tlfID TlfID, id BlockID, buf []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.code != nil {
+		ok, err := s.hasAllShardsLocked(id)
+		if err == nil && !ok {
+			err = s.putShardedLocked(id, buf)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := os.Stat(s.dataPath(id))
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(s.blockPath(id), 0700)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(s.dataPath(id), buf, 0600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(s.tlfsPath(id), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		filepath.Join(s.tlfsPath(id), tlfID.String()), nil, 0600)
+}
+
+// get returns the data for the given block.
+func (s *bserverBlockStore) get(id BlockID) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.code != nil {
+		data, err := s.getShardedLocked(id)
+		if _, ok := err.(BServerErrorBlockNonExistent); !ok {
+			return data, err
+		}
+		// The block may have been put before the store was
+		// erasure-coded.
+	}
+
+	data, err := ioutil.ReadFile(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, BServerErrorBlockNonExistent{}
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// getSize returns the size of the data for the given block.
+func (s *bserverBlockStore) getSize(id BlockID) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.code != nil {
+		for i := range s.shardDirs {
+			_, size, err := s.readShardLocked(i, id)
+			if err == nil {
+				return size, nil
+			}
+		}
+	}
+
+	fi, err := os.Stat(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return 0, BServerErrorBlockNonExistent{}
+	} else if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// release records that tlfID no longer references the given block,
+// and deletes the block's data if no other TLF does.
+func (s *bserverBlockStore) release(tlfID TlfID, id BlockID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := os.Remove(filepath.Join(s.tlfsPath(id), tlfID.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	count, err := s.refCountLocked(id)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if s.code != nil {
+		if err := s.removeShardsLocked(id); err != nil {
+			return err
+		}
+	}
+	err = os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.RemoveAll(s.tlfsPath(id))
+	if err != nil {
+		return err
+	}
+	// Only succeeds if nothing else (e.g., the key server half of a
+	// journal sharing this directory) is left.
+	os.Remove(s.blockPath(id))
+	return nil
+}
+
+func (s *bserverBlockStore) refCountLocked(id BlockID) (int, error) {
+	tlfs, err := ioutil.ReadDir(s.tlfsPath(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return len(tlfs), nil
+}
+
+// refCount returns the number of TLFs referencing the given block.
+func (s *bserverBlockStore) refCount(id BlockID) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refCountLocked(id)
+}
+
+// ErasureScrubResult describes what a scrub of an erasure-coded block
+// server found, and fixed.  It is suitable for encoding directly as
+// JSON.
+type ErasureScrubResult struct {
+	// Blocks is how many blocks were checked.
+	Blocks int
+	// DamagedBlocks is how many of them had missing or corrupt
+	// shards.
+	DamagedBlocks int
+	// DamagedShards counts the missing or corrupt shards found in
+	// each shard directory.
+	DamagedShards map[string]int
+	// Unsharded is how many blocks were put before the block
+	// server was erasure-coded.
+	Unsharded int
+	// Rebuilt is how many damaged or unsharded blocks had all of
+	// their shards written again.
+	Rebuilt int
+	// Lost lists the blocks with too few intact shards left to
+	// rebuild them.
+	Lost []BlockID
+}
+
+// scrubBlock checks the shards of one block, and, if rebuild is true,
+// writes the ones that are damaged from the others.
+func (s *bserverBlockStore) scrubBlock(id BlockID, rebuild bool,
+	result *ErasureScrubResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	shards, size, bad, err := s.readShardsLocked(id)
+	if _, ok := err.(BServerErrorBlockNonExistent); ok {
+		data, err := ioutil.ReadFile(s.dataPath(id))
+		if os.IsNotExist(err) {
+			// Nothing is stored here.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		result.Blocks++
+		result.Unsharded++
+		if !rebuild {
+			return nil
+		}
+		if err := s.putShardedLocked(id, data); err != nil {
+			return err
+		}
+		result.Rebuilt++
+		return os.Remove(s.dataPath(id))
+	} else if err != nil {
+		return err
+	}
+
+	result.Blocks++
+	if len(bad) == 0 {
+		return nil
+	}
+	result.DamagedBlocks++
+	for _, i := range bad {
+		result.DamagedShards[s.shardDirs[i]]++
+	}
+	if err := s.code.reconstruct(shards); err == errTooFewShards {
+		result.Lost = append(result.Lost, id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !rebuild {
+		return nil
+	}
+	for _, i := range bad {
+		if err := s.writeShardLocked(i, id, int(size), shards[i]); err != nil {
+			return err
+		}
+	}
+	result.Rebuilt++
+	return nil
+}
+
+// scrub checks every shard of every block in an erasure-coded store,
+// and, if rebuild is true, rewrites the damaged ones, and shards the
+// blocks put before the store was erasure-coded.  Other operations
+// on the store can go on while it runs.
+func (s *bserverBlockStore) scrub(rebuild bool) (ErasureScrubResult, error) {
+	result := ErasureScrubResult{DamagedShards: make(map[string]int)}
+	if s.code == nil {
+		return result, errors.New("The block store isn't erasure-coded")
+	}
+	prefixes, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return result, err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		rests, err := ioutil.ReadDir(filepath.Join(s.dir, prefix.Name()))
+		if err != nil {
+			return result, err
+		}
+		for _, rest := range rests {
+			id, err := BlockIDFromString(prefix.Name() + rest.Name())
+			if err != nil {
+				// Not a block.
+				continue
+			}
+			if err := s.scrubBlock(id, rebuild, &result); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -8,22 +8,60 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
 	"golang.org/x/net/context"
 )
 
 // BlockServerDisk implements the BlockServer interface by just
-// storing blocks in a local leveldb instance.
+// storing blocks in a local leveldb instance.  Block data is stored
+// once no matter how many TLFs put the same block.
+//
+// Each block counts against the quota of the user who first put it,
+// separately for each TLF that references it, unless the TLF belongs
+// to a QuotaPool, in which case the block counts against the pool's
+// quota instead.  Puts of new blocks fail with a throttled
+// BServerErrorOverQuota once the usage they count against would
+// exceed its limit.
+//
+// The block data can also be erasure-coded across several
+// directories, on different disks, so that losing any
+// erasureParityShards of them loses no blocks (see
+// NewBlockServerErasureCoded).  The references and key server halves
+// of the blocks are still kept in the main directory.
 type BlockServerDisk struct {
+	config       Config
 	codec        Codec
 	crypto       Crypto
 	log          logger.Logger
 	dirPath      string
 	shutdownFunc func(logger.Logger)
+	blockStore   *bserverBlockStore
+
+	// quotaLock serializes puts, so that concurrent puts can't
+	// together exceed the quota limit.  It also protects
+	// quotaLimit and quotaPools.
+	quotaLock  sync.Mutex
+	quotaLimit int64
+	// quotaPools maps each pooled TLF to its pool.
+	quotaPools map[TlfID]*quotaPoolLocal
+	// allStorageLoaded is whether every TLF on disk has been
+	// loaded, and so counted in userBytes.  Protected by
+	// quotaLock.
+	allStorageLoaded bool
+
+	// userBytesLock protects userBytes, the bytes written by each
+	// uploader to all the loaded TLFs, pooled or not.  It's kept
+	// up to date by the TLF storage as blocks are put, removed and
+	// archived, so that puts don't have to add up the usage of
+	// every TLF.
+	userBytesLock sync.Mutex
+	userBytes     map[keybase1.UID]int64
 
 	tlfStorageLock sync.RWMutex
 	// tlfStorage is nil after Shutdown() is called.
@@ -32,16 +70,32 @@ type BlockServerDisk struct {
 
 var _ BlockServer = (*BlockServerDisk)(nil)
 
+// sharedBlocksPath returns where a BlockServerDisk in the given
+// directory keeps its bserverBlockStore.
+func sharedBlocksPath(dirPath string) string {
+	return filepath.Join(dirPath, "shared_blocks")
+}
+
 // newBlockServerDisk constructs a new BlockServerDisk that stores
-// its data in the given directory.
-func newBlockServerDisk(
-	config Config, dirPath string, shutdownFunc func(logger.Logger)) *BlockServerDisk {
+// its data in the given directory, and its block data in the given
+// store.
+func newBlockServerDisk(config Config, dirPath string,
+	blockStore *bserverBlockStore,
+	shutdownFunc func(logger.Logger)) *BlockServerDisk {
 	bserv := &BlockServerDisk{
+		config,
 		config.Codec(),
 		config.Crypto(),
 		config.MakeLogger("BSD"),
 		dirPath,
 		shutdownFunc,
+		blockStore,
+		sync.Mutex{},
+		math.MaxInt64,
+		make(map[TlfID]*quotaPoolLocal),
+		false,
+		sync.Mutex{},
+		make(map[keybase1.UID]int64),
 		sync.RWMutex{},
 		make(map[TlfID]*bserverTlfJournal),
 	}
@@ -51,7 +105,24 @@ func newBlockServerDisk(
 // NewBlockServerDir constructs a new BlockServerDisk that stores
 // its data in the given directory.
 func NewBlockServerDir(config Config, dirPath string) *BlockServerDisk {
-	return newBlockServerDisk(config, dirPath, nil)
+	return newBlockServerDisk(config, dirPath,
+		makeBserverBlockStore(sharedBlocksPath(dirPath)), nil)
+}
+
+// NewBlockServerErasureCoded constructs a new BlockServerDisk that
+// stores its data in the given directory, except for the block data,
+// which it erasure-codes into one shard per given shard directory.
+// There must be more than erasureParityShards shard directories, e.g.
+// six for four data shards and two parity shards.  Blocks already
+// stored in the directory without erasure coding can still be read.
+func NewBlockServerErasureCoded(config Config, dirPath string,
+	shardDirs []string) (*BlockServerDisk, error) {
+	blockStore, err := makeErasureCodedBserverBlockStore(
+		sharedBlocksPath(dirPath), shardDirs)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockServerDisk(config, dirPath, blockStore, nil), nil
 }
 
 // NewBlockServerTempDir constructs a new BlockServerDisk that stores its
@@ -61,7 +132,8 @@ func NewBlockServerTempDir(config Config) (*BlockServerDisk, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newBlockServerDisk(config, tempdir, func(log logger.Logger) {
+	blockStore := makeBserverBlockStore(sharedBlocksPath(tempdir))
+	return newBlockServerDisk(config, tempdir, blockStore, func(log logger.Logger) {
 		err := os.RemoveAll(tempdir)
 		if err != nil {
 			log.Warning("error removing %s: %s", tempdir, err)
@@ -71,6 +143,78 @@ func NewBlockServerTempDir(config Config) (*BlockServerDisk, error) {
 
 var errBlockServerDiskShutdown = errors.New("BlockServerDisk is shutdown")
 
+// Scrub checks every shard of every block of an erasure-coded
+// BlockServerDisk.  If rebuild is true, it also writes the missing or
+// corrupt shards again from the intact ones, and shards the blocks
+// stored before erasure coding was turned on.  The BlockServerDisk
+// keeps serving blocks while it runs.
+func (b *BlockServerDisk) Scrub(ctx context.Context, rebuild bool) (
+	ErasureScrubResult, error) {
+	b.log.CDebugf(ctx, "BlockServerDisk.Scrub rebuild=%t", rebuild)
+	return b.blockStore.scrub(rebuild)
+}
+
+// scrubBlockServerShards is like BlockServerDisk.Scrub, for the
+// erasure-coded BlockServerDisk in the given directories, which must
+// not be in use by a running BlockServerDisk.
+func scrubBlockServerShards(dirPath string, shardDirs []string,
+	rebuild bool) (ErasureScrubResult, error) {
+	blockStore, err := makeErasureCodedBserverBlockStore(
+		sharedBlocksPath(dirPath), shardDirs)
+	if err != nil {
+		return ErasureScrubResult{}, err
+	}
+	return blockStore.scrub(rebuild)
+}
+
+// SetQuotaLimit sets the number of bytes each user may have stored
+// in this BlockServerDisk.
+func (b *BlockServerDisk) SetQuotaLimit(limit int64) {
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	b.quotaLimit = limit
+}
+
+// quotaPoolLocal is a QuotaPool with its folder IDs parsed.
+type quotaPoolLocal struct {
+	name  string
+	limit int64
+	tlfs  map[TlfID]bool
+}
+
+// SetQuotaPools replaces the quota pools of this BlockServerDisk.  A
+// folder may belong to at most one pool.
+func (b *BlockServerDisk) SetQuotaPools(pools []QuotaPool) error {
+	quotaPools := make(map[TlfID]*quotaPoolLocal)
+	for _, pool := range pools {
+		p := &quotaPoolLocal{
+			name:  pool.Name,
+			limit: pool.Limit,
+			tlfs:  make(map[TlfID]bool),
+		}
+		if p.limit == 0 {
+			p.limit = math.MaxInt64
+		}
+		for _, folder := range pool.Folders {
+			tlfID, err := ParseTlfID(folder)
+			if err != nil {
+				return err
+			}
+			if other, ok := quotaPools[tlfID]; ok {
+				return fmt.Errorf("Folder %s is in quota pools %s and %s",
+					tlfID, other.name, p.name)
+			}
+			p.tlfs[tlfID] = true
+			quotaPools[tlfID] = p
+		}
+	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	b.quotaPools = quotaPools
+	return nil
+}
+
 func (b *BlockServerDisk) getStorage(tlfID TlfID) (*bserverTlfJournal, error) {
 	storage, err := func() (*bserverTlfJournal, error) {
 		b.tlfStorageLock.RLock()
@@ -101,7 +245,8 @@ func (b *BlockServerDisk) getStorage(tlfID TlfID) (*bserverTlfJournal, error) {
 	}
 
 	path := filepath.Join(b.dirPath, tlfID.String())
-	storage, err = makeBserverTlfJournal(b.codec, b.crypto, path)
+	storage, err = makeSharedBserverTlfJournal(
+		b.codec, b.crypto, path, tlfID, b.blockStore, b.chargeUserBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +255,38 @@ func (b *BlockServerDisk) getStorage(tlfID TlfID) (*bserverTlfJournal, error) {
 	return storage, nil
 }
 
+// getLoadedStorage returns the storage of the given TLF, or nil if
+// it hasn't been loaded.
+func (b *BlockServerDisk) getLoadedStorage(tlfID TlfID) *bserverTlfJournal {
+	b.tlfStorageLock.RLock()
+	defer b.tlfStorageLock.RUnlock()
+	return b.tlfStorage[tlfID]
+}
+
+// loadAllStorageLocked loads every TLF on disk, if that hasn't been
+// done yet, so that all of them are counted in userBytes.
+func (b *BlockServerDisk) loadAllStorageLocked() error {
+	if b.allStorageLoaded {
+		return nil
+	}
+	if _, err := b.getAllStorage(); err != nil {
+		return err
+	}
+	b.allStorageLoaded = true
+	return nil
+}
+
+// chargeUserBytes adds the given number of bytes, which may be
+// negative, to the usage of the given uploader.
+func (b *BlockServerDisk) chargeUserBytes(uid keybase1.UID, bytes int64) {
+	b.userBytesLock.Lock()
+	defer b.userBytesLock.Unlock()
+	b.userBytes[uid] += bytes
+	if b.userBytes[uid] == 0 {
+		delete(b.userBytes, uid)
+	}
+}
+
 // Get implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
@@ -126,6 +303,13 @@ func (b *BlockServerDisk) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	return data, keyServerHalf, nil
 }
 
+// GetKey implements the BlockServer interface for BlockServerDisk.
+func (b *BlockServerDisk) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (BlockCryptKeyServerHalf, error) {
+	_, serverHalf, err := b.Get(ctx, id, tlfID, context)
+	return serverHalf, err
+}
+
 // Put implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext, buf []byte,
@@ -141,9 +325,56 @@ func (b *BlockServerDisk) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	if err != nil {
 		return err
 	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	// Blocks already referenced by this TLF don't cost anything
+	// more.
+	if !tlfStorage.hasReferences(id) {
+		err := b.checkQuotaLocked(tlfID, context.GetCreator(), len(buf))
+		if err != nil {
+			return err
+		}
+	}
 	return tlfStorage.putData(id, context, buf, serverHalf)
 }
 
+// checkQuotaLocked returns an error if the given uploader can't put
+// size more bytes into the given TLF.
+func (b *BlockServerDisk) checkQuotaLocked(
+	tlfID TlfID, uid keybase1.UID, size int) error {
+	if err := b.loadAllStorageLocked(); err != nil {
+		return err
+	}
+	var usage, limit int64
+	quota := "quota"
+	if pool, ok := b.quotaPools[tlfID]; ok {
+		info, err := b.getQuotaPoolInfoLocked(pool)
+		if err != nil {
+			return err
+		}
+		usage, limit = info.Total.Bytes[UsageWrite], info.Limit
+		quota = fmt.Sprintf("quota of pool %s", pool.name)
+	} else {
+		var err error
+		usage, err = b.getUserBytesLocked(uid)
+		if err != nil {
+			return err
+		}
+		limit = b.quotaLimit
+	}
+	if usage+int64(size) > limit {
+		return BServerErrorOverQuota{
+			Msg: fmt.Sprintf("Putting %d bytes would exceed the "+
+				"%s of %d bytes", size, quota, limit),
+			Usage:     usage,
+			Limit:     limit,
+			Throttled: true,
+		}
+	}
+	return nil
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) AddBlockReference(ctx context.Context, id BlockID,
 	tlfID TlfID, context BlockContext) error {
@@ -235,8 +466,169 @@ func (b *BlockServerDisk) Shutdown() {
 // RefreshAuthToken implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) RefreshAuthToken(_ context.Context) {}
 
+// getAllStorage returns the storage of every TLF with data in this
+// BlockServerDisk, including the ones not accessed since startup.
+func (b *BlockServerDisk) getAllStorage() (
+	map[TlfID]*bserverTlfJournal, error) {
+	fis, err := ioutil.ReadDir(b.dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	res := make(map[TlfID]*bserverTlfJournal)
+	for _, fi := range fis {
+		tlfID, err := ParseTlfID(fi.Name())
+		if err != nil {
+			// Not a TLF directory (e.g., shared_blocks).
+			continue
+		}
+		res[tlfID], err = b.getStorage(tlfID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (b *BlockServerDisk) getUserQuotaInfoLocked(uid keybase1.UID) (
+	*UserQuotaInfo, error) {
+	allStorage, err := b.getAllStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	info := NewUserQuotaInfo()
+	info.Limit = b.quotaLimit
+	for tlfID, tlfStorage := range allStorage {
+		if _, ok := b.quotaPools[tlfID]; ok {
+			// Charged to the pool instead.
+			continue
+		}
+		usage, err := tlfStorage.getQuotaUsage()
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := usage[uid]; ok {
+			info.Folders[tlfID.String()] = u
+			info.Total.Accum(u, func(a, b int64) int64 { return a + b })
+		}
+	}
+	return info, nil
+}
+
+// getUserBytesLocked returns the bytes the given uploader has
+// written to TLFs that aren't pooled.  It must be called after
+// loadAllStorageLocked.
+func (b *BlockServerDisk) getUserBytesLocked(uid keybase1.UID) (
+	int64, error) {
+	bytes := func() int64 {
+		b.userBytesLock.Lock()
+		defer b.userBytesLock.Unlock()
+		return b.userBytes[uid]
+	}()
+	// userBytes counts pooled TLFs too, so take those back out.
+	for tlfID := range b.quotaPools {
+		tlfStorage := b.getLoadedStorage(tlfID)
+		if tlfStorage == nil {
+			// Nothing has been stored in it yet.
+			continue
+		}
+		usage, err := tlfStorage.getQuotaUsage()
+		if err != nil {
+			return 0, err
+		}
+		if u, ok := usage[uid]; ok {
+			bytes -= u.Bytes[UsageWrite]
+		}
+	}
+	return bytes, nil
+}
+
+func (b *BlockServerDisk) getQuotaPoolInfoLocked(pool *quotaPoolLocal) (
+	*QuotaPoolInfo, error) {
+	if err := b.loadAllStorageLocked(); err != nil {
+		return nil, err
+	}
+
+	info := NewQuotaPoolInfo(pool.name, pool.limit)
+	for tlfID := range pool.tlfs {
+		tlfStorage := b.getLoadedStorage(tlfID)
+		if tlfStorage == nil {
+			// Nothing has been stored in it yet.
+			continue
+		}
+		usage, err := tlfStorage.getQuotaUsage()
+		if err != nil {
+			return nil, err
+		}
+		info.AccumFolder(tlfID.String(), usage)
+	}
+	return info, nil
+}
+
 // GetUserQuotaInfo implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) GetUserQuotaInfo(ctx context.Context) (info *UserQuotaInfo, err error) {
-	// Return a dummy value here.
-	return &UserQuotaInfo{Limit: 0x7FFFFFFFFFFFFFFF}, nil
+	_, uid, err := b.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	return b.getUserQuotaInfoLocked(uid)
+}
+
+// GetTLFQuotaInfo implements the BlockServer interface for BlockServerDisk.
+func (b *BlockServerDisk) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	_, uid, err := b.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlfStorage := b.getLoadedStorage(tlfID)
+	if tlfStorage == nil {
+		// Only load folders that exist on disk, since loading
+		// a folder creates its storage, and a query shouldn't.
+		_, err := os.Stat(filepath.Join(b.dirPath, tlfID.String()))
+		if os.IsNotExist(err) {
+			return NewUsageStat(), nil
+		} else if err != nil {
+			return nil, err
+		}
+		tlfStorage, err = b.getStorage(tlfID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	usage, err := tlfStorage.getQuotaUsage()
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := usage[uid]; ok {
+		return u, nil
+	}
+	return NewUsageStat(), nil
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerDisk.
+func (b *BlockServerDisk) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	pool, ok := b.quotaPools[tlfID]
+	if !ok {
+		return nil, nil
+	}
+	return b.getQuotaPoolInfoLocked(pool)
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerDisk.
+func (b *BlockServerDisk) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	return BlockServerCapabilities{
+		Encodings: []string{RawBlockTransportEncodingName},
+	}, nil
 }
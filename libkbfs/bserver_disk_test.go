@@ -0,0 +1,270 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBServerDiskQuota(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	b, err := NewBlockServerTempDir(config)
+	require.NoError(t, err)
+	defer b.Shutdown()
+	b.SetQuotaLimit(10)
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	put := func(tlfID TlfID, data []byte) error {
+		id, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+		return b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	}
+
+	tlfID1 := FakeTlfID(1, false)
+	tlfID2 := FakeTlfID(2, false)
+	data := []byte{1, 2, 3, 4, 5, 6}
+	err = put(tlfID1, data)
+	require.NoError(t, err)
+	// Putting the same block again doesn't cost anything.
+	err = put(tlfID1, data)
+	require.NoError(t, err)
+
+	info, err := b.GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), info.Limit)
+	require.Equal(t, int64(6), info.Total.Bytes[UsageWrite])
+	require.Equal(t, int64(6), info.Folders[tlfID1.String()].Bytes[UsageWrite])
+
+	// The same block counts again in another folder, which would
+	// exceed the quota.
+	err = put(tlfID2, data)
+	require.Equal(t, BServerErrorOverQuota{
+		Msg:       "Putting 6 bytes would exceed the quota of 10 bytes",
+		Usage:     6,
+		Limit:     10,
+		Throttled: true,
+	}, err)
+
+	// But a smaller block still fits.
+	err = put(tlfID2, []byte{7, 8, 9, 10})
+	require.NoError(t, err)
+	info, err = b.GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), info.Total.Bytes[UsageWrite])
+
+	// Removing the first block frees up its space.
+	id, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	_, err = b.RemoveBlockReference(ctx, tlfID1, map[BlockID][]BlockContext{
+		id: {{uid, "", zeroBlockRefNonce}},
+	})
+	require.NoError(t, err)
+	err = put(tlfID2, data)
+	require.NoError(t, err)
+}
+
+func TestBServerDiskTLFQuotaInfo(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	b, err := NewBlockServerTempDir(config)
+	require.NoError(t, err)
+	defer b.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	tlfID1 := FakeTlfID(1, false)
+	tlfID2 := FakeTlfID(2, false)
+	data := []byte{1, 2, 3, 4, 5, 6}
+	id, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	err = b.Put(ctx, id, tlfID1, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	err = b.ArchiveBlockReferences(ctx, tlfID1,
+		map[BlockID][]BlockContext{id: {bCtx}})
+	require.NoError(t, err)
+
+	usage, err := b.GetTLFQuotaInfo(ctx, tlfID1)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), usage.Bytes[UsageWrite])
+	require.Equal(t, int64(6), usage.Bytes[UsageArchive])
+
+	// Folders without any blocks report no usage, and asking
+	// about them doesn't create any storage for them.
+	usage, err = b.GetTLFQuotaInfo(ctx, tlfID2)
+	require.NoError(t, err)
+	require.False(t, usage.NonZero())
+	require.Nil(t, b.getLoadedStorage(tlfID2))
+	_, err = os.Stat(filepath.Join(b.dirPath, tlfID2.String()))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestBServerDiskQuotaPools(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	b, err := NewBlockServerTempDir(config)
+	require.NoError(t, err)
+	defer b.Shutdown()
+	b.SetQuotaLimit(10)
+
+	tlfID1 := FakeTlfID(1, false)
+	tlfID2 := FakeTlfID(2, false)
+	tlfID3 := FakeTlfID(3, false)
+	err = b.SetQuotaPools([]QuotaPool{{
+		Name:    "eng",
+		Limit:   20,
+		Folders: []string{tlfID1.String(), tlfID2.String()},
+	}})
+	require.NoError(t, err)
+
+	// A folder can only be in one pool.
+	err = b.SetQuotaPools([]QuotaPool{
+		{Name: "a", Folders: []string{tlfID1.String()}},
+		{Name: "b", Folders: []string{tlfID1.String()}},
+	})
+	require.Error(t, err)
+
+	_, alice, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	_, bob, err := config.KBPKI().Resolve(ctx, "bob")
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	put := func(tlfID TlfID, uid keybase1.UID, data []byte) error {
+		id, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+		return b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	}
+
+	// Pooled folders can go past each member's personal quota.
+	err = put(tlfID1, alice, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	require.NoError(t, err)
+	err = put(tlfID2, alice, []byte{1, 2, 3, 4, 5, 6})
+	require.NoError(t, err)
+	err = put(tlfID2, bob, []byte{7, 8, 9, 10})
+	require.NoError(t, err)
+
+	info, err := b.GetQuotaPoolInfo(ctx, tlfID2)
+	require.NoError(t, err)
+	require.Equal(t, "eng", info.Name)
+	require.Equal(t, int64(20), info.Limit)
+	require.Equal(t, int64(18), info.Total.Bytes[UsageWrite])
+	require.Equal(t, int64(14), info.Members[alice].Bytes[UsageWrite])
+	require.Equal(t, int64(4), info.Members[bob].Bytes[UsageWrite])
+	require.Equal(t, int64(8),
+		info.Folders[tlfID1.String()].Bytes[UsageWrite])
+	require.Equal(t, int64(10),
+		info.Folders[tlfID2.String()].Bytes[UsageWrite])
+
+	// But not past the pool's.
+	err = put(tlfID1, bob, []byte{11, 12, 13})
+	require.Equal(t, BServerErrorOverQuota{
+		Msg: "Putting 3 bytes would exceed the quota of pool eng " +
+			"of 20 bytes",
+		Usage:     18,
+		Limit:     20,
+		Throttled: true,
+	}, err)
+
+	// Pooled folders don't count against personal quotas.
+	uqi, err := b.GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.False(t, uqi.Total.NonZero())
+	err = put(tlfID3, alice, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	require.NoError(t, err)
+
+	info, err = b.GetQuotaPoolInfo(ctx, tlfID3)
+	require.NoError(t, err)
+	require.Nil(t, info)
+}
+
+func TestBServerDiskErasureCoded(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_bserver_shards")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	var shardDirs []string
+	for i := 0; i < 4; i++ {
+		shardDirs = append(shardDirs,
+			filepath.Join(tempdir, fmt.Sprintf("shard%d", i)))
+	}
+	b, err := NewBlockServerErasureCoded(
+		config, filepath.Join(tempdir, "root"), shardDirs)
+	require.NoError(t, err)
+	defer b.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	id, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	err = b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	result, err := b.Scrub(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Blocks)
+	require.Equal(t, 0, result.DamagedBlocks)
+
+	// Losing two of the shard directories loses no data.
+	require.NoError(t, os.RemoveAll(shardDirs[0]))
+	require.NoError(t, os.RemoveAll(shardDirs[3]))
+	buf, _, err := b.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	result, err = b.Scrub(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.DamagedBlocks)
+	require.Equal(t, map[string]int{shardDirs[0]: 1, shardDirs[3]: 1},
+		result.DamagedShards)
+	require.Equal(t, 0, result.Rebuilt)
+
+	result, err = b.Scrub(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Rebuilt)
+	require.Len(t, result.Lost, 0)
+
+	// The rebuilt shards are enough on their own.
+	require.NoError(t, os.RemoveAll(shardDirs[1]))
+	require.NoError(t, os.RemoveAll(shardDirs[2]))
+	buf, _, err = b.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
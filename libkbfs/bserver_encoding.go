@@ -0,0 +1,166 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// RawBlockTransportEncodingName is the name of the encoding that
+// sends blocks unchanged.  Every client and server supports it, and
+// it's the only one used with servers that can't negotiate
+// encodings.
+const RawBlockTransportEncodingName = "raw"
+
+type rawBlockTransportEncoding struct{}
+
+var _ BlockTransportEncoding = rawBlockTransportEncoding{}
+
+// Name implements the BlockTransportEncoding interface for
+// rawBlockTransportEncoding.
+func (rawBlockTransportEncoding) Name() string {
+	return RawBlockTransportEncodingName
+}
+
+// Encode implements the BlockTransportEncoding interface for
+// rawBlockTransportEncoding.
+func (rawBlockTransportEncoding) Encode(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+// Decode implements the BlockTransportEncoding interface for
+// rawBlockTransportEncoding.
+func (rawBlockTransportEncoding) Decode(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+// findBlockTransportEncoding returns the encoding with the given name
+// from encodings, or the raw encoding.
+func findBlockTransportEncoding(encodings []BlockTransportEncoding,
+	name string) (BlockTransportEncoding, error) {
+	if name == RawBlockTransportEncodingName {
+		return rawBlockTransportEncoding{}, nil
+	}
+	for _, e := range encodings {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+	return nil, BServerErrorBadRequest{
+		Msg: fmt.Sprintf("Unknown block encoding %q", name)}
+}
+
+// chooseBlockTransportEncoding returns the first of the preferred
+// encodings that is also in supported, or the raw encoding if there
+// is none.
+func chooseBlockTransportEncoding(preferred []BlockTransportEncoding,
+	supported []string) BlockTransportEncoding {
+	for _, e := range preferred {
+		for _, name := range supported {
+			if e.Name() == name {
+				return e
+			}
+		}
+	}
+	return rawBlockTransportEncoding{}
+}
+
+// blockTransportEncodingNames returns the names of encodings, with
+// the raw encoding last.
+func blockTransportEncodingNames(encodings []BlockTransportEncoding) []string {
+	names := make([]string, 0, len(encodings)+1)
+	for _, e := range encodings {
+		if e.Name() != RawBlockTransportEncodingName {
+			names = append(names, e.Name())
+		}
+	}
+	return append(names, RawBlockTransportEncodingName)
+}
+
+// blockEncodingHandler serves the encoded block RPCs on top of any
+// BlockServer, the same way a remote block server does, so that
+// local servers can stand in for a remote one in tests.
+type blockEncodingHandler struct {
+	bserver   BlockServer
+	encodings []BlockTransportEncoding
+}
+
+func (h blockEncodingHandler) getBlockEncodings() []string {
+	return blockTransportEncodingNames(h.encodings)
+}
+
+func (h blockEncodingHandler) putBlockEncoded(ctx context.Context,
+	arg putBlockEncodedArg) error {
+	id, err := BlockIDFromString(arg.Bid.BlockHash)
+	if err != nil {
+		return err
+	}
+	tlfID, err := ParseTlfID(arg.Folder)
+	if err != nil {
+		return err
+	}
+	serverHalf, err := ParseBlockCryptKeyServerHalf(arg.BlockKey)
+	if err != nil {
+		return err
+	}
+	encoding, err := findBlockTransportEncoding(h.encodings, arg.Encoding)
+	if err != nil {
+		return err
+	}
+	buf, err := encoding.Decode(arg.Buf)
+	if err != nil {
+		return BServerErrorBadRequest{Msg: err.Error()}
+	}
+
+	bCtx := BlockContext{
+		RefNonce: zeroBlockRefNonce,
+		Creator:  arg.Bid.ChargedTo,
+	}
+	return h.bserver.Put(ctx, id, tlfID, bCtx, buf, serverHalf)
+}
+
+func (h blockEncodingHandler) getBlockEncoded(ctx context.Context,
+	arg getBlockEncodedArg) (getBlockEncodedRes, error) {
+	id, err := BlockIDFromString(arg.Bid.BlockHash)
+	if err != nil {
+		return getBlockEncodedRes{}, err
+	}
+	tlfID, err := ParseTlfID(arg.Folder)
+	if err != nil {
+		return getBlockEncodedRes{}, err
+	}
+
+	// The RPC doesn't pass along the whole block context, so use
+	// the one the block was originally put with.
+	bCtx := BlockContext{
+		RefNonce: zeroBlockRefNonce,
+		Creator:  arg.Bid.ChargedTo,
+	}
+	buf, serverHalf, err := h.bserver.Get(ctx, id, tlfID, bCtx)
+	if err != nil {
+		return getBlockEncodedRes{}, err
+	}
+
+	// Use the first encoding the client accepts.
+	var encoding BlockTransportEncoding = rawBlockTransportEncoding{}
+	for _, name := range arg.Encodings {
+		if e, err := findBlockTransportEncoding(
+			h.encodings, name); err == nil {
+			encoding = e
+			break
+		}
+	}
+	encoded, err := encoding.Encode(buf)
+	if err != nil {
+		return getBlockEncodedRes{}, err
+	}
+	return getBlockEncodedRes{
+		BlockKey: serverHalf.String(),
+		Encoding: encoding.Name(),
+		Buf:      encoded,
+	}, nil
+}
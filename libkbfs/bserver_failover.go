@@ -0,0 +1,387 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// bserverHealthCheckPeriod is how often a BlockServerFailover checks
+// whether its unreachable block servers are back.
+const bserverHealthCheckPeriod = 10 * time.Second
+
+// errNoBlockServerAvailable is returned by a BlockServerFailover when
+// none of its block servers can be reached.
+var errNoBlockServerAvailable = errors.New("No block server is available")
+
+// isBServerUnavailable returns whether err, returned from a block
+// server call made with ctx, means that the server couldn't be
+// reached, rather than that it refused the request.
+func isBServerUnavailable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if _, ok := err.(BServerErrorThrottle); ok {
+		return true
+	}
+	// Every error that the block server itself returns can be
+	// turned into a status for the RPC reply.
+	_, ok := err.(interface {
+		ToStatus() keybase1.Status
+	})
+	return !ok
+}
+
+// bserverFailoverWrite is a write that a BlockServerFailover's
+// primary block server missed, journaled to be replayed once it's
+// back.
+type bserverFailoverWrite struct {
+	name  string
+	id    BlockID
+	apply func(ctx context.Context, bserv BlockServer) error
+}
+
+// BlockServerFailover is a BlockServer that spreads its calls over an
+// ordered list of block servers, e.g. the same block store in
+// several regions.  Every call goes to the first of them that's
+// reachable.  Once a block server can't be reached, it's skipped
+// until a periodic health check finds it reachable again.
+//
+// Writes that go to any server but the first, the primary, are also
+// journaled in memory.  When the primary comes back, the journal is
+// replayed to it, in order, before it's used again.
+type BlockServerFailover struct {
+	config  Config
+	log     logger.Logger
+	servers []BlockServer
+
+	lock sync.Mutex
+	// down is whether each server has been found to be
+	// unreachable.
+	down []bool
+	// journal holds the writes the primary has missed, in the
+	// order they were made.  The primary stays down until they've
+	// been replayed to it.
+	journal []bserverFailoverWrite
+
+	// replayLock makes sure only one replay runs at a time.
+	replayLock sync.Mutex
+
+	shutdownChan chan struct{}
+	shutdownOnce sync.Once
+}
+
+var _ BlockServer = (*BlockServerFailover)(nil)
+
+// NewBlockServerFailover returns a new BlockServerFailover that uses
+// the given block servers, in order of preference, and starts its
+// health checks.
+func NewBlockServerFailover(config Config,
+	servers []BlockServer) *BlockServerFailover {
+	b := &BlockServerFailover{
+		config:       config,
+		log:          config.MakeLogger(""),
+		servers:      servers,
+		down:         make([]bool, len(servers)),
+		shutdownChan: make(chan struct{}),
+	}
+	go b.healthCheckLoop()
+	return b
+}
+
+func (b *BlockServerFailover) healthCheckLoop() {
+	ticker := time.NewTicker(bserverHealthCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.checkHealth(context.Background())
+		case <-b.shutdownChan:
+			return
+		}
+	}
+}
+
+// checkHealth probes every server that's down, and brings back the
+// ones that answer.  A recovered primary gets its journal replayed
+// first.
+func (b *BlockServerFailover) checkHealth(ctx context.Context) {
+	for i, bserv := range b.servers {
+		if !b.isDown(i) {
+			continue
+		}
+		_, err := bserv.GetUserQuotaInfo(ctx)
+		if isBServerUnavailable(ctx, err) {
+			continue
+		}
+		if i == 0 {
+			err = b.replayJournal(ctx)
+			if err != nil {
+				b.log.CDebugf(ctx, "Couldn't replay the journal to the "+
+					"primary block server: %v", err)
+				continue
+			}
+		} else {
+			b.setDown(i, false)
+		}
+		b.log.CDebugf(ctx, "Block server %d is back", i)
+	}
+}
+
+// replayJournal applies the journaled writes to the primary, in
+// order, and marks the primary as up once they've all been applied.
+func (b *BlockServerFailover) replayJournal(ctx context.Context) error {
+	b.replayLock.Lock()
+	defer b.replayLock.Unlock()
+	primary := b.servers[0]
+	for {
+		var write bserverFailoverWrite
+		done := func() bool {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			if len(b.journal) == 0 {
+				b.down[0] = false
+				return true
+			}
+			write = b.journal[0]
+			return false
+		}()
+		if done {
+			return nil
+		}
+
+		err := write.apply(ctx, primary)
+		if isBServerUnavailable(ctx, err) || ctx.Err() != nil {
+			b.setDown(0, true)
+			return err
+		} else if err != nil {
+			// The primary refused the write, so replaying it
+			// again won't help.
+			b.log.CWarningf(ctx, "Dropping journaled %s of block %s, "+
+				"refused by the primary block server: %v",
+				write.name, write.id, err)
+		}
+
+		b.lock.Lock()
+		b.journal = b.journal[1:]
+		b.lock.Unlock()
+	}
+}
+
+func (b *BlockServerFailover) isDown(i int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.down[i]
+}
+
+func (b *BlockServerFailover) setDown(i int, down bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.down[i] = down
+}
+
+// JournalLength returns the number of writes waiting to be replayed
+// to the primary block server.
+func (b *BlockServerFailover) JournalLength() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.journal)
+}
+
+// do runs f against each reachable server in turn, until one can be
+// reached, and returns the index of that server.
+func (b *BlockServerFailover) do(ctx context.Context,
+	f func(bserv BlockServer) error) (int, error) {
+	for i, bserv := range b.servers {
+		if b.isDown(i) {
+			continue
+		}
+		err := f(bserv)
+		if !isBServerUnavailable(ctx, err) {
+			return i, err
+		}
+		b.log.CDebugf(ctx, "Block server %d is unreachable: %v", i, err)
+		b.setDown(i, true)
+	}
+	return -1, errNoBlockServerAvailable
+}
+
+// write runs f like do, and journals it for the primary if it didn't
+// go there.  Writes that depend on each other are never in flight at
+// the same time, so journaling each write once it's done keeps them
+// in order.
+func (b *BlockServerFailover) write(ctx context.Context, name string,
+	id BlockID, f func(ctx context.Context, bserv BlockServer) error) error {
+	i, err := b.do(ctx, func(bserv BlockServer) error {
+		return f(ctx, bserv)
+	})
+	if err != nil || i == 0 {
+		return err
+	}
+
+	primaryUp := func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.journal = append(b.journal, bserverFailoverWrite{name, id, f})
+		return !b.down[0]
+	}()
+	if primaryUp {
+		// The primary came back while f was running, so it has
+		// to catch up before anything that depends on this write
+		// goes to it.
+		if err := b.replayJournal(ctx); err != nil {
+			b.log.CDebugf(ctx, "Couldn't replay the journal to the "+
+				"primary block server: %v", err)
+		}
+	}
+	return nil
+}
+
+// Get implements the BlockServer interface for BlockServerFailover.
+func (b *BlockServerFailover) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		buf, serverHalf, err = bserv.Get(ctx, id, tlfID, context)
+		return err
+	})
+	return buf, serverHalf, err
+}
+
+// GetKey implements the BlockServer interface for BlockServerFailover.
+func (b *BlockServerFailover) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	serverHalf BlockCryptKeyServerHalf, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		serverHalf, err = bserv.GetKey(ctx, id, tlfID, context)
+		return err
+	})
+	return serverHalf, err
+}
+
+// Put implements the BlockServer interface for BlockServerFailover.
+func (b *BlockServerFailover) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, blockCtx BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	return b.write(ctx, "put", id,
+		func(ctx context.Context, bserv BlockServer) error {
+			return bserv.Put(ctx, id, tlfID, blockCtx, buf, serverHalf)
+		})
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) AddBlockReference(ctx context.Context,
+	id BlockID, tlfID TlfID, blockCtx BlockContext) error {
+	return b.write(ctx, "reference", id,
+		func(ctx context.Context, bserv BlockServer) error {
+			return bserv.AddBlockReference(ctx, id, tlfID, blockCtx)
+		})
+}
+
+// firstBlockID returns an arbitrary ID from contexts, for logging.
+func firstBlockID(contexts map[BlockID][]BlockContext) BlockID {
+	for id := range contexts {
+		return id
+	}
+	return BlockID{}
+}
+
+// RemoveBlockReference implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) RemoveBlockReference(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	err = b.write(ctx, "reference removal", firstBlockID(contexts),
+		func(ctx context.Context, bserv BlockServer) (err error) {
+			liveCounts, err = bserv.RemoveBlockReference(
+				ctx, tlfID, contexts)
+			return err
+		})
+	return liveCounts, err
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	return b.write(ctx, "reference archival", firstBlockID(contexts),
+		func(ctx context.Context, bserv BlockServer) error {
+			return bserv.ArchiveBlockReferences(ctx, tlfID, contexts)
+		})
+}
+
+// RefreshAuthToken implements the AuthTokenRefreshHandler interface
+// for BlockServerFailover.
+func (b *BlockServerFailover) RefreshAuthToken(ctx context.Context) {
+	for _, bserv := range b.servers {
+		bserv.RefreshAuthToken(ctx)
+	}
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) GetUserQuotaInfo(ctx context.Context) (
+	info *UserQuotaInfo, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		info, err = bserv.GetUserQuotaInfo(ctx)
+		return err
+	})
+	return info, err
+}
+
+// GetTLFQuotaInfo implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) GetTLFQuotaInfo(ctx context.Context,
+	tlfID TlfID) (info *UsageStat, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		info, err = bserv.GetTLFQuotaInfo(ctx, tlfID)
+		return err
+	})
+	return info, err
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) GetQuotaPoolInfo(ctx context.Context,
+	tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		info, err = bserv.GetQuotaPoolInfo(ctx, tlfID)
+		return err
+	})
+	return info, err
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) Capabilities(ctx context.Context) (
+	caps BlockServerCapabilities, err error) {
+	_, err = b.do(ctx, func(bserv BlockServer) (err error) {
+		caps, err = bserv.Capabilities(ctx)
+		return err
+	})
+	return caps, err
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerFailover.
+func (b *BlockServerFailover) Shutdown() {
+	b.shutdownOnce.Do(func() {
+		close(b.shutdownChan)
+		if n := b.JournalLength(); n > 0 {
+			b.log.Warning("Shutting down with %d writes not yet "+
+				"replayed to the primary block server", n)
+		}
+		for _, bserv := range b.servers {
+			bserv.Shutdown()
+		}
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+var errBServerUnreachableForTest = errors.New("unreachable")
+
+// bserverUnreachable wraps a BlockServer that can be made
+// unreachable.
+type bserverUnreachable struct {
+	BlockServer
+	lock sync.Mutex
+	down bool
+}
+
+func (b *bserverUnreachable) setDown(down bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.down = down
+}
+
+func (b *bserverUnreachable) check() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		return errBServerUnreachableForTest
+	}
+	return nil
+}
+
+func (b *bserverUnreachable) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	if err := b.check(); err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	return b.BlockServer.Get(ctx, id, tlfID, context)
+}
+
+func (b *bserverUnreachable) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.BlockServer.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+func (b *bserverUnreachable) AddBlockReference(ctx context.Context,
+	id BlockID, tlfID TlfID, context BlockContext) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.BlockServer.AddBlockReference(ctx, id, tlfID, context)
+}
+
+func (b *bserverUnreachable) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.BlockServer.GetUserQuotaInfo(ctx)
+}
+
+func TestBServerFailover(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	primary := &bserverUnreachable{BlockServer: NewBlockServerMemory(config)}
+	secondary := &bserverUnreachable{
+		BlockServer: NewBlockServerMemory(config)}
+	b := NewBlockServerFailover(config, []BlockServer{primary, secondary})
+	defer b.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	put := func(data []byte) BlockID {
+		id, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		err = b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		return id
+	}
+	checkGet := func(bserv BlockServer, id BlockID, data []byte) {
+		buf, _, err := bserv.Get(ctx, id, tlfID, bCtx)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+
+	// With the primary up, nothing goes to the secondary.
+	data1 := []byte{1, 2, 3}
+	id1 := put(data1)
+	checkGet(b, id1, data1)
+	_, _, err = secondary.Get(ctx, id1, tlfID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	// Once the primary is down, writes go to the secondary and
+	// are journaled.
+	primary.setDown(true)
+	data2 := []byte{4, 5, 6}
+	id2 := put(data2)
+	checkGet(secondary, id2, data2)
+	refNonce, err := crypto.MakeBlockRefNonce()
+	require.NoError(t, err)
+	bCtx2 := BlockContext{uid, uid, refNonce}
+	err = b.AddBlockReference(ctx, id2, tlfID, bCtx2)
+	require.NoError(t, err)
+	require.Equal(t, 2, b.JournalLength())
+
+	// Requests the secondary refuses aren't failed over.
+	_, _, err = b.Get(ctx, id1, tlfID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	// The primary stays down while it's unreachable.
+	primary.setDown(false)
+	checkGet(b, id2, data2)
+	_, _, err = primary.Get(ctx, id2, tlfID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	// The health check replays the journal to the primary before
+	// using it again.
+	b.checkHealth(ctx)
+	require.Equal(t, 0, b.JournalLength())
+	checkGet(primary, id2, data2)
+	buf, _, err := primary.Get(ctx, id2, tlfID, bCtx2)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	checkGet(b, id1, data1)
+
+	// With every server down, calls fail.
+	primary.setDown(true)
+	secondary.setDown(true)
+	_, _, err = b.Get(ctx, id1, tlfID, bCtx)
+	require.Equal(t, errNoBlockServerAvailable, err)
+	secondary.setDown(false)
+	b.checkHealth(ctx)
+	checkGet(b, id2, data2)
+}
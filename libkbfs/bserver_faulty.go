@@ -0,0 +1,170 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// BlockServerFaulty delegates to another BlockServer instance, but
+// first injects the latencies and failures asked for by the config's
+// FaultPolicy, for tests and soak runs.
+type BlockServerFaulty struct {
+	delegate BlockServer
+	faults   *faultInjector
+}
+
+var _ BlockServer = BlockServerFaulty{}
+
+// NewBlockServerFaulty creates and returns a new BlockServerFaulty
+// instance with the given delegate and config.
+func NewBlockServerFaulty(
+	delegate BlockServer, config Config) BlockServerFaulty {
+	return BlockServerFaulty{delegate, newFaultInjector(config)}
+}
+
+// Get implements the BlockServer interface for BlockServerFaulty.
+func (b BlockServerFaulty) Get(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, err error) {
+	err = b.faults.inject(ctx, "BlockServer.Get", func() (err error) {
+		buf, serverHalf, err = b.delegate.Get(ctx, id, tlfID, context)
+		return err
+	})
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	return buf, serverHalf, nil
+}
+
+// GetKey implements the BlockServer interface for BlockServerFaulty.
+func (b BlockServerFaulty) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	serverHalf BlockCryptKeyServerHalf, err error) {
+	err = b.faults.inject(ctx, "BlockServer.GetKey", func() (err error) {
+		serverHalf, err = b.delegate.GetKey(ctx, id, tlfID, context)
+		return err
+	})
+	if err != nil {
+		return BlockCryptKeyServerHalf{}, err
+	}
+	return serverHalf, nil
+}
+
+// Put implements the BlockServer interface for BlockServerFaulty.
+func (b BlockServerFaulty) Put(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	return b.faults.inject(ctx, "BlockServer.Put", func() error {
+		return b.delegate.Put(ctx, id, tlfID, context, buf, serverHalf)
+	})
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) AddBlockReference(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) error {
+	return b.faults.inject(ctx, "BlockServer.AddBlockReference",
+		func() error {
+			return b.delegate.AddBlockReference(ctx, id, tlfID, context)
+		})
+}
+
+// RemoveBlockReference implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) RemoveBlockReference(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	err = b.faults.inject(ctx, "BlockServer.RemoveBlockReference",
+		func() (err error) {
+			liveCounts, err = b.delegate.RemoveBlockReference(
+				ctx, tlfID, contexts)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return liveCounts, nil
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	return b.faults.inject(ctx, "BlockServer.ArchiveBlockReferences",
+		func() error {
+			return b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
+		})
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) Shutdown() {
+	b.delegate.Shutdown()
+}
+
+// RefreshAuthToken implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) RefreshAuthToken(ctx context.Context) {
+	b.delegate.RefreshAuthToken(ctx)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) GetUserQuotaInfo(ctx context.Context) (
+	info *UserQuotaInfo, err error) {
+	err = b.faults.inject(ctx, "BlockServer.GetUserQuotaInfo",
+		func() (err error) {
+			info, err = b.delegate.GetUserQuotaInfo(ctx)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetTLFQuotaInfo implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	err = b.faults.inject(ctx, "BlockServer.GetTLFQuotaInfo",
+		func() (err error) {
+			info, err = b.delegate.GetTLFQuotaInfo(ctx, tlfID)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	err = b.faults.inject(ctx, "BlockServer.GetQuotaPoolInfo",
+		func() (err error) {
+			info, err = b.delegate.GetQuotaPoolInfo(ctx, tlfID)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerFaulty.
+func (b BlockServerFaulty) Capabilities(ctx context.Context) (
+	caps BlockServerCapabilities, err error) {
+	err = b.faults.inject(ctx, "BlockServer.Capabilities",
+		func() (err error) {
+			caps, err = b.delegate.Capabilities(ctx)
+			return err
+		})
+	if err != nil {
+		return BlockServerCapabilities{}, err
+	}
+	return caps, nil
+}
@@ -14,10 +14,12 @@ import (
 type BlockServerMeasured struct {
 	delegate                    BlockServer
 	getTimer                    metrics.Timer
+	getKeyTimer                 metrics.Timer
 	putTimer                    metrics.Timer
 	addBlockReferenceTimer      metrics.Timer
 	removeBlockReferenceTimer   metrics.Timer
 	archiveBlockReferencesTimer metrics.Timer
+	errorCounter                metrics.Counter
 }
 
 var _ BlockServer = BlockServerMeasured{}
@@ -26,17 +28,28 @@ var _ BlockServer = BlockServerMeasured{}
 // BlockServerMeasured instance with the given delegate and registry.
 func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServerMeasured {
 	getTimer := metrics.GetOrRegisterTimer("BlockServer.Get", r)
+	getKeyTimer := metrics.GetOrRegisterTimer("BlockServer.GetKey", r)
 	putTimer := metrics.GetOrRegisterTimer("BlockServer.Put", r)
 	addBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReference", r)
 	removeBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.RemoveBlockReference", r)
 	archiveBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.ArchiveBlockReferences", r)
+	errorCounter := metrics.GetOrRegisterCounter("BlockServer.Errors", r)
 	return BlockServerMeasured{
 		delegate:                    delegate,
 		getTimer:                    getTimer,
+		getKeyTimer:                 getKeyTimer,
 		putTimer:                    putTimer,
 		addBlockReferenceTimer:      addBlockReferenceTimer,
 		removeBlockReferenceTimer:   removeBlockReferenceTimer,
 		archiveBlockReferencesTimer: archiveBlockReferencesTimer,
+		errorCounter:                errorCounter,
+	}
+}
+
+// countErr counts any error returned by the delegate.
+func (b BlockServerMeasured) countErr(err error) {
+	if err != nil {
+		b.errorCounter.Inc(1)
 	}
 }
 
@@ -47,9 +60,21 @@ func (b BlockServerMeasured) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	b.getTimer.Time(func() {
 		buf, serverHalf, err = b.delegate.Get(ctx, id, tlfID, context)
 	})
+	b.countErr(err)
 	return buf, serverHalf, err
 }
 
+// GetKey implements the BlockServer interface for BlockServerMeasured.
+func (b BlockServerMeasured) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	serverHalf BlockCryptKeyServerHalf, err error) {
+	b.getKeyTimer.Time(func() {
+		serverHalf, err = b.delegate.GetKey(ctx, id, tlfID, context)
+	})
+	b.countErr(err)
+	return serverHalf, err
+}
+
 // Put implements the BlockServer interface for BlockServerMeasured.
 func (b BlockServerMeasured) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext, buf []byte,
@@ -57,6 +82,7 @@ func (b BlockServerMeasured) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	b.putTimer.Time(func() {
 		err = b.delegate.Put(ctx, id, tlfID, context, buf, serverHalf)
 	})
+	b.countErr(err)
 	return err
 }
 
@@ -67,6 +93,7 @@ func (b BlockServerMeasured) AddBlockReference(ctx context.Context, id BlockID,
 	b.addBlockReferenceTimer.Time(func() {
 		err = b.delegate.AddBlockReference(ctx, id, tlfID, context)
 	})
+	b.countErr(err)
 	return err
 }
 
@@ -78,6 +105,7 @@ func (b BlockServerMeasured) RemoveBlockReference(ctx context.Context,
 	b.removeBlockReferenceTimer.Time(func() {
 		liveCounts, err = b.delegate.RemoveBlockReference(ctx, tlfID, contexts)
 	})
+	b.countErr(err)
 	return liveCounts, err
 }
 
@@ -88,6 +116,7 @@ func (b BlockServerMeasured) ArchiveBlockReferences(ctx context.Context,
 	b.archiveBlockReferencesTimer.Time(func() {
 		err = b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
 	})
+	b.countErr(err)
 	return err
 }
 
@@ -107,3 +136,23 @@ func (b BlockServerMeasured) RefreshAuthToken(ctx context.Context) {
 func (b BlockServerMeasured) GetUserQuotaInfo(ctx context.Context) (info *UserQuotaInfo, err error) {
 	return b.delegate.GetUserQuotaInfo(ctx)
 }
+
+// GetTLFQuotaInfo implements the BlockServer interface for BlockServerMeasured
+func (b BlockServerMeasured) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	return b.delegate.GetTLFQuotaInfo(ctx, tlfID)
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerMeasured
+func (b BlockServerMeasured) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	return b.delegate.GetQuotaPoolInfo(ctx, tlfID)
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerMeasured.
+func (b BlockServerMeasured) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	return b.delegate.Capabilities(ctx)
+}
@@ -163,6 +163,13 @@ func (b *BlockServerMemory) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	return entry.blockData, entry.keyServerHalf, nil
 }
 
+// GetKey implements the BlockServer interface for BlockServerMemory.
+func (b *BlockServerMemory) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (BlockCryptKeyServerHalf, error) {
+	_, serverHalf, err := b.Get(ctx, id, tlfID, context)
+	return serverHalf, err
+}
+
 func validateBlockServerPut(
 	crypto cryptoPure, id BlockID, context BlockContext, buf []byte) error {
 	if context.GetCreator() != context.GetWriter() {
@@ -421,3 +428,27 @@ func (b *BlockServerMemory) GetUserQuotaInfo(ctx context.Context) (info *UserQuo
 	// Return a dummy value here.
 	return &UserQuotaInfo{Limit: 0x7FFFFFFFFFFFFFFF}, nil
 }
+
+// GetTLFQuotaInfo implements the BlockServer interface for BlockServerMemory.
+func (b *BlockServerMemory) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	// Return a dummy value here.
+	return NewUsageStat(), nil
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	// There are no quotas here, pooled or not.
+	return nil, nil
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	return BlockServerCapabilities{
+		Encodings: []string{RawBlockTransportEncodingName},
+	}, nil
+}
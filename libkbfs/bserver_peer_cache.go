@@ -0,0 +1,367 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// peerCacheBlockPath is the URL path under which a
+	// BlockServerPeerCache serves blocks to its peers, followed by
+	// the block ID.
+	peerCacheBlockPath = "/kbfs/block/"
+	// peerCacheAuthHeader is the HTTP header that authenticates a
+	// request to a peer.
+	peerCacheAuthHeader = "X-Kbfs-Peer-Auth"
+	// peerCacheTimeout is how long a BlockServerPeerCache waits for
+	// its peers before going to the block server.
+	peerCacheTimeout = 2 * time.Second
+	// peerCacheBytesDefault is the default amount of block data a
+	// BlockServerPeerCache keeps for its peers.
+	peerCacheBytesDefault = 256 << 20
+	// peerCacheMaxBlockBytes is the most a BlockServerPeerCache
+	// reads of a peer's response.  Blocks are padded to the next
+	// power of two before they're encrypted, so the encrypted data
+	// of a block of the largest size is at most twice as big, plus
+	// a little for the encryption.
+	peerCacheMaxBlockBytes = 2*MaxBlockSizeBytesDefault + 4096
+)
+
+// peerBlockCache holds the encrypted data of recently used blocks,
+// up to a number of bytes.
+type peerBlockCache struct {
+	lock     sync.Mutex
+	lru      *simplelru.LRU
+	bytes    int64
+	capacity int64
+}
+
+func newPeerBlockCache(capacity int64) *peerBlockCache {
+	c := &peerBlockCache{capacity: capacity}
+	// Blocks are evicted by size, not by count.
+	c.lru, _ = simplelru.NewLRU(math.MaxInt32, c.onEvict)
+	return c
+}
+
+func (c *peerBlockCache) onEvict(key interface{}, value interface{}) {
+	c.bytes -= int64(len(value.([]byte)))
+}
+
+func (c *peerBlockCache) put(id BlockID, buf []byte) {
+	if int64(len(buf)) > c.capacity {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.lru.Get(id); ok {
+		return
+	}
+	c.lru.Add(id, buf)
+	c.bytes += int64(len(buf))
+	for c.bytes > c.capacity {
+		c.lru.RemoveOldest()
+	}
+}
+
+func (c *peerBlockCache) get(id BlockID) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	buf, ok := c.lru.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return buf.([]byte), true
+}
+
+// peerCacheAuth returns the authenticator for a request for the
+// given block from a peer that knows secret.  It can only be replayed
+// for the same block, whose encrypted data travels in the clear
+// anyway.
+func peerCacheAuth(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BlockServerPeerCache delegates to another BlockServer, but first
+// tries to fetch blocks from peers: other KBFS clients nearby, e.g. on
+// the same LAN, that have recently read or written them.  In turn, it
+// serves the blocks that it has recently read or written to those
+// peers, over HTTP.
+//
+// Peers only ever exchange encrypted block data, which is checked
+// against the block ID before it's used; the server half of the
+// block's key, and with it the permission check, still comes from the
+// block server.  Requests between peers are authenticated with a
+// secret that they share.
+type BlockServerPeerCache struct {
+	delegate BlockServer
+	config   Config
+	log      logger.Logger
+	peers    []string
+	secret   []byte
+	cache    *peerBlockCache
+	client   *http.Client
+	listener net.Listener
+}
+
+var _ BlockServer = (*BlockServerPeerCache)(nil)
+
+// NewBlockServerPeerCache starts serving up to cacheBytes of recently
+// used blocks on the given address (e.g., "0.0.0.0:9189"), to the
+// peers that know the given secret, and returns a BlockServer that
+// asks the given peers (as host:port) for blocks before asking
+// delegate.
+func NewBlockServerPeerCache(config Config, delegate BlockServer,
+	addr string, peers []string, secret []byte, cacheBytes int64) (
+	*BlockServerPeerCache, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("The peer cache needs a shared secret")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BlockServerPeerCache{
+		delegate: delegate,
+		config:   config,
+		log:      config.MakeLogger(""),
+		peers:    peers,
+		secret:   secret,
+		cache:    newPeerBlockCache(cacheBytes),
+		client:   &http.Client{Timeout: peerCacheTimeout},
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(peerCacheBlockPath, b.serveBlock)
+	go func() {
+		// Serve only returns once the listener is closed.
+		err := http.Serve(listener, mux)
+		b.log.CDebugf(nil, "Peer cache on %s stopped: %v", b.Addr(), err)
+	}()
+	return b, nil
+}
+
+// Addr returns the network address the peer cache is serving on.
+func (b *BlockServerPeerCache) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *BlockServerPeerCache) serveBlock(
+	w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, peerCacheBlockPath)
+	auth := r.Header.Get(peerCacheAuthHeader)
+	if !hmac.Equal([]byte(auth), []byte(peerCacheAuth(b.secret, idStr))) {
+		http.Error(w, "Bad peer authenticator", http.StatusForbidden)
+		return
+	}
+	id, err := BlockIDFromString(idStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf, ok := b.cache.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf)
+}
+
+// getFromPeer returns the encrypted data of the given block from the
+// given peer, or nil if the peer doesn't have it.
+func (b *BlockServerPeerCache) getFromPeer(ctx context.Context,
+	peer string, id BlockID) ([]byte, error) {
+	req, err := http.NewRequest(
+		"GET", "http://"+peer+peerCacheBlockPath+id.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerCacheAuthHeader, peerCacheAuth(b.secret, id.String()))
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Peer %s returned %s", peer, resp.Status)
+	}
+	// Read one byte past the limit, to tell whether the peer
+	// sent more than that.
+	buf, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, peerCacheMaxBlockBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > peerCacheMaxBlockBytes {
+		return nil, fmt.Errorf("Peer %s returned more than %d bytes",
+			peer, peerCacheMaxBlockBytes)
+	}
+	// A peer could hand out any data, so make sure it's really
+	// this block.
+	err = b.config.Crypto().VerifyBlockID(buf, id)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// getFromPeers asks all the peers for the encrypted data of the given
+// block at once, and returns the first copy found, or nil if no peer
+// has it.
+func (b *BlockServerPeerCache) getFromPeers(ctx context.Context,
+	id BlockID) []byte {
+	if len(b.peers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bufs := make(chan []byte, len(b.peers))
+	for _, peer := range b.peers {
+		go func(peer string) {
+			buf, err := b.getFromPeer(ctx, peer, id)
+			if err != nil {
+				b.log.CDebugf(ctx, "Couldn't get block %s from peer %s: %v",
+					id, peer, err)
+			}
+			bufs <- buf
+		}(peer)
+	}
+	for range b.peers {
+		if buf := <-bufs; buf != nil {
+			return buf
+		}
+	}
+	return nil
+}
+
+// Get implements the BlockServer interface for BlockServerPeerCache.
+func (b *BlockServerPeerCache) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	buf, ok := b.cache.get(id)
+	if !ok {
+		buf = b.getFromPeers(ctx, id)
+	}
+	if buf == nil {
+		buf, serverHalf, err := b.delegate.Get(ctx, id, tlfID, context)
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		b.cache.put(id, buf)
+		return buf, serverHalf, nil
+	}
+
+	serverHalf, err := b.delegate.GetKey(ctx, id, tlfID, context)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	b.cache.put(id, buf)
+	return buf, serverHalf, nil
+}
+
+// Put implements the BlockServer interface for BlockServerPeerCache.
+func (b *BlockServerPeerCache) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	err := b.delegate.Put(ctx, id, tlfID, context, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+	b.cache.put(id, buf)
+	return nil
+}
+
+// GetKey implements the BlockServer interface for BlockServerPeerCache.
+func (b *BlockServerPeerCache) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (BlockCryptKeyServerHalf, error) {
+	return b.delegate.GetKey(ctx, id, tlfID, context)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) AddBlockReference(ctx context.Context,
+	id BlockID, tlfID TlfID, context BlockContext) error {
+	return b.delegate.AddBlockReference(ctx, id, tlfID, context)
+}
+
+// RemoveBlockReference implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) RemoveBlockReference(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	return b.delegate.RemoveBlockReference(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	return b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// RefreshAuthToken implements the AuthTokenRefreshHandler interface
+// for BlockServerPeerCache.
+func (b *BlockServerPeerCache) RefreshAuthToken(ctx context.Context) {
+	b.delegate.RefreshAuthToken(ctx)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	return b.delegate.GetUserQuotaInfo(ctx)
+}
+
+// GetTLFQuotaInfo implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) GetTLFQuotaInfo(ctx context.Context,
+	tlfID TlfID) (*UsageStat, error) {
+	return b.delegate.GetTLFQuotaInfo(ctx, tlfID)
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) GetQuotaPoolInfo(ctx context.Context,
+	tlfID TlfID) (*QuotaPoolInfo, error) {
+	return b.delegate.GetQuotaPoolInfo(ctx, tlfID)
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	return b.delegate.Capabilities(ctx)
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerPeerCache.
+func (b *BlockServerPeerCache) Shutdown() {
+	b.listener.Close()
+	b.delegate.Shutdown()
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// bserverCountingGets wraps a BlockServer, counting the calls to Get.
+type bserverCountingGets struct {
+	BlockServer
+	gets int
+}
+
+func (b *bserverCountingGets) Get(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	b.gets++
+	return b.BlockServer.Get(ctx, id, tlfID, context)
+}
+
+func TestBServerPeerCache(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	// Both peers share the same block server, as they would in
+	// practice.
+	bserv := &bserverCountingGets{BlockServer: NewBlockServerMemory(config)}
+	secret := []byte("peer secret")
+	b1, err := NewBlockServerPeerCache(
+		config, bserv, "127.0.0.1:0", nil, secret, 1024)
+	require.NoError(t, err)
+	defer b1.listener.Close()
+	b2, err := NewBlockServerPeerCache(
+		config, bserv, "127.0.0.1:0", []string{b1.Addr()}, secret, 1024)
+	require.NoError(t, err)
+	defer b2.listener.Close()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	id, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	err = b1.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	// The block written through one peer is read from it by the
+	// other, with only the key coming from the block server.
+	buf, key, err := b2.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+	require.Equal(t, 0, bserv.gets)
+
+	// Blocks a peer doesn't have come from the block server.
+	data2 := []byte{5, 6, 7, 8}
+	id2, err := crypto.MakePermanentBlockID(data2)
+	require.NoError(t, err)
+	err = bserv.Put(ctx, id2, tlfID, bCtx, data2, serverHalf)
+	require.NoError(t, err)
+	buf, _, err = b2.Get(ctx, id2, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	require.Equal(t, 1, bserv.gets)
+
+	// Peers refuse requests from clients without the secret.
+	b3, err := NewBlockServerPeerCache(config, bserv, "127.0.0.1:0",
+		[]string{b1.Addr()}, []byte("wrong secret"), 1024)
+	require.NoError(t, err)
+	defer b3.listener.Close()
+	_, err = b3.getFromPeer(ctx, b1.Addr(), id)
+	require.Error(t, err)
+	buf, _, err = b3.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, 2, bserv.gets)
+
+	// Data from a peer that doesn't match the block ID is rejected.
+	b1.cache.put(id2, []byte{9, 9, 9, 9})
+	req, err := http.NewRequest(
+		"GET", "http://"+b1.Addr()+peerCacheBlockPath+id2.String(), nil)
+	require.NoError(t, err)
+	req.Header.Set(peerCacheAuthHeader, peerCacheAuth(secret, id2.String()))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = b2.getFromPeer(ctx, b1.Addr(), id2)
+	require.Error(t, err)
+
+	// So is more data than any block could have.
+	bigPeer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, peerCacheMaxBlockBytes+1))
+		}))
+	defer bigPeer.Close()
+	_, err = b2.getFromPeer(
+		ctx, strings.TrimPrefix(bigPeer.URL, "http://"), id2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "returned more than")
+}
+
+func TestPeerBlockCacheEviction(t *testing.T) {
+	c := newPeerBlockCache(10)
+	id := fakeBlockID
+	c.put(id(1), make([]byte, 4))
+	c.put(id(2), make([]byte, 4))
+	_, ok := c.get(id(1))
+	require.True(t, ok)
+
+	// Block 2 is the least recently used, so it makes room for
+	// block 3.
+	c.put(id(3), make([]byte, 4))
+	_, ok = c.get(id(2))
+	require.False(t, ok)
+	_, ok = c.get(id(1))
+	require.True(t, ok)
+	require.Equal(t, int64(8), c.bytes)
+
+	// Blocks bigger than the whole cache aren't kept.
+	c.put(id(4), make([]byte, 11))
+	_, ok = c.get(id(4))
+	require.False(t, ok)
+	_, ok = c.get(id(3))
+	require.True(t, ok)
+}
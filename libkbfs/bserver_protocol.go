@@ -0,0 +1,136 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// This file has the block server RPCs that aren't in the vendored
+// keybase1 protocol yet.  Once the protocol is regenerated with
+// them, these types should be replaced by the keybase1 ones.
+
+type getBlockEncodedRes struct {
+	BlockKey string `codec:"blockKey" json:"blockKey"`
+	Encoding string `codec:"encoding" json:"encoding"`
+	Buf      []byte `codec:"buf" json:"buf"`
+}
+
+type blockCapabilities struct {
+	BatchPuts    bool     `codec:"batchPuts" json:"batchPuts"`
+	MaxBlockSize int64    `codec:"maxBlockSize" json:"maxBlockSize"`
+	Encodings    []string `codec:"encodings" json:"encodings"`
+}
+
+type putBlockChunkArg struct {
+	Bid       keybase1.BlockIdCombo `codec:"bid" json:"bid"`
+	Folder    string                `codec:"folder" json:"folder"`
+	BlockKey  string                `codec:"blockKey" json:"blockKey"`
+	Offset    int64                 `codec:"offset" json:"offset"`
+	TotalSize int64                 `codec:"totalSize" json:"totalSize"`
+	Buf       []byte                `codec:"buf" json:"buf"`
+}
+
+type getBlockUploadOffsetArg struct {
+	Bid    keybase1.BlockIdCombo `codec:"bid" json:"bid"`
+	Folder string                `codec:"folder" json:"folder"`
+}
+
+type getBlockKeyArg struct {
+	Bid    keybase1.BlockIdCombo `codec:"bid" json:"bid"`
+	Folder string                `codec:"folder" json:"folder"`
+}
+
+type getBlockEncodingsArg struct {
+}
+
+type getBlockCapabilitiesArg struct {
+}
+
+type putBlockEncodedArg struct {
+	Bid      keybase1.BlockIdCombo `codec:"bid" json:"bid"`
+	Folder   string                `codec:"folder" json:"folder"`
+	BlockKey string                `codec:"blockKey" json:"blockKey"`
+	Encoding string                `codec:"encoding" json:"encoding"`
+	Buf      []byte                `codec:"buf" json:"buf"`
+}
+
+type getBlockEncodedArg struct {
+	Bid       keybase1.BlockIdCombo `codec:"bid" json:"bid"`
+	Folder    string                `codec:"folder" json:"folder"`
+	Encodings []string              `codec:"encodings" json:"encodings"`
+}
+
+// blockServerClient is keybase1.BlockInterface plus the block server
+// RPCs defined in this file.
+type blockServerClient interface {
+	keybase1.BlockInterface
+	PutBlockChunk(context.Context, putBlockChunkArg) (int64, error)
+	GetBlockUploadOffset(context.Context, getBlockUploadOffsetArg) (
+		int64, error)
+	GetBlockKey(context.Context, getBlockKeyArg) (string, error)
+	GetBlockEncodings(context.Context) ([]string, error)
+	GetBlockCapabilities(context.Context) (blockCapabilities, error)
+	PutBlockEncoded(context.Context, putBlockEncodedArg) error
+	GetBlockEncoded(context.Context, getBlockEncodedArg) (
+		getBlockEncodedRes, error)
+}
+
+// blockClient implements blockServerClient over an RPC client.
+type blockClient struct {
+	keybase1.BlockClient
+}
+
+var _ blockServerClient = blockClient{}
+
+func (c blockClient) PutBlockChunk(ctx context.Context,
+	arg putBlockChunkArg) (res int64, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.putBlockChunk",
+		[]interface{}{arg}, &res)
+	return
+}
+
+func (c blockClient) GetBlockUploadOffset(ctx context.Context,
+	arg getBlockUploadOffsetArg) (res int64, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.getBlockUploadOffset",
+		[]interface{}{arg}, &res)
+	return
+}
+
+func (c blockClient) GetBlockKey(ctx context.Context,
+	arg getBlockKeyArg) (res string, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.getBlockKey",
+		[]interface{}{arg}, &res)
+	return
+}
+
+func (c blockClient) GetBlockEncodings(ctx context.Context) (
+	res []string, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.getBlockEncodings",
+		[]interface{}{getBlockEncodingsArg{}}, &res)
+	return
+}
+
+func (c blockClient) GetBlockCapabilities(ctx context.Context) (
+	res blockCapabilities, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.getBlockCapabilities",
+		[]interface{}{getBlockCapabilitiesArg{}}, &res)
+	return
+}
+
+func (c blockClient) PutBlockEncoded(ctx context.Context,
+	arg putBlockEncodedArg) (err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.putBlockEncoded",
+		[]interface{}{arg}, nil)
+	return
+}
+
+func (c blockClient) GetBlockEncoded(ctx context.Context,
+	arg getBlockEncodedArg) (res getBlockEncodedRes, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.block.getBlockEncoded",
+		[]interface{}{arg}, &res)
+	return
+}
@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"encoding/hex"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -22,16 +24,44 @@ const (
 	BServerTokenExpireIn = 2 * 60 * 60 // 2 hours
 )
 
+const (
+	// Blocks bigger than this are uploaded in chunks, so that an
+	// interrupted upload can be resumed from the last chunk the
+	// server acknowledged.  It's well above the encoded size of a
+	// block of the default maximum size, so that the usual blocks
+	// go up in a single call.
+	bserverPutChunkThreshold = 4 << 20
+	// The size of each chunk of a chunked upload.
+	bserverPutChunkSize = 1 << 20
+	// How many times to try resuming a chunked upload before giving
+	// up on it.
+	bserverPutChunkMaxResumes = 10
+)
+
 // BlockServerRemote implements the BlockServer interface and
 // represents a remote KBFS block server.
 type BlockServerRemote struct {
 	config     Config
 	shutdownFn func()
-	client     keybase1.BlockInterface
+	client     blockServerClient
 	log        logger.Logger
 	deferLog   logger.Logger
 	blkSrvAddr string
 	authToken  *AuthToken
+
+	// putSem limits the number of puts in flight to this server,
+	// if non-nil.
+	putSem chan struct{}
+
+	// capabilities are the features that the server supports,
+	// and encoding is the block transport encoding negotiated
+	// with it.  Either is nil if it hasn't been asked for yet on
+	// the current connection.  noChunkedPuts is set once the
+	// server has turned out not to support chunked uploads.
+	capabilitiesLock sync.Mutex
+	capabilities     *BlockServerCapabilities
+	encoding         BlockTransportEncoding
+	noChunkedPuts    bool
 }
 
 // Test that BlockServerRemote fully implements the BlockServer interface.
@@ -50,6 +80,7 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 		log:        log,
 		deferLog:   deferLog,
 		blkSrvAddr: blkSrvAddr,
+		putSem:     makeBlockPutSem(config),
 	}
 	bs.log.Debug("new instance server addr %s", blkSrvAddr)
 	bs.authToken = NewAuthToken(config,
@@ -59,14 +90,16 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 	conn := rpc.NewTLSConnection(blkSrvAddr, GetRootCerts(blkSrvAddr),
 		bServerErrorUnwrapper{}, bs, false, ctx.NewRPCLogFactory(),
 		libkb.WrapError, config.MakeLogger(""), LogTagsFromContext)
-	bs.client = keybase1.BlockClient{Cli: conn.GetClient()}
+	bs.client = blockClient{keybase1.BlockClient{Cli: rpcRetryClient{
+		rpcDeadlineClient{conn.GetClient(), config}, config,
+		newRPCRetryState(config, BServiceName)}}}
 	bs.shutdownFn = conn.Shutdown
 	return bs
 }
 
 // For testing.
 func newBlockServerRemoteWithClient(config Config,
-	client keybase1.BlockInterface) *BlockServerRemote {
+	client blockServerClient) *BlockServerRemote {
 	log := config.MakeLogger("BSR")
 	deferLog := log.CloneWithAddedDepth(1)
 	bs := &BlockServerRemote{
@@ -74,10 +107,18 @@ func newBlockServerRemoteWithClient(config Config,
 		client:   client,
 		log:      log,
 		deferLog: deferLog,
+		putSem:   makeBlockPutSem(config),
 	}
 	return bs
 }
 
+func makeBlockPutSem(config Config) chan struct{} {
+	if n := config.BlockPutsPerHost(); n > 0 {
+		return make(chan struct{}, n)
+	}
+	return nil
+}
+
 // RemoteAddress returns the remote bserver this client is talking to
 func (b *BlockServerRemote) RemoteAddress() string {
 	return b.blkSrvAddr
@@ -91,6 +132,15 @@ func (*BlockServerRemote) HandlerName() string {
 // OnConnect implements the ConnectionHandler interface.
 func (b *BlockServerRemote) OnConnect(ctx context.Context,
 	_ *rpc.Connection, client rpc.GenericClient, _ *rpc.Server) error {
+	// The server on the other end of a new connection may support
+	// different features than the last one.
+	func() {
+		b.capabilitiesLock.Lock()
+		defer b.capabilitiesLock.Unlock()
+		b.capabilities = nil
+		b.encoding = nil
+		b.noChunkedPuts = false
+	}()
 	// reset auth -- using b.client here would cause problematic recursion.
 	c := keybase1.BlockClient{Cli: client}
 	return b.resetAuth(ctx, c)
@@ -157,22 +207,8 @@ func (b *BlockServerRemote) OnDisconnected(ctx context.Context,
 
 // ShouldRetry implements the ConnectionHandler interface.
 func (b *BlockServerRemote) ShouldRetry(rpcName string, err error) bool {
-	//do not let connection.go's DoCommand retry any batch rpcs automatically
-	//because i will manually retry them without successfully completed references
-	switch rpcName {
-	case "keybase.1.block.delReferenceWithCount":
-		return false
-	case "keybase.1.block.archiveReferenceWithCount":
-		return false
-	case "keybase.1.block.archiveReference":
-		return false
-	}
-	if _, ok := err.(BServerErrorThrottle); ok {
-		return true
-	}
-	if quotaErr, ok := err.(BServerErrorOverQuota); ok && quotaErr.Throttled {
-		return true
-	}
+	// Failed calls are retried by rpcRetryClient instead, following
+	// the configured RetryPolicy.
 	return false
 }
 
@@ -204,6 +240,63 @@ func makeBlockReference(id BlockID, context BlockContext) keybase1.BlockReferenc
 	}
 }
 
+// getEncoding returns the block transport encoding to use with the
+// server, negotiating it first if needed.  Servers that don't know
+// how to negotiate only get the raw encoding.
+func (b *BlockServerRemote) getEncoding(
+	ctx context.Context) (BlockTransportEncoding, error) {
+	b.capabilitiesLock.Lock()
+	defer b.capabilitiesLock.Unlock()
+	if b.encoding != nil {
+		return b.encoding, nil
+	}
+
+	preferred := b.config.BlockTransportEncodings()
+	if len(preferred) == 0 {
+		// No need to ask the server.
+		b.encoding = rawBlockTransportEncoding{}
+		return b.encoding, nil
+	}
+	caps, err := b.getCapabilitiesLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.encoding = chooseBlockTransportEncoding(preferred, caps.Encodings)
+	b.log.CDebugf(ctx, "Using block encoding %s (server supports %v)",
+		b.encoding.Name(), caps.Encodings)
+	return b.encoding, nil
+}
+
+// getCapabilitiesLocked returns the features that the server
+// supports, asking the server first if needed.  For servers that
+// can't report their capabilities, it only finds out which block
+// transport encodings they support, if they can negotiate those.
+func (b *BlockServerRemote) getCapabilitiesLocked(
+	ctx context.Context) (BlockServerCapabilities, error) {
+	if b.capabilities != nil {
+		return *b.capabilities, nil
+	}
+
+	var caps BlockServerCapabilities
+	res, err := b.client.GetBlockCapabilities(ctx)
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		encodings, err := b.client.GetBlockEncodings(ctx)
+		if _, ok := err.(rpc.MethodNotFoundError); ok {
+			encodings = nil
+		} else if err != nil {
+			return BlockServerCapabilities{}, err
+		}
+		caps.Encodings = encodings
+	} else if err != nil {
+		return BlockServerCapabilities{}, err
+	} else {
+		caps = blockServerCapabilitiesFromRPC(res)
+	}
+	b.log.CDebugf(ctx, "Block server capabilities: %+v", caps)
+	b.capabilities = &caps
+	return caps, nil
+}
+
 // Get implements the BlockServer interface for BlockServerRemote.
 func (b *BlockServerRemote) Get(ctx context.Context, id BlockID, tlfID TlfID,
 	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
@@ -221,24 +314,96 @@ func (b *BlockServerRemote) Get(ctx context.Context, id BlockID, tlfID TlfID,
 		}
 	}()
 
-	arg := keybase1.GetBlockArg{
-		Bid:    makeBlockIDCombo(id, context),
-		Folder: tlfID.String(),
-	}
-
-	res, err := b.client.GetBlock(ctx, arg)
+	encoding, err := b.getEncoding(ctx)
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 
-	size = len(res.Buf)
+	var buf []byte
+	var blockKey string
+	if encoding.Name() == RawBlockTransportEncodingName {
+		arg := keybase1.GetBlockArg{
+			Bid:    makeBlockIDCombo(id, context),
+			Folder: tlfID.String(),
+		}
+		var res keybase1.GetBlockRes
+		res, err = b.client.GetBlock(ctx, arg)
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		err = waitToReceive(ctx, b.config, len(res.Buf))
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		buf, blockKey = res.Buf, res.BlockKey
+	} else {
+		// Accept any encoding we know; the server picks.
+		encodings := b.config.BlockTransportEncodings()
+		arg := getBlockEncodedArg{
+			Bid:       makeBlockIDCombo(id, context),
+			Folder:    tlfID.String(),
+			Encodings: blockTransportEncodingNames(encodings),
+		}
+		var res getBlockEncodedRes
+		res, err = b.client.GetBlockEncoded(ctx, arg)
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		err = waitToReceive(ctx, b.config, len(res.Buf))
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		var resEncoding BlockTransportEncoding
+		resEncoding, err = findBlockTransportEncoding(
+			encodings, res.Encoding)
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		buf, err = resEncoding.Decode(res.Buf)
+		if err != nil {
+			return nil, BlockCryptKeyServerHalf{}, err
+		}
+		blockKey = res.BlockKey
+	}
+
+	size = len(buf)
 	bk := BlockCryptKeyServerHalf{}
 	var kbuf []byte
-	if kbuf, err = hex.DecodeString(res.BlockKey); err != nil {
+	if kbuf, err = hex.DecodeString(blockKey); err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 	copy(bk.data[:], kbuf)
-	return res.Buf, bk, nil
+	return buf, bk, nil
+}
+
+// GetKey implements the BlockServer interface for BlockServerRemote.
+func (b *BlockServerRemote) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	serverHalf BlockCryptKeyServerHalf, err error) {
+	defer func() {
+		if err != nil {
+			b.deferLog.CWarningf(
+				ctx, "GetKey id=%s tlf=%s context=%s err=%v",
+				id, tlfID, context, err)
+		} else {
+			b.deferLog.CDebugf(
+				ctx, "GetKey id=%s tlf=%s context=%s", id, tlfID, context)
+		}
+	}()
+
+	arg := getBlockKeyArg{
+		Bid:    makeBlockIDCombo(id, context),
+		Folder: tlfID.String(),
+	}
+	blockKey, err := b.client.GetBlockKey(ctx, arg)
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		// Older servers only return the key along with the block.
+		_, serverHalf, err = b.Get(ctx, id, tlfID, context)
+		return serverHalf, err
+	} else if err != nil {
+		return BlockCryptKeyServerHalf{}, err
+	}
+	return ParseBlockCryptKeyServerHalf(blockKey)
 }
 
 // Put implements the BlockServer interface for BlockServerRemote.
@@ -268,7 +433,30 @@ func (b *BlockServerRemote) Put(ctx context.Context, id BlockID, tlfID TlfID,
 		Buf:      buf,
 	}
 
-	err = b.client.PutBlock(ctx, arg)
+	if b.putSem != nil {
+		select {
+		case b.putSem <- struct{}{}:
+			defer func() { <-b.putSem }()
+		case <-ctx.Done():
+			err = ctx.Err()
+			return err
+		}
+	}
+
+	encoding, err := b.getEncoding(ctx)
+	if err != nil {
+		return err
+	}
+
+	if encoding.Name() != RawBlockTransportEncodingName {
+		// Encoded blocks are always sent whole.
+		err = b.putEncoded(ctx, arg, encoding)
+	} else if len(buf) > bserverPutChunkThreshold &&
+		b.chunkedPutsSupported() {
+		err = b.putChunked(ctx, arg)
+	} else {
+		err = b.putWhole(ctx, arg)
+	}
 	if err != nil {
 		if qe, ok := err.(BServerErrorOverQuota); ok && !qe.Throttled {
 			return nil
@@ -278,6 +466,142 @@ func (b *BlockServerRemote) Put(ctx context.Context, id BlockID, tlfID TlfID,
 	return nil
 }
 
+// putWhole uploads the block described by arg in a single call.
+func (b *BlockServerRemote) putWhole(ctx context.Context,
+	arg keybase1.PutBlockArg) error {
+	err := waitToSend(ctx, b.config, len(arg.Buf))
+	if err != nil {
+		return err
+	}
+	return b.client.PutBlock(ctx, arg)
+}
+
+// putEncoded uploads the block described by arg, after encoding it
+// with the given encoding.
+func (b *BlockServerRemote) putEncoded(ctx context.Context,
+	arg keybase1.PutBlockArg, encoding BlockTransportEncoding) error {
+	buf, err := encoding.Encode(arg.Buf)
+	if err != nil {
+		return err
+	}
+	err = waitToSend(ctx, b.config, len(buf))
+	if err != nil {
+		return err
+	}
+	return b.client.PutBlockEncoded(ctx, putBlockEncodedArg{
+		Bid:      arg.Bid,
+		Folder:   arg.Folder,
+		BlockKey: arg.BlockKey,
+		Encoding: encoding.Name(),
+		Buf:      buf,
+	})
+}
+
+// isResumableUploadError returns true if a chunked upload that failed
+// with the given error can be resumed, i.e. if the error came from
+// the connection rather than from the server rejecting the block.
+func isResumableUploadError(err error) bool {
+	switch err.(type) {
+	case BServerError, BServerErrorBadRequest, BServerErrorUnauthorized,
+		BServerErrorOverQuota, BServerErrorBlockNonExistent,
+		BServerErrorBlockArchived, BServerErrorNoPermission,
+		BServerErrorBlockDeleted, BServerErrorNonceNonExistent,
+		BServerErrorThrottle:
+		return false
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// chunkedPutsSupported returns false if the server on the current
+// connection is known not to support chunked uploads.
+func (b *BlockServerRemote) chunkedPutsSupported() bool {
+	b.capabilitiesLock.Lock()
+	defer b.capabilitiesLock.Unlock()
+	return !b.noChunkedPuts
+}
+
+// putChunked uploads the block described by arg in chunks.  Before
+// sending anything, and after each failure, it asks the server how
+// much of the block it has already received, and continues from
+// there.  If the server doesn't support chunked uploads, it falls
+// back to a single PutBlock call, and remembers not to try chunking
+// again on this connection.
+func (b *BlockServerRemote) putChunked(
+	ctx context.Context, arg keybase1.PutBlockArg) error {
+	total := int64(len(arg.Buf))
+	resumes := 0
+	for {
+		err := b.putChunksFromServerOffset(ctx, arg)
+		if _, ok := err.(rpc.MethodNotFoundError); ok {
+			b.log.CDebugf(ctx, "Chunked uploads not supported; "+
+				"falling back to a single put")
+			func() {
+				b.capabilitiesLock.Lock()
+				defer b.capabilitiesLock.Unlock()
+				b.noChunkedPuts = true
+			}()
+			return b.putWhole(ctx, arg)
+		}
+		if err == nil || !isResumableUploadError(err) ||
+			resumes >= bserverPutChunkMaxResumes {
+			return err
+		}
+		resumes++
+		b.log.CDebugf(ctx, "Resuming upload of block %s (sz=%d, "+
+			"attempt %d) after error: %v", arg.Bid.BlockHash, total,
+			resumes, err)
+	}
+}
+
+func (b *BlockServerRemote) putChunksFromServerOffset(
+	ctx context.Context, arg keybase1.PutBlockArg) error {
+	total := int64(len(arg.Buf))
+	offset, err := b.client.GetBlockUploadOffset(ctx,
+		getBlockUploadOffsetArg{
+			Bid:    arg.Bid,
+			Folder: arg.Folder,
+		})
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > total {
+		// The server's partial upload doesn't match ours; start
+		// over.
+		offset = 0
+	}
+
+	for {
+		end := offset + bserverPutChunkSize
+		if end > total {
+			end = total
+		}
+		err := waitToSend(ctx, b.config, int(end-offset))
+		if err != nil {
+			return err
+		}
+		acked, err := b.client.PutBlockChunk(ctx, putBlockChunkArg{
+			Bid:       arg.Bid,
+			Folder:    arg.Folder,
+			BlockKey:  arg.BlockKey,
+			Offset:    offset,
+			TotalSize: total,
+			Buf:       arg.Buf[offset:end],
+		})
+		if err != nil {
+			return err
+		}
+		if acked >= total {
+			return nil
+		}
+		if acked <= offset {
+			return BServerError{Msg: fmt.Sprintf(
+				"Server made no progress on chunk at offset %d of "+
+					"block %s", offset, arg.Bid.BlockHash)}
+		}
+		offset = acked
+	}
+}
+
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
 func (b *BlockServerRemote) AddBlockReference(ctx context.Context, id BlockID,
 	tlfID TlfID, context BlockContext) error {
@@ -449,6 +773,39 @@ func (b *BlockServerRemote) GetUserQuotaInfo(ctx context.Context) (info *UserQuo
 	return UserQuotaInfoDecode(res, b.config)
 }
 
+// GetTLFQuotaInfo implements the BlockServer interface for BlockServerRemote
+func (b *BlockServerRemote) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	// The block server has no per-TLF call yet, so pick the folder
+	// out of the user's full quota info.
+	uqi, err := b.GetUserQuotaInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if usage, ok := uqi.Folders[tlfID.String()]; ok && usage != nil {
+		return usage, nil
+	}
+	return NewUsageStat(), nil
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerRemote.
+func (b *BlockServerRemote) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	// The block server charges every block to its uploader, and
+	// has no pools yet.
+	return nil, nil
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerRemote.
+func (b *BlockServerRemote) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	b.capabilitiesLock.Lock()
+	defer b.capabilitiesLock.Unlock()
+	return b.getCapabilitiesLocked(ctx)
+}
+
 // Shutdown implements the BlockServer interface for BlockServerRemote.
 func (b *BlockServerRemote) Shutdown() {
 	if b.shutdownFn != nil {
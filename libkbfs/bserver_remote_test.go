@@ -7,11 +7,14 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"io"
+	"sync"
 	"testing"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
 	"github.com/keybase/go-framed-msgpack-rpc"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -21,6 +24,36 @@ type FakeBServerClient struct {
 	readyChan  chan<- struct{}
 	goChan     <-chan struct{}
 	finishChan chan<- struct{}
+
+	uploadLock sync.Mutex
+	// Partial chunked uploads, keyed by folder and block hash.
+	uploads map[string][]byte
+	// If set, the next chunk ending past this offset is stored,
+	// but its ack is lost, as if the connection dropped.
+	dropAckAfter int64
+	// The total number of chunk bytes received.
+	chunkBytes int
+	// If set, the client acts like a server that doesn't support
+	// chunked uploads.
+	noChunks bool
+	// The number of upload offset requests received.
+	uploadOffsetCalls int
+
+	// If nil, the client acts like a server that can't negotiate
+	// block encodings.
+	encodings []BlockTransportEncoding
+	// The encoding of the last encoded put.
+	lastPutEncoding string
+
+	// If nil, the client acts like a server that can't report
+	// its capabilities.
+	capabilities *blockCapabilities
+	// The number of capability requests received.
+	capabilityCalls int
+
+	// If set, the client acts like a server that can only return
+	// block keys along with the blocks.
+	noBlockKeys bool
 }
 
 func NewFakeBServerClient(
@@ -33,6 +66,7 @@ func NewFakeBServerClient(
 		readyChan:  readyChan,
 		goChan:     goChan,
 		finishChan: finishChan,
+		uploads:    make(map[string][]byte),
 	}
 }
 
@@ -95,6 +129,60 @@ func (fc *FakeBServerClient) PutBlock(ctx context.Context, arg keybase1.PutBlock
 	return fc.bserverMem.Put(ctx, id, tlfID, bCtx, arg.Buf, serverHalf)
 }
 
+func (fc *FakeBServerClient) PutBlockChunk(
+	ctx context.Context, arg putBlockChunkArg) (int64, error) {
+	key := arg.Folder + "/" + arg.Bid.BlockHash
+	buf, done, err := func() ([]byte, bool, error) {
+		fc.uploadLock.Lock()
+		defer fc.uploadLock.Unlock()
+		buf := fc.uploads[key]
+		if arg.Offset != int64(len(buf)) {
+			return nil, false, BServerErrorBadRequest{
+				Msg: "Chunk offset doesn't match upload"}
+		}
+		buf = append(buf, arg.Buf...)
+		fc.uploads[key] = buf
+		fc.chunkBytes += len(arg.Buf)
+		if int64(len(buf)) < arg.TotalSize {
+			if fc.dropAckAfter > 0 && int64(len(buf)) > fc.dropAckAfter {
+				fc.dropAckAfter = 0
+				return nil, false, io.ErrUnexpectedEOF
+			}
+			return buf, false, nil
+		}
+		delete(fc.uploads, key)
+		return buf, true, nil
+	}()
+	if err != nil {
+		return 0, err
+	}
+	if !done {
+		return int64(len(buf)), nil
+	}
+
+	err = fc.PutBlock(ctx, keybase1.PutBlockArg{
+		Bid:      arg.Bid,
+		Folder:   arg.Folder,
+		BlockKey: arg.BlockKey,
+		Buf:      buf,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return arg.TotalSize, nil
+}
+
+func (fc *FakeBServerClient) GetBlockUploadOffset(
+	ctx context.Context, arg getBlockUploadOffsetArg) (int64, error) {
+	fc.uploadLock.Lock()
+	defer fc.uploadLock.Unlock()
+	fc.uploadOffsetCalls++
+	if fc.noChunks {
+		return 0, rpc.MethodNotFoundError{}
+	}
+	return int64(len(fc.uploads[arg.Folder+"/"+arg.Bid.BlockHash])), nil
+}
+
 func (fc *FakeBServerClient) GetBlock(ctx context.Context, arg keybase1.GetBlockArg) (keybase1.GetBlockRes, error) {
 	err := fc.maybeWaitOnChannel(ctx)
 	defer fc.maybeFinishOnChannel()
@@ -131,6 +219,50 @@ func (fc *FakeBServerClient) GetBlock(ctx context.Context, arg keybase1.GetBlock
 	}, nil
 }
 
+func (fc *FakeBServerClient) GetBlockKey(ctx context.Context,
+	arg getBlockKeyArg) (string, error) {
+	if fc.noBlockKeys {
+		return "", rpc.MethodNotFoundError{}
+	}
+	res, err := fc.GetBlock(ctx, keybase1.GetBlockArg(arg))
+	if err != nil {
+		return "", err
+	}
+	return res.BlockKey, nil
+}
+
+func (fc *FakeBServerClient) encodingHandler() blockEncodingHandler {
+	return blockEncodingHandler{fc.bserverMem, fc.encodings}
+}
+
+func (fc *FakeBServerClient) GetBlockEncodings(
+	ctx context.Context) ([]string, error) {
+	if fc.encodings == nil {
+		return nil, rpc.MethodNotFoundError{}
+	}
+	return fc.encodingHandler().getBlockEncodings(), nil
+}
+
+func (fc *FakeBServerClient) GetBlockCapabilities(
+	ctx context.Context) (blockCapabilities, error) {
+	fc.capabilityCalls++
+	if fc.capabilities == nil {
+		return blockCapabilities{}, rpc.MethodNotFoundError{}
+	}
+	return *fc.capabilities, nil
+}
+
+func (fc *FakeBServerClient) PutBlockEncoded(
+	ctx context.Context, arg putBlockEncodedArg) error {
+	fc.lastPutEncoding = arg.Encoding
+	return fc.encodingHandler().putBlockEncoded(ctx, arg)
+}
+
+func (fc *FakeBServerClient) GetBlockEncoded(ctx context.Context,
+	arg getBlockEncodedArg) (getBlockEncodedRes, error) {
+	return fc.encodingHandler().getBlockEncoded(ctx, arg)
+}
+
 func (fc *FakeBServerClient) AddReference(ctx context.Context, arg keybase1.AddReferenceArg) error {
 	id, err := BlockIDFromString(arg.Ref.Bid.BlockHash)
 	if err != nil {
@@ -247,6 +379,283 @@ func TestBServerRemotePutAndGet(t *testing.T) {
 	}
 }
 
+// Test that an upload of a large block that gets interrupted resumes
+// from the last chunk the server acknowledged.
+func TestBServerRemotePutChunkedResume(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1"})
+	currentUID := localUsers[0].UID
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	bCtx := BlockContext{currentUID, "", zeroBlockRefNonce}
+	data := make([]byte, bserverPutChunkThreshold+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	bID, err := crypto.MakePermanentBlockID(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverHalf, err := config.Crypto().MakeRandomBlockCryptKeyServerHalf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the ack for the second chunk.
+	fc.dropAckAfter = bserverPutChunkSize
+	ctx := context.Background()
+	err = b.Put(ctx, bID, tlfID, bCtx, data, serverHalf)
+	if err != nil {
+		t.Fatalf("Put got error: %v", err)
+	}
+
+	// Nothing should have been sent twice.
+	if fc.chunkBytes != len(data) {
+		t.Errorf("Server got %d bytes, expected %d", fc.chunkBytes, len(data))
+	}
+
+	buf, key, err := b.Get(ctx, bID, tlfID, bCtx)
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Got bad data back")
+	}
+	if key != serverHalf {
+		t.Errorf("Got bad key -- got %v, expected %v", key, serverHalf)
+	}
+}
+
+// Test that blocks of the usual size go up in a single call, and
+// that once the server turns out not to support chunked uploads,
+// later large blocks aren't offered to it in chunks again.
+func TestBServerRemotePutChunkedUnsupported(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1"})
+	currentUID := localUsers[0].UID
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	bCtx := BlockContext{currentUID, "", zeroBlockRefNonce}
+	ctx := context.Background()
+	put := func(size int, fill byte) {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = fill
+		}
+		bID, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = b.Put(ctx, bID, tlfID, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		buf, _, err := b.Get(ctx, bID, tlfID, bCtx)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+
+	put(2*MaxBlockSizeBytesDefault, 1)
+	require.Equal(t, 0, fc.uploadOffsetCalls)
+
+	fc.noChunks = true
+	put(bserverPutChunkThreshold+10, 2)
+	put(bserverPutChunkThreshold+10, 3)
+	require.Equal(t, 1, fc.uploadOffsetCalls)
+	require.Equal(t, 0, fc.chunkBytes)
+}
+
+// testXorBlockTransportEncoding flips every bit of the block.
+type testXorBlockTransportEncoding struct{}
+
+func (testXorBlockTransportEncoding) Name() string {
+	return "test-xor"
+}
+
+func (testXorBlockTransportEncoding) Encode(buf []byte) ([]byte, error) {
+	encoded := make([]byte, len(buf))
+	for i, b := range buf {
+		encoded[i] = ^b
+	}
+	return encoded, nil
+}
+
+func (e testXorBlockTransportEncoding) Decode(buf []byte) ([]byte, error) {
+	return e.Encode(buf)
+}
+
+func testBServerRemoteEncodings(t *testing.T,
+	serverEncodings []BlockTransportEncoding, expectedEncoding string) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1"})
+	currentUID := localUsers[0].UID
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	config.SetBlockTransportEncodings(
+		[]BlockTransportEncoding{testXorBlockTransportEncoding{}})
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	fc.encodings = serverEncodings
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	bCtx := BlockContext{currentUID, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverHalf, err := config.Crypto().MakeRandomBlockCryptKeyServerHalf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = b.Put(ctx, bID, tlfID, bCtx, data, serverHalf)
+	if err != nil {
+		t.Fatalf("Put got error: %v", err)
+	}
+	if fc.lastPutEncoding != expectedEncoding {
+		t.Errorf("Put used encoding %q, expected %q",
+			fc.lastPutEncoding, expectedEncoding)
+	}
+
+	// The server must have stored the decoded block.
+	buf, _, err := fc.bserverMem.Get(ctx, bID, tlfID, bCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Server stored bad data -- got %v, expected %v", buf, data)
+	}
+
+	buf, key, err := b.Get(ctx, bID, tlfID, bCtx)
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("Got bad data -- got %v, expected %v", buf, data)
+	}
+	if key != serverHalf {
+		t.Errorf("Got bad key -- got %v, expected %v", key, serverHalf)
+	}
+}
+
+// Test that blocks are sent with an encoding both sides support.
+func TestBServerRemoteEncodedPutAndGet(t *testing.T) {
+	testBServerRemoteEncodings(t,
+		[]BlockTransportEncoding{testXorBlockTransportEncoding{}},
+		testXorBlockTransportEncoding{}.Name())
+}
+
+// Test that servers that can't negotiate encodings get raw blocks.
+func TestBServerRemoteEncodingFallback(t *testing.T) {
+	testBServerRemoteEncodings(t, nil, "")
+	// A server that can negotiate, but doesn't support any of
+	// the client's encodings.
+	testBServerRemoteEncodings(t, []BlockTransportEncoding{}, "")
+}
+
+// Test that the capabilities reported by the server are used to pick
+// an encoding, and are only asked for once per connection.
+func TestBServerRemoteCapabilities(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	xor := testXorBlockTransportEncoding{}
+	config.SetBlockTransportEncodings([]BlockTransportEncoding{xor})
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	fc.capabilities = &blockCapabilities{
+		BatchPuts:    true,
+		MaxBlockSize: 1 << 20,
+		Encodings:    []string{xor.Name(), RawBlockTransportEncodingName},
+	}
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	ctx := context.Background()
+	caps, err := b.Capabilities(ctx)
+	require.NoError(t, err)
+	require.Equal(t, BlockServerCapabilities{
+		BatchPuts:    true,
+		MaxBlockSize: 1 << 20,
+		Encodings:    []string{xor.Name(), RawBlockTransportEncodingName},
+	}, caps)
+	require.True(t, caps.SupportsEncoding(xor.Name()))
+
+	encoding, err := b.getEncoding(ctx)
+	require.NoError(t, err)
+	require.Equal(t, xor.Name(), encoding.Name())
+	require.Equal(t, 1, fc.capabilityCalls)
+}
+
+// Test that the capabilities of servers that can't report them are
+// filled in from the encodings they support, if any.
+func TestBServerRemoteCapabilitiesFallback(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	xor := testXorBlockTransportEncoding{}
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	fc.encodings = []BlockTransportEncoding{xor}
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	ctx := context.Background()
+	caps, err := b.Capabilities(ctx)
+	require.NoError(t, err)
+	require.Equal(t, BlockServerCapabilities{
+		Encodings: []string{xor.Name(), RawBlockTransportEncodingName},
+	}, caps)
+
+	fc = NewFakeBServerClient(config, nil, nil, nil)
+	b = newBlockServerRemoteWithClient(config, fc)
+	caps, err = b.Capabilities(ctx)
+	require.NoError(t, err)
+	require.Equal(t, BlockServerCapabilities{}, caps)
+	require.False(t, caps.SupportsEncoding(xor.Name()))
+	require.True(t, caps.SupportsEncoding(RawBlockTransportEncodingName))
+}
+
+// Test that block keys can be fetched on their own, even from servers
+// that can only return them along with the blocks.
+func TestBServerRemoteGetKey(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1"})
+	crypto := &CryptoLocal{CryptoCommon: makeTestCryptoCommon(t)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+	fc := NewFakeBServerClient(config, nil, nil, nil)
+	b := newBlockServerRemoteWithClient(config, fc)
+
+	tlfID := FakeTlfID(2, false)
+	bCtx := BlockContext{localUsers[0].UID, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	ctx := context.Background()
+	err = b.Put(ctx, bID, tlfID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	key, err := b.GetKey(ctx, bID, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, serverHalf, key)
+
+	fc.noBlockKeys = true
+	key, err = b.GetKey(ctx, bID, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, serverHalf, key)
+}
+
 // If we cancel the RPC before the RPC returns, the call should error quickly.
 func TestBServerRemotePutCanceled(t *testing.T) {
 	codec := NewCodecMsgpack()
@@ -258,7 +667,7 @@ func TestBServerRemotePutCanceled(t *testing.T) {
 
 	serverConn, conn := rpc.MakeConnectionForTest(t)
 	b := newBlockServerRemoteWithClient(
-		config, keybase1.BlockClient{Cli: conn.GetClient()})
+		config, blockClient{keybase1.BlockClient{Cli: conn.GetClient()}})
 
 	f := func(ctx context.Context) error {
 		bID := fakeBlockID(1)
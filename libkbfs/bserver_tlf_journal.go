@@ -13,6 +13,8 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+
+	keybase1 "github.com/keybase/client/go/protocol"
 )
 
 // bserverTlfJournal stores an ordered list of BlockServer mutating
@@ -48,6 +50,10 @@ import (
 // ID, and key_server_half, which contains the raw data for the
 // associated key server half.
 //
+// The block data may instead be kept in a bserverBlockStore shared
+// with other TLFs, in which case dir/blocks only holds the key server
+// halves.
+//
 // TODO: Do all high-level operations atomically on the file-system
 // level.
 //
@@ -60,6 +66,12 @@ type bserverTlfJournal struct {
 	codec  Codec
 	crypto cryptoPure
 	dir    string
+	tlfID  TlfID
+	// Where the block data lives.  ownBlockStore is in dir/blocks,
+	// and is the same as blockStore unless the data is shared with
+	// other TLFs.
+	blockStore    *bserverBlockStore
+	ownBlockStore *bserverBlockStore
 
 	// Protects any IO operations in dir or any of its children,
 	// as well as refs and isShutdown.
@@ -69,16 +81,47 @@ type bserverTlfJournal struct {
 	lock       sync.RWMutex
 	refs       map[BlockID]blockRefMap
 	isShutdown bool
+	// usage is the quota usage of each uploader of the blocks
+	// referenced by this TLF, and sizes caches the data size of
+	// those blocks.
+	usage map[keybase1.UID]*UsageStat
+	sizes map[BlockID]int64
+	// onCharge, if non-nil, is called with every change to the
+	// written bytes of each uploader, with lock held.
+	onCharge func(uid keybase1.UID, bytes int64)
 }
 
 // makeBserverTlfJournal returns a new bserverTlfJournal for the given
-// directory. Any existing journal entries are read.
+// directory, which stores its own block data. Any existing journal
+// entries are read.
 func makeBserverTlfJournal(codec Codec, crypto cryptoPure, dir string) (
+	*bserverTlfJournal, error) {
+	return makeSharedBserverTlfJournal(
+		codec, crypto, dir, NullTlfID, nil, nil)
+}
+
+// makeSharedBserverTlfJournal returns a new bserverTlfJournal for the
+// given TLF and directory, which keeps its block data in the given
+// store.  If blockStore is nil, the journal stores its own block
+// data. Any existing journal entries are read.  If onCharge is
+// non-nil, it's called with the written bytes of each uploader of
+// the existing blocks, and then with every change to them.
+func makeSharedBserverTlfJournal(codec Codec, crypto cryptoPure, dir string,
+	tlfID TlfID, blockStore *bserverBlockStore,
+	onCharge func(uid keybase1.UID, bytes int64)) (
 	*bserverTlfJournal, error) {
 	bserver := &bserverTlfJournal{
-		codec:  codec,
-		crypto: crypto,
-		dir:    dir,
+		codec:      codec,
+		crypto:     crypto,
+		dir:        dir,
+		tlfID:      tlfID,
+		blockStore: blockStore,
+		usage:      make(map[keybase1.UID]*UsageStat),
+		sizes:      make(map[BlockID]int64),
+	}
+	bserver.ownBlockStore = makeBserverBlockStore(bserver.blocksPath())
+	if bserver.blockStore == nil {
+		bserver.blockStore = bserver.ownBlockStore
 	}
 
 	// Locking here is not strictly necessary, but do it anyway
@@ -91,6 +134,21 @@ func makeBserverTlfJournal(codec Codec, crypto cryptoPure, dir string) (
 	}
 
 	bserver.refs = refs
+	for id := range refs {
+		charge, err := bserver.blockChargeLocked(id)
+		if err != nil {
+			return nil, err
+		}
+		bserver.applyChargeLocked(charge, 1)
+	}
+
+	// Only report the existing usage once it's all been read.
+	bserver.onCharge = onCharge
+	if onCharge != nil {
+		for uid, usage := range bserver.usage {
+			onCharge(uid, usage.Bytes[UsageWrite])
+		}
+	}
 	return bserver, nil
 }
 
@@ -141,10 +199,6 @@ func (s *bserverTlfJournal) blockPath(id BlockID) string {
 	return filepath.Join(s.blocksPath(), idStr[:4], idStr[4:])
 }
 
-func (s *bserverTlfJournal) blockDataPath(id BlockID) string {
-	return filepath.Join(s.blockPath(id), "data")
-}
-
 func (s *bserverTlfJournal) keyServerHalfPath(id BlockID) string {
 	return filepath.Join(s.blockPath(id), "key_server_half")
 }
@@ -388,11 +442,14 @@ func (s *bserverTlfJournal) getDataLocked(id BlockID, context BlockContext) (
 
 	// Read files.
 
-	data, err := ioutil.ReadFile(s.blockDataPath(id))
-	if os.IsNotExist(err) {
-		return nil, BlockCryptKeyServerHalf{},
-			BServerErrorBlockNonExistent{}
-	} else if err != nil {
+	data, err := s.blockStore.get(id)
+	if _, ok := err.(BServerErrorBlockNonExistent); ok &&
+		s.blockStore != s.ownBlockStore {
+		// The block may have been put before this journal
+		// started sharing its block data.
+		data, err = s.ownBlockStore.get(id)
+	}
+	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 
@@ -455,6 +512,130 @@ func (s *bserverTlfJournal) putRefEntryLocked(
 	return nil
 }
 
+// blockCharge describes how a block counts towards its uploader's
+// quota: all referenced blocks count as written bytes, and the ones
+// with only archived references also count as archived bytes.
+type blockCharge struct {
+	referenced bool
+	uploader   keybase1.UID
+	size       int64
+	archived   bool
+}
+
+// refChargeLocked returns the charge of the given block as of its
+// current references, without its size.
+func (s *bserverTlfJournal) refChargeLocked(id BlockID) blockCharge {
+	refs := s.refs[id]
+	if len(refs) == 0 {
+		return blockCharge{}
+	}
+
+	charge := blockCharge{referenced: true, archived: true}
+	for _, refEntry := range refs {
+		// All references share the creator of the original put.
+		charge.uploader = refEntry.Context.GetCreator()
+		if refEntry.Status == liveBlockRef {
+			charge.archived = false
+		}
+	}
+	return charge
+}
+
+// blockSizeLocked returns the size of the given block's data.
+func (s *bserverTlfJournal) blockSizeLocked(id BlockID) (int64, error) {
+	size, ok := s.sizes[id]
+	if !ok {
+		var err error
+		size, err = s.blockStore.getSize(id)
+		if _, ok := err.(BServerErrorBlockNonExistent); ok &&
+			s.blockStore != s.ownBlockStore {
+			size, err = s.ownBlockStore.getSize(id)
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.sizes[id] = size
+	}
+	return size, nil
+}
+
+func (s *bserverTlfJournal) blockChargeLocked(id BlockID) (
+	blockCharge, error) {
+	charge := s.refChargeLocked(id)
+	if !charge.referenced {
+		return charge, nil
+	}
+	size, err := s.blockSizeLocked(id)
+	if err != nil {
+		return blockCharge{}, err
+	}
+	charge.size = size
+	return charge, nil
+}
+
+// applyChargeLocked adds (if sign is 1) or removes (if sign is -1)
+// the given charge to or from its uploader's usage.
+func (s *bserverTlfJournal) applyChargeLocked(charge blockCharge, sign int) {
+	if !charge.referenced {
+		return
+	}
+	usage := s.usage[charge.uploader]
+	if usage == nil {
+		usage = NewUsageStat()
+		s.usage[charge.uploader] = usage
+	}
+	usage.AccumOne(sign*int(charge.size), UsageWrite)
+	if charge.archived {
+		usage.AccumOne(sign*int(charge.size), UsageArchive)
+	}
+	if s.onCharge != nil {
+		s.onCharge(charge.uploader, int64(sign)*charge.size)
+	}
+}
+
+// updateChargeLocked runs the given function, which changes the
+// references to the given block, and updates the quota usage to
+// match.
+func (s *bserverTlfJournal) updateChargeLocked(
+	id BlockID, fn func() error) error {
+	before, err := s.blockChargeLocked(id)
+	if err != nil {
+		return err
+	}
+	// Even if fn fails, it may have changed the references, so
+	// once it's run, the new charge has to be worked out without
+	// any lookup that could fail and leave the usage behind.
+	fnErr := fn()
+	after := s.refChargeLocked(id)
+	if after.referenced {
+		if before.referenced {
+			// A block's data never changes, so neither does
+			// its size.
+			after.size = before.size
+		} else {
+			// fn only adds the first reference once the data
+			// is stored and its size cached, so this can only
+			// fail if the store is broken.  Charge nothing for
+			// the block then, and remember that, so that the
+			// charge is taken back out consistently later.
+			size, err := s.blockSizeLocked(id)
+			if err != nil {
+				s.sizes[id] = 0
+				if fnErr == nil {
+					fnErr = err
+				}
+			}
+			after.size = size
+		}
+	}
+	s.applyChargeLocked(before, -1)
+	s.applyChargeLocked(after, 1)
+	if !after.referenced {
+		delete(s.sizes, id)
+	}
+	return fnErr
+}
+
 // All functions below are public functions.
 
 func (s *bserverTlfJournal) getData(id BlockID, context BlockContext) (
@@ -489,6 +670,37 @@ func (s *bserverTlfJournal) getAll() (
 	return res, nil
 }
 
+// hasReferences returns whether this TLF has any references to the
+// given block.
+func (s *bserverTlfJournal) hasReferences(id BlockID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.refs[id]) > 0
+}
+
+// getQuotaUsage returns a copy of the quota usage of each uploader
+// of the blocks referenced by this TLF.
+func (s *bserverTlfJournal) getQuotaUsage() (
+	map[keybase1.UID]*UsageStat, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.isShutdown {
+		return nil, errBserverTlfJournalShutdown
+	}
+
+	res := make(map[keybase1.UID]*UsageStat)
+	for uid, usage := range s.usage {
+		if !usage.NonZero() {
+			continue
+		}
+		c := NewUsageStat()
+		c.Accum(usage, func(a, b int64) int64 { return a + b })
+		res[uid] = c
+	}
+	return res, nil
+}
+
 func (s *bserverTlfJournal) putData(
 	id BlockID, context BlockContext, buf []byte,
 	serverHalf BlockCryptKeyServerHalf) error {
@@ -530,34 +742,37 @@ func (s *bserverTlfJournal) putData(
 		}
 	}
 
-	err = os.MkdirAll(s.blockPath(id), 0700)
-	if err != nil {
-		return err
-	}
+	return s.updateChargeLocked(id, func() error {
+		err := os.MkdirAll(s.blockPath(id), 0700)
+		if err != nil {
+			return err
+		}
 
-	err = ioutil.WriteFile(s.blockDataPath(id), buf, 0600)
-	if err != nil {
-		return err
-	}
+		err = s.blockStore.put(s.tlfID, id, buf)
+		if err != nil {
+			return err
+		}
+		s.sizes[id] = int64(len(buf))
 
-	// TODO: Add integrity-checking for key server half?
+		// TODO: Add integrity-checking for key server half?
 
-	err = ioutil.WriteFile(
-		s.keyServerHalfPath(id), serverHalf.data[:], 0600)
-	if err != nil {
-		return err
-	}
+		err = ioutil.WriteFile(
+			s.keyServerHalfPath(id), serverHalf.data[:], 0600)
+		if err != nil {
+			return err
+		}
 
-	err = s.putRefEntryLocked(id, blockRefEntry{
-		Status:  liveBlockRef,
-		Context: context,
-	})
-	if err != nil {
-		return err
-	}
+		err = s.putRefEntryLocked(id, blockRefEntry{
+			Status:  liveBlockRef,
+			Context: context,
+		})
+		if err != nil {
+			return err
+		}
 
-	return s.appendJournalEntryLocked(
-		blockPutOp, id, []BlockContext{context})
+		return s.appendJournalEntryLocked(
+			blockPutOp, id, []BlockContext{context})
+	})
 }
 
 func (s *bserverTlfJournal) addReference(id BlockID, context BlockContext) error {
@@ -620,32 +835,39 @@ func (s *bserverTlfJournal) removeReferences(
 		return 0, nil
 	}
 
-	for _, context := range contexts {
-		refNonce := context.GetRefNonce()
-		// If this check fails, this ref is already gone,
-		// which is not an error.
-		if refEntry, ok := refs[refNonce]; ok {
-			err := refEntry.checkContext(context)
-			if err != nil {
-				return 0, err
-			}
+	count := 0
+	err := s.updateChargeLocked(id, func() error {
+		for _, context := range contexts {
+			refNonce := context.GetRefNonce()
+			// If this check fails, this ref is already gone,
+			// which is not an error.
+			if refEntry, ok := refs[refNonce]; ok {
+				err := refEntry.checkContext(context)
+				if err != nil {
+					return err
+				}
 
-			delete(refs, refNonce)
+				delete(refs, refNonce)
+			}
 		}
-	}
 
-	count := len(refs)
-	if count == 0 {
-		err := os.RemoveAll(s.blockPath(id))
-		if err != nil {
-			return 0, err
+		count = len(refs)
+		if count == 0 {
+			err := s.blockStore.release(s.tlfID, id)
+			if err != nil {
+				return err
+			}
+			err = os.RemoveAll(s.blockPath(id))
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	// TODO: Figure out what to do with live count when we have a
-	// real block server backend.
+		// TODO: Figure out what to do with live count when we
+		// have a real block server backend.
 
-	err := s.appendJournalEntryLocked(removeRefsOp, id, contexts)
+		return s.appendJournalEntryLocked(removeRefsOp, id, contexts)
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -662,37 +884,39 @@ func (s *bserverTlfJournal) archiveReferences(
 		return errBserverTlfJournalShutdown
 	}
 
-	for _, context := range contexts {
-		refNonce := context.GetRefNonce()
-		refEntry, err := s.getRefEntryLocked(id, refNonce)
-		switch err.(type) {
-		case BServerErrorBlockNonExistent:
-			return BServerErrorBlockNonExistent{
-				fmt.Sprintf(
-					"Block ID %s (ref %s) doesn't "+
-						"exist and cannot be archived.",
-					id, refNonce),
+	return s.updateChargeLocked(id, func() error {
+		for _, context := range contexts {
+			refNonce := context.GetRefNonce()
+			refEntry, err := s.getRefEntryLocked(id, refNonce)
+			switch err.(type) {
+			case BServerErrorBlockNonExistent:
+				return BServerErrorBlockNonExistent{
+					fmt.Sprintf(
+						"Block ID %s (ref %s) doesn't "+
+							"exist and cannot be archived.",
+						id, refNonce),
+				}
+			case nil:
+				break
+
+			default:
+				return err
 			}
-		case nil:
-			break
-
-		default:
-			return err
-		}
 
-		err = refEntry.checkContext(context)
-		if err != nil {
-			return err
-		}
+			err = refEntry.checkContext(context)
+			if err != nil {
+				return err
+			}
 
-		refEntry.Status = archivedBlockRef
-		err = s.putRefEntryLocked(id, refEntry)
-		if err != nil {
-			return err
+			refEntry.Status = archivedBlockRef
+			err = s.putRefEntryLocked(id, refEntry)
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	return s.appendJournalEntryLocked(archiveRefsOp, id, contexts)
+		return s.appendJournalEntryLocked(archiveRefsOp, id, contexts)
+	})
 }
 
 func (s *bserverTlfJournal) shutdown() {
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/keybase/client/go/protocol"
@@ -199,3 +200,149 @@ func TestBserverTlfJournalArchiveReferences(t *testing.T) {
 	require.IsType(t, BServerErrorBlockArchived{}, err)
 	require.Equal(t, 3, getJournalLength(t, s))
 }
+
+func TestBserverTlfJournalSharedBlockStore(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	store := makeBserverBlockStore(filepath.Join(tempdir, "shared"))
+	tlfID1 := FakeTlfID(1, false)
+	tlfID2 := FakeTlfID(2, false)
+	s1, err := makeSharedBserverTlfJournal(codec, crypto,
+		filepath.Join(tempdir, tlfID1.String()), tlfID1, store, nil)
+	require.NoError(t, err)
+	defer s1.shutdown()
+	s2, err := makeSharedBserverTlfJournal(codec, crypto,
+		filepath.Join(tempdir, tlfID2.String()), tlfID2, store, nil)
+	require.NoError(t, err)
+	defer s2.shutdown()
+
+	uid1 := keybase1.MakeTestUID(1)
+	bCtx := BlockContext{uid1, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf1, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	serverHalf2, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	// Put the same block in both TLFs; the data is only stored
+	// once, but each TLF keeps its own key server half.
+	err = s1.putData(bID, bCtx, data, serverHalf1)
+	require.NoError(t, err)
+	err = s2.putData(bID, bCtx, data, serverHalf2)
+	require.NoError(t, err)
+	count, err := store.refCount(bID)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	_, err = os.Stat(filepath.Join(s1.blockPath(bID), "data"))
+	require.True(t, os.IsNotExist(err))
+
+	buf, key, err := s2.getData(bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf2, key)
+
+	// Removing it from one TLF leaves it readable in the other.
+	_, err = s1.removeReferences(bID, []BlockContext{bCtx})
+	require.NoError(t, err)
+	count, err = store.refCount(bID)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	buf, _, err = s2.getData(bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// And removing it from the last TLF deletes the data.
+	_, err = s2.removeReferences(bID, []BlockContext{bCtx})
+	require.NoError(t, err)
+	_, err = store.get(bID)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+}
+
+func TestBserverTlfJournalQuotaUsage(t *testing.T) {
+	codec := NewCodecMsgpack()
+	crypto := makeTestCryptoCommon(t)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "bserver_tlf_storage")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+
+	s, err := makeBserverTlfJournal(codec, crypto, tempdir)
+	require.NoError(t, err)
+	// s changes on restart below.
+	defer func() { s.shutdown() }()
+
+	requireUsage := func(uid keybase1.UID, written, archived int64) {
+		usage, err := s.getQuotaUsage()
+		require.NoError(t, err)
+		if written == 0 {
+			require.NotContains(t, usage, uid)
+			return
+		}
+		require.Equal(t, written, usage[uid].Bytes[UsageWrite])
+		require.Equal(t, archived, usage[uid].Bytes[UsageArchive])
+	}
+
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	// Each block counts against the user who put it, even when
+	// referenced by someone else.
+	data1 := []byte{1, 2, 3, 4}
+	bID1, err := crypto.MakePermanentBlockID(data1)
+	require.NoError(t, err)
+	bCtx1 := BlockContext{uid1, "", zeroBlockRefNonce}
+	err = s.putData(bID1, bCtx1, data1, serverHalf)
+	require.NoError(t, err)
+	nonce, err := crypto.MakeBlockRefNonce()
+	require.NoError(t, err)
+	bCtx1b := BlockContext{uid1, uid2, nonce}
+	err = s.addReference(bID1, bCtx1b)
+	require.NoError(t, err)
+
+	data2 := []byte{5, 6}
+	bID2, err := crypto.MakePermanentBlockID(data2)
+	require.NoError(t, err)
+	bCtx2 := BlockContext{uid2, "", zeroBlockRefNonce}
+	err = s.putData(bID2, bCtx2, data2, serverHalf)
+	require.NoError(t, err)
+
+	requireUsage(uid1, 4, 0)
+	requireUsage(uid2, 2, 0)
+
+	// A block is archived once all its references are.
+	err = s.archiveReferences(bID1, []BlockContext{bCtx1})
+	require.NoError(t, err)
+	requireUsage(uid1, 4, 0)
+	err = s.archiveReferences(bID1, []BlockContext{bCtx1b})
+	require.NoError(t, err)
+	requireUsage(uid1, 4, 4)
+
+	// Usage survives a restart.
+	s.shutdown()
+	s, err = makeBserverTlfJournal(codec, crypto, tempdir)
+	require.NoError(t, err)
+	requireUsage(uid1, 4, 4)
+	requireUsage(uid2, 2, 0)
+
+	// Removing all references frees the bytes.
+	_, err = s.removeReferences(bID1, []BlockContext{bCtx1, bCtx1b})
+	require.NoError(t, err)
+	requireUsage(uid1, 0, 0)
+	requireUsage(uid2, 2, 0)
+}
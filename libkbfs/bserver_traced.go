@@ -0,0 +1,133 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// BlockServerTraced delegates to another BlockServer instance but
+// also records a tracing span for each call, if the config has a
+// SpanExporter.
+type BlockServerTraced struct {
+	delegate BlockServer
+	config   Config
+}
+
+var _ BlockServer = BlockServerTraced{}
+
+// NewBlockServerTraced creates and returns a new BlockServerTraced
+// instance with the given delegate and config.
+func NewBlockServerTraced(
+	delegate BlockServer, config Config) BlockServerTraced {
+	return BlockServerTraced{delegate, config}
+}
+
+// Get implements the BlockServer interface for BlockServerTraced.
+func (b BlockServerTraced) Get(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.Get")
+	defer func() { span.finish(err) }()
+	span.setTag("block", id.String())
+	return b.delegate.Get(ctx, id, tlfID, context)
+}
+
+// GetKey implements the BlockServer interface for BlockServerTraced.
+func (b BlockServerTraced) GetKey(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (
+	serverHalf BlockCryptKeyServerHalf, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.GetKey")
+	defer func() { span.finish(err) }()
+	span.setTag("block", id.String())
+	return b.delegate.GetKey(ctx, id, tlfID, context)
+}
+
+// Put implements the BlockServer interface for BlockServerTraced.
+func (b BlockServerTraced) Put(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) (err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.Put")
+	defer func() { span.finish(err) }()
+	span.setTag("block", id.String())
+	return b.delegate.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) AddBlockReference(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext) (err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.AddBlockReference")
+	defer func() { span.finish(err) }()
+	span.setTag("block", id.String())
+	return b.delegate.AddBlockReference(ctx, id, tlfID, context)
+}
+
+// RemoveBlockReference implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) RemoveBlockReference(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	ctx, span := startTraceSpan(
+		ctx, b.config, "BlockServer.RemoveBlockReference")
+	defer func() { span.finish(err) }()
+	return b.delegate.RemoveBlockReference(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (err error) {
+	ctx, span := startTraceSpan(
+		ctx, b.config, "BlockServer.ArchiveBlockReferences")
+	defer func() { span.finish(err) }()
+	return b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) Shutdown() {
+	b.delegate.Shutdown()
+}
+
+// RefreshAuthToken implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) RefreshAuthToken(ctx context.Context) {
+	b.delegate.RefreshAuthToken(ctx)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) GetUserQuotaInfo(ctx context.Context) (
+	info *UserQuotaInfo, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.GetUserQuotaInfo")
+	defer func() { span.finish(err) }()
+	return b.delegate.GetUserQuotaInfo(ctx)
+}
+
+// GetTLFQuotaInfo implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) GetTLFQuotaInfo(
+	ctx context.Context, tlfID TlfID) (info *UsageStat, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.GetTLFQuotaInfo")
+	defer func() { span.finish(err) }()
+	return b.delegate.GetTLFQuotaInfo(ctx, tlfID)
+}
+
+// GetQuotaPoolInfo implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) GetQuotaPoolInfo(
+	ctx context.Context, tlfID TlfID) (info *QuotaPoolInfo, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.GetQuotaPoolInfo")
+	defer func() { span.finish(err) }()
+	return b.delegate.GetQuotaPoolInfo(ctx, tlfID)
+}
+
+// Capabilities implements the BlockServer interface for
+// BlockServerTraced.
+func (b BlockServerTraced) Capabilities(ctx context.Context) (
+	caps BlockServerCapabilities, err error) {
+	ctx, span := startTraceSpan(ctx, b.config, "BlockServer.Capabilities")
+	defer func() { span.finish(err) }()
+	return b.delegate.Capabilities(ctx)
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// cdcWindowSize is the number of trailing bytes that determine the
+// value of the rolling hash at any position.  Since the gear hash
+// shifts left by one bit per byte, a byte stops affecting the hash
+// 64 bytes after it was added.
+const cdcWindowSize = 64
+
+// cdcGear maps each byte value to a pseudo-random 64-bit value for
+// the gear rolling hash.  It must be the same for all clients, so
+// that they all pick the same boundaries for the same data.
+var cdcGear [256]uint64
+
+func init() {
+	// splitmix64, with a fixed seed.
+	x := uint64(0x6b626673)
+	for i := range cdcGear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		cdcGear[i] = z ^ (z >> 31)
+	}
+}
+
+// BlockSplitterCDC implements the BlockSplitter interface using
+// content-defined chunking: file blocks end wherever a rolling hash
+// of the preceding bytes hits a particular pattern, rather than at
+// fixed offsets.  That means a change in the middle of a large file
+// only moves the block boundaries near the change, and all the
+// blocks after it keep their old contents.
+//
+// Blocks are never shorter than minSize (except at the end of a
+// file), and never longer than the max size of the underlying
+// BlockSplitterSimple.
+type BlockSplitterCDC struct {
+	simple        *BlockSplitterSimple
+	minSize       int64
+	boundaryShift uint
+}
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC whose blocks,
+// once encoded, are never bigger than desiredBlockSize.  Blocks are
+// about half that size on average.
+func NewBlockSplitterCDC(desiredBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterCDC, error) {
+	simple, err := NewBlockSplitterSimple(
+		desiredBlockSize, blockChangeEmbedMaxSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockSplitterCDCWithSimple(simple), nil
+}
+
+func newBlockSplitterCDCWithSimple(
+	simple *BlockSplitterSimple) *BlockSplitterCDC {
+	minSize := simple.maxSize / 4
+	// A boundary shows up with probability 2^-bits at each position
+	// past minSize, so blocks average about minSize + 2^bits bytes.
+	var bits uint
+	for int64(1)<<(bits+1) <= simple.maxSize/4 {
+		bits++
+	}
+	return &BlockSplitterCDC{
+		simple:        simple,
+		minSize:       minSize,
+		boundaryShift: 64 - bits,
+	}
+}
+
+// nextBoundary returns the length of the first block that can be cut
+// from the beginning of buf, considering only lengths of at least
+// from.  It returns -1 if buf doesn't contain a boundary yet.
+func (b *BlockSplitterCDC) nextBoundary(buf []byte, from int64) int64 {
+	start := from
+	if start < b.minSize {
+		start = b.minSize
+	}
+	// Only the last cdcWindowSize bytes before start matter for
+	// the hash at start.
+	warm := start - cdcWindowSize
+	if warm < 0 {
+		warm = 0
+	}
+	var h uint64
+	for i := warm; i < int64(len(buf)); i++ {
+		h = (h << 1) + cdcGear[buf[i]]
+		end := i + 1
+		if end < start {
+			continue
+		}
+		if h>>b.boundaryShift == 0 || end >= b.simple.maxSize {
+			return end
+		}
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if off != currLen {
+		// Overwrites (and writes past the end of the block) don't
+		// get a say in where the block ends; CheckSplit fixes up
+		// the boundaries once the file is synced.
+		return b.simple.CopyUntilSplit(block, lastBlock, data, off)
+	}
+
+	toCopy := int64(len(data))
+	if room := b.simple.maxSize - currLen; room < toCopy {
+		if room <= 0 {
+			return 0
+		}
+		toCopy = room
+	}
+	block.Contents = append(block.Contents, data[:toCopy]...)
+	// Only look for boundaries in the new data, since any earlier
+	// boundary would have stopped the previous append.
+	end := b.nextBoundary(block.Contents, currLen)
+	if end >= 0 && end < int64(len(block.Contents)) {
+		block.Contents = block.Contents[:end]
+		toCopy = end - currLen
+	}
+	return toCopy
+}
+
+// SplitNoCopy implements the blockSplitterNoCopy interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) SplitNoCopy(currLen int64, data []byte) int64 {
+	if currLen != 0 {
+		// Like in CopyUntilSplit, overwrites don't get a say in
+		// where the block ends.
+		return b.simple.SplitNoCopy(currLen, data)
+	}
+	n := int64(len(data))
+	if n > b.simple.maxSize {
+		n = b.simple.maxSize
+	}
+	if end := b.nextBoundary(data[:n], 0); end >= 0 && end < n {
+		n = end
+	}
+	return n
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	end := b.nextBoundary(block.Contents, 0)
+	switch {
+	case end < 0:
+		// No boundary yet, so this block should take some bytes
+		// from the next one.
+		return -1
+	case end == int64(len(block.Contents)):
+		return 0
+	default:
+		return end
+	}
+}
+
+// maxContentsSize implements the blockSplitterServerLimited interface
+// for BlockSplitterCDC.
+func (b *BlockSplitterCDC) maxContentsSize() int64 {
+	return b.simple.maxSize
+}
+
+// withServerMaxBlockSize implements the blockSplitterServerLimited
+// interface for BlockSplitterCDC.  Shrinking the block size moves
+// the boundaries of the blocks written from then on, but blocks
+// that are already on the server are kept as they are.
+func (b *BlockSplitterCDC) withServerMaxBlockSize(
+	serverMax int64, codec Codec) (BlockSplitter, error) {
+	simple, err := b.simple.withServerMax(serverMax, codec)
+	if err != nil {
+		return nil, err
+	}
+	if simple == b.simple {
+		return b, nil
+	}
+	return newBlockSplitterCDCWithSimple(simple), nil
+}
+
+// ShouldEmbedBlockChanges implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) ShouldEmbedBlockChanges(
+	bc *BlockChanges) bool {
+	return b.simple.ShouldEmbedBlockChanges(bc)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeTestCDCSplitter() *BlockSplitterCDC {
+	return newBlockSplitterCDCWithSimple(
+		&BlockSplitterSimple{maxSize: 1024, blockChangeEmbedMaxSize: 10})
+}
+
+// cdcChunkAll splits data the way a sequence of appending writes of
+// writeSize bytes each would.
+func cdcChunkAll(bsplit *BlockSplitterCDC, data []byte,
+	writeSize int) [][]byte {
+	var chunks [][]byte
+	fblock := NewFileBlock().(*FileBlock)
+	for len(data) > 0 {
+		n := writeSize
+		if n > len(data) {
+			n = len(data)
+		}
+		nCopied := bsplit.CopyUntilSplit(fblock, true, data[:n],
+			int64(len(fblock.Contents)))
+		data = data[nCopied:]
+		if nCopied < int64(n) {
+			chunks = append(chunks, fblock.Contents)
+			fblock = NewFileBlock().(*FileBlock)
+		}
+	}
+	if len(fblock.Contents) > 0 {
+		chunks = append(chunks, fblock.Contents)
+	}
+	return chunks
+}
+
+func TestBsplitterCDCBlockSizes(t *testing.T) {
+	bsplit := makeTestCDCSplitter()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := cdcChunkAll(bsplit, data, 100)
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	var joined []byte
+	for i, c := range chunks {
+		if int64(len(c)) > bsplit.simple.maxSize {
+			t.Errorf("Chunk %d is too big: %d", i, len(c))
+		}
+		if i < len(chunks)-1 && int64(len(c)) < bsplit.minSize {
+			t.Errorf("Chunk %d is too small: %d", i, len(c))
+		}
+		// Every chunk but the last should end at a boundary.
+		if i < len(chunks)-1 {
+			if split := bsplit.CheckSplit(
+				&FileBlock{Contents: c}); split != 0 {
+				t.Errorf("Chunk %d should be split at %d", i, split)
+			}
+		}
+		joined = append(joined, c...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Errorf("Chunks don't add up to the original data")
+	}
+
+	// The boundaries don't depend on the size of the writes.
+	chunks2 := cdcChunkAll(bsplit, data, 1000)
+	if len(chunks2) != len(chunks) {
+		t.Fatalf("Different number of chunks: %d vs %d",
+			len(chunks2), len(chunks))
+	}
+	for i := range chunks {
+		if !bytes.Equal(chunks[i], chunks2[i]) {
+			t.Errorf("Chunk %d differs", i)
+		}
+	}
+}
+
+func TestBsplitterCDCInsertInMiddle(t *testing.T) {
+	bsplit := makeTestCDCSplitter()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	mid := len(data) / 2
+	edited := append([]byte{}, data[:mid]...)
+	edited = append(edited, []byte("inserted bytes")...)
+	edited = append(edited, data[mid:]...)
+
+	chunks := cdcChunkAll(bsplit, data, 512)
+	editedChunks := cdcChunkAll(bsplit, edited, 512)
+
+	old := make(map[string]bool)
+	for _, c := range chunks {
+		old[string(c)] = true
+	}
+	changed := 0
+	for _, c := range editedChunks {
+		if !old[string(c)] {
+			changed++
+		}
+	}
+	// Only the chunks around the insertion should change.
+	if changed > 3 {
+		t.Errorf("%d of %d chunks changed after a small insertion",
+			changed, len(editedChunks))
+	}
+}
+
+func TestBsplitterCDCCheckSplit(t *testing.T) {
+	bsplit := makeTestCDCSplitter()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	chunks := cdcChunkAll(bsplit, data, 4096)
+	if len(chunks) < 3 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+
+	// Two chunks glued together should split at the first boundary.
+	fblock := &FileBlock{Contents: append(
+		append([]byte{}, chunks[0]...), chunks[1]...)}
+	if split := bsplit.CheckSplit(fblock); split != int64(len(chunks[0])) {
+		t.Errorf("Unexpected split %d, expected %d", split, len(chunks[0]))
+	}
+
+	// A chunk that's too small needs more bytes.
+	fblock = &FileBlock{Contents: chunks[0][:bsplit.minSize-1]}
+	if split := bsplit.CheckSplit(fblock); split != -1 {
+		t.Errorf("Unexpected split %d for a short block", split)
+	}
+
+	// Pulling in bytes from the next block stops at the boundary.
+	nCopied := bsplit.CopyUntilSplit(fblock, false, data[len(fblock.Contents):],
+		int64(len(fblock.Contents)))
+	if !bytes.Equal(fblock.Contents, chunks[0]) {
+		t.Errorf("Copied %d bytes, expected to end at %d", nCopied,
+			len(chunks[0]))
+	}
+}
+
+func TestBsplitterCDCSplitNoCopy(t *testing.T) {
+	bsplit := makeTestCDCSplitter()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// Splitting without copying should give the same blocks as one
+	// big appending write.
+	chunks := cdcChunkAll(bsplit, data, len(data))
+	for i, c := range chunks {
+		n := bsplit.SplitNoCopy(0, data)
+		if !bytes.Equal(c, data[:n]) {
+			t.Fatalf("Chunk %d differs: %d bytes vs %d", i, len(c), n)
+		}
+		data = data[n:]
+	}
+
+	// Blocks that would keep some of their old contents can't be
+	// split without copying.
+	if n := bsplit.SplitNoCopy(200, make([]byte, 100)); n != 0 {
+		t.Errorf("Unexpected split of %d bytes", n)
+	}
+	if n := bsplit.SplitNoCopy(200, make([]byte, 300)); n != 300 {
+		t.Errorf("Unexpected split of %d bytes", n)
+	}
+}
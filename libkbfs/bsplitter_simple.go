@@ -11,6 +11,9 @@ import "fmt"
 type BlockSplitterSimple struct {
 	maxSize                 int64
 	blockChangeEmbedMaxSize uint64
+	// blockSize is the desired encoded block size that maxSize
+	// was derived from, or 0 if maxSize was set directly.
+	blockSize int64
 }
 
 // NewBlockSplitterSimple creates a new BlockSplittleSimple and
@@ -19,6 +22,7 @@ type BlockSplitterSimple struct {
 // round-up padding we do.
 func NewBlockSplitterSimple(desiredBlockSize int64,
 	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterSimple, error) {
+	blockSize := desiredBlockSize
 	// If the desired block size is exactly a power of 2, subtract one
 	// from it to account for the padding we will do, which rounds up
 	// when the encoded size is exactly a power of 2.
@@ -71,9 +75,68 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 	return &BlockSplitterSimple{
 		maxSize:                 maxSize,
 		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+		blockSize:               blockSize,
 	}, nil
 }
 
+// blockEncryptionOverhead bounds the number of bytes that padding
+// and encrypting an encoded block adds to it, beyond rounding it up
+// to a power of 2: the padding's length prefix, the encryption's
+// nonce and authenticator, and the encoding of the result.
+const blockEncryptionOverhead = 1024
+
+// blockSizeForServerMax returns the largest desired block size
+// whose blocks, once padded and encrypted, are no bigger than
+// serverMax bytes.
+func blockSizeForServerMax(serverMax int64) (int64, error) {
+	size := int64(minBlockSize)
+	if size+blockEncryptionOverhead > serverMax {
+		return 0, fmt.Errorf("The block server's max block size of %d "+
+			"bytes is too small", serverMax)
+	}
+	for 2*size+blockEncryptionOverhead <= serverMax {
+		size *= 2
+	}
+	return size, nil
+}
+
+// withServerMax returns a splitter like b whose blocks fit within
+// serverMax bytes once encrypted, or b itself if they already do or
+// if serverMax is 0.  The block size never grows back, which only
+// costs some efficiency if a server relaxes its limit.
+func (b *BlockSplitterSimple) withServerMax(
+	serverMax int64, codec Codec) (*BlockSplitterSimple, error) {
+	if serverMax == 0 || b.blockSize == 0 {
+		return b, nil
+	}
+	blockSize, err := blockSizeForServerMax(serverMax)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize >= b.blockSize {
+		return b, nil
+	}
+	return NewBlockSplitterSimple(
+		blockSize, b.blockChangeEmbedMaxSize, codec)
+}
+
+// maxContentsSize implements the blockSplitterServerLimited interface
+// for BlockSplitterSimple.
+func (b *BlockSplitterSimple) maxContentsSize() int64 {
+	return b.maxSize
+}
+
+// withServerMaxBlockSize implements the blockSplitterServerLimited
+// interface for BlockSplitterSimple.
+func (b *BlockSplitterSimple) withServerMaxBlockSize(
+	serverMax int64, codec Codec) (BlockSplitter, error) {
+	simple, err := b.withServerMax(serverMax, codec)
+	if err != nil {
+		return nil, err
+	}
+	return simple, nil
+}
+
 // CopyUntilSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CopyUntilSplit(
@@ -112,10 +175,27 @@ func (b *BlockSplitterSimple) CopyUntilSplit(
 	return toCopy
 }
 
+// SplitNoCopy implements the blockSplitterNoCopy interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) SplitNoCopy(currLen int64, data []byte) int64 {
+	n := int64(len(data))
+	if n > b.maxSize {
+		n = b.maxSize
+	}
+	if n < currLen {
+		return 0
+	}
+	return n
+}
+
 // CheckSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CheckSplit(block *FileBlock) int64 {
-	// The split will always be right
+	// The split will always be right, unless the block was written
+	// before the max size shrank to fit a block server.
+	if int64(len(block.Contents)) > b.maxSize {
+		return b.maxSize
+	}
 	return 0
 }
 
@@ -10,7 +10,7 @@ import (
 )
 
 func TestBsplitterEmptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	data := []byte{1, 2, 3, 4, 5}
 
@@ -22,7 +22,7 @@ func TestBsplitterEmptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterNonemptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -35,7 +35,7 @@ func TestBsplitterNonemptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterAppendAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -48,7 +48,7 @@ func TestBsplitterAppendAll(t *testing.T) {
 }
 
 func TestBsplitterAppendExact(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5}
@@ -62,7 +62,7 @@ func TestBsplitterAppendExact(t *testing.T) {
 }
 
 func TestBsplitterSplitOne(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -76,7 +76,7 @@ func TestBsplitterSplitOne(t *testing.T) {
 }
 
 func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
-	bsplit := &BlockSplitterSimple{5, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 5, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
@@ -89,7 +89,7 @@ func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
 }
 
 func TestBsplitterBlockTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{3, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 3, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -102,7 +102,7 @@ func TestBsplitterBlockTooBig(t *testing.T) {
 }
 
 func TestBsplitterOffTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -116,7 +116,7 @@ func TestBsplitterOffTooBig(t *testing.T) {
 }
 
 func TestBsplitterShouldEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 1
 	if !bsplit.ShouldEmbedBlockChanges(bc) {
@@ -129,7 +129,7 @@ func TestBsplitterShouldEmbed(t *testing.T) {
 }
 
 func TestBsplitterShouldNotEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 10}
+	bsplit := &BlockSplitterSimple{maxSize: 10, blockChangeEmbedMaxSize: 10}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 11
 	if bsplit.ShouldEmbedBlockChanges(bc) {
@@ -166,3 +166,73 @@ func TestBsplitterOverhead(t *testing.T) {
 			g, e)
 	}
 }
+
+func TestBsplitterWithServerMaxBlockSize(t *testing.T) {
+	codec := NewCodecMsgpack()
+	bsplit, err := NewBlockSplitterSimple(64*1024, 8*1024, codec)
+	if err != nil {
+		t.Fatalf("Got error making block splitter: %v", err)
+	}
+
+	// Servers without a limit, or with a looser one, don't change
+	// the splitter.
+	for _, serverMax := range []int64{0, 64*1024 + blockEncryptionOverhead,
+		1 << 20} {
+		s, err := bsplit.withServerMaxBlockSize(serverMax, codec)
+		if err != nil {
+			t.Fatalf("Got error fitting to %d bytes: %v", serverMax, err)
+		}
+		if s != bsplit {
+			t.Errorf("Splitter changed for a max block size of %d",
+				serverMax)
+		}
+	}
+
+	const serverMax = 20 * 1024
+	s, err := bsplit.withServerMaxBlockSize(serverMax, codec)
+	if err != nil {
+		t.Fatalf("Got error fitting to %d bytes: %v", serverMax, err)
+	}
+	shrunk := s.(*BlockSplitterSimple)
+	if shrunk.maxSize >= bsplit.maxSize {
+		t.Fatalf("Max size %d didn't shrink from %d", shrunk.maxSize,
+			bsplit.maxSize)
+	}
+	// Fitting again to the same limit is a no-op.
+	if s2, err := shrunk.withServerMaxBlockSize(serverMax, codec); err != nil {
+		t.Fatalf("Got error fitting again: %v", err)
+	} else if s2 != s {
+		t.Errorf("Splitter changed when fitted to the same limit")
+	}
+
+	// A full block must fit on the server once encrypted.
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, shrunk.maxSize)
+	for i := range block.Contents {
+		block.Contents[i] = byte(i)
+	}
+	crypto := makeTestCryptoCommon(t)
+	_, encryptedBlock, err := crypto.EncryptBlock(block, BlockCryptKey{})
+	if err != nil {
+		t.Fatalf("Encrypting block failed: %v", err)
+	}
+	buf, err := codec.Encode(encryptedBlock)
+	if err != nil {
+		t.Fatalf("Encoding block failed: %v", err)
+	}
+	if len(buf) > serverMax {
+		t.Errorf("Encrypted block of %d bytes is bigger than %d",
+			len(buf), serverMax)
+	}
+
+	// Blocks written before the splitter shrank get split.
+	block.Contents = make([]byte, bsplit.maxSize)
+	if splitAt := shrunk.CheckSplit(block); splitAt != shrunk.maxSize {
+		t.Errorf("Oversized block split at %d, not %d", splitAt,
+			shrunk.maxSize)
+	}
+
+	if _, err := bsplit.withServerMaxBlockSize(100, codec); err == nil {
+		t.Errorf("No error for a tiny max block size")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// blockCacheHandoffVersion is the current format version of
+	// the block cache handoff file.
+	blockCacheHandoffVersion = 1
+	// blockCacheHandoffFile is the name of the handoff file, in
+	// the write-back journal directory.
+	blockCacheHandoffFile = "cache_handoff"
+	// blockCacheHandoffMaxBytes caps how many bytes of blocks are
+	// handed over, so that shutting down stays quick.
+	blockCacheHandoffMaxBytes = 128 << 20
+)
+
+// blockCacheHandoff is the on-disk form of the clean blocks that a
+// process hands over to the next one.  Payload holds the encoded
+// []blockCacheHandoffEntry, and Hash is its hash.
+type blockCacheHandoff struct {
+	Version int
+	Hash    Hash
+	Payload []byte
+}
+
+// blockCacheHandoffEntry is a single handed-over block.  Tlf is only
+// set for blocks of pinned TLFs, so that they can go back into the
+// pinned partition.
+type blockCacheHandoffEntry struct {
+	ID   BlockID
+	Tlf  *TlfID `codec:",omitempty"`
+	Dir  bool   `codec:",omitempty"`
+	Data []byte
+}
+
+// blockCacheHandoffVersionError is returned when a handoff file was
+// written by a newer version of KBFS than this one.
+type blockCacheHandoffVersionError struct {
+	path    string
+	version int
+}
+
+func (e blockCacheHandoffVersionError) Error() string {
+	return fmt.Sprintf("block cache handoff %s has version %d, "+
+		"but only versions up to %d are supported",
+		e.path, e.version, blockCacheHandoffVersion)
+}
+
+// handoffEntries returns the clean transient blocks of the cache,
+// most recently used first, up to maxBytes worth of them.  Permanent
+// blocks aren't included, since they're still waiting to be put to
+// the server, and the write-back journal already covers them.
+func (b *BlockCacheStandard) handoffEntries(maxBytes uint64) (
+	entries []pinnedCacheEntry, ids []BlockID) {
+	var total uint64
+	add := func(id BlockID, entry pinnedCacheEntry) bool {
+		size := uint64(getCachedBlockSize(entry.block))
+		if total+size > maxBytes {
+			return false
+		}
+		total += size
+		entries = append(entries, entry)
+		ids = append(ids, id)
+		return true
+	}
+	// Keys() returns the oldest entries first.
+	addLRU := func(lru *simplelru.LRU, pinned bool) bool {
+		if lru == nil {
+			return true
+		}
+		keys := lru.Keys()
+		for i := len(keys) - 1; i >= 0; i-- {
+			tmp, ok := lru.Peek(keys[i])
+			if !ok {
+				continue
+			}
+			var entry pinnedCacheEntry
+			if pinned {
+				entry = tmp.(pinnedCacheEntry)
+			} else {
+				entry.block = tmp.(Block)
+			}
+			if !add(keys[i].(BlockID), entry) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// The metadata and pinned partitions go first, since those
+	// are the blocks most worth keeping.
+	b.metaLock.Lock()
+	ok := addLRU(b.cleanMetadata, false)
+	b.metaLock.Unlock()
+	if !ok {
+		return entries, ids
+	}
+	b.pinLock.Lock()
+	ok = addLRU(b.cleanPinned, true)
+	b.pinLock.Unlock()
+	if !ok {
+		return entries, ids
+	}
+	b.blockPinLock.Lock()
+	for id, entry := range b.pinnedBlocks {
+		if !add(id, entry) {
+			b.blockPinLock.Unlock()
+			return entries, ids
+		}
+	}
+	b.blockPinLock.Unlock()
+	b.transientLock.Lock()
+	defer b.transientLock.Unlock()
+	addLRU(b.cleanTransient, false)
+	return entries, ids
+}
+
+// writeBlockCacheHandoff writes the hottest clean blocks of config's
+// block cache to the write-back journal directory, so that the next
+// process to use the directory (usually an upgraded one) starts with
+// a warm cache.  It does nothing if there's no write-back journal
+// directory.  Blocks are content-addressed, so a handed-over block
+// never goes stale.
+func writeBlockCacheHandoff(config Config) error {
+	dir := config.WriteBackJournalDir()
+	if dir == "" {
+		return nil
+	}
+	bcache, ok := config.BlockCache().(*BlockCacheStandard)
+	if !ok {
+		return nil
+	}
+	codec := config.Codec()
+	cached, ids := bcache.handoffEntries(blockCacheHandoffMaxBytes)
+	entries := make([]blockCacheHandoffEntry, 0, len(cached))
+	for i, c := range cached {
+		data, err := codec.Encode(c.block)
+		if err != nil {
+			return err
+		}
+		entry := blockCacheHandoffEntry{ID: ids[i], Data: data}
+		if c.tlf != NullTlfID {
+			tlf := c.tlf
+			entry.Tlf = &tlf
+		}
+		_, entry.Dir = c.block.(*DirBlock)
+		entries = append(entries, entry)
+	}
+	payload, err := codec.Encode(entries)
+	if err != nil {
+		return err
+	}
+	h, err := DefaultHash(payload)
+	if err != nil {
+		return err
+	}
+	buf, err := codec.Encode(blockCacheHandoff{
+		Version: blockCacheHandoffVersion,
+		Hash:    h,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, blockCacheHandoffFile)
+	err = ioutil.WriteFile(path+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadBlockCacheHandoff puts the blocks handed over by the previous
+// process, if any, into config's block cache, and removes the
+// handoff file so that it's only loaded once.  It returns the number
+// of blocks loaded.  A handoff that's corrupted or from a newer
+// version of KBFS is removed without loading anything.
+func loadBlockCacheHandoff(config Config) (int, error) {
+	dir := config.WriteBackJournalDir()
+	if dir == "" {
+		return 0, nil
+	}
+	bcache, ok := config.BlockCache().(*BlockCacheStandard)
+	if !ok {
+		return 0, nil
+	}
+	path := filepath.Join(dir, blockCacheHandoffFile)
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+
+	codec := config.Codec()
+	var handoff blockCacheHandoff
+	err = codec.Decode(buf, &handoff)
+	if err != nil {
+		return 0, err
+	}
+	if handoff.Version > blockCacheHandoffVersion {
+		return 0, blockCacheHandoffVersionError{path, handoff.Version}
+	}
+	err = handoff.Hash.Verify(handoff.Payload)
+	if err != nil {
+		return 0, err
+	}
+	var entries []blockCacheHandoffEntry
+	err = codec.Decode(handoff.Payload, &entries)
+	if err != nil {
+		return 0, err
+	}
+	// Put the least recently used blocks first, so that they're
+	// the first to be evicted again.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		var block Block
+		if entry.Dir {
+			block = NewDirBlock()
+		} else {
+			block = NewFileBlock()
+		}
+		err = codec.Decode(entry.Data, block)
+		if err != nil {
+			return 0, err
+		}
+		block.SetEncodedSize(uint32(len(entry.Data)))
+		tlf := NullTlfID
+		if entry.Tlf != nil {
+			tlf = *entry.Tlf
+		}
+		// Don't go through Put, since the pointers needed for
+		// the hash -> pointer mapping aren't known.
+		bcache.putTransientEntry(entry.ID, tlf, block, true)
+	}
+	return len(entries), nil
+}
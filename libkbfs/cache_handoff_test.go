@@ -0,0 +1,112 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test that the blocks cached by one process are handed over to the
+// next one, and that a bad handoff is dropped.
+func TestBlockCacheHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cache_handoff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config1 := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config1)
+	config1.SetWriteBackJournalDir(dir)
+	tlf := FakeTlfID(1, false)
+	config1.BlockCache().SetPinnedTlfs(map[TlfID]bool{tlf: true}, 1<<20)
+
+	fileID := fakeBlockID(1)
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = []byte{1, 2, 3}
+	dirID := fakeBlockID(2)
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.Children["a"] = DirEntry{EntryInfo: EntryInfo{Size: 3}}
+	pinnedID := fakeBlockID(3)
+	pblock := NewFileBlock().(*FileBlock)
+	pblock.Contents = []byte{4, 5}
+	permID := fakeBlockID(4)
+	for _, p := range []struct {
+		id       BlockID
+		tlf      TlfID
+		block    Block
+		lifetime BlockCacheLifetime
+	}{
+		{fileID, FakeTlfID(2, false), fblock, TransientEntry},
+		{dirID, FakeTlfID(2, false), dblock, TransientEntry},
+		{pinnedID, tlf, pblock, TransientEntry},
+		{permID, tlf, NewFileBlock(), PermanentEntry},
+	} {
+		err = config1.BlockCache().Put(
+			BlockPointer{ID: p.id}, p.tlf, p.block, p.lifetime)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writeBlockCacheHandoff(config1))
+
+	config2 := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetWriteBackJournalDir(dir)
+	config2.BlockCache().SetPinnedTlfs(map[TlfID]bool{tlf: true}, 1<<20)
+	n, err := loadBlockCacheHandoff(config2)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = os.Stat(filepath.Join(dir, blockCacheHandoffFile))
+	require.True(t, os.IsNotExist(err))
+
+	block, err := config2.BlockCache().Get(BlockPointer{ID: fileID})
+	require.NoError(t, err)
+	require.Equal(t, fblock.Contents, block.(*FileBlock).Contents)
+	block, err = config2.BlockCache().Get(BlockPointer{ID: dirID})
+	require.NoError(t, err)
+	require.Equal(t, dblock.Children, block.(*DirBlock).Children)
+	_, ok := config2.BlockCache().(*BlockCacheStandard).getPinned(pinnedID)
+	require.True(t, ok)
+	// Permanent blocks are covered by the write-back journal.
+	testExpectedMissing(t, permID, config2.BlockCache())
+	// The handed-over blocks can't be used for deduplication,
+	// since their full pointers aren't known.
+	ptr, err := config2.BlockCache().CheckForKnownPtr(
+		FakeTlfID(2, false), fblock)
+	require.NoError(t, err)
+	require.Equal(t, BlockPointer{}, ptr)
+
+	// A corrupted handoff is dropped.
+	require.NoError(t, writeBlockCacheHandoff(config1))
+	path := filepath.Join(dir, blockCacheHandoffFile)
+	var handoff blockCacheHandoff
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, config1.Codec().Decode(buf, &handoff))
+	handoff.Payload[len(handoff.Payload)-1]++
+	buf, err = config1.Codec().Encode(handoff)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, buf, 0600))
+	config3 := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(t, config3)
+	config3.SetWriteBackJournalDir(dir)
+	_, err = loadBlockCacheHandoff(config3)
+	require.Error(t, err)
+	testExpectedMissing(t, fileID, config3.BlockCache())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// So is one from a newer version.
+	handoff.Version = blockCacheHandoffVersion + 1
+	buf, err = config1.Codec().Encode(handoff)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, buf, 0600))
+	_, err = loadBlockCacheHandoff(config3)
+	require.Equal(t,
+		blockCacheHandoffVersionError{path, blockCacheHandoffVersion + 1},
+		err)
+}
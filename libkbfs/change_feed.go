@@ -0,0 +1,214 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ChangeEvent describes a change to one file or directory, by its
+// full canonical path (e.g., "/keybase/private/alice/dir/file").
+type ChangeEvent struct {
+	Path string
+	// Entries holds the names of the entries added to, removed
+	// from, or renamed within a directory.
+	Entries []string `json:",omitempty"`
+	// Writes holds the ranges written to a file.  A zero Len is a
+	// truncate to Off.
+	Writes []WriteRange `json:",omitempty"`
+}
+
+// ChangeBatch is the list of changes made to one folder since the
+// previous batch, with at most one event per path.
+type ChangeBatch struct {
+	TlfID  string
+	Events []ChangeEvent
+}
+
+// changeBatchBuilder merges changes to one folder into a ChangeBatch.
+type changeBatchBuilder struct {
+	batch  ChangeBatch
+	byPath map[string]int
+}
+
+func (b *changeBatchBuilder) add(event ChangeEvent) {
+	i, ok := b.byPath[event.Path]
+	if !ok {
+		// Copy the slices, since they may be shared with other
+		// observers, and will be appended to.
+		event.Entries = append([]string(nil), event.Entries...)
+		event.Writes = append([]WriteRange(nil), event.Writes...)
+		b.byPath[event.Path] = len(b.batch.Events)
+		b.batch.Events = append(b.batch.Events, event)
+		return
+	}
+	merged := &b.batch.Events[i]
+outer:
+	for _, name := range event.Entries {
+		for _, old := range merged.Entries {
+			if old == name {
+				continue outer
+			}
+		}
+		merged.Entries = append(merged.Entries, name)
+	}
+	merged.Writes = append(merged.Writes, event.Writes...)
+}
+
+// ChangeSubscription collects path-level changes to a set of folders,
+// for an application watching them (see KBFSOps.WatchChanges).
+// Changes pile up, merged by folder and path, until the application
+// asks for them with Next, so a slow application never holds up KBFS.
+type ChangeSubscription struct {
+	unregister func()
+
+	lock    sync.Mutex
+	pending []*changeBatchBuilder
+	byTlf   map[TlfID]*changeBatchBuilder
+	closed  bool
+	readyCh chan struct{}
+}
+
+func newChangeSubscription() *ChangeSubscription {
+	return &ChangeSubscription{
+		byTlf:   make(map[TlfID]*changeBatchBuilder),
+		readyCh: make(chan struct{}, 1),
+	}
+}
+
+func (s *ChangeSubscription) add(tlf TlfID, events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	b, ok := s.byTlf[tlf]
+	if !ok {
+		b = &changeBatchBuilder{
+			batch:  ChangeBatch{TlfID: tlf.String()},
+			byPath: make(map[string]int),
+		}
+		s.byTlf[tlf] = b
+		s.pending = append(s.pending, b)
+	}
+	for _, event := range events {
+		b.add(event)
+	}
+	select {
+	case s.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until there are changes, and returns a batch for each
+// folder that has changed since the last call.  It returns io.EOF
+// once the subscription is closed.
+func (s *ChangeSubscription) Next(ctx context.Context) (
+	[]ChangeBatch, error) {
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return nil, io.EOF
+		}
+		if len(s.pending) > 0 {
+			batches := make([]ChangeBatch, 0, len(s.pending))
+			for _, b := range s.pending {
+				batches = append(batches, b.batch)
+			}
+			s.pending = nil
+			s.byTlf = make(map[TlfID]*changeBatchBuilder)
+			s.lock.Unlock()
+			return batches, nil
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.readyCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops the subscription, and makes any call to Next return.
+func (s *ChangeSubscription) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.pending = nil
+	s.byTlf = nil
+	s.lock.Unlock()
+
+	s.unregister()
+	select {
+	case s.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// canonicalNodePath returns the full canonical path of p.
+func canonicalNodePath(p path) string {
+	names := make([]string, 0, len(p.path))
+	names = append(names, buildCanonicalPath(
+		p.Tlf.IsPublic(), CanonicalTlfName(p.path[0].Name)))
+	for _, n := range p.path[1:] {
+		names = append(names, n.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// changeFeedObserver turns the changes an Observer sees in one folder
+// into ChangeEvents for a ChangeSubscription.
+type changeFeedObserver struct {
+	sub       *ChangeSubscription
+	tlf       TlfID
+	nodeCache NodeCache
+}
+
+var _ Observer = (*changeFeedObserver)(nil)
+
+// LocalChange implements the Observer interface for
+// changeFeedObserver.  Applications only hear about changes once
+// they've been synced.
+func (o *changeFeedObserver) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+}
+
+// BatchChanges implements the Observer interface for
+// changeFeedObserver.
+func (o *changeFeedObserver) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	events := make([]ChangeEvent, 0, len(changes))
+	for _, change := range changes {
+		p := o.nodeCache.PathFromNode(change.Node)
+		if !p.isValid() {
+			// Unlinked nodes no longer have a path.
+			continue
+		}
+		events = append(events, ChangeEvent{
+			Path:    canonicalNodePath(p),
+			Entries: change.DirUpdated,
+			Writes:  change.FileUpdated,
+		})
+	}
+	o.sub.add(o.tlf, events)
+}
+
+// TlfHandleChange implements the Observer interface for
+// changeFeedObserver.  Later events just use the folder's new path.
+func (o *changeFeedObserver) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+)
+
+// ChangeFeedServer serves path-level change notifications for
+// top-level folders to local applications, like sync tools and
+// editors, over HTTP.  A GET of /changes, with one or more tlf
+// parameters holding folder IDs, returns a stream of newline-separated
+// JSON lists of ChangeBatches, written as the folders change.
+//
+// Since the changes reveal the names of private files, every request
+// must also carry the server's random token, which is only handed out
+// as part of the URL returned by SubscribeURL.
+type ChangeFeedServer struct {
+	config   Config
+	log      logger.Logger
+	listener net.Listener
+	token    string
+
+	lock sync.Mutex
+	// subs holds the subscriptions of the requests being served,
+	// so they can be ended on shutdown; it's nil once shut down.
+	subs map[*ChangeSubscription]bool
+}
+
+var _ ChangeFeed = (*ChangeFeedServer)(nil)
+
+// NewChangeFeedServer starts serving changes on the given address
+// (e.g., "127.0.0.1:0").
+func NewChangeFeedServer(config Config, addr string) (
+	*ChangeFeedServer, error) {
+	token, err := MakeRandomRequestID()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ChangeFeedServer{
+		config:   config,
+		log:      config.MakeLogger(""),
+		listener: listener,
+		token:    token,
+		subs:     make(map[*ChangeSubscription]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changes", s.serveChanges)
+	go func() {
+		// Serve only returns once the listener is closed.
+		err := http.Serve(listener, mux)
+		s.log.CDebugf(nil, "Change feed on %s stopped: %v", s.Addr(), err)
+	}()
+	return s, nil
+}
+
+func (s *ChangeFeedServer) serveChanges(
+	w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare(
+		[]byte(r.FormValue("token")), []byte(s.token)) != 1 {
+		http.Error(w, "Bad token", http.StatusForbidden)
+		return
+	}
+	var tlfIDs []TlfID
+	for _, str := range r.Form["tlf"] {
+		tlf, err := ParseTlfID(str)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tlfIDs = append(tlfIDs, tlf)
+	}
+	if len(tlfIDs) == 0 {
+		http.Error(w, "No folders given", http.StatusBadRequest)
+		return
+	}
+
+	sub, err := s.config.Notifier().WatchChanges(tlfIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+	if !s.addSub(sub) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.removeSub(sub)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	ctx := r.Context()
+	enc := json.NewEncoder(w)
+	for {
+		batches, err := sub.Next(ctx)
+		if err != nil {
+			s.log.CDebugf(ctx, "Change feed for %v ended: %v", tlfIDs, err)
+			return
+		}
+		// Encode writes a newline after each list.
+		if err := enc.Encode(batches); err != nil {
+			s.log.CDebugf(ctx, "Couldn't send changes to %s: %v",
+				r.RemoteAddr, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *ChangeFeedServer) addSub(sub *ChangeSubscription) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subs == nil {
+		return false
+	}
+	s.subs[sub] = true
+	return true
+}
+
+func (s *ChangeFeedServer) removeSub(sub *ChangeSubscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subs, sub)
+}
+
+// Addr implements the ChangeFeed interface for ChangeFeedServer.
+func (s *ChangeFeedServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// SubscribeURL implements the ChangeFeed interface for
+// ChangeFeedServer.
+func (s *ChangeFeedServer) SubscribeURL(tlfIDs ...TlfID) string {
+	params := url.Values{"token": {s.token}}
+	for _, tlf := range tlfIDs {
+		params.Add("tlf", tlf.String())
+	}
+	return fmt.Sprintf("http://%s/changes?%s", s.Addr(), params.Encode())
+}
+
+// Shutdown implements the ChangeFeed interface for ChangeFeedServer.
+func (s *ChangeFeedServer) Shutdown() {
+	s.listener.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for sub := range s.subs {
+		sub.Close()
+	}
+	s.subs = nil
+}
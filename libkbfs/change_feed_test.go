@@ -0,0 +1,155 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestChangeSubscriptionMerges(t *testing.T) {
+	sub := newChangeSubscription()
+	sub.unregister = func() {}
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+
+	sub.add(tlf1, []ChangeEvent{{Path: "/keybase/private/a",
+		Entries: []string{"x"}}})
+	sub.add(tlf2, []ChangeEvent{{Path: "/keybase/private/b/f",
+		Writes: []WriteRange{{Off: 0, Len: 10}}}})
+	sub.add(tlf1, []ChangeEvent{
+		{Path: "/keybase/private/a", Entries: []string{"x", "y"}},
+		{Path: "/keybase/private/a/z"},
+	})
+	sub.add(tlf2, []ChangeEvent{{Path: "/keybase/private/b/f",
+		Writes: []WriteRange{{Off: 5}}}})
+
+	ctx := context.Background()
+	batches, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ChangeBatch{
+		{TlfID: tlf1.String(), Events: []ChangeEvent{
+			{Path: "/keybase/private/a", Entries: []string{"x", "y"}},
+			{Path: "/keybase/private/a/z"},
+		}},
+		{TlfID: tlf2.String(), Events: []ChangeEvent{
+			{Path: "/keybase/private/b/f",
+				Writes: []WriteRange{{Off: 0, Len: 10}, {Off: 5}}},
+		}},
+	}, batches)
+
+	// Nothing's left, so Next waits.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = sub.Next(timeoutCtx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	sub.Close()
+	_, err = sub.Next(ctx)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestKBFSOpsWatchChanges(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+
+	// Watch from another device.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fb := rootNode2.GetFolderBranch()
+	sub, err := config2.Notifier().WatchChanges([]TlfID{fb.Tlf})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	batches, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []ChangeBatch{{TlfID: fb.Tlf.String(), Events: []ChangeEvent{
+		{Path: "/keybase/private/alice", Entries: []string{"a"}},
+	}}}, batches)
+
+	// Writes are reported for files this device knows about.
+	_, _, err = config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	batches, err = sub.Next(ctx)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	events := make(map[string]ChangeEvent)
+	for _, event := range batches[0].Events {
+		events[event.Path] = event
+	}
+	require.Contains(t, events["/keybase/private/alice/a"].Writes,
+		WriteRange{Off: 0, Len: 3})
+
+	// Once the subscription is closed, it stops getting changes.
+	sub.Close()
+	err = kbfsOps.Write(ctx, fileNode, []byte{4}, 3)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = config2.KBFSOps().SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	_, err = sub.Next(ctx)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestChangeFeedServer(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	tlf := rootNode.GetFolderBranch().Tlf
+
+	feed, err := NewChangeFeedServer(config, "127.0.0.1:0")
+	require.NoError(t, err)
+	config.SetChangeFeed(feed)
+
+	url := feed.SubscribeURL(tlf)
+	resp, err := http.Get(strings.Replace(url, "token=", "token=x", 1))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, _, err = config.KBFSOps().CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	require.NoError(t, err)
+	var batches []ChangeBatch
+	err = json.Unmarshal(line, &batches)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, tlf.String(), batches[0].TlfID)
+	require.Equal(t, ChangeEvent{
+		Path:    "/keybase/private/alice",
+		Entries: []string{"d"},
+	}, batches[0].Events[0])
+}
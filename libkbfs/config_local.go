@@ -22,19 +22,37 @@ const (
 	maxFileBytesDefault = 2 * 1024 * 1024 * 1024
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
-	// Maximum supported plaintext size of a directory in KBFS. TODO:
-	// increase this once we support levels of indirection for
-	// directories.
-	maxDirBytesDefault = MaxBlockSizeBytesDefault
+	// Maximum supported plaintext size of a directory in KBFS.
+	maxDirBytesDefault = 512 * 1024 * 1024
+	// Maximum supported number of entries in a directory.
+	maxDirEntriesDefault = 1024 * 1024
+	// Maximum number of entries, or indirect pointers, in each block
+	// of a directory that's split across several blocks.
+	maxDirEntriesPerBlockDefault = 1024
 	// Default time after setting the rekey bit before prompting for a
 	// paper key.
 	rekeyWithPromptWaitTimeDefault = 10 * time.Minute
+	// Default age at which unsynced changes to a file are synced,
+	// no matter how full the dirty buffer is.
+	maxDirtyAgeDefault = 30 * time.Second
 	// How often do we check for stuff to reclaim?
 	qrPeriodDefault = 1 * time.Minute
 	// How long must something be unreferenced before we reclaim it?
 	qrUnrefAgeDefault = 1 * time.Minute
 	// tlfValidDurationDefault is the default for tlf validity before redoing identify.
 	tlfValidDurationDefault = 6 * time.Hour
+	// blockPutsPerHostDefault is the default limit on concurrent
+	// block uploads to a single block server.
+	blockPutsPerHostDefault = 2 * maxParallelBlockPuts
+	// Cache sizes used in InitReadOnlyReplica mode, where a single
+	// process serves reads of many folders and has no dirty data.
+	replicaMDCacheEntries    = 50000
+	replicaBlockCacheEntries = 100000
+	replicaBlockCacheBytes   = MaxBlockSizeBytesDefault * 4096
+	// A 1/blockCacheMetadataPartitionDivisor share of the block
+	// cache's bytes is reserved for directory and indirect file
+	// blocks.
+	blockCacheMetadataPartitionDivisor = 10
 )
 
 // ConfigLocal implements the Config interface using purely local
@@ -44,6 +62,7 @@ type ConfigLocal struct {
 	kbfs        KBFSOps
 	keyman      KeyManager
 	rep         Reporter
+	eventBus    EventBus
 	kcache      KeyCache
 	bcache      BlockCache
 	dirtyBcache DirtyBlockCache
@@ -62,16 +81,30 @@ type ConfigLocal struct {
 	clock       Clock
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	merger      MergeStrategy
+	deletions   DeletionPolicy
+	anomalies   AnomalyDetector
 	registry    metrics.Registry
+	exporter    MetricsExporter
+	spanExp     SpanExporter
+	changeFeed  ChangeFeed
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
 	rwpWaitTime time.Duration
+	maxDirtyAge time.Duration
+
+	writeCoalesceWindow  time.Duration
+	integrityCheckPeriod time.Duration
+	resolveCache         ResolveCache
 
 	maxFileBytes uint64
 	maxNameBytes uint32
 	maxDirBytes  uint64
 	rekeyQueue   RekeyQueue
 
+	maxDirEntries         int
+	maxDirEntriesPerBlock int
+
 	qrPeriod   time.Duration
 	qrUnrefAge time.Duration
 
@@ -81,6 +114,25 @@ type ConfigLocal struct {
 
 	// tlfValidDuration is the time TLFs are valid before redoing identification.
 	tlfValidDuration time.Duration
+
+	mode InitMode
+
+	blockGetsPerTlf  int
+	blockPutWorkers  int
+	blockPutsPerHost int
+	mdWritesPerMin   int
+	bEncodings       []BlockTransportEncoding
+	rpcDeadlines     RPCDeadlinePolicy
+	retryPolicy      RetryPolicy
+	faultPolicy      FaultPolicy
+	bandwidth        BandwidthScheduler
+	cdc              bool
+	kvStoreBackend   KVStoreBackend
+	bcacheAdmission  bool
+	bcacheSizer      *blockCacheAutoSizer
+	writeFairness    bool
+	writeBackDir     string
+	writeBackLimits  WriteBackJournalLimits
 }
 
 var _ Config = (*ConfigLocal)(nil)
@@ -190,17 +242,22 @@ func NewConfigLocal() *ConfigLocal {
 	config := &ConfigLocal{}
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
+	config.SetEventBus(NewEventBusStandard(config))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
 	config.ResetCaches()
 	config.SetCodec(NewCodecMsgpack())
 	config.SetBlockOps(&BlockOpsStandard{config})
 	config.SetKeyOps(&KeyOpsStandard{config})
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
+	config.SetBandwidthScheduler(NewBandwidthSchedulerStandard(config))
 
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirEntries = maxDirEntriesDefault
+	config.maxDirEntriesPerBlock = maxDirEntriesPerBlockDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
+	config.maxDirtyAge = maxDirtyAgeDefault
 
 	config.qrPeriod = qrPeriodDefault
 	config.qrUnrefAge = qrUnrefAgeDefault
@@ -213,6 +270,12 @@ func NewConfigLocal() *ConfigLocal {
 
 	config.tlfValidDuration = tlfValidDurationDefault
 
+	config.blockGetsPerTlf = maxParallelBlockGets
+	config.blockPutWorkers = maxParallelBlockPuts
+	config.blockPutsPerHost = blockPutsPerHostDefault
+	config.rpcDeadlines = DefaultRPCDeadlinePolicy()
+	config.retryPolicy = DefaultRetryPolicy()
+
 	return config
 }
 
@@ -272,6 +335,20 @@ func (c *ConfigLocal) SetReporter(r Reporter) {
 	c.rep = r
 }
 
+// EventBus implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) EventBus() EventBus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.eventBus
+}
+
+// SetEventBus implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetEventBus(eb EventBus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.eventBus = eb
+}
+
 // KeyCache implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) KeyCache() KeyCache {
 	c.lock.RLock()
@@ -511,19 +588,106 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// MergeStrategy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MergeStrategy() MergeStrategy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetMergeStrategy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMergeStrategy(ms MergeStrategy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = ms
+}
+
+// DeletionPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DeletionPolicy() DeletionPolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.deletions
+}
+
+// SetDeletionPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDeletionPolicy(dp DeletionPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deletions = dp
+}
+
+// AnomalyDetector implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) AnomalyDetector() AnomalyDetector {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.anomalies
+}
+
+// SetAnomalyDetector implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetAnomalyDetector(ad AnomalyDetector) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.anomalies = ad
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
-	return InitialExtraMetadataVer
+	return FolderFeaturesMetadataVer
 }
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return FilesWithHolesDataVer
+	return IndirectDirsDataVer
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DoBackgroundFlushes() bool {
-	return !c.noBGFlush
+	// Read-only instances never have anything to flush.
+	return !c.noBGFlush && !c.Mode().IsReadOnly()
+}
+
+// MaxDirtyAge implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirtyAge() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxDirtyAge
+}
+
+// SetMaxDirtyAge implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMaxDirtyAge(age time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxDirtyAge = age
+}
+
+// WriteCoalesceWindow implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) WriteCoalesceWindow() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeCoalesceWindow
+}
+
+// SetWriteCoalesceWindow implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetWriteCoalesceWindow(window time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeCoalesceWindow = window
+}
+
+// IntegrityCheckPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) IntegrityCheckPeriod() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.integrityCheckPeriod
+}
+
+// SetIntegrityCheckPeriod implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetIntegrityCheckPeriod(period time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.integrityCheckPeriod = period
 }
 
 // RekeyWithPromptWaitTime implements the Config interface for
@@ -562,14 +726,52 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
 }
 
+// MaxDirEntries implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirEntries() int {
+	return c.maxDirEntries
+}
+
+// MaxDirEntriesPerBlock implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxDirEntriesPerBlock() int {
+	return c.maxDirEntriesPerBlock
+}
+
 // ResetCaches implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ResetCaches() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.mdcache = NewMDCacheStandard(5000)
+	var bcache *BlockCacheStandard
+	var bcacheBytes uint64
+	if c.mode == InitReadOnlyReplica {
+		// Replicas are shared by many readers across many
+		// folders, so trade memory for fewer server round trips.
+		c.mdcache = NewMDCacheStandard(replicaMDCacheEntries)
+		bcacheBytes = replicaBlockCacheBytes
+		bcache = NewBlockCacheStandard(
+			c, replicaBlockCacheEntries, bcacheBytes)
+	} else {
+		c.mdcache = NewMDCacheStandard(5000)
+		// Limit the block cache to 10K entries or 1024 blocks
+		// (currently 512MiB)
+		bcacheBytes = MaxBlockSizeBytesDefault * 1024
+		bcache = NewBlockCacheStandard(c, 10000, bcacheBytes)
+	}
+	if c.registry != nil {
+		bcache.registerMetrics(c.registry)
+	}
+	// Keep directory browsing fast while large files are read.
+	bcache.EnableMetadataPartition(
+		bcacheBytes / blockCacheMetadataPartitionDivisor)
+	if c.bcacheAdmission {
+		bcache.EnableAdmissionControl(c.registry)
+	}
+	if c.bcacheSizer != nil {
+		if entries, bytes, ok := c.bcacheSizer.limits(); ok {
+			bcache.SetCacheLimits(entries, bytes)
+		}
+	}
+	c.bcache = bcache
 	c.kcache = NewKeyCacheStandard(5000)
-	// Limit the block cache to 10K entries or 1024 blocks (currently 512MiB)
-	c.bcache = NewBlockCacheStandard(c, 10000, MaxBlockSizeBytesDefault*1024)
 	minFactor := 1
 	if maxParallelBlockPuts > 10 {
 		minFactor = maxParallelBlockPuts / 10
@@ -592,8 +794,15 @@ func (c *ConfigLocal) ResetCaches() {
 	// defaults).
 	maxSyncBufferSize :=
 		int64(MaxBlockSizeBytesDefault * maxParallelBlockPuts * 2)
-	c.dirtyBcache = NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
+	dirtyBcache := NewDirtyBlockCacheStandard(c.clock, c.MakeLogger,
 		minSyncBufferSize, maxSyncBufferSize)
+	if c.writeFairness {
+		dirtyBcache.EnablePerWriterFairness()
+	}
+	if c.registry != nil {
+		dirtyBcache.registerMetrics(c.registry)
+	}
+	c.dirtyBcache = dirtyBcache
 }
 
 // MakeLogger implements the Config interface for ConfigLocal.
@@ -654,6 +863,62 @@ func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
 	c.registry = r
 }
 
+// MetricsExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MetricsExporter() MetricsExporter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.exporter
+}
+
+// SetMetricsExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMetricsExporter(e MetricsExporter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.exporter = e
+}
+
+// SpanExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SpanExporter() SpanExporter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.spanExp
+}
+
+// SetSpanExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetSpanExporter(e SpanExporter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.spanExp = e
+}
+
+// ChangeFeed implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ChangeFeed() ChangeFeed {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.changeFeed
+}
+
+// SetChangeFeed implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetChangeFeed(f ChangeFeed) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.changeFeed = f
+}
+
+// ResolveCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ResolveCache() ResolveCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.resolveCache
+}
+
+// SetResolveCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetResolveCache(rc ResolveCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.resolveCache = rc
+}
+
 // SetTLFValidDuration implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetTLFValidDuration(r time.Duration) {
 	c.tlfValidDuration = r
@@ -664,6 +929,273 @@ func (c *ConfigLocal) TLFValidDuration() time.Duration {
 	return c.tlfValidDuration
 }
 
+// Mode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Mode() InitMode {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mode
+}
+
+// SetMode implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMode(mode InitMode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mode = mode
+}
+
+// WriteBackJournalDir implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) WriteBackJournalDir() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeBackDir
+}
+
+// SetWriteBackJournalDir implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetWriteBackJournalDir(dir string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeBackDir = dir
+}
+
+// WriteBackJournalLimits implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) WriteBackJournalLimits() WriteBackJournalLimits {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeBackLimits
+}
+
+// SetWriteBackJournalLimits implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetWriteBackJournalLimits(
+	limits WriteBackJournalLimits) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeBackLimits = limits
+}
+
+// BlockGetsPerFolder implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockGetsPerFolder() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockGetsPerTlf
+}
+
+// SetBlockGetsPerFolder implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockGetsPerFolder(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockGetsPerTlf = n
+}
+
+// BlockPutWorkers implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockPutWorkers() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockPutWorkers
+}
+
+// SetBlockPutWorkers implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockPutWorkers(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockPutWorkers = n
+}
+
+// BlockPutsPerHost implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockPutsPerHost() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockPutsPerHost
+}
+
+// SetBlockPutsPerHost implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockPutsPerHost(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockPutsPerHost = n
+}
+
+// MDWritesPerMinute implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MDWritesPerMinute() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mdWritesPerMin
+}
+
+// SetMDWritesPerMinute implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetMDWritesPerMinute(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mdWritesPerMin = n
+}
+
+// BlockTransportEncodings implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) BlockTransportEncodings() []BlockTransportEncoding {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bEncodings
+}
+
+// SetBlockTransportEncodings implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockTransportEncodings(
+	encodings []BlockTransportEncoding) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bEncodings = encodings
+}
+
+// RPCDeadlinePolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) RPCDeadlinePolicy() RPCDeadlinePolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.rpcDeadlines
+}
+
+// SetRPCDeadlinePolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetRPCDeadlinePolicy(policy RPCDeadlinePolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rpcDeadlines = policy
+}
+
+// RetryPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) RetryPolicy() RetryPolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.retryPolicy
+}
+
+// SetRetryPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetRetryPolicy(policy RetryPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.retryPolicy = policy
+}
+
+// FaultPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) FaultPolicy() FaultPolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.faultPolicy
+}
+
+// SetFaultPolicy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetFaultPolicy(policy FaultPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.faultPolicy = policy
+}
+
+// BandwidthScheduler implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BandwidthScheduler() BandwidthScheduler {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bandwidth
+}
+
+// SetBandwidthScheduler implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBandwidthScheduler(b BandwidthScheduler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bandwidth = b
+}
+
+// ContentDefinedChunking implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ContentDefinedChunking() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cdc
+}
+
+// SetContentDefinedChunking implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetContentDefinedChunking(cdc bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cdc = cdc
+}
+
+// KVStoreBackend implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) KVStoreBackend() KVStoreBackend {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.kvStoreBackend
+}
+
+// SetKVStoreBackend implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetKVStoreBackend(b KVStoreBackend) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.kvStoreBackend = b
+}
+
+// BlockCacheAdmission implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockCacheAdmission() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bcacheAdmission
+}
+
+// SetBlockCacheAdmission implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockCacheAdmission(admission bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bcacheAdmission = admission
+}
+
+// BlockCacheAutoSize implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockCacheAutoSize() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bcacheSizer != nil
+}
+
+// SetBlockCacheAutoSize implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockCacheAutoSize(autoSize bool) {
+	c.lock.Lock()
+	sizer := c.bcacheSizer
+	c.bcacheSizer = nil
+	c.lock.Unlock()
+	if sizer != nil {
+		sizer.shutdown()
+	}
+	if !autoSize {
+		return
+	}
+
+	sizer = newBlockCacheAutoSizer(c, getSystemMemory)
+	if err := sizer.start(); err != nil {
+		c.MakeLogger("").Warning(
+			"Keeping the fixed block cache limits: %v", err)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bcacheSizer = sizer
+}
+
+// PerFileWriteFairness implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) PerFileWriteFairness() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writeFairness
+}
+
+// SetPerFileWriteFairness implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetPerFileWriteFairness(fairness bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeFairness = fairness
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown() error {
 	c.RekeyQueue().Clear()
@@ -690,16 +1222,32 @@ func (c *ConfigLocal) Shutdown() error {
 		errors = append(errors, err)
 		// Continue with shutdown regardless of err.
 	}
+	// Now that every folder is shut down, hand the cache over to
+	// the next process along with the write-back journals.
+	err = writeBlockCacheHandoff(c)
+	if err != nil {
+		errors = append(errors, err)
+	}
 	c.MDServer().Shutdown()
 	c.KeyServer().Shutdown()
 	c.KeybaseDaemon().Shutdown()
 	c.BlockServer().Shutdown()
 	c.Crypto().Shutdown()
 	c.Reporter().Shutdown()
+	if e := c.MetricsExporter(); e != nil {
+		e.Shutdown()
+	}
+	if f := c.ChangeFeed(); f != nil {
+		f.Shutdown()
+	}
+	if rc := c.ResolveCache(); rc != nil {
+		rc.Shutdown()
+	}
 	err = c.DirtyBlockCache().Shutdown()
 	if err != nil {
 		errors = append(errors, err)
 	}
+	c.SetBlockCacheAutoSize(false)
 
 	if len(errors) == 1 {
 		return errors[0]
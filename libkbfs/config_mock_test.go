@@ -76,6 +76,7 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetKeyManager(config.mockKeyman)
 	config.mockRep = NewMockReporter(c)
 	config.SetReporter(config.mockRep)
+	config.SetEventBus(NewEventBusStandard(config))
 	config.mockMdcache = NewMockMDCache(c)
 	config.SetMDCache(config.mockMdcache)
 	config.mockKcache = NewMockKeyCache(c)
@@ -103,6 +104,8 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.mockKserv = NewMockKeyServer(c)
 	config.SetKeyServer(config.mockKserv)
 	config.mockBserv = NewMockBlockServer(c)
+	config.mockBserv.EXPECT().Capabilities(gomock.Any()).
+		AnyTimes().Return(BlockServerCapabilities{}, nil)
 	config.SetBlockServer(config.mockBserv)
 	config.mockBsplit = NewMockBlockSplitter(c)
 	config.SetBlockSplitter(config.mockBsplit)
@@ -123,7 +126,10 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxDirEntries = maxDirEntriesDefault
+	config.maxDirEntriesPerBlock = maxDirEntriesPerBlockDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
+	config.maxDirtyAge = maxDirtyAgeDefault
 
 	config.qrPeriod = 0 * time.Second // no auto reclamation
 	config.qrUnrefAge = qrUnrefAgeDefault
@@ -1799,7 +1799,7 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 		newPtr = BlockPointer{
 			ID:      newID,
 			KeyGen:  md.LatestKeyGeneration(),
-			DataVer: cr.config.DataVersion(),
+			DataVer: fblock.DataVersion(),
 			BlockContext: BlockContext{
 				Creator:  uid,
 				RefNonce: zeroBlockRefNonce,
@@ -2537,6 +2537,54 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 	return bps, nil
 }
 
+// liveSplitDirPtrs returns the leaf and indirect blocks of the split
+// directories that the resolution in md either writes itself, or
+// keeps as is from the unmerged branch.  refs holds the pointers
+// referenced by md's ops.
+func (cr *ConflictResolver) liveSplitDirPtrs(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState,
+	refs map[BlockPointer]bool, unmergedChains *crChains) (
+	map[BlockPointer]bool, error) {
+	live := make(map[BlockPointer]bool)
+	// The indirect blocks of a directory are always rewritten, so
+	// the blocks being put already point to all of the leaves.
+	for _, bs := range bps.blockStates {
+		if dblock, ok := bs.block.(*DirBlock); ok {
+			for _, iptr := range dblock.IPtrs {
+				live[iptr.BlockPointer] = true
+			}
+		}
+	}
+	// Directories created on the unmerged branch can be kept
+	// without being rewritten.
+	for ptr := range refs {
+		if unmergedChains.byMostRecent[ptr] == nil {
+			continue
+		}
+		block, err := cr.fbo.blocks.GetBlockForReading(ctx, lState, md, ptr,
+			cr.fbo.branch())
+		if err != nil {
+			return nil, err
+		}
+		dblock, ok := block.(*DirBlock)
+		if !ok || !dblock.IsInd {
+			continue
+		}
+		leaves, indirect, err := cr.fbo.blocks.GetDirLeafPtrs(
+			ctx, lState, md, dblock, cr.fbo.branch())
+		if err != nil {
+			return nil, err
+		}
+		for _, leaf := range leaves {
+			live[leaf.BlockPointer] = true
+		}
+		for _, info := range indirect {
+			live[info.BlockPointer] = true
+		}
+	}
+	return live, nil
+}
+
 // calculateResolutionBytes figured out how many bytes are referenced
 // and unreferenced in the merged branch by this resolution.  It
 // should be called before the block changes are unembedded in md.
@@ -2577,8 +2625,14 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 		}
 	}
 
+	splitDirPtrs, err := cr.liveSplitDirPtrs(
+		ctx, lState, md, bps, refs, unmergedChains)
+	if err != nil {
+		return err
+	}
+
 	// Add bytes for every ref'd block.
-	var err error
+	var droppedRefs []BlockPointer
 	for ptr := range refs {
 		block, ok := localBlocks[ptr]
 		if !ok {
@@ -2599,12 +2653,50 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 			}
 		}
 
+		// Split directory blocks referenced by the unmerged ops
+		// don't survive the resolution unless they're still part
+		// of a directory.
+		if _, ok := block.(*DirBlock); ok &&
+			unmergedChains.refPointers[ptr] && !splitDirPtrs[ptr] {
+			droppedRefs = append(droppedRefs, ptr)
+			continue
+		}
+
 		cr.log.CDebugf(ctx, "Ref'ing block %v", ptr)
 		size := uint64(block.GetEncodedSize())
 		md.RefBytes += size
 		md.DiskUsage += size
 	}
 
+	for _, ptr := range droppedRefs {
+		cr.log.CDebugf(ctx, "Dropping ref to unmerged block %v", ptr)
+		delete(refs, ptr)
+		for _, op := range md.data.Changes.Ops {
+			op.DelRefBlock(ptr)
+		}
+	}
+
+	// Conversely, split directory blocks from the unmerged branch
+	// that are still part of a directory might have lost their refs
+	// when their ops were collapsed, so reference those again.
+	for ptr := range splitDirPtrs {
+		if refs[ptr] || !unmergedChains.refPointers[ptr] {
+			continue
+		}
+		block, err := cr.fbo.blocks.GetBlockForReading(ctx, lState, md, ptr,
+			cr.fbo.branch())
+		if err != nil {
+			return err
+		}
+
+		cr.log.CDebugf(ctx, "Ref'ing kept unmerged block %v", ptr)
+		refs[ptr] = true
+		md.data.Changes.Ops[len(md.data.Changes.Ops)-1].AddRefBlock(ptr)
+		size := uint64(block.GetEncodedSize())
+		md.RefBytes += size
+		md.DiskUsage += size
+	}
+
 	// Subtract bytes for every unref'd block that wasn't created in
 	// the unmerged branch
 	for ptr := range unrefs {
@@ -2612,7 +2704,8 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 		if !ok {
 			original = ptr
 		}
-		if original != ptr || unmergedChains.isCreated(original) {
+		if original != ptr || unmergedChains.isCreated(original) ||
+			unmergedChains.refPointers[ptr] {
 			// Only unref pointers that weren't created as part of the
 			// unmerged branch.  Either they existed already or they
 			// were created as part of the merged branch.
@@ -2648,6 +2741,14 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 			toUnref[ptr] = true
 		}
 	}
+	for ptr := range unmergedChains.refPointers {
+		// Blocks like the leaves of indirect files and directories
+		// aren't in any chain, so catch the dropped ones here.
+		// Skip any that the merged branch references too.
+		if !refs[ptr] && !unrefs[ptr] && !mergedChains.refPointers[ptr] {
+			toUnref[ptr] = true
+		}
+	}
 	for ptr := range unmergedChains.createdOriginals {
 		if !refs[ptr] && !unrefs[ptr] && unmergedChains.byOriginal[ptr] != nil {
 			toUnref[ptr] = true
@@ -3151,10 +3252,19 @@ func (e CRWrapError) Error() string {
 
 func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	cr.log.CDebugf(ctx, "Starting conflict resolution with input %v", ci)
+	cr.config.EventBus().Publish(Event{
+		Kind:         EventCRStarted,
+		FolderBranch: cr.fbo.folderBranch,
+	})
 	var err error
 	lState := makeFBOLockState()
 	defer func() {
 		cr.log.CDebugf(ctx, "Finished conflict resolution: %v", err)
+		cr.config.EventBus().Publish(Event{
+			Kind:         EventCRFinished,
+			FolderBranch: cr.fbo.folderBranch,
+			Err:          err,
+		})
 		if err != nil {
 			handle := cr.fbo.getHead(lState).GetTlfHandle()
 			cr.config.Reporter().ReportErr(ctx,
@@ -3226,11 +3336,14 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// actions contains the logic needed to manipulate the data into
 	// the final merged state, including the resolution of any
 	// conflicts that occurred between the two branches.
+	merges := cr.findFileMerges(
+		ctx, unmergedChains, mergedChains, mergedPaths)
 	actionMap, newUnmergedPaths, err := cr.computeActions(ctx, unmergedChains,
 		mergedChains, mergedPaths, recOps)
 	if err != nil {
 		return
 	}
+	merges = matchFileMerges(merges, actionMap)
 
 	// Insert the new unmerged paths as needed
 	if len(newUnmergedPaths) > 0 {
@@ -3291,6 +3404,11 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		return
 	}
 
+	// Step 5: now that the folder is merged again, try to merge
+	// the contents of any files written on both branches, so their
+	// conflicted copies aren't needed.
+	cr.mergeFiles(ctx, lState, merges)
+
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
 	// don't count against the quota forever.  (Though of course if we
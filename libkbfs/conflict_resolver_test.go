@@ -22,7 +22,8 @@ func crTestInit(t *testing.T) (mockCtrl *gomock.Controller, config *ConfigMock,
 	config = NewConfigMock(mockCtrl, ctr)
 	config.SetCodec(NewCodecMsgpack())
 	id := FakeTlfID(1, false)
-	fbo := newFolderBranchOps(config, FolderBranch{id, MasterBranch}, standard)
+	fbo := newFolderBranchOps(
+		config, FolderBranch{id, MasterBranch}, standard, nil)
 	// usernames don't matter for these tests
 	config.mockKbpki.EXPECT().GetNormalizedUsername(gomock.Any(), gomock.Any()).
 		AnyTimes().Return(libkb.NormalizedUsername("mockUser"), nil)
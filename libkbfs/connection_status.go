@@ -21,12 +21,14 @@ func (errDisconnected) Error() string { return "Disconnected" }
 type kbfsCurrentStatus struct {
 	lock            sync.Mutex
 	failingServices map[string]error
+	retryStatus     map[string]RetryStatus
 	invalidateChan  chan StatusUpdate
 }
 
 // Init inits the kbfsCurrentStatus.
 func (kcs *kbfsCurrentStatus) Init() {
 	kcs.failingServices = map[string]error{}
+	kcs.retryStatus = map[string]RetryStatus{}
 	kcs.invalidateChan = make(chan StatusUpdate)
 }
 
@@ -42,8 +44,11 @@ func (kcs *kbfsCurrentStatus) CurrentStatus() (map[string]error, chan StatusUpda
 	return res, kcs.invalidateChan
 }
 
-// PushConnectionStatusChange pushes a change to the connection status of one of the services.
-func (kcs *kbfsCurrentStatus) PushConnectionStatusChange(service string, err error) {
+// PushConnectionStatusChange pushes a change to the connection status
+// of one of the services.  It returns true if the service was failing
+// and has now recovered.
+func (kcs *kbfsCurrentStatus) PushConnectionStatusChange(
+	service string, err error) (recovered bool) {
 	kcs.lock.Lock()
 	defer kcs.lock.Unlock()
 
@@ -53,11 +58,41 @@ func (kcs *kbfsCurrentStatus) PushConnectionStatusChange(service string, err err
 		// Potentially exit early if nothing changes.
 		_, exist := kcs.failingServices[service]
 		if !exist {
-			return
+			return false
 		}
 		delete(kcs.failingServices, service)
+		recovered = true
 	}
 
 	close(kcs.invalidateChan)
 	kcs.invalidateChan = make(chan StatusUpdate)
+	return recovered
+}
+
+// CurrentRetryStatus returns a copy of the current retry status of
+// each service, or nil if no call has been retried.
+func (kcs *kbfsCurrentStatus) CurrentRetryStatus() map[string]RetryStatus {
+	kcs.lock.Lock()
+	defer kcs.lock.Unlock()
+
+	if len(kcs.retryStatus) == 0 {
+		return nil
+	}
+	res := make(map[string]RetryStatus, len(kcs.retryStatus))
+	for k, v := range kcs.retryStatus {
+		res[k] = v
+	}
+	return res
+}
+
+// PushRetryStatusChange pushes a change to the status of the retried
+// calls to one of the services.
+func (kcs *kbfsCurrentStatus) PushRetryStatusChange(
+	service string, status RetryStatus) {
+	kcs.lock.Lock()
+	defer kcs.lock.Unlock()
+
+	kcs.retryStatus[service] = status
+	close(kcs.invalidateChan)
+	kcs.invalidateChan = make(chan StatusUpdate)
 }
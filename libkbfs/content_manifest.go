@@ -0,0 +1,339 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// ContentManifestEntry describes one entry in a ContentManifest.
+type ContentManifestEntry struct {
+	// Path is the path of the entry, relative to the root of the
+	// manifest and separated by slashes.
+	Path string
+	Type EntryType
+	// Size is the size of a file, or of a symlink's target path.
+	Size uint64 `json:",omitempty"`
+	// Hash is the hex-encoded hash of a file's contents.
+	Hash string `json:",omitempty"`
+	// SymPath is the target of a symlink.
+	SymPath string `json:",omitempty"`
+}
+
+// ContentManifest lists every entry of a directory tree within a
+// folder, as of one MD revision of that folder, and is signed by the
+// device that made it.  It is suitable for encoding directly as JSON,
+// so that it can be distributed alongside copies of the tree.
+type ContentManifest struct {
+	// Folder is the canonical path of the folder.
+	Folder string
+	// Root is the path of the tree within the folder, separated by
+	// slashes.  It is empty for the root of the folder.
+	Root string
+	// Revision and MdID identify the MD revision the tree was read
+	// at.
+	Revision MetadataRevision
+	MdID     string
+	// Signer is the user who made the manifest.
+	Signer string
+	// Entries are sorted by path.
+	Entries []ContentManifestEntry
+	// Signature is the encoded SignatureInfo over all of the fields
+	// above.
+	Signature []byte
+}
+
+// maxContentManifestAttempts is the number of times making a
+// manifest is retried when the folder changes during the walk.
+const maxContentManifestAttempts = 3
+
+// contentManifestReadSize is the size of the chunks files are read
+// in while hashing them.
+const contentManifestReadSize = 64 * 1024
+
+type contentManifestEntriesByPath []ContentManifestEntry
+
+func (e contentManifestEntriesByPath) Len() int           { return len(e) }
+func (e contentManifestEntriesByPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+func (e contentManifestEntriesByPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// signedBytes returns the bytes that m's signature covers.
+func (m ContentManifest) signedBytes(codec Codec) ([]byte, error) {
+	m.Signature = nil
+	if len(m.Entries) == 0 {
+		// An empty list may come back as nil after a round-trip
+		// through JSON.
+		m.Entries = nil
+	}
+	return codec.Encode(m)
+}
+
+// nodeReader reads a KBFS file node sequentially.
+type nodeReader struct {
+	ctx     context.Context
+	kbfsOps KBFSOps
+	node    Node
+	off     int64
+}
+
+func (r *nodeReader) Read(p []byte) (int, error) {
+	n, err := r.kbfsOps.Read(r.ctx, r.node, p, r.off)
+	if err != nil {
+		return int(n), err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	return int(n), nil
+}
+
+// hashContents returns the hex-encoded default hash of everything r
+// returns.
+func hashContents(r io.Reader) (string, error) {
+	hasher := DefaultHashNew()
+	_, err := io.CopyBuffer(hasher, r, make([]byte, contentManifestReadSize))
+	if err != nil {
+		return "", err
+	}
+	hash, err := HashFromRaw(DefaultHashType, hasher.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// listContentManifestEntries appends an entry for everything under
+// dir to entries, with prefix prepended to their paths.
+func listContentManifestEntries(ctx context.Context, kbfsOps KBFSOps,
+	dir Node, prefix string, entries []ContentManifestEntry) (
+	[]ContentManifestEntry, error) {
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for name, ei := range children {
+		entry := ContentManifestEntry{Path: prefix + name, Type: ei.Type}
+		switch ei.Type {
+		case Sym:
+			entry.Size = ei.Size
+			entry.SymPath = ei.SymPath
+			entries = append(entries, entry)
+		case File, Exec:
+			node, _, err := kbfsOps.Lookup(ctx, dir, name)
+			if err != nil {
+				return nil, err
+			}
+			entry.Size = ei.Size
+			entry.Hash, err = hashContents(
+				&nodeReader{ctx: ctx, kbfsOps: kbfsOps, node: node})
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case Dir:
+			node, _, err := kbfsOps.Lookup(ctx, dir, name)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			entries, err = listContentManifestEntries(
+				ctx, kbfsOps, node, entry.Path+"/", entries)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// makeContentManifest lists and signs the tree under dir, which lives
+// at root within its folder.  Local changes under dir are synced
+// first, and the walk is retried if the folder's head changes
+// underneath it, so that the manifest exactly matches the revision
+// it names.
+func makeContentManifest(ctx context.Context, config Config, dir Node,
+	root string) (ContentManifest, error) {
+	kbfsOps := config.KBFSOps()
+	ei, err := kbfsOps.Stat(ctx, dir)
+	if err != nil {
+		return ContentManifest{}, err
+	}
+	if ei.Type != Dir {
+		return ContentManifest{}, fmt.Errorf("%s is not a directory", root)
+	}
+	err = kbfsOps.FlushPath(ctx, dir)
+	if err != nil {
+		return ContentManifest{}, err
+	}
+
+	for i := 0; i < maxContentManifestAttempts; i++ {
+		head, headChanged, err := kbfsOps.GetFolderHead(
+			ctx, dir.GetFolderBranch())
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		entries, err := listContentManifestEntries(ctx, kbfsOps, dir, "", nil)
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		select {
+		case <-headChanged:
+			continue
+		default:
+		}
+
+		sort.Sort(contentManifestEntriesByPath(entries))
+		username, _, err := config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		m := ContentManifest{
+			Folder:   head.Folder,
+			Root:     root,
+			Revision: head.Revision,
+			MdID:     head.MdID,
+			Signer:   username.String(),
+			Entries:  entries,
+		}
+		buf, err := m.signedBytes(config.Codec())
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		sigInfo, err := config.Crypto().Sign(ctx, buf)
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		m.Signature, err = config.Codec().Encode(sigInfo)
+		if err != nil {
+			return ContentManifest{}, err
+		}
+		return m, nil
+	}
+	return ContentManifest{}, fmt.Errorf("%s kept changing while its "+
+		"manifest was being made", root)
+}
+
+// VerifyContentManifest checks that m is validly signed, and returns
+// the key that signed it.  The caller must check that the key
+// belongs to a device of a user it trusts, such as m.Signer.
+func VerifyContentManifest(codec Codec, crypto Crypto, m ContentManifest) (
+	VerifyingKey, error) {
+	var sigInfo SignatureInfo
+	err := codec.Decode(m.Signature, &sigInfo)
+	if err != nil {
+		return VerifyingKey{}, err
+	}
+	buf, err := m.signedBytes(codec)
+	if err != nil {
+		return VerifyingKey{}, err
+	}
+	err = crypto.Verify(buf, sigInfo)
+	if err != nil {
+		return VerifyingKey{}, err
+	}
+	return sigInfo.VerifyingKey, nil
+}
+
+// CheckContentManifest checks that the local directory dir holds
+// exactly the tree described by m, and returns a
+// ContentManifestMismatchError for the first difference found.  It
+// doesn't check m's signature; see VerifyContentManifest.
+func CheckContentManifest(m ContentManifest, dir string) error {
+	expected := make(map[string]ContentManifestEntry, len(m.Entries))
+	for _, entry := range m.Entries {
+		expected[entry.Path] = entry
+	}
+
+	err := filepath.Walk(dir, func(
+		fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fullPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		entry, ok := expected[rel]
+		if !ok {
+			return ContentManifestMismatchError{rel, "not in the manifest"}
+		}
+		delete(expected, rel)
+		return checkContentManifestEntry(entry, fullPath, info)
+	})
+	if err != nil {
+		return err
+	}
+	// Anything left over is missing from the local copy; report the
+	// first one, in manifest order.
+	for _, entry := range m.Entries {
+		if _, ok := expected[entry.Path]; ok {
+			return ContentManifestMismatchError{entry.Path, "missing"}
+		}
+	}
+	return nil
+}
+
+func checkContentManifestEntry(entry ContentManifestEntry, fullPath string,
+	info os.FileInfo) error {
+	mode := info.Mode()
+	switch entry.Type {
+	case Dir:
+		if !mode.IsDir() {
+			return ContentManifestMismatchError{entry.Path, "not a directory"}
+		}
+		return nil
+	case Sym:
+		if mode&os.ModeSymlink == 0 {
+			return ContentManifestMismatchError{entry.Path, "not a symlink"}
+		}
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return err
+		}
+		if target != entry.SymPath {
+			return ContentManifestMismatchError{entry.Path, fmt.Sprintf(
+				"links to %q instead of %q", target, entry.SymPath)}
+		}
+		return nil
+	}
+
+	if !mode.IsRegular() {
+		return ContentManifestMismatchError{entry.Path, "not a regular file"}
+	}
+	// Windows has no executable bits to check.
+	if runtime.GOOS != "windows" && (entry.Type == Exec) != (mode&0100 != 0) {
+		return ContentManifestMismatchError{entry.Path, fmt.Sprintf(
+			"should be of type %s", entry.Type)}
+	}
+	if uint64(info.Size()) != entry.Size {
+		return ContentManifestMismatchError{entry.Path, fmt.Sprintf(
+			"has size %d instead of %d", info.Size(), entry.Size)}
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash, err := hashContents(f)
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash {
+		return ContentManifestMismatchError{entry.Path, "contents differ"}
+	}
+	return nil
+}
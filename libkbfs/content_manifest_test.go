@@ -0,0 +1,100 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentManifest(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", true)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "release")
+	require.NoError(t, err)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "bin")
+	require.NoError(t, err)
+	fileA, _, err := kbfsOps.CreateFile(ctx, dirNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileA, []byte("hello"), 0)
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, subdirNode, "b", true)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileB, []byte("#!/bin/sh\n"), 0)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "s", "a")
+	require.NoError(t, err)
+
+	// Unsynced writes get synced before the manifest is made.
+	m, err := kbfsOps.MakeContentManifest(ctx, dirNode)
+	require.NoError(t, err)
+	head, _, err := kbfsOps.GetFolderHead(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, "/keybase/public/alice", m.Folder)
+	require.Equal(t, "release", m.Root)
+	require.Equal(t, head.Revision, m.Revision)
+	require.Equal(t, head.MdID, m.MdID)
+	require.Equal(t, "alice", m.Signer)
+	var paths []string
+	for _, entry := range m.Entries {
+		paths = append(paths, entry.Path)
+	}
+	require.Equal(t, []string{"a", "bin", "bin/b", "s"}, paths)
+	require.Equal(t, uint64(5), m.Entries[0].Size)
+	require.Equal(t, Exec, m.Entries[2].Type)
+	require.Equal(t, "a", m.Entries[3].SymPath)
+
+	// The signature must survive a round-trip through JSON.
+	buf, err := json.Marshal(m)
+	require.NoError(t, err)
+	var decoded ContentManifest
+	err = json.Unmarshal(buf, &decoded)
+	require.NoError(t, err)
+	key, err := VerifyContentManifest(config.Codec(), config.Crypto(), decoded)
+	require.NoError(t, err)
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	err = config.KBPKI().HasVerifyingKey(ctx, uid, key, config.Clock().Now())
+	require.NoError(t, err)
+	decoded.Entries[0].Hash = decoded.Entries[2].Hash
+	_, err = VerifyContentManifest(config.Codec(), config.Crypto(), decoded)
+	require.Error(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "content_manifest")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	require.NoError(t, os.Mkdir(filepath.Join(tempdir, "bin"), 0700))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(tempdir, "a"), []byte("hello"), 0600))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(tempdir, "bin", "b"), []byte("#!/bin/sh\n"), 0700))
+	require.NoError(t, os.Symlink("a", filepath.Join(tempdir, "s")))
+	require.NoError(t, CheckContentManifest(m, tempdir))
+
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(tempdir, "a"), []byte("jello"), 0600))
+	require.Equal(t, ContentManifestMismatchError{"a", "contents differ"},
+		CheckContentManifest(m, tempdir))
+	require.NoError(t, os.Remove(filepath.Join(tempdir, "a")))
+	require.Equal(t, ContentManifestMismatchError{"a", "missing"},
+		CheckContentManifest(m, tempdir))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(tempdir, "a"), []byte("hello"), 0600))
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(tempdir, "c"), nil, 0600))
+	require.Equal(t, ContentManifestMismatchError{"c", "not in the manifest"},
+		CheckContentManifest(m, tempdir))
+}
@@ -178,7 +178,7 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 			entry.Size = unmergedEntry.Size
 			entry.EncodedSize = unmergedEntry.EncodedSize
 			entry.BlockPointer = unmergedEntry.BlockPointer
-			mergedBlock.Children[cuea.toName] = entry
+			mergedBlock.setEntry(cuea.toName, entry)
 			return nil
 		}
 		// copy any attrs that were explicitly set on the unmerged
@@ -189,11 +189,15 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.Xattrs = cuea.unmergedEntry.Xattrs
+			case linksAttr:
+				unmergedEntry.Links = cuea.unmergedEntry.Links
 			}
 		}
 	}
 
-	mergedBlock.Children[cuea.toName] = unmergedEntry
+	mergedBlock.setEntry(cuea.toName, unmergedEntry)
 	return nil
 }
 
@@ -314,9 +318,13 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
 			mergedEntry.BlockPointer = unmergedEntry.BlockPointer
+		case xattrAttr:
+			mergedEntry.Xattrs = unmergedEntry.Xattrs
+		case linksAttr:
+			mergedEntry.Links = unmergedEntry.Links
 		}
 	}
-	mergedBlock.Children[cuaa.toName] = mergedEntry
+	mergedBlock.setEntry(cuaa.toName, mergedEntry)
 
 	return nil
 }
@@ -366,7 +374,7 @@ func (rmea *rmMergedEntryAction) do(ctx context.Context,
 	if _, ok := mergedBlock.Children[rmea.name]; !ok {
 		return NoSuchNameError{rmea.name}
 	}
-	delete(mergedBlock.Children, rmea.name)
+	mergedBlock.removeEntry(rmea.name)
 	return nil
 }
 
@@ -437,7 +445,7 @@ func crActionCopyFile(ctx context.Context, copier fileBlockDeepCopier,
 	// Set the entry with the new pointer.
 	oldPointer := fromEntry.BlockPointer
 	fromEntry.BlockPointer = ptr
-	toBlock.Children[name] = fromEntry
+	toBlock.setEntry(name, fromEntry)
 	return oldPointer, name, nil
 }
 
@@ -630,7 +638,7 @@ func (rma *renameMergedAction) do(ctx context.Context,
 	}
 	rma.toName = newName
 
-	mergedBlock.Children[rma.toName] = mergedEntry
+	mergedBlock.setEntry(rma.toName, mergedEntry)
 
 	// Add the unmerged entry as the new "fromName".
 	unmergedEntry, ok := unmergedBlock.Children[rma.fromName]
@@ -641,7 +649,7 @@ func (rma *renameMergedAction) do(ctx context.Context,
 		unmergedEntry.Type = Sym
 		unmergedEntry.SymPath = rma.symPath
 	}
-	mergedBlock.Children[rma.fromName] = unmergedEntry
+	mergedBlock.setEntry(rma.fromName, unmergedEntry)
 
 	return nil
 }
@@ -197,6 +197,11 @@ type crChains struct {
 	// Pointers that should be explicitly cleaned up in the resolution.
 	toUnrefPointers map[BlockPointer]bool
 
+	// All the pointers referenced by the ops in these chains,
+	// including ones that aren't nodes themselves, like the leaf
+	// blocks of indirect files and directories.
+	refPointers map[BlockPointer]bool
+
 	// Also keep a reference to the most recent MD that's part of this
 	// chain.
 	mostRecentMD *RootMetadata
@@ -506,6 +511,7 @@ func newCRChainsEmpty() *crChains {
 		renamedOriginals:    make(map[BlockPointer]renameInfo),
 		blockChangePointers: make(map[BlockPointer]bool),
 		toUnrefPointers:     make(map[BlockPointer]bool),
+		refPointers:         make(map[BlockPointer]bool),
 		originals:           make(map[BlockPointer]BlockPointer),
 	}
 }
@@ -534,6 +540,9 @@ func newCRChains(ctx context.Context, cfg Config, rmds []*RootMetadata) (
 
 		for _, op := range rmd.data.Changes.Ops {
 			op.setWriterInfo(winfo)
+			for _, ptr := range op.Refs() {
+				ccs.refPointers[ptr] = true
+			}
 			err := ccs.makeChainForOp(op)
 			if err != nil {
 				return nil, err
@@ -0,0 +1,232 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"golang.org/x/net/context"
+)
+
+const (
+	// crMaxMergeBytes is the size of the biggest file whose
+	// conflicting versions conflict resolution will try to merge.
+	crMaxMergeBytes = 8 * 1024 * 1024
+	// crMergeReadBytes is how much of a file to read at once while
+	// loading a version to merge.
+	crMergeReadBytes = 64 * 1024
+)
+
+// crFileMerge is a file that was written on both branches, whose
+// unmerged version conflict resolution copies into a conflicted file
+// next to the merged one.  Once the resolution is done, the two
+// versions can be merged together with the help of their common
+// ancestor, and the conflicted copy removed.
+type crFileMerge struct {
+	// dir holds the names of the merged directories leading to the
+	// file, not including the folder's root.
+	dir  []string
+	name string
+	// mergedDir is the merged most recent pointer of the parent
+	// directory.
+	mergedDir BlockPointer
+	// base is the file's pointer before either branch wrote it.
+	base BlockPointer
+	// action is the one making the conflicted copy, which holds its
+	// final name once it's done.
+	action *renameUnmergedAction
+}
+
+// findFileMerges returns all the files written on both branches that
+// could be merged by the configured MergeStrategy.  It must be called
+// before the actions are computed, since that changes mergedPaths.
+func (cr *ConflictResolver) findFileMerges(ctx context.Context,
+	unmergedChains *crChains, mergedChains *crChains,
+	mergedPaths map[BlockPointer]path) []*crFileMerge {
+	if cr.config.MergeStrategy() == nil {
+		return nil
+	}
+	var merges []*crFileMerge
+	for unmergedMostRecent, chain := range unmergedChains.byMostRecent {
+		if !chain.isFile() || !fileWithConflictingWrite(unmergedChains,
+			mergedChains, chain.original, chain.original) {
+			continue
+		}
+		mergedPath, ok := mergedPaths[unmergedMostRecent]
+		if !ok || !mergedPath.hasValidParent() {
+			continue
+		}
+		// Only merge files that still have the same name on both
+		// branches.
+		var unmergedName string
+		for _, op := range chain.ops {
+			if so, ok := op.(*syncOp); ok {
+				unmergedName = so.getFinalPath().tailName()
+			}
+		}
+		if unmergedName != mergedPath.tailName() {
+			continue
+		}
+		m := &crFileMerge{
+			name:      unmergedName,
+			mergedDir: mergedPath.parentPath().tailPointer(),
+			base:      chain.original,
+		}
+		for _, node := range mergedPath.path[1 : len(mergedPath.path)-1] {
+			m.dir = append(m.dir, node.Name)
+		}
+		cr.log.CDebugf(ctx, "Will try to merge %s", mergedPath)
+		merges = append(merges, m)
+	}
+	return merges
+}
+
+// matchFileMerges finds the action copying the unmerged version of
+// each file to merge, and drops the files that don't have one.
+func matchFileMerges(merges []*crFileMerge,
+	actionMap map[BlockPointer]crActionList) []*crFileMerge {
+	var matched []*crFileMerge
+	for _, m := range merges {
+		// After the actions are collapsed, the file actions are
+		// listed under their merged parent directory.
+		for _, action := range actionMap[m.mergedDir] {
+			rua, ok := action.(*renameUnmergedAction)
+			if ok && rua.fromName == m.name && rua.symPath == "" &&
+				rua.unmergedParentMostRecent.IsInitialized() {
+				m.action = rua
+				matched = append(matched, m)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// readFileForMerge reads all of the given file, or returns false if
+// it's too big to merge.
+func (cr *ConflictResolver) readFileForMerge(ctx context.Context,
+	lState *lockState, md *RootMetadata, file path) ([]byte, bool, error) {
+	var data []byte
+	buf := make([]byte, crMergeReadBytes)
+	for {
+		n, err := cr.fbo.blocks.Read(
+			ctx, lState, md, file, buf, int64(len(data)))
+		if err != nil {
+			return nil, false, err
+		}
+		data = append(data, buf[:n]...)
+		if len(data) > crMaxMergeBytes {
+			return nil, false, nil
+		}
+		if n < int64(len(buf)) {
+			return data, true, nil
+		}
+	}
+}
+
+// mergeFile tries to merge the conflicted copy made for the given
+// file back into the file itself, and removes the copy if it
+// succeeds.  It returns true if the file was merged.
+func (cr *ConflictResolver) mergeFile(ctx context.Context,
+	lState *lockState, m *crFileMerge) (bool, error) {
+	dirNode, _, _, err := cr.fbo.getRootNode(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range m.dir {
+		dirNode, _, err = cr.fbo.Lookup(ctx, dirNode, name)
+		if err != nil {
+			return false, err
+		}
+	}
+	fileNode, _, err := cr.fbo.Lookup(ctx, dirNode, m.name)
+	if err != nil {
+		return false, err
+	}
+	copyNode, _, err := cr.fbo.Lookup(ctx, dirNode, m.action.toName)
+	if err != nil {
+		return false, err
+	}
+
+	md, err := cr.fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+	filePath, err := cr.fbo.pathFromNodeForRead(fileNode)
+	if err != nil {
+		return false, err
+	}
+	if cr.fbo.blocks.IsDirty(lState, filePath) {
+		// Someone is already writing the merged version again.
+		return false, nil
+	}
+	copyPath, err := cr.fbo.pathFromNodeForRead(copyNode)
+	if err != nil {
+		return false, err
+	}
+
+	var base []byte
+	if m.base.IsInitialized() {
+		basePath := path{
+			FolderBranch: cr.fbo.folderBranch,
+			path:         []pathNode{{m.base, m.name}},
+		}
+		var ok bool
+		base, ok, err = cr.readFileForMerge(ctx, lState, md, basePath)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	merged, ok, err := cr.readFileForMerge(ctx, lState, md, filePath)
+	if err != nil || !ok {
+		return false, err
+	}
+	unmerged, ok, err := cr.readFileForMerge(ctx, lState, md, copyPath)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	de, err := cr.fbo.statEntry(ctx, fileNode)
+	if err != nil {
+		return false, err
+	}
+	result, ok, err := cr.config.MergeStrategy().Merge(
+		ctx, m.name, de.Xattrs, base, merged, unmerged)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	cr.log.CDebugf(ctx, "Merged %s into %s", m.action.toName, m.name)
+	err = cr.fbo.Write(ctx, fileNode, result, 0)
+	if err != nil {
+		return false, err
+	}
+	err = cr.fbo.Truncate(ctx, fileNode, uint64(len(result)))
+	if err != nil {
+		return false, err
+	}
+	err = cr.fbo.syncToServer(ctx, fileNode)
+	if err != nil {
+		return false, err
+	}
+	err = cr.fbo.RemoveEntry(ctx, dirNode, m.action.toName)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mergeFiles tries to merge each of the given files, leaving the
+// conflicted copies in place for any that can't be merged.
+func (cr *ConflictResolver) mergeFiles(ctx context.Context,
+	lState *lockState, merges []*crFileMerge) {
+	for _, m := range merges {
+		merged, err := cr.mergeFile(ctx, lState, m)
+		if err != nil {
+			cr.log.CDebugf(ctx, "Couldn't merge %s: %v", m.name, err)
+		} else if !merged {
+			cr.log.CDebugf(ctx, "Keeping conflicted copy %s of %s",
+				m.action.toName, m.name)
+		}
+	}
+}
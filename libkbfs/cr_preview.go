@@ -0,0 +1,117 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// CRPreviewEntry describes what conflict resolution will do to one
+// entry of a folder.  Paths start with the folder's canonical name.
+type CRPreviewEntry struct {
+	// Path is where the entry is now.
+	Path string
+	// NewPath is where the entry will end up, if it's moved or
+	// copied.
+	NewPath string `json:",omitempty"`
+	// Op describes the local change that will be thrown away, if
+	// any.
+	Op string `json:",omitempty"`
+}
+
+// ConflictResolutionPreview reports what conflict resolution would
+// do to a folder's local unmerged changes if it ran right now.  It is
+// suitable for encoding directly as JSON.
+type ConflictResolutionPreview struct {
+	// Staged is false if the folder has no unmerged changes, in
+	// which case there is nothing to resolve.
+	Staged bool
+	// Duplicated lists files changed on both sides, whose local
+	// version will be kept as a separate, renamed copy next to the
+	// merged one.
+	Duplicated []CRPreviewEntry
+	// Renamed lists merged entries that will be moved out of the
+	// way of a local entry with the same name.
+	Renamed []CRPreviewEntry
+	// Dropped lists local changes that will be thrown away, e.g.
+	// because the merged branch removed what they applied to.
+	Dropped []CRPreviewEntry
+}
+
+type crPreviewEntriesByPath []CRPreviewEntry
+
+func (e crPreviewEntriesByPath) Len() int           { return len(e) }
+func (e crPreviewEntriesByPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+func (e crPreviewEntriesByPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// preview works out what resolving the folder's unmerged changes
+// against the latest merged revision would do, without changing the
+// folder or the state of any resolution in progress.
+func (cr *ConflictResolver) preview(ctx context.Context,
+	lState *lockState) (ConflictResolutionPreview, error) {
+	preview := ConflictResolutionPreview{Staged: true}
+
+	// Compute the resolution with a resolver that isn't processing
+	// any input, so that the input of the real one is left alone.
+	previewer := &ConflictResolver{
+		config: cr.config,
+		fbo:    cr.fbo,
+		log:    cr.log,
+		currInput: conflictInput{
+			unmerged: MetadataRevisionUninitialized,
+			merged:   MetadataRevisionUninitialized,
+		},
+	}
+	unmergedChains, mergedChains, _, mergedPaths, recOps, _, _, err :=
+		previewer.buildChainsAndPaths(ctx, lState)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+	if len(mergedPaths) == 0 {
+		return preview, nil
+	}
+	actionMap, _, err := previewer.computeActions(
+		ctx, unmergedChains, mergedChains, mergedPaths, recOps)
+	if err != nil {
+		return ConflictResolutionPreview{}, err
+	}
+
+	// The actions are keyed by the merged directory they apply to.
+	dirs := make(map[BlockPointer]string, len(mergedPaths))
+	for _, p := range mergedPaths {
+		dirs[p.tailPointer()] = p.String()
+	}
+	for ptr, actions := range actionMap {
+		dir := dirs[ptr]
+		for _, action := range actions {
+			switch a := action.(type) {
+			case *renameUnmergedAction:
+				preview.Duplicated = append(preview.Duplicated,
+					CRPreviewEntry{
+						Path:    dir + "/" + a.fromName,
+						NewPath: dir + "/" + a.toName,
+					})
+			case *renameMergedAction:
+				preview.Renamed = append(preview.Renamed,
+					CRPreviewEntry{
+						Path:    dir + "/" + a.fromName,
+						NewPath: dir + "/" + a.toName,
+					})
+			case *dropUnmergedAction:
+				preview.Dropped = append(preview.Dropped,
+					CRPreviewEntry{
+						Path: dir,
+						Op:   a.op.String(),
+					})
+			}
+		}
+	}
+	sort.Sort(crPreviewEntriesByPath(preview.Duplicated))
+	sort.Sort(crPreviewEntriesByPath(preview.Renamed))
+	sort.Sort(crPreviewEntriesByPath(preview.Dropped))
+	return preview, nil
+}
@@ -421,10 +421,12 @@ func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 	if err := binary.Read(buf, binary.LittleEndian, &blockLen); err != nil {
 		return nil, err
 	}
-	blockEndPos := int(blockLen + padPrefixSize)
+	// Do this in 64 bits, so that a bad length from the server
+	// can't overflow it.
+	blockEndPos := uint64(blockLen) + padPrefixSize
 
-	if len(paddedBlock) < blockEndPos {
-		return nil, PaddedBlockReadError{ActualLen: len(paddedBlock), ExpectedLen: blockEndPos}
+	if uint64(len(paddedBlock)) < blockEndPos {
+		return nil, PaddedBlockReadError{ActualLen: len(paddedBlock), ExpectedLen: int(blockEndPos)}
 	}
 	return buf.Next(int(blockLen)), nil
 }
@@ -817,6 +817,16 @@ func TestBlockDepadding(t *testing.T) {
 	}
 }
 
+// Test that a length prefix big enough to overflow is rejected.
+func TestBlockDepaddingBadLength(t *testing.T) {
+	var c CryptoCommon
+	padded := []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}
+	_, err := c.depadBlock(padded)
+	if _, ok := err.(PaddedBlockReadError); !ok {
+		t.Errorf("Expected PaddedBlockReadError, got %v", err)
+	}
+}
+
 // Test padding of blocks results in blocks at least 2^8.
 func TestBlockPadMinimum(t *testing.T) {
 	var c CryptoCommon
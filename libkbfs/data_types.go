@@ -160,6 +160,15 @@ const (
 	FirstValidKeyGen = 1
 )
 
+// WriteBackJournalLimits caps how many bytes of local disk the
+// write-back journals may take up.  Zero means no limit.
+type WriteBackJournalLimits struct {
+	// PerFolderBytes caps the journal of each folder.
+	PerFolderBytes uint64
+	// TotalBytes caps the journals of all folders together.
+	TotalBytes uint64
+}
+
 // MetadataVer is the type of a version for marshalled KBFS metadata
 // structures.
 type MetadataVer int
@@ -175,6 +184,13 @@ const (
 	// InitialExtraMetadataVer is the first metadata version that did
 	// include support for extra MD fields.
 	InitialExtraMetadataVer = 2
+	// FolderFeaturesMetadataVer is the first metadata version for
+	// folders that use a feature older clients would break by
+	// writing to them: content-defined chunking, extended
+	// attributes, archiving, a quota set by the writers, a trash
+	// retention, or hard links.  The features share a version
+	// since they were introduced together.
+	FolderFeaturesMetadataVer = 3
 )
 
 // DataVer is the type of a version for marshalled KBFS data
@@ -189,6 +205,12 @@ const (
 	// FilesWithHolesDataVer is the data version for files
 	// with holes.
 	FilesWithHolesDataVer = 2
+	// XattrsDataVer is the data version for directories with
+	// entries that have extended attributes.
+	XattrsDataVer = 3
+	// IndirectDirsDataVer is the data version for directories
+	// whose entries are split across several blocks.
+	IndirectDirsDataVer = 4
 )
 
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
@@ -656,6 +678,22 @@ type EntryInfo struct {
 	Ctime int64
 }
 
+// XattrSetMode says whether setting an extended attribute may
+// create it, replace an existing value, or both.
+type XattrSetMode int
+
+const (
+	// XattrCreateOrReplace sets the attribute whether or not it
+	// already exists.
+	XattrCreateOrReplace XattrSetMode = iota
+	// XattrCreateOnly fails with XattrExistsError if the attribute
+	// already exists.
+	XattrCreateOnly
+	// XattrReplaceOnly fails with NoSuchXattrError if the attribute
+	// doesn't exist yet.
+	XattrReplaceOnly
+)
+
 // extCode is used to register codec extensions
 type extCode uint64
 
@@ -769,6 +807,18 @@ func (u *UsageStat) Accum(another *UsageStat, accumF func(int64, int64) int64) {
 	}
 }
 
+// FolderUsage breaks down the quota usage of a single folder.
+type FolderUsage struct {
+	// LiveBytes are referenced by the folder's current state.
+	LiveBytes int64
+	// ArchivedBytes are only referenced by older versions of the
+	// folder, and will be freed once those are reclaimed.
+	ArchivedBytes int64
+	// PendingBytes have been written locally, but not yet flushed
+	// to the servers, and so aren't counted in the other fields.
+	PendingBytes int64
+}
+
 // UserQuotaInfo contains a user's quota usage information
 type UserQuotaInfo struct {
 	Folders map[string]*UsageStat
@@ -852,6 +902,51 @@ type TLFUpdateHistory struct {
 	Updates []UpdateSummary
 }
 
+// TLFKeyDeviceHistory describes when a device could read data
+// encrypted with a single key generation.
+type TLFKeyDeviceHistory struct {
+	User   string
+	Writer bool
+	// The KID of the device's crypt public key.
+	Device keybase1.KID
+	// The revision that gave the device the key generation.
+	AddedRevision MetadataRevision
+	// The revision that took the key generation away from the
+	// device, or MetadataRevisionUninitialized if it still has it.
+	RemovedRevision MetadataRevision
+}
+
+// TLFKeyGenerationHistory describes a single key generation of a TLF,
+// and every device that has had access to it.
+type TLFKeyGenerationHistory struct {
+	KeyGen KeyGen
+	// The revision that created this key generation.
+	Revision MetadataRevision
+	Devices  []TLFKeyDeviceHistory
+}
+
+// TLFRekeySummary describes a single MD revision that changed a TLF's
+// keys.
+type TLFRekeySummary struct {
+	Revision MetadataRevision
+	// The time the server says it received the revision; this is
+	// not necessarily trustworthy.
+	Date time.Time
+	User string
+	// The latest key generation as of this revision.
+	KeyGen KeyGen
+}
+
+// TLFCryptKeyHistory gives the history of all of a TLF's key
+// generations, and of all the rekeys that changed them, and is
+// suitable for encoding directly as JSON.
+type TLFCryptKeyHistory struct {
+	ID          string
+	Name        string
+	Generations []TLFKeyGenerationHistory
+	Rekeys      []TLFRekeySummary
+}
+
 // writerInfo is the keybase username and device that generated the operation.
 type writerInfo struct {
 	name       libkb.NormalizedUsername
@@ -869,3 +964,76 @@ const (
 	// WriteMode indicates that an error happened while trying to write.
 	WriteMode
 )
+
+// FolderPinning is a user's override of whether a folder's blocks
+// should be pinned in the block cache.
+type FolderPinning int
+
+const (
+	// PinAuto pins the folder only while it is among the most
+	// frequently-accessed folders that fit in the pinning budget.
+	PinAuto FolderPinning = iota
+	// PinAlways always pins the folder.
+	PinAlways
+	// PinNever never pins the folder.
+	PinNever
+)
+
+func (p FolderPinning) String() string {
+	switch p {
+	case PinAuto:
+		return "auto"
+	case PinAlways:
+		return "always"
+	case PinNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFolderPinning parses the string representation of a
+// FolderPinning, as returned by its String method.
+func ParseFolderPinning(s string) (FolderPinning, error) {
+	for _, p := range []FolderPinning{PinAuto, PinAlways, PinNever} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return PinAuto, fmt.Errorf("Unknown folder pinning %q", s)
+}
+
+// TlfSyncMode says how much of a folder is kept on this device.
+type TlfSyncMode int
+
+const (
+	// SyncOnDemand only fetches the folder's blocks as they're
+	// needed, and lets the block cache evict them.
+	SyncOnDemand TlfSyncMode = iota
+	// SyncFull fetches every block of the folder as soon as it
+	// changes, and keeps them all pinned in the block cache, so the
+	// whole folder stays readable while offline.
+	SyncFull
+)
+
+func (m TlfSyncMode) String() string {
+	switch m {
+	case SyncOnDemand:
+		return "on-demand"
+	case SyncFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseTlfSyncMode parses the string representation of a
+// TlfSyncMode, as returned by its String method.
+func ParseTlfSyncMode(s string) (TlfSyncMode, error) {
+	for _, m := range []TlfSyncMode{SyncOnDemand, SyncFull} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return SyncOnDemand, fmt.Errorf("Unknown sync mode %q", s)
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// deletionWindowDefault is how far back DeletionGuard adds up the
+// deletions in a folder, by default.
+const deletionWindowDefault = time.Minute
+
+// LargeDeletion describes deletions from a shared folder that have
+// gone past a DeletionGuard's limits.
+type LargeDeletion struct {
+	Folder CanonicalTlfName
+	// Entries and Bytes are how many entries, and how many bytes of
+	// file data, have been deleted from the folder recently,
+	// including the deletion waiting for confirmation.
+	Entries int
+	Bytes   uint64
+}
+
+// DeletionConfirmer asks someone, e.g. with a GUI prompt, whether a
+// large deletion should go ahead.  It returns true if it should.
+type DeletionConfirmer func(ctx context.Context, d LargeDeletion) (bool, error)
+
+// DeletionLimits are the limits past which a DeletionGuard holds up
+// deletions from a shared folder.
+type DeletionLimits struct {
+	// Entries and Bytes are how many entries, and how many bytes of
+	// file data, may be deleted from a folder within Window without
+	// confirmation.  Zero means no limit.
+	Entries int
+	Bytes   uint64
+	// Window is how far back deletions are added up.  Zero means
+	// deletionWindowDefault.
+	Window time.Duration
+	// GracePeriod is how long deletions past the limits are held
+	// when no DeletionConfirmer is registered, during which they
+	// can be canceled with DeletionGuard.Cancel.
+	GracePeriod time.Duration
+}
+
+type deletionRecord struct {
+	when    time.Time
+	entries int
+	bytes   uint64
+}
+
+// DeletionGuard is a DeletionPolicy that adds up the recent deletions
+// in each shared folder, and once they go past its limits, holds up
+// further deletions until the registered DeletionConfirmer confirms
+// them or, without one, until a grace period passes.  Once confirmed,
+// the folder's deletions go ahead freely until a whole window passes
+// without any.
+type DeletionGuard struct {
+	limits DeletionLimits
+	clock  Clock
+
+	lock      sync.Mutex
+	confirm   DeletionConfirmer
+	recent    map[TlfID][]deletionRecord
+	confirmed map[TlfID]bool
+	canceled  map[TlfID]chan struct{}
+}
+
+var _ DeletionPolicy = (*DeletionGuard)(nil)
+
+// NewDeletionGuard returns a DeletionGuard with the given limits and
+// no DeletionConfirmer.
+func NewDeletionGuard(limits DeletionLimits, clock Clock) *DeletionGuard {
+	if limits.Window == 0 {
+		limits.Window = deletionWindowDefault
+	}
+	return &DeletionGuard{
+		limits:    limits,
+		clock:     clock,
+		recent:    make(map[TlfID][]deletionRecord),
+		confirmed: make(map[TlfID]bool),
+		canceled:  make(map[TlfID]chan struct{}),
+	}
+}
+
+// RegisterConfirmer makes confirm decide on deletions past the
+// limits, instead of the grace period.  confirm may be nil, to go
+// back to the grace period.
+func (g *DeletionGuard) RegisterConfirmer(confirm DeletionConfirmer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.confirm = confirm
+}
+
+// Cancel makes all the deletions from the given folder that are
+// being held for the grace period fail with DeletionNotConfirmedError.
+func (g *DeletionGuard) Cancel(tlf TlfID) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if c, ok := g.canceled[tlf]; ok {
+		close(c)
+		delete(g.canceled, tlf)
+	}
+}
+
+// totalsLocked forgets the deletions from tlf that are too old to
+// count, and returns the folder's recent totals, including a new
+// deletion of the given size.
+func (g *DeletionGuard) totalsLocked(
+	tlf TlfID, now time.Time, entries int, bytes uint64) (
+	totalEntries int, totalBytes uint64, overLimit bool) {
+	records := g.recent[tlf]
+	if len(records) > 0 &&
+		now.Sub(records[len(records)-1].when) >= g.limits.Window {
+		// The folder's been quiet for a whole window, so any
+		// earlier confirmation no longer applies.
+		delete(g.confirmed, tlf)
+	}
+	var kept []deletionRecord
+	for _, r := range records {
+		if now.Sub(r.when) < g.limits.Window {
+			kept = append(kept, r)
+			totalEntries += r.entries
+			totalBytes += r.bytes
+		}
+	}
+	g.recent[tlf] = kept
+	totalEntries += entries
+	totalBytes += bytes
+	overLimit = (g.limits.Entries > 0 && totalEntries > g.limits.Entries) ||
+		(g.limits.Bytes > 0 && totalBytes > g.limits.Bytes)
+	return totalEntries, totalBytes, overLimit
+}
+
+// CheckDeletion implements the DeletionPolicy interface for
+// DeletionGuard.
+func (g *DeletionGuard) CheckDeletion(ctx context.Context, tlf TlfID,
+	name CanonicalTlfName, entries int, bytes uint64) error {
+	record := deletionRecord{g.clock.Now(), entries, bytes}
+	g.lock.Lock()
+	totalEntries, totalBytes, overLimit := g.totalsLocked(
+		tlf, record.when, entries, bytes)
+	if !overLimit || g.confirmed[tlf] {
+		defer g.lock.Unlock()
+		g.recent[tlf] = append(g.recent[tlf], record)
+		return nil
+	}
+	confirm := g.confirm
+	canceled, ok := g.canceled[tlf]
+	if !ok {
+		canceled = make(chan struct{})
+		g.canceled[tlf] = canceled
+	}
+	g.lock.Unlock()
+
+	d := LargeDeletion{name, totalEntries, totalBytes}
+	if confirm != nil {
+		ok, err := confirm(ctx, d)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return DeletionNotConfirmedError{d}
+		}
+	} else {
+		select {
+		case <-time.After(g.limits.GracePeriod):
+		case <-canceled:
+			return DeletionNotConfirmedError{d}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.confirmed[tlf] = true
+	g.recent[tlf] = append(g.recent[tlf], record)
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestDeletionGuardConfirmer(t *testing.T) {
+	clock := newTestClockNow()
+	g := NewDeletionGuard(DeletionLimits{Entries: 2, Bytes: 100}, clock)
+	ctx := context.Background()
+	tlf := FakeTlfID(1, false)
+
+	var asked []LargeDeletion
+	answer := false
+	g.RegisterConfirmer(func(ctx context.Context, d LargeDeletion) (
+		bool, error) {
+		asked = append(asked, d)
+		return answer, nil
+	})
+
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 10))
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 10))
+	require.Len(t, asked, 0)
+
+	// The third entry is refused, and isn't counted.
+	err := g.CheckDeletion(ctx, tlf, "a,b", 1, 10)
+	require.IsType(t, DeletionNotConfirmedError{}, err)
+	require.Equal(t, []LargeDeletion{{"a,b", 3, 30}}, asked)
+
+	// Once confirmed, the rest of the burst goes ahead.
+	answer = true
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 10))
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 1000))
+	require.Len(t, asked, 2)
+
+	// Other folders are counted separately.
+	require.NoError(t, g.CheckDeletion(ctx, FakeTlfID(2, false), "a,c", 1, 0))
+	require.Len(t, asked, 2)
+
+	// After a quiet window, confirmation is needed again, but only
+	// past the limits.
+	clock.Add(deletionWindowDefault)
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 10))
+	answer = false
+	err = g.CheckDeletion(ctx, tlf, "a,b", 1, 200)
+	require.IsType(t, DeletionNotConfirmedError{}, err)
+	require.Equal(t, LargeDeletion{"a,b", 2, 210}, asked[2])
+}
+
+func TestDeletionGuardGracePeriod(t *testing.T) {
+	g := NewDeletionGuard(DeletionLimits{
+		Entries:     1,
+		GracePeriod: time.Hour,
+	}, newTestClockNow())
+	ctx := context.Background()
+	tlf := FakeTlfID(1, false)
+
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 0))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- g.CheckDeletion(ctx, tlf, "a,b", 1, 0)
+	}()
+	// Wait for the deletion to be held.
+	for held := false; !held; {
+		select {
+		case err := <-errCh:
+			t.Fatalf("Deletion wasn't held: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+		g.lock.Lock()
+		_, held = g.canceled[tlf]
+		g.lock.Unlock()
+	}
+	g.Cancel(tlf)
+	require.IsType(t, DeletionNotConfirmedError{}, <-errCh)
+
+	g = NewDeletionGuard(DeletionLimits{
+		Entries:     1,
+		GracePeriod: time.Millisecond,
+	}, newTestClockNow())
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 0))
+	require.NoError(t, g.CheckDeletion(ctx, tlf, "a,b", 1, 0))
+}
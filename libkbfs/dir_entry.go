@@ -10,6 +10,16 @@ import "github.com/keybase/go-codec/codec"
 type DirEntry struct {
 	BlockInfo
 	EntryInfo
+	// Xattrs holds the extended attributes of the child, by name.
+	Xattrs map[string][]byte `codec:"x,omitempty"`
+	// LinkID, when set on a Sym entry, makes it a hard link to the
+	// file named LinkID in the folder's hard links directory.
+	// SymPath still points to that file, so tools that don't know
+	// about hard links see a working symlink.
+	LinkID string `codec:"l,omitempty"`
+	// Links is the number of hard links to a file in the hard
+	// links directory.
+	Links uint32 `codec:"n,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -34,6 +34,9 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				101,
 				102,
 			},
+			map[string][]byte{"user.fake": {1, 2, 3}},
+			"fake link ID",
+			2,
 			codec.UnknownFieldSetHandler{},
 		},
 		makeExtraOrBust("dirEntry", t),
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/keybase/client/go/logger"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -21,11 +22,69 @@ type dirtyBlockID struct {
 
 type dirtyReq struct {
 	respChan chan<- struct{}
+	writer   NodeID
 	bytes    int64
 	start    time.Time
 	deadline time.Time
 }
 
+// dirtyWaitQueue holds the requests waiting for permission to dirty
+// bytes, so they are granted strictly in the order they arrived.
+// With per-writer fairness, each writer (i.e., file) gets its own
+// FIFO queue, and the writers take turns, one request at a time, so
+// a stream of writes to one file can't hold up writes to the others.
+type dirtyWaitQueue struct {
+	perWriter bool
+	// writers holds the writers with waiting requests, in the
+	// order their turns come up.  Without per-writer fairness, all
+	// requests are queued under the nil writer.
+	writers  []NodeID
+	byWriter map[NodeID][]dirtyReq
+	depth    int
+}
+
+func (q *dirtyWaitQueue) push(req dirtyReq) {
+	var writer NodeID
+	if q.perWriter {
+		writer = req.writer
+	}
+	reqs, ok := q.byWriter[writer]
+	if !ok {
+		q.writers = append(q.writers, writer)
+	}
+	q.byWriter[writer] = append(reqs, req)
+	q.depth++
+}
+
+// peek returns the request whose turn it is, if any.  It stays the
+// same until it's popped, since new requests only go behind it.
+func (q *dirtyWaitQueue) peek() (dirtyReq, bool) {
+	if len(q.writers) == 0 {
+		return dirtyReq{}, false
+	}
+	return q.byWriter[q.writers[0]][0], true
+}
+
+// pop removes the request returned by peek, once it's been granted.
+func (q *dirtyWaitQueue) pop() {
+	if len(q.writers) == 0 {
+		return
+	}
+	writer := q.writers[0]
+	reqs := q.byWriter[writer]
+	q.writers = q.writers[1:]
+	if len(reqs) == 1 {
+		delete(q.byWriter, writer)
+	} else {
+		// Zero out the popped request so its channel can be
+		// collected, and send the writer to the back of the line.
+		reqs[0] = dirtyReq{}
+		q.byWriter[writer] = reqs[1:]
+		q.writers = append(q.writers, writer)
+	}
+	q.depth--
+}
+
 // DirtyBlockCacheStandard implements the DirtyBlockCache interface by
 // storing blocks in an in-memory cache.  Dirty blocks are identified
 // by their block ID, branch name, and reference nonce, since the same
@@ -53,9 +112,9 @@ type DirtyBlockCacheStandard struct {
 	makeLog func(string) logger.Logger
 	log     logger.Logger
 
-	// requestsChan is a queue for channels that should be closed when
-	// permission is granted to dirty new data.
-	requestsChan chan dirtyReq
+	// requestsChan is signalled when a request has been added to
+	// waitQueue.
+	requestsChan chan struct{}
 	// bytesDecreasedChan is signalled when syncs have finished or dirty
 	// blocks have been deleted.
 	bytesDecreasedChan chan struct{}
@@ -74,6 +133,14 @@ type DirtyBlockCacheStandard struct {
 	// sync buffer), the more write requests will be delayed.
 	maxSyncBufferSize int64
 
+	// waitLock protects waitQueue, which holds the requests that
+	// should be granted permission to dirty new data, in order.
+	waitLock  sync.Mutex
+	waitQueue dirtyWaitQueue
+	// waitQueueDepth, if non-nil, tracks the number of requests
+	// waiting in waitQueue.
+	waitQueueDepth metrics.Gauge
+
 	lock               sync.RWMutex
 	cache              map[dirtyBlockID]Block
 	unsyncedDirtyBytes int64
@@ -94,7 +161,7 @@ func NewDirtyBlockCacheStandard(clock Clock,
 	d := &DirtyBlockCacheStandard{
 		clock:              clock,
 		makeLog:            makeLog,
-		requestsChan:       make(chan dirtyReq, 1000),
+		requestsChan:       make(chan struct{}, 1),
 		bytesDecreasedChan: make(chan struct{}, 1),
 		shutdownChan:       make(chan struct{}),
 		cache:              make(map[dirtyBlockID]Block),
@@ -102,10 +169,29 @@ func NewDirtyBlockCacheStandard(clock Clock,
 		maxSyncBufferSize:  maxSyncBufferSize,
 		syncBufferSize:     minSyncBufferSize,
 	}
+	d.waitQueue.byWriter = make(map[NodeID][]dirtyReq)
 	go d.processPermission()
 	return d
 }
 
+// EnablePerWriterFairness makes write requests to different files
+// take turns getting permission to dirty data, rather than getting it
+// strictly in the order the requests arrived.  This must be called
+// before the cache is used.
+func (d *DirtyBlockCacheStandard) EnablePerWriterFairness() {
+	d.waitLock.Lock()
+	defer d.waitLock.Unlock()
+	d.waitQueue.perWriter = true
+}
+
+func (d *DirtyBlockCacheStandard) registerMetrics(r metrics.Registry) {
+	d.waitLock.Lock()
+	defer d.waitLock.Unlock()
+	d.waitQueueDepth = metrics.GetOrRegisterGauge(
+		"DirtyBlockCache.WaitQueueDepth", r)
+	d.waitQueueDepth.Update(int64(d.waitQueue.depth))
+}
+
 // Get implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) Get(ptr BlockPointer, branch BranchName) (
@@ -262,35 +348,56 @@ func (d *DirtyBlockCacheStandard) acceptNewWrite(newBytes int64,
 	return canAccept
 }
 
+func (d *DirtyBlockCacheStandard) peekRequest() (dirtyReq, bool) {
+	d.waitLock.Lock()
+	defer d.waitLock.Unlock()
+	return d.waitQueue.peek()
+}
+
+func (d *DirtyBlockCacheStandard) popRequest() {
+	d.waitLock.Lock()
+	defer d.waitLock.Unlock()
+	d.waitQueue.pop()
+	if d.waitQueueDepth != nil {
+		d.waitQueueDepth.Update(int64(d.waitQueue.depth))
+	}
+}
+
 func (d *DirtyBlockCacheStandard) processPermission() {
-	// Keep track of the most-recently seen request across loop
-	// iterations, because we aren't necessarily going to be able to
-	// deal with it as soon as we see it (since we might be past our
-	// limits already).
+	// Keep track of the request at the head of the queue across
+	// loop iterations, because we aren't necessarily going to be
+	// able to deal with it as soon as we see it (since we might be
+	// past our limits already).  It stays in the queue, and no
+	// later request is considered, until it's been granted.
 	var currentReq dirtyReq
 	var backpressure time.Duration
 	for {
-		reqChan := d.requestsChan
-		if currentReq.respChan != nil {
-			// We are already waiting on a request, so don't bother
-			// trying to read another request from the requests chan.
-			reqChan = nil
+		newReq := false
+		if currentReq.respChan == nil {
+			currentReq, newReq = d.peekRequest()
 		}
 
-		var bpTimer <-chan time.Time
-		if backpressure > 0 {
-			bpTimer = time.After(backpressure)
-		}
+		if !newReq {
+			reqChan := d.requestsChan
+			if currentReq.respChan != nil {
+				// We are already waiting on a request, so don't
+				// bother waiting for new ones.
+				reqChan = nil
+			}
 
-		newReq := false
-		select {
-		case <-d.shutdownChan:
-			return
-		case <-d.bytesDecreasedChan:
-		case <-bpTimer:
-		case r := <-reqChan:
-			currentReq = r
-			newReq = true
+			var bpTimer <-chan time.Time
+			if backpressure > 0 {
+				bpTimer = time.After(backpressure)
+			}
+
+			select {
+			case <-d.shutdownChan:
+				return
+			case <-d.bytesDecreasedChan:
+			case <-bpTimer:
+			case <-reqChan:
+				continue
+			}
 		}
 
 		if currentReq.respChan != nil {
@@ -303,6 +410,7 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 				// our buffers to deal with it, grant permission to
 				// the requestor by closing the response channel.
 				close(currentReq.respChan)
+				d.popRequest()
 				currentReq = dirtyReq{}
 				if d.blockedChanForTesting != nil {
 					d.blockedChanForTesting <- -1
@@ -322,7 +430,8 @@ func (d *DirtyBlockCacheStandard) processPermission() {
 // RequestPermissionToDirty implements the DirtyBlockCache interface
 // for DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
-	ctx context.Context, estimatedDirtyBytes int64) (DirtyPermChan, error) {
+	ctx context.Context, writer NodeID, estimatedDirtyBytes int64) (
+	DirtyPermChan, error) {
 	if estimatedDirtyBytes < 0 {
 		panic("Must request permission for a non-negative number of bytes.")
 	}
@@ -332,13 +441,26 @@ func (d *DirtyBlockCacheStandard) RequestPermissionToDirty(
 	if !ok {
 		deadline = now.Add(backgroundTaskTimeout)
 	}
-	req := dirtyReq{c, estimatedDirtyBytes, now, deadline}
+	req := dirtyReq{c, writer, estimatedDirtyBytes, now, deadline}
 	select {
-	case d.requestsChan <- req:
-		return c, nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	default:
 	}
+
+	d.waitLock.Lock()
+	d.waitQueue.push(req)
+	if d.waitQueueDepth != nil {
+		d.waitQueueDepth.Update(int64(d.waitQueue.depth))
+	}
+	d.waitLock.Unlock()
+
+	select {
+	case d.requestsChan <- struct{}{}:
+	default:
+		// Already something queued there, and one is enough.
+	}
+	return c, nil
 }
 
 func (d *DirtyBlockCacheStandard) signalDecreasedBytes() {
@@ -417,6 +539,16 @@ func (d *DirtyBlockCacheStandard) ShouldForceSync() bool {
 	return d.unsyncedDirtyBytes > d.syncBufferSize
 }
 
+// getBytes returns the number of dirty bytes that haven't started
+// syncing yet, the total number of dirty bytes, and the current size
+// of the sync buffer.
+func (d *DirtyBlockCacheStandard) getBytes() (
+	unsynced, total, syncBufferSize int64) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.unsyncedDirtyBytes, d.totalDirtyBytes, d.syncBufferSize
+}
+
 // Shutdown implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) Shutdown() error {
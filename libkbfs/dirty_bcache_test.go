@@ -5,9 +5,11 @@
 package libkbfs
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -128,7 +130,7 @@ func TestDirtyBcacheRequestPermission(t *testing.T) {
 	ctx := context.Background()
 
 	// The first write should get immediate permission.
-	c1, err := dirtyBcache.RequestPermissionToDirty(ctx, bufSize*2+1)
+	c1, err := dirtyBcache.RequestPermissionToDirty(ctx, nil, bufSize*2+1)
 	if err != nil {
 		t.Fatalf("Request permission error: %v", err)
 	}
@@ -143,7 +145,7 @@ func TestDirtyBcacheRequestPermission(t *testing.T) {
 	}
 
 	// The next request should block
-	c2, err := dirtyBcache.RequestPermissionToDirty(ctx, bufSize)
+	c2, err := dirtyBcache.RequestPermissionToDirty(ctx, nil, bufSize)
 	if err != nil {
 		t.Fatalf("Request permission error: %v", err)
 	}
@@ -197,6 +199,99 @@ func TestDirtyBcacheRequestPermission(t *testing.T) {
 	<-c2
 }
 
+// testDirtyBcacheGrantOrder blocks the dirty cache, then makes two
+// requests to dirty data in file a and then one in file b, and
+// returns the files in the order their requests were granted.
+func testDirtyBcacheGrantOrder(t *testing.T, perWriter bool) []string {
+	bufSize := int64(5)
+	dirtyBcache := NewDirtyBlockCacheStandard(&wallClock{}, testLoggerMaker(t),
+		bufSize, bufSize*2)
+	defer dirtyBcache.Shutdown()
+	if perWriter {
+		dirtyBcache.EnablePerWriterFairness()
+	}
+	registry := metrics.NewRegistry()
+	dirtyBcache.registerMetrics(registry)
+	blockedChan := make(chan int64)
+	dirtyBcache.blockedChanForTesting = blockedChan
+	ctx := context.Background()
+
+	// Fill up the buffer.
+	c, err := dirtyBcache.RequestPermissionToDirty(ctx, nil, bufSize*2+1)
+	if err != nil {
+		t.Fatalf("Request permission error: %v", err)
+	}
+	<-c
+	if blockedSize := <-blockedChan; blockedSize != -1 {
+		t.Fatalf("Wrong blocked size: %d", blockedSize)
+	}
+
+	a, b := &nodeCore{}, &nodeCore{}
+	names := []string{"a", "a", "b"}
+	var chans []DirtyPermChan
+	for i, writer := range []NodeID{a, a, b} {
+		c, err := dirtyBcache.RequestPermissionToDirty(
+			ctx, writer, int64(i+1))
+		if err != nil {
+			t.Fatalf("Request permission error: %v", err)
+		}
+		chans = append(chans, c)
+		if i == 0 {
+			// The first request is blocked, and the other two
+			// wait behind it.
+			if blockedSize := <-blockedChan; blockedSize != 1 {
+				t.Fatalf("Wrong blocked size: %d", blockedSize)
+			}
+		}
+	}
+	gauge := registry.Get("DirtyBlockCache.WaitQueueDepth").(metrics.Gauge)
+	if depth := gauge.Value(); depth != 3 {
+		t.Fatalf("Wrong queue depth: %d", depth)
+	}
+
+	// Finish the sync; now all the requests fit, and are granted
+	// one at a time.
+	dirtyBcache.UpdateUnsyncedBytes(-(bufSize*2 + 1), false)
+	dirtyBcache.SyncFinished(bufSize*2 + 1)
+	granted := make(map[int]bool)
+	var order []string
+	for range chans {
+		if blockedSize := <-blockedChan; blockedSize != -1 {
+			t.Fatalf("Wrong blocked size: %d", blockedSize)
+		}
+		for i, c := range chans {
+			select {
+			case <-c:
+				if !granted[i] {
+					granted[i] = true
+					order = append(order, names[i])
+				}
+			default:
+			}
+		}
+	}
+	if depth := gauge.Value(); depth != 0 {
+		t.Fatalf("Wrong queue depth: %d", depth)
+	}
+	dirtyBcache.UpdateUnsyncedBytes(-6, false)
+	dirtyBcache.SyncFinished(6)
+	return order
+}
+
+func TestDirtyBcacheRequestPermissionFIFO(t *testing.T) {
+	order := testDirtyBcacheGrantOrder(t, false)
+	if !reflect.DeepEqual(order, []string{"a", "a", "b"}) {
+		t.Fatalf("Wrong grant order: %v", order)
+	}
+}
+
+func TestDirtyBcacheRequestPermissionPerWriter(t *testing.T) {
+	order := testDirtyBcacheGrantOrder(t, true)
+	if !reflect.DeepEqual(order, []string{"a", "b", "a"}) {
+		t.Fatalf("Wrong grant order: %v", order)
+	}
+}
+
 func TestDirtyBcacheCalcBackpressure(t *testing.T) {
 	bufSize := int64(10)
 	clock, now := newTestClockAndTimeNow()
@@ -96,6 +96,14 @@ func (df *dirtyFile) blockNeedsCopy(ptr BlockPointer) bool {
 	return df.fileBlockStates[ptr].copy == blockNeedsCopy
 }
 
+// pendingBytes returns the number of dirty bytes in the file that
+// haven't finished syncing yet.
+func (df *dirtyFile) pendingBytes() int64 {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.notYetSyncingBytes + df.totalSyncBytes
+}
+
 func (df *dirtyFile) updateNotYetSyncingBytes(newBytes int64) {
 	df.lock.Lock()
 	defer df.lock.Unlock()
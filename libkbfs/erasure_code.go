@@ -0,0 +1,233 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// gfPoly is the irreducible polynomial, x^8 + x^4 + x^3 + x^2 + 1,
+// defining the GF(2^8) arithmetic of erasureCode.
+const gfPoly = 0x11d
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	// Doubling the table saves a modulo in gfMul.
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be 0.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst, byte by byte.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[logC+int(gfLog[b])]
+		}
+	}
+}
+
+var errSingularMatrix = errors.New("Singular matrix")
+
+// gfInvertMatrix returns the inverse of the given square matrix, by
+// Gauss-Jordan elimination.
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	for i := range m {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingularMatrix
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv := gfInv(a[col][col])
+		for j := range a[col] {
+			a[col][j] = gfMul(a[col][j], inv)
+		}
+		for row := 0; row < n; row++ {
+			if row != col {
+				gfMulAdd(a[row], a[col], a[row][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range a {
+		inv[i] = a[i][n:]
+	}
+	return inv, nil
+}
+
+// erasureCode is a systematic Reed-Solomon code: data is split into
+// dataShards shards, and parityShards more shards are computed from
+// them, such that any dataShards of all the shards are enough to get
+// the others back.  The parity shards use a Cauchy matrix, every
+// square submatrix of which is invertible.
+type erasureCode struct {
+	dataShards   int
+	parityShards int
+	// parity[i][j] is the coefficient of data shard j in parity
+	// shard i.
+	parity [][]byte
+}
+
+// errTooFewShards indicates that too many shards were lost to
+// reconstruct the others.
+var errTooFewShards = errors.New("Too few shards to reconstruct the data")
+
+func newErasureCode(dataShards, parityShards int) (*erasureCode, error) {
+	if dataShards < 1 || parityShards < 1 ||
+		dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("Can't make a %d+%d erasure code",
+			dataShards, parityShards)
+	}
+	parity := make([][]byte, parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, dataShards)
+		for j := range parity[i] {
+			parity[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return &erasureCode{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		parity:       parity,
+	}, nil
+}
+
+func (c *erasureCode) totalShards() int {
+	return c.dataShards + c.parityShards
+}
+
+// row returns the coefficients of the data shards in the given
+// shard.
+func (c *erasureCode) row(shard int) []byte {
+	if shard >= c.dataShards {
+		return c.parity[shard-c.dataShards]
+	}
+	r := make([]byte, c.dataShards)
+	r[shard] = 1
+	return r
+}
+
+// encode splits data into equally sized data shards, padding the
+// last one with zeros, and returns them followed by the parity
+// shards.
+func (c *erasureCode) encode(data []byte) [][]byte {
+	size := (len(data) + c.dataShards - 1) / c.dataShards
+	shards := make([][]byte, c.totalShards())
+	for i := 0; i < c.dataShards; i++ {
+		shards[i] = make([]byte, size)
+		if start := i * size; start < len(data) {
+			copy(shards[i], data[start:])
+		}
+	}
+	for i := range c.parity {
+		p := make([]byte, size)
+		for j := 0; j < c.dataShards; j++ {
+			gfMulAdd(p, shards[j], c.parity[i][j])
+		}
+		shards[c.dataShards+i] = p
+	}
+	return shards
+}
+
+// reconstruct fills in the nil shards from the others, which must
+// all be the same size.  It returns errTooFewShards if fewer than
+// dataShards of them are non-nil.
+func (c *erasureCode) reconstruct(shards [][]byte) error {
+	var have []int
+	for i, shard := range shards {
+		if shard != nil {
+			have = append(have, i)
+		}
+	}
+	if len(have) < c.dataShards {
+		return errTooFewShards
+	}
+	if len(have) == len(shards) {
+		return nil
+	}
+	have = have[:c.dataShards]
+	size := len(shards[have[0]])
+
+	sub := make([][]byte, c.dataShards)
+	for r, shard := range have {
+		sub[r] = c.row(shard)
+	}
+	inv, err := gfInvertMatrix(sub)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < c.dataShards; j++ {
+		if shards[j] != nil {
+			continue
+		}
+		d := make([]byte, size)
+		for r, shard := range have {
+			gfMulAdd(d, shards[shard], inv[j][r])
+		}
+		shards[j] = d
+	}
+	for i := range c.parity {
+		if shards[c.dataShards+i] != nil {
+			continue
+		}
+		p := make([]byte, size)
+		for j := 0; j < c.dataShards; j++ {
+			gfMulAdd(p, shards[j], c.parity[i][j])
+		}
+		shards[c.dataShards+i] = p
+	}
+	return nil
+}
+
+// join returns the first size bytes of the data held by the data
+// shards.
+func (c *erasureCode) join(shards [][]byte, size int) []byte {
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:c.dataShards] {
+		data = append(data, shard...)
+	}
+	return data[:size]
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErasureCodeReconstruct(t *testing.T) {
+	code, err := newErasureCode(4, 2)
+	require.NoError(t, err)
+	data := make([]byte, 1001)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := code.encode(data)
+	require.Len(t, encoded, 6)
+	require.Equal(t, data, code.join(encoded, len(data)))
+
+	// Any two shards can be lost.
+	for i := 0; i < 6; i++ {
+		for j := i; j < 6; j++ {
+			shards := make([][]byte, len(encoded))
+			copy(shards, encoded)
+			shards[i] = nil
+			shards[j] = nil
+			require.NoError(t, code.reconstruct(shards))
+			require.Equal(t, encoded, shards, "lost %d and %d", i, j)
+			require.Equal(t, data, code.join(shards, len(data)))
+		}
+	}
+
+	shards := make([][]byte, len(encoded))
+	copy(shards, encoded)
+	shards[0], shards[2], shards[5] = nil, nil, nil
+	require.Equal(t, errTooFewShards, code.reconstruct(shards))
+}
+
+func TestErasureCodeBadParams(t *testing.T) {
+	_, err := newErasureCode(0, 2)
+	require.Error(t, err)
+	_, err = newErasureCode(250, 10)
+	require.Error(t, err)
+}
@@ -505,6 +505,21 @@ func (e TLFEphemeralPublicKeyNotFoundError) Error() string {
 		"user %s, device KID %v", e.uid, e.kid)
 }
 
+// TLFEphemeralPublicKeyIndexError indicates that the ephemeral public
+// key index for the user and device KID is out of range for its key
+// bundle.
+type TLFEphemeralPublicKeyIndexError struct {
+	uid   keybase1.UID
+	kid   keybase1.KID
+	index int
+}
+
+// Error implements the error interface for TLFEphemeralPublicKeyIndexError.
+func (e TLFEphemeralPublicKeyIndexError) Error() string {
+	return fmt.Sprintf("Invalid ephemeral public key index %d for "+
+		"user %s, device KID %v", e.index, e.uid, e.kid)
+}
+
 // KeyNotFoundError indicates that a key matching the given KID
 // couldn't be found.
 type KeyNotFoundError struct {
@@ -516,6 +531,36 @@ func (e KeyNotFoundError) Error() string {
 	return fmt.Sprintf("Could not find key with kid=%s", e.kid)
 }
 
+// MDChainVerificationError indicates that an MDChain failed
+// verification at the given revision.
+type MDChainVerificationError struct {
+	Revision MetadataRevision
+	Reason   string
+}
+
+// Error implements the error interface for MDChainVerificationError.
+func (e MDChainVerificationError) Error() string {
+	return fmt.Sprintf("MD chain entry for revision %d %s", e.Revision,
+		e.Reason)
+}
+
+// MDServerEquivocationError indicates that the MD server served a
+// merged history of the given folder that contradicts an earlier view
+// of it, from the KBFS Merkle tree or from this device, at the given
+// revision.  The server has either rolled the folder back, or shown
+// different clients different forks of it.
+type MDServerEquivocationError struct {
+	Tlf      TlfID
+	Revision MetadataRevision
+	Reason   string
+}
+
+// Error implements the error interface for MDServerEquivocationError.
+func (e MDServerEquivocationError) Error() string {
+	return fmt.Sprintf("The MD server equivocated about revision %d of "+
+		"%s: %s", e.Revision, e.Tlf, e.Reason)
+}
+
 // UnverifiableTlfUpdateError indicates that a MD update could not be
 // verified.
 type UnverifiableTlfUpdateError struct {
@@ -813,6 +858,42 @@ func (e NotPermittedWhileDirtyError) Error() string {
 	return "Not permitted while writes are dirty"
 }
 
+// UnflushedLogoutError indicates that a logout was refused, because
+// the dirty data in some folders couldn't be flushed or journaled.
+// Nothing was torn down, and the logout may be retried once the data
+// can be flushed.
+type UnflushedLogoutError struct {
+	Folders []FolderBranch
+	Err     error
+}
+
+// Error implements the error interface for UnflushedLogoutError.
+func (e UnflushedLogoutError) Error() string {
+	return fmt.Sprintf("Can't log out until the dirty data in %v is "+
+		"flushed: %v", e.Folders, e.Err)
+}
+
+// WriteBackJournalFullError indicates that a sync would have taken
+// the write-back journal over one of its limits, so it was written
+// through to the servers instead.
+type WriteBackJournalFullError struct {
+	Limit uint64
+	// Total is true if the limit is on the journals of all
+	// folders together, rather than on just this folder's.
+	Total bool
+}
+
+// Error implements the error interface for WriteBackJournalFullError.
+func (e WriteBackJournalFullError) Error() string {
+	which := "this folder's write-back journal"
+	if e.Total {
+		which = "all the write-back journals"
+	}
+	return fmt.Sprintf("The %d-byte limit on %s has been reached; "+
+		"syncing straight to the servers until there's room again",
+		e.Limit, which)
+}
+
 // NoChainFoundError indicates that a conflict resolution chain
 // corresponding to the given pointer could not be found.
 type NoChainFoundError struct {
@@ -851,6 +932,203 @@ func (e FileTooBigError) Error() string {
 		"over the supported limit of %d bytes", e.p, e.size, e.maxAllowedBytes)
 }
 
+// SeekPastEOFError indicates that the user tried to find the next
+// data or hole in a file at or past its end, or to find data past
+// the last data in the file.
+type SeekPastEOFError struct {
+	p   path
+	off int64
+}
+
+// Error implements the error interface for SeekPastEOFError.
+func (e SeekPastEOFError) Error() string {
+	return fmt.Sprintf("No more data or holes in %s at or after offset %d",
+		e.p, e.off)
+}
+
+// InvalidRangeError indicates that the user gave a negative offset,
+// or a length that isn't positive, for a range of a file.
+type InvalidRangeError struct {
+	off    int64
+	length int64
+}
+
+// Error implements the error interface for InvalidRangeError.
+func (e InvalidRangeError) Error() string {
+	return fmt.Sprintf("Invalid range of length %d at offset %d",
+		e.length, e.off)
+}
+
+// NoSuchXattrError indicates that the user tried to get or remove
+// an extended attribute that doesn't exist.
+type NoSuchXattrError struct {
+	name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("No such extended attribute: %s", e.name)
+}
+
+// XattrExistsError indicates that the user tried to create an
+// extended attribute that already exists.
+type XattrExistsError struct {
+	name string
+}
+
+// Error implements the error interface for XattrExistsError.
+func (e XattrExistsError) Error() string {
+	return fmt.Sprintf("Extended attribute %s already exists", e.name)
+}
+
+// XattrNameTooLongError indicates that the user tried to use an
+// extended attribute name that is bigger than KBFS's supported size.
+type XattrNameTooLongError struct {
+	name            string
+	maxAllowedBytes uint32
+}
+
+// Error implements the error interface for XattrNameTooLongError.
+func (e XattrNameTooLongError) Error() string {
+	return fmt.Sprintf("Extended attribute name %s has more than the "+
+		"maximum allowed number of bytes (%d)", e.name, e.maxAllowedBytes)
+}
+
+// XattrTooBigError indicates that the user tried to set an extended
+// attribute value that is bigger than KBFS's supported size.
+type XattrTooBigError struct {
+	name            string
+	size            int
+	maxAllowedBytes uint32
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Value of extended attribute %s (%d bytes) is over "+
+		"the supported limit of %d bytes", e.name, e.size, e.maxAllowedBytes)
+}
+
+// FileLockConflictError indicates that the user tried to take an
+// advisory lock on a file that conflicts with a lock held by someone
+// else.
+type FileLockConflictError struct {
+	file string
+	lock FileLock
+}
+
+// Error implements the error interface for FileLockConflictError.
+func (e FileLockConflictError) Error() string {
+	return fmt.Sprintf("Someone else holds a lock on %s that conflicts "+
+		"with a %s lock on bytes %d-%d", e.file, e.lock.Type,
+		e.lock.Start, e.lock.End)
+}
+
+// DeletionNotConfirmedError indicates that the user tried to delete
+// more from a shared folder than the DeletionGuard allows without
+// confirmation, and the deletion was refused or canceled.
+type DeletionNotConfirmedError struct {
+	deletion LargeDeletion
+}
+
+// Error implements the error interface for DeletionNotConfirmedError.
+func (e DeletionNotConfirmedError) Error() string {
+	return fmt.Sprintf("Deletion of %d entries (%d bytes) from %s "+
+		"was not confirmed", e.deletion.Entries, e.deletion.Bytes,
+		e.deletion.Folder)
+}
+
+// FolderFrozenError indicates that a shared folder was frozen on this
+// device, after its AnomalyDetector noticed suspicious activity by
+// one of its writers.  Updates from the server aren't applied to a
+// frozen folder, and it can't be written to, until it's unfrozen.
+type FolderFrozenError struct {
+	Folder  CanonicalTlfName
+	Writer  libkb.NormalizedUsername
+	Anomaly ActivityAnomaly
+}
+
+// Error implements the error interface for FolderFrozenError.
+func (e FolderFrozenError) Error() string {
+	return fmt.Sprintf("Folder %s was frozen after %s made %d deletions "+
+		"and %d rewrites of existing files, starting at revision %d.  "+
+		"Review the folder's update history, restore its files from "+
+		"revision %d if needed, and then unfreeze it", e.Folder, e.Writer,
+		e.Anomaly.Deletions, e.Anomaly.Rewrites, e.Anomaly.Since,
+		e.Anomaly.Since-1)
+}
+
+// FolderArchivedError indicates that the user tried to modify a
+// folder that has been archived, and so can never be changed again.
+type FolderArchivedError struct {
+	Folder CanonicalTlfName
+}
+
+// Error implements the error interface for FolderArchivedError.
+func (e FolderArchivedError) Error() string {
+	return fmt.Sprintf("Folder %s has been archived, and can't be "+
+		"modified anymore", e.Folder)
+}
+
+// FolderQuotaExceededError indicates that the user tried to write
+// more to a folder than its writers allow it to use.
+type FolderQuotaExceededError struct {
+	Folder CanonicalTlfName
+	Usage  uint64
+	Limit  uint64
+}
+
+// Error implements the error interface for FolderQuotaExceededError.
+func (e FolderQuotaExceededError) Error() string {
+	return fmt.Sprintf("Folder %s would use %d bytes, but its writers "+
+		"limited it to %d bytes", e.Folder, e.Usage, e.Limit)
+}
+
+// InvalidTLFArchiveError indicates that a TLF archive being imported
+// is malformed, or wasn't exported from the folder it's being
+// imported into.
+type InvalidTLFArchiveError struct {
+	Reason string
+}
+
+// Error implements the error interface for InvalidTLFArchiveError.
+func (e InvalidTLFArchiveError) Error() string {
+	return fmt.Sprintf("Invalid TLF archive: %s", e.Reason)
+}
+
+// FolderNotEmptyError indicates that the user tried to import an
+// archive into a folder that already has contents.
+type FolderNotEmptyError struct {
+	Folder CanonicalTlfName
+}
+
+// Error implements the error interface for FolderNotEmptyError.
+func (e FolderNotEmptyError) Error() string {
+	return fmt.Sprintf("Folder %s is not empty, so nothing can be "+
+		"imported into it", e.Folder)
+}
+
+// InvalidTrashPathError indicates that the user tried to restore
+// something from a folder's trash by a path that isn't of the form
+// <removal time>/<original path>.
+type InvalidTrashPathError struct {
+	Path string
+}
+
+// Error implements the error interface for InvalidTrashPathError.
+func (e InvalidTrashPathError) Error() string {
+	return fmt.Sprintf("%q is not a path in the trash", e.Path)
+}
+
+// HardLinkAcrossFoldersError indicates that the user tried to link a
+// file into a different top-level folder.
+type HardLinkAcrossFoldersError struct {
+}
+
+// Error implements the error interface for HardLinkAcrossFoldersError.
+func (e HardLinkAcrossFoldersError) Error() string {
+	return "Cannot link files across folders"
+}
+
 // NameTooLongError indicates that the user tried to write a directory
 // entry name that would be bigger than KBFS's supported size.
 type NameTooLongError struct {
@@ -879,6 +1157,22 @@ func (e DirTooBigError) Error() string {
 		e.size, e.maxAllowedBytes)
 }
 
+// DirTooManyEntriesError indicates that the user tried to add an
+// entry to a directory that already has as many entries as KBFS
+// supports.
+type DirTooManyEntriesError struct {
+	p                 path
+	entries           int
+	maxAllowedEntries int
+}
+
+// Error implements the error interface for DirTooManyEntriesError.
+func (e DirTooManyEntriesError) Error() string {
+	return fmt.Sprintf("Directory %s would have increased to %d entries, "+
+		"which is over the supported limit of %d entries", e.p,
+		e.entries, e.maxAllowedEntries)
+}
+
 // TlfNameNotCanonical indicates that a name isn't a canonical, and
 // that another (not necessarily canonical) name should be tried.
 type TlfNameNotCanonical struct {
@@ -1044,6 +1338,16 @@ func (e MetadataIsFinalError) Error() string {
 	return "Metadata is final"
 }
 
+// MetadataIsArchivedError indicates that we tried to make or set a
+// successor to the last revision of an archived folder.
+type MetadataIsArchivedError struct {
+}
+
+// Error implements the error interface for MetadataIsArchivedError.
+func (e MetadataIsArchivedError) Error() string {
+	return "Metadata is archived"
+}
+
 // IncompatibleHandleError indicates that somethine tried to update
 // the head of a TLF with a RootMetadata with an incompatible handle.
 type IncompatibleHandleError struct {
@@ -1057,3 +1361,96 @@ func (e IncompatibleHandleError) Error() string {
 		"old head %q resolves to %q instead of new head %q",
 		e.oldName, e.partiallyResolvedOldName, e.newName)
 }
+
+// InstanceInUseError indicates that another running KBFS process
+// already owns the state directory this process wanted to use.
+type InstanceInUseError struct {
+	Path string
+	PID  int
+}
+
+// Error implements the error interface for InstanceInUseError.
+func (e InstanceInUseError) Error() string {
+	return fmt.Sprintf("KBFS is already running as pid %d (lock %s); "+
+		"use -takeover to replace it", e.PID, e.Path)
+}
+
+// ReadOnlyBranchError indicates that the user tried to modify a
+// folder-branch that this KBFS instance only serves for reading.
+type ReadOnlyBranchError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for ReadOnlyBranchError.
+func (e ReadOnlyBranchError) Error() string {
+	return fmt.Sprintf("Folder %s is read-only on this device",
+		e.FolderBranch)
+}
+
+// DeviceRevokedError indicates that the current device has been
+// revoked, so any writes it makes would be rejected by the servers.
+type DeviceRevokedError struct {
+	Username libkb.NormalizedUsername
+}
+
+// Error implements the error interface for DeviceRevokedError.
+func (e DeviceRevokedError) Error() string {
+	return fmt.Sprintf("This device has been revoked by user %s, and can "+
+		"no longer write to any folder", e.Username)
+}
+
+// ContentManifestMismatchError indicates that a copy of a directory
+// tree doesn't match its content manifest.
+type ContentManifestMismatchError struct {
+	Path   string
+	Reason string
+}
+
+// Error implements the error interface for ContentManifestMismatchError.
+func (e ContentManifestMismatchError) Error() string {
+	return fmt.Sprintf("%s doesn't match the manifest: %s", e.Path, e.Reason)
+}
+
+// InvalidPaperKeyError indicates that a paper key phrase couldn't be
+// parsed.
+type InvalidPaperKeyError struct {
+	Reason string
+}
+
+// Error implements the error interface for InvalidPaperKeyError.
+func (e InvalidPaperKeyError) Error() string {
+	return fmt.Sprintf("Invalid paper key: %s", e.Reason)
+}
+
+// IntegrityCheckError indicates that the background integrity checker
+// found a block of a fully-synced folder that the block server can no
+// longer serve intact, or that doesn't match this device's copy.
+type IntegrityCheckError struct {
+	Tlf    CanonicalTlfName
+	Public bool
+	Ptr    BlockPointer
+	Reason string
+}
+
+// Error implements the error interface for IntegrityCheckError.
+func (e IntegrityCheckError) Error() string {
+	return fmt.Sprintf("Integrity check of block %v in folder %s "+
+		"failed: %s", e.Ptr, e.Tlf, e.Reason)
+}
+
+// FaultInjectedError is returned by a BlockServerFaulty or
+// MDServerFaulty call that its FaultPolicy made fail.  If Partial is
+// true, the call did reach the server and take effect, but its reply
+// was lost.
+type FaultInjectedError struct {
+	Method  string
+	Partial bool
+}
+
+// Error implements the error interface for FaultInjectedError.
+func (e FaultInjectedError) Error() string {
+	if e.Partial {
+		return fmt.Sprintf("Injected fault: lost the reply to %s", e.Method)
+	}
+	return fmt.Sprintf("Injected fault: %s failed", e.Method)
+}
@@ -9,7 +9,7 @@ package libkbfs
 import (
 	"syscall"
 
-	"bazil.org/fuse"
+	"github.com/keybase/kbfs/fuse"
 )
 
 var _ fuse.ErrorNumber = NoSuchUserError{""}
@@ -103,6 +103,14 @@ func (e DirTooBigError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.EFBIG)
 }
 
+var _ fuse.ErrorNumber = DirTooManyEntriesError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// DirTooManyEntriesError.
+func (e DirTooManyEntriesError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EFBIG)
+}
+
 var _ fuse.ErrorNumber = NoCurrentSessionError{}
 
 // Errno implements the fuse.ErrorNumber interface for NoCurrentSessionError.
@@ -124,3 +132,122 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = ReadOnlyBranchError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ReadOnlyBranchError.
+func (e ReadOnlyBranchError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = DeviceRevokedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// DeviceRevokedError.
+func (e DeviceRevokedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = SeekPastEOFError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// SeekPastEOFError.
+func (e SeekPastEOFError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENXIO)
+}
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrExistsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrExistsError.
+func (e XattrExistsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EEXIST)
+}
+
+var _ fuse.ErrorNumber = XattrNameTooLongError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrNameTooLongError.
+func (e XattrNameTooLongError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ERANGE)
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = FileLockConflictError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FileLockConflictError.
+func (e FileLockConflictError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
+var _ fuse.ErrorNumber = DeletionNotConfirmedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// DeletionNotConfirmedError.
+func (e DeletionNotConfirmedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
+
+var _ fuse.ErrorNumber = FolderFrozenError{}
+
+// Errno implements the fuse.ErrorNumber interface for FolderFrozenError.
+func (e FolderFrozenError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = FolderArchivedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FolderArchivedError.
+func (e FolderArchivedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorArchived{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorArchived.
+func (e MDServerErrorArchived) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = FolderQuotaExceededError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// FolderQuotaExceededError.
+func (e FolderQuotaExceededError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EDQUOT)
+}
+
+var _ fuse.ErrorNumber = HardLinkAcrossFoldersError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// HardLinkAcrossFoldersError.
+func (e HardLinkAcrossFoldersError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = InvalidTrashPathError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// InvalidTrashPathError.
+func (e InvalidTrashPathError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EINVAL)
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind identifies the type of an Event.
+type EventKind int
+
+const (
+	// EventBlockFetched is published when a block is fetched from
+	// the block server (i.e., it wasn't in any cache).
+	EventBlockFetched EventKind = iota
+	// EventMDApplied is published when a folder-branch applies an
+	// MD update written by another device.
+	EventMDApplied
+	// EventCRStarted is published when conflict resolution starts
+	// a resolution attempt.
+	EventCRStarted
+	// EventCRFinished is published when a conflict resolution
+	// attempt ends, successfully or not.
+	EventCRFinished
+	// EventFileSynced is published when a file's dirty data has
+	// been flushed to the servers.
+	EventFileSynced
+	// EventMDServerEquivocated is published when the MD server is
+	// caught serving a folder history that contradicts an earlier
+	// view of it.
+	EventMDServerEquivocated
+	// EventFolderSyncStatus is published as a folder syncs its
+	// files to the servers: when each file's sync starts and ends,
+	// and as its data is flushed.
+	EventFolderSyncStatus
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventBlockFetched:
+		return "BlockFetched"
+	case EventMDApplied:
+		return "MDApplied"
+	case EventCRStarted:
+		return "CRStarted"
+	case EventCRFinished:
+		return "CRFinished"
+	case EventFileSynced:
+		return "FileSynced"
+	case EventMDServerEquivocated:
+		return "MDServerEquivocated"
+	case EventFolderSyncStatus:
+		return "FolderSyncStatus"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event describes something that happened inside libkbfs.  Only the
+// fields relevant to the Kind are set.
+type Event struct {
+	Kind EventKind
+	// Time is when the event happened.  If it's zero when the event
+	// is published, it's filled in by the EventBus.
+	Time         time.Time
+	FolderBranch FolderBranch
+	// Ptr is the block involved, for EventBlockFetched and
+	// EventFileSynced (where it's the file's new pointer).
+	Ptr BlockPointer
+	// Revision is the MD revision involved, for EventMDApplied and
+	// EventMDServerEquivocated.
+	Revision MetadataRevision
+	// Err is the result of the operation, for EventCRFinished, or
+	// the MDServerEquivocationError, for EventMDServerEquivocated.
+	Err error
+	// SyncStatus is the folder's progress, for
+	// EventFolderSyncStatus.
+	SyncStatus *FolderSyncStatus
+}
+
+// EventSubscription is a registration for events with an EventBus.
+type EventSubscription struct {
+	// C receives the events.  It's closed by Unsubscribe.
+	C <-chan Event
+
+	bus   *EventBusStandard
+	c     chan Event
+	kinds map[EventKind]bool
+
+	// dropped is protected by bus.lock.
+	dropped uint64
+}
+
+func (s *EventSubscription) wants(k EventKind) bool {
+	return len(s.kinds) == 0 || s.kinds[k]
+}
+
+// Unsubscribe stops the delivery of events to s, and closes s.C.
+// It is safe to call more than once.
+func (s *EventSubscription) Unsubscribe() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	if _, ok := s.bus.subs[s]; !ok {
+		return
+	}
+	delete(s.bus.subs, s)
+	close(s.c)
+}
+
+// Dropped returns the number of events this subscription missed
+// because its buffer was full.
+func (s *EventSubscription) Dropped() uint64 {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	return s.dropped
+}
+
+// EventBusStandard implements the EventBus interface by fanning each
+// event out to the buffered channels of all matching subscriptions.
+type EventBusStandard struct {
+	config Config
+
+	lock sync.Mutex
+	subs map[*EventSubscription]bool
+}
+
+var _ EventBus = (*EventBusStandard)(nil)
+
+// NewEventBusStandard creates a new EventBusStandard with no
+// subscribers.
+func NewEventBusStandard(config Config) *EventBusStandard {
+	return &EventBusStandard{
+		config: config,
+		subs:   make(map[*EventSubscription]bool),
+	}
+}
+
+func (eb *EventBusStandard) hasSubscribers() bool {
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	return len(eb.subs) > 0
+}
+
+// Publish implements the EventBus interface for EventBusStandard.
+func (eb *EventBusStandard) Publish(e Event) {
+	if !eb.hasSubscribers() {
+		return
+	}
+	// Don't hold up other publishers while reading the clock.
+	if e.Time.IsZero() {
+		e.Time = eb.config.Clock().Now()
+	}
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	for s := range eb.subs {
+		if !s.wants(e.Kind) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Subscribe implements the EventBus interface for EventBusStandard.
+func (eb *EventBusStandard) Subscribe(
+	bufSize int, kinds ...EventKind) *EventSubscription {
+	c := make(chan Event, bufSize)
+	s := &EventSubscription{
+		C:     c,
+		bus:   eb,
+		c:     c,
+		kinds: make(map[EventKind]bool),
+	}
+	for _, k := range kinds {
+		s.kinds[k] = true
+	}
+	eb.lock.Lock()
+	defer eb.lock.Unlock()
+	eb.subs[s] = true
+	return s
+}
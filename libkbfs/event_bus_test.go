@@ -0,0 +1,103 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusSubscribe(t *testing.T) {
+	config := NewConfigLocal()
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	eb := NewEventBusStandard(config)
+
+	all := eb.Subscribe(10)
+	cr := eb.Subscribe(1, EventCRStarted, EventCRFinished)
+
+	eb.Publish(Event{Kind: EventBlockFetched})
+	eb.Publish(Event{Kind: EventCRStarted})
+	eb.Publish(Event{Kind: EventCRFinished})
+
+	require.Len(t, all.C, 3)
+	e := <-all.C
+	require.Equal(t, EventBlockFetched, e.Kind)
+	require.Equal(t, now, e.Time)
+
+	// The CR subscription only had room for one of its two events.
+	require.Len(t, cr.C, 1)
+	e = <-cr.C
+	require.Equal(t, EventCRStarted, e.Kind)
+	require.Equal(t, uint64(1), cr.Dropped())
+	require.Equal(t, uint64(0), all.Dropped())
+
+	cr.Unsubscribe()
+	cr.Unsubscribe()
+	_, ok := <-cr.C
+	require.False(t, ok)
+	eb.Publish(Event{Kind: EventCRStarted})
+	require.Len(t, all.C, 3)
+}
+
+func TestEventBusPublishedByOps(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fb := rootNode1.GetFolderBranch()
+
+	sub1 := config1.EventBus().Subscribe(10, EventFileSynced)
+	defer sub1.Unsubscribe()
+	sub2 := config2.EventBus().Subscribe(10, EventMDApplied, EventBlockFetched)
+	defer sub2.Unsubscribe()
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	// Syncing a clean file doesn't publish anything.
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	require.Len(t, sub1.C, 1)
+	e := <-sub1.C
+	require.Equal(t, EventFileSynced, e.Kind)
+	require.Equal(t, fb, e.FolderBranch)
+	require.Equal(t, fileNode1.(*nodeStandard).core.pathNode.BlockPointer,
+		e.Ptr)
+
+	// The other device applies the update, and fetches the new
+	// file's block when reading it.
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	e = <-sub2.C
+	require.Equal(t, EventMDApplied, e.Kind)
+	require.Equal(t, fb, e.FolderBranch)
+	require.True(t, e.Revision > MetadataRevisionUninitialized)
+
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	var fetched []BlockPointer
+	for len(sub2.C) > 0 {
+		e := <-sub2.C
+		if e.Kind == EventBlockFetched {
+			fetched = append(fetched, e.Ptr)
+		}
+	}
+	require.Contains(t, fetched,
+		fileNode2.(*nodeStandard).core.pathNode.BlockPointer)
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// FaultSpec says how calls to a server method misbehave.  Rates are
+// fractions, from 0 to 1, of the calls.
+type FaultSpec struct {
+	// Latency is added to every call, and lengthened by up to
+	// Jitter at random.
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the rate of calls that fail with a
+	// FaultInjectedError without reaching the server.
+	ErrorRate float64
+	// PartialRate is the rate of calls that reach the server and
+	// take effect, but then fail with a FaultInjectedError as if
+	// the reply was lost.
+	PartialRate float64
+	// ReorderRate is the rate of calls held back for an extra
+	// ReorderDelay, so that calls made after them can overtake
+	// them.
+	ReorderRate  float64
+	ReorderDelay time.Duration
+}
+
+// String implements the fmt.Stringer interface for FaultSpec, in the
+// form parsed by ParseFaultPolicy.
+func (s FaultSpec) String() string {
+	var fields []string
+	if s.Latency > 0 {
+		fields = append(fields, "latency="+s.Latency.String())
+	}
+	if s.Jitter > 0 {
+		fields = append(fields, "jitter="+s.Jitter.String())
+	}
+	if s.ErrorRate > 0 {
+		fields = append(fields,
+			"err="+strconv.FormatFloat(s.ErrorRate, 'g', -1, 64))
+	}
+	if s.PartialRate > 0 {
+		fields = append(fields,
+			"partial="+strconv.FormatFloat(s.PartialRate, 'g', -1, 64))
+	}
+	if s.ReorderRate > 0 {
+		fields = append(fields,
+			"reorder="+strconv.FormatFloat(s.ReorderRate, 'g', -1, 64))
+	}
+	if s.ReorderDelay > 0 {
+		fields = append(fields, "reorder-delay="+s.ReorderDelay.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// FaultPolicy says which faults a BlockServerFaulty or MDServerFaulty
+// injects into the calls made through it.
+type FaultPolicy struct {
+	// Default applies to the calls not matched by Methods.
+	Default FaultSpec
+	// Methods maps either a method, like "BlockServer.Put", or a
+	// whole server, like "MDServer", to the faults for its calls.
+	// A method's entry takes precedence over its server's.
+	Methods map[string]FaultSpec
+}
+
+// IsEmpty returns true if the policy injects no faults at all.
+func (p FaultPolicy) IsEmpty() bool {
+	return p.Default == (FaultSpec{}) && len(p.Methods) == 0
+}
+
+// spec returns the faults for calls to the given method, named as
+// "Server.Method".
+func (p FaultPolicy) spec(method string) FaultSpec {
+	if s, ok := p.Methods[method]; ok {
+		return s
+	}
+	if i := strings.Index(method, "."); i >= 0 {
+		if s, ok := p.Methods[method[:i]]; ok {
+			return s
+		}
+	}
+	return p.Default
+}
+
+func parseFaultRate(kv []string) (float64, error) {
+	rate, err := strconv.ParseFloat(kv[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("Fault rate %s=%s isn't between 0 and 1",
+			kv[0], kv[1])
+	}
+	return rate, nil
+}
+
+// ParseFaultPolicy parses a comma-separated list of fault specs, each
+// given as "NAME [latency=DUR] [jitter=DUR] [err=RATE]
+// [partial=RATE] [reorder=RATE] [reorder-delay=DUR]", where NAME is a
+// method like "MDServer.Put", a server like "BlockServer", or "*" for
+// the default, e.g. "* latency=20ms, MDServer.Put err=0.1".  An empty
+// string means no faults.
+func ParseFaultPolicy(s string) (FaultPolicy, error) {
+	var policy FaultPolicy
+	for _, str := range strings.Split(s, ",") {
+		fields := strings.Fields(str)
+		if len(fields) == 0 {
+			continue
+		}
+		var spec FaultSpec
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return FaultPolicy{}, fmt.Errorf("Unknown fault %q", field)
+			}
+			var err error
+			switch kv[0] {
+			case "latency":
+				spec.Latency, err = time.ParseDuration(kv[1])
+			case "jitter":
+				spec.Jitter, err = time.ParseDuration(kv[1])
+			case "err":
+				spec.ErrorRate, err = parseFaultRate(kv)
+			case "partial":
+				spec.PartialRate, err = parseFaultRate(kv)
+			case "reorder":
+				spec.ReorderRate, err = parseFaultRate(kv)
+			case "reorder-delay":
+				spec.ReorderDelay, err = time.ParseDuration(kv[1])
+			default:
+				err = fmt.Errorf("Unknown fault %q", field)
+			}
+			if err != nil {
+				return FaultPolicy{}, err
+			}
+		}
+		if fields[0] == "*" {
+			policy.Default = spec
+			continue
+		}
+		if policy.Methods == nil {
+			policy.Methods = make(map[string]FaultSpec)
+		}
+		policy.Methods[fields[0]] = spec
+	}
+	return policy, nil
+}
+
+// String implements the fmt.Stringer interface for FaultPolicy, in
+// the form parsed by ParseFaultPolicy.
+func (p FaultPolicy) String() string {
+	var strs []string
+	if p.Default != (FaultSpec{}) {
+		strs = append(strs, strings.TrimSpace("* "+p.Default.String()))
+	}
+	names := make([]string, 0, len(p.Methods))
+	for name := range p.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		strs = append(strs,
+			strings.TrimSpace(name+" "+p.Methods[name].String()))
+	}
+	return strings.Join(strs, ", ")
+}
+
+// faultInjector applies the FaultPolicy of a config to calls made
+// to a server.
+type faultInjector struct {
+	config Config
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func newFaultInjector(config Config) *faultInjector {
+	return &faultInjector{
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// roll decides, for one call following the given spec, how long to
+// hold it back and whether it fails before or after reaching the
+// server.
+func (f *faultInjector) roll(spec FaultSpec) (
+	delay time.Duration, fail, partial bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delay = spec.Latency
+	if spec.Jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(spec.Jitter) + 1))
+	}
+	if f.rand.Float64() < spec.ReorderRate {
+		delay += spec.ReorderDelay
+	}
+	fail = f.rand.Float64() < spec.ErrorRate
+	partial = f.rand.Float64() < spec.PartialRate
+	return delay, fail, partial
+}
+
+// inject makes the given call to the given method, named as
+// "Server.Method", with the faults the config's FaultPolicy asks for.
+func (f *faultInjector) inject(ctx context.Context, method string,
+	call func() error) error {
+	delay, fail, partial := f.roll(f.config.FaultPolicy().spec(method))
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return FaultInjectedError{Method: method}
+	}
+	if err := call(); err != nil {
+		return err
+	}
+	if partial {
+		return FaultInjectedError{Method: method, Partial: true}
+	}
+	return nil
+}
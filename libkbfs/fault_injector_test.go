@@ -0,0 +1,106 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseFaultPolicy(t *testing.T) {
+	p, err := ParseFaultPolicy("")
+	require.NoError(t, err)
+	require.True(t, p.IsEmpty())
+
+	const s = "* latency=20ms jitter=10ms, MDServer.Put err=0.1 " +
+		"partial=0.05, BlockServer reorder=0.5 reorder-delay=1s"
+	p, err = ParseFaultPolicy(s)
+	require.NoError(t, err)
+	require.Equal(t, FaultSpec{
+		Latency: 20 * time.Millisecond,
+		Jitter:  10 * time.Millisecond,
+	}, p.Default)
+	require.Equal(t, FaultSpec{ErrorRate: 0.1, PartialRate: 0.05},
+		p.spec("MDServer.Put"))
+	require.Equal(t, p.Default, p.spec("MDServer.GetForTLF"))
+	require.Equal(t, FaultSpec{ReorderRate: 0.5, ReorderDelay: time.Second},
+		p.spec("BlockServer.Get"))
+
+	// The string form round-trips.
+	p2, err := ParseFaultPolicy(p.String())
+	require.NoError(t, err)
+	require.Equal(t, p, p2)
+
+	_, err = ParseFaultPolicy("* err=2")
+	require.Error(t, err)
+	_, err = ParseFaultPolicy("* latency")
+	require.Error(t, err)
+	_, err = ParseFaultPolicy("* bogus=1")
+	require.Error(t, err)
+}
+
+func TestBlockServerFaulty(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+
+	mem := NewBlockServerMemory(config)
+	b := NewBlockServerFaulty(mem, config)
+	defer b.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3}
+	id, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+
+	// Failed calls never reach the server.
+	config.SetFaultPolicy(FaultPolicy{
+		Methods: map[string]FaultSpec{
+			"BlockServer.Put": {ErrorRate: 1},
+		},
+	})
+	err = b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	require.Equal(t, FaultInjectedError{Method: "BlockServer.Put"}, err)
+	_, _, err = mem.Get(ctx, id, tlfID, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+
+	// Partially-failed calls do.
+	config.SetFaultPolicy(FaultPolicy{
+		Default: FaultSpec{PartialRate: 1},
+	})
+	err = b.Put(ctx, id, tlfID, bCtx, data, serverHalf)
+	require.Equal(t,
+		FaultInjectedError{Method: "BlockServer.Put", Partial: true}, err)
+	buf, _, err := mem.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// Latency is added, and can be cut short by the context.
+	config.SetFaultPolicy(FaultPolicy{
+		Default: FaultSpec{Latency: 50 * time.Millisecond},
+	})
+	start := time.Now()
+	buf, _, err = b.Get(ctx, id, tlfID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	config.SetFaultPolicy(FaultPolicy{
+		Default: FaultSpec{Latency: time.Hour},
+	})
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = b.Get(cancelCtx, id, tlfID, bCtx)
+	require.Equal(t, context.Canceled, err)
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol"
 
@@ -24,6 +25,29 @@ func (f favToAdd) toKBFolder() keybase1.Folder {
 	return f.Favorite.toKBFolder(f.created)
 }
 
+// FavoriteMetadata is what this device knows about a favorite
+// folder, so that it can be listed without loading the folder.
+type FavoriteMetadata struct {
+	// LastAccess is when the folder was last accessed on this
+	// device, or zero if it hasn't been.
+	LastAccess time.Time
+	// DiskUsage is how many bytes the folder's blocks take up, as
+	// of the latest revision this device has seen; that's how much
+	// a full sync keeps on this device.
+	DiskUsage uint64
+	// SyncMode is how much of the folder is kept on this device.
+	SyncMode TlfSyncMode
+	// Unread is whether another device has changed the folder
+	// since it was last accessed on this device.
+	Unread bool
+}
+
+// FavoriteInfo is a favorite folder along with its metadata.
+type FavoriteInfo struct {
+	Favorite
+	FavoriteMetadata
+}
+
 // favReq represents a request to access the logged-in user's
 // favorites list.  A single request can do one or more of the
 // following: refresh the current cached list, add a favorite, remove
@@ -62,6 +86,11 @@ type Favorites struct {
 	inFlightLock sync.Mutex
 	inFlightAdds map[favToAdd]*favReq
 
+	// metaLock protects meta, the latest metadata recorded for
+	// each favorite.
+	metaLock sync.Mutex
+	meta     map[Favorite]FavoriteMetadata
+
 	muShutdown sync.RWMutex
 	shutdown   bool
 }
@@ -71,6 +100,7 @@ func newFavoritesWithChan(config Config, reqChan chan *favReq) *Favorites {
 		config:       config,
 		reqChan:      reqChan,
 		inFlightAdds: make(map[favToAdd]*favReq),
+		meta:         make(map[Favorite]FavoriteMetadata),
 	}
 	go f.loop()
 	return f
@@ -138,6 +168,7 @@ func (f *Favorites) handleReq(req *favReq) (err error) {
 			return err
 		}
 		delete(f.cache, fav)
+		f.deleteMetadata(fav)
 	}
 
 	if req.favs != nil {
@@ -312,3 +343,45 @@ func (f *Favorites) Get(ctx context.Context) ([]Favorite, error) {
 	}
 	return <-favChan, nil
 }
+
+// updateMetadata changes the recorded metadata of the given
+// favorite, which starts out zero.
+func (f *Favorites) updateMetadata(fav Favorite,
+	update func(*FavoriteMetadata)) {
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+	md := f.meta[fav]
+	update(&md)
+	f.meta[fav] = md
+}
+
+func (f *Favorites) deleteMetadata(fav Favorite) {
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+	delete(f.meta, fav)
+}
+
+// clearMetadata forgets the recorded metadata of all favorites.
+func (f *Favorites) clearMetadata() {
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+	f.meta = make(map[Favorite]FavoriteMetadata)
+}
+
+// GetWithMetadata returns the logged-in user's list of favorites,
+// along with the metadata recorded for each of them.  Like Get, it
+// doesn't use the cache.
+func (f *Favorites) GetWithMetadata(ctx context.Context) (
+	[]FavoriteInfo, error) {
+	favs, err := f.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+	infos := make([]FavoriteInfo, 0, len(favs))
+	for _, fav := range favs {
+		infos = append(infos, FavoriteInfo{fav, f.meta[fav]})
+	}
+	return infos, nil
+}
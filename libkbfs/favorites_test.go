@@ -5,7 +5,9 @@
 package libkbfs
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
@@ -184,3 +186,60 @@ func TestFavoritesListFailsDuringAddAsync(t *testing.T) {
 	f.AddAsync(ctx, fav1) // should work
 	<-c
 }
+
+func TestFavoritesMetadata(t *testing.T) {
+	mockCtrl, config, ctx := favTestInit(t)
+	defer favTestShutdown(mockCtrl, config)
+
+	f := NewFavorites(config)
+	fav1 := Favorite{"test", true}
+	fav2 := Favorite{"test,other", true}
+	now := time.Now()
+	f.updateMetadata(fav1, func(md *FavoriteMetadata) {
+		md.LastAccess = now
+		md.DiskUsage = 100
+		md.SyncMode = SyncFull
+		md.Unread = true
+	})
+
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(
+		[]keybase1.Folder{fav1.toKBFolder(false), fav2.toKBFolder(false)},
+		nil)
+	infos, err := f.GetWithMetadata(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get favorites: %v", err)
+	}
+	expected := map[Favorite]FavoriteMetadata{
+		fav1: {now, 100, SyncFull, true},
+		fav2: {},
+		// The current user's own folders.
+		{"tester", true}:  {},
+		{"tester", false}: {},
+	}
+	got := make(map[Favorite]FavoriteMetadata)
+	for _, info := range infos {
+		got[info.Favorite] = info.FavoriteMetadata
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got favorites %v, expected %v", got, expected)
+	}
+
+	// Deleting a favorite forgets its metadata.
+	config.mockKbpki.EXPECT().FavoriteDelete(
+		gomock.Any(), fav1.toKBFolder(false)).Return(nil)
+	if err := f.Delete(ctx, fav1); err != nil {
+		t.Fatalf("Couldn't delete favorite: %v", err)
+	}
+	config.mockKbpki.EXPECT().FavoriteList(gomock.Any()).Return(
+		[]keybase1.Folder{fav1.toKBFolder(false)}, nil)
+	infos, err = f.GetWithMetadata(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get favorites: %v", err)
+	}
+	for _, info := range infos {
+		if info.FavoriteMetadata != (FavoriteMetadata{}) {
+			t.Errorf("Unexpected metadata for %v: %v",
+				info.Favorite, info.FavoriteMetadata)
+		}
+	}
+}
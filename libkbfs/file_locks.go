@@ -0,0 +1,183 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// FileLockType is the type of an advisory file lock.
+type FileLockType int
+
+const (
+	// FileLockUnlock releases the covered range of a lock.
+	FileLockUnlock FileLockType = iota
+	// FileLockRead is a shared lock, which only conflicts with
+	// write locks.
+	FileLockRead
+	// FileLockWrite is an exclusive lock, which conflicts with all
+	// other locks.
+	FileLockWrite
+)
+
+func (t FileLockType) String() string {
+	switch t {
+	case FileLockUnlock:
+		return "unlock"
+	case FileLockRead:
+		return "read"
+	case FileLockWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("FileLockType(%d)", int(t))
+	}
+}
+
+// FileLock is an advisory lock on a range of bytes of a file, as
+// taken by fcntl(2), or on a whole file, as taken by flock(2).  KBFS
+// doesn't enforce these locks on reads or writes; it only keeps
+// cooperating processes, on any device, from holding conflicting
+// locks at the same time.
+type FileLock struct {
+	Type FileLockType
+	// Start and End are the first and last bytes covered by the
+	// lock.
+	Start uint64
+	End   uint64
+	// Flock is true for locks taken by flock(2).  These never
+	// conflict with locks taken by fcntl(2), and vice versa.
+	Flock bool
+	// Owner identifies the holder of the lock among all the locks
+	// taken by one device.  Locks with the same owner, from the
+	// same device, never conflict; instead, a new lock replaces
+	// the owner's old locks on the bytes it covers.
+	Owner uint64
+	// PID is the process that took the lock, on the device that
+	// took it.
+	PID uint32
+}
+
+func (l FileLock) overlaps(other FileLock) bool {
+	return l.Start <= other.End && other.Start <= l.End
+}
+
+// conflicts returns true if l and other can't both be held by
+// different owners.
+func (l FileLock) conflicts(other FileLock) bool {
+	return l.Flock == other.Flock && l.overlaps(other) &&
+		(l.Type == FileLockWrite || other.Type == FileLockWrite)
+}
+
+// fileLockHolder is a lock held by a device.
+type fileLockHolder struct {
+	device keybase1.KID
+	lock   FileLock
+}
+
+func (h fileLockHolder) sameOwner(device keybase1.KID, lock FileLock) bool {
+	return h.device == device && h.lock.Owner == lock.Owner &&
+		h.lock.Flock == lock.Flock
+}
+
+type fileLockKey struct {
+	id   TlfID
+	file string
+}
+
+// fileLockTable keeps track of the advisory locks held on the files
+// of any number of folders, by any number of devices, with POSIX
+// semantics.
+type fileLockTable struct {
+	lock  sync.Mutex
+	locks map[fileLockKey][]fileLockHolder
+}
+
+func newFileLockTable() *fileLockTable {
+	return &fileLockTable{locks: make(map[fileLockKey][]fileLockHolder)}
+}
+
+// get returns a lock that conflicts with the given one, if it were
+// taken on the given file by the given device.
+func (t *fileLockTable) get(id TlfID, file string, device keybase1.KID,
+	lock FileLock) (FileLock, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.getLocked(fileLockKey{id, file}, device, lock)
+}
+
+func (t *fileLockTable) getLocked(key fileLockKey, device keybase1.KID,
+	lock FileLock) (FileLock, bool) {
+	if lock.Type == FileLockUnlock {
+		return FileLock{}, false
+	}
+	for _, h := range t.locks[key] {
+		if !h.sameOwner(device, lock) && h.lock.conflicts(lock) {
+			return h.lock, true
+		}
+	}
+	return FileLock{}, false
+}
+
+// set takes, changes or releases the given lock on the given file
+// for the given device.  It returns false, and changes nothing, if
+// another owner holds a conflicting lock.
+func (t *fileLockTable) set(id TlfID, file string, device keybase1.KID,
+	lock FileLock) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := fileLockKey{id, file}
+	if _, conflict := t.getLocked(key, device, lock); conflict {
+		return false
+	}
+
+	// Cut the new lock's range out of the owner's old locks,
+	// splitting them if needed, and merge the old locks of the
+	// same type that touch the new one into it.
+	var holders []fileLockHolder
+	for _, h := range t.locks[key] {
+		if !h.sameOwner(device, lock) {
+			holders = append(holders, h)
+			continue
+		}
+		old := h.lock
+		if old.Type == lock.Type && lock.Type != FileLockUnlock &&
+			(old.overlaps(lock) || old.End+1 == lock.Start ||
+				lock.End+1 == old.Start) {
+			if old.Start < lock.Start {
+				lock.Start = old.Start
+			}
+			if old.End > lock.End {
+				lock.End = old.End
+			}
+			continue
+		}
+		if !old.overlaps(lock) {
+			holders = append(holders, h)
+			continue
+		}
+		if old.Start < lock.Start {
+			before := old
+			before.End = lock.Start - 1
+			holders = append(holders, fileLockHolder{device, before})
+		}
+		if old.End > lock.End {
+			after := old
+			after.Start = lock.End + 1
+			holders = append(holders, fileLockHolder{device, after})
+		}
+	}
+	if lock.Type != FileLockUnlock {
+		holders = append(holders, fileLockHolder{device, lock})
+	}
+	if len(holders) == 0 {
+		delete(t.locks, key)
+	} else {
+		t.locks[key] = holders
+	}
+	return true
+}
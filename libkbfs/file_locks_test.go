@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLockTable(t *testing.T) {
+	table := newFileLockTable()
+	id := FakeTlfID(1, false)
+	dev1 := keybase1.KID("dev1")
+	dev2 := keybase1.KID("dev2")
+
+	lock := func(typ FileLockType, start, end uint64, owner uint64) FileLock {
+		return FileLock{Type: typ, Start: start, End: end, Owner: owner}
+	}
+
+	// Read locks are shared.
+	require.True(t, table.set(id, "f", dev1, lock(FileLockRead, 0, 99, 1)))
+	require.True(t, table.set(id, "f", dev2, lock(FileLockRead, 50, 149, 1)))
+	require.False(t, table.set(id, "f", dev2, lock(FileLockWrite, 50, 149, 1)))
+
+	// Unlocking the middle of a lock splits it.
+	require.True(t, table.set(id, "f", dev2, lock(FileLockUnlock, 0, 200, 1)))
+	require.True(t, table.set(id, "f", dev1, lock(FileLockUnlock, 40, 59, 1)))
+	require.True(t, table.set(id, "f", dev2, lock(FileLockWrite, 40, 59, 1)))
+	held, conflict := table.get(id, "f", dev2, lock(FileLockWrite, 30, 30, 1))
+	require.True(t, conflict)
+	require.Equal(t, lock(FileLockRead, 0, 39, 1), held)
+	_, conflict = table.get(id, "f", dev2, lock(FileLockWrite, 60, 60, 1))
+	require.True(t, conflict)
+
+	// A different owner on the same device conflicts, but the same
+	// owner just converts its own lock.
+	require.False(t, table.set(id, "f", dev1, lock(FileLockWrite, 50, 50, 2)))
+	require.True(t, table.set(id, "f", dev1, lock(FileLockWrite, 0, 39, 1)))
+	_, conflict = table.get(id, "f", dev2, lock(FileLockRead, 10, 10, 1))
+	require.True(t, conflict)
+
+	// Adjacent locks of the same type are merged.
+	require.True(t, table.set(id, "f", dev1, lock(FileLockRead, 0, 39, 1)))
+	require.True(t, table.set(id, "f", dev2, lock(FileLockUnlock, 40, 59, 1)))
+	require.True(t, table.set(id, "f", dev1, lock(FileLockRead, 40, 59, 1)))
+	require.Equal(t, []fileLockHolder{{dev1, lock(FileLockRead, 0, 99, 1)}},
+		table.locks[fileLockKey{id, "f"}])
+
+	// Other files and folders, and flock(2) locks, are separate.
+	require.True(t, table.set(id, "g", dev2, lock(FileLockWrite, 0, 99, 1)))
+	require.True(t, table.set(FakeTlfID(2, false), "f", dev2,
+		lock(FileLockWrite, 0, 99, 1)))
+	flock := lock(FileLockWrite, 0, 99, 1)
+	flock.Flock = true
+	require.True(t, table.set(id, "f", dev2, flock))
+
+	// Releasing everything leaves nothing behind.
+	require.True(t, table.set(id, "f", dev2, lock(FileLockUnlock, 0, 99, 1)))
+	require.True(t, table.set(id, "f", dev1, lock(FileLockUnlock, 0, 99, 1)))
+	flock.Type = FileLockUnlock
+	require.True(t, table.set(id, "f", dev2, flock))
+	_, ok := table.locks[fileLockKey{id, "f"}]
+	require.False(t, ok)
+}
@@ -73,6 +73,12 @@ type folderBlockManager struct {
 
 	helper fbmHelper
 
+	// ignoreUnrefAge, if set, lets quota reclamation reclaim
+	// blocks no matter how recently they were unreferenced, as
+	// when the folder is about to be archived.
+	ignoreUnrefAgeLock sync.Mutex
+	ignoreUnrefAge     bool
+
 	// Keep track of the last reclamation time, for testing.
 	lastReclamationTimeLock sync.Mutex
 	lastReclamationTime     time.Time
@@ -505,7 +511,22 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 	}
 }
 
+func (fbm *folderBlockManager) setIgnoreUnrefAge(ignore bool) {
+	fbm.ignoreUnrefAgeLock.Lock()
+	defer fbm.ignoreUnrefAgeLock.Unlock()
+	fbm.ignoreUnrefAge = ignore
+}
+
+func (fbm *folderBlockManager) getIgnoreUnrefAge() bool {
+	fbm.ignoreUnrefAgeLock.Lock()
+	defer fbm.ignoreUnrefAgeLock.Unlock()
+	return fbm.ignoreUnrefAge
+}
+
 func (fbm *folderBlockManager) isOldEnough(rmd *RootMetadata) bool {
+	if fbm.getIgnoreUnrefAge() {
+		return true
+	}
 	// Trust the client-provided timestamp -- it's
 	// possible that a writer with a bad clock could cause
 	// another writer to clear out quotas early.  That's
@@ -750,6 +771,11 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	// any considerable amount of time, so it should be safe to let it
 	// run indefinitely.
 
+	// Read-only instances can never write the resulting gcOp.
+	if fbm.config.Mode().IsReadOnly() {
+		return ReadOnlyBranchError{FolderBranch{fbm.id, MasterBranch}}
+	}
+
 	// First get the current head, and see if we're staged or not.
 	head, err := fbm.helper.getMDForFBM(ctx)
 	if err != nil {
@@ -758,6 +784,9 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return err
 	} else if head.MergedStatus() != Merged {
 		return errors.New("Skipping quota reclamation while unstaged")
+	} else if head.IsArchived() {
+		// The gcOp could never be written.
+		return FolderArchivedError{head.GetTlfHandle().GetCanonicalName()}
 	}
 
 	// Make sure we're a writer
@@ -811,6 +840,17 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
+	if lastGCRev != MetadataRevisionUninitialized {
+		// Quota reclamation never needs the revisions it has
+		// already been through again, so let the server prune
+		// them.
+		err := fbm.config.MDServer().SetCheckpoint(
+			ctx, fbm.id, lastGCRev+1)
+		if err != nil {
+			fbm.log.CDebugf(ctx, "Couldn't set the history checkpoint "+
+				"to %d: %v", lastGCRev+1, err)
+		}
+	}
 	if mostRecentOldEnoughRev == MetadataRevisionUninitialized ||
 		mostRecentOldEnoughRev <= lastGCRev {
 		// TODO: need a log level more fine-grained than Debug to
@@ -873,7 +913,8 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 		}
 
 		err := fbm.doReclamation(timer)
-		if _, ok := err.(WriteAccessError); ok {
+		switch err.(type) {
+		case WriteAccessError, ReadOnlyBranchError, FolderArchivedError:
 			// If we got a write access error, don't bother with the
 			// timer anymore. Don't completely shut down, since we
 			// don't want forced reclamations to hang.
@@ -883,6 +924,34 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 	}
 }
 
+// reclaimAllUnrefBlocks runs quota reclamation, ignoring the minimum
+// unref age, until there's nothing left to reclaim: that is, until a
+// pass doesn't need to write a new gcOp.  It's for folders that are
+// about to be archived, whose history won't be needed anymore.
+func (fbm *folderBlockManager) reclaimAllUnrefBlocks(
+	ctx context.Context) error {
+	fbm.setIgnoreUnrefAge(true)
+	defer fbm.setIgnoreUnrefAge(false)
+	for {
+		head, err := fbm.helper.getMDForFBM(ctx)
+		if err != nil {
+			return err
+		}
+		fbm.forceQuotaReclamation()
+		err = fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			return err
+		}
+		newHead, err := fbm.helper.getMDForFBM(ctx)
+		if err != nil {
+			return err
+		}
+		if newHead.Revision == head.Revision {
+			return nil
+		}
+	}
+}
+
 func (fbm *folderBlockManager) getLastReclamationTime() time.Time {
 	fbm.lastReclamationTimeLock.Lock()
 	defer fbm.lastReclamationTimeLock.Unlock()
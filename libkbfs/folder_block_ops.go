@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -128,6 +129,11 @@ type folderBlockOps struct {
 	// Sync().  It is a blocking channel.
 	forceSyncChan chan<- struct{}
 
+	// getSem limits the number of block fetches in flight for this
+	// folder-branch, independently of its block puts.  It's nil if
+	// there's no limit.
+	getSem chan struct{}
+
 	// protects access to blocks in this folder and all fields
 	// below.
 	blockLock blockLock
@@ -195,6 +201,33 @@ func (fbo *folderBlockOps) getBlockFromDirtyOrCleanCache(ptr BlockPointer,
 	return fbo.config.BlockCache().Get(ptr)
 }
 
+func makeBlockGetSem(config Config) chan struct{} {
+	if n := config.BlockGetsPerFolder(); n > 0 {
+		return make(chan struct{}, n)
+	}
+	return nil
+}
+
+// getBlockFromServer fetches the block pointed to by ptr, once one of
+// this folder-branch's fetch slots is free.
+func (fbo *folderBlockOps) getBlockFromServer(ctx context.Context,
+	bops BlockOps, md *RootMetadata, ptr BlockPointer, block Block) error {
+	if fbo.getSem != nil {
+		select {
+		case fbo.getSem <- struct{}{}:
+			defer func() { <-fbo.getSem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := bops.Get(ctx, md, ptr, block)
+	if err != nil {
+		return err
+	}
+	inFlightOpFromContext(ctx).addBytes(int64(block.GetEncodedSize()))
+	return nil
+}
+
 // getBlockHelperLocked retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. If
 // notifyPath is valid and the block isn't cached, trigger a read
@@ -237,11 +270,16 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	// blocks, so don't unlock.
 	var err error
 	fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
-		err = bops.Get(ctx, md, ptr, block)
+		err = fbo.getBlockFromServer(ctx, bops, md, ptr, block)
 	})
 	if err != nil {
 		return nil, err
 	}
+	fbo.config.EventBus().Publish(Event{
+		Kind:         EventBlockFetched,
+		FolderBranch: fbo.folderBranch,
+		Ptr:          ptr,
+	})
 
 	if doCache {
 		if err := fbo.config.BlockCache().Put(ptr, fbo.id(), block,
@@ -325,6 +363,21 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 		return nil, NotDirBlockError{ptr, branch, p}
 	}
 
+	if dblock.IsInd && len(dblock.Children) == 0 {
+		// This is the top block of a directory that's split
+		// across several blocks, as stored on the server.  Cache
+		// it with all of its entries instead.
+		dblock, err = fbo.assembleDirBlockLocked(
+			ctx, lState, md, dblock, branch)
+		if err != nil {
+			return nil, err
+		}
+		if err := fbo.config.BlockCache().Put(ptr, fbo.id(), dblock,
+			TransientEntry); err != nil {
+			return nil, err
+		}
+	}
+
 	return dblock, nil
 }
 
@@ -457,6 +510,182 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	return blockInfos, nil
 }
 
+// getIndirectDirBlockLocked retrieves one of the leaf or indirect
+// blocks of a directory that's split across several blocks, as
+// stored on the server.
+func (fbo *folderBlockOps) getIndirectDirBlockLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer,
+	branch BranchName) (*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	block, err := fbo.getBlockHelperLocked(
+		ctx, lState, md, ptr, branch, NewDirBlock, true, path{})
+	if err != nil {
+		return nil, err
+	}
+
+	dblock, ok := block.(*DirBlock)
+	if !ok {
+		return nil, NotDirBlockError{ptr, branch, path{}}
+	}
+	return dblock, nil
+}
+
+// getDirLeafPtrsLocked follows the given pointers from the top block
+// of a split directory, and returns the pointers to all of its leaf
+// blocks, in order, along with the infos for all the indirect blocks
+// in between.  All of a directory's leaf blocks are at the same
+// depth.
+func (fbo *folderBlockOps) getDirLeafPtrsLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, iptrs []IndirectDirPtr,
+	branch BranchName) (
+	leaves []IndirectDirPtr, indirect []BlockInfo, err error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	for len(iptrs) > 0 {
+		first, err := fbo.getIndirectDirBlockLocked(
+			ctx, lState, md, iptrs[0].BlockPointer, branch)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !first.IsInd {
+			return iptrs, indirect, nil
+		}
+
+		var next []IndirectDirPtr
+		for i, iptr := range iptrs {
+			indirect = append(indirect, iptr.BlockInfo)
+			block := first
+			if i > 0 {
+				block, err = fbo.getIndirectDirBlockLocked(
+					ctx, lState, md, iptr.BlockPointer, branch)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			next = append(next, block.IPtrs...)
+		}
+		iptrs = next
+	}
+	return nil, indirect, nil
+}
+
+// getDirLeafBlocksLocked retrieves the given leaf blocks of a split
+// directory, fetching the ones that aren't cached in parallel.
+func (fbo *folderBlockOps) getDirLeafBlocksLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, leaves []IndirectDirPtr,
+	branch BranchName) ([]*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	blocks := make([]*DirBlock, len(leaves))
+	var missing []int
+	for i, leaf := range leaves {
+		block, err := fbo.getBlockFromDirtyOrCleanCache(
+			leaf.BlockPointer, branch)
+		if err != nil {
+			missing = append(missing, i)
+			continue
+		}
+		dblock, ok := block.(*DirBlock)
+		if !ok {
+			return nil, NotDirBlockError{leaf.BlockPointer, branch, path{}}
+		}
+		blocks[i] = dblock
+	}
+	if len(missing) == 0 {
+		return blocks, nil
+	}
+
+	// getSem limits how many of these are in flight at once.
+	bops := fbo.config.BlockOps()
+	errs := make([]error, len(missing))
+	fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
+		var wg sync.WaitGroup
+		wg.Add(len(missing))
+		for j, i := range missing {
+			go func(j, i int) {
+				defer wg.Done()
+				dblock := NewDirBlock().(*DirBlock)
+				errs[j] = fbo.getBlockFromServer(
+					ctx, bops, md, leaves[i].BlockPointer, dblock)
+				blocks[i] = dblock
+			}(j, i)
+		}
+		wg.Wait()
+	})
+	for j, i := range missing {
+		if errs[j] != nil {
+			return nil, errs[j]
+		}
+		ptr := leaves[i].BlockPointer
+		fbo.config.EventBus().Publish(Event{
+			Kind:         EventBlockFetched,
+			FolderBranch: fbo.folderBranch,
+			Ptr:          ptr,
+		})
+		if err := fbo.config.BlockCache().Put(ptr, fbo.id(), blocks[i],
+			TransientEntry); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// assembleDirBlockLocked returns a copy of the given top block of a
+// split directory, with the entries of all of its leaf blocks.
+func (fbo *folderBlockOps) assembleDirBlockLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, top *DirBlock,
+	branch BranchName) (*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	leaves, _, err := fbo.getDirLeafPtrsLocked(
+		ctx, lState, md, top.IPtrs, branch)
+	if err != nil {
+		return nil, err
+	}
+	leafBlocks, err := fbo.getDirLeafBlocksLocked(
+		ctx, lState, md, leaves, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.IsInd = true
+	dblock.IPtrs = top.IPtrs
+	dblock.SetEncodedSize(top.GetEncodedSize())
+	for _, leafBlock := range leafBlocks {
+		for name, de := range leafBlock.Children {
+			dblock.Children[name] = de
+		}
+	}
+	return dblock, nil
+}
+
+// GetDirLeafPtrs returns the pointers to all the leaf blocks of the
+// given directory block, in order, along with the infos for all the
+// indirect blocks in between.  It returns nothing if the directory
+// isn't split across several blocks.
+func (fbo *folderBlockOps) GetDirLeafPtrs(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	branch BranchName) ([]IndirectDirPtr, []BlockInfo, error) {
+	if !dblock.IsInd {
+		return nil, nil, nil
+	}
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.getDirLeafPtrsLocked(ctx, lState, md, dblock.IPtrs, branch)
+}
+
+// GetDirLeafBlock retrieves the leaf block of a split directory
+// pointed to by ptr, as returned by GetDirLeafPtrs.
+func (fbo *folderBlockOps) GetDirLeafBlock(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer,
+	branch BranchName) (*DirBlock, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	return fbo.getIndirectDirBlockLocked(ctx, lState, md, ptr, branch)
+}
+
 // getDirLocked retrieves the block pointed to by the tail pointer of
 // the given path, which must be valid, either from the cache or from
 // the server. An error is returned if the retrieved block is not a
@@ -503,6 +732,11 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 		if err != nil {
 			return nil, err
 		}
+		if dblock.IsInd {
+			// Track the changed entries, so that only the leaf
+			// blocks holding them get written again.
+			dblock.dirtyNames = make(map[string]bool)
+		}
 	}
 	return dblock, nil
 }
@@ -965,7 +1199,7 @@ func (fbo *folderBlockOps) PrepRename(
 				if de, ok := b.Children[oldParent.tailName()]; ok {
 					de.Ctime = now
 					de.Mtime = now
-					b.Children[oldParent.tailName()] = de
+					b.setEntry(oldParent.tailName(), de)
 					// Put this block back into the local cache as dirty
 					lbc[oldGrandparent.tailPointer()] = b
 				}
@@ -1064,6 +1298,116 @@ func (fbo *folderBlockOps) Read(
 	return n, nil
 }
 
+// readStreamHoleBytes is the most zeroes ReadBlockAt returns at once
+// for a hole.
+const readStreamHoleBytes = 512 * 1024
+
+// ReadBlockAt returns a copy of the data in the given file from off
+// to the end of the child block that holds it, or up to
+// readStreamHoleBytes zeroes if off is in a hole.  It returns no data
+// at the end of the file.  Unlike Read, it never needs more than one
+// child block to be fetched.
+func (fbo *folderBlockOps) ReadBlockAt(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	off int64) ([]byte, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	// getFileLocked already checks read permissions
+	fblock, err := fbo.getFileLocked(ctx, lState, md, file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, block, nextBlockOff, startOff, err :=
+		fbo.getFileBlockAtOffsetLocked(
+			ctx, lState, md, file, fblock, off, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	lastByteInBlock := startOff + int64(len(block.Contents))
+	if off < lastByteInBlock {
+		data := make([]byte, lastByteInBlock-off)
+		copy(data, block.Contents[off-startOff:])
+		return data, nil
+	}
+	if nextBlockOff <= off {
+		return nil, nil
+	}
+	fill := nextBlockOff - off
+	if fill > readStreamHoleBytes {
+		fill = readStreamHoleBytes
+	}
+	return make([]byte, fill), nil
+}
+
+// SeekHoleOrData returns the offset of the start of the first hole,
+// if hole is true, or of the first data otherwise, at or after off in
+// the given file.  A hole is a gap between the end of one child
+// block's data and the start of the next, and the end of the file
+// counts as one.
+func (fbo *folderBlockOps) SeekHoleOrData(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	off int64, hole bool) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	// getFileLocked already checks read permissions
+	fblock, err := fbo.getFileLocked(ctx, lState, md, file, blockRead)
+	if err != nil {
+		return 0, err
+	}
+
+	if !fblock.IsInd {
+		size := int64(len(fblock.Contents))
+		if off < 0 || off >= size {
+			return 0, SeekPastEOFError{file, off}
+		} else if hole {
+			return size, nil
+		}
+		return off, nil
+	}
+
+	// Start with the child block that holds off.
+	start := 0
+	for i, iptr := range fblock.IPtrs {
+		if iptr.Off > off {
+			break
+		}
+		start = i
+	}
+	for i := start; i < len(fblock.IPtrs); i++ {
+		iptr := fblock.IPtrs[i]
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, md, iptr.BlockPointer, file, blockRead)
+		if err != nil {
+			return 0, err
+		}
+		dataStart := iptr.Off
+		if dataStart < off {
+			dataStart = off
+		}
+		dataEnd := iptr.Off + int64(len(block.Contents))
+		last := i == len(fblock.IPtrs)-1
+		if off < 0 || (last && off >= dataEnd) {
+			return 0, SeekPastEOFError{file, off}
+		}
+
+		if !hole {
+			if dataStart < dataEnd {
+				return dataStart, nil
+			}
+		} else if last || dataEnd < fblock.IPtrs[i+1].Off {
+			if dataStart > dataEnd {
+				// off is in the hole itself.
+				return dataStart, nil
+			}
+			return dataEnd, nil
+		}
+	}
+	return 0, SeekPastEOFError{file, off}
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -1192,10 +1536,13 @@ func (fbo *folderBlockOps) createIndirectBlockLocked(lState *lockState,
 }
 
 // Returns the set of blocks dirtied during this write that might need
-// to be cleaned up if the write is deferred.
+// to be cleaned up if the write is deferred.  If noCopy is true, the
+// caller gives up data, and blocks the write entirely replaces are
+// made of slices of it rather than copies.
 func (fbo *folderBlockOps) writeDataLocked(
 	ctx context.Context, lState *lockState, md *RootMetadata, file path,
-	data []byte, off int64) (latestWrite WriteRange, dirtyPtrs []BlockPointer,
+	data []byte, off int64, noCopy bool) (
+	latestWrite WriteRange, dirtyPtrs []BlockPointer,
 	newlyDirtiedChildBytes int64, err error) {
 	if sz := off + int64(len(data)); uint64(sz) > fbo.config.MaxFileBytes() {
 		return WriteRange{}, nil, 0,
@@ -1207,6 +1554,24 @@ func (fbo *folderBlockOps) writeDataLocked(
 		return WriteRange{}, nil, 0, err
 	}
 
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	if err != nil {
+		return WriteRange{}, nil, 0, err
+	}
+	if uint64(off) > de.Size+truncateExtendCutoffPoint {
+		// Leave a hole up to the start of the write, rather than
+		// filling the gap with zeros.
+		_, dirtyPtrs, err = fbo.truncateExtendLocked(
+			ctx, lState, md, file, uint64(off))
+		if err != nil {
+			return WriteRange{}, nil, 0, err
+		}
+		fblock, _, err = fbo.writeGetFileLocked(ctx, lState, md, file)
+		if err != nil {
+			return WriteRange{}, nil, 0, err
+		}
+	}
+
 	dirtyBcache := fbo.config.DirtyBlockCache()
 	bsplit := fbo.config.BlockSplitter()
 	n := int64(len(data))
@@ -1228,7 +1593,7 @@ func (fbo *folderBlockOps) writeDataLocked(
 		}
 	}()
 
-	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	de, err = fbo.getDirtyEntryLocked(ctx, lState, md, file)
 	if err != nil {
 		return WriteRange{}, nil, 0, err
 	}
@@ -1244,6 +1609,26 @@ func (fbo *folderBlockOps) writeDataLocked(
 			return WriteRange{}, nil, newlyDirtiedChildBytes, err
 		}
 
+		if dataEnd := startOff + int64(len(block.Contents)); nextBlockOff > 0 &&
+			off+nCopied > dataEnd+truncateExtendCutoffPoint {
+			// The write starts well inside a hole, so give it a
+			// block of its own rather than filling the start of
+			// the hole with zeros.
+			err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
+				file, fblock, off+nCopied, md)
+			if err != nil {
+				return WriteRange{}, nil, newlyDirtiedChildBytes, err
+			}
+			newb := fblock.IPtrs[len(fblock.IPtrs)-1]
+			copy(fblock.IPtrs[indexInParent+2:], fblock.IPtrs[indexInParent+1:])
+			fblock.IPtrs[indexInParent+1] = newb
+			for i := range fblock.IPtrs {
+				fblock.IPtrs[i].Holes = true
+			}
+			dirtyPtrs = append(dirtyPtrs, newb.BlockPointer)
+			continue
+		}
+
 		oldLen := len(block.Contents)
 		wasDirty := dirtyBcache.IsDirty(ptr, file.Branch)
 
@@ -1255,8 +1640,26 @@ func (fbo *folderBlockOps) writeDataLocked(
 				max = room
 			}
 		}
-		nCopied += bsplit.CopyUntilSplit(block, nextBlockOff < 0, data[nCopied:max],
-			off+nCopied-startOff)
+		chunk := data[nCopied:max]
+		copied := int64(0)
+		if noCopy && off+nCopied == startOff {
+			if nc, ok := bsplit.(blockSplitterNoCopy); ok {
+				if l := nc.SplitNoCopy(int64(len(block.Contents)),
+					chunk); l > 0 {
+					// The write replaces the whole block, so the
+					// block can just take a slice of the caller's
+					// buffer.  Cap it, so that growing the block
+					// later can't write over the next block's data.
+					block.Contents = chunk[:l:l]
+					copied = l
+				}
+			}
+		}
+		if copied == 0 {
+			copied = bsplit.CopyUntilSplit(block, nextBlockOff < 0, chunk,
+				off+nCopied-startOff)
+		}
+		nCopied += copied
 
 		// TODO: support multiple levels of indirection.  Right now the
 		// code only does one but it should be straightforward to
@@ -1347,15 +1750,16 @@ func (fbo *folderBlockOps) writeDataLocked(
 
 // Write writes the given data to the given file. May block if there
 // is too much unflushed data; in that case, it will be unblocked by a
-// future sync.
+// future sync.  If noCopy is true, the caller gives up data, which
+// the file's dirty blocks may then share.
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, md *RootMetadata,
-	file Node, data []byte, off int64) error {
+	file Node, data []byte, off int64, noCopy bool) error {
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
 	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
-		int64(len(data)))
+		file.GetID(), int64(len(data)))
 	if err != nil {
 		return err
 	}
@@ -1379,7 +1783,7 @@ func (fbo *folderBlockOps) Write(
 	}()
 
 	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.writeDataLocked(
-		ctx, lState, md, filePath, data, off)
+		ctx, lState, md, filePath, data, off, noCopy)
 	if err != nil {
 		return err
 	}
@@ -1411,7 +1815,7 @@ func (fbo *folderBlockOps) Write(
 				// Write the data again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
 				_, _, _, err = fbo.writeDataLocked(
-					ctx, lState, rmd, f, dataCopy, off)
+					ctx, lState, rmd, f, dataCopy, off, true)
 				return err
 			})
 	}
@@ -1517,6 +1921,50 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 // truncate that will trigger the extending with a hole algorithm.
 const truncateExtendCutoffPoint = 128 * 1024
 
+// truncateMaxDirtyBytes is about the most bytes a truncate can
+// dirty: shrinking a file only cuts down the block that holds its
+// new end, and extending it writes at most truncateExtendCutoffPoint
+// zeroes before leaving a hole instead.
+const truncateMaxDirtyBytes = truncateExtendCutoffPoint +
+	2*MaxBlockSizeBytesDefault
+
+// truncateAtChildLocked shrinks an indirect file to the given size,
+// which is at or before the start of its child block at index i, and
+// at or past the end of the data of the child before that.  It drops
+// child i and every one after it without fetching any of them;
+// they're unreferenced when the file is next synced.  An empty child
+// takes their place at the new end, in case the data before it ends
+// in a hole.
+func (fbo *folderBlockOps) truncateAtChildLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	file path, fblock *FileBlock, i int, size uint64) (
+	*WriteRange, []BlockPointer, error) {
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	si := fbo.getOrCreateSyncInfoLocked(lState, de)
+	for _, iptr := range fblock.IPtrs[i:] {
+		si.unrefs = append(si.unrefs, iptr.BlockInfo)
+	}
+	fblock.IPtrs = fblock.IPtrs[:i]
+	// This also makes the top block dirty.
+	err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
+		file, fblock, int64(size), md)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirtyPtrs := []BlockPointer{
+		fblock.IPtrs[len(fblock.IPtrs)-1].BlockPointer, file.tailPointer()}
+
+	latestWrite := si.op.addTruncate(size)
+	de.EncodedSize = 0
+	de.Size = size
+	fbo.deCache[file.tailPointer().ref()] = de
+	return &latestWrite, dirtyPtrs, nil
+}
+
 // Returns the set of newly-ID'd blocks created during this truncate
 // that might need to be cleaned up if the truncate is deferred.
 func (fbo *folderBlockOps) truncateLocked(
@@ -1529,12 +1977,35 @@ func (fbo *folderBlockOps) truncateLocked(
 
 	// find the block where the file should now end
 	iSize := int64(size) // TODO: deal with overflow
+	if fblock.IsInd {
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		for i := 1; i < len(fblock.IPtrs) && size < de.Size; i++ {
+			if fblock.IPtrs[i].Off == iSize {
+				// The new end falls between two blocks, so
+				// there's no need to fetch either of them.
+				latestWrite, dirtyPtrs, err := fbo.truncateAtChildLocked(
+					ctx, lState, md, file, fblock, i, size)
+				return latestWrite, dirtyPtrs, 0, err
+			}
+		}
+	}
 	ptr, parentBlock, indexInParent, block, nextBlockOff, startOff, err :=
 		fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, md, file, fblock, iSize, blockWrite)
+	if err != nil {
+		return nil, nil, 0, err
+	}
 
 	currLen := int64(startOff) + int64(len(block.Contents))
-	if currLen+truncateExtendCutoffPoint < iSize {
+	if nextBlockOff > 0 && currLen < iSize {
+		// The new end is in a hole in the middle of the file.
+		latestWrite, dirtyPtrs, err := fbo.truncateAtChildLocked(
+			ctx, lState, md, file, fblock, indexInParent+1, size)
+		return latestWrite, dirtyPtrs, 0, err
+	} else if currLen+truncateExtendCutoffPoint < iSize {
 		latestWrite, dirtyPtrs, err := fbo.truncateExtendLocked(
 			ctx, lState, md, file, uint64(iSize))
 		if err != nil {
@@ -1545,7 +2016,7 @@ func (fbo *folderBlockOps) truncateLocked(
 		moreNeeded := iSize - currLen
 		latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
 			fbo.writeDataLocked(ctx, lState, md, file,
-				make([]byte, moreNeeded, moreNeeded), currLen)
+				make([]byte, moreNeeded, moreNeeded), currLen, true)
 		if err != nil {
 			return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err
 		}
@@ -1636,15 +2107,18 @@ func (fbo *folderBlockOps) Truncate(
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
 	//
-	// Assume the whole remaining file will be dirty after this
-	// truncate.  TODO: try to figure out how many bytes actually will
-	// be dirtied ahead of time?
+	// A truncate never dirties more than a couple of blocks, no
+	// matter how big the file is.
+	dirtyBytes := int64(size)
+	if dirtyBytes > truncateMaxDirtyBytes {
+		dirtyBytes = truncateMaxDirtyBytes
+	}
 	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
-		int64(size))
+		file.GetID(), dirtyBytes)
 	if err != nil {
 		return err
 	}
-	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(-int64(size), false)
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(-dirtyBytes, false)
 	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
 	if err != nil {
 		return err
@@ -1699,6 +2173,176 @@ func (fbo *folderBlockOps) Truncate(
 	return nil
 }
 
+// punchHoleMaxDirtyBytes is the most bytes punching a hole can
+// dirty: only the blocks at either end of the hole are rewritten.
+const punchHoleMaxDirtyBytes = 2 * MaxBlockSizeBytesDefault
+
+// punchHoleLocked deallocates the data of the given file from off to
+// end, without changing the file's size.  Child blocks that are
+// entirely within the range are dropped, leaving a hole in their
+// place, and are unreferenced when the file is next synced; the
+// parts of the range in the blocks at either end are zeroed.
+//
+// Returns the set of blocks dirtied during this punch that might need
+// to be cleaned up if the punch is deferred.
+func (fbo *folderBlockOps) punchHoleLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	off, end int64) (latestWrite *WriteRange, dirtyPtrs []BlockPointer,
+	newlyDirtiedChildBytes int64, err error) {
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if end > int64(de.Size) {
+		end = int64(de.Size)
+	}
+	if off >= end {
+		return nil, nil, 0, nil
+	}
+
+	fblock, _, err := fbo.writeGetFileLocked(ctx, lState, md, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if fblock.IsInd {
+		// The first child always starts the file, and the last one
+		// ends it, so neither can be dropped.
+		var kept []IndirectFilePtr
+		si := fbo.getOrCreateSyncInfoLocked(lState, de)
+		for i, iptr := range fblock.IPtrs {
+			if i > 0 && i < len(fblock.IPtrs)-1 && iptr.Off >= off &&
+				fblock.IPtrs[i+1].Off <= end {
+				si.unrefs = append(si.unrefs, iptr.BlockInfo)
+				continue
+			}
+			kept = append(kept, iptr)
+		}
+		if len(kept) < len(fblock.IPtrs) {
+			fblock.IPtrs = kept
+			for i := range fblock.IPtrs {
+				fblock.IPtrs[i].Holes = true
+			}
+			if err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
+				file.tailPointer(), file, fblock); err != nil {
+				return nil, nil, 0, err
+			}
+			dirtyPtrs = append(dirtyPtrs, file.tailPointer())
+			de.EncodedSize = 0
+			fbo.deCache[file.tailPointer().ref()] = de
+		}
+	}
+
+	// Zero whatever data is left in the range, skipping any holes.
+	for zOff := off; zOff < end; {
+		fblock, _, err = fbo.writeGetFileLocked(ctx, lState, md, file)
+		if err != nil {
+			return nil, nil, newlyDirtiedChildBytes, err
+		}
+		_, _, _, block, nextBlockOff, startOff, err :=
+			fbo.getFileBlockAtOffsetLocked(
+				ctx, lState, md, file, fblock, zOff, blockWrite)
+		if err != nil {
+			return nil, nil, newlyDirtiedChildBytes, err
+		}
+		zEnd := startOff + int64(len(block.Contents))
+		if zEnd > end {
+			zEnd = end
+		}
+		if zOff < zEnd {
+			_, ptrs, bytes, err := fbo.writeDataLocked(ctx, lState, md,
+				file, make([]byte, zEnd-zOff), zOff, true)
+			newlyDirtiedChildBytes += bytes
+			if err != nil {
+				return nil, nil, newlyDirtiedChildBytes, err
+			}
+			dirtyPtrs = append(dirtyPtrs, ptrs...)
+		}
+		if nextBlockOff < 0 {
+			break
+		}
+		zOff = nextBlockOff
+	}
+
+	de, err = fbo.getDirtyEntryLocked(ctx, lState, md, file)
+	if err != nil {
+		return nil, nil, newlyDirtiedChildBytes, err
+	}
+	si := fbo.getOrCreateSyncInfoLocked(lState, de)
+	write := si.op.addWrite(uint64(off), uint64(end-off))
+	return &write, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
+// PunchHole deallocates the given range of the given file, which then
+// reads as zeroes, without changing its size.  May block if there is
+// too much unflushed data; in that case, it will be unblocked by a
+// future sync.
+func (fbo *folderBlockOps) PunchHole(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	file Node, off, length int64) error {
+	dirtyBytes := length
+	if dirtyBytes > punchHoleMaxDirtyBytes {
+		dirtyBytes = punchHoleMaxDirtyBytes
+	}
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
+		file.GetID(), dirtyBytes)
+	if err != nil {
+		return err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(-dirtyBytes, false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return err
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.punchHoleLocked(
+		ctx, lState, md, filePath, off, off+length)
+	if err != nil {
+		return err
+	}
+
+	if latestWrite != nil {
+		fbo.observers.localChange(ctx, file, *latestWrite)
+	}
+
+	if fbo.doDeferWrite {
+		// There's an ongoing sync, and this punch altered dirty
+		// blocks that are in the process of syncing.  So, we have
+		// to redo it once the sync is complete, using the new file
+		// path.
+		fbo.log.CDebugf(ctx, "Deferring a hole punch to file %v",
+			filePath.tailPointer())
+		fbo.deferredDirtyDeletes = append(fbo.deferredDirtyDeletes,
+			dirtyPtrs...)
+		fbo.deferredWrites = append(fbo.deferredWrites,
+			func(ctx context.Context, lState *lockState, rmd *RootMetadata, f path) error {
+				// We are about to re-dirty these bytes, so mark that
+				// they will no longer be synced via the old file.
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+
+				// Punch the hole again.  We know this won't be
+				// deferred, so no need to check the new ptrs.
+				_, _, _, err := fbo.punchHoleLocked(
+					ctx, lState, rmd, f, off, off+length)
+				return err
+			})
+	}
+
+	return nil
+}
+
 // IsDirty returns whether the given file is dirty; if false is
 // returned, then the file doesn't need to be synced.
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
@@ -1707,6 +2351,31 @@ func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
 	return fbo.config.DirtyBlockCache().IsDirty(file.tailPointer(), file.Branch)
 }
 
+// GetPendingBytes returns the number of bytes written to files in
+// this folder that haven't finished syncing yet.
+func (fbo *folderBlockOps) GetPendingBytes(lState *lockState) int64 {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	var pending int64
+	for _, df := range fbo.dirtyFiles {
+		pending += df.pendingBytes()
+	}
+	return pending
+}
+
+// GetDirtyFileBytes returns the number of bytes written to the given
+// file that haven't finished syncing yet.
+func (fbo *folderBlockOps) GetDirtyFileBytes(
+	lState *lockState, file path) int64 {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	df := fbo.dirtyFiles[file.tailPointer()]
+	if df == nil {
+		return 0
+	}
+	return df.pendingBytes()
+}
+
 func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 	file path) error {
 	fbo.blockLock.AssertLocked(lState)
@@ -1846,12 +2515,72 @@ type fileSyncState struct {
 	newIndirectFileBlockPtrs []BlockPointer
 }
 
+// fitBlockSplitterToServer replaces the config's BlockSplitter with
+// one whose blocks fit on the block server, if the server has
+// tightened its max block size since the splitter was set.
+func (fbo *folderBlockOps) fitBlockSplitterToServer(
+	ctx context.Context) error {
+	bsplit := fbo.config.BlockSplitter()
+	limited, ok := bsplit.(blockSplitterServerLimited)
+	if !ok {
+		return nil
+	}
+	caps, err := fbo.config.BlockServer().Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	newBsplit, err := limited.withServerMaxBlockSize(
+		caps.MaxBlockSize, fbo.config.Codec())
+	if err != nil {
+		return err
+	}
+	if newBsplit != bsplit {
+		fbo.log.CDebugf(ctx, "Shrinking blocks to fit the block server's "+
+			"max block size of %d bytes", caps.MaxBlockSize)
+		fbo.config.SetBlockSplitter(newBsplit)
+	}
+	return nil
+}
+
+// splitOversizedFileLocked turns fblock, the top block of file, into
+// an indirect block if it's a direct block that's too big for the
+// current BlockSplitter, so that it can be split up during the sync.
+func (fbo *folderBlockOps) splitOversizedFileLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	fblock *FileBlock) (*FileBlock, error) {
+	fbo.blockLock.AssertLocked(lState)
+	limited, ok := fbo.config.BlockSplitter().(blockSplitterServerLimited)
+	if !ok || fblock.IsInd ||
+		int64(len(fblock.Contents)) <= limited.maxContentsSize() {
+		return fblock, nil
+	}
+	fbo.log.CDebugf(ctx, "Splitting a direct block of %d bytes",
+		len(fblock.Contents))
+	newFblock, err := fbo.createIndirectBlockLocked(lState, md, file, uid,
+		DefaultNewBlockDataVersion(fbo.config, false))
+	if err != nil {
+		return nil, err
+	}
+	err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
+		newFblock.IPtrs[0].BlockPointer, file, fblock)
+	if err != nil {
+		return nil, err
+	}
+	return newFblock, nil
+}
+
 // startSyncWriteLocked contains the portion of StartSync() that's
 // done while write-locking blockLock.
 func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, uid keybase1.UID, file path) (
 	fblock *FileBlock, bps *blockPutState, syncState fileSyncState,
 	err error) {
+	// Make sure the dirty blocks get split to fit on the server,
+	// before they're readied.
+	if err := fbo.fitBlockSplitterToServer(ctx); err != nil {
+		return nil, nil, syncState, err
+	}
+
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 
@@ -1861,6 +2590,11 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 	if err != nil {
 		return nil, nil, syncState, err
 	}
+	fblock, err = fbo.splitOversizedFileLocked(
+		ctx, lState, md, uid, file, fblock)
+	if err != nil {
+		return nil, nil, syncState, err
+	}
 
 	fileRef := file.tailPointer().ref()
 	si, ok := fbo.unrefCache[fileRef]
@@ -1923,9 +2657,14 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 	//   3) if it needs more bytes, then use copyUntilSplit() to fetch bytes
 	//      from the next block (if there is one), remove the copied bytes
 	//      from the next block and mark it dirty
+	// With content-defined chunking, the extra bytes in (2) go into a
+	// new block inserted after this one instead, so that the
+	// boundaries of all the following blocks don't have to move, and
+	// (3) repeats until this block ends at a boundary.
 	//   4) Then go through once more, and ready and finalize each
 	//      dirty block, updating its ID in the indirect pointer list
 	bsplit := fbo.config.BlockSplitter()
+	cdc := fbo.config.ContentDefinedChunking()
 	if fblock.IsInd {
 		// TODO: Verify that any getFileBlock... calls here
 		// only use the dirty cache and not the network, since
@@ -1949,6 +2688,31 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 				switch {
 				case splitAt == 0:
 					continue
+				case splitAt > 0 && cdc:
+					extraBytes := block.Contents[splitAt:]
+					block.Contents = block.Contents[:splitAt]
+					newOff := ptr.Off + splitAt
+					if err := fbo.newRightBlockLocked(
+						ctx, lState, file.tailPointer(), file, fblock,
+						newOff, md); err != nil {
+						return nil, nil, syncState, err
+					}
+					// And push the indirect pointers to right
+					newb := fblock.IPtrs[len(fblock.IPtrs)-1]
+					copy(fblock.IPtrs[i+2:], fblock.IPtrs[i+1:])
+					fblock.IPtrs[i+1] = newb
+					rPtr, _, _, rblock, _, _, err :=
+						fbo.getFileBlockAtOffsetLocked(
+							ctx, lState, md, file, fblock,
+							newOff, blockWrite)
+					if err != nil {
+						return nil, nil, syncState, err
+					}
+					rblock.Contents = append(rblock.Contents, extraBytes...)
+					if err = fbo.cacheBlockIfNotYetDirtyLocked(
+						lState, rPtr, file, rblock); err != nil {
+						return nil, nil, syncState, err
+					}
 				case splitAt > 0:
 					endOfBlock := ptr.Off + int64(len(block.Contents))
 					extraBytes := block.Contents[splitAt:]
@@ -1991,6 +2755,12 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 					if err != nil {
 						return nil, nil, syncState, err
 					}
+					if cdc && !dirtyBcache.IsDirty(rPtr, file.Branch) {
+						// All of the next block's bytes are about
+						// to become dirty.
+						df.updateNotYetSyncingBytes(
+							int64(len(rblock.Contents)))
+					}
 					// copy some of that block's data into this block
 					nCopied := bsplit.CopyUntilSplit(block, false,
 						rblock.Contents, int64(len(block.Contents)))
@@ -2016,11 +2786,19 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 						md.AddUnrefBlock(fblock.IPtrs[i+1].BlockInfo)
 						fblock.IPtrs =
 							append(fblock.IPtrs[:i+1], fblock.IPtrs[i+2:]...)
+						if cdc && nCopied > 0 {
+							// This block may still need more bytes.
+							i--
+						}
 					}
 				}
 			}
 		}
 
+		// The blocks readied so far in this sync, by the hash of
+		// their contents, so that repeated contents only get put
+		// once.
+		readiedBlocks := make(map[RawDefaultHash]BlockInfo)
 		for i, ptr := range fblock.IPtrs {
 			localPtr := ptr.BlockPointer
 			isDirty := dirtyBcache.IsDirty(localPtr, file.Branch)
@@ -2034,10 +2812,30 @@ func (fbo *folderBlockOps) startSyncWriteLocked(ctx context.Context,
 					return nil, nil, syncState, err
 				}
 
-				newInfo, _, readyBlockData, err :=
-					fbo.ReadyBlock(ctx, md, block, uid)
-				if err != nil {
-					return nil, nil, syncState, err
+				var newInfo BlockInfo
+				var readyBlockData ReadyBlockData
+				_, hash := DoRawDefaultHash(block.Contents)
+				if dupInfo, ok := readiedBlocks[hash]; ok {
+					// Just add another reference to the identical
+					// block, which doBlockPuts will do once that
+					// block has been put.
+					newInfo = dupInfo
+					newInfo.RefNonce, err =
+						fbo.config.Crypto().MakeBlockRefNonce()
+					if err != nil {
+						return nil, nil, syncState, err
+					}
+					newInfo.SetWriter(uid)
+					// The block is never readied itself, but it
+					// may stand in for the original in the cache.
+					block.SetEncodedSize(newInfo.EncodedSize)
+				} else {
+					newInfo, _, readyBlockData, err =
+						fbo.ReadyBlock(ctx, md, block, uid)
+					if err != nil {
+						return nil, nil, syncState, err
+					}
+					readiedBlocks[hash] = newInfo
 				}
 
 				syncState.newIndirectFileBlockPtrs = append(syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
@@ -2103,7 +2901,7 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	if de, ok := fbo.deCache[fileRef]; ok {
 		// remember the old info
 		de.EncodedSize = si.oldInfo.EncodedSize
-		dblock.Children[file.tailName()] = de
+		dblock.setEntry(file.tailName(), de)
 		lbc[parentPath.tailPointer()] = dblock
 	}
 
@@ -2441,6 +3239,10 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
+	case linksAttr:
+		fileEntry.Links = realEntry.Links
 	}
 	fbo.deCache[ref] = fileEntry
 }
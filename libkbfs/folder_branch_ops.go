@@ -5,15 +5,23 @@
 package libkbfs
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/backoff"
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
+	metrics "github.com/rcrowley/go-metrics"
 	"golang.org/x/net/context"
 )
 
@@ -63,6 +71,9 @@ const (
 	MaxBlockSizeBytesDefault = 512 << 10
 	// Maximum number of blocks that can be sent in parallel
 	maxParallelBlockPuts = 100
+	// Maximum number of blocks each folder fetches in parallel by
+	// default.
+	maxParallelBlockGets = 50
 	// Max response size for a single DynamoDB query is 1MB.
 	maxMDsAtATime = 10
 	// Time between checks for dirty files to flush, in case Sync is
@@ -74,6 +85,9 @@ const (
 	dirtyBytesThreshold = maxParallelBlockPuts * MaxBlockSizeBytesDefault
 	// The timeout for any background task.
 	backgroundTaskTimeout = 1 * time.Minute
+	// How often to retry pushing journaled writes to the servers,
+	// in write-back mode, after a failure.
+	writeBackRetryPeriod = 10 * time.Second
 )
 
 type fboMutexLevel mutexLevel
@@ -210,7 +224,10 @@ type folderBranchOps struct {
 	bid          BranchID // protected by mdWriterLock
 	bType        branchType
 	head         *RootMetadata
-	observers    *observerList
+	// headChangedChan is closed, and replaced, whenever head
+	// changes.  Protected by headLock.
+	headChangedChan chan StatusUpdate
+	observers       *observerList
 
 	// these locks, when locked concurrently by the same goroutine,
 	// should only be taken in the following order to avoid deadlock:
@@ -250,6 +267,19 @@ type folderBranchOps struct {
 
 	// The current status summary for this folder
 	status *folderBranchStatusKeeper
+	// Recent latencies of the main operations on this folder
+	latencies *opLatencyTracker
+	// The operations currently running on this folder
+	inFlight *inFlightOpTracker
+	// How far this folder has gotten with syncing its files
+	syncStatus *folderSyncTracker
+	// Small sequential writes that haven't been applied yet
+	coalescer *writeCoalescer
+	// Recent update rates of each of this folder's writers
+	writerRates *writerRateTracker
+	// If non-nil, spaces out this device's MD writes to the folder
+	// when it's shared
+	mdWriteLimiter *mdWriteLimiter
 
 	// How to log
 	log      logger.Logger
@@ -269,16 +299,49 @@ type folderBranchOps struct {
 	// to know when it should sync immediately.
 	forceSyncChan <-chan struct{}
 
+	// writeBack, if non-nil, holds the writes to this
+	// folder-branch's files that haven't been synced to the servers
+	// yet, so that Sync can return once they're journaled on disk.
+	// writeBackChan tells the background write-back goroutine to
+	// push the journaled writes to the servers, and writeBackLock
+	// makes sure only one flush of the journal runs at a time.
+	writeBack     *writeBackJournal
+	writeBackChan chan struct{}
+	writeBackLock sync.Mutex
+	// writeBackFull is 1 while syncs are written through to the
+	// servers because the journal has hit one of its limits, so
+	// that the user is only notified once each time.
+	writeBackFull int32
+
+	// priorityFlushes counts the priority flushes in progress.  The
+	// background flusher stops early while there are any, so they
+	// don't have to wait behind it.  Accessed atomically.
+	priorityFlushes int32
+
+	// unread is 1 if another device has changed this folder since
+	// it was last accessed on this device.  Accessed atomically.
+	unread int32
+
 	// How to resolve conflicts
 	cr *ConflictResolver
 
 	// Helper class for archiving and cleaning up the blocks for this TLF
 	fbm *folderBlockManager
 
+	// Runs the block puts for all syncs of this folder-branch
+	blockPuts *blockPutPool
+
 	// rekeyWithPromptTimer tracks a timed function that will try to
 	// rekey with a paper key prompt, if enough time has passed.
 	// Protected by mdWriterLock
 	rekeyWithPromptTimer *time.Timer
+
+	// If non-nil, the error returned by all writes, e.g. because
+	// this device has been revoked.  If frozen is non-nil, writes
+	// fail with it too, and updates from the server aren't applied.
+	writeFenceLock sync.RWMutex
+	writeFence     error
+	frozen         error
 }
 
 var _ KBFSOps = (*folderBranchOps)(nil)
@@ -287,7 +350,7 @@ var _ fbmHelper = (*folderBranchOps)(nil)
 
 // newFolderBranchOps constructs a new folderBranchOps object.
 func newFolderBranchOps(config Config, fb FolderBranch,
-	bType branchType) *folderBranchOps {
+	bType branchType, writeBackUsage *writeBackUsage) *folderBranchOps {
 	nodeCache := newNodeCacheStandard(fb)
 
 	// make logger
@@ -312,20 +375,27 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 	forceSyncChan := make(chan struct{})
 
 	fbo := &folderBranchOps{
-		config:       config,
-		folderBranch: fb,
-		bid:          BranchID{},
-		bType:        bType,
-		observers:    observers,
-		status:       newFolderBranchStatusKeeper(config, nodeCache),
-		mdWriterLock: mdWriterLock,
-		headLock:     headLock,
+		config:          config,
+		folderBranch:    fb,
+		bid:             BranchID{},
+		bType:           bType,
+		observers:       observers,
+		status:          newFolderBranchStatusKeeper(config, nodeCache),
+		latencies:       newOpLatencyTracker(config),
+		inFlight:        newInFlightOpTracker(config, nodeCache),
+		syncStatus:      newFolderSyncTracker(config),
+		writerRates:     newWriterRateTracker(config.Clock()),
+		mdWriteLimiter:  newMDWriteLimiter(config.Clock(), config.MDWritesPerMinute()),
+		mdWriterLock:    mdWriterLock,
+		headLock:        headLock,
+		headChangedChan: make(chan StatusUpdate),
 		blocks: folderBlockOps{
 			config:        config,
 			log:           log,
 			folderBranch:  fb,
 			observers:     observers,
 			forceSyncChan: forceSyncChan,
+			getSem:        makeBlockGetSem(config),
 			blockLock: blockLock{
 				leveledRWMutex: blockLockMu,
 			},
@@ -342,12 +412,28 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		shutdownChan:    make(chan struct{}),
 		updatePauseChan: make(chan (<-chan struct{})),
 		forceSyncChan:   forceSyncChan,
+		blockPuts:       newBlockPutPool(config.BlockPutWorkers()),
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
+	fbo.coalescer = newWriteCoalescer(
+		config, fbo.applyWrite, fbo.runUnlessShutdown)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
 	}
+	if dir := config.WriteBackJournalDir(); dir != "" &&
+		fb.Branch == MasterBranch {
+		writeBack, err := makeWriteBackJournal(config.Codec(),
+			filepath.Join(dir, fb.Tlf.String()), writeBackUsage)
+		if err != nil {
+			log.CWarningf(nil, "Couldn't open the write-back journal; "+
+				"syncing straight to the servers instead: %v", err)
+		} else {
+			fbo.writeBack = writeBack
+			fbo.writeBackChan = make(chan struct{}, 1)
+			go fbo.backgroundWriteBack(writeBackRetryPeriod)
+		}
+	}
 	return fbo
 }
 
@@ -365,6 +451,10 @@ func (fbo *folderBranchOps) markForReIdentifyIfNeeded(now time.Time, maxValid ti
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by folderBranchOps.
 func (fbo *folderBranchOps) Shutdown() error {
+	if err := fbo.flushAllCoalescedWrites(context.TODO()); err != nil {
+		fbo.log.CWarningf(nil, "Couldn't apply the held-back writes "+
+			"before shutting down: %v", err)
+	}
 	if fbo.config.CheckStateOnShutdown() {
 		ctx := context.TODO()
 		lState := makeFBOLockState()
@@ -390,6 +480,20 @@ func (fbo *folderBranchOps) Shutdown() error {
 	close(fbo.shutdownChan)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
+	fbo.blockPuts.shutdown()
+	if fbo.writeBack != nil {
+		// Wait for any push to the servers to stop, and then seal
+		// what's left for the next process, which may be a newer
+		// version of KBFS.
+		fbo.writeBackLock.Lock()
+		err := fbo.writeBack.seal()
+		fbo.writeBackLock.Unlock()
+		if err != nil {
+			fbo.log.CWarningf(nil, "Couldn't seal the write-back "+
+				"journal: %v", err)
+		}
+		fbo.writeBack.release()
+	}
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
 	if fbo.updateDoneChan != nil {
@@ -411,6 +515,12 @@ func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetFavoritesWithMetadata(ctx context.Context) (
+	[]FavoriteInfo, error) {
+	return nil, errors.New(
+		"GetFavoritesWithMetadata is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) RefreshCachedFavorites(ctx context.Context) {
 	// no-op
 }
@@ -460,6 +570,18 @@ func (fbo *folderBranchOps) deleteFromFavorites(ctx context.Context,
 	return favorites.Delete(ctx, h.ToFavorite())
 }
 
+// markRead notes that the folder was just accessed on this device,
+// so it has no unseen changes.
+func (fbo *folderBranchOps) markRead() {
+	atomic.StoreInt32(&fbo.unread, 0)
+}
+
+// hasUnread returns whether another device has changed this folder
+// since it was last accessed on this device.
+func (fbo *folderBranchOps) hasUnread() bool {
+	return atomic.LoadInt32(&fbo.unread) != 0
+}
+
 func (fbo *folderBranchOps) getHead(lState *lockState) *RootMetadata {
 	fbo.headLock.RLock(lState)
 	defer fbo.headLock.RUnlock(lState)
@@ -492,8 +614,7 @@ func (fbo *folderBranchOps) checkDataVersion(p path, ptr BlockPointer) error {
 	if ptr.DataVer < FirstValidDataVer {
 		return InvalidDataVersionError{ptr.DataVer}
 	}
-	// TODO: migrate back to fbo.config.DataVersion
-	if ptr.DataVer > FilesWithHolesDataVer {
+	if ptr.DataVer > fbo.config.DataVersion() {
 		return NewDataVersionError{p, ptr.DataVer}
 	}
 	return nil
@@ -542,6 +663,8 @@ func (fbo *folderBranchOps) setHeadLocked(
 	}
 
 	fbo.head = md
+	close(fbo.headChangedChan)
+	fbo.headChangedChan = make(chan StatusUpdate)
 	fbo.status.setRootMetadata(md)
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
@@ -647,6 +770,7 @@ func (fbo *folderBranchOps) setHeadSuccessorLocked(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	fbo.writerRates.record(md.LastModifyingWriter)
 
 	if oldName != newName {
 		fbo.log.CDebugf(ctx, "Handle changed (%s -> %s)",
@@ -773,11 +897,16 @@ func (fbo *folderBranchOps) getMDLocked(
 	// Not in cache, fetch from server and add to cache.  First, see
 	// if this device has any unmerged commits -- take the latest one.
 	mdops := fbo.config.MDOps()
+	fetchStart := fbo.config.Clock().Now()
 
-	// get the head of the unmerged branch for this device (if any)
-	md, err = mdops.GetUnmergedForTLF(ctx, fbo.id(), NullBranchID)
-	if err != nil {
-		return nil, err
+	// get the head of the unmerged branch for this device (if any).
+	// Read-only branches can never have unmerged changes, so they
+	// only need to track the merged head.
+	if !fbo.isReadOnly() {
+		md, err = mdops.GetUnmergedForTLF(ctx, fbo.id(), NullBranchID)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if md == nil {
 		// no unmerged MDs for this device, so just get the current head
@@ -786,6 +915,7 @@ func (fbo *folderBranchOps) getMDLocked(
 			return nil, err
 		}
 	}
+	fbo.latencies.record(opLatencyMDFetch, fetchStart)
 
 	if md.data.Dir.Type != Dir && (!md.IsInitialized() || md.IsReadable()) {
 		err = fbo.initMDLocked(ctx, lState, md)
@@ -849,6 +979,10 @@ func (fbo *folderBranchOps) getMDForWriteLocked(
 	ctx context.Context, lState *lockState) (*RootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.checkWritable(); err != nil {
+		return nil, err
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return nil, err
@@ -878,6 +1012,10 @@ func (fbo *folderBranchOps) getMDForRekeyWriteLocked(
 	ctx context.Context, lState *lockState) (rmd *RootMetadata, wasRekeySet bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := fbo.checkWritable(); err != nil {
+		return nil, false, err
+	}
+
 	md, err := fbo.getMDLocked(ctx, lState, mdRekey)
 	if err != nil {
 		return nil, false, err
@@ -980,7 +1118,8 @@ func (fbo *folderBranchOps) initMDLocked(
 		return err
 	}
 	if err = fbo.config.BlockCache().Put(
-		info.BlockPointer, fbo.id(), newDblock, TransientEntry); err != nil {
+		info.BlockPointer, fbo.id(), newDblock,
+		TransientLocalEntry); err != nil {
 		return err
 	}
 
@@ -1021,6 +1160,58 @@ func (fbo *folderBranchOps) GetOrCreateRootNode(
 	return
 }
 
+// isReadOnly returns true if this folder-branch can never be
+// modified by this device.
+func (fbo *folderBranchOps) isReadOnly() bool {
+	return fbo.bType == archive || fbo.bType == archiveOffline
+}
+
+// checkWritable returns an error if this folder-branch can't be
+// modified by this device.
+func (fbo *folderBranchOps) checkWritable() error {
+	if fbo.isReadOnly() {
+		return ReadOnlyBranchError{fbo.folderBranch}
+	}
+	if err := fbo.getWriteFence(); err != nil {
+		return err
+	}
+	if head := fbo.getHead(makeFBOLockState()); head != nil &&
+		head.IsArchived() {
+		return FolderArchivedError{head.GetTlfHandle().GetCanonicalName()}
+	}
+	return fbo.getFrozen()
+}
+
+// fenceWrites makes all future writes to this folder-branch fail
+// with the given error, and stops the background flushing of any
+// dirty data.
+func (fbo *folderBranchOps) fenceWrites(err error) {
+	fbo.writeFenceLock.Lock()
+	defer fbo.writeFenceLock.Unlock()
+	fbo.writeFence = err
+}
+
+func (fbo *folderBranchOps) getWriteFence() error {
+	fbo.writeFenceLock.RLock()
+	defer fbo.writeFenceLock.RUnlock()
+	return fbo.writeFence
+}
+
+// freeze makes all future writes to this folder-branch, and all
+// attempts to apply updates from the server, fail with the given
+// error; nil unfreezes it.
+func (fbo *folderBranchOps) freeze(err error) {
+	fbo.writeFenceLock.Lock()
+	defer fbo.writeFenceLock.Unlock()
+	fbo.frozen = err
+}
+
+func (fbo *folderBranchOps) getFrozen() error {
+	fbo.writeFenceLock.RLock()
+	defer fbo.writeFenceLock.RUnlock()
+	return fbo.frozen
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1078,6 +1269,9 @@ func (fbo *folderBranchOps) CheckForNewMDAndInit(
 			return nil
 		}
 		// Initialize if needed
+		if err := fbo.checkWritable(); err != nil {
+			return err
+		}
 		created = true
 		return fbo.initMDLocked(ctx, lState, md)
 	})
@@ -1182,6 +1376,11 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		return nil, err
 	}
 
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	err = runUnlessCanceled(ctx, func() error {
 		var err error
 		lState := makeFBOLockState()
@@ -1201,6 +1400,29 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		if err != nil {
 			return err
 		}
+
+		// Hard links look like the files they link to.
+		root := path{dirPath.FolderBranch, dirPath.path[:1]}
+		for name, ei := range children {
+			if ei.Type != Sym {
+				continue
+			}
+			de, err := fbo.blocks.GetDirtyEntry(
+				ctx, lState, md, dirPath.ChildPathNoPtr(name))
+			if err != nil {
+				return err
+			}
+			if de.LinkID == "" {
+				continue
+			}
+			_, de, err = fbo.getHardLink(ctx, lState, md, root, de.LinkID)
+			if _, ok := err.(NoSuchNameError); ok {
+				continue
+			} else if err != nil {
+				return err
+			}
+			children[name] = de.EntryInfo
+		}
 		return nil
 	})
 	if err != nil {
@@ -1213,12 +1435,20 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	node Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Lookup %p %s", dir.GetID(), name)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	defer fbo.latencies.record(opLatencyLookup, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencyLookup, dir, name)
+	defer fbo.inFlight.end(ifo)
 
 	err = fbo.checkNode(dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
 
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
 	var de DirEntry
 	err = runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
@@ -1240,7 +1470,13 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 			return err
 		}
 
-		if de.Type == Sym {
+		if de.LinkID != "" {
+			node, de, err = fbo.getHardLinkNode(ctx, lState, md,
+				path{dirPath.FolderBranch, dirPath.path[:1]}, de.LinkID)
+			if err != nil {
+				return err
+			}
+		} else if de.Type == Sym {
 			node = nil
 		} else {
 			err = fbo.checkDataVersion(childPath, de.BlockPointer)
@@ -1317,6 +1553,11 @@ func (fbo *folderBranchOps) Stat(ctx context.Context, node Node) (
 	fbo.log.CDebugf(ctx, "Stat %p", node.GetID())
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
 	var de DirEntry
 	err = runUnlessCanceled(ctx, func() error {
 		de, err = fbo.statEntry(ctx, node)
@@ -1374,6 +1615,245 @@ func (fbo *folderBranchOps) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// dirLeafGroup is a sorted run of a split directory's entries, which
+// all belonged to the same leaf block (old, if initialized) the last
+// time the directory was written.  If the directory block tracks its
+// changed entries, dirty tells whether any of them fall in this
+// group; otherwise the entries are compared against the old leaf.
+type dirLeafGroup struct {
+	names   []string
+	old     IndirectDirPtr
+	tracked bool
+	dirty   bool
+}
+
+// readyDirLeaves readies new leaf blocks for the given group of
+// dblock's entries.  If the entries haven't changed, the group's old
+// leaf block is kept; otherwise it's unreferenced, and the entries
+// are split evenly among as many new leaf blocks as needed.  It
+// returns the pointers to the leaf blocks, and their plaintext size.
+func (fbo *folderBranchOps) readyDirLeaves(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock, g dirLeafGroup,
+	uid keybase1.UID, bps *blockPutState) (
+	leaves []IndirectDirPtr, size uint64, err error) {
+	names, old := g.names, g.old
+	maxEntries := fbo.config.MaxDirEntriesPerBlock()
+	if old.IsInitialized() {
+		same := g.tracked && !g.dirty
+		var oldLeaf *DirBlock
+		if !g.tracked {
+			oldLeaf, err = fbo.blocks.GetDirLeafBlock(
+				ctx, lState, md, old.BlockPointer, fbo.branch())
+			if err != nil {
+				return nil, 0, err
+			}
+			same = len(names) == len(oldLeaf.Children)
+			for _, name := range names {
+				if !same {
+					break
+				}
+				de, ok := oldLeaf.Children[name]
+				same = ok && reflect.DeepEqual(de, dblock.Children[name])
+			}
+		}
+		if same && len(names) > 0 {
+			if old.Size == 0 {
+				// The leaf was written without its size.
+				if oldLeaf == nil {
+					oldLeaf, err = fbo.blocks.GetDirLeafBlock(
+						ctx, lState, md, old.BlockPointer, fbo.branch())
+					if err != nil {
+						return nil, 0, err
+					}
+				}
+				buf, err := fbo.config.Codec().Encode(oldLeaf)
+				if err != nil {
+					return nil, 0, err
+				}
+				old.Size = uint64(len(buf))
+			}
+			return []IndirectDirPtr{old}, old.Size, nil
+		}
+		md.AddUnrefBlock(old.BlockInfo)
+	}
+	if len(names) == 0 {
+		return nil, 0, nil
+	}
+
+	numLeaves := (len(names) + maxEntries - 1) / maxEntries
+	perLeaf := (len(names) + numLeaves - 1) / numLeaves
+	for start := 0; start < len(names); start += perLeaf {
+		end := start + perLeaf
+		if end > len(names) {
+			end = len(names)
+		}
+		leaf := NewDirBlock().(*DirBlock)
+		for _, name := range names[start:end] {
+			leaf.Children[name] = dblock.Children[name]
+		}
+		info, plainSize, err := fbo.readyBlockMultiple(ctx, md, leaf, uid, bps)
+		if err != nil {
+			return nil, 0, err
+		}
+		md.AddRefBlock(info)
+		off := names[start]
+		if start == 0 {
+			off = old.Off
+		}
+		leaves = append(leaves, IndirectDirPtr{
+			BlockInfo: info,
+			Off:       off,
+			Size:      uint64(plainSize),
+		})
+		size += uint64(plainSize)
+	}
+	return leaves, size, nil
+}
+
+// readyDirBlockMultiple readies the given directory block, like
+// readyBlockMultiple.  If the directory has more entries than fit in
+// one block, they're split across leaf blocks, which are indexed by
+// as many levels of indirect blocks as needed.  Only the leaf blocks
+// whose entries have changed since the directory was last written
+// are replaced, and any blocks the directory no longer uses are
+// unreferenced in md.  The block tracked in bps for dblock keeps all
+// of the directory's entries, so that it can be cached as is.  It
+// returns the info for the directory's new top block, and the
+// plaintext size of all its blocks.
+func (fbo *folderBranchOps) readyDirBlockMultiple(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock, uid keybase1.UID,
+	bps *blockPutState) (info BlockInfo, size uint64, err error) {
+	oldLeaves, oldIndirect, err := fbo.blocks.GetDirLeafPtrs(
+		ctx, lState, md, dblock, fbo.branch())
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	for _, oldInfo := range oldIndirect {
+		md.AddUnrefBlock(oldInfo)
+	}
+
+	// The block gets cached as is once it's readied, so stop
+	// tracking its changes.
+	dirtyNames := dblock.dirtyNames
+	dblock.dirtyNames = nil
+
+	maxEntries := fbo.config.MaxDirEntriesPerBlock()
+	if maxEntries <= 0 || len(dblock.Children) <= maxEntries {
+		for _, old := range oldLeaves {
+			md.AddUnrefBlock(old.BlockInfo)
+		}
+		dblock.IsInd = false
+		dblock.IPtrs = nil
+		info, plainSize, err := fbo.readyBlockMultiple(
+			ctx, md, dblock, uid, bps)
+		return info, uint64(plainSize), err
+	}
+
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Keep the boundaries between the old leaf blocks, so that
+	// leaves untouched by this change don't need to be rewritten.
+	if len(oldLeaves) == 0 {
+		oldLeaves = []IndirectDirPtr{{}}
+	}
+	groups := make([]dirLeafGroup, 0, len(oldLeaves))
+	start := 0
+	for i, old := range oldLeaves {
+		end := len(names)
+		if i+1 < len(oldLeaves) {
+			end = start + sort.SearchStrings(names[start:], oldLeaves[i+1].Off)
+		}
+		groups = append(groups, dirLeafGroup{
+			names:   names[start:end],
+			old:     old,
+			tracked: dirtyNames != nil,
+		})
+		start = end
+	}
+	for name := range dirtyNames {
+		// Find the group whose range holds the name, whether or
+		// not it's still an entry.
+		i := sort.Search(len(oldLeaves)-1, func(i int) bool {
+			return name < oldLeaves[i+1].Off
+		})
+		groups[i].dirty = true
+	}
+	// Fold leaves that have gotten too small into the next one.
+	for i := 0; i+1 < len(groups); i++ {
+		if len(groups[i].names) >= maxEntries/4 {
+			continue
+		}
+		if groups[i].old.IsInitialized() {
+			md.AddUnrefBlock(groups[i].old.BlockInfo)
+		}
+		groups[i+1].names = append(
+			groups[i].names[:len(groups[i].names):len(groups[i].names)],
+			groups[i+1].names...)
+		groups[i+1].old.Off = groups[i].old.Off
+		groups[i+1].dirty = true
+		groups[i].names = nil
+		groups[i].old = IndirectDirPtr{}
+	}
+
+	var iptrs []IndirectDirPtr
+	for _, g := range groups {
+		leaves, leavesSize, err := fbo.readyDirLeaves(
+			ctx, lState, md, dblock, g, uid, bps)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		iptrs = append(iptrs, leaves...)
+		size += leavesSize
+	}
+	// The first leaf covers all the names before the second one.
+	iptrs[0].Off = ""
+
+	// Index the leaves with as many levels of indirect blocks as
+	// needed.  These are small, so they're just rewritten each time.
+	for len(iptrs) > maxEntries {
+		var next []IndirectDirPtr
+		for start := 0; start < len(iptrs); start += maxEntries {
+			end := start + maxEntries
+			if end > len(iptrs) {
+				end = len(iptrs)
+			}
+			iblock := NewDirBlock().(*DirBlock)
+			iblock.IsInd = true
+			iblock.IPtrs = iptrs[start:end]
+			info, plainSize, err := fbo.readyBlockMultiple(
+				ctx, md, iblock, uid, bps)
+			if err != nil {
+				return BlockInfo{}, 0, err
+			}
+			md.AddRefBlock(info)
+			next = append(next, IndirectDirPtr{
+				BlockInfo: info,
+				Off:       iptrs[start].Off,
+			})
+			size += uint64(plainSize)
+		}
+		iptrs = next
+	}
+
+	top := NewDirBlock().(*DirBlock)
+	top.IsInd = true
+	top.IPtrs = iptrs
+	info, plainSize, readyBlockData, err :=
+		fbo.blocks.ReadyBlock(ctx, md, top, uid)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	dblock.IsInd = true
+	dblock.IPtrs = iptrs
+	dblock.SetEncodedSize(info.EncodedSize)
+	bps.addNewBlock(info.BlockPointer, dblock, readyBlockData, nil)
+	return info, size + uint64(plainSize), nil
+}
+
 func (fbo *folderBranchOps) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, uid keybase1.UID) (err error) {
@@ -1436,8 +1916,18 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err :=
-			fbo.readyBlockMultiple(ctx, md, currBlock, uid, bps)
+		var info BlockInfo
+		var size uint64
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			info, size, err = fbo.readyDirBlockMultiple(
+				ctx, lState, md, dblock, uid, bps)
+		} else {
+			var plainSize int
+			info, plainSize, err =
+				fbo.readyBlockMultiple(ctx, md, currBlock, uid, bps)
+			size = uint64(plainSize)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -1513,10 +2003,7 @@ func (fbo *folderBranchOps) syncBlock(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
-			de.Size = uint64(plainSize)
+			de.Size = size
 		}
 
 		if prevIdx < 0 {
@@ -1548,7 +2035,7 @@ func (fbo *folderBranchOps) syncBlock(
 		if prevIdx < 0 {
 			md.data.Dir = de
 		} else {
-			prevDblock.Children[currName] = de
+			prevDblock.setEntry(currName, de)
 		}
 		currName = nextName
 
@@ -1624,9 +2111,31 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 		}
 	}
 
+	// Check the folder's quota now that the usage is final, but
+	// before any blocks are uploaded.
+	if err := checkFolderQuota(md); err != nil {
+		return path{}, DirEntry{}, nil, err
+	}
+
 	return newPath, newDe, bps, nil
 }
 
+// checkFolderQuota returns a FolderQuotaExceededError if md would
+// take the folder's usage over the limit its writers set.  Changes
+// that don't grow the folder are always let through, so that a
+// folder over its limit can still be cleaned up.
+func checkFolderQuota(md *RootMetadata) error {
+	limit := md.Extra.QuotaLimit
+	if limit == 0 || md.DiskUsage <= limit || md.RefBytes <= md.UnrefBytes {
+		return nil
+	}
+	return FolderQuotaExceededError{
+		Folder: md.GetTlfHandle().GetCanonicalName(),
+		Usage:  md.DiskUsage,
+		Limit:  limit,
+	}
+}
+
 func isRecoverableBlockError(err error) bool {
 	_, isArchiveError := err.(BServerErrorBlockArchived)
 	_, isDeleteError := err.(BServerErrorBlockDeleted)
@@ -1644,6 +2153,17 @@ func (fbo *folderBranchOps) doOneBlockPut(ctx context.Context,
 	errChan chan error, blocksToRemoveChan chan *FileBlock) {
 	err := fbo.config.BlockOps().
 		Put(ctx, md, blockState.blockPtr, blockState.readyBlockData)
+	if err == nil {
+		inFlightOpFromContext(ctx).addBytes(
+			int64(blockState.readyBlockData.GetEncodedSize()))
+		if fblock, ok := blockState.block.(*FileBlock); ok && !fblock.IsInd {
+			status, syncing := fbo.syncStatus.bytesFlushed(
+				int64(len(fblock.Contents)))
+			if syncing {
+				fbo.publishSyncStatus(status)
+			}
+		}
+	}
 	if err == nil && blockState.syncedCb != nil {
 		err = blockState.syncedCb()
 	}
@@ -1673,42 +2193,68 @@ func (fbo *folderBranchOps) doOneBlockPut(ctx context.Context,
 // errors and should be removed by the caller from any saved state.
 func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 	md *RootMetadata, bps blockPutState) ([]BlockPointer, error) {
+	// New references to blocks that are themselves being put here
+	// can only be added once those blocks exist on the server.
+	firstRefs := make(map[BlockID]bool)
+	for _, blockState := range bps.blockStates {
+		if blockState.blockPtr.IsFirstRef() {
+			firstRefs[blockState.blockPtr.ID] = true
+		}
+	}
+	var puts, laterRefs []blockState
+	for _, blockState := range bps.blockStates {
+		if !blockState.blockPtr.IsFirstRef() &&
+			firstRefs[blockState.blockPtr.ID] {
+			laterRefs = append(laterRefs, blockState)
+		} else {
+			puts = append(puts, blockState)
+		}
+	}
+
+	blocksToRemove, err := fbo.doBlockPutsInParallel(ctx, md, puts)
+	if err != nil || len(laterRefs) == 0 {
+		return blocksToRemove, err
+	}
+	return fbo.doBlockPutsInParallel(ctx, md, laterRefs)
+}
+
+// doBlockPutsInParallel does the given block puts over the shared
+// put pool, with the same semantics as doBlockPuts.
+func (fbo *folderBranchOps) doBlockPutsInParallel(ctx context.Context,
+	md *RootMetadata, blockStates []blockState) ([]BlockPointer, error) {
 	errChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	blocks := make(chan blockState, len(bps.blockStates))
 	var wg sync.WaitGroup
 
-	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
-	}
-	wg.Add(numWorkers)
 	// A channel to list any blocks that have been archived or
-	// deleted.  Any of these will result in an error, so the maximum
-	// we'll get is the same as the number of workers.
-	blocksToRemoveChan := make(chan *FileBlock, numWorkers)
-
-	worker := func() {
-		defer wg.Done()
-		for blockState := range blocks {
-			fbo.doOneBlockPut(ctx, md, blockState, errChan, blocksToRemoveChan)
+	// deleted.  Since the puts are spread over the shared put pool,
+	// any number of them could fail this way.
+	blocksToRemoveChan := make(chan *FileBlock, len(blockStates))
+
+	wg.Add(len(blockStates))
+	for i, blockState := range blockStates {
+		blockState := blockState
+		err := fbo.blockPuts.submit(ctx, func() {
+			defer wg.Done()
 			select {
-			// return early if the context has been canceled
+			// skip the put if the context has been canceled
 			case <-ctx.Done():
 				return
 			default:
 			}
+			fbo.doOneBlockPut(ctx, md, blockState, errChan, blocksToRemoveChan)
+		})
+		if err != nil {
+			// None of the remaining puts will run.
+			wg.Add(-(len(blockStates) - i))
+			select {
+			case errChan <- err:
+			default:
+			}
+			break
 		}
 	}
-	for i := 0; i < numWorkers; i++ {
-		go worker()
-	}
-
-	for _, blockState := range bps.blockStates {
-		blocks <- blockState
-	}
-	close(blocks)
 
 	go func() {
 		wg.Wait()
@@ -1722,12 +2268,12 @@ func (fbo *folderBranchOps) doBlockPuts(ctx context.Context,
 		// Wait for all the outstanding puts to finish, to amortize
 		// the work of re-doing the put.
 		for fblock := range blocksToRemoveChan {
-			for i, bs := range bps.blockStates {
+			for i, bs := range blockStates {
 				if bs.block == fblock {
 					// Let the caller know which blocks shouldn't be
 					// retried.
 					blocksToRemove = append(blocksToRemove,
-						bps.blockStates[i].blockPtr)
+						blockStates[i].blockPtr)
 				}
 			}
 
@@ -1752,7 +2298,7 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 			continue
 		}
 		if err := bcache.Put(newPtr, fbo.id(), blockState.block,
-			TransientEntry); err != nil {
+			TransientLocalEntry); err != nil {
 			return err
 		}
 	}
@@ -1784,6 +2330,12 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	doUnmergedPut, wasMasterBranch := true, fbo.isMasterBranchLocked(lState)
 	mergedRev := MetadataRevisionUninitialized
 
+	if fbo.mdWriteLimiter != nil && md.GetTlfHandle().IsShared() {
+		if err := fbo.mdWriteLimiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+
 	if fbo.isMasterBranchLocked(lState) {
 		// only do a normal Put if we're not already staged.
 		err = mdops.Put(ctx, md)
@@ -2004,7 +2556,12 @@ func checkDisallowedPrefixes(name string) error {
 }
 
 func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
-	lState *lockState, md *RootMetadata, dirPath path, newName string) error {
+	lState *lockState, md *RootMetadata, dirPath path, dblock *DirBlock,
+	newName string) error {
+	if err := fbo.checkNewDirEntry(dirPath, dblock); err != nil {
+		return err
+	}
+
 	// Check that the directory isn't past capacity already.
 	var currSize uint64
 	if dirPath.hasValidParent() {
@@ -2028,6 +2585,18 @@ func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
 	return nil
 }
 
+// checkNewDirEntry checks that the given directory has room for
+// another entry.
+func (fbo *folderBranchOps) checkNewDirEntry(
+	dirPath path, dblock *DirBlock) error {
+	maxEntries := fbo.config.MaxDirEntries()
+	if maxEntries > 0 && len(dblock.Children) >= maxEntries {
+		return DirTooManyEntriesError{dirPath, len(dblock.Children) + 1,
+			maxEntries}
+	}
+	return nil
+}
+
 // entryType must not by Sym.
 func (fbo *folderBranchOps) createEntryLocked(
 	ctx context.Context, lState *lockState, dir Node, name string,
@@ -2038,6 +2607,16 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, err
 	}
 
+	return fbo.createEntryAnyNameLocked(ctx, lState, dir, name, entryType)
+}
+
+// createEntryAnyNameLocked is like createEntryLocked, but it also
+// allows the names reserved for KBFS's own entries.
+func (fbo *folderBranchOps) createEntryAnyNameLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
 		return nil, DirEntry{},
 			NameTooLongError{name, fbo.config.MaxNameBytes()}
@@ -2064,7 +2643,8 @@ func (fbo *folderBranchOps) createEntryLocked(
 		return nil, DirEntry{}, NameExistsError{name}
 	}
 
-	if err := fbo.checkNewDirSize(ctx, lState, md, dirPath, name); err != nil {
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md, dirPath, dblock, name); err != nil {
 		return nil, DirEntry{}, err
 	}
 
@@ -2205,9 +2785,11 @@ func (fbo *folderBranchOps) CreateFile(
 	return n, ei, nil
 }
 
+// createLinkLocked creates a symlink to toPath, or, if linkID is set,
+// a hard link to the file with that link ID.
 func (fbo *folderBranchOps) createLinkLocked(
 	ctx context.Context, lState *lockState, dir Node, fromName string,
-	toPath string) (DirEntry, error) {
+	toPath string, linkID string) (DirEntry, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := checkDisallowedPrefixes(fromName); err != nil {
@@ -2236,6 +2818,9 @@ func (fbo *folderBranchOps) createLinkLocked(
 	}
 
 	// TODO: validate inputs
+	if linkID != "" {
+		toPath = hardLinkSymPath(dirPath, linkID)
+	}
 
 	// does name already exist?
 	if _, ok := dblock.Children[fromName]; ok {
@@ -2243,7 +2828,7 @@ func (fbo *folderBranchOps) createLinkLocked(
 	}
 
 	if err := fbo.checkNewDirSize(ctx, lState, md,
-		dirPath, fromName); err != nil {
+		dirPath, dblock, fromName); err != nil {
 		return DirEntry{}, err
 	}
 
@@ -2251,7 +2836,7 @@ func (fbo *folderBranchOps) createLinkLocked(
 
 	// Create a direntry for the link, and then sync
 	now := fbo.nowUnixNano()
-	dblock.Children[fromName] = DirEntry{
+	dblock.setEntry(fromName, DirEntry{
 		EntryInfo: EntryInfo{
 			Type:    Sym,
 			Size:    uint64(len(toPath)),
@@ -2259,6 +2844,10 @@ func (fbo *folderBranchOps) createLinkLocked(
 			Mtime:   now,
 			Ctime:   now,
 		},
+		LinkID: linkID,
+	})
+	if linkID != "" {
+		md.WFlags |= MetadataFlagHardLinks
 	}
 
 	_, err = fbo.syncBlockAndFinalizeLocked(
@@ -2284,7 +2873,8 @@ func (fbo *folderBranchOps) CreateLink(
 
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
+			de, err := fbo.createLinkLocked(
+				ctx, lState, dir, fromName, toPath, "")
 			ei = de.EntryInfo
 			return err
 		})
@@ -2294,1033 +2884,3315 @@ func (fbo *folderBranchOps) CreateLink(
 	return ei, nil
 }
 
-// unrefEntry modifies md to unreference all relevant blocks for the
-// given entry.
-func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, de DirEntry,
-	name string) error {
-	md.AddUnrefBlock(de.BlockInfo)
-	// construct a path for the child so we can unlink with it.
-	childPath := dir.ChildPath(name, de.BlockPointer)
+// hardLinksDirName is the directory, at the root of each folder, that
+// holds the files with hard links.  Each of those files is named by
+// a random link ID, and each of its names elsewhere in the folder is
+// a Sym entry with that LinkID.
+const hardLinksDirName = ".kbfs_links"
 
-	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
-			ctx, lState, md, childPath)
-		if err != nil {
-			return NoSuchBlockError{de.ID}
-		}
-		for _, blockInfo := range blockInfos {
-			md.AddUnrefBlock(blockInfo)
-		}
+// hardLinkSymPath returns the path, relative to dir, of the file with
+// the given link ID.
+func hardLinkSymPath(dir path, linkID string) string {
+	symPath := hardLinksDirName + "/" + linkID
+	// The first node of the path is the root of the folder.
+	for range dir.path[1:] {
+		symPath = "../" + symPath
 	}
-	return nil
+	return symPath
 }
 
-func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, dir path, name string) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+// isHardLinkPath returns whether p is the path of a file in the hard
+// links directory.
+func isHardLinkPath(p path) bool {
+	return len(p.path) == 3 && p.path[1].Name == hardLinksDirName
+}
 
-	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dir, blockWrite)
-	if err != nil {
-		return err
+func makeHardLinkID() (string, error) {
+	buf := make([]byte, 128/8)
+	if err := cryptoRandRead(buf); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(buf), nil
+}
 
-	// make sure the entry exists
-	de, ok := pblock.Children[name]
-	if !ok {
-		return NoSuchNameError{name}
+// rootPath returns the path of the root directory of the folder, as
+// of md.
+func (fbo *folderBranchOps) rootPath(md *RootMetadata) path {
+	return path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			BlockPointer: md.data.Dir.BlockPointer,
+			Name:         string(md.GetTlfHandle().GetCanonicalName()),
+		}},
 	}
+}
 
-	md.AddOp(newRmOp(name, dir.tailPointer()))
-	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+// getHardLink returns the path and entry of the file with the given
+// link ID, in the folder with the given root.
+func (fbo *folderBranchOps) getHardLink(ctx context.Context,
+	lState *lockState, md *RootMetadata, root path, linkID string) (
+	path, DirEntry, error) {
+	linksDe, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, root.ChildPathNoPtr(hardLinksDirName))
 	if err != nil {
-		return err
+		return path{}, DirEntry{}, err
+	}
+	linksPath := root.ChildPath(hardLinksDirName, linksDe.BlockPointer)
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, linksPath.ChildPathNoPtr(linkID))
+	if err != nil {
+		return path{}, DirEntry{}, err
 	}
+	return linksPath.ChildPath(linkID, de.BlockPointer), de, nil
+}
 
-	// the actual unlink
-	delete(pblock.Children, name)
+// getHardLinkNode returns the node and entry of the file with the
+// given link ID, in the folder with the given root.
+func (fbo *folderBranchOps) getHardLinkNode(ctx context.Context,
+	lState *lockState, md *RootMetadata, root path, linkID string) (
+	Node, DirEntry, error) {
+	filePath, de, err := fbo.getHardLink(ctx, lState, md, root, linkID)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	err = fbo.checkDataVersion(filePath, de.BlockPointer)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
 
-	// sync the parent directory
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
-		Dir, true, true, zeroPtr)
+	rootNode := fbo.nodeCache.Get(root.tailPointer().ref())
+	if rootNode == nil {
+		return nil, DirEntry{}, InvalidPathError{root}
+	}
+	linksNode, err := fbo.nodeCache.GetOrCreate(
+		filePath.parentPath().tailPointer(), hardLinksDirName, rootNode)
 	if err != nil {
-		return err
+		return nil, DirEntry{}, err
 	}
-	return nil
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, linkID, linksNode)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return node, de, nil
 }
 
-func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
-	lState *lockState, dir Node, dirName string) (err error) {
+// getHardLinksDirLocked returns the node of the hard links directory,
+// creating it if it doesn't exist yet.
+func (fbo *folderBranchOps) getHardLinksDirLocked(
+	ctx context.Context, lState *lockState) (Node, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	// verify we have permission to write
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	root := fbo.rootPath(md)
+	rootNode, err := fbo.nodeCache.GetOrCreate(
+		root.tailPointer(), root.tailName(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
-	de, ok := pblock.Children[dirName]
-	if !ok {
-		return NoSuchNameError{dirName}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, root.ChildPathNoPtr(hardLinksDirName))
+	switch err.(type) {
+	case nil:
+		return fbo.nodeCache.GetOrCreate(
+			de.BlockPointer, hardLinksDirName, rootNode)
+	case NoSuchNameError:
+		node, _, err := fbo.createEntryAnyNameLocked(
+			ctx, lState, rootNode, hardLinksDirName, Dir)
+		return node, err
+	default:
+		return nil, err
 	}
+}
 
-	// construct a path for the child so we can check for an empty dir
-	childPath := dirPath.ChildPath(dirName, de.BlockPointer)
+// setLinksLocked sets the number of hard links to the given file in
+// the hard links directory.
+func (fbo *folderBranchOps) setLinksLocked(
+	ctx context.Context, lState *lockState, file path, links uint32) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	childBlock, err := fbo.blocks.GetDir(
-		ctx, lState, md, childPath, blockRead)
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
 
-	if len(childBlock.Children) > 0 {
-		return DirNotEmptyError{dirName}
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return err
 	}
 
-	return fbo.removeEntryLocked(ctx, lState, md, dirPath, dirName)
+	parentPath := file.parentPath()
+	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), linksAttr,
+		file.tailPointer()))
+
+	// Older clients don't know to keep the link counts up to date,
+	// so they must not write to the folder anymore.
+	md.WFlags |= MetadataFlagHardLinks
+	de.Links = links
+	de.Ctime = fbo.nowUnixNano()
+	dblock.setEntry(file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
 }
 
-func (fbo *folderBranchOps) RemoveDir(
-	ctx context.Context, dir Node, dirName string) (err error) {
-	fbo.log.CDebugf(ctx, "RemoveDir %p %s", dir.GetID(), dirName)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+// getLinkIDLocked returns the link ID of the named entry in dir, if
+// the entry exists and is a hard link.
+func (fbo *folderBranchOps) getLinkIDLocked(ctx context.Context,
+	lState *lockState, dir path, name string) (string, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(dir)
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
-		return
+		return "", err
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.removeDirLocked(ctx, lState, dir, dirName)
-		})
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, dir.ChildPathNoPtr(name))
+	if _, ok := err.(NoSuchNameError); ok {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return de.LinkID, nil
 }
 
-func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
-	name string) (err error) {
-	fbo.log.CDebugf(ctx, "RemoveEntry %p %s", dir.GetID(), name)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+// unlinkHardLinkLocked drops one hard link to the file with the given
+// link ID, whose entry must already be gone, and removes the file if
+// that was its last link.
+func (fbo *folderBranchOps) unlinkHardLinkLocked(ctx context.Context,
+	lState *lockState, linkID string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(dir)
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			// verify we have permission to write
-			md, err := fbo.getMDForWriteLocked(ctx, lState)
-			if err != nil {
-				return err
-			}
-
-			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
-			if err != nil {
-				return err
-			}
+	filePath, de, err := fbo.getHardLink(
+		ctx, lState, md, fbo.rootPath(md), linkID)
+	if _, ok := err.(NoSuchNameError); ok {
+		// There's nothing left to unlink.
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
-		})
+	if de.Links > 1 {
+		return fbo.setLinksLocked(ctx, lState, filePath, de.Links-1)
+	}
+	return fbo.removeEntryLocked(
+		ctx, lState, md, *filePath.parentPath(), linkID)
 }
 
-func (fbo *folderBranchOps) renameLocked(
-	ctx context.Context, lState *lockState, oldParent path,
-	oldName string, newParent path, newName string) (err error) {
+// createHardLinkLocked links the target file under the given name in
+// dir.  The first time a file is linked, it moves into the hard links
+// directory, and gets a link under its old name.  Each step is its
+// own revision, ordered so that an interrupted link can at worst
+// leave an unreachable file behind.  The first step marks the folder
+// with MetadataFlagHardLinks, so older clients, which would remove
+// links without updating the link counts, can't write to it.
+func (fbo *folderBranchOps) createHardLinkLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	target Node) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
 	// verify we have permission to write
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
 
-	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
-		ctx, lState, md, oldParent, oldName, newParent, newName)
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
 
+	targetPath, err := fbo.pathFromNodeForMDWriteLocked(lState, target)
 	if err != nil {
 		return err
 	}
 
-	// does name exist?
-	if de, ok := newPBlock.Children[newName]; ok {
-		if de.Type == Dir {
-			fbo.log.CWarningf(ctx, "Renaming over a directory (%s/%s) is not "+
-				"allowed.", newParent, newName)
-			return NotFileError{newParent.ChildPathNoPtr(newName)}
-		}
+	if !targetPath.hasValidParent() {
+		return NotFileError{targetPath}
+	}
 
-		// Delete the old block pointed to by this direntry.
-		err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, targetPath)
+	if err != nil {
+		return err
+	}
+	if de.Type != File && de.Type != Exec {
+		return NotFileError{targetPath}
+	}
+
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	if err != nil {
+		return err
+	}
+	if _, ok := dblock.Children[name]; ok {
+		return NameExistsError{name}
+	}
+
+	linkID := targetPath.tailName()
+	if isHardLinkPath(targetPath) {
+		err = fbo.setLinksLocked(ctx, lState, targetPath, de.Links+1)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Set the link count while the file is still in place, so
+		// that the folder is marked as using hard links before
+		// anything moves.
+		err = fbo.setLinksLocked(ctx, lState, targetPath, 2)
 		if err != nil {
 			return err
 		}
-	}
 
-	// only the ctime changes
-	newDe.Ctime = fbo.nowUnixNano()
-	newPBlock.Children[newName] = newDe
-	delete(oldPBlock.Children, oldName)
+		linksDir, err := fbo.getHardLinksDirLocked(ctx, lState)
+		if err != nil {
+			return err
+		}
 
-	// find the common ancestor
-	var i int
-	found := false
-	// the root block will always be the same, so start at number 1
-	for i = 1; i < len(oldParent.path) && i < len(newParent.path); i++ {
-		if oldParent.path[i].ID != newParent.path[i].ID {
-			found = true
-			i--
-			break
+		// The revisions so far have changed the paths.
+		linksPath, err := fbo.pathFromNodeForMDWriteLocked(lState, linksDir)
+		if err != nil {
+			return err
 		}
-	}
-	if !found {
-		// if we couldn't find one, then the common ancestor is the
-		// last node in the shorter path
-		if len(oldParent.path) < len(newParent.path) {
-			i = len(oldParent.path) - 1
-		} else {
-			i = len(newParent.path) - 1
+		targetPath, err = fbo.pathFromNodeForMDWriteLocked(lState, target)
+		if err != nil {
+			return err
 		}
-	}
-	commonAncestor := oldParent.path[i].BlockPointer
-	oldIsCommon := oldParent.tailPointer() == commonAncestor
-	newIsCommon := newParent.tailPointer() == commonAncestor
 
-	newOldPath := path{FolderBranch: oldParent.FolderBranch}
-	var oldBps *blockPutState
-	if oldIsCommon {
-		if newIsCommon {
-			// if old and new are both the common ancestor, there is
-			// nothing to do (syncBlock will take care of everything)
-		} else {
-			// If the old one is common and the new one is
-			// not, then the last
-			// syncBlockAndCheckEmbedLocked call will need
-			// to access the old one.
-			lbc[oldParent.tailPointer()] = oldPBlock
+		parentPath := *targetPath.parentPath()
+		parent := fbo.nodeCache.Get(parentPath.tailPointer().ref())
+		if parent == nil {
+			return InvalidPathError{parentPath}
 		}
-	} else {
-		if newIsCommon {
-			// If the new one is common, then the first
-			// syncBlockAndCheckEmbedLocked call will need to access
-			// it.
-			lbc[newParent.tailPointer()] = newPBlock
+		oldName := targetPath.tailName()
+		linkID, err = makeHardLinkID()
+		if err != nil {
+			return err
 		}
 
-		// The old one is not the common ancestor, so we need to sync it.
-		// TODO: optimize by pushing blocks from both paths in parallel
-		newOldPath, _, oldBps, err = fbo.syncBlockAndCheckEmbedLocked(
-			ctx, lState, md, oldPBlock, *oldParent.parentPath(), oldParent.tailName(),
-			Dir, true, true, commonAncestor, lbc)
+		// The target node follows the file into the hard links
+		// directory.
+		err = fbo.renameLocked(
+			ctx, lState, parentPath, oldName, linksPath, linkID)
+		if err != nil {
+			return err
+		}
+		_, err = fbo.createLinkLocked(ctx, lState, parent, oldName, "", linkID)
 		if err != nil {
 			return err
 		}
 	}
 
-	newNewPath, _, newBps, err := fbo.syncBlockAndCheckEmbedLocked(
-		ctx, lState, md, newPBlock, *newParent.parentPath(), newParent.tailName(),
-		Dir, true, true, zeroPtr, lbc)
-	if err != nil {
-		return err
-	}
+	_, err = fbo.createLinkLocked(ctx, lState, dir, name, "", linkID)
+	return err
+}
 
-	// newOldPath is really just a prefix now.  A copy is necessary as an
-	// append could cause the new path to contain nodes from the old path.
-	newOldPath.path = append(make([]pathNode, i+1, i+1), newOldPath.path...)
-	copy(newOldPath.path[:i+1], newNewPath.path[:i+1])
+func (fbo *folderBranchOps) CreateHardLink(
+	ctx context.Context, dir Node, name string, target Node) (err error) {
+	fbo.log.CDebugf(ctx, "CreateHardLink %p %s -> %p",
+		dir.GetID(), name, target.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	// merge and finalize the blockPutStates
-	if oldBps != nil {
-		newBps.mergeOtherBps(oldBps)
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return err
 	}
 
-	defer func() {
-		if err != nil {
-			fbo.fbm.cleanUpBlockState(md, newBps)
-		}
-	}()
-
-	_, err = fbo.doBlockPuts(ctx, md, *newBps)
+	err = fbo.flushCoalescedWrites(ctx)
 	if err != nil {
 		return err
 	}
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, newBps)
-}
-
-func (fbo *folderBranchOps) Rename(
-	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) (err error) {
-	fbo.log.CDebugf(ctx, "Rename %p/%s -> %p/%s", oldParent.GetID(),
-		oldName, newParent.GetID(), newName)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
-
-	err = fbo.checkNode(newParent)
+	err = fbo.checkNode(target)
 	if err != nil {
 		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			oldParentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, oldParent)
-			if err != nil {
-				return err
-			}
-
-			newParentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, newParent)
-			if err != nil {
-				return err
-			}
+			return fbo.createHardLinkLocked(ctx, lState, dir, name, target)
+		})
+}
 
-			// only works for paths within the same topdir
-			if oldParentPath.FolderBranch != newParentPath.FolderBranch {
-				return RenameAcrossDirsError{}
-			}
+// unrefEntry modifies md to unreference all relevant blocks for the
+// given entry.
+func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, de DirEntry,
+	name string) error {
+	md.AddUnrefBlock(de.BlockInfo)
+	// construct a path for the child so we can unlink with it.
+	childPath := dir.ChildPath(name, de.BlockPointer)
 
-			return fbo.renameLocked(ctx, lState, oldParentPath, oldName,
-				newParentPath, newName)
-		})
+	// If this is an indirect block, we need to delete all of its
+	// children as well. NOTE: non-empty directories can't be
+	// removed, so no need to check for indirect directory blocks
+	// here.
+	if de.Type == File || de.Type == Exec {
+		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, md, childPath)
+		if err != nil {
+			return NoSuchBlockError{de.ID}
+		}
+		for _, blockInfo := range blockInfos {
+			md.AddUnrefBlock(blockInfo)
+		}
+	}
+	return nil
 }
 
-func (fbo *folderBranchOps) Read(
-	ctx context.Context, file Node, dest []byte, off int64) (
-	n int64, err error) {
-	fbo.log.CDebugf(ctx, "Read %p %d %d", file.GetID(), len(dest), off)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(file)
+	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dir, blockWrite)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	// Don't let the goroutine below write directly to the return
-	// variable, since if the context is canceled the goroutine might
-	// outlast this function call, and end up in a read/write race
-	// with the caller.
-	var bytesRead int64
-	err = runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
+	// make sure the entry exists
+	de, ok := pblock.Children[name]
+	if !ok {
+		return NoSuchNameError{name}
+	}
 
-		// verify we have permission to read
-		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
-		if err != nil {
-			return err
-		}
+	md.AddOp(newRmOp(name, dir.tailPointer()))
+	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+	if err != nil {
+		return err
+	}
 
-		filePath, err := fbo.pathFromNodeForRead(file)
-		if err != nil {
-			return err
-		}
+	// the actual unlink
+	pblock.removeEntry(name)
 
-		bytesRead, err = fbo.blocks.Read(ctx, lState, md, filePath, dest, off)
-		return err
-	})
+	// sync the parent directory
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, pblock, *dir.parentPath(), dir.tailName(),
+		Dir, true, true, zeroPtr)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return bytesRead, nil
+	return nil
 }
 
-func (fbo *folderBranchOps) Write(
-	ctx context.Context, file Node, data []byte, off int64) (err error) {
-	fbo.log.CDebugf(ctx, "Write %p %d %d", file.GetID(), len(data), off)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
+	lState *lockState, dir Node, dirName string) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(file)
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
-		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
-		if err != nil {
-			return err
-		}
-
-		err = fbo.blocks.Write(ctx, lState, md, file, data, off)
-		if err != nil {
-			return err
-		}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
 
-		fbo.status.addDirtyNode(file)
-		return nil
-	})
-}
+	pblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	de, ok := pblock.Children[dirName]
+	if !ok {
+		return NoSuchNameError{dirName}
+	}
 
-func (fbo *folderBranchOps) Truncate(
-	ctx context.Context, file Node, size uint64) (err error) {
-	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	// construct a path for the child so we can check for an empty dir
+	childPath := dirPath.ChildPath(dirName, de.BlockPointer)
 
-	err = fbo.checkNode(file)
+	childBlock, err := fbo.blocks.GetDir(
+		ctx, lState, md, childPath, blockRead)
 	if err != nil {
 		return err
 	}
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
-		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
-		if err != nil {
-			return err
-		}
-
-		err = fbo.blocks.Truncate(ctx, lState, md, file, size)
-		if err != nil {
-			return err
-		}
+	if len(childBlock.Children) > 0 {
+		return DirNotEmptyError{dirName}
+	}
 
-		fbo.status.addDirtyNode(file)
-		return nil
-	})
+	return fbo.removeEntryLocked(ctx, lState, md, dirPath, dirName)
 }
 
-func (fbo *folderBranchOps) setExLocked(
-	ctx context.Context, lState *lockState, file path,
-	ex bool) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+// checkDeletion asks the configured DeletionPolicy, if any, whether
+// the named entry of dir may be deleted, if this is a shared folder.
+// It must not be called with mdWriterLock held, since the policy may
+// wait for a confirmation.
+func (fbo *folderBranchOps) checkDeletion(
+	ctx context.Context, dir Node, name string) error {
+	policy := fbo.config.DeletionPolicy()
+	if policy == nil {
+		return nil
+	}
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 	if err != nil {
-		return
+		return err
+	}
+	handle := md.GetTlfHandle()
+	if !handle.IsShared() {
+		return nil
 	}
 
-	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
-		ctx, lState, md, file)
+	dirPath, err := fbo.pathFromNodeForRead(dir)
 	if err != nil {
-		return
+		return err
 	}
-
-	// If the file is a symlink, do nothing (to match ext4
-	// behavior).
-	if de.Type == Sym {
-		return
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name))
+	if _, ok := err.(NoSuchNameError); ok {
+		// Nothing will be deleted.
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	if ex && (de.Type == File) {
-		de.Type = Exec
-	} else if !ex && (de.Type == Exec) {
-		de.Type = File
+	var bytes uint64
+	if de.Type == File || de.Type == Exec {
+		bytes = de.Size
 	}
-
-	parentPath := file.parentPath()
-	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), exAttr,
-		file.tailPointer()))
-
-	// If the type isn't File or Exec, there's nothing to do, but
-	// change the ctime anyway (to match ext4 behavior).
-	de.Ctime = fbo.nowUnixNano()
-	dblock.Children[file.tailName()] = de
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr)
-	return err
+	return policy.CheckDeletion(
+		ctx, fbo.id(), handle.GetCanonicalName(), 1, bytes)
 }
 
-func (fbo *folderBranchOps) SetEx(
-	ctx context.Context, file Node, ex bool) (err error) {
-	fbo.log.CDebugf(ctx, "SetEx %p %t", file.GetID(), ex)
+func (fbo *folderBranchOps) RemoveDir(
+	ctx context.Context, dir Node, dirName string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveDir %p %s", dir.GetID(), dirName)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNode(dir)
 	if err != nil {
 		return
 	}
 
+	err = fbo.checkDeletion(ctx, dir, dirName)
+	if err != nil {
+		return err
+	}
+
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
-
-			return fbo.setExLocked(ctx, lState, filePath, ex)
+			return fbo.removeDirLocked(ctx, lState, dir, dirName)
 		})
 }
 
-func (fbo *folderBranchOps) setMtimeLocked(
-	ctx context.Context, lState *lockState, file path,
-	mtime *time.Time) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
+	name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveEntry %p %s", dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	err = fbo.checkNode(dir)
 	if err != nil {
 		return err
 	}
 
-	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
-		ctx, lState, md, file)
+	err = fbo.flushCoalescedWrites(ctx)
 	if err != nil {
 		return err
 	}
 
-	parentPath := file.parentPath()
-	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), mtimeAttr,
-		file.tailPointer()))
-
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
-	de.Ctime = fbo.nowUnixNano()
-	dblock.Children[file.tailName()] = de
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr)
-	return err
-}
-
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
-
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
-	}
-
-	err = fbo.checkNode(file)
+	err = fbo.checkDeletion(ctx, dir, name)
 	if err != nil {
-		return
+		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			// verify we have permission to write
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
 			if err != nil {
 				return err
 			}
 
-			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+			if err != nil {
+				return err
+			}
+
+			if md.Extra.TrashRetention > 0 && isTrashable(dirPath) {
+				return fbo.trashEntryLocked(ctx, lState, dir, name)
+			}
+
+			linkID, err := fbo.getLinkIDLocked(ctx, lState, dirPath, name)
+			if err != nil {
+				return err
+			}
+
+			err = fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
+			if err != nil || linkID == "" {
+				return err
+			}
+			return fbo.unlinkHardLinkLocked(ctx, lState, linkID)
 		})
 }
 
-func (fbo *folderBranchOps) syncLocked(ctx context.Context,
-	lState *lockState, file path) (stillDirty bool, err error) {
+func (fbo *folderBranchOps) renameLocked(
+	ctx context.Context, lState *lockState, oldParent path,
+	oldName string, newParent path, newName string) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	// if the cache for this file isn't dirty, we're done
-	if !fbo.blocks.IsDirty(lState, file) {
-		return false, nil
-	}
-
-	// Verify we have permission to write.  We do this after the dirty
-	// check because otherwise readers who sync clean files on close
-	// would get an error.
+	// verify we have permission to write
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
-		return true, err
+		return err
 	}
 
-	// If the MD doesn't match the MD expected by the path, that
-	// implies we are using a cached path, which implies the node has
-	// been unlinked.  In that case, we can safely ignore this sync.
-	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
-		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
-			file.tailPointer())
-		// Removing the cached info here is a little sketchy,
-		// since there's no guarantee that this sync comes
-		// from closing the file, and we still want to serve
-		// stat calls accurately if the user still has an open
-		// handle to this file. TODO: Hook this in with the
-		// node cache GC logic to be perfectly accurate.
-		return true, fbo.blocks.ClearCacheInfo(lState, file)
-	}
+	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
+		ctx, lState, md, oldParent, oldName, newParent, newName)
 
-	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return true, err
+		return err
 	}
 
-	// notify the daemon that a write is being performed
-	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
-	defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+	// does name exist?
+	if de, ok := newPBlock.Children[newName]; ok {
+		if de.Type == Dir {
+			fbo.log.CWarningf(ctx, "Renaming over a directory (%s/%s) is not "+
+				"allowed.", newParent, newName)
+			return NotFileError{newParent.ChildPathNoPtr(newName)}
+		}
 
-	// Filled in by doBlockPuts below.
-	var blocksToRemove []BlockPointer
-	fblock, bps, lbc, syncState, err :=
-		fbo.blocks.StartSync(ctx, lState, md, uid, file)
-	defer func() {
-		fbo.blocks.CleanupSyncState(
-			ctx, lState, file, blocksToRemove, syncState, err)
-	}()
-	if err != nil {
-		return true, err
+		// Delete the old block pointed to by this direntry.
+		err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
+		if err != nil {
+			return err
+		}
+	} else if oldParent.tailPointer() != newParent.tailPointer() {
+		if err := fbo.checkNewDirEntry(newParent, newPBlock); err != nil {
+			return err
+		}
 	}
 
-	newPath, _, newBps, err :=
-		fbo.syncBlockAndCheckEmbedLocked(
-			ctx, lState, md, fblock, *file.parentPath(),
-			file.tailName(), File, true, true, zeroPtr, lbc)
-	if err != nil {
-		return true, err
+	// only the ctime changes
+	newDe.Ctime = fbo.nowUnixNano()
+	newPBlock.setEntry(newName, newDe)
+	oldPBlock.removeEntry(oldName)
+
+	// find the common ancestor
+	var i int
+	found := false
+	// the root block will always be the same, so start at number 1
+	for i = 1; i < len(oldParent.path) && i < len(newParent.path); i++ {
+		if oldParent.path[i].ID != newParent.path[i].ID {
+			found = true
+			i--
+			break
+		}
+	}
+	if !found {
+		// if we couldn't find one, then the common ancestor is the
+		// last node in the shorter path
+		if len(oldParent.path) < len(newParent.path) {
+			i = len(oldParent.path) - 1
+		} else {
+			i = len(newParent.path) - 1
+		}
 	}
+	commonAncestor := oldParent.path[i].BlockPointer
+	oldIsCommon := oldParent.tailPointer() == commonAncestor
+	newIsCommon := newParent.tailPointer() == commonAncestor
 
-	bps.mergeOtherBps(newBps)
+	newOldPath := path{FolderBranch: oldParent.FolderBranch}
+	var oldBps *blockPutState
+	if oldIsCommon {
+		if newIsCommon {
+			// if old and new are both the common ancestor, there is
+			// nothing to do (syncBlock will take care of everything)
+		} else {
+			// If the old one is common and the new one is
+			// not, then the last
+			// syncBlockAndCheckEmbedLocked call will need
+			// to access the old one.
+			lbc[oldParent.tailPointer()] = oldPBlock
+		}
+	} else {
+		if newIsCommon {
+			// If the new one is common, then the first
+			// syncBlockAndCheckEmbedLocked call will need to access
+			// it.
+			lbc[newParent.tailPointer()] = newPBlock
+		}
 
-	defer func() {
+		// The old one is not the common ancestor, so we need to sync it.
+		// TODO: optimize by pushing blocks from both paths in parallel
+		newOldPath, _, oldBps, err = fbo.syncBlockAndCheckEmbedLocked(
+			ctx, lState, md, oldPBlock, *oldParent.parentPath(), oldParent.tailName(),
+			Dir, true, true, commonAncestor, lbc)
 		if err != nil {
-			fbo.fbm.cleanUpBlockState(md, bps)
+			return err
 		}
-	}()
+	}
 
-	blocksToRemove, err = fbo.doBlockPuts(ctx, md, *bps)
+	newNewPath, _, newBps, err := fbo.syncBlockAndCheckEmbedLocked(
+		ctx, lState, md, newPBlock, *newParent.parentPath(), newParent.tailName(),
+		Dir, true, true, zeroPtr, lbc)
 	if err != nil {
-		return true, err
+		return err
 	}
 
-	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps)
-	if err != nil {
-		return true, err
+	// newOldPath is really just a prefix now.  A copy is necessary as an
+	// append could cause the new path to contain nodes from the old path.
+	newOldPath.path = append(make([]pathNode, i+1, i+1), newOldPath.path...)
+	copy(newOldPath.path[:i+1], newNewPath.path[:i+1])
+
+	// merge and finalize the blockPutStates
+	if oldBps != nil {
+		newBps.mergeOtherBps(oldBps)
 	}
 
-	// At this point, all reads through the old path (i.e., file)
-	// see writes that happened since StartSync, whereas all reads
-	// through the new path (newPath) don't.
-	//
-	// TODO: This isn't completely correct, since reads that
-	// happen after a write should always see the new data.
-	//
-	// After FinishSync succeeds, then reads through both the old
-	// and the new paths will see the writes that happened during
-	// the sync.
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md, newBps)
+		}
+	}()
 
-	return fbo.blocks.FinishSync(ctx, lState, file, newPath, md, syncState)
+	_, err = fbo.doBlockPuts(ctx, md, *newBps)
+	if err != nil {
+		return err
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, newBps)
 }
 
-func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
-	fbo.log.CDebugf(ctx, "Sync %p", file.GetID())
+func (fbo *folderBranchOps) Rename(
+	ctx context.Context, oldParent Node, oldName string, newParent Node,
+	newName string) (err error) {
+	fbo.log.CDebugf(ctx, "Rename %p/%s -> %p/%s", oldParent.GetID(),
+		oldName, newParent.GetID(), newName)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNode(newParent)
 	if err != nil {
-		return
+		return err
 	}
 
-	var stillDirty bool
-	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
-
-			stillDirty, err = fbo.syncLocked(ctx, lState, filePath)
-			return err
-		})
+	err = fbo.flushCoalescedWrites(ctx)
 	if err != nil {
 		return err
 	}
 
-	if !stillDirty {
-		fbo.status.rmDirtyNode(file)
+	// Renaming over an existing file deletes it.
+	err = fbo.checkDeletion(ctx, newParent, newName)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func (fbo *folderBranchOps) FolderStatus(
-	ctx context.Context, folderBranch FolderBranch) (
-	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
-	fbo.log.CDebugf(ctx, "Status")
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			oldParentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, oldParent)
+			if err != nil {
+				return err
+			}
 
-	if folderBranch != fbo.folderBranch {
-		return FolderBranchStatus{}, nil,
-			WrongOpsError{fbo.folderBranch, folderBranch}
-	}
+			newParentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, newParent)
+			if err != nil {
+				return err
+			}
 
-	// Wait for conflict resolution to settle down, if necessary.
-	fbo.cr.Wait(ctx)
+			// only works for paths within the same topdir
+			if oldParentPath.FolderBranch != newParentPath.FolderBranch {
+				return RenameAcrossDirsError{}
+			}
 
-	return fbo.status.getStatus(ctx)
-}
+			// A hard link being renamed over loses a link.
+			linkID, err := fbo.getLinkIDLocked(
+				ctx, lState, newParentPath, newName)
+			if err != nil {
+				return err
+			}
 
-func (fbo *folderBranchOps) Status(
-	ctx context.Context) (
-	fbs KBFSStatus, updateChan <-chan StatusUpdate, err error) {
-	return KBFSStatus{}, nil, InvalidOpError{}
+			err = fbo.renameLocked(ctx, lState, oldParentPath, oldName,
+				newParentPath, newName)
+			if err != nil || linkID == "" {
+				return err
+			}
+			return fbo.unlinkHardLinkLocked(ctx, lState, linkID)
+		})
 }
 
-// RegisterForChanges registers a single Observer to receive
-// notifications about this folder/branch.
-func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
-	// It's the caller's responsibility to make sure
-	// RegisterForChanges isn't called twice for the same Observer
-	fbo.observers.add(obs)
-	return nil
-}
+// getRootNodeForMDWriteLocked returns the node of the root directory
+// of the folder, as of the head.
+func (fbo *folderBranchOps) getRootNodeForMDWriteLocked(
+	ctx context.Context, lState *lockState) (Node, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-// UnregisterFromChanges stops an Observer from getting notifications
-// about the folder/branch.
-func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
-	fbo.observers.remove(obs)
-	return nil
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	root := fbo.rootPath(md)
+	return fbo.nodeCache.GetOrCreate(root.tailPointer(), root.tailName(), nil)
 }
 
-// notifyBatchLocked sends out a notification for the most recent op
-// in md.
-func (fbo *folderBranchOps) notifyBatchLocked(
-	ctx context.Context, lState *lockState, md *RootMetadata) {
-	fbo.headLock.AssertLocked(lState)
-
-	lastOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
-	fbo.notifyOneOpLocked(ctx, lState, lastOp, md)
-}
+// getOrCreateDirLocked returns the node of the named subdirectory of
+// dir, creating it first if it doesn't exist.  Any name is allowed,
+// including the ones reserved for KBFS's own entries.  It returns
+// NameExistsError if something other than a directory has the name.
+func (fbo *folderBranchOps) getOrCreateDirLocked(ctx context.Context,
+	lState *lockState, dir Node, name string) (Node, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-// searchForNode tries to figure out the path to the given
-// blockPointer, using only the block updates that happened as part of
-// a given MD update operation.
-func (fbo *folderBranchOps) searchForNode(ctx context.Context,
-	ptr BlockPointer, md *RootMetadata) (Node, error) {
-	// Record which pointers are new to this update, and thus worth
-	// searching.
-	newPtrs := make(map[BlockPointer]bool)
-	for _, op := range md.data.Changes.Ops {
-		for _, update := range op.AllUpdates() {
-			newPtrs[update.Ref] = true
-		}
-		for _, ref := range op.Refs() {
-			newPtrs[ref] = true
-		}
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
 	}
 
-	nodeMap, err := fbo.blocks.SearchForNodes(ctx, fbo.nodeCache, []BlockPointer{ptr},
-		newPtrs, md)
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	n, ok := nodeMap[ptr]
-	if !ok {
-		return nil, NodeNotFoundError{ptr}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name))
+	switch err.(type) {
+	case nil:
+		if de.Type != Dir {
+			return nil, NameExistsError{name}
+		}
+		return fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+	case NoSuchNameError:
+		node, _, err := fbo.createEntryAnyNameLocked(
+			ctx, lState, dir, name, Dir)
+		return node, err
+	default:
+		return nil, err
 	}
-
-	return n, nil
 }
 
-func (fbo *folderBranchOps) unlinkFromCache(op op, oldDir BlockPointer,
-	node Node, name string) error {
-	// The entry could be under any one of the unref'd blocks, and
-	// it's safe to perform this when the pointer isn't real, so just
-	// try them all to avoid the overhead of looking up the right
-	// pointer in the old version of the block.
-	p, err := fbo.pathFromNodeForRead(node)
+// getOrCreateSettingsDir returns the node of the settings directory
+// at the root of the folder, creating it first if it doesn't exist.
+// Its name is reserved, so it can't be made with CreateDir.
+func (fbo *folderBranchOps) getOrCreateSettingsDir(
+	ctx context.Context) (n Node, err error) {
+	fbo.log.CDebugf(ctx, "getOrCreateSettingsDir")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			rootNode, err := fbo.getRootNodeForMDWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			n, err = fbo.getOrCreateDirLocked(
+				ctx, lState, rootNode, settingsDirName)
+			return err
+		})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return n, nil
+}
 
-	childPath := p.ChildPathNoPtr(name)
+// moveToTrashLocked moves the named entry of dir into the trash,
+// under the given removal time directory and then the same path it
+// had from the root of the folder.  It returns NameExistsError if
+// something with that path is already there.  Like hard links, each
+// directory it makes is its own revision, and the entry moves in a
+// final rename, so an interruption at worst leaves empty
+// directories in the trash.
+func (fbo *folderBranchOps) moveToTrashLocked(ctx context.Context,
+	lState *lockState, dir Node, name string, stamp string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	// revert the parent pointer
-	childPath.path[len(childPath.path)-2].BlockPointer = oldDir
-	for _, ptr := range op.Unrefs() {
-		childPath.path[len(childPath.path)-1].BlockPointer = ptr
-		fbo.nodeCache.Unlink(ptr.ref(), childPath)
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+	var dirNames []string
+	for _, pn := range dirPath.path[1:] {
+		dirNames = append(dirNames, pn.Name)
 	}
 
-	return nil
+	rootNode, err := fbo.getRootNodeForMDWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	parent := rootNode
+	for _, dirName := range append([]string{trashDirName, stamp}, dirNames...) {
+		parent, err = fbo.getOrCreateDirLocked(ctx, lState, parent, dirName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Making the directories changed the paths.
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+	parentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, parent)
+	if err != nil {
+		return err
+	}
+	_, err = fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, parentPath.ChildPathNoPtr(name))
+	switch err.(type) {
+	case nil:
+		return NameExistsError{name}
+	case NoSuchNameError:
+	default:
+		return err
+	}
+	return fbo.renameLocked(ctx, lState, dirPath, name, parentPath, name)
 }
 
-func (fbo *folderBranchOps) updatePointers(op op) {
-	for _, update := range op.AllUpdates() {
-		oldRef := update.Unref.ref()
-		fbo.nodeCache.UpdatePointer(oldRef, update.Ref)
+// trashEntryLocked moves the named entry of dir into the trash.  A
+// hard link keeps its link while it's in the trash, and only drops
+// it once it's purged.
+func (fbo *folderBranchOps) trashEntryLocked(ctx context.Context,
+	lState *lockState, dir Node, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	removed := fbo.config.Clock().Now().UTC()
+	err := fbo.moveToTrashLocked(
+		ctx, lState, dir, name, removed.Format(trashTimeFormat))
+	if _, ok := err.(NameExistsError); !ok {
+		return err
 	}
+	// The same path was already trashed within this second.
+	return fbo.moveToTrashLocked(
+		ctx, lState, dir, name, removed.Format(trashTimeFormatNano))
 }
 
-func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
-	lState *lockState, op op, md *RootMetadata) {
-	fbo.headLock.AssertLocked(lState)
+// removeTreeLocked deletes the named entry of dir, and everything
+// under it, one entry per revision.
+func (fbo *folderBranchOps) removeTreeLocked(ctx context.Context,
+	lState *lockState, dir Node, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	fbo.updatePointers(op)
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, dirPath.ChildPathNoPtr(name))
+	if err != nil {
+		return err
+	}
 
-	var changes []NodeChange
-	switch realOp := op.(type) {
-	default:
-		return
-	case *createOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
-		if node == nil {
-			return
+	if de.Type == Dir {
+		node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+		if err != nil {
+			return err
 		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: create %s in node %p",
-			realOp.NewName, node.GetID())
-		changes = append(changes, NodeChange{
-			Node:       node,
-			DirUpdated: []string{realOp.NewName},
-		})
-	case *rmOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
-		if node == nil {
-			return
+		children, err := fbo.blocks.GetDirtyDirChildren(
+			ctx, lState, md, dirPath.ChildPath(name, de.BlockPointer))
+		if err != nil {
+			return err
 		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: remove %s in node %p",
-			realOp.OldName, node.GetID())
-		changes = append(changes, NodeChange{
-			Node:       node,
-			DirUpdated: []string{realOp.OldName},
+		for childName := range children {
+			err := fbo.removeTreeLocked(ctx, lState, node, childName)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Removing the children changed the paths.
+		md, err = fbo.getMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return err
+		}
+		dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
+	if err != nil || de.LinkID == "" {
+		return err
+	}
+	return fbo.unlinkHardLinkLocked(ctx, lState, de.LinkID)
+}
+
+// getTrashPath returns the path of the trash directory as of md, or
+// false if there isn't one.
+func (fbo *folderBranchOps) getTrashPath(ctx context.Context,
+	lState *lockState, md *RootMetadata) (path, bool, error) {
+	root := fbo.rootPath(md)
+	de, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md, root.ChildPathNoPtr(trashDirName))
+	if _, ok := err.(NoSuchNameError); ok {
+		return path{}, false, nil
+	} else if err != nil {
+		return path{}, false, err
+	}
+	return root.ChildPath(trashDirName, de.BlockPointer), true, nil
+}
+
+// appendTrashEntries appends an entry for each file and symlink under
+// dir, which is origDir from the root of the folder, in the removal
+// time directory with the given name.
+func (fbo *folderBranchOps) appendTrashEntries(ctx context.Context,
+	lState *lockState, md *RootMetadata, entries []TrashEntry, dir path,
+	stamp string, removed time.Time, origDir string) ([]TrashEntry, error) {
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dir, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	for name, de := range dblock.Children {
+		origPath := name
+		if origDir != "" {
+			origPath = origDir + "/" + name
+		}
+		if de.Type == Dir {
+			entries, err = fbo.appendTrashEntries(ctx, lState, md, entries,
+				dir.ChildPath(name, de.BlockPointer), stamp, removed,
+				origPath)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries = append(entries, TrashEntry{
+			Path:      origPath,
+			TrashPath: stamp + "/" + origPath,
+			Removed:   removed,
+			Type:      de.Type,
+			Size:      de.Size,
 		})
+	}
+	return entries, nil
+}
 
-		// If this node exists, then the child node might exist too,
-		// and we need to unlink it in the node cache.
-		err := fbo.unlinkFromCache(op, realOp.Dir.Unref, node, realOp.OldName)
+// ListTrash implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ListTrash(ctx context.Context,
+	folderBranch FolderBranch) (entries []TrashEntry, err error) {
+	fbo.log.CDebugf(ctx, "ListTrash")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 		if err != nil {
-			fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
-			return
+			return err
 		}
-	case *renameOp:
-		oldNode := fbo.nodeCache.Get(realOp.OldDir.Ref.ref())
-		if oldNode != nil {
-			changes = append(changes, NodeChange{
-				Node:       oldNode,
-				DirUpdated: []string{realOp.OldName},
-			})
+
+		trashPath, ok, err := fbo.getTrashPath(ctx, lState, md)
+		if err != nil || !ok {
+			return err
 		}
-		var newNode Node
-		if realOp.NewDir.Ref != zeroPtr {
-			newNode = fbo.nodeCache.Get(realOp.NewDir.Ref.ref())
-			if newNode != nil {
-				changes = append(changes, NodeChange{
-					Node:       newNode,
-					DirUpdated: []string{realOp.NewName},
-				})
+		tblock, err := fbo.blocks.GetDir(ctx, lState, md, trashPath, blockRead)
+		if err != nil {
+			return err
+		}
+		for stamp, de := range tblock.Children {
+			removed, err := time.Parse(trashTimeFormat, stamp)
+			if err != nil || de.Type != Dir {
+				// Not put there by a removal.
+				continue
 			}
-		} else {
-			newNode = oldNode
-			if oldNode != nil {
-				// Add another name to the existing NodeChange.
-				changes[len(changes)-1].DirUpdated =
-					append(changes[len(changes)-1].DirUpdated, realOp.NewName)
+			entries, err = fbo.appendTrashEntries(ctx, lState, md, entries,
+				trashPath.ChildPath(stamp, de.BlockPointer), stamp, removed,
+				"")
+			if err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(trashEntriesByRemoval(entries))
+	return entries, nil
+}
 
-		if oldNode != nil {
-			var newNodeID NodeID
-			if newNode != nil {
-				newNodeID = newNode.GetID()
-			}
-			fbo.log.CDebugf(ctx, "notifyOneOp: rename %v from %s/%p to %s/%p",
-				realOp.Renamed, realOp.OldName, oldNode.GetID(), realOp.NewName,
-				newNodeID)
+// RestoreFromTrash implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RestoreFromTrash(ctx context.Context,
+	folderBranch FolderBranch, trashPath string) (err error) {
+	fbo.log.CDebugf(ctx, "RestoreFromTrash %s", trashPath)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-			if newNode == nil {
-				if childNode :=
-					fbo.nodeCache.Get(realOp.Renamed.ref()); childNode != nil {
-					// if the childNode exists, we still have to update
-					// its path to go through the new node.  That means
-					// creating nodes for all the intervening paths.
-					// Unfortunately we don't have enough information to
-					// know what the newPath is; we have to guess it from
-					// the updates.
-					var err error
-					newNode, err =
-						fbo.searchForNode(ctx, realOp.NewDir.Ref, md)
-					if newNode == nil {
-						fbo.log.CErrorf(ctx, "Couldn't find the new node: %v",
-							err)
-					}
-				}
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+	stamp, origNames, err := parseTrashPath(trashPath)
+	if err != nil {
+		return err
+	}
+	name := origNames[len(origNames)-1]
+	origDirNames := origNames[:len(origNames)-1]
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			rootNode, err := fbo.getRootNodeForMDWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
 			}
 
-			if newNode != nil {
-				// If new node exists as well, unlink any previously
-				// existing entry and move the node.
-				var unrefPtr BlockPointer
-				if oldNode != newNode {
-					unrefPtr = realOp.NewDir.Unref
-				} else {
-					unrefPtr = realOp.OldDir.Unref
+			// Find the trashed entry's directory, without
+			// creating anything along the way.
+			trashDir := fbo.rootPath(md)
+			trashDirNode := rootNode
+			for _, dirName := range append(
+				[]string{trashDirName, stamp}, origDirNames...) {
+				de, err := fbo.blocks.GetDirtyEntry(
+					ctx, lState, md, trashDir.ChildPathNoPtr(dirName))
+				if err != nil {
+					return err
 				}
-				err := fbo.unlinkFromCache(op, unrefPtr, newNode, realOp.NewName)
+				if de.Type != Dir {
+					return NoSuchNameError{dirName}
+				}
+				trashDir = trashDir.ChildPath(dirName, de.BlockPointer)
+				trashDirNode, err = fbo.nodeCache.GetOrCreate(
+					de.BlockPointer, dirName, trashDirNode)
 				if err != nil {
-					fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
-					return
+					return err
 				}
-				err = fbo.nodeCache.Move(realOp.Renamed.ref(), newNode, realOp.NewName)
+			}
+			_, err = fbo.blocks.GetDirtyEntry(
+				ctx, lState, md, trashDir.ChildPathNoPtr(name))
+			if err != nil {
+				return err
+			}
+
+			parent := rootNode
+			for _, dirName := range origDirNames {
+				parent, err = fbo.getOrCreateDirLocked(
+					ctx, lState, parent, dirName)
 				if err != nil {
-					fbo.log.CErrorf(ctx, "Couldn't move node in cache: %v", err)
-					return
+					return err
 				}
 			}
+
+			// Making the directories changed the paths.
+			md, err = fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			parentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, parent)
+			if err != nil {
+				return err
+			}
+			_, err = fbo.blocks.GetDirtyEntry(
+				ctx, lState, md, parentPath.ChildPathNoPtr(name))
+			switch err.(type) {
+			case nil:
+				return NameExistsError{name}
+			case NoSuchNameError:
+			default:
+				return err
+			}
+			trashDirPath, err := fbo.pathFromNodeForMDWriteLocked(
+				lState, trashDirNode)
+			if err != nil {
+				return err
+			}
+			return fbo.renameLocked(
+				ctx, lState, trashDirPath, name, parentPath, name)
+		})
+}
+
+// EmptyTrash implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) EmptyTrash(ctx context.Context,
+	folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "EmptyTrash")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			rootNode, err := fbo.getRootNodeForMDWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			err = fbo.removeTreeLocked(ctx, lState, rootNode, trashDirName)
+			if _, ok := err.(NoSuchNameError); ok {
+				// There's no trash.
+				return nil
+			}
+			return err
+		})
+}
+
+// purgeTrash deletes everything in the trash that was removed more
+// than the folder's trash retention before the given time, or
+// everything if the folder no longer has a trash retention.  It only
+// takes the writer lock if there's something to delete.
+func (fbo *folderBranchOps) purgeTrash(
+	ctx context.Context, now time.Time) error {
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return err
+	}
+	before := now.Add(-md.Extra.TrashRetention)
+	trashPath, ok, err := fbo.getTrashPath(ctx, lState, md)
+	if err != nil || !ok {
+		return err
+	}
+	children, err := fbo.blocks.GetDirtyDirChildren(
+		ctx, lState, md, trashPath)
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for stamp := range children {
+		removed, err := time.Parse(trashTimeFormat, stamp)
+		if err == nil && removed.Before(before) {
+			expired = append(expired, stamp)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	fbo.log.CDebugf(ctx, "Purging %d expired removals from the trash",
+		len(expired))
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			rootNode, err := fbo.getRootNodeForMDWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			trashNode, err := fbo.getOrCreateDirLocked(
+				ctx, lState, rootNode, trashDirName)
+			if err != nil {
+				return err
+			}
+			for _, stamp := range expired {
+				err := fbo.removeTreeLocked(ctx, lState, trashNode, stamp)
+				if _, ok := err.(NoSuchNameError); ok {
+					// Another device purged it first.
+					continue
+				} else if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+func (fbo *folderBranchOps) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (
+	n int64, err error) {
+	fbo.log.CDebugf(ctx, "Read %p %d %d", file.GetID(), len(dest), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	defer fbo.latencies.record(opLatencyRead, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencyRead, file, "")
+	defer fbo.inFlight.end(ifo)
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Don't let the goroutine below write directly to the return
+	// variable, since if the context is canceled the goroutine might
+	// outlast this function call, and end up in a read/write race
+	// with the caller.
+	var bytesRead int64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+
+		bytesRead, err = fbo.blocks.Read(ctx, lState, md, filePath, dest, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return bytesRead, nil
+}
+
+// readBlockAt returns the data in the given file from off to the end
+// of the child block that holds it, for a read stream.
+func (fbo *folderBranchOps) readBlockAt(
+	ctx context.Context, file Node, off int64) ([]byte, error) {
+	defer fbo.latencies.record(opLatencyRead, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencyRead, file, "")
+	defer fbo.inFlight.end(ifo)
+	lState := makeFBOLockState()
+
+	// verify we have permission to read
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return fbo.blocks.ReadBlockAt(ctx, lState, md, filePath, off)
+}
+
+func (fbo *folderBranchOps) ReadStream(
+	ctx context.Context, file Node, off int64) (
+	stream io.ReadCloser, err error) {
+	fbo.log.CDebugf(ctx, "ReadStream %p %d", file.GetID(), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 {
+		return nil, InvalidOpError{"ReadStream at a negative offset"}
+	}
+
+	// Read the first block right away, so that any problem with
+	// the file is reported here rather than by the stream.
+	var first []byte
+	err = runUnlessCanceled(ctx, func() error {
+		var err error
+		first, err = fbo.readBlockAt(ctx, file, off)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(first) == 0 {
+		return newFileReadStream(ctx, nil, off, func(
+			context.Context, int64) ([]byte, error) {
+			return nil, nil
+		}), nil
+	}
+	return newFileReadStream(ctx, first, off+int64(len(first)),
+		func(ctx context.Context, off int64) ([]byte, error) {
+			return fbo.readBlockAt(ctx, file, off)
+		}), nil
+}
+
+func (fbo *folderBranchOps) SeekHoleOrData(
+	ctx context.Context, file Node, off int64, hole bool) (
+	newOff int64, err error) {
+	fbo.log.CDebugf(ctx, "SeekHoleOrData %p %d %t", file.GetID(), off, hole)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", newOff, err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// As in Read, keep the goroutine from writing directly to the
+	// return variable.
+	var found int64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+
+		found, err = fbo.blocks.SeekHoleOrData(
+			ctx, lState, md, filePath, off, hole)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return found, nil
+}
+
+func (fbo *folderBranchOps) Write(
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	fbo.log.CDebugf(ctx, "Write %p %d %d", file.GetID(), len(data), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	return fbo.write(ctx, file, data, off, false)
+}
+
+func (fbo *folderBranchOps) WriteNoCopy(
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	fbo.log.CDebugf(ctx, "WriteNoCopy %p %d %d", file.GetID(), len(data), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	return fbo.write(ctx, file, data, off, true)
+}
+
+func (fbo *folderBranchOps) write(ctx context.Context, file Node,
+	data []byte, off int64, noCopy bool) (err error) {
+	defer fbo.latencies.record(opLatencyWrite, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencyWrite, file, "")
+	defer fbo.inFlight.end(ifo)
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	return fbo.coalescer.write(ctx, file, data, off, noCopy)
+}
+
+// applyWrite writes the given data to the given file's blocks.
+func (fbo *folderBranchOps) applyWrite(ctx context.Context, file Node,
+	data []byte, off int64, noCopy bool) error {
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Write(ctx, lState, md, file, data, off, noCopy)
+		if err != nil {
+			return err
+		}
+		if fbo.writeBack != nil {
+			fbo.writeBack.recordWrite(file, data, off)
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) Truncate(
+	ctx context.Context, file Node, size uint64) (err error) {
+	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Truncate(ctx, lState, md, file, size)
+		if err != nil {
+			return err
+		}
+		if fbo.writeBack != nil {
+			fbo.writeBack.recordTruncate(file, size)
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) PunchHole(
+	ctx context.Context, file Node, off, length int64) (err error) {
+	fbo.log.CDebugf(ctx, "PunchHole %p %d %d", file.GetID(), off, length)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if off < 0 || length <= 0 {
+		return InvalidRangeError{off, length}
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.PunchHole(ctx, lState, md, file, off, length)
+		if err != nil {
+			return err
+		}
+		if fbo.writeBack != nil {
+			fbo.writeBack.recordPunchHole(file, off, length)
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) setExLocked(
+	ctx context.Context, lState *lockState, file path,
+	ex bool) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return
+	}
+
+	// If the file is a symlink, do nothing (to match ext4
+	// behavior).
+	if de.Type == Sym {
+		return
+	}
+
+	if ex && (de.Type == File) {
+		de.Type = Exec
+	} else if !ex && (de.Type == Exec) {
+		de.Type = File
+	}
+
+	parentPath := file.parentPath()
+	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), exAttr,
+		file.tailPointer()))
+
+	// If the type isn't File or Exec, there's nothing to do, but
+	// change the ctime anyway (to match ext4 behavior).
+	de.Ctime = fbo.nowUnixNano()
+	dblock.setEntry(file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
+}
+
+func (fbo *folderBranchOps) SetEx(
+	ctx context.Context, file Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetEx %p %t", file.GetID(), ex)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setExLocked(ctx, lState, filePath, ex)
+		})
+}
+
+func (fbo *folderBranchOps) setMtimeLocked(
+	ctx context.Context, lState *lockState, file path,
+	mtime *time.Time) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return err
+	}
+
+	parentPath := file.parentPath()
+	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), mtimeAttr,
+		file.tailPointer()))
+
+	de.Mtime = mtime.UnixNano()
+	// setting the mtime counts as changing the file MD, so must set ctime too
+	de.Ctime = fbo.nowUnixNano()
+	dblock.setEntry(file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
+}
+
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+		})
+}
+
+// maxXattrValueBytes is the largest extended attribute value that
+// can be set, which matches the Linux limit.
+const maxXattrValueBytes = 64 * 1024
+
+func (fbo *folderBranchOps) GetXattr(
+	ctx context.Context, node Node, name string) (value []byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := de.Xattrs[name]
+	if !ok {
+		return nil, NoSuchXattrError{name}
+	}
+	return value, nil
+}
+
+func (fbo *folderBranchOps) ListXattr(
+	ctx context.Context, node Node) (names []string, err error) {
+	fbo.log.CDebugf(ctx, "ListXattr %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name := range de.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// setXattrLocked sets the named extended attribute of the given
+// file to value, or removes it if remove is true.
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, file path, name string,
+	value []byte, mode XattrSetMode, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md, file)
+	if err != nil {
+		return err
+	}
+
+	_, exists := de.Xattrs[name]
+	if !exists && (remove || mode == XattrReplaceOnly) {
+		return NoSuchXattrError{name}
+	} else if exists && !remove && mode == XattrCreateOnly {
+		return XattrExistsError{name}
+	}
+
+	// Don't modify the map in place, since it may be shared with
+	// other copies of the entry.
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	for k, v := range de.Xattrs {
+		xattrs[k] = v
+	}
+	if remove {
+		delete(xattrs, name)
+	} else {
+		xattrs[name] = append(make([]byte, 0, len(value)), value...)
+		md.WFlags |= MetadataFlagXattrs
+	}
+	if len(xattrs) == 0 {
+		xattrs = nil
+	}
+
+	parentPath := file.parentPath()
+	md.AddOp(newSetAttrOp(file.tailName(), parentPath.tailPointer(), xattrAttr,
+		file.tailPointer()))
+
+	de.Xattrs = xattrs
+	// changing the extended attributes counts as changing the file
+	// MD, so set the ctime
+	de.Ctime = fbo.nowUnixNano()
+	dblock.setEntry(file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr)
+	return err
+}
+
+func (fbo *folderBranchOps) doSetXattr(ctx context.Context, node Node,
+	name string, value []byte, mode XattrSetMode, remove bool) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	if maxBytes := fbo.config.MaxNameBytes(); uint32(len(name)) > maxBytes {
+		return XattrNameTooLongError{name, maxBytes}
+	}
+	if len(value) > maxXattrValueBytes {
+		return XattrTooBigError{name, len(value), maxXattrValueBytes}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setXattrLocked(
+				ctx, lState, nodePath, name, value, mode, remove)
+		})
+}
+
+func (fbo *folderBranchOps) SetXattr(ctx context.Context, node Node,
+	name string, value []byte, mode XattrSetMode) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s %d %d", node.GetID(), name,
+		len(value), mode)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.doSetXattr(ctx, node, name, value, mode, false)
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.doSetXattr(ctx, node, name, nil, XattrCreateOrReplace, true)
+}
+
+// fileLockPollPeriod is how often SetFileLock retries taking a lock
+// that someone else holds, when it's been asked to wait for it.
+const fileLockPollPeriod = 500 * time.Millisecond
+
+// fileLockName returns the name under which the MD server keeps the
+// locks of the given file, which is its path within the folder.
+func (fbo *folderBranchOps) fileLockName(file Node) (string, error) {
+	err := fbo.checkNode(file)
+	if err != nil {
+		return "", err
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(filePath.path)-1)
+	for _, pn := range filePath.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/"), nil
+}
+
+func (fbo *folderBranchOps) GetFileLock(ctx context.Context, file Node,
+	lock FileLock) (held FileLock, conflict bool, err error) {
+	fbo.log.CDebugf(ctx, "GetFileLock %p %+v", file.GetID(), lock)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %t %v", conflict, err) }()
+
+	name, err := fbo.fileLockName(file)
+	if err != nil {
+		return FileLock{}, false, err
+	}
+	return fbo.config.MDServer().GetFileLock(ctx, fbo.id(), name, lock)
+}
+
+func (fbo *folderBranchOps) SetFileLock(ctx context.Context, file Node,
+	lock FileLock, wait bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetFileLock %p %+v wait=%t", file.GetID(), lock,
+		wait)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	name, err := fbo.fileLockName(file)
+	if err != nil {
+		return err
+	}
+	if lock.Type != FileLockWrite {
+		// Whoever takes the lock next should see everything written
+		// under it.
+		if err := fbo.Sync(ctx, file); err != nil {
+			return err
+		}
+	}
+	for {
+		ok, err := fbo.config.MDServer().SetFileLock(
+			ctx, fbo.id(), name, lock)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if lock.Type != FileLockUnlock {
+				// Catch up with what the last holder wrote.
+				if err := fbo.refreshHead(ctx); err != nil {
+					fbo.log.CDebugf(ctx, "Couldn't refresh head after "+
+						"taking lock: %v", err)
+				}
+			}
+			return nil
+		}
+		if !wait {
+			return FileLockConflictError{name, lock}
+		}
+		select {
+		case <-time.After(fileLockPollPeriod):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (fbo *folderBranchOps) syncLocked(ctx context.Context,
+	lState *lockState, file path) (stillDirty bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// if the cache for this file isn't dirty, we're done
+	if !fbo.blocks.IsDirty(lState, file) {
+		return false, nil
+	}
+
+	// Verify we have permission to write.  We do this after the dirty
+	// check because otherwise readers who sync clean files on close
+	// would get an error.
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return true, err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this sync.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
+			file.tailPointer())
+		// Removing the cached info here is a little sketchy,
+		// since there's no guarantee that this sync comes
+		// from closing the file, and we still want to serve
+		// stat calls accurately if the user still has an open
+		// handle to this file. TODO: Hook this in with the
+		// node cache GC logic to be perfectly accurate.
+		return true, fbo.blocks.ClearCacheInfo(lState, file)
+	}
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return true, err
+	}
+
+	if fbo.config.ContentDefinedChunking() {
+		md.WFlags |= MetadataFlagContentChunked
+	}
+
+	// notify the daemon that a write is being performed
+	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
+	defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+
+	// Filled in by doBlockPuts below.
+	var blocksToRemove []BlockPointer
+	fblock, bps, lbc, syncState, err :=
+		fbo.blocks.StartSync(ctx, lState, md, uid, file)
+	defer func() {
+		fbo.blocks.CleanupSyncState(
+			ctx, lState, file, blocksToRemove, syncState, err)
+	}()
+	if err != nil {
+		return true, err
+	}
+
+	newPath, _, newBps, err :=
+		fbo.syncBlockAndCheckEmbedLocked(
+			ctx, lState, md, fblock, *file.parentPath(),
+			file.tailName(), File, true, true, zeroPtr, lbc)
+	if err != nil {
+		return true, err
+	}
+
+	bps.mergeOtherBps(newBps)
+
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md, bps)
+		}
+	}()
+
+	blocksToRemove, err = fbo.doBlockPuts(ctx, md, *bps)
+	if err != nil {
+		return true, err
+	}
+
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps)
+	if err != nil {
+		return true, err
+	}
+
+	// At this point, all reads through the old path (i.e., file)
+	// see writes that happened since StartSync, whereas all reads
+	// through the new path (newPath) don't.
+	//
+	// TODO: This isn't completely correct, since reads that
+	// happen after a write should always see the new data.
+	//
+	// After FinishSync succeeds, then reads through both the old
+	// and the new paths will see the writes that happened during
+	// the sync.
+
+	return fbo.blocks.FinishSync(ctx, lState, file, newPath, md, syncState)
+}
+
+func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) error {
+	if err := fbo.flushCoalescedWrites(ctx); err != nil {
+		return err
+	}
+	err := fbo.coalescer.takeErrs(func(n Node) bool {
+		return n.GetID() == file.GetID()
+	})
+	if err != nil {
+		return err
+	}
+	if fbo.writeBack != nil {
+		err := fbo.syncToJournal(ctx, file)
+		fullErr, full := err.(WriteBackJournalFullError)
+		if !full {
+			if err == nil &&
+				atomic.CompareAndSwapInt32(&fbo.writeBackFull, 1, 0) {
+				fbo.log.CDebugf(ctx, "The write-back journal has room "+
+					"again")
+			}
+			return err
+		}
+		// Write through to the servers instead of filling up
+		// the disk.
+		if atomic.CompareAndSwapInt32(&fbo.writeBackFull, 0, 1) {
+			fbo.log.CWarningf(ctx, "%v", fullErr)
+			handle := fbo.getHead(makeFBOLockState()).GetTlfHandle()
+			fbo.config.Reporter().ReportErr(ctx, handle.GetCanonicalName(),
+				handle.IsPublic(), WriteMode, fullErr)
+		}
+	}
+	return fbo.syncToServer(ctx, file)
+}
+
+// syncToJournal persists the given file's unsynced writes to the
+// write-back journal, and leaves it to the background write-back
+// goroutine to sync them to the servers.
+func (fbo *folderBranchOps) syncToJournal(
+	ctx context.Context, file Node) (err error) {
+	fbo.log.CDebugf(ctx, "SyncToJournal %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	defer fbo.latencies.record(opLatencySync, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencySync, file, "")
+	defer fbo.inFlight.end(ifo)
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	p, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	err = fbo.writeBack.journal(
+		file, names, fbo.config.WriteBackJournalLimits())
+	if err != nil {
+		return err
+	}
+
+	select {
+	case fbo.writeBackChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// syncToServer syncs the given file's dirty data and metadata to
+// the servers, and returns once they're there.
+func (fbo *folderBranchOps) syncToServer(
+	ctx context.Context, file Node) (err error) {
+	fbo.log.CDebugf(ctx, "Sync %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	defer fbo.latencies.record(opLatencySync, fbo.config.Clock().Now())
+	ctx, ifo := fbo.inFlight.begin(ctx, opLatencySync, file, "")
+	defer fbo.inFlight.end(ifo)
+	if registry := fbo.config.MetricsRegistry(); registry != nil {
+		timer := metrics.GetOrRegisterTimer("KBFSOps.Sync", registry)
+		defer timer.UpdateSince(time.Now())
+	}
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	dirty := fbo.dirtyFileBytes()
+	for n := range dirty {
+		if n.GetID() == file.GetID() {
+			fbo.publishSyncStatus(fbo.syncStatus.syncStarted(
+				fbo.nodeCache.PathFromNode(file).String(), dirty))
+			defer func() {
+				fbo.publishSyncStatus(
+					fbo.syncStatus.syncFinished(fbo.dirtyFileBytes()))
+			}()
+			break
+		}
+	}
+
+	var wasDirty, stillDirty bool
+	var writeBackOps int
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			// Every write recorded so far has already been
+			// applied to the dirty blocks, so this sync includes
+			// it.
+			if fbo.writeBack != nil {
+				writeBackOps = fbo.writeBack.pendingOps(file)
+			}
+			wasDirty = fbo.blocks.IsDirty(lState, filePath)
+			fbo.status.syncStarted(file)
+			stillDirty, err = fbo.syncLocked(ctx, lState, filePath)
+			return err
+		})
+	fbo.status.syncFinished(file, err == nil)
+	if err != nil {
+		return err
+	}
+
+	if fbo.writeBack != nil {
+		err = fbo.writeBack.synced(file, writeBackOps)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !stillDirty {
+		fbo.status.rmDirtyNode(file)
+	}
+	if wasDirty {
+		fbo.config.EventBus().Publish(Event{
+			Kind:         EventFileSynced,
+			FolderBranch: fbo.folderBranch,
+			Ptr:          fbo.nodeCache.PathFromNode(file).tailPointer(),
+		})
+	}
+
+	return nil
+}
+
+// flushCoalescedWrites applies the small writes held back to be
+// coalesced, so that the caller sees all the writes made so far.
+// Errors from applying them are kept against their files, to be
+// reported by the next write or sync of each; it only fails if ctx
+// is done.  It must be called before taking any locks.
+func (fbo *folderBranchOps) flushCoalescedWrites(ctx context.Context) error {
+	return fbo.coalescer.flush(ctx)
+}
+
+// flushAllCoalescedWrites applies the small writes held back to be
+// coalesced, and returns the first error from applying the held-back
+// writes of any file.
+func (fbo *folderBranchOps) flushAllCoalescedWrites(
+	ctx context.Context) error {
+	if err := fbo.coalescer.flush(ctx); err != nil {
+		return err
+	}
+	return fbo.coalescer.takeErrs(func(Node) bool { return true })
+}
+
+// publishSyncStatus publishes the given sync progress of this folder.
+func (fbo *folderBranchOps) publishSyncStatus(status FolderSyncStatus) {
+	fbo.config.EventBus().Publish(Event{
+		Kind:         EventFolderSyncStatus,
+		FolderBranch: fbo.folderBranch,
+		SyncStatus:   &status,
+	})
+}
+
+func (fbo *folderBranchOps) FolderUsage(
+	ctx context.Context, folderBranch FolderBranch) (
+	usage FolderUsage, err error) {
+	fbo.log.CDebugf(ctx, "FolderUsage")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return FolderUsage{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	stat, err := fbo.config.BlockServer().GetTLFQuotaInfo(ctx, fbo.id())
+	if err != nil {
+		return FolderUsage{}, err
+	}
+	lState := makeFBOLockState()
+	return FolderUsage{
+		// Written bytes include the archived ones.
+		LiveBytes:     stat.Bytes[UsageWrite] - stat.Bytes[UsageArchive],
+		ArchivedBytes: stat.Bytes[UsageArchive],
+		PendingBytes:  fbo.blocks.GetPendingBytes(lState),
+	}, nil
+}
+
+func (fbo *folderBranchOps) FolderStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
+	fbo.log.CDebugf(ctx, "Status")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return FolderBranchStatus{}, nil,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	err = fbo.flushCoalescedWrites(ctx)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+
+	// Wait for conflict resolution to settle down, if necessary.
+	fbo.cr.Wait(ctx)
+
+	fbs, updateChan, err = fbo.status.getStatus(ctx)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+	fbs.Latencies = fbo.latencies.stats()
+	fbs.InFlightOps = fbo.inFlight.getOps()
+	fbs.WriterRates = fbo.getWriterRates(ctx)
+	fbs.QuotaPool = fbo.getQuotaPoolStatus(ctx)
+	if fbo.writeBack != nil {
+		writeBack, err := fbo.writeBack.status()
+		if err != nil {
+			return FolderBranchStatus{}, nil, err
+		}
+		fbs.WriteBack = &writeBack
+	}
+	if err := fbo.getFrozen(); err != nil {
+		fbs.Frozen = err.Error()
+	}
+	return fbs, updateChan, nil
+}
+
+// getWriterRates returns the recent update rates of this folder's
+// writers, by name.
+func (fbo *folderBranchOps) getWriterRates(
+	ctx context.Context) map[libkb.NormalizedUsername]float64 {
+	rates := fbo.writerRates.rates()
+	if rates == nil {
+		return nil
+	}
+	byName := make(map[libkb.NormalizedUsername]float64, len(rates))
+	for uid, rate := range rates {
+		name, err := fbo.config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			name = libkb.NormalizedUsername(uid.String())
+		}
+		byName[name] = rate
+	}
+	return byName
+}
+
+// getQuotaPoolStatus returns the usage of the quota pool this folder
+// belongs to, or nil if it doesn't belong to one.
+func (fbo *folderBranchOps) getQuotaPoolStatus(
+	ctx context.Context) *QuotaPoolStatus {
+	info, err := fbo.config.BlockServer().GetQuotaPoolInfo(ctx, fbo.id())
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get quota pool info: %v", err)
+		return nil
+	}
+	if info == nil {
+		return nil
+	}
+	status := &QuotaPoolStatus{
+		Name:        info.Name,
+		UsageBytes:  info.Total.Bytes[UsageWrite],
+		LimitBytes:  info.Limit,
+		MemberBytes: make(map[libkb.NormalizedUsername]int64),
+	}
+	for uid, usage := range info.Members {
+		name, err := fbo.config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			name = libkb.NormalizedUsername(uid.String())
+		}
+		status.MemberBytes[name] += usage.Bytes[UsageWrite]
+	}
+	return status
+}
+
+func (fbo *folderBranchOps) Status(
+	ctx context.Context) (
+	fbs KBFSStatus, updateChan <-chan StatusUpdate, err error) {
+	return KBFSStatus{}, nil, InvalidOpError{}
+}
+
+func (fbo *folderBranchOps) SetFolderPinning(ctx context.Context,
+	folderBranch FolderBranch, pinning FolderPinning) error {
+	return InvalidOpError{"SetFolderPinning"}
+}
+
+func (fbo *folderBranchOps) SetTlfSyncMode(ctx context.Context,
+	folderBranch FolderBranch, mode TlfSyncMode) error {
+	return InvalidOpError{"SetTlfSyncMode"}
+}
+
+func (fbo *folderBranchOps) SetBandwidthSchedule(ctx context.Context,
+	schedule BandwidthSchedule) error {
+	return InvalidOpError{"SetBandwidthSchedule"}
+}
+
+func (fbo *folderBranchOps) PreviewConflictResolution(
+	ctx context.Context, tlfID TlfID) (ConflictResolutionPreview, error) {
+	return ConflictResolutionPreview{},
+		InvalidOpError{"PreviewConflictResolution"}
+}
+
+func (fbo *folderBranchOps) ExportTLF(
+	ctx context.Context, tlfID TlfID, w io.Writer) error {
+	return InvalidOpError{"ExportTLF"}
+}
+
+func (fbo *folderBranchOps) ImportTLF(
+	ctx context.Context, tlfID TlfID, r io.Reader) error {
+	return InvalidOpError{"ImportTLF"}
+}
+
+func (fbo *folderBranchOps) UnsyncedChanges(
+	ctx context.Context) ([]UnsyncedChange, error) {
+	return nil, InvalidOpError{"UnsyncedChanges"}
+}
+
+func (fbo *folderBranchOps) GetUnsyncedChange(
+	ctx context.Context, file Node) (*UnsyncedChange, error) {
+	return nil, InvalidOpError{"GetUnsyncedChange"}
+}
+
+func (fbo *folderBranchOps) MakeContentManifest(
+	ctx context.Context, dir Node) (ContentManifest, error) {
+	return ContentManifest{}, InvalidOpError{"MakeContentManifest"}
+}
+
+func (fbo *folderBranchOps) RotateKeysAfterRevocation(
+	ctx context.Context, uid keybase1.UID) error {
+	return InvalidOpError{"RotateKeysAfterRevocation"}
+}
+
+func (fbo *folderBranchOps) KeyRotations(
+	ctx context.Context) ([]KeyRotationStatus, error) {
+	return nil, InvalidOpError{"KeyRotations"}
+}
+
+func (fbo *folderBranchOps) FlushPath(ctx context.Context, node Node) error {
+	return InvalidOpError{"FlushPath"}
+}
+
+func (fbo *folderBranchOps) FlushAndWait(
+	ctx context.Context, progress func(FlushProgress)) error {
+	return InvalidOpError{"FlushAndWait"}
+}
+
+func (fbo *folderBranchOps) MoveAcrossFolders(
+	ctx context.Context, oldParent Node, oldName string, newParent Node,
+	newName string, progress func(MoveProgress)) error {
+	return InvalidOpError{"MoveAcrossFolders"}
+}
+
+func (fbo *folderBranchOps) CheckDeviceRevocation(
+	ctx context.Context) error {
+	return InvalidOpError{"CheckDeviceRevocation"}
+}
+
+func (fbo *folderBranchOps) Logout(ctx context.Context) error {
+	return InvalidOpError{"Logout"}
+}
+
+func (fbo *folderBranchOps) Login(ctx context.Context) error {
+	return InvalidOpError{"Login"}
+}
+
+// RegisterForChanges registers a single Observer to receive
+// notifications about this folder/branch.
+func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
+	// It's the caller's responsibility to make sure
+	// RegisterForChanges isn't called twice for the same Observer
+	fbo.observers.add(obs)
+	return nil
+}
+
+// UnregisterFromChanges stops an Observer from getting notifications
+// about the folder/branch.
+func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
+	fbo.observers.remove(obs)
+	return nil
+}
+
+// notifyBatchLocked sends out a notification for the most recent op
+// in md.
+func (fbo *folderBranchOps) notifyBatchLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata) {
+	fbo.headLock.AssertLocked(lState)
+
+	lastOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
+	fbo.notifyOneOpLocked(ctx, lState, lastOp, md)
+}
+
+// searchForNode tries to figure out the path to the given
+// blockPointer, using only the block updates that happened as part of
+// a given MD update operation.
+func (fbo *folderBranchOps) searchForNode(ctx context.Context,
+	ptr BlockPointer, md *RootMetadata) (Node, error) {
+	// Record which pointers are new to this update, and thus worth
+	// searching.
+	newPtrs := make(map[BlockPointer]bool)
+	for _, op := range md.data.Changes.Ops {
+		for _, update := range op.AllUpdates() {
+			newPtrs[update.Ref] = true
+		}
+		for _, ref := range op.Refs() {
+			newPtrs[ref] = true
+		}
+	}
+
+	nodeMap, err := fbo.blocks.SearchForNodes(ctx, fbo.nodeCache, []BlockPointer{ptr},
+		newPtrs, md)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := nodeMap[ptr]
+	if !ok {
+		return nil, NodeNotFoundError{ptr}
+	}
+
+	return n, nil
+}
+
+func (fbo *folderBranchOps) unlinkFromCache(op op, oldDir BlockPointer,
+	node Node, name string) error {
+	// The entry could be under any one of the unref'd blocks, and
+	// it's safe to perform this when the pointer isn't real, so just
+	// try them all to avoid the overhead of looking up the right
+	// pointer in the old version of the block.
+	p, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return err
+	}
+
+	childPath := p.ChildPathNoPtr(name)
+
+	// revert the parent pointer
+	childPath.path[len(childPath.path)-2].BlockPointer = oldDir
+	for _, ptr := range op.Unrefs() {
+		childPath.path[len(childPath.path)-1].BlockPointer = ptr
+		fbo.nodeCache.Unlink(ptr.ref(), childPath)
+	}
+
+	return nil
+}
+
+func (fbo *folderBranchOps) updatePointers(op op) {
+	for _, update := range op.AllUpdates() {
+		oldRef := update.Unref.ref()
+		fbo.nodeCache.UpdatePointer(oldRef, update.Ref)
+	}
+}
+
+func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
+	lState *lockState, op op, md *RootMetadata) {
+	fbo.headLock.AssertLocked(lState)
+
+	fbo.updatePointers(op)
+
+	var changes []NodeChange
+	switch realOp := op.(type) {
+	default:
+		return
+	case *createOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
+		if node == nil {
+			return
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: create %s in node %p",
+			realOp.NewName, node.GetID())
+		changes = append(changes, NodeChange{
+			Node:       node,
+			DirUpdated: []string{realOp.NewName},
+		})
+	case *rmOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
+		if node == nil {
+			return
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: remove %s in node %p",
+			realOp.OldName, node.GetID())
+		changes = append(changes, NodeChange{
+			Node:       node,
+			DirUpdated: []string{realOp.OldName},
+		})
+
+		// If this node exists, then the child node might exist too,
+		// and we need to unlink it in the node cache.
+		err := fbo.unlinkFromCache(op, realOp.Dir.Unref, node, realOp.OldName)
+		if err != nil {
+			fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
+			return
+		}
+	case *renameOp:
+		oldNode := fbo.nodeCache.Get(realOp.OldDir.Ref.ref())
+		if oldNode != nil {
+			changes = append(changes, NodeChange{
+				Node:       oldNode,
+				DirUpdated: []string{realOp.OldName},
+			})
+		}
+		var newNode Node
+		if realOp.NewDir.Ref != zeroPtr {
+			newNode = fbo.nodeCache.Get(realOp.NewDir.Ref.ref())
+			if newNode != nil {
+				changes = append(changes, NodeChange{
+					Node:       newNode,
+					DirUpdated: []string{realOp.NewName},
+				})
+			}
+		} else {
+			newNode = oldNode
+			if oldNode != nil {
+				// Add another name to the existing NodeChange.
+				changes[len(changes)-1].DirUpdated =
+					append(changes[len(changes)-1].DirUpdated, realOp.NewName)
+			}
+		}
+
+		if oldNode != nil {
+			var newNodeID NodeID
+			if newNode != nil {
+				newNodeID = newNode.GetID()
+			}
+			fbo.log.CDebugf(ctx, "notifyOneOp: rename %v from %s/%p to %s/%p",
+				realOp.Renamed, realOp.OldName, oldNode.GetID(), realOp.NewName,
+				newNodeID)
+
+			if newNode == nil {
+				if childNode :=
+					fbo.nodeCache.Get(realOp.Renamed.ref()); childNode != nil {
+					// if the childNode exists, we still have to update
+					// its path to go through the new node.  That means
+					// creating nodes for all the intervening paths.
+					// Unfortunately we don't have enough information to
+					// know what the newPath is; we have to guess it from
+					// the updates.
+					var err error
+					newNode, err =
+						fbo.searchForNode(ctx, realOp.NewDir.Ref, md)
+					if newNode == nil {
+						fbo.log.CErrorf(ctx, "Couldn't find the new node: %v",
+							err)
+					}
+				}
+			}
+
+			if newNode != nil {
+				// If new node exists as well, unlink any previously
+				// existing entry and move the node.
+				var unrefPtr BlockPointer
+				if oldNode != newNode {
+					unrefPtr = realOp.NewDir.Unref
+				} else {
+					unrefPtr = realOp.OldDir.Unref
+				}
+				err := fbo.unlinkFromCache(op, unrefPtr, newNode, realOp.NewName)
+				if err != nil {
+					fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
+					return
+				}
+				err = fbo.nodeCache.Move(realOp.Renamed.ref(), newNode, realOp.NewName)
+				if err != nil {
+					fbo.log.CErrorf(ctx, "Couldn't move node in cache: %v", err)
+					return
+				}
+			}
+		}
+	case *syncOp:
+		node := fbo.nodeCache.Get(realOp.File.Ref.ref())
+		if node == nil {
+			return
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: sync %d writes in node %p",
+			len(realOp.Writes), node.GetID())
+
+		changes = append(changes, NodeChange{
+			Node:        node,
+			FileUpdated: realOp.Writes,
+		})
+	case *setAttrOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
+		if node == nil {
+			return
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: setAttr %s for file %s in node %p",
+			realOp.Attr, realOp.Name, node.GetID())
+
+		p, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return
+		}
+
+		childNode, err := fbo.blocks.UpdateCachedEntryAttributes(
+			ctx, lState, md, p, realOp)
+		if err != nil {
+			// TODO: Log error?
+			return
+		}
+		if childNode == nil {
+			return
+		}
+
+		changes = append(changes, NodeChange{
+			Node: childNode,
+		})
+	case *gcOp:
+		// Unreferenced blocks in a gcOp mean that we shouldn't cache
+		// them anymore
+		bcache := fbo.config.BlockCache()
+		for _, ptr := range realOp.Unrefs() {
+			if err := bcache.DeleteTransient(ptr, fbo.id()); err != nil {
+				fbo.log.CDebugf(ctx,
+					"Couldn't delete transient entry for %v: %v", ptr, err)
+			}
+		}
+	}
+
+	fbo.observers.batchChanges(ctx, changes)
+}
+
+func (fbo *folderBranchOps) getCurrMDRevisionLocked(lState *lockState) MetadataRevision {
+	fbo.headLock.AssertAnyLocked(lState)
+
+	if fbo.head != nil {
+		return fbo.head.Revision
+	}
+	return MetadataRevisionUninitialized
+}
+
+func (fbo *folderBranchOps) getCurrMDRevision(
+	lState *lockState) MetadataRevision {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.getCurrMDRevisionLocked(lState)
+}
+
+func (fbo *folderBranchOps) reembedBlockChanges(ctx context.Context,
+	lState *lockState, rmds []*RootMetadata) error {
+	// if any of the operations have unembedded block ops, fetch those
+	// now and fix them up.  TODO: parallelize me.
+	for _, rmd := range rmds {
+		info := rmd.data.Changes.Info
+		if info.BlockPointer == zeroPtr {
+			continue
+		}
+
+		fblock, err := fbo.blocks.GetFileBlockForReading(ctx, lState, rmd,
+			info.BlockPointer, fbo.folderBranch.Branch, path{})
+		if err != nil {
+			return err
+		}
+
+		err = fbo.config.Codec().Decode(fblock.Contents, &rmd.data.Changes)
+		if err != nil {
+			return err
+		}
+		// The changes block pointer is an implicit ref block
+		rmd.data.Changes.Ops[0].AddRefBlock(info.BlockPointer)
+		rmd.data.cachedChanges.Info = info
+	}
+	return nil
+}
+
+// reembedForFBM is a helper method for the folderBlockManager only.
+func (fbo *folderBranchOps) reembedForFBM(ctx context.Context,
+	rmds []*RootMetadata) error {
+	lState := makeFBOLockState()
+	return fbo.reembedBlockChanges(ctx, lState, rmds)
+}
+
+type applyMDUpdatesFunc func(context.Context, *lockState, []*RootMetadata) error
+
+func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
+	lState *lockState, rmds []*RootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+
+	if err := fbo.getFrozen(); err != nil {
+		return err
+	}
+
+	// if we have staged changes, ignore all updates until conflict
+	// resolution kicks in.  TODO: cache these for future use.
+	if !fbo.isMasterBranchLocked(lState) {
+		if len(rmds) > 0 {
+			unmergedRev := MetadataRevisionUninitialized
+			if fbo.head != nil {
+				unmergedRev = fbo.head.Revision
+			}
+			fbo.cr.Resolve(unmergedRev, rmds[len(rmds)-1].Revision)
+		}
+		return errors.New("Ignoring MD updates while local updates are staged")
+	}
+
+	// Don't allow updates while we're in the dirty state; the next
+	// sync will put us into an unmerged state anyway and we'll
+	// require conflict resolution.
+	if fbo.blocks.GetState(lState) != cleanState {
+		return errors.New("Ignoring MD updates while writes are dirty")
+	}
+
+	if err := fbo.reembedBlockChanges(ctx, lState, rmds); err != nil {
+		return err
+	}
+
+	for _, rmd := range rmds {
+		// check that we're applying the expected MD revision
+		if rmd.Revision <= fbo.getCurrMDRevisionLocked(lState) {
+			// Already caught up!
+			continue
+		}
+		if err := rmd.isReadableOrError(ctx, fbo.config); err != nil {
+			return err
+		}
+		if err := fbo.checkForAnomalyLocked(ctx, lState, rmd); err != nil {
+			return err
+		}
+
+		err := fbo.setHeadSuccessorLocked(ctx, lState, rmd)
+		if err != nil {
+			return err
+		}
+		fbo.config.EventBus().Publish(Event{
+			Kind:         EventMDApplied,
+			FolderBranch: fbo.folderBranch,
+			Revision:     rmd.Revision,
+		})
+		// No new operations in these.
+		if rmd.IsWriterMetadataCopiedSet() {
+			continue
+		}
+		atomic.StoreInt32(&fbo.unread, 1)
+		for _, op := range rmd.data.Changes.Ops {
+			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
+		}
+	}
+	return nil
+}
+
+// checkForAnomalyLocked freezes this folder-branch, and returns the
+// resulting FolderFrozenError, if the AnomalyDetector finds the given
+// update from the server suspicious.
+func (fbo *folderBranchOps) checkForAnomalyLocked(ctx context.Context,
+	lState *lockState, rmd *RootMetadata) error {
+	fbo.headLock.AssertLocked(lState)
+
+	detector := fbo.config.AnomalyDetector()
+	if detector == nil || rmd.IsWriterMetadataCopiedSet() {
+		return nil
+	}
+	handle := rmd.GetTlfHandle()
+	if !handle.IsShared() {
+		return nil
+	}
+	anomaly := detector.CheckUpdate(ctx, fbo.id(), rmd)
+	if anomaly == nil {
+		return nil
+	}
+
+	writer, err := fbo.config.KBPKI().GetNormalizedUsername(
+		ctx, anomaly.Writer)
+	if err != nil {
+		writer = libkb.NormalizedUsername(anomaly.Writer.String())
+	}
+	frozenErr := FolderFrozenError{
+		handle.GetCanonicalName(), writer, *anomaly}
+	fbo.log.CWarningf(ctx, "Freezing the folder: %v", frozenErr)
+	fbo.freeze(frozenErr)
+	fbo.config.Reporter().ReportErr(ctx, handle.GetCanonicalName(),
+		handle.IsPublic(), WriteMode, frozenErr)
+	return frozenErr
+}
+
+// UnfreezeFolder implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) UnfreezeFolder(ctx context.Context,
+	folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "UnfreezeFolder")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	// Start over, so the activity that's been reviewed doesn't
+	// freeze the folder again right away.
+	if detector := fbo.config.AnomalyDetector(); detector != nil {
+		detector.ResetFolder(fbo.id())
+	}
+	fbo.freeze(nil)
+
+	lState := makeFBOLockState()
+	return fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
+}
+
+// ArchiveFolder implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ArchiveFolder(ctx context.Context,
+	folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "ArchiveFolder")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	// Everything written so far goes into the archive.
+	if err := fbo.syncAllDirty(ctx); err != nil {
+		return err
+	}
+
+	// Only the last revision will ever be read again, so there's
+	// no need to wait before reclaiming the blocks that only
+	// older revisions reference.  If it fails, the blocks are
+	// just kept, so go on.
+	if err := fbo.fbm.reclaimAllUnrefBlocks(ctx); err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't reclaim unreferenced blocks "+
+			"before archiving: %v", err)
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		return UnexpectedUnmergedPutError{}
+	}
+	md.WFlags |= MetadataFlagArchived
+
+	err = fbo.config.MDOps().Put(ctx, md)
+	if err != nil {
+		return err
+	}
+
+	fbo.setBranchIDLocked(lState, NullBranchID)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	return fbo.setHeadSuccessorLocked(ctx, lState, md)
+}
+
+// SetFolderQuota implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SetFolderQuota(ctx context.Context,
+	folderBranch FolderBranch, limit uint64) (err error) {
+	fbo.log.CDebugf(ctx, "SetFolderQuota %d", limit)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	return fbo.setWriterExtra(ctx, folderBranch,
+		func(extra *WriterMetadataExtra) bool {
+			if extra.QuotaLimit == limit {
+				return false
+			}
+			extra.QuotaLimit = limit
+			return true
+		})
+}
+
+// SetFolderTrashRetention implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetFolderTrashRetention(ctx context.Context,
+	folderBranch FolderBranch, retention time.Duration) (err error) {
+	fbo.log.CDebugf(ctx, "SetFolderTrashRetention %s", retention)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if retention < 0 {
+		return fmt.Errorf("Invalid trash retention %s", retention)
+	}
+	return fbo.setWriterExtra(ctx, folderBranch,
+		func(extra *WriterMetadataExtra) bool {
+			if extra.TrashRetention == retention {
+				return false
+			}
+			extra.TrashRetention = retention
+			return true
+		})
+}
+
+// setWriterExtra writes a new revision of the folder in which the
+// writer-only extra fields of its MD have been changed by update.
+// update returns false if there's nothing to change.
+func (fbo *folderBranchOps) setWriterExtra(ctx context.Context,
+	folderBranch FolderBranch,
+	update func(extra *WriterMetadataExtra) bool) error {
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		return UnexpectedUnmergedPutError{}
+	}
+	if !update(&md.Extra) {
+		return nil
+	}
+
+	err = fbo.config.MDOps().Put(ctx, md)
+	if err != nil {
+		return err
+	}
+
+	fbo.setBranchIDLocked(lState, NullBranchID)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	return fbo.setHeadSuccessorLocked(ctx, lState, md)
+}
+
+// decryptTLFArchiveBlock checks the given archived block against its
+// pointer, and decrypts it with the keys in md.
+func (fbo *folderBranchOps) decryptTLFArchiveBlock(ctx context.Context,
+	md *RootMetadata, ab tlfArchiveBlock) (Block, error) {
+	crypto := fbo.config.Crypto()
+	if err := crypto.VerifyBlockID(ab.Buf, ab.Ptr.ID); err != nil {
+		return nil, err
+	}
+	tlfCryptKey, err := fbo.config.KeyManager().
+		GetTLFCryptKeyForBlockDecryption(ctx, md, ab.Ptr)
+	if err != nil {
+		return nil, err
+	}
+	block := NewFileBlock()
+	if ab.IsDir {
+		block = NewDirBlock()
+	}
+	err = decryptBlock(fbo.config.Codec(), crypto, ab.Buf, ab.ServerHalf,
+		tlfCryptKey, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// exportBlockTree writes the given block, and every block under it,
+// to a TLF archive, in post-order.
+func (fbo *folderBranchOps) exportBlockTree(ctx context.Context,
+	md *RootMetadata, ptr BlockPointer, isDir bool, w io.Writer) error {
+	buf, serverHalf, err := fbo.config.BlockServer().Get(
+		ctx, ptr.ID, md.ID, ptr.BlockContext)
+	if err != nil {
+		return err
+	}
+	ab := tlfArchiveBlock{
+		Ptr:        ptr,
+		IsDir:      isDir,
+		ServerHalf: serverHalf,
+		Buf:        buf,
+	}
+	block, err := fbo.decryptTLFArchiveBlock(ctx, md, ab)
+	if err != nil {
+		return err
+	}
+	err = forEachTLFArchiveChild(block,
+		func(info BlockInfo, isDir bool) (BlockInfo, error) {
+			return info, fbo.exportBlockTree(
+				ctx, md, info.BlockPointer, isDir, w)
+		})
+	if err != nil {
+		return err
+	}
+	return writeTLFArchiveRecord(w, fbo.config.Codec(), ab)
+}
+
+func (fbo *folderBranchOps) exportTLF(ctx context.Context, w io.Writer) (
+	err error) {
+	fbo.log.CDebugf(ctx, "ExportTLF")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	// Everything written so far goes into the archive.
+	if err := fbo.syncAllDirty(ctx); err != nil {
+		return err
+	}
+	if err := fbo.WaitForWriteBack(ctx, fbo.folderBranch); err != nil {
+		return err
+	}
+
+	// Hold the lock for the whole export, so that the head
+	// doesn't move on and let the blocks being exported be
+	// reclaimed.
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	md, err := fbo.getMDForReadHelper(ctx, lState, mdWrite)
+	if err != nil {
+		return err
+	}
+	if err := md.isReadableOrError(ctx, fbo.config); err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		return errors.New("Can't export a folder with unmerged changes")
+	}
+
+	// Export the MD exactly as the server has it, so that its
+	// signature can still be checked.
+	rmdses, err := fbo.config.MDServer().GetRange(
+		ctx, fbo.id(), NullBranchID, Merged, md.Revision, md.Revision)
+	if err != nil {
+		return err
+	}
+	if len(rmdses) != 1 {
+		return fmt.Errorf("Couldn't get revision %d of folder %s",
+			md.Revision, fbo.id())
+	}
+	codec := fbo.config.Codec()
+	mdBuf, err := codec.Encode(rmdses[0])
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, tlfArchiveMagic); err != nil {
+		return err
+	}
+	err = writeTLFArchiveRecord(w, codec, tlfArchiveHeader{
+		Version: tlfArchiveVersion,
+		TlfID:   fbo.id(),
+		MD:      mdBuf,
+	})
+	if err != nil {
+		return err
+	}
+	return fbo.exportBlockTree(ctx, md, md.data.Dir.BlockPointer, true, w)
+}
+
+// tlfImportBatchSize is how many imported blocks are readied before
+// they're put to the block server.
+const tlfImportBatchSize = 100
+
+// importedBlock is a block of a TLF archive that has been readied
+// again under a new pointer.
+type importedBlock struct {
+	info  BlockInfo
+	isDir bool
+}
+
+func (fbo *folderBranchOps) importTLF(ctx context.Context, r io.Reader) (
+	err error) {
+	fbo.log.CDebugf(ctx, "ImportTLF")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if err := fbo.checkWritable(); err != nil {
+		return err
+	}
+
+	codec := fbo.config.Codec()
+	crypto := fbo.config.Crypto()
+	magic := make([]byte, len(tlfArchiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != tlfArchiveMagic {
+		return InvalidTLFArchiveError{"not a TLF archive"}
+	}
+	var header tlfArchiveHeader
+	err = readTLFArchiveRecord(r, codec, &header)
+	if err == io.EOF {
+		return InvalidTLFArchiveError{"no header"}
+	} else if err != nil {
+		return err
+	}
+	if header.Version != tlfArchiveVersion {
+		return InvalidTLFArchiveError{
+			fmt.Sprintf("unknown version %d", header.Version)}
+	}
+	var rmds RootMetadataSigned
+	if err := codec.Decode(header.MD, &rmds); err != nil {
+		return InvalidTLFArchiveError{err.Error()}
+	}
+	if header.TlfID != fbo.id() || rmds.MD.ID != fbo.id() {
+		return InvalidTLFArchiveError{fmt.Sprintf(
+			"exported from folder %s, not %s", rmds.MD.ID, fbo.id())}
+	}
+	if err := rmds.MD.VerifyWriterMetadata(codec, crypto); err != nil {
+		return err
+	}
+	if err := rmds.VerifyRootMetadata(codec, crypto); err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		return UnexpectedUnmergedPutError{}
+	}
+	if fbo.blocks.GetState(lState) != cleanState {
+		return NotPermittedWhileDirtyError{}
+	}
+	oldRoot, err := fbo.blocks.GetDirBlockForReading(
+		ctx, lState, md, md.data.Dir.BlockPointer, fbo.branch(), path{})
+	if err != nil {
+		return err
+	}
+	if len(oldRoot.Children) > 0 {
+		return FolderNotEmptyError{md.GetTlfHandle().GetCanonicalName()}
+	}
+
+	// Keys are never removed from a folder, so the current MD has
+	// every key the archived one had.
+	archived := &rmds.MD
+	archived.tlfHandle = md.GetTlfHandle()
+	if err := decryptMDPrivateData(ctx, fbo.config, archived, md); err != nil {
+		return err
+	}
+	archivedRoot := archived.data.Dir.BlockPointer
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Ready every archived block again under a new pointer, with
+	// the latest keys.  The archive lists each block after the
+	// blocks it points to, so their new pointers are known by the
+	// time it comes up.  Fresh pointers keep the restored files
+	// independent of any references that older revisions of the
+	// folder still hold to the same blocks.
+	imported := make(map[BlockPointer]importedBlock)
+	var refs []BlockInfo
+	var rootInfo BlockInfo
+	var rootSize int
+	bps := newBlockPutState(tlfImportBatchSize)
+	var putBpses []*blockPutState
+	defer func() {
+		if err != nil {
+			for _, b := range append(putBpses, bps) {
+				fbo.fbm.cleanUpBlockState(md, b)
+			}
+		}
+	}()
+	putBlocks := func() error {
+		ptrsToDelete, err := fbo.doBlockPuts(ctx, md, *bps)
+		if err != nil {
+			return err
+		}
+		if len(ptrsToDelete) > 0 {
+			return fmt.Errorf("Unexpected pointers to delete after "+
+				"importing blocks: %v", ptrsToDelete)
+		}
+		putBpses = append(putBpses, bps)
+		bps = newBlockPutState(tlfImportBatchSize)
+		return nil
+	}
+	for {
+		var ab tlfArchiveBlock
+		err := readTLFArchiveRecord(r, codec, &ab)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
 		}
-	case *syncOp:
-		node := fbo.nodeCache.Get(realOp.File.Ref.ref())
-		if node == nil {
-			return
+		if rootInfo.IsInitialized() {
+			return InvalidTLFArchiveError{"blocks after the root block"}
 		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: sync %d writes in node %p",
-			len(realOp.Writes), node.GetID())
-
-		changes = append(changes, NodeChange{
-			Node:        node,
-			FileUpdated: realOp.Writes,
-		})
-	case *setAttrOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.ref())
-		if node == nil {
-			return
+		block, err := fbo.decryptTLFArchiveBlock(ctx, md, ab)
+		if err != nil {
+			return err
 		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: setAttr %s for file %s in node %p",
-			realOp.Attr, realOp.Name, node.GetID())
-
-		p, err := fbo.pathFromNodeForRead(node)
+		err = forEachTLFArchiveChild(block,
+			func(info BlockInfo, isDir bool) (BlockInfo, error) {
+				ib, ok := imported[info.BlockPointer]
+				if !ok || ib.isDir != isDir {
+					return BlockInfo{}, InvalidTLFArchiveError{
+						fmt.Sprintf("block %v is missing",
+							info.BlockPointer)}
+				}
+				delete(imported, info.BlockPointer)
+				return ib.info, nil
+			})
 		if err != nil {
-			return
+			return err
 		}
-
-		childNode, err := fbo.blocks.UpdateCachedEntryAttributes(
-			ctx, lState, md, p, realOp)
+		// Ready the block directly, rather than through
+		// ReadyBlock, so that it's never deduplicated against a
+		// known block that may since have been archived.
+		id, plainSize, readyBlockData, err :=
+			fbo.config.BlockOps().Ready(ctx, md, block)
 		if err != nil {
-			// TODO: Log error?
-			return
+			return err
 		}
-		if childNode == nil {
-			return
+		info := BlockInfo{
+			BlockPointer: BlockPointer{
+				ID:      id,
+				KeyGen:  md.LatestKeyGeneration(),
+				DataVer: block.DataVersion(),
+				BlockContext: BlockContext{
+					Creator:  uid,
+					RefNonce: zeroBlockRefNonce,
+				},
+			},
+			EncodedSize: uint32(readyBlockData.GetEncodedSize()),
 		}
-
-		changes = append(changes, NodeChange{
-			Node: childNode,
-		})
-	case *gcOp:
-		// Unreferenced blocks in a gcOp mean that we shouldn't cache
-		// them anymore
-		bcache := fbo.config.BlockCache()
-		for _, ptr := range realOp.Unrefs() {
-			if err := bcache.DeleteTransient(ptr, fbo.id()); err != nil {
-				fbo.log.CDebugf(ctx,
-					"Couldn't delete transient entry for %v: %v", ptr, err)
+		bps.addNewBlock(info.BlockPointer, block, readyBlockData, nil)
+		if ab.Ptr == archivedRoot && ab.IsDir {
+			rootInfo, rootSize = info, plainSize
+		} else {
+			imported[ab.Ptr] = importedBlock{info, ab.IsDir}
+			refs = append(refs, info)
+		}
+		if len(bps.blockStates) >= tlfImportBatchSize {
+			if err := putBlocks(); err != nil {
+				return err
 			}
 		}
 	}
-
-	fbo.observers.batchChanges(ctx, changes)
-}
-
-func (fbo *folderBranchOps) getCurrMDRevisionLocked(lState *lockState) MetadataRevision {
-	fbo.headLock.AssertAnyLocked(lState)
-
-	if fbo.head != nil {
-		return fbo.head.Revision
+	if !rootInfo.IsInitialized() {
+		return InvalidTLFArchiveError{"no root block"}
+	}
+	if len(imported) > 0 {
+		return InvalidTLFArchiveError{fmt.Sprintf(
+			"%d blocks aren't in the folder", len(imported))}
+	}
+	if err := putBlocks(); err != nil {
+		return err
 	}
-	return MetadataRevisionUninitialized
-}
 
-func (fbo *folderBranchOps) getCurrMDRevision(
-	lState *lockState) MetadataRevision {
-	fbo.headLock.RLock(lState)
-	defer fbo.headLock.RUnlock(lState)
-	return fbo.getCurrMDRevisionLocked(lState)
-}
+	newRoot, err := fbo.blocks.GetDirBlockForReading(
+		ctx, lState, md, rootInfo.BlockPointer, fbo.branch(), path{})
+	if err != nil {
+		return err
+	}
+	if len(newRoot.Children) == 0 {
+		// Nothing to restore.
+		for _, b := range putBpses {
+			fbo.fbm.cleanUpBlockState(md, b)
+		}
+		return nil
+	}
 
-func (fbo *folderBranchOps) reembedBlockChanges(ctx context.Context,
-	lState *lockState, rmds []*RootMetadata) error {
-	// if any of the operations have unembedded block ops, fetch those
-	// now and fix them up.  TODO: parallelize me.
-	for _, rmd := range rmds {
-		info := rmd.data.Changes.Info
-		if info.BlockPointer == zeroPtr {
+	// Record the restored entries as created in the root
+	// directory, so that other devices notice them.  Only the
+	// first op replaces the root block.
+	names := make([]string, 0, len(newRoot.Children))
+	for name := range newRoot.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	oldRootInfo := md.data.Dir.BlockInfo
+	for i, name := range names {
+		entryType := newRoot.Children[name].Type
+		if i == 0 {
+			md.AddOp(newCreateOp(name, oldRootInfo.BlockPointer, entryType))
+			md.AddUpdate(oldRootInfo, rootInfo)
 			continue
 		}
+		co := newCreateOp(name, rootInfo.BlockPointer, entryType)
+		co.AddUpdate(rootInfo.BlockPointer, rootInfo.BlockPointer)
+		md.AddOp(co)
+	}
+	for _, info := range refs {
+		md.AddRefBlock(info)
+	}
+	now := fbo.nowUnixNano()
+	md.data.Dir.BlockInfo = rootInfo
+	md.data.Dir.Size = uint64(rootSize)
+	md.data.Dir.Mtime = now
+	md.data.Dir.Ctime = now
 
-		fblock, err := fbo.blocks.GetFileBlockForReading(ctx, lState, rmd,
-			info.BlockPointer, fbo.folderBranch.Branch, path{})
+	if err := checkFolderQuota(md); err != nil {
+		return err
+	}
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(&md.data.Changes) {
+		err = fbo.unembedBlockChanges(ctx, bps, md, &md.data.Changes, uid)
 		if err != nil {
 			return err
 		}
-
-		err = fbo.config.Codec().Decode(fblock.Contents, &rmd.data.Changes)
-		if err != nil {
+		if err := putBlocks(); err != nil {
 			return err
 		}
-		// The changes block pointer is an implicit ref block
-		rmd.data.Changes.Ops[0].AddRefBlock(info.BlockPointer)
-		rmd.data.cachedChanges.Info = info
 	}
-	return nil
-}
-
-// reembedForFBM is a helper method for the folderBlockManager only.
-func (fbo *folderBranchOps) reembedForFBM(ctx context.Context,
-	rmds []*RootMetadata) error {
-	lState := makeFBOLockState()
-	return fbo.reembedBlockChanges(ctx, lState, rmds)
-}
 
-type applyMDUpdatesFunc func(context.Context, *lockState, []*RootMetadata) error
+	err = fbo.config.MDOps().Put(ctx, md)
+	if err != nil {
+		return err
+	}
 
-func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
-	lState *lockState, rmds []*RootMetadata) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.setBranchIDLocked(lState, NullBranchID)
+	md.swapCachedBlockChanges()
 
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
-
-	// if we have staged changes, ignore all updates until conflict
-	// resolution kicks in.  TODO: cache these for future use.
-	if !fbo.isMasterBranchLocked(lState) {
-		if len(rmds) > 0 {
-			unmergedRev := MetadataRevisionUninitialized
-			if fbo.head != nil {
-				unmergedRev = fbo.head.Revision
-			}
-			fbo.cr.Resolve(unmergedRev, rmds[len(rmds)-1].Revision)
-		}
-		return errors.New("Ignoring MD updates while local updates are staged")
-	}
-
-	// Don't allow updates while we're in the dirty state; the next
-	// sync will put us into an unmerged state anyway and we'll
-	// require conflict resolution.
-	if fbo.blocks.GetState(lState) != cleanState {
-		return errors.New("Ignoring MD updates while writes are dirty")
-	}
-
-	if err := fbo.reembedBlockChanges(ctx, lState, rmds); err != nil {
+	err = fbo.setHeadSuccessorLocked(ctx, lState, md)
+	if err != nil {
 		return err
 	}
 
-	for _, rmd := range rmds {
-		// check that we're applying the expected MD revision
-		if rmd.Revision <= fbo.getCurrMDRevisionLocked(lState) {
-			// Already caught up!
-			continue
-		}
-		if err := rmd.isReadableOrError(ctx, fbo.config); err != nil {
-			return err
-		}
+	// Archive the old, empty root block.
+	fbo.fbm.archiveUnrefBlocks(md)
 
-		err := fbo.setHeadSuccessorLocked(ctx, lState, rmd)
-		if err != nil {
-			return err
-		}
-		// No new operations in these.
-		if rmd.IsWriterMetadataCopiedSet() {
-			continue
-		}
-		for _, op := range rmd.data.Changes.Ops {
-			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
-		}
-	}
+	fbo.notifyBatchLocked(ctx, lState, md)
 	return nil
 }
 
@@ -3388,16 +6260,235 @@ func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
 	lState *lockState, applyFunc applyMDUpdatesFunc) error {
 	// first look up all MD revisions newer than my current head
 	start := fbo.getCurrMDRevision(lState) + 1
+	fetchStart := fbo.config.Clock().Now()
 	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(), start)
 	if err != nil {
 		return err
 	}
+	fbo.latencies.record(opLatencyMDFetch, fetchStart)
+
+	err = applyFunc(ctx, lState, rmds)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// refreshHead fetches and applies any merged MD updates this folder
+// missed, e.g. while it was disconnected from the MD server.  It does
+// nothing for folders with local changes, since conflict resolution
+// or the next sync will catch those up anyway.
+func (fbo *folderBranchOps) refreshHead(ctx context.Context) (err error) {
+	lState := makeFBOLockState()
+	if !fbo.isMasterBranch(lState) ||
+		fbo.blocks.GetState(lState) != cleanState ||
+		fbo.getHead(lState) == nil {
+		return nil
+	}
+
+	fbo.log.CDebugf(ctx, "Refreshing head")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
+	if applyErr, ok := err.(MDRevisionMismatch); ok &&
+		applyErr.rev == applyErr.curr {
+		// Already up-to-date.
+		return nil
+	}
+	return err
+}
+
+// fetchFileBlocks fetches the given file block into the block cache,
+// along with all the blocks under it if it's indirect.
+func (fbo *folderBranchOps) fetchFileBlocks(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer) error {
+	fblock, err := fbo.blocks.GetFileBlockForReading(
+		ctx, lState, md, ptr, fbo.branch(), path{})
+	if err != nil {
+		return err
+	}
+	for _, iptr := range fblock.IPtrs {
+		err := fbo.fetchFileBlocks(ctx, lState, md, iptr.BlockPointer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchDirBlocks fetches the given directory block into the block
+// cache, along with the blocks of everything under it.
+func (fbo *folderBranchOps) fetchDirBlocks(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer) error {
+	dblock, err := fbo.blocks.GetDirBlockForReading(
+		ctx, lState, md, ptr, fbo.branch(), path{})
+	if err != nil {
+		return err
+	}
+	for _, de := range dblock.Children {
+		switch de.Type {
+		case Sym:
+			continue
+		case Dir:
+			err = fbo.fetchDirBlocks(ctx, lState, md, de.BlockPointer)
+		default:
+			err = fbo.fetchFileBlocks(ctx, lState, md, de.BlockPointer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchAllBlocks fetches every block reachable from the current head
+// into the block cache, so the whole folder can be read offline, and
+// returns the revision of that head.
+func (fbo *folderBranchOps) fetchAllBlocks(ctx context.Context) (
+	rev MetadataRevision, err error) {
+	lState := makeFBOLockState()
+	md := fbo.getHead(lState)
+	if md == nil {
+		return MetadataRevisionUninitialized, nil
+	}
+
+	fbo.log.CDebugf(ctx, "Fetching all blocks at revision %d", md.Revision)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	err = fbo.fetchDirBlocks(ctx, lState, md, md.data.Dir.BlockPointer)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	return md.Revision, nil
+}
+
+// findAllBlockPtrs adds the given block pointer, and those of all the
+// blocks under it, to ptrs, mapped to whether each one is a
+// directory block.
+func (fbo *folderBranchOps) findAllBlockPtrs(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer, isDir bool,
+	ptrs map[BlockPointer]bool) error {
+	ptrs[ptr] = isDir
+	if !isDir {
+		fblock, err := fbo.blocks.GetFileBlockForReading(
+			ctx, lState, md, ptr, fbo.branch(), path{})
+		if err != nil {
+			return err
+		}
+		for _, iptr := range fblock.IPtrs {
+			err := fbo.findAllBlockPtrs(
+				ctx, lState, md, iptr.BlockPointer, false, ptrs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dblock, err := fbo.blocks.GetDirBlockForReading(
+		ctx, lState, md, ptr, fbo.branch(), path{})
+	if err != nil {
+		return err
+	}
+	for _, de := range dblock.Children {
+		if de.Type == Sym {
+			continue
+		}
+		err := fbo.findAllBlockPtrs(
+			ctx, lState, md, de.BlockPointer, de.Type == Dir, ptrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBlockIntegrity re-reads the given block straight from the
+// block server, and returns why it's no longer intact, if it isn't:
+// the server has lost it, its contents don't match its ID, it can't
+// be decrypted, or it doesn't match the copy in the block cache.
+// Errors that say nothing about the block itself, like being offline,
+// are returned as err instead.
+func (fbo *folderBranchOps) checkBlockIntegrity(ctx context.Context,
+	md *RootMetadata, ptr BlockPointer, isDir bool) (
+	reason string, err error) {
+	buf, serverHalf, err := fbo.config.BlockServer().Get(
+		ctx, ptr.ID, md.ID, ptr.BlockContext)
+	switch err.(type) {
+	case nil:
+	case BServerErrorBlockNonExistent, BServerErrorBlockDeleted:
+		return err.Error(), nil
+	default:
+		return "", err
+	}
+
+	crypto := fbo.config.Crypto()
+	if err := crypto.VerifyBlockID(buf, ptr.ID); err != nil {
+		return fmt.Sprintf("its contents don't match its ID: %v", err), nil
+	}
+	tlfCryptKey, err := fbo.config.KeyManager().
+		GetTLFCryptKeyForBlockDecryption(ctx, md, ptr)
+	if err != nil {
+		return "", err
+	}
+	block := NewFileBlock()
+	if isDir {
+		block = NewDirBlock()
+	}
+	codec := fbo.config.Codec()
+	err = decryptBlock(codec, crypto, buf, serverHalf, tlfCryptKey, block)
+	if err != nil {
+		return fmt.Sprintf("it can't be decrypted: %v", err), nil
+	}
+
+	cached, err := fbo.config.BlockCache().Get(ptr)
+	if err != nil {
+		// Nothing to compare it with.
+		return "", nil
+	}
+	equal, err := CodecEqual(codec, cached, block)
+	if err != nil {
+		return "", err
+	}
+	if !equal {
+		return "it doesn't match this device's copy", nil
+	}
+	return "", nil
+}
+
+// checkIntegrity checks up to maxBlocks blocks, picked at random from
+// those reachable from the current head, with checkBlockIntegrity.
+// It returns how many blocks it checked, and the ones that failed.
+func (fbo *folderBranchOps) checkIntegrity(ctx context.Context,
+	maxBlocks int) (
+	checked int, anomalies []IntegrityCheckError, err error) {
+	lState := makeFBOLockState()
+	md := fbo.getHead(lState)
+	if md == nil {
+		return 0, nil, nil
+	}
 
-	err = applyFunc(ctx, lState, rmds)
+	fbo.log.CDebugf(ctx, "Checking the integrity of up to %d blocks "+
+		"at revision %d", maxBlocks, md.Revision)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+	ptrs := make(map[BlockPointer]bool)
+	err = fbo.findAllBlockPtrs(
+		ctx, lState, md, md.data.Dir.BlockPointer, true, ptrs)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	return nil
+
+	handle := md.GetTlfHandle()
+	for _, ptr := range pickIntegrityCheckPtrs(ptrs, maxBlocks) {
+		reason, err := fbo.checkBlockIntegrity(ctx, md, ptr, ptrs[ptr])
+		if err != nil {
+			return checked, anomalies, err
+		}
+		checked++
+		if reason != "" {
+			anomalies = append(anomalies, IntegrityCheckError{
+				handle.GetCanonicalName(), handle.IsPublic(), ptr, reason})
+		}
+	}
+	return checked, anomalies, nil
 }
 
 // getUnmergedMDUpdates returns a slice of the unmerged MDs for this
@@ -3528,6 +6619,76 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 	return fbo.finalizeMDWriteLocked(ctx, lState, md, &blockPutState{})
 }
 
+// unsyncedChanges lists the files in this folder-branch with local
+// changes that haven't been synced yet.
+func (fbo *folderBranchOps) unsyncedChanges() []UnsyncedChange {
+	lState := makeFBOLockState()
+	now := fbo.config.Clock().Now()
+	var changes []UnsyncedChange
+	for n, since := range fbo.status.getDirtyNodes() {
+		file := fbo.nodeCache.PathFromNode(n)
+		if !file.isValid() {
+			continue
+		}
+		changes = append(changes, UnsyncedChange{
+			Path:  file.String(),
+			Bytes: fbo.blocks.GetDirtyFileBytes(lState, file),
+			Age:   now.Sub(since),
+		})
+	}
+	return changes
+}
+
+// getUnsyncedChange returns the unsynced changes to the given file,
+// or nil if it has none.
+func (fbo *folderBranchOps) getUnsyncedChange(
+	file Node) (*UnsyncedChange, error) {
+	since, ok := fbo.status.getDirtySince(file)
+	if !ok {
+		return nil, nil
+	}
+	p := fbo.nodeCache.PathFromNode(file)
+	if !p.isValid() {
+		return nil, InvalidPathError{p}
+	}
+	lState := makeFBOLockState()
+	return &UnsyncedChange{
+		Path:  p.String(),
+		Bytes: fbo.blocks.GetDirtyFileBytes(lState, p),
+		Age:   fbo.config.Clock().Now().Sub(since),
+	}, nil
+}
+
+// dirtyFileBytes returns each file in this folder with unsynced
+// changes, along with how many of its written bytes are unsynced.
+func (fbo *folderBranchOps) dirtyFileBytes() map[Node]int64 {
+	lState := makeFBOLockState()
+	dirty := fbo.status.getDirtyNodes()
+	files := make(map[Node]int64, len(dirty))
+	for n := range dirty {
+		file := fbo.nodeCache.PathFromNode(n)
+		if !file.isValid() {
+			continue
+		}
+		files[n] = fbo.blocks.GetDirtyFileBytes(lState, file)
+	}
+	return files
+}
+
+// previewConflictResolution reports what conflict resolution would
+// do to this folder's unmerged changes, if there are any.
+func (fbo *folderBranchOps) previewConflictResolution(
+	ctx context.Context) (preview ConflictResolutionPreview, err error) {
+	fbo.log.CDebugf(ctx, "PreviewConflictResolution")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	lState := makeFBOLockState()
+	if fbo.isMasterBranch(lState) {
+		return ConflictResolutionPreview{}, nil
+	}
+	return fbo.cr.preview(ctx, lState)
+}
+
 // TODO: remove once we have automatic conflict resolution
 func (fbo *folderBranchOps) UnstageForTesting(
 	ctx context.Context, folderBranch FolderBranch) (err error) {
@@ -3773,6 +6934,18 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
+	if err := fbo.flushCoalescedWrites(ctx); err != nil {
+		return err
+	}
+
+	// Synced files stay dirty until they're out of the write-back
+	// journal.
+	if fbo.writeBack != nil {
+		if err := fbo.flushWriteBack(ctx); err != nil {
+			return err
+		}
+	}
+
 	lState := makeFBOLockState()
 
 	if !fbo.isMasterBranch(lState) {
@@ -3949,21 +7122,88 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 			case <-unpause:
 				fbo.log.CInfof(ctx, "Updates unpaused")
 			case <-ctx.Done():
+				fbo.config.MDServer().CancelRegistration(ctx, fbo.id())
 				return ctx.Err()
 			}
 		case <-ctx.Done():
+			// Let a future instance of this folder-branch (e.g.,
+			// after a re-login) register again.
+			fbo.config.MDServer().CancelRegistration(ctx, fbo.id())
 			return ctx.Err()
 		}
 	}
 }
 
+// dirtyNode is a node with unsynced changes, along with when the
+// oldest of them was made.
+type dirtyNode struct {
+	node  Node
+	since time.Time
+}
+
+type dirtyNodesOldestFirst []dirtyNode
+
+func (d dirtyNodesOldestFirst) Len() int           { return len(d) }
+func (d dirtyNodesOldestFirst) Less(i, j int) bool { return d[i].since.Before(d[j].since) }
+func (d dirtyNodesOldestFirst) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// getDirtyNodesOldestFirst returns the nodes of the files with
+// unsynced changes, ordered by the age of their oldest change.
+func (fbo *folderBranchOps) getDirtyNodesOldestFirst(
+	lState *lockState) []dirtyNode {
+	sinces := make(map[NodeID]time.Time)
+	for n, since := range fbo.status.getDirtyNodes() {
+		sinces[n.GetID()] = since
+	}
+	now := fbo.config.Clock().Now()
+	var nodes []dirtyNode
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		since, ok := sinces[node.GetID()]
+		if !ok {
+			// Only its attributes have changed, which doesn't
+			// count as dirty data.
+			since = now
+		}
+		nodes = append(nodes, dirtyNode{node, since})
+	}
+	sort.Stable(dirtyNodesOldestFirst(nodes))
+	return nodes
+}
+
+// timeUntilStale returns how long it will be until the oldest
+// unsynced change to a file in this folder-branch is older than
+// Config.MaxDirtyAge, or false if there's no such change that isn't
+// already too old.
+func (fbo *folderBranchOps) timeUntilStale() (time.Duration, bool) {
+	maxAge := fbo.config.MaxDirtyAge()
+	if maxAge <= 0 {
+		return 0, false
+	}
+	now := fbo.config.Clock().Now()
+	var next time.Duration
+	found := false
+	for _, since := range fbo.status.getDirtyNodes() {
+		d := since.Add(maxAge).Sub(now)
+		if d > 0 && (!found || d < next) {
+			next = d
+			found = true
+		}
+	}
+	return next, found
+}
+
 func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 	ticker := time.NewTicker(betweenFlushes)
 	defer ticker.Stop()
 	lState := makeFBOLockState()
 	for {
 		doSelect := true
-		if fbo.blocks.GetState(lState) == dirtyState &&
+		if fbo.getWriteFence() == nil &&
+			fbo.blocks.GetState(lState) == dirtyState &&
 			fbo.config.DirtyBlockCache().ShouldForceSync() {
 			// We have dirty files, and the system has a full buffer,
 			// so don't bother waiting for a signal, just get right to
@@ -3972,14 +7212,39 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 		}
 
 		if doSelect {
+			// Also wake up when a file's unsynced changes get too
+			// old, so they're synced even if the buffer isn't full
+			// and the next tick is a while away.
+			var staleTimer *time.Timer
+			var staleChan <-chan time.Time
+			if d, ok := fbo.timeUntilStale(); ok {
+				staleTimer = time.NewTimer(d)
+				staleChan = staleTimer.C
+			}
 			select {
 			case <-ticker.C:
+			case <-staleChan:
 			case <-fbo.forceSyncChan:
 			case <-fbo.shutdownChan:
+				if staleTimer != nil {
+					staleTimer.Stop()
+				}
 				return
 			}
+			if staleTimer != nil {
+				staleTimer.Stop()
+			}
+		}
+		if fbo.getWriteFence() != nil {
+			// Any flush would just be rejected by the server.
+			continue
 		}
-		dirtyRefs := fbo.blocks.GetDirtyRefs(lState)
+		// Sync the files with the oldest changes first, so that a
+		// big file that takes a long time to sync can't keep
+		// holding up small changes to others.
+		dirtyNodes := fbo.getDirtyNodesOldestFirst(lState)
+		maxAge := fbo.config.MaxDirtyAge()
+		now := fbo.config.Clock().Now()
 		fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
 			// Denote that these are coming from a background
 			// goroutine, not directly from any user.
@@ -3995,27 +7260,37 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 			// actual Sync command, to avoid unnecessary errors.
 			shortCtx, shortCancel := context.WithTimeout(ctx, 1*time.Second)
 			defer shortCancel()
-			for _, ref := range dirtyRefs {
-				select {
-				case <-shortCtx.Done():
-					fbo.log.CDebugf(ctx,
-						"Stopping background sync early due to timeout")
-					return nil
-				default:
+			for _, dn := range dirtyNodes {
+				// Files whose changes are too old get synced no
+				// matter what.
+				age := now.Sub(dn.since)
+				if maxAge > 0 && age >= maxAge {
+					fbo.log.CDebugf(ctx, "Forcing a sync of %p, whose "+
+						"oldest unsynced change is %s old",
+						dn.node.GetID(), age)
+				} else {
+					select {
+					case <-shortCtx.Done():
+						fbo.log.CDebugf(ctx,
+							"Stopping background sync early due to timeout")
+						return nil
+					default:
+					}
+					if atomic.LoadInt32(&fbo.priorityFlushes) > 0 {
+						fbo.log.CDebugf(ctx, "Stopping background sync "+
+							"early to make way for a priority flush")
+						return nil
+					}
 				}
 
-				node := fbo.nodeCache.Get(ref)
-				if node == nil {
-					continue
-				}
-				err := fbo.Sync(longCtx, node)
+				err := fbo.syncToServer(longCtx, dn.node)
 				if err != nil {
 					// Just log the warning and keep trying to
 					// sync the rest of the dirty files.
-					p := fbo.nodeCache.PathFromNode(node)
+					p := fbo.nodeCache.PathFromNode(dn.node)
 					fbo.log.CWarningf(ctx, "Couldn't sync dirty file with "+
-						"ref=%v, nodeID=%p, and path=%v: %v",
-						ref, node.GetID(), p, err)
+						"nodeID=%p and path=%v: %v",
+						dn.node.GetID(), p, err)
 				}
 			}
 			return nil
@@ -4023,6 +7298,252 @@ func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 	}
 }
 
+// flushPath syncs every dirty file at or under the given node right
+// away, without waiting for the background flusher to get to them.
+func (fbo *folderBranchOps) flushPath(ctx context.Context, node Node) (
+	err error) {
+	fbo.log.CDebugf(ctx, "FlushPath %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt32(&fbo.priorityFlushes, 1)
+	defer atomic.AddInt32(&fbo.priorityFlushes, -1)
+
+	if err := fbo.flushCoalescedWrites(ctx); err != nil {
+		return err
+	}
+
+	p := fbo.nodeCache.PathFromNode(node)
+	if !p.isValid() {
+		return InvalidPathError{p}
+	}
+	isUnder := func(n Node) bool {
+		np := fbo.nodeCache.PathFromNode(n)
+		return len(np.path) >= len(p.path) &&
+			np.path[len(p.path)-1].BlockPointer == p.tailPointer()
+	}
+	if err := fbo.coalescer.takeErrs(isUnder); err != nil {
+		return err
+	}
+	var toSync []Node
+	for n := range fbo.status.getDirtyNodes() {
+		if isUnder(n) {
+			toSync = append(toSync, n)
+		}
+	}
+	for _, n := range toSync {
+		err := fbo.syncToServer(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAllDirty syncs every dirty file in this folder-branch, and
+// returns the first error encountered, if any.  Unlike the
+// background flusher, it doesn't stop early to make way for user
+// requests.
+func (fbo *folderBranchOps) syncAllDirty(ctx context.Context) error {
+	firstErr := fbo.flushAllCoalescedWrites(ctx)
+	lState := makeFBOLockState()
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if err := fbo.syncToServer(ctx, node); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// journalAllDirty persists the unsynced writes of every dirty file
+// to the write-back journal, regardless of its limits, so that they
+// survive this folder being shut down before they can be synced to
+// the servers.  The next run to open the folder replays them.  It
+// returns an error if there's no write-back journal, or if any of
+// the writes couldn't be persisted.
+func (fbo *folderBranchOps) journalAllDirty(ctx context.Context) error {
+	if fbo.writeBack == nil {
+		return errors.New("No write-back journal to hold the dirty data")
+	}
+	if err := fbo.flushAllCoalescedWrites(ctx); err != nil {
+		return err
+	}
+	lState := makeFBOLockState()
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		if fbo.writeBack.pendingOps(node) == 0 {
+			return fmt.Errorf("The dirty data of %p isn't in the "+
+				"write-back journal", node.GetID())
+		}
+	}
+	for _, node := range fbo.writeBack.unjournaledNodes() {
+		p, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(p.path)-1)
+		for _, pn := range p.path[1:] {
+			names = append(names, pn.Name)
+		}
+		err = fbo.writeBack.journal(node, names, WriteBackJournalLimits{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backgroundWriteBack pushes the writes in the write-back journal to
+// the servers whenever Sync adds to it, retrying periodically after
+// failures.  It starts by replaying anything left in the journal by
+// a previous run.
+func (fbo *folderBranchOps) backgroundWriteBack(betweenRetries time.Duration) {
+	ticker := time.NewTicker(betweenRetries)
+	defer ticker.Stop()
+	for {
+		fbo.runUnlessShutdown(func(ctx context.Context) error {
+			ctx = context.WithValue(ctx, CtxBackgroundSyncKey, "1")
+			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+			defer cancel()
+			if err := fbo.flushWriteBack(ctx); err != nil {
+				fbo.log.CWarningf(ctx, "Couldn't push the write-back "+
+					"journal to the servers: %v", err)
+			}
+			return nil
+		})
+
+		select {
+		case <-fbo.writeBackChan:
+		case <-ticker.C:
+		case <-fbo.shutdownChan:
+			return
+		}
+	}
+}
+
+// flushWriteBack syncs every file with journaled writes to the
+// servers, after first replaying the entries left in the journal by
+// a previous run.  It returns the first error encountered, if any.
+func (fbo *folderBranchOps) flushWriteBack(ctx context.Context) error {
+	fbo.writeBackLock.Lock()
+	defer fbo.writeBackLock.Unlock()
+
+	err := fbo.replayWriteBackLeftovers(ctx)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, node := range fbo.writeBack.journaledNodes() {
+		err := fbo.syncToServer(ctx, node)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// replayWriteBackLeftovers applies the writes in each entry left in
+// the write-back journal by a previous run to the file at the
+// entry's path, and journals them again for this run.  Entries
+// whose files no longer exist are set aside.
+func (fbo *folderBranchOps) replayWriteBackLeftovers(
+	ctx context.Context) error {
+	leftovers := fbo.writeBack.getLeftovers()
+	if len(leftovers) == 0 {
+		return nil
+	}
+
+	rootNode, _, _, err := fbo.getRootNode(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range leftovers {
+		entry, err := fbo.writeBack.readEntry(name)
+		if err != nil {
+			return err
+		}
+		fbo.log.CDebugf(ctx, "Replaying %d journaled writes to %v",
+			len(entry.Ops), entry.Path)
+
+		node := rootNode
+		for _, pathName := range entry.Path {
+			node, _, err = fbo.Lookup(ctx, node, pathName)
+			if err != nil {
+				break
+			}
+		}
+		if _, ok := err.(NoSuchNameError); ok {
+			fbo.log.CWarningf(ctx, "Can't replay journaled writes to "+
+				"%v, which no longer exists; leaving them in %s",
+				entry.Path, fbo.writeBack.entryPath(
+					name+unrecoverableWriteBackSuffix))
+			err = fbo.writeBack.replayed(name, true)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, op := range entry.Ops {
+			if op.Truncate {
+				err = fbo.Truncate(ctx, node, op.Size)
+			} else if op.PunchHole {
+				err = fbo.PunchHole(ctx, node, op.Off, int64(op.Size))
+			} else {
+				err = fbo.Write(ctx, node, op.Data, op.Off)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// The leftover is already on disk, so re-journaling it
+		// isn't subject to the limits.
+		err = fbo.writeBack.journal(
+			node, entry.Path, WriteBackJournalLimits{})
+		if err != nil {
+			return err
+		}
+		err = fbo.writeBack.replayed(name, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForWriteBack implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) WaitForWriteBack(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "WaitForWriteBack")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if err := fbo.flushCoalescedWrites(ctx); err != nil {
+		return err
+	}
+	if fbo.writeBack == nil {
+		return nil
+	}
+	return fbo.flushWriteBack(ctx)
+}
+
 // finalizeResolution caches all the blocks, and writes the new MD to
 // the merged branch, failing if there is a conflict.  It also sends
 // out the given newOps notifications locally.  This is used for
@@ -4178,7 +7699,107 @@ func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 	return history, nil
 }
 
+// ExportMDChain implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) ExportMDChain(ctx context.Context,
+	folderBranch FolderBranch) (chain MDChain, err error) {
+	fbo.log.CDebugf(ctx, "ExportMDChain")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return MDChain{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	_, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return MDChain{}, err
+	}
+
+	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(),
+		MetadataRevisionInitial)
+	if err != nil {
+		return MDChain{}, err
+	}
+	err = fbo.reembedBlockChanges(ctx, lState, rmds)
+	if err != nil {
+		return MDChain{}, err
+	}
+	return exportMDChain(ctx, fbo.config, rmds)
+}
+
+// VerifyTLFHistory implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) VerifyTLFHistory(ctx context.Context,
+	folderBranch FolderBranch, proof TLFMerkleProof) (
+	rev MetadataRevision, err error) {
+	fbo.log.CDebugf(ctx, "VerifyTLFHistory")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", rev, err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return MetadataRevisionUninitialized,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+
+	rev, err = verifyTLFHistory(ctx, fbo.config, md, proof)
+	if equivErr, ok := err.(MDServerEquivocationError); ok {
+		handle := md.GetTlfHandle()
+		fbo.log.CWarningf(ctx, "%v", equivErr)
+		fbo.config.Reporter().ReportErr(ctx, handle.GetCanonicalName(),
+			handle.IsPublic(), ReadMode, equivErr)
+		fbo.config.EventBus().Publish(Event{
+			Kind:         EventMDServerEquivocated,
+			FolderBranch: fbo.folderBranch,
+			Revision:     equivErr.Revision,
+			Err:          equivErr,
+		})
+	}
+	return rev, err
+}
+
+// GetFolderHead implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetFolderHead(ctx context.Context,
+	folderBranch FolderBranch) (
+	head FolderHead, headChanged <-chan StatusUpdate, err error) {
+	fbo.log.CDebugf(ctx, "GetFolderHead")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return FolderHead{}, nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	_, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return FolderHead{}, nil, err
+	}
+	// Get the head and the channel together, so no change can be
+	// missed in between.
+	md, headChanged := func() (*RootMetadata, <-chan StatusUpdate) {
+		fbo.headLock.RLock(lState)
+		defer fbo.headLock.RUnlock(lState)
+		return fbo.head, fbo.headChangedChan
+	}()
+
+	head, err = makeFolderHead(ctx, fbo.config, md)
+	if err != nil {
+		return FolderHead{}, nil, err
+	}
+	return head, headChanged, nil
+}
+
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fbo *folderBranchOps) PushConnectionStatusChange(service string, newStatus error) {
 	fbo.config.KBFSOps().PushConnectionStatusChange(service, newStatus)
 }
+
+// PushRetryStatusChange pushes changes to the retried calls to a
+// service.
+func (fbo *folderBranchOps) PushRetryStatusChange(
+	service string, status RetryStatus) {
+	fbo.config.KBFSOps().PushRetryStatusChange(service, status)
+}
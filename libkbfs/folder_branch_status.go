@@ -5,7 +5,9 @@
 package libkbfs
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 
@@ -22,6 +24,27 @@ type FolderBranchStatus struct {
 	RekeyPending bool
 	FolderID     string
 
+	// Pinned is true if this folder's blocks are currently pinned
+	// in the block cache, and Pinning is the user's override of
+	// whether it should be ("auto", "always" or "never").
+	Pinned  bool
+	Pinning string
+	// SyncMode is how much of the folder is kept on this device
+	// ("on-demand" or "full").
+	SyncMode string
+	// Frozen, if set, explains why the folder was frozen on this
+	// device after suspicious activity.
+	Frozen string `json:",omitempty"`
+	// Archived is true if the folder has been archived, so it
+	// can't be modified anymore.
+	Archived bool `json:",omitempty"`
+	// QuotaLimit, if set, is the most bytes the folder's writers
+	// let it use, to compare with DiskUsage.
+	QuotaLimit uint64 `json:",omitempty"`
+	// TrashRetention, if set, is how long entries removed from the
+	// folder stay in its trash, e.g. "720h0m0s".
+	TrashRetention string `json:",omitempty"`
+
 	// DirtyPaths are files that have been written, but not flushed.
 	// They do not represent unstaged changes in your local instance.
 	DirtyPaths []string
@@ -30,6 +53,69 @@ type FolderBranchStatus struct {
 	// diverging operations per-file
 	Unmerged []*crChainSummary
 	Merged   []*crChainSummary
+
+	// Latencies shows how long Read, Write, Sync, Lookup and
+	// MDFetch operations on this folder have been taking recently.
+	Latencies map[string]OpLatencyStats `json:",omitempty"`
+	// InFlightOps lists the Read, Write, Sync and Lookup operations
+	// on this folder that are running right now, oldest first.
+	InFlightOps []InFlightOp `json:",omitempty"`
+	// WriterRates shows how many updates a minute each writer has
+	// made to this folder over the last five minutes.
+	WriterRates map[libkb.NormalizedUsername]float64 `json:",omitempty"`
+	// QuotaPool, if set, describes the quota this folder shares
+	// with the other folders of its pool.
+	QuotaPool *QuotaPoolStatus `json:",omitempty"`
+	// WriteBack, if set, describes this folder's write-back
+	// journal.
+	WriteBack *WriteBackStatus `json:",omitempty"`
+}
+
+// WriteBackStatus describes the state of a folder's write-back
+// journal.  It is suitable for encoding directly as JSON.
+type WriteBackStatus struct {
+	// Entries is the number of files whose journaled writes
+	// haven't been synced to the servers yet.
+	Entries int
+	// Leftovers is how many of those entries are left over from a
+	// previous run, and haven't been replayed yet.
+	Leftovers int
+	// SetAside is the number of entries that couldn't be replayed,
+	// and were kept on disk for the user to recover.
+	SetAside int
+	// Bytes is how much disk the entries waiting to be synced take
+	// up, which counts against the limits in
+	// Config.WriteBackJournalLimits.
+	Bytes uint64
+}
+
+// QuotaPoolStatus describes the usage of a QuotaPool.  It is suitable
+// for encoding directly as JSON.
+type QuotaPoolStatus struct {
+	Name       string
+	UsageBytes int64
+	LimitBytes int64
+	// MemberBytes breaks UsageBytes down by the users who uploaded
+	// the blocks.
+	MemberBytes map[libkb.NormalizedUsername]int64
+}
+
+// ServiceErrors maps the names of failing services to the errors
+// they're failing with.  It encodes as JSON with the errors as
+// strings.
+type ServiceErrors map[string]error
+
+// MarshalJSON implements the json.Marshaler interface for
+// ServiceErrors.
+func (se ServiceErrors) MarshalJSON() ([]byte, error) {
+	if se == nil {
+		return []byte("null"), nil
+	}
+	strs := make(map[string]string, len(se))
+	for service, err := range se {
+		strs[service] = err.Error()
+	}
+	return json.Marshal(strs)
 }
 
 // KBFSStatus represents the content of the top-level status file. It is
@@ -40,7 +126,57 @@ type KBFSStatus struct {
 	IsConnected     bool
 	UsageBytes      int64
 	LimitBytes      int64
-	FailingServices map[string]error
+	FailingServices ServiceErrors
+	// PinnedFolders lists the folders whose blocks are currently
+	// pinned in the block cache.
+	PinnedFolders []string
+	// BlockCacheAdmission shows how well the block cache's
+	// admission control is working, if it's enabled.
+	BlockCacheAdmission *BlockCacheAdmissionStats `json:",omitempty"`
+	// BlockCacheUsage shows how much of the block cache is pinned,
+	// and how much can be evicted.
+	BlockCacheUsage *BlockCacheUsage `json:",omitempty"`
+	// FolderLatencies shows the recent operation latencies of each
+	// loaded folder, by canonical path, like
+	// FolderBranchStatus.Latencies.
+	FolderLatencies map[string]map[string]OpLatencyStats `json:",omitempty"`
+	// InFlightOps lists the operations running right now on all
+	// the loaded folders, oldest first, like
+	// FolderBranchStatus.InFlightOps.
+	InFlightOps []InFlightOp `json:",omitempty"`
+	// BandwidthSchedule shows the caps on the traffic to and from
+	// the servers, if any.
+	BandwidthSchedule string `json:",omitempty"`
+	// RetryStatus shows, for each remote server, the calls to it
+	// that have been retried.
+	RetryStatus map[string]RetryStatus `json:",omitempty"`
+	// Integrity shows what the background integrity checks of
+	// fully-synced folders have found, if they're enabled.
+	Integrity *IntegrityStatus `json:",omitempty"`
+}
+
+// UnsyncedChange describes a file with local changes that haven't
+// been flushed to the servers yet.
+type UnsyncedChange struct {
+	// Path is the path of the file, starting with the name of its
+	// top-level folder.
+	Path string
+	// Bytes is how many written bytes are still waiting to be
+	// flushed.  It can be 0 for files that were only truncated.
+	Bytes int64
+	// Age is how long ago the file was first changed after its
+	// last flush.
+	Age time.Duration
+}
+
+// FlushProgress reports how much local data is still waiting to be
+// flushed to the servers by KBFSOps.FlushAndWait.
+type FlushProgress struct {
+	// Files is how many files still have unsynced changes.
+	Files int
+	// Bytes is how many written bytes are still unsynced, across
+	// all of those files.
+	Bytes int64
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -55,9 +191,16 @@ type folderBranchStatusKeeper struct {
 
 	md         *RootMetadata
 	dirtyNodes map[NodeID]Node
-	unmerged   *crChains
-	merged     *crChains
-	dataMutex  sync.Mutex
+	// dirtySince holds, for each dirty node, when the oldest of its
+	// unsynced changes was made.
+	dirtySince map[NodeID]time.Time
+	// syncing holds, for each dirty node being synced, when it was
+	// first dirtied again after the sync started, or the zero time
+	// if it hasn't been yet.
+	syncing   map[NodeID]time.Time
+	unmerged  *crChains
+	merged    *crChains
+	dataMutex sync.Mutex
 
 	updateChan  chan StatusUpdate
 	updateMutex sync.Mutex
@@ -69,6 +212,8 @@ func newFolderBranchStatusKeeper(
 		config:     config,
 		nodeCache:  nodeCache,
 		dirtyNodes: make(map[NodeID]Node),
+		dirtySince: make(map[NodeID]time.Time),
+		syncing:    make(map[NodeID]time.Time),
 		updateChan: make(chan StatusUpdate, 1),
 	}
 }
@@ -130,13 +275,84 @@ func (fbsk *folderBranchStatusKeeper) rmNode(m map[NodeID]Node, n Node) {
 }
 
 func (fbsk *folderBranchStatusKeeper) addDirtyNode(n Node) {
+	func() {
+		fbsk.dataMutex.Lock()
+		defer fbsk.dataMutex.Unlock()
+		id := n.GetID()
+		now := fbsk.config.Clock().Now()
+		if _, ok := fbsk.dirtySince[id]; !ok {
+			fbsk.dirtySince[id] = now
+		}
+		if since, ok := fbsk.syncing[id]; ok && since.IsZero() {
+			fbsk.syncing[id] = now
+		}
+	}()
 	fbsk.addNode(fbsk.dirtyNodes, n)
 }
 
 func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) {
+	func() {
+		fbsk.dataMutex.Lock()
+		defer fbsk.dataMutex.Unlock()
+		delete(fbsk.dirtySince, n.GetID())
+		delete(fbsk.syncing, n.GetID())
+	}()
 	fbsk.rmNode(fbsk.dirtyNodes, n)
 }
 
+// syncStarted notes that a sync of the given node has started, so
+// that changes made from now on are aged separately from the ones
+// the sync includes.
+func (fbsk *folderBranchStatusKeeper) syncStarted(n Node) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	id := n.GetID()
+	if _, ok := fbsk.syncing[id]; !ok {
+		fbsk.syncing[id] = time.Time{}
+	}
+}
+
+// syncFinished notes that a sync of the given node has ended.  If it
+// succeeded, the node's remaining unsynced changes, if any, are the
+// ones made during the sync, so its age restarts from the first of
+// those.  If it failed, all of its changes are still unsynced, and
+// its age is unchanged.
+func (fbsk *folderBranchStatusKeeper) syncFinished(n Node, succeeded bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	id := n.GetID()
+	since, ok := fbsk.syncing[id]
+	delete(fbsk.syncing, id)
+	if !ok || !succeeded || since.IsZero() {
+		return
+	}
+	if _, ok := fbsk.dirtySince[id]; ok {
+		fbsk.dirtySince[id] = since
+	}
+}
+
+// getDirtySince returns when the oldest unsynced change to the given
+// node was made, and false if it has no unsynced changes.
+func (fbsk *folderBranchStatusKeeper) getDirtySince(n Node) (
+	time.Time, bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	since, ok := fbsk.dirtySince[n.GetID()]
+	return since, ok
+}
+
+// getDirtyNodes returns the nodes with unsynced changes, along with
+// when the oldest unsynced change to each one was made.
+func (fbsk *folderBranchStatusKeeper) getDirtyNodes() map[Node]time.Time {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	dirty := make(map[Node]time.Time, len(fbsk.dirtyNodes))
+	for id, n := range fbsk.dirtyNodes {
+		dirty[n] = fbsk.dirtySince[id]
+	}
+	return dirty
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	m map[NodeID]Node) []string {
@@ -168,6 +384,11 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context) (
 		fbs.DiskUsage = fbsk.md.DiskUsage
 		fbs.RekeyPending = fbsk.config.RekeyQueue().IsRekeyPending(fbsk.md.ID)
 		fbs.FolderID = fbsk.md.ID.String()
+		fbs.Archived = fbsk.md.IsArchived()
+		fbs.QuotaLimit = fbsk.md.Extra.QuotaLimit
+		if retention := fbsk.md.Extra.TrashRetention; retention > 0 {
+			fbs.TrashRetention = retention.String()
+		}
 	}
 
 	fbs.DirtyPaths = fbsk.convertNodesToPathsLocked(fbsk.dirtyNodes)
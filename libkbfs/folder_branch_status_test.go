@@ -5,10 +5,13 @@
 package libkbfs
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"golang.org/x/net/context"
@@ -19,6 +22,7 @@ func fbStatusTestInit(t *testing.T) (*gomock.Controller, *ConfigMock,
 	ctr := NewSafeTestReporter(t)
 	mockCtrl := gomock.NewController(ctr)
 	config := NewConfigMock(mockCtrl, ctr)
+	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
 	nodeCache := NewMockNodeCache(mockCtrl)
 	fbsk := newFolderBranchStatusKeeper(config, nodeCache)
 	interposeDaemonKBPKI(config, "alice", "bob")
@@ -136,3 +140,74 @@ func TestFBStatusAllFields(t *testing.T) {
 	expectedDirtyPaths := []string{p1.String(), p2.String()}
 	checkStringSlices(t, expectedDirtyPaths, status.DirtyPaths)
 }
+
+func TestFBStatusDirtyAgeAcrossSyncs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	clock, t0 := newTestClockAndTimeNow()
+	config := &ConfigLocal{}
+	config.SetClock(clock)
+	fbsk := newFolderBranchStatusKeeper(config, nil)
+	n := newMockNode(mockCtrl)
+
+	checkSince := func(expected time.Time) {
+		since, ok := fbsk.getDirtyNodes()[n]
+		if !ok {
+			t.Fatalf("Node isn't dirty")
+		}
+		if !since.Equal(expected) {
+			t.Errorf("Expected dirty since %v, got %v", expected, since)
+		}
+	}
+
+	fbsk.addDirtyNode(n)
+	clock.Add(time.Second)
+	fbsk.addDirtyNode(n)
+	checkSince(t0)
+
+	// A failed sync leaves the age alone, even if there were
+	// writes during it.
+	fbsk.syncStarted(n)
+	clock.Add(time.Second)
+	fbsk.addDirtyNode(n)
+	fbsk.syncFinished(n, false)
+	checkSince(t0)
+
+	// After a successful sync, only the writes made during it are
+	// left unsynced.
+	fbsk.syncStarted(n)
+	clock.Add(time.Second)
+	t3 := clock.Now()
+	fbsk.addDirtyNode(n)
+	clock.Add(time.Second)
+	fbsk.addDirtyNode(n)
+	fbsk.syncFinished(n, true)
+	checkSince(t3)
+
+	fbsk.rmDirtyNode(n)
+	if len(fbsk.getDirtyNodes()) != 0 {
+		t.Errorf("Node is still dirty")
+	}
+}
+
+func TestServiceErrorsJSON(t *testing.T) {
+	status := KBFSStatus{FailingServices: ServiceErrors{
+		MDServiceName: errors.New("connection refused"),
+	}}
+	data, err := json.Marshal(status.FailingServices)
+	if err != nil {
+		t.Fatalf("Couldn't encode: %v", err)
+	}
+	if expected := `{"md-server":"connection refused"}`; string(data) != expected {
+		t.Errorf("Got %s, expected %s", data, expected)
+	}
+
+	status.FailingServices = nil
+	data, err = json.Marshal(status.FailingServices)
+	if err != nil {
+		t.Fatalf("Couldn't encode: %v", err)
+	}
+	if string(data) != "null" {
+		t.Errorf("Got %s, expected null", data)
+	}
+}
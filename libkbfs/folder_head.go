@@ -0,0 +1,89 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// FolderHead describes the current head of a folder-branch, along
+// with a proof that external tools can check to attest to the state
+// of the folder.  It is suitable for encoding directly as JSON.
+type FolderHead struct {
+	// Folder is the canonical path of the folder.
+	Folder string
+	// TlfID is the ID of the folder.
+	TlfID string
+	// Revision is the revision of the head MD.
+	Revision MetadataRevision
+	// MdID is the ID of the head MD.
+	MdID string
+	// RootBlockID is the ID of the folder's root directory block.
+	RootBlockID string
+	// Writer is the user who made the head revision.
+	Writer string
+	// Proof is the encoded, signed MD object exactly as stored on
+	// the MD server.  Decoding it into a RootMetadataSigned and
+	// verifying its signature, then checking that it hashes to
+	// MdID, proves that the given writer made this revision with
+	// the given root block.
+	Proof []byte
+}
+
+// makeFolderHead fetches the signed copy of md from the MD server,
+// and checks that it matches md before building the FolderHead.
+func makeFolderHead(ctx context.Context, config Config, md *RootMetadata) (
+	FolderHead, error) {
+	mdID, err := md.MetadataID(config)
+	if err != nil {
+		return FolderHead{}, err
+	}
+
+	rmdses, err := config.MDServer().GetRange(ctx, md.ID, md.BID,
+		md.MergedStatus(), md.Revision, md.Revision)
+	if err != nil {
+		return FolderHead{}, err
+	}
+	if len(rmdses) != 1 {
+		return FolderHead{}, fmt.Errorf("Expected one MD for revision %d "+
+			"of %s, got %d", md.Revision, md.ID, len(rmdses))
+	}
+	rmds := rmdses[0]
+	err = rmds.VerifyRootMetadata(config.Codec(), config.Crypto())
+	if err != nil {
+		return FolderHead{}, err
+	}
+	serverMdID, err := config.Crypto().MakeMdID(&rmds.MD)
+	if err != nil {
+		return FolderHead{}, err
+	}
+	if serverMdID != mdID {
+		return FolderHead{}, fmt.Errorf("MD server returned MD %s for "+
+			"revision %d of %s, expected %s", serverMdID, md.Revision,
+			md.ID, mdID)
+	}
+	proof, err := config.Codec().Encode(rmds)
+	if err != nil {
+		return FolderHead{}, err
+	}
+
+	writer, err := config.KBPKI().GetNormalizedUsername(
+		ctx, md.LastModifyingWriter)
+	if err != nil {
+		return FolderHead{}, err
+	}
+
+	return FolderHead{
+		Folder:      md.GetTlfHandle().GetCanonicalPath(),
+		TlfID:       md.ID.String(),
+		Revision:    md.Revision,
+		MdID:        mdID.String(),
+		RootBlockID: md.data.Dir.BlockPointer.ID.String(),
+		Writer:      writer.String(),
+		Proof:       proof,
+	}, nil
+}
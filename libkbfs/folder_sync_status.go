@@ -0,0 +1,132 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// FolderSyncStatus describes how far a folder has gotten with
+// flushing its local changes to the servers, for progress bars.  It's
+// published in EventFolderSyncStatus events as files are synced.
+type FolderSyncStatus struct {
+	// BytesQueued is how many written bytes are still waiting to
+	// be flushed, across all the files in the folder.
+	BytesQueued int64
+	// BytesFlushed is how many bytes of file data have been
+	// flushed since the folder last had nothing left to flush.
+	BytesFlushed int64
+	// FilesPending is how many files still have unsynced changes,
+	// including the one being synced.
+	FilesPending int
+	// CurrentFile is the path of the file being synced, starting
+	// with the name of its top-level folder, or empty if none is.
+	CurrentFile string
+	// TimeRemaining estimates how long the queued bytes will take
+	// to flush, at the rate they've been flushed so far.  It's zero
+	// if there's no estimate yet.
+	TimeRemaining time.Duration
+}
+
+// folderSyncTracker keeps track of one folder's sync progress.  Syncs
+// of a folder's files happen one at a time, under its MD writer lock.
+type folderSyncTracker struct {
+	config Config
+
+	lock sync.Mutex
+	// queued is how many bytes were unsynced when the current
+	// file's sync started, and currentFlushed is how many of them
+	// have been flushed since.
+	queued         int64
+	currentFlushed int64
+	// flushed is how many bytes have been flushed since start.
+	flushed int64
+	files   int
+	current string
+	start   time.Time
+}
+
+func newFolderSyncTracker(config Config) *folderSyncTracker {
+	return &folderSyncTracker{config: config}
+}
+
+// getStatusLocked returns the current status.
+func (fst *folderSyncTracker) getStatusLocked() FolderSyncStatus {
+	status := FolderSyncStatus{
+		BytesQueued:  fst.queued - fst.currentFlushed,
+		BytesFlushed: fst.flushed,
+		FilesPending: fst.files,
+		CurrentFile:  fst.current,
+	}
+	if status.BytesQueued < 0 {
+		// A sync can flush more than was written, e.g. when it
+		// rewrites whole blocks around small writes.
+		status.BytesQueued = 0
+	}
+	elapsed := fst.config.Clock().Now().Sub(fst.start)
+	if fst.flushed > 0 && elapsed > 0 {
+		status.TimeRemaining = time.Duration(
+			float64(elapsed) * float64(status.BytesQueued) /
+				float64(fst.flushed))
+	}
+	return status
+}
+
+// syncStarted records that the given file is about to be synced,
+// while the given files (including it) have unsynced bytes.
+func (fst *folderSyncTracker) syncStarted(
+	file string, dirty map[Node]int64) FolderSyncStatus {
+	fst.lock.Lock()
+	defer fst.lock.Unlock()
+	if fst.start.IsZero() {
+		fst.start = fst.config.Clock().Now()
+	}
+	fst.queued = 0
+	for _, bytes := range dirty {
+		fst.queued += bytes
+	}
+	fst.currentFlushed = 0
+	fst.files = len(dirty)
+	fst.current = file
+	return fst.getStatusLocked()
+}
+
+// bytesFlushed records that n more bytes of file data were flushed.
+// It returns false if no file is being synced.
+func (fst *folderSyncTracker) bytesFlushed(n int64) (
+	FolderSyncStatus, bool) {
+	fst.lock.Lock()
+	defer fst.lock.Unlock()
+	if fst.current == "" {
+		return FolderSyncStatus{}, false
+	}
+	fst.currentFlushed += n
+	fst.flushed += n
+	return fst.getStatusLocked(), true
+}
+
+// syncFinished records that the current file's sync is over, and that
+// the given files are left with unsynced bytes.  Once none are left,
+// the count of flushed bytes starts over.
+func (fst *folderSyncTracker) syncFinished(
+	dirty map[Node]int64) FolderSyncStatus {
+	fst.lock.Lock()
+	defer fst.lock.Unlock()
+	fst.queued = 0
+	for _, bytes := range dirty {
+		fst.queued += bytes
+	}
+	fst.currentFlushed = 0
+	fst.files = len(dirty)
+	fst.current = ""
+	status := fst.getStatusLocked()
+	if fst.files == 0 {
+		status.TimeRemaining = 0
+		fst.flushed = 0
+		fst.start = time.Time{}
+	}
+	return status
+}
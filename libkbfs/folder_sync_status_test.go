@@ -0,0 +1,103 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolderSyncTracker(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	fst := newFolderSyncTracker(config)
+
+	// Nothing is flushed while no file is being synced.
+	_, ok := fst.bytesFlushed(10)
+	require.False(t, ok)
+
+	var n1, n2 Node = &nodeStandard{}, &nodeStandard{}
+	status := fst.syncStarted("alice/a", map[Node]int64{n1: 100, n2: 300})
+	require.Equal(t, FolderSyncStatus{
+		BytesQueued:  400,
+		FilesPending: 2,
+		CurrentFile:  "alice/a",
+	}, status)
+
+	clock.Add(time.Second)
+	status, ok = fst.bytesFlushed(100)
+	require.True(t, ok)
+	require.Equal(t, FolderSyncStatus{
+		BytesQueued:   300,
+		BytesFlushed:  100,
+		FilesPending:  2,
+		CurrentFile:   "alice/a",
+		TimeRemaining: 3 * time.Second,
+	}, status)
+
+	status = fst.syncFinished(map[Node]int64{n2: 300})
+	require.Equal(t, FolderSyncStatus{
+		BytesQueued:   300,
+		BytesFlushed:  100,
+		FilesPending:  1,
+		TimeRemaining: 3 * time.Second,
+	}, status)
+
+	// Once nothing is left, the next sync starts over.
+	fst.syncStarted("alice/b", map[Node]int64{n2: 300})
+	clock.Add(time.Second)
+	fst.bytesFlushed(300)
+	status = fst.syncFinished(nil)
+	require.Equal(t, FolderSyncStatus{BytesFlushed: 400}, status)
+	status = fst.syncStarted("alice/c", map[Node]int64{n1: 50})
+	require.Equal(t, FolderSyncStatus{
+		BytesQueued:  50,
+		FilesPending: 1,
+		CurrentFile:  "alice/c",
+	}, status)
+}
+
+func TestFolderSyncStatusPublished(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	sub := config.EventBus().Subscribe(100, EventFolderSyncStatus)
+	defer sub.Unsubscribe()
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	var statuses []FolderSyncStatus
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		require.Equal(t, rootNode.GetFolderBranch(), e.FolderBranch)
+		statuses = append(statuses, *e.SyncStatus)
+	}
+	require.True(t, len(statuses) >= 3, "%v", statuses)
+	first, last := statuses[0], statuses[len(statuses)-1]
+	require.Equal(t, "alice/a", first.CurrentFile)
+	require.Equal(t, 1, first.FilesPending)
+	require.True(t, first.BytesQueued >= int64(len(data)))
+	require.Equal(t, "", last.CurrentFile)
+	require.Equal(t, 0, last.FilesPending)
+	require.Equal(t, int64(0), last.BytesQueued)
+	require.Equal(t, int64(len(data)), last.BytesFlushed)
+
+	// Syncing a clean file doesn't publish anything.
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, sub.C, 0)
+}
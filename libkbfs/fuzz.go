@@ -0,0 +1,189 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build gofuzz
+
+// The Fuzz* functions below are entry points for go-fuzz, each
+// feeding its input to the client as if it had come from a malicious
+// server.  Build one with, e.g.:
+//
+//   go-fuzz-build -func FuzzDecodeRootMetadataSigned \
+//       github.com/keybase/kbfs/libkbfs
+//
+// and add -libfuzzer to build it for libFuzzer instead.  Each returns
+// 1 if its input got past decoding, so that the fuzzer favors it, and
+// 0 otherwise; it panics only if a client invariant is broken.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/keybase/client/go/logger"
+)
+
+// fuzzKey is the key the fuzzers use for everything they have to
+// encrypt so that the client can decrypt it again.
+var fuzzKey = [32]byte{1}
+
+func makeFuzzCodecAndCrypto() (Codec, CryptoCommon) {
+	codec := NewCodecMsgpack()
+	RegisterOps(codec)
+	return codec, MakeCryptoCommon(codec, logger.NewNull())
+}
+
+// FuzzDecodeRootMetadataSigned decodes its input as MD returned by
+// the MD server, and runs the checks done on it before its
+// signatures are trusted.
+func FuzzDecodeRootMetadataSigned(data []byte) int {
+	codec, crypto := makeFuzzCodecAndCrypto()
+	var rmds RootMetadataSigned
+	if err := codec.Decode(data, &rmds); err != nil {
+		return 0
+	}
+
+	// Signatures are checked against re-encoded MD, so the
+	// encoding of anything decoded must be stable.
+	buf, err := codec.Encode(rmds)
+	if err != nil {
+		return 0
+	}
+	var rmds2 RootMetadataSigned
+	if err := codec.Decode(buf, &rmds2); err != nil {
+		panic(fmt.Sprintf("Couldn't decode re-encoded MD: %v", err))
+	}
+	buf2, err := codec.Encode(rmds2)
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't re-encode decoded MD: %v", err))
+	}
+	if !bytes.Equal(buf, buf2) {
+		panic("Encoding of MD isn't stable")
+	}
+
+	md := &rmds.MD
+	_ = rmds.IsInitialized()
+	_ = md.IsInitialized()
+	_ = rmds.Version()
+	_, _ = md.MakeBareTlfHandle()
+	_ = md.VerifyWriterMetadata(codec, crypto)
+	_ = rmds.VerifyRootMetadata(codec, crypto)
+
+	if md.ID.IsPublic() {
+		return 1
+	}
+	for i := 0; i < len(md.WKeys) && i < len(md.RKeys); i++ {
+		keyGen := FirstValidKeyGen + KeyGen(i)
+		for _, userKeys := range []UserDeviceKeyInfoMap{
+			md.WKeys[i].WKeys, md.RKeys[i].RKeys} {
+			for user, devices := range userKeys {
+				for kid := range devices {
+					_, _ = md.GetTLFEphemeralPublicKey(
+						keyGen, user, MakeCryptPublicKey(kid))
+				}
+			}
+		}
+	}
+	return 1
+}
+
+// FuzzDecryptPrivateMetadata decodes its input as the private part of
+// MD, after it's been decrypted.
+func FuzzDecryptPrivateMetadata(data []byte) int {
+	_, crypto := makeFuzzCodecAndCrypto()
+	encryptedData, err := crypto.encryptData(data, fuzzKey)
+	if err != nil {
+		panic(err)
+	}
+	_, err = crypto.DecryptPrivateMetadata(
+		EncryptedPrivateMetadata(encryptedData), MakeTLFCryptKey(fuzzKey))
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzDecryptBlock decodes its input as a block returned by the block
+// server, after it's been decrypted.  The first byte of the input
+// picks whether it's read as a file or a directory block, and the
+// rest is the padded block, as if it had been encrypted by a
+// malicious writer with the right key.
+func FuzzDecryptBlock(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	block := NewFileBlock()
+	if data[0]&1 != 0 {
+		block = NewDirBlock()
+	}
+
+	codec, crypto := makeFuzzCodecAndCrypto()
+	serverHalf := MakeBlockCryptKeyServerHalf([32]byte{})
+	tlfCryptKey := MakeTLFCryptKey(fuzzKey)
+	blockCryptKey, err := crypto.UnmaskBlockCryptKey(
+		serverHalf, tlfCryptKey)
+	if err != nil {
+		panic(err)
+	}
+	encryptedData, err := crypto.encryptData(data[1:], blockCryptKey.data)
+	if err != nil {
+		panic(err)
+	}
+	buf, err := codec.Encode(EncryptedBlock(encryptedData))
+	if err != nil {
+		panic(err)
+	}
+
+	err = decryptBlock(codec, crypto, buf, serverHalf, tlfCryptKey, block)
+	if err != nil {
+		return 0
+	}
+	if block.GetEncodedSize() != uint32(len(buf)) {
+		panic(fmt.Sprintf("Encoded size %d != %d",
+			block.GetEncodedSize(), len(buf)))
+	}
+	return 1
+}
+
+// FuzzParseTlfName parses its input as the name of a TLF, as found in
+// a path, along with its extension suffix if it has one.
+func FuzzParseTlfName(data []byte) int {
+	name := string(data)
+	ret := 0
+	for _, public := range []bool{false, true} {
+		writers, readers, suffix, err :=
+			splitAndNormalizeTLFName(name, public)
+		if err != nil {
+			continue
+		}
+		ret = 1
+
+		// A name that parsed is already canonical.
+		normalized, err := normalizeNamesInTLF(writers, readers, suffix)
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't re-normalize %q: %v", name, err))
+		}
+		if normalized != name {
+			panic(fmt.Sprintf("%q normalized to %q", name, normalized))
+		}
+
+		if suffix == "" {
+			continue
+		}
+		extensions, err := ParseTlfHandleExtensionSuffix(suffix)
+		if err != nil {
+			continue
+		}
+		suffix2 := NewTlfHandleExtensionSuffix(extensions)
+		extensions2, err := ParseTlfHandleExtensionSuffix(suffix2)
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't re-parse %q: %v", suffix2, err))
+		}
+		if len(extensions) != len(extensions2) {
+			panic(fmt.Sprintf("%q and %q have different extensions",
+				suffix, suffix2))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hotFolderHalfLife is how long it takes for the access score
+	// of an idle folder to drop by half.
+	hotFolderHalfLife = 1 * time.Hour
+	// hotFolderMinScore is the access score a folder needs before
+	// it's pinned automatically, so one-off visits don't displace
+	// folders that are used regularly.
+	hotFolderMinScore = 5.0
+	// hotFolderForgetScore is the access score below which an
+	// unpinned folder is no longer tracked at all.
+	hotFolderForgetScore = 0.01
+	// hotFolderRebalancePeriod is how often the set of pinned
+	// folders is recomputed.
+	hotFolderRebalancePeriod = 1 * time.Minute
+	// hotFolderPinBudgetDefault is the default limit on the total
+	// disk usage of automatically pinned folders, and on the
+	// number of bytes the block cache sets aside for them out of
+	// its capacity (currently 128MiB).
+	hotFolderPinBudgetDefault = MaxBlockSizeBytesDefault * 256
+	// reconnectPrefetchFolders is how many of the most recently
+	// used folders catch up on missed MD updates as soon as the MD
+	// server connection comes back.
+	reconnectPrefetchFolders = 10
+)
+
+type hotFolder struct {
+	score      float64
+	lastAccess time.Time
+	pinning    FolderPinning
+	syncMode   TlfSyncMode
+}
+
+// alwaysPinned returns whether the folder must be pinned no matter
+// how often it's used: either the user asked for it to be pinned, or
+// for it to be fully synced.
+func (hf *hotFolder) alwaysPinned() bool {
+	return hf.pinning == PinAlways || hf.syncMode == SyncFull
+}
+
+// hotFolderTracker keeps a decaying count of accesses to each folder,
+// and uses it to pick the folders that should be pinned in the block
+// cache: every folder the user has asked to always pin or to fully
+// sync, plus the most frequently-accessed other folders, as long as
+// their total disk usage fits in the pinning budget.
+type hotFolderTracker struct {
+	config Config
+	budget uint64
+
+	lock    sync.Mutex
+	folders map[TlfID]*hotFolder
+	pinned  map[TlfID]bool
+}
+
+func newHotFolderTracker(config Config, budget uint64) *hotFolderTracker {
+	return &hotFolderTracker{
+		config:  config,
+		budget:  budget,
+		folders: make(map[TlfID]*hotFolder),
+		pinned:  make(map[TlfID]bool),
+	}
+}
+
+func (hft *hotFolderTracker) scoreLocked(
+	hf *hotFolder, now time.Time) float64 {
+	elapsed := now.Sub(hf.lastAccess)
+	return hf.score * math.Exp2(-float64(elapsed)/float64(hotFolderHalfLife))
+}
+
+func (hft *hotFolderTracker) getLocked(tlf TlfID) *hotFolder {
+	hf, ok := hft.folders[tlf]
+	if !ok {
+		hf = &hotFolder{lastAccess: hft.config.Clock().Now()}
+		hft.folders[tlf] = hf
+	}
+	return hf
+}
+
+// recordAccess notes that the given folder was just accessed.
+func (hft *hotFolderTracker) recordAccess(tlf TlfID) {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	now := hft.config.Clock().Now()
+	hf := hft.getLocked(tlf)
+	hf.score = hft.scoreLocked(hf, now) + 1
+	hf.lastAccess = now
+}
+
+// setPinning overrides whether the given folder is pinned.  The
+// change takes effect the next time choosePinned is called.
+func (hft *hotFolderTracker) setPinning(tlf TlfID, pinning FolderPinning) {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	hft.getLocked(tlf).pinning = pinning
+}
+
+// getPinning returns the user's override for the given folder, and
+// whether the folder is currently pinned.
+func (hft *hotFolderTracker) getPinning(tlf TlfID) (FolderPinning, bool) {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	pinning := PinAuto
+	if hf, ok := hft.folders[tlf]; ok {
+		pinning = hf.pinning
+	}
+	return pinning, hft.pinned[tlf]
+}
+
+// setSyncMode changes the sync mode of the given folder.  The change
+// to its pinning takes effect the next time choosePinned is called.
+func (hft *hotFolderTracker) setSyncMode(tlf TlfID, mode TlfSyncMode) {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	hft.getLocked(tlf).syncMode = mode
+}
+
+// getSyncMode returns the sync mode of the given folder.
+func (hft *hotFolderTracker) getSyncMode(tlf TlfID) TlfSyncMode {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	if hf, ok := hft.folders[tlf]; ok {
+		return hf.syncMode
+	}
+	return SyncOnDemand
+}
+
+// getLastAccess returns when the given folder was last accessed, and
+// false if it hasn't been accessed since it was last forgotten.
+func (hft *hotFolderTracker) getLastAccess(tlf TlfID) (time.Time, bool) {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	// A folder can be tracked just for its pinning or sync mode,
+	// without ever being accessed, in which case its score is 0.
+	if hf, ok := hft.folders[tlf]; ok && hf.score > 0 {
+		return hf.lastAccess, true
+	}
+	return time.Time{}, false
+}
+
+// fullySynced returns the set of folders in the SyncFull mode.
+func (hft *hotFolderTracker) fullySynced() map[TlfID]bool {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	synced := make(map[TlfID]bool)
+	for tlf, hf := range hft.folders {
+		if hf.syncMode == SyncFull {
+			synced[tlf] = true
+		}
+	}
+	return synced
+}
+
+func (hft *hotFolderTracker) copyPinnedLocked() map[TlfID]bool {
+	pinned := make(map[TlfID]bool, len(hft.pinned))
+	for tlf := range hft.pinned {
+		pinned[tlf] = true
+	}
+	return pinned
+}
+
+// getPinned returns the set of currently-pinned folders.
+func (hft *hotFolderTracker) getPinned() map[TlfID]bool {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	return hft.copyPinnedLocked()
+}
+
+// recentFolders returns up to n of the tracked folders, most
+// recently accessed first.
+func (hft *hotFolderTracker) recentFolders(n int) []TlfID {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	tlfs := make([]TlfID, 0, len(hft.folders))
+	for tlf := range hft.folders {
+		tlfs = append(tlfs, tlf)
+	}
+	sort.Sort(hotFoldersByRecency{tlfs, hft.folders})
+	if len(tlfs) > n {
+		tlfs = tlfs[:n]
+	}
+	return tlfs
+}
+
+type hotFoldersByRecency struct {
+	tlfs    []TlfID
+	folders map[TlfID]*hotFolder
+}
+
+func (r hotFoldersByRecency) Len() int { return len(r.tlfs) }
+func (r hotFoldersByRecency) Swap(i, j int) {
+	r.tlfs[i], r.tlfs[j] = r.tlfs[j], r.tlfs[i]
+}
+func (r hotFoldersByRecency) Less(i, j int) bool {
+	return r.folders[r.tlfs[i]].lastAccess.After(
+		r.folders[r.tlfs[j]].lastAccess)
+}
+
+type hotFolderCandidate struct {
+	tlf    TlfID
+	score  float64
+	size   uint64
+	always bool
+}
+
+type hotFolderCandidates []hotFolderCandidate
+
+func (c hotFolderCandidates) Len() int      { return len(c) }
+func (c hotFolderCandidates) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+// Less sorts folders that are always pinned first, and then the rest
+// by decreasing score.
+func (c hotFolderCandidates) Less(i, j int) bool {
+	if c[i].always != c[j].always {
+		return c[i].always
+	}
+	return c[i].score > c[j].score
+}
+
+// choosePinned recomputes and returns the set of pinned folders,
+// given the current disk usage of each loaded folder.  Folders with
+// unknown disk usage are only pinned if the user asked for it, and
+// fully-synced folders are always pinned, even if the user asked
+// for them never to be.
+func (hft *hotFolderTracker) choosePinned(
+	sizes map[TlfID]uint64) map[TlfID]bool {
+	hft.lock.Lock()
+	defer hft.lock.Unlock()
+	now := hft.config.Clock().Now()
+
+	var candidates hotFolderCandidates
+	for tlf, hf := range hft.folders {
+		score := hft.scoreLocked(hf, now)
+		size, sizeKnown := sizes[tlf]
+		switch {
+		case hf.alwaysPinned():
+		case hf.pinning == PinNever:
+			continue
+		case score < hotFolderForgetScore:
+			delete(hft.folders, tlf)
+			continue
+		case score < hotFolderMinScore || !sizeKnown:
+			continue
+		}
+		candidates = append(candidates,
+			hotFolderCandidate{tlf, score, size, hf.alwaysPinned()})
+	}
+	sort.Sort(candidates)
+
+	hft.pinned = make(map[TlfID]bool)
+	var used uint64
+	for _, c := range candidates {
+		if !c.always && used+c.size > hft.budget {
+			continue
+		}
+		hft.pinned[c.tlf] = true
+		used += c.size
+	}
+	return hft.copyPinnedLocked()
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func hotFolderTrackerTestInit(budget uint64) (
+	*hotFolderTracker, *TestClock) {
+	config := &ConfigLocal{}
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	return newHotFolderTracker(config, budget), clock
+}
+
+func TestHotFolderTrackerChoosesHottestWithinBudget(t *testing.T) {
+	hft, _ := hotFolderTrackerTestInit(100)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	tlf3 := FakeTlfID(3, false)
+	for i := 0; i < 20; i++ {
+		hft.recordAccess(tlf1)
+	}
+	for i := 0; i < 10; i++ {
+		hft.recordAccess(tlf2)
+		hft.recordAccess(tlf3)
+	}
+	hft.recordAccess(tlf3)
+
+	// tlf3 is hotter than tlf2, but it doesn't fit next to tlf1.
+	sizes := map[TlfID]uint64{tlf1: 50, tlf2: 40, tlf3: 60}
+	pinned := hft.choosePinned(sizes)
+	expected := map[TlfID]bool{tlf1: true, tlf2: true}
+	if !reflect.DeepEqual(pinned, expected) {
+		t.Errorf("Pinned %v, expected %v", pinned, expected)
+	}
+}
+
+func TestHotFolderTrackerDecay(t *testing.T) {
+	hft, clock := hotFolderTrackerTestInit(100)
+	tlf := FakeTlfID(1, false)
+	sizes := map[TlfID]uint64{tlf: 10}
+	for i := 0; i < 10; i++ {
+		hft.recordAccess(tlf)
+	}
+	if pinned := hft.choosePinned(sizes); !pinned[tlf] {
+		t.Errorf("Hot folder wasn't pinned")
+	}
+
+	// After a while without any accesses, it cools off.
+	clock.Add(2 * hotFolderHalfLife)
+	if pinned := hft.choosePinned(sizes); pinned[tlf] {
+		t.Errorf("Cold folder was still pinned")
+	}
+
+	// And eventually it's forgotten completely.
+	clock.Add(20 * hotFolderHalfLife)
+	hft.choosePinned(sizes)
+	if _, ok := hft.folders[tlf]; ok {
+		t.Errorf("Cold folder is still tracked")
+	}
+}
+
+func TestHotFolderTrackerOverrides(t *testing.T) {
+	hft, clock := hotFolderTrackerTestInit(100)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	for i := 0; i < 10; i++ {
+		hft.recordAccess(tlf1)
+	}
+
+	// Overrides win over access patterns and the budget.
+	hft.setPinning(tlf1, PinNever)
+	hft.setPinning(tlf2, PinAlways)
+	clock.Add(24 * time.Hour)
+	sizes := map[TlfID]uint64{tlf1: 10, tlf2: 1000}
+	pinned := hft.choosePinned(sizes)
+	expected := map[TlfID]bool{tlf2: true}
+	if !reflect.DeepEqual(pinned, expected) {
+		t.Errorf("Pinned %v, expected %v", pinned, expected)
+	}
+
+	pinning, isPinned := hft.getPinning(tlf2)
+	if pinning != PinAlways || !isPinned {
+		t.Errorf("Unexpected pinning for %s: %s, %t", tlf2, pinning, isPinned)
+	}
+}
+
+func TestHotFolderTrackerRecentFolders(t *testing.T) {
+	hft, clock := hotFolderTrackerTestInit(0)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+	tlf3 := FakeTlfID(3, false)
+	for _, tlf := range []TlfID{tlf1, tlf2, tlf3, tlf1} {
+		hft.recordAccess(tlf)
+		clock.Add(time.Second)
+	}
+
+	if recent, expected := hft.recentFolders(2),
+		[]TlfID{tlf1, tlf3}; !reflect.DeepEqual(recent, expected) {
+		t.Errorf("Got recent folders %v, expected %v", recent, expected)
+	}
+	if recent, expected := hft.recentFolders(5),
+		[]TlfID{tlf1, tlf3, tlf2}; !reflect.DeepEqual(recent, expected) {
+		t.Errorf("Got recent folders %v, expected %v", recent, expected)
+	}
+}
+
+func TestHotFolderTrackerSyncMode(t *testing.T) {
+	hft, _ := hotFolderTrackerTestInit(100)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, false)
+
+	// Fully-synced folders are pinned even if the user asked for
+	// them never to be, and no matter how big they are.
+	hft.setPinning(tlf1, PinNever)
+	hft.setSyncMode(tlf1, SyncFull)
+	hft.setSyncMode(tlf2, SyncOnDemand)
+	sizes := map[TlfID]uint64{tlf1: 1000, tlf2: 10}
+	pinned := hft.choosePinned(sizes)
+	expected := map[TlfID]bool{tlf1: true}
+	if !reflect.DeepEqual(pinned, expected) {
+		t.Errorf("Pinned %v, expected %v", pinned, expected)
+	}
+	if synced := hft.fullySynced(); !reflect.DeepEqual(synced, expected) {
+		t.Errorf("Fully synced %v, expected %v", synced, expected)
+	}
+
+	hft.setSyncMode(tlf1, SyncOnDemand)
+	if mode := hft.getSyncMode(tlf1); mode != SyncOnDemand {
+		t.Errorf("Unexpected sync mode for %s: %s", tlf1, mode)
+	}
+	if pinned := hft.choosePinned(sizes); pinned[tlf1] {
+		t.Errorf("Folder was still pinned after going back to on-demand")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type identifyBatchCall struct {
+	done chan struct{}
+	info UserInfo
+	err  error
+}
+
+type identifyBatchResult struct {
+	info UserInfo
+	at   time.Time
+}
+
+// identifyBatchingKBPKI wraps a KBPKI so that concurrent identifies
+// of the same assertion, coming from any number of folders, share a
+// single call to the daemon, and successful results are reused for
+// other folders until they expire.  This keeps the identify load
+// manageable for processes that serve many folders with overlapping
+// sets of users.
+type identifyBatchingKBPKI struct {
+	KBPKI
+	clock    Clock
+	validFor time.Duration
+
+	lock    sync.Mutex
+	pending map[string]*identifyBatchCall
+	results map[string]identifyBatchResult
+}
+
+var _ KBPKI = (*identifyBatchingKBPKI)(nil)
+
+func newIdentifyBatchingKBPKI(kbpki KBPKI, clock Clock,
+	validFor time.Duration) *identifyBatchingKBPKI {
+	return &identifyBatchingKBPKI{
+		KBPKI:    kbpki,
+		clock:    clock,
+		validFor: validFor,
+		pending:  make(map[string]*identifyBatchCall),
+		results:  make(map[string]identifyBatchResult),
+	}
+}
+
+// Identify implements the KBPKI interface for identifyBatchingKBPKI.
+func (k *identifyBatchingKBPKI) Identify(
+	ctx context.Context, assertion, reason string) (UserInfo, error) {
+	call, isNew := func() (*identifyBatchCall, bool) {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		if r, ok := k.results[assertion]; ok {
+			if k.clock.Now().Sub(r.at) < k.validFor {
+				return &identifyBatchCall{info: r.info}, false
+			}
+			delete(k.results, assertion)
+		}
+		if call, ok := k.pending[assertion]; ok {
+			return call, false
+		}
+		call := &identifyBatchCall{done: make(chan struct{})}
+		k.pending[assertion] = call
+		return call, true
+	}()
+
+	if call.done == nil {
+		// Cached result.
+		return call.info, nil
+	}
+
+	if !isNew {
+		select {
+		case <-call.done:
+			return call.info, call.err
+		case <-ctx.Done():
+			return UserInfo{}, ctx.Err()
+		}
+	}
+
+	call.info, call.err = k.KBPKI.Identify(ctx, assertion, reason)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.pending, assertion)
+	if call.err == nil {
+		k.results[assertion] = identifyBatchResult{call.info, k.clock.Now()}
+	}
+	close(call.done)
+	return call.info, call.err
+}
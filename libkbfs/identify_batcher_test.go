@@ -0,0 +1,78 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestIdentifyBatchingKBPKICachesResults(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	kbpki := NewMockKBPKI(mockCtrl)
+	clock := newTestClockNow()
+	k := newIdentifyBatchingKBPKI(kbpki, clock, time.Minute)
+	ctx := context.Background()
+
+	info := UserInfo{Name: "alice", UID: keybase1.MakeTestUID(1)}
+	kbpki.EXPECT().Identify(gomock.Any(), "alice", gomock.Any()).
+		Times(1).Return(info, nil)
+
+	// The second call should be served from the cache.
+	for i := 0; i < 2; i++ {
+		got, err := k.Identify(ctx, "alice", "test")
+		require.NoError(t, err)
+		require.Equal(t, info, got)
+	}
+
+	// Once the result expires, the daemon is asked again.
+	clock.Add(2 * time.Minute)
+	kbpki.EXPECT().Identify(gomock.Any(), "alice", gomock.Any()).
+		Times(1).Return(info, nil)
+	got, err := k.Identify(ctx, "alice", "test")
+	require.NoError(t, err)
+	require.Equal(t, info, got)
+}
+
+func TestIdentifyBatchingKBPKICoalescesConcurrentCalls(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	kbpki := NewMockKBPKI(mockCtrl)
+	k := newIdentifyBatchingKBPKI(kbpki, newTestClockNow(), time.Minute)
+	ctx := context.Background()
+
+	info := UserInfo{Name: "alice", UID: keybase1.MakeTestUID(1)}
+	started := make(chan struct{})
+	unstall := make(chan struct{})
+	kbpki.EXPECT().Identify(gomock.Any(), "alice", gomock.Any()).
+		Times(1).Do(func(context.Context, string, string) {
+		close(started)
+		<-unstall
+	}).Return(info, nil)
+
+	const numCalls = 5
+	errCh := make(chan error, numCalls)
+	go func() {
+		_, err := k.Identify(ctx, "alice", "test")
+		errCh <- err
+	}()
+	<-started
+	for i := 1; i < numCalls; i++ {
+		go func() {
+			_, err := k.Identify(ctx, "alice", "test")
+			errCh <- err
+		}()
+	}
+	close(unstall)
+	for i := 0; i < numCalls; i++ {
+		require.NoError(t, <-errCh)
+	}
+}
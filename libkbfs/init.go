@@ -8,10 +8,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -26,8 +28,10 @@ type InitParams struct {
 	// If non-empty, where to write a CPU profile.
 	CPUProfile string
 
-	// If non-empty, the host:port of the block server. If empty,
-	// a default value is used depending on the run mode.
+	// If non-empty, the host:port of the block server, or a
+	// comma-separated list of them in order of preference, to be
+	// used through a BlockServerFailover. If empty, a default value
+	// is used depending on the run mode.
 	BServerAddr string
 	// If non-empty the host:port of the metadata server. If
 	// empty, a default value is used depending on the run mode.
@@ -39,14 +43,193 @@ type InitParams struct {
 	// If non-empty, use on-disk servers and ignore BServerAddr
 	// and MDServerAddr.
 	ServerRootDir string
+	// ServerRootQuota is the number of bytes each user may store
+	// in the on-disk block server.  Zero means no limit.
+	ServerRootQuota int64
+	// ServerRootMDRetention says which revisions the on-disk MD
+	// server keeps once its clients have checkpointed past them.
+	// The zero value keeps every revision.
+	ServerRootMDRetention MDRetentionPolicy
+	// ServerRootQuotaPools, if non-empty, is a JSON file listing
+	// the QuotaPools of the on-disk block server, whose folders
+	// share a quota instead of using their writers' quotas.
+	ServerRootQuotaPools string
+	// ServerRootShards, if non-empty, is a comma-separated list of
+	// directories, ideally on different disks, across which the
+	// on-disk block server erasure-codes its block data, so that
+	// losing any two of them loses no blocks.
+	ServerRootShards string
 	// Fake local user name. If non-empty, either ServerInMemory
 	// must be true or ServerRootDir must be non-empty.
 	LocalUser string
 
+	// Keyring, if non-empty, is a JSON file holding a Keyring, which
+	// is used to look up users instead of the Keybase service.
+	// KeyringSecrets must then hold the KeyringDeviceSecrets of
+	// this device.
+	Keyring        string
+	KeyringSecrets string
+
 	// TLFValidDuration is the duration that TLFs are valid
 	// before marked for lazy revalidation.
 	TLFValidDuration time.Duration
 
+	// ReadOnlyReplica, if true, runs KBFS in InitReadOnlyReplica
+	// mode, with all writes disabled.
+	ReadOnlyReplica bool
+
+	// PaperKeyUser, if non-empty, runs KBFS in InitPaperKeyRecovery
+	// mode as this user, with the paper key phrase read from
+	// PaperKeyFile standing in for a device.
+	PaperKeyUser string
+	PaperKeyFile string
+
+	// WriteBackJournalDir, if non-empty, is where unsynced writes
+	// are journaled, so that Sync can return before they reach the
+	// servers.  On shutdown, the hottest blocks of the block cache
+	// are also left there for the next process to start with.
+	WriteBackJournalDir string
+	// WriteBackJournalLimits caps the disk used by the write-back
+	// journals, per folder and in total.
+	WriteBackJournalLimits WriteBackJournalLimits
+
+	// BlockGetsPerFolder is the number of blocks each folder can
+	// fetch in parallel, separately from its uploads.  Zero means
+	// no limit.
+	BlockGetsPerFolder int
+	// BlockPutWorkers is the number of blocks each folder uploads
+	// in parallel while syncing.
+	BlockPutWorkers int
+	// BlockPutsPerHost limits the number of block uploads in
+	// flight to the block server, across all folders.  Zero means
+	// no limit.
+	BlockPutsPerHost int
+
+	// ContentDefinedChunking, if true, splits file blocks at
+	// content-defined boundaries instead of fixed offsets, so that
+	// edits in the middle of large files change fewer blocks.
+	// Folders written this way can't be written by older clients.
+	ContentDefinedChunking bool
+
+	// MergeTextConflicts, if true, makes conflict resolution try a
+	// three-way merge of small text files written on both sides of
+	// a conflict, before falling back to keeping both copies.  The
+	// base of the merge is the file as of the revision the two
+	// sides diverged from.  It's off by default, since a clean line
+	// merge isn't always a correct one (see TextMergeStrategy).
+	MergeTextConflicts bool
+	// MergeDrivers are commands that merge the conflicting versions
+	// of particular files, each given as
+	// "name[:.ext,...]=command [args...]".  See
+	// CommandMergeDriver for how the command is run.
+	MergeDrivers []string
+
+	// DeletionLimitEntries and DeletionLimitBytes are how many
+	// entries, and how many bytes of file data, may be deleted from
+	// a shared folder within a minute before further deletions are
+	// held for confirmation, or for DeletionGracePeriod if nothing
+	// has registered to confirm them.  Zero means no limit.
+	DeletionLimitEntries int
+	DeletionLimitBytes   uint64
+	DeletionGracePeriod  time.Duration
+
+	// AnomalyDeletions and AnomalyRewrites are how many entries one
+	// writer may delete from a shared folder, and how many existing
+	// files it may rewrite, within five minutes before the folder
+	// is frozen on this device as a precaution.  Zero means no
+	// limit.
+	AnomalyDeletions int
+	AnomalyRewrites  int
+
+	// MDWritesPerMinute is the rate at which each shared folder
+	// may be updated from this device, after a short burst.  Zero
+	// means no limit.
+	MDWritesPerMinute int
+
+	// RetryMaxAttempts and RetryMaxBackoff override those of the
+	// DefaultRetryPolicy for calls to the remote servers, if
+	// positive.
+	RetryMaxAttempts int
+	RetryMaxBackoff  time.Duration
+
+	// BandwidthSchedule caps the block and MD traffic to and from
+	// the servers by time of day, in the form parsed by
+	// ParseBandwidthSchedule.  Empty means no caps.
+	BandwidthSchedule string
+
+	// FaultInjection, if non-empty, wraps the servers in a
+	// BlockServerFaulty and MDServerFaulty that inject the faults
+	// it lists, in the form parsed by ParseFaultPolicy.  It's meant
+	// for soak testing, never for real use.
+	FaultInjection string
+
+	// BlockCacheAdmission, if true, keeps blocks that are only read
+	// once (e.g., by backups or media scans) from evicting
+	// frequently-used blocks from the block cache.
+	BlockCacheAdmission bool
+
+	// BlockCacheAutoSize, if true, sizes the block cache to the
+	// system's memory, and shrinks it whenever the system runs low
+	// on memory.
+	BlockCacheAutoSize bool
+
+	// MaxDirtyAge is how old unsynced changes to a file can get
+	// before the file is synced in the background, no matter how
+	// little has been written, or 0 to not limit it.
+	MaxDirtyAge time.Duration
+
+	// WriteCoalesceWindow is how long small sequential writes to a
+	// file, like a log's appends, are held back so they can be
+	// applied together, or 0 to apply every write right away.
+	WriteCoalesceWindow time.Duration
+
+	// IntegrityCheckPeriod is how often to re-read a random sample
+	// of the blocks of each fully-synced folder from the block
+	// server, to make sure they're still intact and match this
+	// device's copy, or 0 to never check them.
+	IntegrityCheckPeriod time.Duration
+
+	// PerFileWriteFairness, if true, makes writes to different files
+	// take turns when the dirty block cache is full, so that a
+	// stream of writes to one file can't hold up the others.
+	PerFileWriteFairness bool
+
+	// MetricsAddr, if non-empty, is the host:port on which to serve
+	// KBFS metrics to Prometheus, at /metrics.
+	MetricsAddr string
+
+	// KVStoreBackend is the name of the database that the
+	// key-value stores kept on disk use, "leveldb" or "bolt".
+	// Stores kept with the other one are migrated to it.
+	KVStoreBackend string
+
+	// ResolveCacheDir, if non-empty, is the directory in which
+	// the resolutions of assertions are cached across restarts.
+	// Otherwise they're only cached in memory.
+	ResolveCacheDir string
+
+	// ResolveCacheTTL is how long a cached resolution is trusted
+	// before the service is asked again, or 0 to not cache them.
+	// It's off by default, since a cached resolution of a social
+	// assertion keeps resolving for the whole TTL after its proof
+	// is revoked, unless the service reports a change to the user.
+	ResolveCacheTTL time.Duration
+
+	// ChangeFeedAddr, if non-empty, is the host:port on which to
+	// serve folder change notifications to local applications.
+	ChangeFeedAddr string
+
+	// PeerCacheAddr, if non-empty, is the host:port on which to
+	// serve up to PeerCacheBytes of recently used encrypted blocks
+	// to the comma-separated host:ports in PeerCachePeers, which are
+	// in turn asked for blocks before the block server.  All of them
+	// must share the secret in PeerCacheSecretFile.  See
+	// BlockServerPeerCache.
+	PeerCacheAddr       string
+	PeerCachePeers      string
+	PeerCacheSecretFile string
+	PeerCacheBytes      int64
+
 	// LogToFile if true, logs to a default file location.
 	LogToFile bool
 
@@ -90,13 +273,58 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	flags.BoolVar(&params.Debug, "debug", BoolForString(os.Getenv("KBFS_DEBUG")), "Print debug messages")
 	flags.StringVar(&params.CPUProfile, "cpuprofile", "", "write cpu profile to file")
 
-	flags.StringVar(&params.BServerAddr, "bserver", GetDefaultBServer(ctx), "host:port of the block server")
+	flags.StringVar(&params.BServerAddr, "bserver", GetDefaultBServer(ctx), "host:port of the block server, or a comma-separated list of them to fail over between, in order of preference")
 	flags.StringVar(&params.MDServerAddr, "mdserver", GetDefaultMDServer(ctx), "host:port of the metadata server")
 
 	flags.BoolVar(&params.ServerInMemory, "server-in-memory", false, "use in-memory server (and ignore -bserver, -mdserver, and -server-root)")
 	flags.StringVar(&params.ServerRootDir, "server-root", "", "directory to put local server files (and ignore -bserver and -mdserver)")
+	flags.Var(SizeFlag{&params.ServerRootQuota}, "server-root-quota", "max bytes each user may store in the block server under -server-root (0 for no limit)")
+	flags.IntVar(&params.ServerRootMDRetention.Revisions, "server-root-md-retention-revisions", 0, "number of latest revisions of each folder always kept by the MD server under -server-root (0 to not keep revisions by number)")
+	flags.DurationVar(&params.ServerRootMDRetention.Age, "server-root-md-retention-age", 0, "how long the MD server under -server-root keeps revisions before they can be pruned (0 to not keep revisions by age)")
+	flags.StringVar(&params.ServerRootQuotaPools, "server-root-quota-pools", "", "JSON file listing pools of folders (e.g., a team's) that share one quota in the block server under -server-root")
+	flags.StringVar(&params.ServerRootShards, "server-root-shards", "", "comma-separated directories, on different disks, across which the block server under -server-root erasure-codes blocks (at least 3; any 2 can be lost)")
 	flags.StringVar(&params.LocalUser, "localuser", "", "fake local user (used only with -server-in-memory or -server-root)")
+	flags.StringVar(&params.Keyring, "keyring", "", "JSON file listing the users and device keys to use instead of the Keybase service")
+	flags.StringVar(&params.KeyringSecrets, "keyring-secrets", "", "JSON file holding this device's secret keys, for -keyring")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid", tlfValidDurationDefault, "time tlfs are valid before redoing identification")
+	flags.BoolVar(&params.ReadOnlyReplica, "read-only-replica", false, "serve reads only, optimized for many readers across many folders")
+	flags.StringVar(&params.PaperKeyUser, "paper-key-user", "", "read this user's folders using only a paper key, with all writes disabled")
+	flags.StringVar(&params.PaperKeyFile, "paper-key-file", "", "file holding the paper key phrase for -paper-key-user")
+	flags.StringVar(&params.WriteBackJournalDir, "write-back-journal", "", "if non-empty, the directory in which to journal writes, so that fsync returns before they're uploaded, and to hand the block cache over to the next process")
+	flags.Uint64Var(&params.WriteBackJournalLimits.PerFolderBytes, "write-back-journal-folder-limit", 0, "number of bytes of disk the write-back journal of each folder may use before syncs write through to the servers (0 for no limit)")
+	flags.Uint64Var(&params.WriteBackJournalLimits.TotalBytes, "write-back-journal-total-limit", 0, "number of bytes of disk all the write-back journals together may use before syncs write through to the servers (0 for no limit)")
+	flags.IntVar(&params.BlockGetsPerFolder, "block-gets-per-folder", maxParallelBlockGets, "max number of block fetches each folder has in flight, separate from its uploads (0 for no limit)")
+	flags.IntVar(&params.BlockPutWorkers, "block-put-workers", maxParallelBlockPuts, "number of blocks each folder uploads in parallel while syncing")
+	flags.IntVar(&params.BlockPutsPerHost, "block-puts-per-host", blockPutsPerHostDefault, "max number of block uploads in flight to the block server (0 for no limit)")
+	flags.BoolVar(&params.ContentDefinedChunking, "content-defined-chunking", false, "split file blocks at content-defined boundaries (needs newer clients to write the folder)")
+	flags.BoolVar(&params.MergeTextConflicts, "merge-text-conflicts", false, "try to merge conflicting writes to small text files line by line, instead of keeping both copies")
+	flags.Var(MergeDriverFlag{&params.MergeDrivers}, "merge-driver", "a command that merges conflicting versions of the files it's registered for, as name[:.ext,...]=command [args...], where %O, %A and %B are the ancestor, merged and unmerged files (may be repeated)")
+	flags.IntVar(&params.DeletionLimitEntries, "deletion-limit-entries", 0, "number of entries that may be deleted from a shared folder within a minute without confirmation (0 for no limit)")
+	flags.Uint64Var(&params.DeletionLimitBytes, "deletion-limit-bytes", 0, "number of bytes of file data that may be deleted from a shared folder within a minute without confirmation (0 for no limit)")
+	flags.DurationVar(&params.DeletionGracePeriod, "deletion-grace-period", 30*time.Second, "how long deletions past the limits are held, during which they can be canceled, when nothing is registered to confirm them")
+	flags.IntVar(&params.AnomalyDeletions, "anomaly-deletions", 0, "number of entries another writer may delete from a shared folder within five minutes before the folder is frozen on this device (0 for no limit)")
+	flags.IntVar(&params.AnomalyRewrites, "anomaly-rewrites", 0, "number of existing files another writer may rewrite in a shared folder within five minutes before the folder is frozen on this device (0 for no limit)")
+	flags.IntVar(&params.MDWritesPerMinute, "md-writes-per-minute", 0, "max number of updates this device makes to each shared folder per minute, after a short burst, so that it can't crowd out the other writers (0 for no limit)")
+	flags.IntVar(&params.RetryMaxAttempts, "retry-max-attempts", retryMaxAttemptsDefault, "max number of times to try a call to the servers that was throttled, including the first")
+	flags.DurationVar(&params.RetryMaxBackoff, "retry-max-backoff", retryMaxBackoffDefault, "max time to wait between retries of a call to the servers")
+	flags.StringVar(&params.BandwidthSchedule, "bandwidth-schedule", "", "comma-separated daily windows of upload and download caps in bytes per second, e.g. \"09:00-17:00 up=1m down=1m\"; traffic outside them isn't capped")
+	flags.StringVar(&params.FaultInjection, "fault-injection", "", "comma-separated latencies and failures to inject into calls to the servers, for soak testing, e.g. \"* latency=20ms jitter=10ms, MDServer.Put err=0.1 partial=0.05\"")
+	flags.BoolVar(&params.BlockCacheAdmission, "block-cache-admission", false, "keep blocks that are only read once from evicting frequently-used blocks from the block cache")
+	flags.BoolVar(&params.BlockCacheAutoSize, "block-cache-auto-size", true, "size the block cache to the system's memory, and shrink it when memory runs low")
+	flags.DurationVar(&params.MaxDirtyAge, "max-dirty-age", maxDirtyAgeDefault, "how old unsynced changes to a file can get before they're synced, even if little has been written (0 for no limit)")
+	flags.DurationVar(&params.WriteCoalesceWindow, "write-coalesce-window", 0, "how long small sequential writes to a file are held back so they can be applied together (0 to apply every write right away)")
+	flags.DurationVar(&params.IntegrityCheckPeriod, "integrity-check-period", 0, "how often to re-read and check a random sample of the blocks of fully-synced folders (0 to never check them)")
+	flags.BoolVar(&params.PerFileWriteFairness, "per-file-write-fairness", false, "when writes are blocked on syncing, let writes to different files take turns instead of going strictly in order")
+	flags.StringVar(&params.MetricsAddr, "metrics-addr", "", "host:port on which to serve metrics to Prometheus (empty to disable)")
+	flags.StringVar(&params.PeerCacheAddr, "peer-cache-addr", "", "host:port on which to serve recently used encrypted blocks to the -peer-cache-peers (empty to disable)")
+	flags.StringVar(&params.PeerCachePeers, "peer-cache-peers", "", "comma-separated host:ports of other KBFS clients to ask for blocks before the block server, with -peer-cache-addr")
+	flags.StringVar(&params.PeerCacheSecretFile, "peer-cache-secret-file", "", "file holding the secret shared with the -peer-cache-peers")
+	params.PeerCacheBytes = peerCacheBytesDefault
+	flags.Var(SizeFlag{&params.PeerCacheBytes}, "peer-cache-size", "max bytes of blocks to keep for the -peer-cache-peers")
+	flags.StringVar(&params.KVStoreBackend, "kv-store", KVStoreLeveldb.String(), "database for the key-value stores kept on disk, \"leveldb\" or \"bolt\"; stores kept with the other one are migrated")
+	flags.StringVar(&params.ResolveCacheDir, "resolve-cache", "", "directory in which to keep resolved user and team assertions across restarts (empty to keep them in memory)")
+	flags.DurationVar(&params.ResolveCacheTTL, "resolve-cache-ttl", 0, "how long to trust a resolved assertion before asking the service again; an assertion whose proof is revoked keeps resolving for up to this long (0 to not cache them)")
+	flags.StringVar(&params.ChangeFeedAddr, "change-feed-addr", "", "host:port on which to serve folder change notifications to local applications, e.g. 127.0.0.1:0 (empty to disable)")
 	flags.BoolVar(&params.LogToFile, "log-to-file", false, fmt.Sprintf("Log to default file: %s", defaultLogPath(ctx)))
 	flags.StringVar(&params.LogFileConfig.Path, "log-file", "", "Path to log file")
 	flags.DurationVar(&params.LogFileConfig.MaxAge, "log-file-max-age", 30*24*time.Hour, "Maximum age of a log file before rotation")
@@ -107,11 +335,17 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	return &params
 }
 
-func makeMDServer(config Config, serverInMemory bool, serverRootDir, mdserverAddr string, ctx Context) (
+func makeMDServer(config Config, serverInMemory bool, serverRootDir string,
+	retention MDRetentionPolicy, mdserverAddr string, ctx Context) (
 	MDServer, error) {
 	if serverInMemory {
 		// local in-memory MD server
-		return NewMDServerMemory(config)
+		mdServer, err := NewMDServerMemory(config)
+		if err != nil {
+			return nil, err
+		}
+		mdServer.SetRetentionPolicy(retention)
+		return mdServer, nil
 	}
 
 	if len(serverRootDir) > 0 {
@@ -119,8 +353,15 @@ func makeMDServer(config Config, serverInMemory bool, serverRootDir, mdserverAdd
 		handlePath := filepath.Join(serverRootDir, "kbfs_handles")
 		mdPath := filepath.Join(serverRootDir, "kbfs_md")
 		branchPath := filepath.Join(serverRootDir, "kbfs_branches")
-		return NewMDServerLocal(
-			config, handlePath, mdPath, branchPath)
+		historyPath := filepath.Join(serverRootDir, "kbfs_md_history")
+		locksPath := filepath.Join(serverRootDir, "kbfs_locks")
+		mdServer, err := NewMDServerLocal(config, handlePath, mdPath,
+			branchPath, historyPath, locksPath)
+		if err != nil {
+			return nil, err
+		}
+		mdServer.SetRetentionPolicy(retention)
+		return mdServer, nil
 	}
 
 	if len(mdserverAddr) == 0 {
@@ -158,7 +399,22 @@ func makeKeyServer(config Config, serverInMemory bool, serverRootDir, keyserverA
 	return keyServer, nil
 }
 
-func makeBlockServer(config Config, serverInMemory bool, serverRootDir, bserverAddr string, ctx Context, log logger.Logger) (
+// serverRootBlockDir is where the on-disk block server keeps its
+// data under the server root.
+const serverRootBlockDir = "kbfs_block"
+
+// ScrubServerRootShards checks the shards of every block of the
+// erasure-coded on-disk block server under the given server root,
+// and, if rebuild is true, writes the damaged ones again (see
+// BlockServerDisk.Scrub).  No KBFS instance may be using the server
+// root at the same time.
+func ScrubServerRootShards(serverRootDir string, shardDirs []string,
+	rebuild bool) (ErasureScrubResult, error) {
+	return scrubBlockServerShards(
+		filepath.Join(serverRootDir, serverRootBlockDir), shardDirs, rebuild)
+}
+
+func makeBlockServer(config Config, serverInMemory bool, serverRootDir string, serverRootQuota int64, serverRootQuotaPools string, serverRootShards string, bserverAddr string, ctx Context, log logger.Logger) (
 	BlockServer, error) {
 	if serverInMemory {
 		// local in-memory block server
@@ -167,14 +423,47 @@ func makeBlockServer(config Config, serverInMemory bool, serverRootDir, bserverA
 
 	if len(serverRootDir) > 0 {
 		// local persistent block server
-		blockPath := filepath.Join(serverRootDir, "kbfs_block")
-		return NewBlockServerDir(config, blockPath), nil
+		blockPath := filepath.Join(serverRootDir, serverRootBlockDir)
+		var bserv *BlockServerDisk
+		if serverRootShards != "" {
+			var err error
+			bserv, err = NewBlockServerErasureCoded(config, blockPath,
+				strings.Split(serverRootShards, ","))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			bserv = NewBlockServerDir(config, blockPath)
+		}
+		if serverRootQuota > 0 {
+			bserv.SetQuotaLimit(serverRootQuota)
+		}
+		if serverRootQuotaPools != "" {
+			pools, err := ReadQuotaPools(serverRootQuotaPools)
+			if err != nil {
+				return nil, err
+			}
+			if err := bserv.SetQuotaPools(pools); err != nil {
+				return nil, err
+			}
+		}
+		return bserv, nil
 	}
 
 	if len(bserverAddr) == 0 {
 		return nil, errors.New("Empty block server address")
 	}
 
+	addrs := strings.Split(bserverAddr, ",")
+	if len(addrs) > 1 {
+		log.Debug("Using remote bservers %s", strings.Join(addrs, ", "))
+		bservs := make([]BlockServer, 0, len(addrs))
+		for _, addr := range addrs {
+			bservs = append(bservs, NewBlockServerRemote(config, addr, ctx))
+		}
+		return NewBlockServerFailover(config, bservs), nil
+	}
+
 	log.Debug("Using remote bserver %s", bserverAddr)
 	return NewBlockServerRemote(config, bserverAddr, ctx), nil
 }
@@ -281,14 +570,107 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 		os.Exit(1)
 	}()
 
+	var keyring Keyring
+	var keyringSecrets KeyringDeviceSecrets
+	if params.Keyring != "" {
+		if localUser != "" || params.PaperKeyUser != "" {
+			return nil, errors.New(
+				"a keyring can't be used with a local or paper key user")
+		}
+		var err error
+		keyring, err = ReadKeyring(params.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read keyring: %v", err)
+		}
+		keyringSecrets, err = ReadKeyringDeviceSecrets(params.KeyringSecrets)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read keyring secrets: %v", err)
+		}
+	}
+
+	var paperKey PaperKey
+	if params.PaperKeyUser != "" {
+		if params.ReadOnlyReplica {
+			return nil, errors.New(
+				"a paper key can't be used with a read-only replica")
+		}
+		phrase, err := ioutil.ReadFile(params.PaperKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read paper key: %v", err)
+		}
+		paperKey, err = MakePaperKey(strings.TrimSpace(string(phrase)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	config := NewConfigLocal()
+	if params.ReadOnlyReplica {
+		config.SetMode(InitReadOnlyReplica)
+	} else if params.PaperKeyUser != "" {
+		config.SetMode(InitPaperKeyRecovery)
+	}
+	config.SetBlockCacheAdmission(params.BlockCacheAdmission)
+	config.SetBlockCacheAutoSize(params.BlockCacheAutoSize)
+	config.SetPerFileWriteFairness(params.PerFileWriteFairness)
+	config.SetMaxDirtyAge(params.MaxDirtyAge)
+	config.SetWriteCoalesceWindow(params.WriteCoalesceWindow)
+	config.SetIntegrityCheckPeriod(params.IntegrityCheckPeriod)
+	if params.KVStoreBackend != "" {
+		backend, err := ParseKVStoreBackend(params.KVStoreBackend)
+		if err != nil {
+			return nil, err
+		}
+		config.SetKVStoreBackend(backend)
+	}
+	// Rebuild the caches for the mode and settings above.
+	config.ResetCaches()
 
-	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
-		config.Codec())
+	var bsplitter BlockSplitter
+	var err error
+	if params.ContentDefinedChunking {
+		bsplitter, err = NewBlockSplitterCDC(MaxBlockSizeBytesDefault,
+			8*1024, config.Codec())
+	} else {
+		bsplitter, err = NewBlockSplitterSimple(MaxBlockSizeBytesDefault,
+			8*1024, config.Codec())
+	}
 	if err != nil {
 		return nil, err
 	}
 	config.SetBlockSplitter(bsplitter)
+	config.SetContentDefinedChunking(params.ContentDefinedChunking)
+	var merger MergeStrategy
+	if params.MergeTextConflicts {
+		merger = TextMergeStrategy{}
+	}
+	if len(params.MergeDrivers) > 0 {
+		drivers := NewMergeDrivers(merger)
+		for _, spec := range params.MergeDrivers {
+			name, exts, driver, err := parseMergeDriver(spec)
+			if err != nil {
+				return nil, err
+			}
+			drivers.Register(name, driver, exts...)
+		}
+		merger = drivers
+	}
+	if merger != nil {
+		config.SetMergeStrategy(merger)
+	}
+	if params.DeletionLimitEntries > 0 || params.DeletionLimitBytes > 0 {
+		config.SetDeletionPolicy(NewDeletionGuard(DeletionLimits{
+			Entries:     params.DeletionLimitEntries,
+			Bytes:       params.DeletionLimitBytes,
+			GracePeriod: params.DeletionGracePeriod,
+		}, config.Clock()))
+	}
+	if params.AnomalyDeletions > 0 || params.AnomalyRewrites > 0 {
+		config.SetAnomalyDetector(NewActivityMonitor(ActivityLimits{
+			Deletions: params.AnomalyDeletions,
+			Rewrites:  params.AnomalyRewrites,
+		}, config.Clock()))
+	}
 
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
@@ -314,6 +696,48 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 	})
 
 	config.SetTLFValidDuration(params.TLFValidDuration)
+	config.SetWriteBackJournalDir(params.WriteBackJournalDir)
+	config.SetWriteBackJournalLimits(params.WriteBackJournalLimits)
+	if n, err := loadBlockCacheHandoff(config); err != nil {
+		log.Warning("Couldn't load the block cache handed over by the "+
+			"previous process: %v", err)
+	} else if n > 0 {
+		log.Debug("Loaded %d blocks handed over by the previous process", n)
+	}
+	config.SetBlockGetsPerFolder(params.BlockGetsPerFolder)
+	config.SetBlockPutWorkers(params.BlockPutWorkers)
+	config.SetBlockPutsPerHost(params.BlockPutsPerHost)
+	config.SetMDWritesPerMinute(params.MDWritesPerMinute)
+
+	retryPolicy := DefaultRetryPolicy()
+	if params.RetryMaxAttempts > 0 {
+		retryPolicy.MaxAttempts = params.RetryMaxAttempts
+	}
+	if params.RetryMaxBackoff > 0 {
+		retryPolicy.MaxBackoff = params.RetryMaxBackoff
+	}
+	config.SetRetryPolicy(retryPolicy)
+
+	bandwidthSchedule, err := ParseBandwidthSchedule(params.BandwidthSchedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth schedule: %v", err)
+	}
+	config.BandwidthScheduler().SetSchedule(bandwidthSchedule)
+
+	faultPolicy, err := ParseFaultPolicy(params.FaultInjection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault injection: %v", err)
+	}
+	config.SetFaultPolicy(faultPolicy)
+
+	if params.ResolveCacheTTL > 0 {
+		resolveCache, err := NewResolveCacheStandard(
+			config, params.ResolveCacheDir, params.ResolveCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open resolve cache: %v", err)
+		}
+		config.SetResolveCache(resolveCache)
+	}
 
 	kbfsOps := NewKBFSOpsStandard(config)
 	config.SetKBFSOps(kbfsOps)
@@ -322,7 +746,8 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 	config.SetMDOps(NewMDOpsStandard(config))
 
 	mdServer, err := makeMDServer(
-		config, params.ServerInMemory, params.ServerRootDir, params.MDServerAddr, ctx)
+		config, params.ServerInMemory, params.ServerRootDir,
+		params.ServerRootMDRetention, params.MDServerAddr, ctx)
 	if err != nil {
 		return nil, fmt.Errorf("problem creating MD server: %v", err)
 	}
@@ -341,7 +766,23 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 
 	config.SetKeyServer(keyServer)
 
-	daemon, err := makeKeybaseDaemon(config, params.ServerInMemory, params.ServerRootDir, localUser, config.Codec(), ctx, config.MakeLogger(""), params.Debug)
+	// Wrap the MD server only after the key server is made, since
+	// makeKeyServer needs the unwrapped MD server.
+	if !faultPolicy.IsEmpty() {
+		mdServer = NewMDServerFaulty(mdServer, config)
+	}
+	if registry := config.MetricsRegistry(); registry != nil {
+		mdServer = NewMDServerMeasured(mdServer, registry)
+	}
+	config.SetMDServer(NewMDServerTraced(mdServer, config))
+
+	var daemon KeybaseDaemon
+	if params.Keyring != "" {
+		daemon, err = NewKeybaseDaemonKeyring(keyring, keyringSecrets,
+			params.KeyringSecrets, config.Codec())
+	} else {
+		daemon, err = makeKeybaseDaemon(config, params.ServerInMemory, params.ServerRootDir, localUser, config.Codec(), ctx, config.MakeLogger(""), params.Debug)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("problem creating daemon: %s", err)
 	}
@@ -352,12 +793,29 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 
 	config.SetKeybaseDaemon(daemon)
 
-	k := NewKBPKIClient(config)
+	var k KBPKI = NewKBPKIClient(config)
+	if config.Mode() == InitReadOnlyReplica {
+		// Replicas serve many folders with overlapping users, so
+		// share identifies between them.
+		k = newIdentifyBatchingKBPKI(
+			k, config.Clock(), config.TLFValidDuration())
+	} else if config.Mode() == InitPaperKeyRecovery {
+		k = newPaperKeyKBPKI(k, config.Clock(),
+			libkb.NewNormalizedUsername(params.PaperKeyUser), paperKey)
+	}
 	config.SetKBPKI(k)
 
 	config.SetReporter(NewReporterKBPKI(config, 10, 1000))
 
-	if localUser == "" {
+	if config.Mode() == InitPaperKeyRecovery {
+		config.SetCrypto(NewCryptoPaperKey(config, paperKey))
+	} else if params.Keyring != "" {
+		signingKey, cryptPrivateKey, err := keyringSecrets.Keys()
+		if err != nil {
+			return nil, err
+		}
+		config.SetCrypto(NewCryptoLocal(config, signingKey, cryptPrivateKey))
+	} else if localUser == "" {
 		c := NewCryptoClient(config, ctx)
 		config.SetCrypto(c)
 	} else {
@@ -366,17 +824,53 @@ func Init(ctx Context, params InitParams, onInterruptFn func(), log logger.Logge
 		config.SetCrypto(NewCryptoLocal(config, signingKey, cryptPrivateKey))
 	}
 
-	bserv, err := makeBlockServer(config, params.ServerInMemory, params.ServerRootDir, params.BServerAddr, ctx, log)
+	bserv, err := makeBlockServer(config, params.ServerInMemory, params.ServerRootDir, params.ServerRootQuota, params.ServerRootQuotaPools, params.ServerRootShards, params.BServerAddr, ctx, log)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open block database: %v", err)
 	}
 
+	if params.PeerCacheAddr != "" {
+		secret, err := ioutil.ReadFile(params.PeerCacheSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read peer cache secret: %v", err)
+		}
+		var peers []string
+		if params.PeerCachePeers != "" {
+			peers = strings.Split(params.PeerCachePeers, ",")
+		}
+		bserv, err = NewBlockServerPeerCache(config, bserv,
+			params.PeerCacheAddr, peers, secret, params.PeerCacheBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot start peer cache: %v", err)
+		}
+	}
+
+	if !faultPolicy.IsEmpty() {
+		bserv = NewBlockServerFaulty(bserv, config)
+	}
 	if registry := config.MetricsRegistry(); registry != nil {
 		bserv = NewBlockServerMeasured(bserv, registry)
 	}
+	bserv = NewBlockServerTraced(bserv, config)
 
 	config.SetBlockServer(bserv)
 
+	if params.MetricsAddr != "" && config.MetricsRegistry() != nil {
+		exporter, err := NewPrometheusExporter(config, params.MetricsAddr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot export metrics: %v", err)
+		}
+		config.SetMetricsExporter(exporter)
+	}
+
+	if params.ChangeFeedAddr != "" {
+		feed, err := NewChangeFeedServer(config, params.ChangeFeedAddr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot serve change feed: %v", err)
+		}
+		config.SetChangeFeed(feed)
+	}
+
 	return config, nil
 }
 
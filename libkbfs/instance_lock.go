@@ -0,0 +1,329 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// InstanceLockFileName is the name of the file, within a KBFS state
+// directory, that records which process currently owns that
+// directory.
+const InstanceLockFileName = "kbfs.lock"
+
+const (
+	// How long to wait when checking whether the owner of an
+	// existing lock is still listening for takeover requests.
+	instanceLockDialTimeout = 5 * time.Second
+	// How often to check whether a lock we're taking over has been
+	// released.
+	instanceLockPollPeriod = 100 * time.Millisecond
+	// The string sent back to a requester once the old instance
+	// has finished shutting down.
+	instanceTakeoverAck = "ok"
+)
+
+// instanceLockInfo is the on-disk contents of an instance lock file.
+// It is only readable by the owning user, so the token acts as proof
+// that a takeover request comes from someone allowed to see the file.
+type instanceLockInfo struct {
+	PID   int
+	Addr  string
+	Token string
+}
+
+// instanceTakeoverRequest is sent, as a single line of JSON, by a
+// process that wants the current owner of a state directory to shut
+// down and hand the directory over.
+type instanceTakeoverRequest struct {
+	Token string
+	PID   int
+}
+
+// InstanceLock represents this process's ownership of a KBFS state
+// directory.  While it is held, other KBFS processes trying to use
+// the same directory will either fail with an InstanceInUseError, or
+// ask this process to shut down via a local socket (see
+// AcquireInstanceLock).
+type InstanceLock struct {
+	log        logger.Logger
+	path       string
+	token      string
+	listener   net.Listener
+	onTakeover func()
+
+	takeoverOnce sync.Once
+	releaseOnce  sync.Once
+	releasedCh   chan struct{}
+}
+
+// AcquireInstanceLock takes ownership of the given state directory
+// for this process.  If another live KBFS process already owns it,
+// and takeover is false, it returns an InstanceInUseError.  If
+// takeover is true, it instead asks the other process to shut down,
+// and waits (until ctx is done) for that process to flush its state
+// and release the directory.  Locks left behind by processes that
+// are no longer running are cleaned up automatically.
+//
+// onTakeover is called (in a separate goroutine) when another process
+// asks this one to hand over the directory; it should start an
+// orderly shutdown that ends with a call to Release, and the
+// requester will not proceed until Release is called or this process
+// exits.
+func AcquireInstanceLock(ctx context.Context, log logger.Logger,
+	dir string, takeover bool, onTakeover func()) (*InstanceLock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	token, err := MakeRandomRequestID()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	il := &InstanceLock{
+		log:        log,
+		path:       filepath.Join(dir, InstanceLockFileName),
+		token:      token,
+		listener:   listener,
+		onTakeover: onTakeover,
+		releasedCh: make(chan struct{}),
+	}
+
+	for {
+		created, err := il.tryCreate()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if created {
+			go il.serve()
+			return il, nil
+		}
+
+		err = il.handleExisting(ctx, takeover)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+}
+
+// tryCreate atomically creates the lock file, returning false if one
+// already exists.  The file is written under a temporary name first
+// and then linked into place, so that nobody can ever see a lock file
+// that's only partially written.
+func (il *InstanceLock) tryCreate() (bool, error) {
+	buf, err := json.Marshal(instanceLockInfo{
+		PID:   os.Getpid(),
+		Addr:  il.listener.Addr().String(),
+		Token: il.token,
+	})
+	if err != nil {
+		return false, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(il.path), InstanceLockFileName)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.Link(f.Name(), il.path)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readInstanceLockInfo returns the parsed contents of the lock file
+// at path, along with its raw contents.
+func readInstanceLockInfo(path string) (instanceLockInfo, []byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return instanceLockInfo{}, nil, err
+	}
+	var info instanceLockInfo
+	err = json.Unmarshal(buf, &info)
+	return info, buf, err
+}
+
+// handleExisting deals with a lock file owned by someone else.  It
+// returns nil once it's worth trying to create the lock again.
+func (il *InstanceLock) handleExisting(
+	ctx context.Context, takeover bool) error {
+	info, buf, err := readInstanceLockInfo(il.path)
+	if os.IsNotExist(err) {
+		// Released in the meantime.
+		return nil
+	} else if buf == nil {
+		return err
+	} else if err != nil {
+		// Lock files are never partially written, so this
+		// one is corrupt and can't belong to a live process.
+		il.log.CWarningf(ctx, "Removing unreadable instance lock %s: %v",
+			il.path, err)
+		return il.removeStale(buf)
+	}
+
+	conn, err := net.DialTimeout("tcp", info.Addr, instanceLockDialTimeout)
+	if err != nil {
+		il.log.CDebugf(ctx, "Removing stale instance lock %s from pid %d",
+			il.path, info.PID)
+		return il.removeStale(buf)
+	}
+	defer conn.Close()
+
+	if !takeover {
+		return InstanceInUseError{Path: il.path, PID: info.PID}
+	}
+
+	il.log.CDebugf(ctx, "Asking pid %d to hand over %s", info.PID, il.path)
+	err = runUnlessCanceled(ctx, func() error {
+		buf, err := json.Marshal(instanceTakeoverRequest{
+			Token: info.Token,
+			PID:   os.Getpid(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(buf, '\n')); err != nil {
+			return err
+		}
+		// The old instance acks once it has shut down; if it
+		// exits without acking, we'll just see EOF here, and
+		// the poll below will clean up after it.
+		ack, _ := bufio.NewReader(conn).ReadString('\n')
+		if ack != instanceTakeoverAck+"\n" {
+			il.log.CDebugf(ctx, "No takeover ack from pid %d", info.PID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return il.waitForRelease(ctx, info)
+}
+
+// waitForRelease waits until the lock described by info is gone, or
+// its owner has exited.
+func (il *InstanceLock) waitForRelease(
+	ctx context.Context, info instanceLockInfo) error {
+	ticker := time.NewTicker(instanceLockPollPeriod)
+	defer ticker.Stop()
+	for {
+		curr, buf, err := readInstanceLockInfo(il.path)
+		if os.IsNotExist(err) || (err == nil && curr.Token != info.Token) {
+			return nil
+		}
+		if err == nil {
+			conn, dialErr := net.DialTimeout(
+				"tcp", curr.Addr, instanceLockDialTimeout)
+			if dialErr != nil {
+				// The owner exited without cleaning up.
+				return il.removeStale(buf)
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// removeStale removes a lock file left behind by another process,
+// given the contents it had when it was found to be stale.  If the
+// file has changed since, it's a new lock, and it's left alone.
+func (il *InstanceLock) removeStale(stale []byte) error {
+	buf, err := ioutil.ReadFile(il.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, stale) {
+		return nil
+	}
+	err = os.Remove(il.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (il *InstanceLock) serve() {
+	for {
+		conn, err := il.listener.Accept()
+		if err != nil {
+			// Closed by Release.
+			return
+		}
+		go il.handleConn(conn)
+	}
+}
+
+func (il *InstanceLock) handleConn(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		// Most likely just a liveness check.
+		return
+	}
+	var req instanceTakeoverRequest
+	if err := json.Unmarshal([]byte(line), &req); err != nil ||
+		req.Token != il.token {
+		il.log.Warning("Ignoring invalid takeover request on %s", il.path)
+		return
+	}
+
+	il.log.Info("Pid %d is taking over %s; shutting down", req.PID, il.path)
+	if il.onTakeover != nil {
+		il.takeoverOnce.Do(func() { go il.onTakeover() })
+	}
+	<-il.releasedCh
+	conn.Write([]byte(instanceTakeoverAck + "\n"))
+}
+
+// Release gives up ownership of the state directory, letting any
+// process waiting to take it over proceed.  It should be called only
+// after all state in the directory has been flushed.  It is safe to
+// call Release more than once.
+func (il *InstanceLock) Release() {
+	il.releaseOnce.Do(func() {
+		il.listener.Close()
+		// Only remove the file if it's still ours.
+		if info, _, err := readInstanceLockInfo(il.path); err == nil &&
+			info.Token == il.token {
+			if err := os.Remove(il.path); err != nil {
+				il.log.Warning("Couldn't remove instance lock %s: %v",
+					il.path, err)
+			}
+		}
+		close(il.releasedCh)
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+func TestInstanceLockInUse(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "instance_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	ctx := context.Background()
+	log := logger.NewTestLogger(t)
+	lock1, err := AcquireInstanceLock(ctx, log, tempdir, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock1.Release()
+
+	_, err = AcquireInstanceLock(ctx, log, tempdir, false, nil)
+	if _, ok := err.(InstanceInUseError); !ok {
+		t.Fatalf("Expected InstanceInUseError, got %v", err)
+	}
+
+	// Once released, the directory can be taken again.
+	lock1.Release()
+	lock2, err := AcquireInstanceLock(ctx, log, tempdir, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock2.Release()
+}
+
+func TestInstanceLockTakeover(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "instance_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	ctx := context.Background()
+	log := logger.NewTestLogger(t)
+	var lock1 *InstanceLock
+	takenOver := make(chan struct{})
+	lock1, err = AcquireInstanceLock(ctx, log, tempdir, false, func() {
+		close(takenOver)
+		lock1.Release()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock2, err := AcquireInstanceLock(ctx, log, tempdir, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock2.Release()
+
+	select {
+	case <-takenOver:
+	default:
+		t.Fatal("Old instance was not asked to shut down")
+	}
+
+	info, _, err := readInstanceLockInfo(
+		filepath.Join(tempdir, InstanceLockFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != lock2.token {
+		t.Fatalf("Lock owned by the wrong instance: %v", info)
+	}
+}
+
+func TestInstanceLockStale(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "instance_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	// Nobody is listening on port 1, so this lock is stale.
+	err = ioutil.WriteFile(filepath.Join(tempdir, InstanceLockFileName),
+		[]byte(`{"PID":1,"Addr":"127.0.0.1:1","Token":"x"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := AcquireInstanceLock(context.Background(),
+		logger.NewTestLogger(t), tempdir, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Release()
+}
+
+func TestInstanceLockStaleReplaced(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "instance_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	ctx := context.Background()
+	log := logger.NewTestLogger(t)
+	lock, err := AcquireInstanceLock(ctx, log, tempdir, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	// Another process that saw an older, stale lock before this
+	// one was created mustn't remove this one.
+	err = lock.removeStale(
+		[]byte(`{"PID":1,"Addr":"127.0.0.1:1","Token":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _, err := readInstanceLockInfo(lock.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != lock.token {
+		t.Fatalf("Lock owned by the wrong instance: %v", info)
+	}
+}
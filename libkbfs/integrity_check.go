@@ -0,0 +1,74 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// integrityCheckBlocksPerFolder is how many blocks of each
+// fully-synced folder are checked on each pass of the background
+// integrity checker.
+const integrityCheckBlocksPerFolder = 16
+
+// IntegrityStatus summarizes what the background integrity checker
+// has found in fully-synced folders so far.
+type IntegrityStatus struct {
+	// LastCheck is when the last pass over the folders finished.
+	LastCheck time.Time
+	// BlocksChecked is how many blocks have been re-read from the
+	// block server and checked.
+	BlocksChecked uint64
+	// Anomalies is how many of those blocks failed a check.
+	Anomalies uint64
+	// LastAnomaly describes the most recent block that failed.
+	LastAnomaly string `json:",omitempty"`
+}
+
+// integrityTracker adds up the results of the background integrity
+// checks.
+type integrityTracker struct {
+	lock   sync.Mutex
+	status IntegrityStatus
+}
+
+// record adds the results of checking one folder.
+func (it *integrityTracker) record(now time.Time, checked int,
+	anomalies []IntegrityCheckError) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.status.LastCheck = now
+	it.status.BlocksChecked += uint64(checked)
+	it.status.Anomalies += uint64(len(anomalies))
+	if len(anomalies) > 0 {
+		it.status.LastAnomaly = anomalies[len(anomalies)-1].Error()
+	}
+}
+
+func (it *integrityTracker) getStatus() IntegrityStatus {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	return it.status
+}
+
+// pickIntegrityCheckPtrs returns up to n of the given block pointers,
+// picked at random.
+func pickIntegrityCheckPtrs(ptrs map[BlockPointer]bool,
+	n int) []BlockPointer {
+	all := make([]BlockPointer, 0, len(ptrs))
+	for ptr := range ptrs {
+		all = append(all, ptr)
+	}
+	if len(all) <= n {
+		return all
+	}
+	picked := make([]BlockPointer, n)
+	for i, j := range rand.Perm(len(all))[:n] {
+		picked[i] = all[j]
+	}
+	return picked
+}
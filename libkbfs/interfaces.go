@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"fmt"
+	"io"
 	"reflect"
 	"time"
 
@@ -94,6 +96,14 @@ type KBFSOps interface {
 	// GetFavorites returns the logged-in user's list of favorite
 	// top-level folders.  This is a remote-access operation.
 	GetFavorites(ctx context.Context) ([]Favorite, error)
+	// GetFavoritesWithMetadata returns the logged-in user's list
+	// of favorite top-level folders, along with what this device
+	// knows about each of them: when it was last accessed, how
+	// much space it takes up, its sync mode, and whether it has
+	// changes that haven't been seen yet.  Like GetFavorites, this
+	// is a remote-access operation, but it doesn't load or fetch
+	// the metadata of any folder.
+	GetFavoritesWithMetadata(ctx context.Context) ([]FavoriteInfo, error)
 	// RefreshCachedFavorites tells the instances to forget any cached
 	// favorites list and fetch a new list from the server.  The
 	// effects are asychronous; if there's an error refreshing the
@@ -149,6 +159,13 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CreateHardLink creates a new name, under the given node, for
+	// the given file, which must be in the same top-level folder, if
+	// the logged-in user has write permission to it.  The file keeps
+	// its contents until its last name is removed.  This is a
+	// remote-sync operation.
+	CreateHardLink(ctx context.Context, dir Node, name string,
+		target Node) error
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -156,7 +173,10 @@ type KBFSOps interface {
 	RemoveDir(ctx context.Context, dir Node, dirName string) error
 	// RemoveEntry removes the directory entry represented by the
 	// given node, if the logged-in user has write permission to the
-	// top-level folder.  This is a remote-sync operation.
+	// top-level folder.  If the folder has a trash retention set
+	// with SetFolderTrashRetention, the entry moves into the
+	// folder's trash instead, from which it can be restored with
+	// RestoreFromTrash.  This is a remote-sync operation.
 	RemoveEntry(ctx context.Context, dir Node, name string) error
 	// Rename performs an atomic rename operation with a given
 	// top-level folder if the logged-in user has write permission to
@@ -167,6 +187,18 @@ type KBFSOps interface {
 	// remote-sync operation.
 	Rename(ctx context.Context, oldParent Node, oldName string, newParent Node,
 		newName string) error
+	// MoveAcrossFolders is like Rename, but it also moves entries
+	// between different top-level folders, by copying the entry and
+	// everything under it into the new folder and then removing the
+	// original.  The copied files are re-encrypted with the new
+	// folder's keys and uploaded again, so moving between folders
+	// takes as long as writing the data anew.  If the copy can't
+	// be completed, it's removed and the original is left as it
+	// was.  If progress is non-nil, it is called with how much of
+	// the copy is done before it starts and after each chunk of
+	// file data and each file.
+	MoveAcrossFolders(ctx context.Context, oldParent Node, oldName string,
+		newParent Node, newName string, progress func(MoveProgress)) error
 	// Read fills in the given buffer with data from the file at the
 	// given node starting at the given offset, if the logged-in user
 	// has read permission to the top-level folder.  The read data
@@ -180,6 +212,29 @@ type KBFSOps interface {
 	// that means EOF has been reached. This is a remote-access
 	// operation.
 	Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error)
+	// ReadStream returns a stream of the data in the given file
+	// starting at the given offset, which hands over the data of
+	// each of the file's blocks as soon as that block has been
+	// fetched and decrypted, fetching a few blocks ahead of the
+	// reader.  Unlike a large Read, the caller can start using the
+	// data before all of it has arrived, which suits media players
+	// and HTTP gateways.  The stream reads the file as it is at the
+	// time each block is read, the same as a series of Reads would,
+	// and stops reading when ctx is canceled or the stream is
+	// closed.  This is a remote-access operation.
+	ReadStream(ctx context.Context, file Node, off int64) (
+		io.ReadCloser, error)
+	// SeekHoleOrData finds the start of the first hole in the given
+	// file at or after off, if hole is true, and otherwise the first
+	// byte of data at or after off, the same way lseek's SEEK_HOLE
+	// and SEEK_DATA do.  Holes are the ranges left by writing or
+	// truncating far past the end of a file, which take up no block
+	// storage, and the end of the file counts as one.  It returns a
+	// SeekPastEOFError if off is at or past the end of the file, or
+	// if there's no data after it.  This is a remote-access
+	// operation.
+	SeekHoleOrData(ctx context.Context, file Node, off int64, hole bool) (
+		int64, error)
 	// Write modifies the file at the given node, by writing the given
 	// buffer at the given offset within the file, if the logged-in
 	// user has write permission to the top-level folder.  It
@@ -190,6 +245,12 @@ type KBFSOps interface {
 	// the necessary blocks have been locally cached.  This is a
 	// remote-access operation.
 	Write(ctx context.Context, file Node, data []byte, off int64) error
+	// WriteNoCopy is like Write, except that it takes ownership of
+	// data: whenever the write replaces whole blocks of the file,
+	// those blocks are made of slices of data instead of copies of
+	// it, which saves memory when copying large files.  The caller
+	// must not modify or reuse data afterwards.
+	WriteNoCopy(ctx context.Context, file Node, data []byte, off int64) error
 	// Truncate modifies the file at the given node, by either
 	// shrinking or extending its size to match the given size, if the
 	// logged-in user has write permission to the top-level folder.
@@ -198,6 +259,14 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// PunchHole deallocates length bytes of the file at the given
+	// node, starting at off, if the logged-in user has write
+	// permission to the top-level folder.  The range then reads as
+	// zeroes, and the file's blocks entirely within it are removed,
+	// but the file's size doesn't change.  It returns an
+	// InvalidRangeError if off is negative or length isn't
+	// positive.  This is a remote-access operation.
+	PunchHole(ctx context.Context, file Node, off, length int64) error
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -208,6 +277,40 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// GetXattr returns the value of the named extended attribute of
+	// the given node, or a NoSuchXattrError if it has none by that
+	// name.
+	GetXattr(ctx context.Context, node Node, name string) ([]byte, error)
+	// ListXattr returns the names of all the extended attributes of
+	// the given node, in sorted order.
+	ListXattr(ctx context.Context, node Node) ([]string, error)
+	// SetXattr sets the named extended attribute of the given node,
+	// if the logged-in user has write permissions to the top-level
+	// folder.  mode says whether the attribute must or must not
+	// already exist.  This is a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte,
+		mode XattrSetMode) error
+	// RemoveXattr removes the named extended attribute of the given
+	// node, if the logged-in user has write permissions to the
+	// top-level folder.  This is a remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
+	// GetFileLock returns an advisory lock held by someone else, on
+	// any device, that conflicts with lock on the given file, and
+	// true, if there is one.  lock.Owner must be unique among the
+	// owners of locks on this device.
+	GetFileLock(ctx context.Context, file Node, lock FileLock) (
+		FileLock, bool, error)
+	// SetFileLock takes, changes or (for FileLockUnlock) releases
+	// an advisory lock on the given file, shared with all the
+	// devices that can read the top-level folder.  If someone else
+	// holds a conflicting lock, it returns FileLockConflictError,
+	// unless wait is true, in which case it waits until the lock
+	// can be taken or ctx is canceled.  The file is synced before
+	// a lock on it is released or downgraded, and the folder is
+	// brought up to date after one is taken, so that holders see
+	// each other's writes.
+	SetFileLock(ctx context.Context, file Node, lock FileLock,
+		wait bool) error
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
@@ -225,6 +328,140 @@ type KBFSOps interface {
 	// error.
 	Status(ctx context.Context) (
 		KBFSStatus, <-chan StatusUpdate, error)
+	// FolderUsage returns how much of the user's quota the given
+	// folder-branch uses, along with how many bytes are still
+	// waiting to be flushed to the servers.
+	FolderUsage(ctx context.Context, folderBranch FolderBranch) (
+		FolderUsage, error)
+	// SetFolderPinning overrides whether the blocks of the given
+	// folder-branch are pinned in the block cache.  By default
+	// (PinAuto), the most frequently-accessed folders are pinned
+	// automatically, up to a space budget.
+	SetFolderPinning(ctx context.Context, folderBranch FolderBranch,
+		pinning FolderPinning) error
+	// SetTlfSyncMode changes how much of the given folder-branch
+	// is kept on this device.  In the SyncFull mode, all of the
+	// folder's blocks are fetched in the background whenever it
+	// changes, and are kept pinned in the block cache, so the
+	// folder stays readable while offline.
+	SetTlfSyncMode(ctx context.Context, folderBranch FolderBranch,
+		mode TlfSyncMode) error
+	// SetBandwidthSchedule replaces the caps on the traffic to and
+	// from the servers, on this device and, via the user's synced
+	// settings, on all the user's other devices.
+	SetBandwidthSchedule(ctx context.Context,
+		schedule BandwidthSchedule) error
+	// UnfreezeFolder lets the given folder-branch, frozen with a
+	// FolderFrozenError after suspicious activity, be written to
+	// again, and applies the updates that were held back.
+	UnfreezeFolder(ctx context.Context, folderBranch FolderBranch) error
+	// ArchiveFolder permanently makes the given folder-branch
+	// read-only, for every device: it syncs any dirty files,
+	// reclaims the blocks that only older revisions reference, and
+	// then writes a last revision marked as archived, after which
+	// the MD server rejects any new revision and writes fail with
+	// FolderArchivedError.
+	ArchiveFolder(ctx context.Context, folderBranch FolderBranch) error
+	// SetFolderQuota limits how many bytes the given folder-branch
+	// may use, recording the limit in its MD so that it applies
+	// to every writer.  Syncs that would take the folder's usage
+	// over the limit fail with FolderQuotaExceededError.  A limit
+	// of 0 removes it.
+	SetFolderQuota(ctx context.Context, folderBranch FolderBranch,
+		limit uint64) error
+	// SetFolderTrashRetention sets how long entries removed from
+	// the given folder-branch stay in its trash before they're
+	// deleted for good, recording it in the folder's MD so that
+	// every writer trashes and purges entries the same way.  A
+	// retention of 0 turns the trash off, and empties it the next
+	// time it's purged.
+	SetFolderTrashRetention(ctx context.Context, folderBranch FolderBranch,
+		retention time.Duration) error
+	// ListTrash lists the files and symlinks in the trash of the
+	// given folder-branch, oldest removal first.
+	ListTrash(ctx context.Context, folderBranch FolderBranch) (
+		[]TrashEntry, error)
+	// RestoreFromTrash moves the entry at the given path in the
+	// trash of the given folder-branch, as in TrashEntry.TrashPath,
+	// back to where it was removed from, recreating any parent
+	// directories that are gone since.  It fails with
+	// NameExistsError if something else is there now.
+	RestoreFromTrash(ctx context.Context, folderBranch FolderBranch,
+		trashPath string) error
+	// EmptyTrash deletes everything in the trash of the given
+	// folder-branch for good, without waiting for the retention
+	// period to be up.
+	EmptyTrash(ctx context.Context, folderBranch FolderBranch) error
+	// ExportTLF writes an archive of the current revision of the
+	// given top-level folder to w: its signed MD and every block
+	// reachable from it, all still encrypted, so that the folder
+	// can be backed up to untrusted media.  Any dirty files are
+	// synced first.
+	ExportTLF(ctx context.Context, tlfID TlfID, w io.Writer) error
+	// ImportTLF restores an archive written by ExportTLF into the
+	// same top-level folder, which must be empty.  Only the
+	// folder's own keys can decrypt the archive; the restored
+	// blocks are re-encrypted with its latest keys.
+	ImportTLF(ctx context.Context, tlfID TlfID, r io.Reader) error
+	// UnsyncedChanges lists every file, in any loaded folder, with
+	// local changes that haven't been flushed to the servers yet,
+	// sorted by path.  An empty list means everything is uploaded.
+	UnsyncedChanges(ctx context.Context) ([]UnsyncedChange, error)
+	// GetUnsyncedChange returns the local changes to the given file
+	// that haven't been flushed to the servers yet, including those
+	// only in the write-back journal, or nil if it has none.
+	GetUnsyncedChange(ctx context.Context, file Node) (
+		*UnsyncedChange, error)
+	// FlushPath syncs all outstanding writes and truncates for the
+	// given file, or for every file under the given directory, right
+	// away, ahead of any background flushes of other files in the
+	// same folder.  It returns once they are all on the KBFS
+	// servers, so they're visible to other users.
+	FlushPath(ctx context.Context, node Node) error
+	// FlushAndWait syncs every file, in any loaded folder, that has
+	// local changes, and blocks until there are none left, so that
+	// nothing is lost when the process exits.  If progress is
+	// non-nil, it is called with how much remains to be flushed
+	// before the first sync, after each file finishes syncing, and
+	// once more when everything is flushed.  Files changed while
+	// this runs are flushed too.
+	FlushAndWait(ctx context.Context, progress func(FlushProgress)) error
+	// WaitForWriteBack blocks until every write that Sync has put
+	// in the write-back journal of the given folder-branch is on
+	// the KBFS servers, pushing them there right away rather than
+	// waiting for the background write-back.  Callers that need
+	// full durability in write-back mode (see
+	// Config.WriteBackJournalDir) should call it after Sync.  It
+	// returns immediately when write-back mode is off, since Sync
+	// already waits for the servers then.
+	WaitForWriteBack(ctx context.Context, folderBranch FolderBranch) error
+	// PreviewConflictResolution reports what automatic conflict
+	// resolution would do to the local unmerged changes of the
+	// given top-level folder, if it ran right now, without
+	// changing anything.  This lets users see which files will be
+	// renamed, duplicated or dropped before the merge happens.
+	PreviewConflictResolution(ctx context.Context, tlfID TlfID) (
+		ConflictResolutionPreview, error)
+	// CheckDeviceRevocation checks whether the current device has
+	// been revoked.  If so, all further writes, to any folder, fail
+	// immediately with a DeviceRevokedError, no more dirty data is
+	// flushed, and the user is notified.
+	CheckDeviceRevocation(ctx context.Context) error
+	// Logout tears down all per-user state: dirty data in every
+	// open folder is flushed, the folders are shut down, and the
+	// current user's metadata, key and block caches are set aside
+	// so that nothing decrypted for that user stays reachable.  Dirty
+	// data that can't be flushed is left in the write-back journal,
+	// to be replayed when the folder is next opened.  If there's no
+	// write-back journal to hold it, it returns an
+	// UnflushedLogoutError and tears nothing down, so the data
+	// isn't lost; a later Login by a different user drops it.
+	Logout(ctx context.Context) error
+	// Login readies KBFS for the newly logged-in user.  If that
+	// user is the one who most recently logged out, the caches set
+	// aside by Logout are restored so they don't start cold;
+	// otherwise the set-aside caches are discarded.
+	Login(ctx context.Context) error
 	// UnstageForTesting clears out this device's staged state, if
 	// any, and fast-forwards to the current head of this
 	// folder-branch. TODO: remove this once we have automatic
@@ -232,6 +469,16 @@ type KBFSOps interface {
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
 	// Rekey rekeys this folder.
 	Rekey(ctx context.Context, id TlfID) error
+	// RotateKeysAfterRevocation checks whether the given user has
+	// any newly revoked devices.  If so, it rotates the crypt keys
+	// of every loaded private folder the user is a member of, and
+	// that the current user can write to, so that the revoked
+	// devices can't read anything written from now on, even with
+	// keys they have cached.
+	RotateKeysAfterRevocation(ctx context.Context, uid keybase1.UID) error
+	// KeyRotations reports the latest key rotation of each folder
+	// started by RotateKeysAfterRevocation, sorted by folder.
+	KeyRotations(ctx context.Context) ([]KeyRotationStatus, error)
 	// SyncFromServerForTesting blocks until the local client has
 	// contacted the server and guaranteed that all known updates
 	// for the given top-level folder have been applied locally
@@ -247,12 +494,43 @@ type KBFSOps interface {
 	// outstanding writes from the local device.
 	GetUpdateHistory(ctx context.Context, folderBranch FolderBranch) (
 		history TLFUpdateHistory, err error)
+	// ExportMDChain returns the complete merged MD history of the
+	// given folder, with each revision's signed MD exactly as
+	// stored on the MD server, for auditors to check with
+	// VerifyMDChain.  Like GetUpdateHistory, this is expensive.
+	ExportMDChain(ctx context.Context, folderBranch FolderBranch) (
+		MDChain, error)
+	// VerifyTLFHistory checks that the merged history the MD server
+	// serves for the given folder is consistent with the folder's
+	// leaf in the given proof from the KBFS Merkle tree, and with
+	// this device's own head: neither may have been rolled back or
+	// forked away from.  If the server has equivocated, it returns
+	// an MDServerEquivocationError, after reporting it and
+	// publishing an EventMDServerEquivocated.  Otherwise it returns
+	// the server's merged head revision.
+	VerifyTLFHistory(ctx context.Context, folderBranch FolderBranch,
+		proof TLFMerkleProof) (MetadataRevision, error)
+	// GetFolderHead returns the current head of the given
+	// folder-branch, including a proof of its MD revision and root
+	// block that external tools can verify.  The returned channel
+	// is closed when the head changes.
+	GetFolderHead(ctx context.Context, folderBranch FolderBranch) (
+		FolderHead, <-chan StatusUpdate, error)
+	// MakeContentManifest lists the path, size and content hash of
+	// everything under the given directory, as of the current head
+	// revision of its folder, and signs the list with the current
+	// device's key.  Unsynced changes under the directory are synced
+	// first.  See VerifyContentManifest and CheckContentManifest.
+	MakeContentManifest(ctx context.Context, dir Node) (ContentManifest, error)
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
 	Shutdown() error
 	// PushConnectionStatusChange updates the status of a service for
 	// human readable connection status tracking.
 	PushConnectionStatusChange(service string, newStatus error)
+	// PushRetryStatusChange updates the status of the retried calls
+	// to a service.
+	PushRetryStatusChange(service string, status RetryStatus)
 }
 
 // KeybaseDaemon is an interface for communicating with the local
@@ -432,6 +710,13 @@ type KeyManager interface {
 	// If promptPaper is set, prompts for any unlocked paper keys.
 	// promptPaper shouldn't be set if md is for a public TLF.
 	Rekey(ctx context.Context, md *RootMetadata, promptPaper bool) (bool, *TLFCryptKey, error)
+
+	// GetTLFCryptKeyHistory returns the history of the given TLF's
+	// key generations: which devices have had access to each one,
+	// and when each rekey happened.  This lets users audit who
+	// could have read the TLF over time.
+	GetTLFCryptKeyHistory(ctx context.Context, tlfID TlfID) (
+		TLFCryptKeyHistory, error)
 }
 
 // Reporter exports events (asynchronously) to any number of sinks
@@ -447,6 +732,76 @@ type Reporter interface {
 	Shutdown()
 }
 
+// EventBus delivers typed events about what's happening inside
+// libkbfs (blocks fetched, MD updates applied, conflict resolution
+// running, files synced) to any number of subscribers.  Core code
+// publishes without knowing who, if anyone, is listening, so tests,
+// metrics and notification layers can hook in without changes to
+// the code that generates the events.
+//
+// Since delivery is asynchronous and may drop events, the bus is
+// only for consumers that can live with that.  Observers still get
+// their changes directly, because the kernel caches they invalidate
+// must be invalidated before the operation returns, and so does the
+// Reporter, because the user must see every error and notification.
+type EventBus interface {
+	// Publish sends the given event to all matching subscribers.
+	// It never blocks; subscribers that aren't keeping up miss
+	// the event.
+	Publish(e Event)
+	// Subscribe returns a new subscription that receives all
+	// events of the given kinds (or of all kinds, if none are
+	// given), buffering up to bufSize of them.
+	Subscribe(bufSize int, kinds ...EventKind) *EventSubscription
+}
+
+// SpanExporter receives finished tracing spans, e.g. to forward them
+// to a tracing system like Jaeger or an OpenTelemetry collector.
+type SpanExporter interface {
+	// ExportSpan is called once for each finished span, on the
+	// goroutine that finished it, so it shouldn't block for long.
+	ExportSpan(span TraceSpan)
+}
+
+// MetricsExporter serves the contents of the metrics registry to
+// outside monitoring systems.
+type MetricsExporter interface {
+	// Addr returns the network address the exporter is serving on.
+	Addr() string
+	// Shutdown stops the exporter.
+	Shutdown()
+}
+
+// ChangeFeed serves path-level change notifications for top-level
+// folders to applications outside of KBFS.
+type ChangeFeed interface {
+	// Addr returns the network address the feed is serving on.
+	Addr() string
+	// SubscribeURL returns the URL from which an application can
+	// stream the changes to the given folders.  The URL includes
+	// a secret, so it should only be handed to the user's own
+	// applications.
+	SubscribeURL(tlfIDs ...TlfID) string
+	// Shutdown stops the feed.
+	Shutdown()
+}
+
+// ResolveCache remembers what assertions resolved to, so that
+// resolving the same handles again doesn't need the service.
+type ResolveCache interface {
+	// Get returns the user the given assertion last resolved to,
+	// if that's still fresh enough to trust.
+	Get(assertion string) (libkb.NormalizedUsername, keybase1.UID, bool)
+	// Put records that the given assertion resolved to the given
+	// user.
+	Put(assertion string, name libkb.NormalizedUsername, uid keybase1.UID)
+	// InvalidateUser forgets every assertion that resolved to the
+	// given user, e.g. because their proofs or memberships changed.
+	InvalidateUser(uid keybase1.UID)
+	// Shutdown closes the cache.
+	Shutdown()
+}
+
 // MDCache gets and puts plaintext top-level metadata into the cache.
 type MDCache interface {
 	// Get gets the metadata object associated with the given TlfID,
@@ -474,6 +829,11 @@ const (
 	// PermanentEntry means that the cache entry must remain until
 	// explicitly removed from the cache.
 	PermanentEntry
+	// TransientLocalEntry is a TransientEntry for a block that
+	// this device just wrote.  It's always let into the cache,
+	// even if admission control would have kept it out, since
+	// it's likely to be read again soon.
+	TransientLocalEntry
 )
 
 // BlockCache gets and puts plaintext dir blocks and file blocks into
@@ -490,16 +850,16 @@ type BlockCache interface {
 	// a nil error.
 	CheckForKnownPtr(tlf TlfID, block *FileBlock) (BlockPointer, error)
 	// Put stores the final (content-addressable) block associated
-	// with the given block ID. If lifetime is TransientEntry,
-	// then it is assumed that the block exists on the server and
-	// the entry may be evicted from the cache at any time. If
-	// lifetime is PermanentEntry, then it is assumed that the
-	// block doesn't exist on the server and must remain in the
-	// cache until explicitly removed. As an intermediary state,
-	// as when a block is being sent to the server, the block may
-	// be put into the cache both with TransientEntry and
-	// PermanentEntry -- these are two separate entries. This is
-	// fine, since the block should be the same.
+	// with the given block ID. If lifetime is TransientEntry or
+	// TransientLocalEntry, then it is assumed that the block
+	// exists on the server and the entry may be evicted from the
+	// cache at any time. If lifetime is PermanentEntry, then it
+	// is assumed that the block doesn't exist on the server and
+	// must remain in the cache until explicitly removed. As an
+	// intermediary state, as when a block is being sent to the
+	// server, the block may be put into the cache both with
+	// TransientEntry and PermanentEntry -- these are two separate
+	// entries. This is fine, since the block should be the same.
 	Put(ptr BlockPointer, tlf TlfID, block Block,
 		lifetime BlockCacheLifetime) error
 	// DeleteTransient removes the transient entry for the given
@@ -513,6 +873,27 @@ type BlockCache interface {
 	// DeleteKnownPtr removes the cached ID for the given file
 	// block. It does not remove the block itself.
 	DeleteKnownPtr(tlf TlfID, block *FileBlock) error
+	// SetPinnedTlfs replaces the set of TLFs whose transient
+	// entries are pinned.  Those entries are kept apart from all
+	// other transient entries, using at most pinnedBytesCapacity
+	// bytes, so they are never evicted to make room for blocks
+	// from other TLFs.  Those bytes come out of the cache's total
+	// bytes capacity, and are capped at half of it.
+	SetPinnedTlfs(tlfs map[TlfID]bool, pinnedBytesCapacity uint64)
+	// SetCacheLimits changes how many transient entries the cache
+	// may hold, and how many bytes it may hold in all, evicting
+	// transient entries right away if it's now over either limit.
+	SetCacheLimits(transientCapacity int, cleanBytesCapacity uint64)
+	// PinBlock protects the transient entry for the given block,
+	// of the given TLF, from eviction, whether it's cached yet or
+	// not, until UnpinBlock has been called for it as many times as
+	// PinBlock.  Pinned entries don't count against the cache's
+	// limits, so callers such as prefetchers and open files should
+	// only pin the blocks they're about to need.
+	PinBlock(ptr BlockPointer, tlf TlfID)
+	// UnpinBlock undoes one call to PinBlock for the given block.
+	// Once it's no longer pinned, its entry can be evicted again.
+	UnpinBlock(ptr BlockPointer)
 }
 
 // DirtyPermChan is a channel that gets closed when the holder has
@@ -549,11 +930,13 @@ type DirtyBlockCache interface {
 	// practice we can just use the number of bytes sent in via the
 	// Write. It returns a channel that blocks until the cache is
 	// ready to receive more dirty data, at which point the channel is
-	// closed.  The user must call
-	// `UpdateUnsyncedBytes(-estimatedDirtyBytes)` once it has
-	// completed its write and called `UpdateUnsyncedBytes` for all
-	// the exact dirty block sizes.
-	RequestPermissionToDirty(ctx context.Context,
+	// closed.  Requests are granted in the order they were made,
+	// though the cache may let requests from different writers
+	// (identified by the ID of the file's node) take turns.  The
+	// user must call `UpdateUnsyncedBytes(-estimatedDirtyBytes)` once
+	// it has completed its write and called `UpdateUnsyncedBytes` for
+	// all the exact dirty block sizes.
+	RequestPermissionToDirty(ctx context.Context, writer NodeID,
 		estimatedDirtyBytes int64) (DirtyPermChan, error)
 	// UpdateUnsyncedBytes is called by a user, who has already been
 	// granted permission to write, with the delta in block sizes that
@@ -911,12 +1294,27 @@ type MDServer interface {
 	RegisterForUpdate(ctx context.Context, id TlfID,
 		currHead MetadataRevision) (<-chan error, error)
 
+	// CancelRegistration lets the local MD server know that the
+	// caller is no longer interested in updates for the given
+	// folder, so that it may register for them again later.  It
+	// doesn't close the chan returned by RegisterForUpdate.
+	CancelRegistration(ctx context.Context, id TlfID)
+
 	// CheckForRekeys initiates the rekey checking process on the
 	// server.  The server is allowed to delay this request, and so it
 	// returns a channel for returning the error. Actual rekey
 	// requests are expected to come in asynchronously.
 	CheckForRekeys(ctx context.Context) <-chan error
 
+	// GetRekeyHints returns the IDs of the folders that the server
+	// has flagged as needing a rekey that the current user can do,
+	// e.g. because another member of the folder has a new device
+	// without the folder's keys.  Unlike CheckForRekeys, which only
+	// finds folders the current device can't read, this lets a
+	// client rekey folders on behalf of other members without
+	// checking each of its folders itself.
+	GetRekeyHints(ctx context.Context) ([]TlfID, error)
+
 	// TruncateLock attempts to take the history truncation lock for
 	// this folder, for a TTL defined by the server.  Returns true if
 	// the lock was successfully taken.
@@ -926,6 +1324,29 @@ type MDServer interface {
 	// released.
 	TruncateUnlock(ctx context.Context, id TlfID) (bool, error)
 
+	// SetCheckpoint tells the server that the folder's clients no
+	// longer need the merged revisions before rev, e.g. because
+	// quota reclamation has already gone through them, so the
+	// server may prune them, subject to its retention policy.
+	// Checkpoints only ever move forward.
+	SetCheckpoint(ctx context.Context, id TlfID, rev MetadataRevision) error
+	// GetHistoryStatus returns the folder's checkpoint, and how much
+	// of its merged history the server has pruned.
+	GetHistoryStatus(ctx context.Context, id TlfID) (MDHistoryStatus, error)
+
+	// GetFileLock returns a lock held by another owner on the given
+	// file of this folder that conflicts with lock, and true, if
+	// there is one.  file identifies the file within the folder.
+	GetFileLock(ctx context.Context, id TlfID, file string,
+		lock FileLock) (FileLock, bool, error)
+	// SetFileLock takes, changes or (for FileLockUnlock) releases
+	// an advisory lock on the given file of this folder, on behalf
+	// of the current device.  Returns false, and changes nothing,
+	// if another owner holds a conflicting lock.  The server
+	// releases a device's locks when its session ends.
+	SetFileLock(ctx context.Context, id TlfID, file string,
+		lock FileLock) (bool, error)
+
 	// DisableRekeyUpdatesForTesting disables processing rekey updates
 	// received from the mdserver while testing.
 	DisableRekeyUpdatesForTesting()
@@ -942,6 +1363,10 @@ type MDServer interface {
 	// should verify the mapping with a Merkle tree lookup.
 	GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 		BareTlfHandle, error)
+
+	// Capabilities returns the optional features that the server
+	// supports.
+	Capabilities(ctx context.Context) (MDServerCapabilities, error)
 }
 
 // BlockServer gets and puts opaque data blocks.  The instantiation
@@ -958,6 +1383,12 @@ type BlockServer interface {
 	// block.
 	Get(ctx context.Context, id BlockID, tlfID TlfID, context BlockContext) (
 		[]byte, BlockCryptKeyServerHalf, error)
+	// GetKey gets just the server half of the key of the given
+	// block, under the same permission checks as Get, for callers
+	// that already have the block's (encrypted) data from
+	// elsewhere.
+	GetKey(ctx context.Context, id BlockID, tlfID TlfID,
+		context BlockContext) (BlockCryptKeyServerHalf, error)
 	// Put stores the (encrypted) block data under the given ID and
 	// context on the server, along with the server half of the block
 	// key.  context should contain a BlockRefNonce of zero.  There
@@ -1010,6 +1441,21 @@ type BlockServer interface {
 
 	// GetUserQuotaInfo returns the quota for the user.
 	GetUserQuotaInfo(ctx context.Context) (info *UserQuotaInfo, err error)
+
+	// GetTLFQuotaInfo returns the quota usage charged to the user
+	// for the given TLF.
+	GetTLFQuotaInfo(ctx context.Context, tlfID TlfID) (
+		info *UsageStat, err error)
+
+	// GetQuotaPoolInfo returns the quota usage of the pool the
+	// given TLF belongs to, or nil if the TLF's blocks are charged
+	// to the personal quotas of their uploaders.
+	GetQuotaPoolInfo(ctx context.Context, tlfID TlfID) (
+		info *QuotaPoolInfo, err error)
+
+	// Capabilities returns the optional features that the server
+	// supports.
+	Capabilities(ctx context.Context) (BlockServerCapabilities, error)
 }
 
 type blockRefLocalStatus int
@@ -1050,6 +1496,35 @@ type BlockSplitter interface {
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
 }
 
+// blockSplitterNoCopy is implemented by BlockSplitters that can say
+// how much of some data should make up a block, without copying it
+// into the block.  It lets large writes that replace whole blocks
+// hand the caller's buffers straight to the dirty block cache.
+type blockSplitterNoCopy interface {
+	// SplitNoCopy returns how many bytes from the start of data
+	// should make up a block whose old contents, currLen bytes
+	// long, are all being overwritten from the start, i.e. how
+	// many bytes CopyUntilSplit would copy into such a block.  It
+	// returns 0 if the block wouldn't be entirely replaced.
+	SplitNoCopy(currLen int64, data []byte) int64
+}
+
+// blockSplitterServerLimited is implemented by BlockSplitters that
+// can shrink their blocks to fit the largest block a block server
+// accepts.  Once a splitter shrinks, CheckSplit splits dirty blocks
+// that were written before then.
+type blockSplitterServerLimited interface {
+	// maxContentsSize returns the largest number of bytes the
+	// contents of a file block can have.
+	maxContentsSize() int64
+	// withServerMaxBlockSize returns a splitter whose blocks fit
+	// within serverMax bytes once encrypted, or this splitter
+	// itself if they already do.  A serverMax of 0 means there's
+	// no limit.
+	withServerMaxBlockSize(serverMax int64, codec Codec) (
+		BlockSplitter, error)
+}
+
 // KeyServer fetches/writes server-side key halves from/to the key server.
 type KeyServer interface {
 	// GetTLFCryptKeyServerHalf gets a server-side key half for a
@@ -1115,6 +1590,14 @@ type Notifier interface {
 	// longer wants to subscribe to updates for the given top-level
 	// folders.
 	UnregisterFromChanges(folderBranches []FolderBranch, obs Observer) error
+	// WatchChanges subscribes to the changes made to the master
+	// branches of the given top-level folders, as batches of
+	// path-level events, for applications outside of KBFS.  Only
+	// folders that have been accessed on this device get updates,
+	// and writes are only reported for files that have been looked
+	// up on it.
+	// The caller must close the subscription when done with it.
+	WatchChanges(tlfIDs []TlfID) (*ChangeSubscription, error)
 }
 
 // Clock is an interface for getting the current time
@@ -1129,6 +1612,97 @@ type ConflictRenamer interface {
 	ConflictRename(op op, original string) string
 }
 
+// BlockTransportEncoding transforms the (already encrypted) contents
+// of a block on their way to or from a block server.  Encodings are
+// negotiated by name with each server, so that new ones can be
+// introduced without breaking servers or clients that don't know
+// about them.
+type BlockTransportEncoding interface {
+	// Name identifies the encoding to the server.  It must be
+	// unique, and must never change meaning.
+	Name() string
+	// Encode returns the encoded form of buf.
+	Encode(buf []byte) ([]byte, error)
+	// Decode returns the original form of encoded buf.
+	Decode(buf []byte) ([]byte, error)
+}
+
+// MergeStrategy merges the contents of a file that was written on
+// both the merged and unmerged branches of a folder, so conflict
+// resolution doesn't have to keep the unmerged version as a separate
+// conflicted copy.
+type MergeStrategy interface {
+	// Merge combines the merged and unmerged versions of the file
+	// with the given name and merged extended attributes, given
+	// their common ancestor base.  ok is false if the versions can't
+	// be merged cleanly, in which case both copies are kept.
+	Merge(ctx context.Context, name string, xattrs map[string][]byte,
+		base, merged, unmerged []byte) (result []byte, ok bool, err error)
+}
+
+// DeletionPolicy is consulted before each deletion from a shared
+// folder, so that large deletions can be confirmed before they
+// happen.
+type DeletionPolicy interface {
+	// CheckDeletion is called before the given number of entries,
+	// holding the given number of bytes of file data, are deleted
+	// from the given folder.  It returns nil if the deletion may go
+	// ahead, and may block until it's confirmed.
+	CheckDeletion(ctx context.Context, tlf TlfID, name CanonicalTlfName,
+		entries int, bytes uint64) error
+}
+
+// AnomalyDetector looks at the updates other devices make to shared
+// folders, for signs of a writer's machine having been compromised,
+// e.g. by ransomware.
+type AnomalyDetector interface {
+	// CheckUpdate is called before the given update is applied to
+	// the given folder.  It returns a non-nil anomaly if the update
+	// is part of a burst of suspicious activity.
+	CheckUpdate(ctx context.Context, tlf TlfID,
+		md *RootMetadata) *ActivityAnomaly
+	// ResetFolder forgets all the activity seen so far in the given
+	// folder, e.g. once the user has reviewed an anomaly.
+	ResetFolder(tlf TlfID)
+}
+
+// InitMode indicates how KBFS should configure itself at runtime.
+type InitMode int
+
+const (
+	// InitDefault is the normal mode for when KBFS data will be read
+	// and written.
+	InitDefault InitMode = iota
+	// InitReadOnlyReplica is for processes that only serve reads of
+	// many folders (e.g., web gateways or CI fetchers).  All writes
+	// are disabled, caches are sized more generously, and per-folder
+	// background work is kept to a minimum.
+	InitReadOnlyReplica
+	// InitPaperKeyRecovery is for users who have lost all their
+	// devices, but still have a paper key.  The paper key stands in
+	// for a device, so the user's private folders can be read, but
+	// all writes are disabled.
+	InitPaperKeyRecovery
+)
+
+func (m InitMode) String() string {
+	switch m {
+	case InitDefault:
+		return "default"
+	case InitReadOnlyReplica:
+		return "readOnlyReplica"
+	case InitPaperKeyRecovery:
+		return "paperKeyRecovery"
+	default:
+		return fmt.Sprintf("InitMode(%d)", int(m))
+	}
+}
+
+// IsReadOnly returns true if KBFS never writes anything in this mode.
+func (m InitMode) IsReadOnly() bool {
+	return m == InitReadOnlyReplica || m == InitPaperKeyRecovery
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
@@ -1141,6 +1715,8 @@ type Config interface {
 	SetKeyManager(KeyManager)
 	Reporter() Reporter
 	SetReporter(Reporter)
+	EventBus() EventBus
+	SetEventBus(EventBus)
 	MDCache() MDCache
 	SetMDCache(MDCache)
 	KeyCache() KeyCache
@@ -1175,6 +1751,23 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	// MergeStrategy may be nil, which means conflict resolution
+	// always keeps a conflicted copy of files written on both
+	// branches.  It's nil unless a merge is configured, so that
+	// no file is ever merged without the user asking for it.
+	MergeStrategy() MergeStrategy
+	// SetMergeStrategy sets MergeStrategy.
+	SetMergeStrategy(MergeStrategy)
+	// DeletionPolicy may be nil, which means deletions from shared
+	// folders never need confirmation.
+	DeletionPolicy() DeletionPolicy
+	// SetDeletionPolicy sets DeletionPolicy.
+	SetDeletionPolicy(DeletionPolicy)
+	// AnomalyDetector may be nil, which means updates to shared
+	// folders are never checked for suspicious activity.
+	AnomalyDetector() AnomalyDetector
+	// SetAnomalyDetector sets AnomalyDetector.
+	SetAnomalyDetector(AnomalyDetector)
 	MetadataVersion() MetadataVer
 	DataVersion() DataVer
 	RekeyQueue() RekeyQueue
@@ -1191,10 +1784,37 @@ type Config interface {
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
+	// MaxDirEntries indicates the maximum supported number of entries
+	// in a directory, or 0 if there's no limit.
+	MaxDirEntries() int
+	// MaxDirEntriesPerBlock indicates how many entries a directory
+	// block may hold before the directory is split across several
+	// blocks, or 0 if directories are never split.
+	MaxDirEntriesPerBlock() int
 	// DoBackgroundFlushes says whether we should periodically try to
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
+	// MaxDirtyAge is how old the oldest unsynced change to a file
+	// can get before the background flusher syncs the file ahead of
+	// the others, regardless of how full the dirty buffer is, or 0
+	// if changes can get arbitrarily old.
+	MaxDirtyAge() time.Duration
+	// SetMaxDirtyAge sets MaxDirtyAge.
+	SetMaxDirtyAge(time.Duration)
+	// WriteCoalesceWindow is how long small sequential writes to a
+	// file are held back, so they can be applied to the file's
+	// blocks together, or 0 if every write is applied right away.
+	WriteCoalesceWindow() time.Duration
+	// SetWriteCoalesceWindow sets WriteCoalesceWindow.
+	SetWriteCoalesceWindow(time.Duration)
+	// IntegrityCheckPeriod is how often a sample of the blocks of
+	// each fully-synced folder is re-read from the block server
+	// and checked, or 0 if they're never checked.  It only takes
+	// effect for KBFSOps made after it's set.
+	IntegrityCheckPeriod() time.Duration
+	// SetIntegrityCheckPeriod sets IntegrityCheckPeriod.
+	SetIntegrityCheckPeriod(time.Duration)
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -1218,10 +1838,155 @@ type Config interface {
 	// objects, which is to use the default registry.
 	MetricsRegistry() metrics.Registry
 	SetMetricsRegistry(metrics.Registry)
+	// MetricsExporter may be nil, which means the metrics aren't
+	// served to anyone outside the process.
+	MetricsExporter() MetricsExporter
+	// SetMetricsExporter sets MetricsExporter.  The exporter is
+	// shut down along with the Config.
+	SetMetricsExporter(MetricsExporter)
+	// SpanExporter may be nil, which means operations aren't
+	// traced at all.
+	SpanExporter() SpanExporter
+	// SetSpanExporter sets SpanExporter.
+	SetSpanExporter(SpanExporter)
+	// ChangeFeed may be nil, which means changes aren't served to
+	// applications outside the process.
+	ChangeFeed() ChangeFeed
+	// SetChangeFeed sets ChangeFeed.  The feed is shut down along
+	// with the Config.
+	SetChangeFeed(ChangeFeed)
+	// ResolveCache may be nil, which means every assertion is
+	// resolved by the service.
+	ResolveCache() ResolveCache
+	// SetResolveCache sets ResolveCache.  The cache is shut down
+	// along with the Config.
+	SetResolveCache(ResolveCache)
 	// TLFValidDuration is the time TLFs are valid before identification needs to be redone.
 	TLFValidDuration() time.Duration
 	// SetTLFValidDuration sets TLFValidDuration.
 	SetTLFValidDuration(time.Duration)
+	// Mode indicates how this KBFS instance is being used.
+	Mode() InitMode
+	// SetMode sets Mode.  Callers should call ResetCaches afterwards
+	// so that the caches are sized appropriately for the new mode.
+	SetMode(InitMode)
+	// WriteBackJournalDir is the directory holding the write-back
+	// journal.  If it's non-empty, Sync returns as soon as a file's
+	// writes are safely in the journal on local disk, and they are
+	// pushed to the servers in the background; see
+	// KBFSOps.WaitForWriteBack.  If it's empty, Sync returns only
+	// once the writes are on the servers.
+	WriteBackJournalDir() string
+	// SetWriteBackJournalDir sets WriteBackJournalDir.  It only
+	// affects folder-branches created afterwards.
+	SetWriteBackJournalDir(string)
+	// WriteBackJournalLimits caps how much local disk the
+	// write-back journals may use.  A Sync that would take a
+	// journal over either limit writes through to the servers
+	// instead, and the user is notified with a
+	// WriteBackJournalFullError.
+	WriteBackJournalLimits() WriteBackJournalLimits
+	// SetWriteBackJournalLimits sets WriteBackJournalLimits.
+	SetWriteBackJournalLimits(WriteBackJournalLimits)
+	// BlockGetsPerFolder is the maximum number of block fetches
+	// each folder-branch can have in flight at once.  It's
+	// separate from BlockPutWorkers, so that a large upload can't
+	// starve the folder's reads, nor a burst of reads its
+	// uploads.  Zero means no limit.
+	BlockGetsPerFolder() int
+	// SetBlockGetsPerFolder sets BlockGetsPerFolder.  It only
+	// affects folder-branches created afterwards.
+	SetBlockGetsPerFolder(int)
+	// BlockPutWorkers is the maximum number of blocks each
+	// folder-branch uploads in parallel while syncing.
+	BlockPutWorkers() int
+	// SetBlockPutWorkers sets BlockPutWorkers.  It only affects
+	// folder-branches created afterwards.
+	SetBlockPutWorkers(int)
+	// BlockPutsPerHost is the maximum number of block uploads that
+	// can be in flight to any single block server host, across all
+	// folders.  Zero means no limit.
+	BlockPutsPerHost() int
+	// SetBlockPutsPerHost sets BlockPutsPerHost.  It only affects
+	// block servers created afterwards.
+	SetBlockPutsPerHost(int)
+	// MDWritesPerMinute is the maximum rate at which each
+	// folder-branch writes new MD revisions to a shared folder,
+	// after a short burst, so that one busy device can't crowd
+	// out the folder's other writers.  Zero means no limit.
+	MDWritesPerMinute() int
+	// SetMDWritesPerMinute sets MDWritesPerMinute.  It only
+	// affects folder-branches created afterwards.
+	SetMDWritesPerMinute(int)
+	// BlockTransportEncodings lists the encodings this instance can
+	// use to transfer blocks to and from block servers, most
+	// preferred first.  The raw encoding is always supported, and
+	// doesn't need to be listed.
+	BlockTransportEncodings() []BlockTransportEncoding
+	// SetBlockTransportEncodings sets BlockTransportEncodings.
+	SetBlockTransportEncodings([]BlockTransportEncoding)
+	// RPCDeadlinePolicy gives the default deadlines for calls to
+	// remote servers whose contexts don't have their own.
+	RPCDeadlinePolicy() RPCDeadlinePolicy
+	// SetRPCDeadlinePolicy sets RPCDeadlinePolicy.
+	SetRPCDeadlinePolicy(RPCDeadlinePolicy)
+	// RetryPolicy says which failed calls to the remote servers
+	// are retried, and how often.
+	RetryPolicy() RetryPolicy
+	// SetRetryPolicy sets RetryPolicy.
+	SetRetryPolicy(RetryPolicy)
+	// FaultPolicy says which faults to inject into calls made
+	// through a BlockServerFaulty or MDServerFaulty.  It has no
+	// effect unless the servers are wrapped in them.
+	FaultPolicy() FaultPolicy
+	// SetFaultPolicy sets FaultPolicy.  It takes effect right
+	// away, even for calls already waiting to be made.
+	SetFaultPolicy(FaultPolicy)
+	// BandwidthScheduler paces the block and MD traffic to and from
+	// the remote servers.  It may be nil, which means no caps.
+	BandwidthScheduler() BandwidthScheduler
+	// SetBandwidthScheduler sets BandwidthScheduler.
+	SetBandwidthScheduler(BandwidthScheduler)
+	// ContentDefinedChunking indicates whether file blocks written
+	// by this instance are split using content-defined chunking.
+	// Folders written this way get marked so that they need
+	// FolderFeaturesMetadataVer.
+	ContentDefinedChunking() bool
+	// SetContentDefinedChunking sets ContentDefinedChunking.  The
+	// caller should also set a matching BlockSplitter, such as a
+	// BlockSplitterCDC.
+	SetContentDefinedChunking(bool)
+	// KVStoreBackend is the database used by the key-value stores
+	// kept on disk, like those of the local servers.
+	KVStoreBackend() KVStoreBackend
+	// SetKVStoreBackend sets KVStoreBackend.  Stores kept with the
+	// other backend are migrated as they're opened.
+	SetKVStoreBackend(KVStoreBackend)
+	// BlockCacheAdmission indicates whether the block cache uses
+	// admission control, so that blocks read only once can't evict
+	// frequently-used blocks.
+	BlockCacheAdmission() bool
+	// SetBlockCacheAdmission sets BlockCacheAdmission.  Callers
+	// should call ResetCaches afterwards so that the block cache
+	// picks it up.
+	SetBlockCacheAdmission(bool)
+	// BlockCacheAutoSize indicates whether the block cache's limits
+	// are sized to the system's memory, and shrunk whenever the
+	// system runs low on memory.
+	BlockCacheAutoSize() bool
+	// SetBlockCacheAutoSize sets BlockCacheAutoSize.  If the
+	// system's memory isn't known, the block cache keeps its fixed
+	// limits.
+	SetBlockCacheAutoSize(bool)
+	// PerFileWriteFairness indicates whether writes to different
+	// files take turns getting into the dirty block cache when it's
+	// full, instead of getting in strictly in the order they were
+	// made.
+	PerFileWriteFairness() bool
+	// SetPerFileWriteFairness sets PerFileWriteFairness.  Callers
+	// should call ResetCaches afterwards so that the dirty block
+	// cache picks it up.
+	SetPerFileWriteFairness(bool)
 	// Shutdown is called to free config resources.
 	Shutdown() error
 	// CheckStateOnShutdown tells the caller whether or not it is safe
@@ -1312,6 +2077,23 @@ type crAction interface {
 	String() string
 }
 
+// BandwidthScheduler caps the rate of the block and MD traffic to
+// and from the remote servers, following a BandwidthSchedule.
+type BandwidthScheduler interface {
+	// Schedule returns the schedule in effect.
+	Schedule() BandwidthSchedule
+	// SetSchedule replaces the schedule, starting with the next
+	// bytes sent or received.
+	SetSchedule(BandwidthSchedule)
+	// WaitToSend blocks until n more bytes may be sent to the
+	// servers under the current upload cap.
+	WaitToSend(ctx context.Context, n int) error
+	// WaitToReceive accounts for n bytes just received from the
+	// servers, and blocks until the download rate is back under the
+	// current cap.
+	WaitToReceive(ctx context.Context, n int) error
+}
+
 // RekeyQueue is a managed queue of folders needing some rekey action taken upon them
 // by the current client.
 type RekeyQueue interface {
@@ -1325,4 +2107,16 @@ type RekeyQueue interface {
 	Clear()
 	// Waits for all queued rekeys to finish
 	Wait(ctx context.Context) error
+	// Status reports which folders are waiting to be rekeyed, how
+	// many have been rekeyed so far, and any rekeys that failed.
+	Status() RekeyQueueStatus
+	// Prioritize moves the given folder to the front of the queue,
+	// so it's rekeyed as soon as the rekey in progress (if any)
+	// finishes.  It returns false if the folder isn't queued.
+	Prioritize(id TlfID) bool
+	// SetMinRekeyInterval sets the minimum time between the starts
+	// of two consecutive rekeys, to bound how much bandwidth and
+	// CPU rekeying a large set of folders can use.  Zero, the
+	// default, means rekeys run back to back.
+	SetMinRekeyInterval(interval time.Duration)
 }
@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"bytes"
+	"fmt"
 	"reflect"
 	"sync"
 	"testing"
@@ -640,6 +642,550 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 }
 
+// Tests that the indirect file blocks copied by conflict resolution
+// keep the data version of the file, rather than taking the newest
+// version the client supports, which older clients couldn't read.
+func TestCRFileConflictIndirectDataVersion(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	// make blocks small, so that the files are indirect
+	blockSize := int64(5)
+	config1.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
+	config2.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %v", err)
+	}
+
+	err = kbfsOps1.Write(ctx, fileB1, []byte("0123456789abcdef"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+	err = kbfsOps2.Write(ctx, fileB2, []byte("fedcba9876543210"), 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileB2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't restart CR: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	cre := WriterDeviceDateConflictRenamer{}
+	ops := getOps(config2, rootNode2.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	for _, child := range []string{
+		"b", cre.ConflictRenameHelper(now, "u2", "dev1", "b")} {
+		node, _, err := kbfsOps2.Lookup(ctx, rootNode2, child)
+		if err != nil {
+			t.Fatalf("Couldn't lookup %s: %v", child, err)
+		}
+		de, err := ops.blocks.GetDirtyEntry(ctx, lState, md,
+			ops.nodeCache.PathFromNode(node))
+		if err != nil {
+			t.Fatalf("Couldn't get the entry of %s: %v", child, err)
+		}
+		if de.DataVer != FirstValidDataVer {
+			t.Errorf("%s has data version %d, expected %d",
+				child, de.DataVer, FirstValidDataVer)
+		}
+	}
+}
+
+// Tests that conflict resolution of a directory that's split across
+// several blocks leaves consistent blocks behind.
+func TestCRSplitDir(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+	config1.(*ConfigLocal).maxDirEntriesPerBlock = 4
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.maxDirEntriesPerBlock = 4
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a big directory in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	const numEntries = 30
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps1.CreateFile(
+			ctx, dirNode1, fmt.Sprintf("f%02d", i), false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %v", err)
+	}
+
+	// Both users change entries all over the directory.
+	for i := 0; i < numEntries; i += 3 {
+		err := kbfsOps1.RemoveEntry(ctx, dirNode1, fmt.Sprintf("f%02d", i))
+		if err != nil {
+			t.Fatalf("Couldn't remove file: %v", err)
+		}
+		_, _, err = kbfsOps1.CreateFile(
+			ctx, dirNode1, fmt.Sprintf("g%02d", i), false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+	}
+	for i := 1; i < numEntries; i += 3 {
+		err := kbfsOps2.RemoveEntry(ctx, dirNode2, fmt.Sprintf("f%02d", i))
+		if err != nil {
+			t.Fatalf("Couldn't remove file: %v", err)
+		}
+		_, _, err = kbfsOps2.CreateFile(
+			ctx, dirNode2, fmt.Sprintf("h%02d", i), false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		file, _, err := kbfsOps2.Lookup(ctx, dirNode2, fmt.Sprintf("f%02d", i+1))
+		if err != nil {
+			t.Fatalf("Couldn't lookup file: %v", err)
+		}
+		err = kbfsOps2.SetEx(ctx, file, true)
+		if err != nil {
+			t.Fatalf("Couldn't set ex: %v", err)
+		}
+	}
+
+	// User 2 also makes a new big directory, which conflict
+	// resolution keeps as is.
+	newDirNode2, _, err := kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps2.CreateFile(
+			ctx, newDirNode2, fmt.Sprintf("f%02d", i), false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+	}
+	for i := 0; i < numEntries; i += 5 {
+		err := kbfsOps2.RemoveEntry(ctx, newDirNode2, fmt.Sprintf("f%02d", i))
+		if err != nil {
+			t.Fatalf("Couldn't remove file: %v", err)
+		}
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't restart CR: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// Make sure they both see the merged set of children
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirNode1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	for i := 0; i < numEntries; i++ {
+		f := fmt.Sprintf("f%02d", i)
+		_, ok := children1[f]
+		if removed := i%3 != 2; ok == removed {
+			t.Errorf("Wrong presence for %s: %t", f, ok)
+		}
+		var other string
+		switch i % 3 {
+		case 0:
+			other = fmt.Sprintf("g%02d", i)
+		case 1:
+			other = fmt.Sprintf("h%02d", i)
+		case 2:
+			if children1[f].Type != Exec {
+				t.Errorf("%s isn't executable", f)
+			}
+			continue
+		}
+		if _, ok := children1[other]; !ok {
+			t.Errorf("Couldn't find child %s", other)
+		}
+	}
+	if !reflect.DeepEqual(children1, children2) {
+		t.Fatalf("Users 1 and 2 see different children: %v vs %v",
+			children1, children2)
+	}
+
+	newDirNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+	children1, err = kbfsOps1.GetDirChildren(ctx, newDirNode1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if g, e := len(children1), numEntries-numEntries/5; g != e {
+		t.Errorf("Wrong number of children: %d vs %d", g, e)
+	}
+}
+
+// Tests that a preview of conflict resolution reports the conflicted
+// copy that the real resolution makes, without resolving anything.
+func TestCRPreviewFileConflict(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	fb := rootNode2.GetFolderBranch()
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// Nothing to resolve yet.
+	preview, err := kbfsOps2.PreviewConflictResolution(ctx, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't preview conflict resolution: %v", err)
+	}
+	if !reflect.DeepEqual(preview, ConflictResolutionPreview{}) {
+		t.Errorf("Unexpected preview without a conflict: %v", preview)
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 writes the file
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1, 2, 3, 4, 5}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// User 2 writes the same file, and becomes unmerged
+	err = kbfsOps2.Write(ctx, fileB2, []byte{5, 4, 3, 2, 1}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileB2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictName := cre.ConflictRenameHelper(now, "u2", "dev1", "b")
+	preview, err = kbfsOps2.PreviewConflictResolution(ctx, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't preview conflict resolution: %v", err)
+	}
+	expectedPreview := ConflictResolutionPreview{
+		Staged: true,
+		Duplicated: []CRPreviewEntry{{
+			Path:    name + "/a/b",
+			NewPath: name + "/a/" + conflictName,
+		}},
+	}
+	if !reflect.DeepEqual(preview, expectedPreview) {
+		t.Errorf("Unexpected preview: %v vs %v", preview, expectedPreview)
+	}
+
+	// The preview didn't resolve anything.
+	status, _, err := kbfsOps2.FolderStatus(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if !status.Staged {
+		t.Errorf("Folder is no longer staged after the preview")
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// The real resolution matches the preview.
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if _, ok := children2[conflictName]; !ok {
+		t.Errorf("Couldn't find child %s", conflictName)
+	}
+}
+
+// Tests that, with a merge strategy, CR merges the contents of text
+// files written on both branches instead of keeping conflicted
+// copies, unless the writes overlap.
+func TestCRMergeTextFileConflict(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+	config2.SetMergeStrategy(TextMergeStrategy{})
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates two text files in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	base := []byte("one\ntwo\nthree\n")
+	files1 := make(map[string]Node)
+	for _, fileName := range []string{"b", "c"} {
+		file, _, err := kbfsOps1.CreateFile(ctx, dirA1, fileName, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		err = kbfsOps1.Write(ctx, file, base, 0)
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		err = kbfsOps1.Sync(ctx, file)
+		if err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+		files1[fileName] = file
+	}
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	fb := rootNode2.GetFolderBranch()
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+	files2 := make(map[string]Node)
+	for _, fileName := range []string{"b", "c"} {
+		file, _, err := kbfsOps2.Lookup(ctx, dirA2, fileName)
+		if err != nil {
+			t.Fatalf("Couldn't lookup file: %v", err)
+		}
+		files2[fileName] = file
+	}
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+
+	// User 1 changes the first line of b, and the second of c.
+	writes1 := map[string][]byte{
+		"b": []byte("ONE\ntwo\nthree\n"),
+		"c": []byte("one\nTwo\nthree\n"),
+	}
+	for fileName, data := range writes1 {
+		err = kbfsOps1.Write(ctx, files1[fileName], data, 0)
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		err = kbfsOps1.Sync(ctx, files1[fileName])
+		if err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+
+	// User 2 changes the last line of b, and also the second of c,
+	// and becomes unmerged.
+	writes2 := map[string][]byte{
+		"b": []byte("one\ntwo\nTHREE\n"),
+		"c": []byte("one\ntWo\nthree\n"),
+	}
+	for fileName, data := range writes2 {
+		err = kbfsOps2.Write(ctx, files2[fileName], data, 0)
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		err = kbfsOps2.Sync(ctx, files2[fileName])
+		if err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	// b was merged, but c still has a conflicted copy.
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictName := cre.ConflictRenameHelper(now, "u2", "dev1", "c")
+	for _, config := range []Config{config1, config2} {
+		kbfsOps := config.KBFSOps()
+		rootNode := GetRootNodeOrBust(t, config, name, false)
+		dirA, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		if err != nil {
+			t.Fatalf("Couldn't lookup dir: %v", err)
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, dirA)
+		if err != nil {
+			t.Fatalf("Couldn't get children: %v", err)
+		}
+		if len(children) != 3 {
+			t.Errorf("Unexpected children: %v", children)
+		}
+		if _, ok := children[conflictName]; !ok {
+			t.Errorf("Couldn't find child %s", conflictName)
+		}
+
+		fileB, _, err := kbfsOps.Lookup(ctx, dirA, "b")
+		if err != nil {
+			t.Fatalf("Couldn't lookup file: %v", err)
+		}
+		expected := []byte("ONE\ntwo\nTHREE\n")
+		data := make([]byte, 2*len(expected))
+		n, err := kbfsOps.Read(ctx, fileB, data, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %v", err)
+		}
+		if !bytes.Equal(data[:n], expected) {
+			t.Errorf("Unexpected merged contents: %q", data[:n])
+		}
+	}
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
@@ -5,11 +5,16 @@
 package libkbfs
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
 
 	"golang.org/x/net/context"
 )
@@ -34,6 +39,57 @@ type KBFSOpsStandard struct {
 	favs *Favorites
 
 	currentStatus kbfsCurrentStatus
+
+	hotFolders         *hotFolderTracker
+	hotFoldersShutdown chan struct{}
+
+	settings         *settingsSyncer
+	settingsShutdown chan struct{}
+
+	keyInvalidator *keyInvalidator
+
+	// fullSyncLock protects fullySyncedRevs, the latest revision
+	// of each fully-synced folder whose blocks have all been
+	// fetched, and fullSyncing, the set of folders whose blocks
+	// are being fetched right now.
+	fullSyncLock    sync.Mutex
+	fullySyncedRevs map[TlfID]MetadataRevision
+	fullSyncing     map[TlfID]bool
+	// fullSyncs tracks the folders whose blocks are being fetched.
+	fullSyncs RepeatedWaitGroup
+
+	// integrity adds up the results of the background integrity
+	// checks of fully-synced folders, if they're enabled.
+	integrity         integrityTracker
+	integrityShutdown chan struct{}
+
+	trashShutdown chan struct{}
+
+	// writeBackUsage adds up the disk used by the write-back
+	// journals of all folders.
+	writeBackUsage *writeBackUsage
+
+	// writeFence, if non-nil, is the error all writes fail with
+	// (e.g., because this device was revoked).  Protected by
+	// opsLock.
+	writeFence error
+
+	// loggedOut, if non-nil, holds the caches of the user who most
+	// recently logged out.  Protected by opsLock.
+	loggedOut *loggedOutUserState
+	// unflushedUser, if set, is the user whose logout was refused
+	// because some of their dirty data couldn't be flushed, and
+	// whose state is still live.  Protected by opsLock.
+	unflushedUser keybase1.UID
+}
+
+// loggedOutUserState holds the per-user caches that Logout set
+// aside, so that a later Login by the same user can start warm.
+type loggedOutUserState struct {
+	uid     keybase1.UID
+	mdcache MDCache
+	kcache  KeyCache
+	bcache  BlockCache
 }
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
@@ -49,9 +105,26 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		opsByFav:              make(map[Favorite]*folderBranchOps),
 		reIdentifyControlChan: make(chan struct{}),
 		favs: NewFavorites(config),
+		hotFolders: newHotFolderTracker(
+			config, hotFolderPinBudgetDefault),
+		hotFoldersShutdown: make(chan struct{}),
+		settingsShutdown:   make(chan struct{}),
+		integrityShutdown:  make(chan struct{}),
+		trashShutdown:      make(chan struct{}),
+		fullySyncedRevs:    make(map[TlfID]MetadataRevision),
+		fullSyncing:        make(map[TlfID]bool),
+		keyInvalidator:     newKeyInvalidator(),
+		writeBackUsage:     &writeBackUsage{},
 	}
+	kops.settings = newSettingsSyncer(config, kops)
 	kops.currentStatus.Init()
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.rebalancePinnedFoldersLoop()
+	go kops.syncSettingsLoop()
+	if period := config.IntegrityCheckPeriod(); period > 0 {
+		go kops.checkIntegrityLoop(period)
+	}
+	go kops.purgeTrashLoop()
 	return kops
 }
 
@@ -89,10 +162,235 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(now time.Time, maxValid tim
 	}
 }
 
+func (fs *KBFSOpsStandard) rebalancePinnedFoldersLoop() {
+	ticker := time.NewTicker(hotFolderRebalancePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.rebalancePinnedFolders()
+		case <-fs.hotFoldersShutdown:
+			return
+		}
+	}
+}
+
+// rebalancePinnedFolders recomputes which folders are pinned, based
+// on their recent access patterns and current sizes, and passes the
+// result along to the block cache.  It also starts fetching the
+// blocks of any fully-synced folders that have changed.
+func (fs *KBFSOpsStandard) rebalancePinnedFolders() {
+	sizes := make(map[TlfID]uint64)
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		lState := makeFBOLockState()
+		for fb, ops := range fs.ops {
+			if fb.Branch != MasterBranch {
+				continue
+			}
+			if head := ops.getHead(lState); head != nil {
+				sizes[fb.Tlf] = head.DiskUsage
+			}
+		}
+	}()
+	pinned := fs.hotFolders.choosePinned(sizes)
+	// Fully-synced folders get room for all their blocks on top
+	// of the usual budget.
+	capacity := fs.hotFolders.budget
+	fullySynced := fs.hotFolders.fullySynced()
+	for tlf := range fullySynced {
+		capacity += sizes[tlf]
+	}
+	fs.config.BlockCache().SetPinnedTlfs(pinned, capacity)
+	fs.startFullSyncs(fullySynced)
+	fs.updateFavoritesMetadata()
+}
+
+// startFullSyncs starts fetching, in the background, all the blocks
+// of each of the given folders that's loaded and has changed since
+// its blocks were last fetched.
+func (fs *KBFSOpsStandard) startFullSyncs(tlfs map[TlfID]bool) {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	fs.fullSyncLock.Lock()
+	defer fs.fullSyncLock.Unlock()
+	lState := makeFBOLockState()
+	for tlf := range tlfs {
+		ops, ok := fs.ops[FolderBranch{tlf, MasterBranch}]
+		if !ok || fs.fullSyncing[tlf] {
+			continue
+		}
+		head := ops.getHead(lState)
+		if head == nil || head.Revision <= fs.fullySyncedRevs[tlf] {
+			continue
+		}
+		fs.fullSyncing[tlf] = true
+		fs.fullSyncs.Add(1)
+		go fs.fullySync(tlf, ops)
+	}
+}
+
+// fullySync fetches all the blocks of the given folder, and records
+// the revision they were fetched at.
+func (fs *KBFSOpsStandard) fullySync(tlf TlfID, ops *folderBranchOps) {
+	defer fs.fullSyncs.Done()
+	rev := MetadataRevisionUninitialized
+	err := ops.runUnlessShutdown(func(ctx context.Context) (err error) {
+		rev, err = ops.fetchAllBlocks(ctx)
+		return err
+	})
+	if err != nil {
+		fs.log.CDebugf(nil, "Couldn't fetch all the blocks of %s: %v",
+			tlf, err)
+	}
+
+	fs.fullSyncLock.Lock()
+	defer fs.fullSyncLock.Unlock()
+	delete(fs.fullSyncing, tlf)
+	if err == nil && rev > fs.fullySyncedRevs[tlf] {
+		fs.fullySyncedRevs[tlf] = rev
+	}
+}
+
+func (fs *KBFSOpsStandard) checkIntegrityLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.checkIntegrity(context.Background())
+		case <-fs.integrityShutdown:
+			return
+		}
+	}
+}
+
+// checkIntegrity re-reads a random sample of the blocks of each
+// loaded, fully-synced folder from the block server, and reports any
+// that are no longer intact.
+func (fs *KBFSOpsStandard) checkIntegrity(ctx context.Context) {
+	var opses []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for tlf := range fs.hotFolders.fullySynced() {
+			if ops, ok := fs.ops[FolderBranch{tlf, MasterBranch}]; ok {
+				opses = append(opses, ops)
+			}
+		}
+	}()
+
+	for _, ops := range opses {
+		var checked int
+		var anomalies []IntegrityCheckError
+		err := ops.runUnlessShutdown(func(ctx context.Context) (err error) {
+			checked, anomalies, err = ops.checkIntegrity(
+				ctx, integrityCheckBlocksPerFolder)
+			return err
+		})
+		if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't check the integrity of %s: %v",
+				ops.id(), err)
+		}
+		fs.integrity.record(fs.config.Clock().Now(), checked, anomalies)
+		for _, anomaly := range anomalies {
+			fs.log.CWarningf(ctx, "%v", anomaly)
+			fs.config.Reporter().ReportErr(ctx, anomaly.Tlf,
+				anomaly.Public, ReadMode, anomaly)
+		}
+	}
+}
+
+func (fs *KBFSOpsStandard) purgeTrashLoop() {
+	ticker := time.NewTicker(trashPurgePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.purgeTrash(context.Background(), fs.config.Clock().Now())
+		case <-fs.trashShutdown:
+			return
+		}
+	}
+}
+
+// purgeTrash deletes everything whose retention period is up as of
+// the given time from the trash of each loaded folder.
+func (fs *KBFSOpsStandard) purgeTrash(ctx context.Context, now time.Time) {
+	var opses []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for fb, ops := range fs.ops {
+			if fb.Branch == MasterBranch {
+				opses = append(opses, ops)
+			}
+		}
+	}()
+
+	for _, ops := range opses {
+		err := ops.runUnlessShutdown(func(ctx context.Context) error {
+			return ops.purgeTrash(ctx, now)
+		})
+		if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't purge the trash of %s: %v",
+				ops.id(), err)
+		}
+	}
+}
+
+func (fs *KBFSOpsStandard) syncSettingsLoop() {
+	ticker := time.NewTicker(settingsSyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx := context.Background()
+			if err := fs.syncSettings(ctx); err != nil {
+				fs.log.CDebugf(ctx, "Couldn't sync settings: %v", err)
+			}
+		case <-fs.settingsShutdown:
+			return
+		}
+	}
+}
+
+// syncSettings syncs the user's settings with their other devices,
+// and applies the result.
+func (fs *KBFSOpsStandard) syncSettings(ctx context.Context) error {
+	if fs.config.Mode().IsReadOnly() {
+		// Replicas don't act on behalf of any one user, and
+		// recovery mounts can't write the synced settings.
+		return nil
+	}
+	settings, err := fs.settings.sync(ctx)
+	if err != nil {
+		return err
+	}
+	for tlfID, pinning := range settings.folderPinnings(fs.config.Codec()) {
+		fs.hotFolders.setPinning(tlfID, pinning)
+	}
+	for tlfID, mode := range settings.tlfSyncModes(fs.config.Codec()) {
+		fs.hotFolders.setSyncMode(tlfID, mode)
+	}
+	if schedule, ok := settings.bandwidthSchedule(fs.config.Codec()); ok {
+		if bw := fs.config.BandwidthScheduler(); bw != nil {
+			bw.SetSchedule(schedule)
+		}
+	}
+	fs.rebalancePinnedFolders()
+	return nil
+}
+
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by KBFSOpsStandard.
 func (fs *KBFSOpsStandard) Shutdown() error {
 	close(fs.reIdentifyControlChan)
+	close(fs.hotFoldersShutdown)
+	close(fs.settingsShutdown)
+	close(fs.integrityShutdown)
+	close(fs.trashShutdown)
 	fs.favs.Shutdown()
 	var errors []error
 	for _, ops := range fs.ops {
@@ -112,7 +410,56 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 
 // PushConnectionStatusChange pushes human readable connection status changes.
 func (fs *KBFSOpsStandard) PushConnectionStatusChange(service string, newStatus error) {
-	fs.currentStatus.PushConnectionStatusChange(service, newStatus)
+	recovered := fs.currentStatus.PushConnectionStatusChange(
+		service, newStatus)
+	if recovered && service == MDServiceName {
+		// Catch up on what we missed while disconnected, so the
+		// user sees fresh contents right away.
+		go fs.prefetchRecentHeads()
+	}
+}
+
+// PushRetryStatusChange implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) PushRetryStatusChange(
+	service string, status RetryStatus) {
+	fs.currentStatus.PushRetryStatusChange(service, status)
+}
+
+// prefetchRecentHeads fetches and applies, in parallel, any MD
+// updates missed by the most recently used loaded folders.
+func (fs *KBFSOpsStandard) prefetchRecentHeads() {
+	// Folders that aren't loaded will get their latest heads when
+	// they're first used anyway.
+	var opses []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for _, tlf := range fs.hotFolders.recentFolders(
+			reconnectPrefetchFolders) {
+			if ops, ok := fs.ops[FolderBranch{tlf, MasterBranch}]; ok {
+				opses = append(opses, ops)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, ops := range opses {
+		wg.Add(1)
+		go func(ops *folderBranchOps) {
+			defer wg.Done()
+			err := ops.runUnlessShutdown(func(ctx context.Context) error {
+				ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+				defer cancel()
+				return ops.refreshHead(ctx)
+			})
+			if err != nil {
+				fs.log.CDebugf(nil, "Couldn't refresh the head of %s "+
+					"after reconnecting: %v", ops.id(), err)
+			}
+		}(ops)
+	}
+	wg.Wait()
 }
 
 // GetFavorites implements the KBFSOps interface for
@@ -122,6 +469,40 @@ func (fs *KBFSOpsStandard) GetFavorites(ctx context.Context) (
 	return fs.favs.Get(ctx)
 }
 
+// updateFavoritesMetadata records the metadata of each loaded
+// favorite folder with the favorites.
+func (fs *KBFSOpsStandard) updateFavoritesMetadata() {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	lState := makeFBOLockState()
+	for fav, ops := range fs.opsByFav {
+		head := ops.getHead(lState)
+		if head == nil {
+			continue
+		}
+		tlf := ops.id()
+		fs.favs.updateMetadata(fav, func(md *FavoriteMetadata) {
+			// Keep the last access time even once the folder
+			// is no longer tracked as hot.
+			if lastAccess, ok := fs.hotFolders.getLastAccess(
+				tlf); ok {
+				md.LastAccess = lastAccess
+			}
+			md.DiskUsage = head.DiskUsage
+			md.SyncMode = fs.hotFolders.getSyncMode(tlf)
+			md.Unread = ops.hasUnread()
+		})
+	}
+}
+
+// GetFavoritesWithMetadata implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetFavoritesWithMetadata(ctx context.Context) (
+	[]FavoriteInfo, error) {
+	fs.updateFavoritesMetadata()
+	return fs.favs.GetWithMetadata(ctx)
+}
+
 // RefreshCachedFavorites implements the KBFSOps interface for
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) RefreshCachedFavorites(ctx context.Context) {
@@ -190,8 +571,16 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		// branch; for now assume online and read-write, unless
+		// this whole instance is read-only.
+		bType := standard
+		if fs.config.Mode().IsReadOnly() {
+			bType = archive
+		}
+		ops = newFolderBranchOps(fs.config, fb, bType, fs.writeBackUsage)
+		if fs.writeFence != nil {
+			ops.fenceWrites(fs.writeFence)
+		}
 		fs.ops[fb] = ops
 	}
 	return ops
@@ -200,6 +589,12 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 func (fs *KBFSOpsStandard) getOps(
 	ctx context.Context, fb FolderBranch) *folderBranchOps {
 	ops := fs.getOpsNoAdd(fb)
+	if fs.config.Mode().IsReadOnly() {
+		// Replicas serve folders on behalf of others, so they
+		// shouldn't pollute the favorites list, and recovery
+		// mounts can't change it.
+		return ops
+	}
 	if err := ops.addToFavorites(ctx, fs.favs, false); err != nil {
 		// Failure to favorite shouldn't cause a failure.  Just log
 		// and move on.
@@ -210,7 +605,11 @@ func (fs *KBFSOpsStandard) getOps(
 
 func (fs *KBFSOpsStandard) getOpsByNode(ctx context.Context,
 	node Node) *folderBranchOps {
-	return fs.getOps(ctx, node.GetFolderBranch())
+	fb := node.GetFolderBranch()
+	fs.hotFolders.recordAccess(fb.Tlf)
+	ops := fs.getOps(ctx, fb)
+	ops.markRead()
+	return ops
 }
 
 func (fs *KBFSOpsStandard) getOpsByHandle(ctx context.Context,
@@ -237,9 +636,15 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 	// Do GetForHandle() unlocked -- no cache lookups, should be fine
 	mdops := fs.config.MDOps()
 	// TODO: only do this the first time, cache the folder ID after that
-	md, err := mdops.GetUnmergedForHandle(ctx, h)
-	if err != nil {
-		return nil, EntryInfo{}, err
+	var md *RootMetadata
+	isReplica := fs.config.Mode() == InitReadOnlyReplica
+	if !isReplica {
+		// Replicas never write, so they can't have unmerged
+		// changes.
+		md, err = mdops.GetUnmergedForHandle(ctx, h)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
 	}
 	if md == nil {
 		md, err = mdops.GetForHandle(ctx, h)
@@ -280,6 +685,9 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 		return nil, EntryInfo{}, err
 	}
 
+	if isReplica {
+		return node, ei, nil
+	}
 	if err := ops.addToFavorites(ctx, fs.favs, created); err != nil {
 		// Failure to favorite shouldn't cause a failure.  Just log
 		// and move on.
@@ -290,14 +698,18 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
-	map[string]EntryInfo, error) {
+	children map[string]EntryInfo, err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.GetDirChildren")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.GetDirChildren(ctx, dir)
 }
 
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
-	Node, EntryInfo, error) {
+	node Node, ei EntryInfo, err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Lookup")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.Lookup(ctx, dir, name)
 }
@@ -311,7 +723,10 @@ func (fs *KBFSOpsStandard) Stat(ctx context.Context, node Node) (
 
 // CreateDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateDir(
-	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	ctx context.Context, dir Node, name string) (
+	node Node, ei EntryInfo, err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.CreateDir")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.CreateDir(ctx, dir, name)
 }
@@ -319,7 +734,9 @@ func (fs *KBFSOpsStandard) CreateDir(
 // CreateFile implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateFile(
 	ctx context.Context, dir Node, name string, isExec bool) (
-	Node, EntryInfo, error) {
+	node Node, ei EntryInfo, err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.CreateFile")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.CreateFile(ctx, dir, name, isExec)
 }
@@ -332,6 +749,16 @@ func (fs *KBFSOpsStandard) CreateLink(
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CreateHardLink implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateHardLink(
+	ctx context.Context, dir Node, name string, target Node) error {
+	if dir.GetFolderBranch() != target.GetFolderBranch() {
+		return HardLinkAcrossFoldersError{}
+	}
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateHardLink(ctx, dir, name, target)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
 	ctx context.Context, dir Node, name string) error {
@@ -341,7 +768,9 @@ func (fs *KBFSOpsStandard) RemoveDir(
 
 // RemoveEntry implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveEntry(
-	ctx context.Context, dir Node, name string) error {
+	ctx context.Context, dir Node, name string) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.RemoveEntry")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.RemoveEntry(ctx, dir, name)
 }
@@ -349,7 +778,9 @@ func (fs *KBFSOpsStandard) RemoveEntry(
 // Rename implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) error {
+	newName string) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Rename")
+	defer func() { span.finish(err) }()
 	oldFB := oldParent.GetFolderBranch()
 	newFB := newParent.GetFolderBranch()
 
@@ -366,24 +797,62 @@ func (fs *KBFSOpsStandard) Rename(
 func (fs *KBFSOpsStandard) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
 	numRead int64, err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Read")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Read(ctx, file, dest, off)
 }
 
+// ReadStream implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ReadStream(
+	ctx context.Context, file Node, off int64) (io.ReadCloser, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.ReadStream(ctx, file, off)
+}
+
+// SeekHoleOrData implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SeekHoleOrData(
+	ctx context.Context, file Node, off int64, hole bool) (int64, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SeekHoleOrData(ctx, file, off, hole)
+}
+
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
-	ctx context.Context, file Node, data []byte, off int64) error {
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Write")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Write(ctx, file, data, off)
 }
 
+// WriteNoCopy implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteNoCopy(
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.WriteNoCopy")
+	defer func() { span.finish(err) }()
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.WriteNoCopy(ctx, file, data, off)
+}
+
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
-	ctx context.Context, file Node, size uint64) error {
+	ctx context.Context, file Node, size uint64) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Truncate")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Truncate(ctx, file, size)
 }
 
+// PunchHole implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PunchHole(
+	ctx context.Context, file Node, off, length int64) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.PunchHole")
+	defer func() { span.finish(err) }()
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.PunchHole(ctx, file, off, length)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
@@ -398,8 +867,52 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// GetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattr(
+	ctx context.Context, node Node, name string) ([]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattr(ctx, node, name)
+}
+
+// ListXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListXattr(
+	ctx context.Context, node Node) ([]string, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.ListXattr(ctx, node)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(ctx context.Context, node Node,
+	name string, value []byte, mode XattrSetMode) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value, mode)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
+// GetFileLock implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileLock(ctx context.Context, file Node,
+	lock FileLock) (FileLock, bool, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileLock(ctx, file, lock)
+}
+
+// SetFileLock implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetFileLock(ctx context.Context, file Node,
+	lock FileLock, wait bool) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.SetFileLock(ctx, file, lock, wait)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
-func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
+func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) (err error) {
+	ctx, span := startTraceSpan(ctx, fs.config, "KBFSOps.Sync")
+	defer func() { span.finish(err) }()
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Sync(ctx, file)
 }
@@ -409,7 +922,15 @@ func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
 	FolderBranchStatus, <-chan StatusUpdate, error) {
 	ops := fs.getOps(ctx, folderBranch)
-	return ops.FolderStatus(ctx, folderBranch)
+	status, ch, err := ops.FolderStatus(ctx, folderBranch)
+	if err != nil {
+		return status, ch, err
+	}
+	pinning, pinned := fs.hotFolders.getPinning(folderBranch.Tlf)
+	status.Pinned = pinned
+	status.Pinning = pinning.String()
+	status.SyncMode = fs.hotFolders.getSyncMode(folderBranch.Tlf).String()
+	return status, ch, nil
 }
 
 // Status implements the KBFSOps interface for KBFSOpsStandard
@@ -433,16 +954,565 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 			}
 		}
 	}
+	var admission *BlockCacheAdmissionStats
+	var bcacheUsage *BlockCacheUsage
+	if bcache, ok := fs.config.BlockCache().(*BlockCacheStandard); ok {
+		if stats, ok := bcache.AdmissionStats(); ok {
+			admission = &stats
+		}
+		usage := bcache.Usage()
+		bcacheUsage = &usage
+	}
+	var bandwidthSchedule string
+	if bw := fs.config.BandwidthScheduler(); bw != nil {
+		bandwidthSchedule = bw.Schedule().String()
+	}
+	var integrity *IntegrityStatus
+	if fs.config.IntegrityCheckPeriod() > 0 {
+		status := fs.integrity.getStatus()
+		integrity = &status
+	}
 	failures, ch := fs.currentStatus.CurrentStatus()
+	retries := fs.currentStatus.CurrentRetryStatus()
 	return KBFSStatus{
-		CurrentUser:     username.String(),
-		IsConnected:     fs.config.MDServer().IsConnected(),
-		UsageBytes:      usageBytes,
-		LimitBytes:      limitBytes,
-		FailingServices: failures,
+		CurrentUser:         username.String(),
+		IsConnected:         fs.config.MDServer().IsConnected(),
+		UsageBytes:          usageBytes,
+		LimitBytes:          limitBytes,
+		FailingServices:     failures,
+		PinnedFolders:       fs.getPinnedFolderNames(),
+		BlockCacheAdmission: admission,
+		BlockCacheUsage:     bcacheUsage,
+		FolderLatencies:     fs.getFolderLatencies(),
+		InFlightOps:         fs.getInFlightOps(),
+		BandwidthSchedule:   bandwidthSchedule,
+		RetryStatus:         retries,
+		Integrity:           integrity,
 	}, ch, err
 }
 
+// getInFlightOps returns the operations currently running on all the
+// loaded folders, oldest first.
+func (fs *KBFSOpsStandard) getInFlightOps() []InFlightOp {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	var inFlight []InFlightOp
+	for _, ops := range fs.ops {
+		inFlight = append(inFlight, ops.inFlight.getOps()...)
+	}
+	sort.Sort(inFlightOpsByStart(inFlight))
+	return inFlight
+}
+
+// getFolderLatencies returns the recent operation latencies of each
+// loaded folder with a known head, by canonical path.
+func (fs *KBFSOpsStandard) getFolderLatencies() map[string]map[string]OpLatencyStats {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	lState := makeFBOLockState()
+	var latencies map[string]map[string]OpLatencyStats
+	for fb, ops := range fs.ops {
+		if fb.Branch != MasterBranch {
+			continue
+		}
+		head := ops.getHead(lState)
+		if head == nil {
+			continue
+		}
+		stats := ops.latencies.stats()
+		if stats == nil {
+			continue
+		}
+		if latencies == nil {
+			latencies = make(map[string]map[string]OpLatencyStats)
+		}
+		latencies[head.GetTlfHandle().GetCanonicalPath()] = stats
+	}
+	return latencies
+}
+
+// FolderUsage implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FolderUsage(
+	ctx context.Context, folderBranch FolderBranch) (FolderUsage, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.FolderUsage(ctx, folderBranch)
+}
+
+func (fs *KBFSOpsStandard) getPinnedFolderNames() []string {
+	pinned := fs.hotFolders.getPinned()
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	lState := makeFBOLockState()
+	var names []string
+	for tlf := range pinned {
+		ops, ok := fs.ops[FolderBranch{tlf, MasterBranch}]
+		if !ok {
+			continue
+		}
+		if head := ops.getHead(lState); head != nil {
+			names = append(names, head.GetTlfHandle().GetCanonicalPath())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetFolderPinning implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetFolderPinning(ctx context.Context,
+	folderBranch FolderBranch, pinning FolderPinning) error {
+	fs.log.CDebugf(ctx, "Setting pinning of %s to %s",
+		folderBranch, pinning)
+	fs.hotFolders.setPinning(folderBranch.Tlf, pinning)
+	return fs.saveSetting(ctx,
+		settingsPinningPrefix+folderBranch.Tlf.String(), pinning)
+}
+
+// UnfreezeFolder implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) UnfreezeFolder(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.UnfreezeFolder(ctx, folderBranch)
+}
+
+// ArchiveFolder implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ArchiveFolder(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.ArchiveFolder(ctx, folderBranch)
+}
+
+// SetFolderQuota implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetFolderQuota(ctx context.Context,
+	folderBranch FolderBranch, limit uint64) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetFolderQuota(ctx, folderBranch, limit)
+}
+
+// SetFolderTrashRetention implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetFolderTrashRetention(ctx context.Context,
+	folderBranch FolderBranch, retention time.Duration) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.SetFolderTrashRetention(ctx, folderBranch, retention)
+}
+
+// ListTrash implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ListTrash(ctx context.Context,
+	folderBranch FolderBranch) ([]TrashEntry, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.ListTrash(ctx, folderBranch)
+}
+
+// RestoreFromTrash implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RestoreFromTrash(ctx context.Context,
+	folderBranch FolderBranch, trashPath string) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.RestoreFromTrash(ctx, folderBranch, trashPath)
+}
+
+// EmptyTrash implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) EmptyTrash(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.EmptyTrash(ctx, folderBranch)
+}
+
+// ExportTLF implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ExportTLF(ctx context.Context, tlfID TlfID,
+	w io.Writer) error {
+	ops := fs.getOps(ctx, FolderBranch{tlfID, MasterBranch})
+	return ops.exportTLF(ctx, w)
+}
+
+// ImportTLF implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ImportTLF(ctx context.Context, tlfID TlfID,
+	r io.Reader) error {
+	ops := fs.getOps(ctx, FolderBranch{tlfID, MasterBranch})
+	return ops.importTLF(ctx, r)
+}
+
+// SetTlfSyncMode implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetTlfSyncMode(ctx context.Context,
+	folderBranch FolderBranch, mode TlfSyncMode) error {
+	fs.log.CDebugf(ctx, "Setting sync mode of %s to %s",
+		folderBranch, mode)
+	fs.hotFolders.setSyncMode(folderBranch.Tlf, mode)
+	if mode != SyncFull {
+		// Fetch everything again if the folder is ever fully
+		// synced again, since the blocks may have been evicted
+		// in the meantime.
+		func() {
+			fs.fullSyncLock.Lock()
+			defer fs.fullSyncLock.Unlock()
+			delete(fs.fullySyncedRevs, folderBranch.Tlf)
+		}()
+	}
+	return fs.saveSetting(ctx,
+		settingsSyncModePrefix+folderBranch.Tlf.String(), mode)
+}
+
+// SetBandwidthSchedule implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SetBandwidthSchedule(ctx context.Context,
+	schedule BandwidthSchedule) error {
+	fs.log.CDebugf(ctx, "Setting bandwidth schedule to %q", schedule)
+	bw := fs.config.BandwidthScheduler()
+	if bw == nil {
+		return errors.New("No bandwidth scheduler")
+	}
+	bw.SetSchedule(schedule)
+	// Store the canonical string form, so that a schedule written
+	// by a newer client that this one can't parse is just skipped.
+	return fs.saveSetting(ctx,
+		settingsBandwidthScheduleKey, schedule.String())
+}
+
+// saveSetting changes the value of a setting that's already been
+// applied locally, and syncs it to the user's other devices.
+func (fs *KBFSOpsStandard) saveSetting(ctx context.Context,
+	key string, value interface{}) error {
+	if err := fs.settings.set(key, value); err != nil {
+		return err
+	}
+	// The new setting is applied locally either way, so failing to
+	// sync it to the user's other devices isn't fatal; the next
+	// sync will retry.
+	if err := fs.syncSettings(ctx); err != nil {
+		fs.log.CDebugf(ctx, "Couldn't sync settings: %v", err)
+		fs.rebalancePinnedFolders()
+	}
+	return nil
+}
+
+type unsyncedChangesByPath []UnsyncedChange
+
+func (c unsyncedChangesByPath) Len() int           { return len(c) }
+func (c unsyncedChangesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c unsyncedChangesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// UnsyncedChanges implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) UnsyncedChanges(
+	ctx context.Context) ([]UnsyncedChange, error) {
+	var opses []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for _, ops := range fs.ops {
+			opses = append(opses, ops)
+		}
+	}()
+	var changes []UnsyncedChange
+	for _, ops := range opses {
+		changes = append(changes, ops.unsyncedChanges()...)
+	}
+	sort.Sort(unsyncedChangesByPath(changes))
+	return changes, nil
+}
+
+// GetUnsyncedChange implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetUnsyncedChange(
+	ctx context.Context, file Node) (*UnsyncedChange, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.getUnsyncedChange(file)
+}
+
+// FlushPath implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) FlushPath(ctx context.Context, node Node) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.flushPath(ctx, node)
+}
+
+// WaitForWriteBack implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) WaitForWriteBack(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.WaitForWriteBack(ctx, folderBranch)
+}
+
+// FlushAndWait implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) FlushAndWait(
+	ctx context.Context, progress func(FlushProgress)) error {
+	report := func(p FlushProgress) {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	for {
+		var opses []*folderBranchOps
+		func() {
+			fs.opsLock.RLock()
+			defer fs.opsLock.RUnlock()
+			for _, ops := range fs.ops {
+				opses = append(opses, ops)
+			}
+		}()
+
+		type dirtyFile struct {
+			ops   *folderBranchOps
+			node  Node
+			bytes int64
+		}
+		var files []dirtyFile
+		var remaining FlushProgress
+		for _, ops := range opses {
+			if err := ops.flushAllCoalescedWrites(ctx); err != nil {
+				return err
+			}
+			for n, bytes := range ops.dirtyFileBytes() {
+				files = append(files, dirtyFile{ops, n, bytes})
+				remaining.Files++
+				remaining.Bytes += bytes
+			}
+		}
+		report(remaining)
+		if len(files) == 0 {
+			return nil
+		}
+
+		for _, f := range files {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if err := f.ops.syncToServer(ctx, f.node); err != nil {
+				return err
+			}
+			remaining.Files--
+			remaining.Bytes -= f.bytes
+			if remaining.Files > 0 {
+				report(remaining)
+			}
+		}
+		// Loop around to pick up anything written while we were
+		// syncing; the final report comes from there.
+	}
+}
+
+// PreviewConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) PreviewConflictResolution(
+	ctx context.Context, tlfID TlfID) (ConflictResolutionPreview, error) {
+	ops := fs.getOps(ctx, FolderBranch{tlfID, MasterBranch})
+	return ops.previewConflictResolution(ctx)
+}
+
+// CheckDeviceRevocation implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) CheckDeviceRevocation(
+	ctx context.Context) error {
+	username, uid, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := fs.config.KBPKI().GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return err
+	}
+	userInfo, err := fs.config.KeybaseDaemon().LoadUserPlusKeys(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if _, revoked := userInfo.RevokedVerifyingKeys[key]; !revoked {
+		return nil
+	}
+
+	fenceErr := DeviceRevokedError{username}
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		fs.writeFence = fenceErr
+		for _, ops := range fs.ops {
+			ops.fenceWrites(fenceErr)
+		}
+	}()
+	fs.log.CWarningf(ctx, "Device %s has been revoked; fencing all writes",
+		key)
+	fs.config.Reporter().ReportErr(ctx, "", false, WriteMode, fenceErr)
+	return nil
+}
+
+// Logout implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) Logout(ctx context.Context) error {
+	return fs.logout(ctx, false)
+}
+
+// logout tears down all per-user state.  It first flushes the dirty
+// data of every folder.  Any data that can't be flushed (e.g.,
+// because this device is offline) is persisted to the folder's
+// write-back journal instead, to be replayed the next time the
+// folder is opened.  Unless force is true, if some of the data can't
+// be journaled either, it returns an UnflushedLogoutError and
+// leaves everything as it was, so that the data can still be
+// flushed later.
+func (fs *KBFSOpsStandard) logout(ctx context.Context, force bool) error {
+	// The session may already be gone, in which case the caches
+	// can't be attributed to anyone and are just dropped.
+	_, uid, uidErr := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	var saved *loggedOutUserState
+	if uidErr == nil {
+		saved = &loggedOutUserState{
+			uid:     uid,
+			mdcache: fs.config.MDCache(),
+			kcache:  fs.config.KeyCache(),
+			bcache:  fs.config.BlockCache(),
+		}
+	}
+
+	var oldOps []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for _, ops := range fs.ops {
+			oldOps = append(oldOps, ops)
+		}
+	}()
+
+	var errors []error
+	syncCtx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+	defer cancel()
+	var unflushed []FolderBranch
+	var firstSyncErr error
+	for _, ops := range oldOps {
+		err := ops.syncAllDirty(syncCtx)
+		if err == nil {
+			continue
+		}
+		fs.log.CWarningf(ctx, "Couldn't flush %s on logout: %v",
+			ops.folderBranch, err)
+		jErr := ops.journalAllDirty(syncCtx)
+		if jErr == nil {
+			fs.log.CDebugf(ctx, "Left the dirty data of %s in the "+
+				"write-back journal", ops.folderBranch)
+			continue
+		}
+		fs.log.CWarningf(ctx, "Couldn't journal the dirty data of %s "+
+			"on logout: %v", ops.folderBranch, jErr)
+		unflushed = append(unflushed, ops.folderBranch)
+		if firstSyncErr == nil {
+			firstSyncErr = err
+		}
+	}
+	if len(unflushed) > 0 && !force {
+		func() {
+			fs.opsLock.Lock()
+			defer fs.opsLock.Unlock()
+			fs.unflushedUser = uid
+		}()
+		return UnflushedLogoutError{unflushed, firstSyncErr}
+	}
+
+	shutDown := make(map[*folderBranchOps]bool)
+	for _, ops := range oldOps {
+		if err := ops.Shutdown(); err != nil {
+			errors = append(errors, err)
+		}
+		shutDown[ops] = true
+	}
+
+	// Now swap in fresh folder maps, so that any folder opened from
+	// here on doesn't see the old user's state.  Shut down any
+	// folder that was opened while the others were shutting down.
+	var stragglers []*folderBranchOps
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		for _, ops := range fs.ops {
+			if !shutDown[ops] {
+				stragglers = append(stragglers, ops)
+			}
+		}
+		fs.ops = make(map[FolderBranch]*folderBranchOps)
+		fs.opsByFav = make(map[Favorite]*folderBranchOps)
+		// The next user shouldn't see how the old one used
+		// their folders.
+		fs.favs.clearMetadata()
+		fs.writeFence = nil
+	}()
+	for _, ops := range stragglers {
+		if err := ops.Shutdown(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	fs.config.ResetCaches()
+	fs.settings.reset()
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		fs.loggedOut = saved
+		fs.unflushedUser = ""
+	}()
+
+	if len(errors) == 1 {
+		return errors[0]
+	} else if len(errors) > 1 {
+		return fmt.Errorf("Multiple errors on logout: %v", errors)
+	}
+	return nil
+}
+
+// Login implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) Login(ctx context.Context) error {
+	_, uid, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// If the last user's logout was refused, their state is still
+	// live.  It's theirs to keep flushing if they're the one
+	// logging back in; otherwise nobody can flush it anymore, and
+	// it has to be torn down before the new user sees any of it.
+	unflushedUser := func() keybase1.UID {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		unflushedUser := fs.unflushedUser
+		fs.unflushedUser = ""
+		return unflushedUser
+	}()
+	if unflushedUser != "" && unflushedUser != uid {
+		fs.log.CWarningf(ctx, "Dropping the unflushed data of user %s",
+			unflushedUser)
+		if err := fs.logout(ctx, true); err != nil {
+			fs.log.CDebugf(ctx, "Error tearing down the state of user "+
+				"%s: %v", unflushedUser, err)
+		}
+	}
+
+	saved := func() *loggedOutUserState {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		saved := fs.loggedOut
+		fs.loggedOut = nil
+		return saved
+	}()
+	if saved != nil && saved.uid == uid {
+		fs.log.CDebugf(ctx, "Restoring caches for user %s", uid)
+		fs.config.SetMDCache(saved.mdcache)
+		fs.config.SetKeyCache(saved.kcache)
+		fs.config.SetBlockCache(saved.bcache)
+	}
+
+	// A device revoked while its user was logged out should be
+	// fenced right away.
+	if err := fs.CheckDeviceRevocation(ctx); err != nil {
+		fs.log.CDebugf(ctx, "Couldn't check for device revocation: %v",
+			err)
+	}
+	if err := fs.syncSettings(ctx); err != nil {
+		fs.log.CDebugf(ctx, "Couldn't sync settings: %v", err)
+	}
+	fs.favs.RefreshCache(ctx)
+	return nil
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
@@ -458,6 +1528,114 @@ func (fs *KBFSOpsStandard) Rekey(ctx context.Context, id TlfID) error {
 	return ops.Rekey(ctx, id)
 }
 
+// RotateKeysAfterRevocation implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RotateKeysAfterRevocation(
+	ctx context.Context, uid keybase1.UID) error {
+	userInfo, err := fs.config.KeybaseDaemon().LoadUserPlusKeys(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !fs.keyInvalidator.isTracking(uid) {
+		fs.keyInvalidator.seedRevokedKeys(uid, fs.getRotatedOutKeys(
+			uid, userInfo.RevokedCryptPublicKeys))
+	}
+	if !fs.keyInvalidator.noteRevokedKeys(
+		uid, userInfo.RevokedCryptPublicKeys) {
+		return nil
+	}
+	_, currentUID, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only writers can make a new key generation, and public
+	// folders have no crypt keys to rotate.
+	var toRotate []*folderBranchOps
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		lState := makeFBOLockState()
+		for fb, ops := range fs.ops {
+			if fb.Branch != MasterBranch {
+				continue
+			}
+			head := ops.getHead(lState)
+			if head == nil {
+				continue
+			}
+			handle := head.GetTlfHandle()
+			if handle.IsPublic() || !handle.IsWriter(currentUID) ||
+				!(handle.IsWriter(uid) || handle.IsReader(uid)) {
+				continue
+			}
+			fs.keyInvalidator.startRotation(fb.Tlf, KeyRotationStatus{
+				Folder:      handle.GetCanonicalPath(),
+				RevokedUser: userInfo.Name.String(),
+				OldKeyGen:   head.LatestKeyGeneration(),
+			})
+			toRotate = append(toRotate, ops)
+		}
+	}()
+
+	fs.log.CDebugf(ctx, "Rotating keys of %d folders after a revocation "+
+		"for user %s", len(toRotate), uid)
+	for _, ops := range toRotate {
+		id := ops.id()
+		err := ops.Rekey(ctx, id)
+		var newKeyGen KeyGen
+		if head := ops.getHead(makeFBOLockState()); head != nil {
+			newKeyGen = head.LatestKeyGeneration()
+		}
+		fs.keyInvalidator.finishRotation(id, newKeyGen, err)
+		if err != nil {
+			fs.log.CWarningf(ctx, "Couldn't rotate the keys of %s: %v",
+				id, err)
+		}
+	}
+	return nil
+}
+
+// getRotatedOutKeys returns those of the given revoked keys of a user
+// that none of the loaded folders' latest key generations are
+// encrypted for anymore.
+func (fs *KBFSOpsStandard) getRotatedOutKeys(uid keybase1.UID,
+	revoked map[CryptPublicKey]keybase1.KeybaseTime) []CryptPublicKey {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	lState := makeFBOLockState()
+	var heads []*RootMetadata
+	for fb, ops := range fs.ops {
+		if fb.Branch != MasterBranch {
+			continue
+		}
+		if head := ops.getHead(lState); head != nil && !head.ID.IsPublic() {
+			heads = append(heads, head)
+		}
+	}
+
+	var rotatedOut []CryptPublicKey
+	for key := range revoked {
+		inUse := false
+		for _, head := range heads {
+			if head.IsWriter(uid, key.KID()) || head.IsReader(uid, key.KID()) {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			rotatedOut = append(rotatedOut, key)
+		}
+	}
+	return rotatedOut
+}
+
+// KeyRotations implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) KeyRotations(
+	ctx context.Context) ([]KeyRotationStatus, error) {
+	return fs.keyInvalidator.getRotations(), nil
+}
+
 // SyncFromServerForTesting implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncFromServerForTesting(
 	ctx context.Context, folderBranch FolderBranch) error {
@@ -472,6 +1650,44 @@ func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	return ops.GetUpdateHistory(ctx, folderBranch)
 }
 
+// ExportMDChain implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ExportMDChain(ctx context.Context,
+	folderBranch FolderBranch) (MDChain, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.ExportMDChain(ctx, folderBranch)
+}
+
+// VerifyTLFHistory implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) VerifyTLFHistory(ctx context.Context,
+	folderBranch FolderBranch, proof TLFMerkleProof) (
+	MetadataRevision, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.VerifyTLFHistory(ctx, folderBranch, proof)
+}
+
+// GetFolderHead implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFolderHead(ctx context.Context,
+	folderBranch FolderBranch) (FolderHead, <-chan StatusUpdate, error) {
+	ops := fs.getOps(ctx, folderBranch)
+	return ops.GetFolderHead(ctx, folderBranch)
+}
+
+// MakeContentManifest implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) MakeContentManifest(
+	ctx context.Context, dir Node) (ContentManifest, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	p := ops.nodeCache.PathFromNode(dir)
+	if !p.isValid() {
+		return ContentManifest{}, InvalidPathError{p}
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, n := range p.path[1:] {
+		names = append(names, n.Name)
+	}
+	return makeContentManifest(ctx, fs.config, dir, strings.Join(names, "/"))
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
@@ -496,3 +1712,29 @@ func (fs *KBFSOpsStandard) UnregisterFromChanges(
 	}
 	return nil
 }
+
+// WatchChanges implements the Notifier interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WatchChanges(tlfIDs []TlfID) (
+	*ChangeSubscription, error) {
+	sub := newChangeSubscription()
+	opses := make([]*folderBranchOps, 0, len(tlfIDs))
+	observers := make([]Observer, 0, len(tlfIDs))
+	for _, tlf := range tlfIDs {
+		ops := fs.getOpsNoAdd(FolderBranch{tlf, MasterBranch})
+		obs := &changeFeedObserver{sub, tlf, ops.nodeCache}
+		if err := ops.RegisterForChanges(obs); err != nil {
+			for i, ops := range opses {
+				ops.UnregisterFromChanges(observers[i])
+			}
+			return nil, err
+		}
+		opses = append(opses, ops)
+		observers = append(observers, obs)
+	}
+	sub.unregister = func() {
+		for i, ops := range opses {
+			ops.UnregisterFromChanges(observers[i])
+		}
+	}
+	return sub, nil
+}
@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
@@ -213,9 +214,11 @@ func testKBFSOpsConcurWritesDuringSync(t *testing.T,
 	if err != nil {
 		t.Fatalf("Couldn't create file: %v", err)
 	}
+	// Give each initial block different contents, so that none
+	// of them are shared when they're put.
 	data := make([]byte, initialWriteBytes)
 	for i := 0; i < initialWriteBytes; i++ {
-		data[i] = 1
+		data[i] = byte(i)
 	}
 	err = kbfsOps.Write(ctx, fileNode, data, 0)
 	if err != nil {
@@ -279,7 +282,7 @@ func testKBFSOpsConcurWritesDuringSync(t *testing.T,
 	// block, the n initial modification blocks plus top block (if
 	// applicable).
 	bcs := config.BlockCache().(*BlockCacheStandard)
-	numCleanBlocks := bcs.cleanTransient.Len()
+	numCleanBlocks := bcs.numTransientEntries()
 	nFileBlocks := 1 + len(data)/int(bsplitter.maxSize)
 	if nFileBlocks > 1 {
 		nFileBlocks++ // top indirect block
@@ -444,6 +447,118 @@ func TestKBFSOpsConcurDeferredDoubleWritesDuringSync(t *testing.T) {
 	}
 }
 
+// Test that a folder's block fetches are limited separately from its
+// block puts, so that stalled reads don't hold up writes.
+func TestKBFSOpsConcurBlockGetsPerFolder(t *testing.T) {
+	config1, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CheckConfigAndShutdown(t, config1)
+
+	// Write two files.
+	rootNode1 := GetRootNodeOrBust(t, config1, "test_user", false)
+	kbfsOps1 := config1.KBFSOps()
+	data := []byte{1, 2, 3}
+	for _, name := range []string{"a", "b"} {
+		fileNode, _, err := kbfsOps1.CreateFile(ctx, rootNode1, name, false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		err = kbfsOps1.Write(ctx, fileNode, data, 0)
+		if err != nil {
+			t.Fatalf("Couldn't write file: %v", err)
+		}
+		err = kbfsOps1.Sync(ctx, fileNode)
+		if err != nil {
+			t.Fatalf("Couldn't sync file: %v", err)
+		}
+	}
+
+	// A second device, which has none of the file blocks cached,
+	// can only fetch one block at a time.
+	config2 := ConfigAsUser(config1.(*ConfigLocal), "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetBlockGetsPerFolder(1)
+
+	onReadStalledCh := make(chan struct{}, 1)
+	readUnstallCh := make(chan struct{})
+	stallKey := "requestName"
+	readValue := "read"
+	config2.SetBlockOps(&stallingBlockOps{
+		stallOpName: "Get",
+		stallKey:    stallKey,
+		stallMap: map[interface{}]staller{
+			readValue: staller{
+				stalled: onReadStalledCh,
+				unstall: readUnstallCh,
+			},
+		},
+		internalDelegate: config2.BlockOps(),
+	})
+
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	nodeA, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+	nodeB, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't look up file: %v", err)
+	}
+
+	// Start a read, and wait for it to stall while holding the
+	// folder's only fetch slot.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	bufA := make([]byte, len(data))
+	var readErr error
+	go func() {
+		defer wg.Done()
+		readCtx := context.WithValue(ctx, stallKey, readValue)
+		_, readErr = kbfsOps2.Read(readCtx, nodeA, bufA, 0)
+	}()
+	<-onReadStalledCh
+
+	// Another read has to wait for the slot.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	bufB := make([]byte, len(data))
+	_, err = kbfsOps2.Read(timeoutCtx, nodeB, bufB, 0)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a deadline error while the read slot is "+
+			"taken, got %v", err)
+	}
+
+	// But writes don't.
+	nodeC, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "c", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps2.Write(ctx, nodeC, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, nodeC)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	close(readUnstallCh)
+	wg.Wait()
+	if readErr != nil {
+		t.Fatalf("Couldn't read file: %v", readErr)
+	}
+	if !bytes.Equal(data, bufA) {
+		t.Errorf("Read %v, expected %v", bufA, data)
+	}
+	_, err = kbfsOps2.Read(ctx, nodeB, bufB, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(data, bufB) {
+		t.Errorf("Read %v, expected %v", bufB, data)
+	}
+}
+
 // Test that a block write can happen concurrently with a block
 // read. This is a regression test for KBFS-536.
 func TestKBFSOpsConcurBlockReadWrite(t *testing.T) {
@@ -581,6 +696,11 @@ func (km *mdRecordingKeyManager) Rekey(
 	return km.delegate.Rekey(ctx, md, promptPaper)
 }
 
+func (km *mdRecordingKeyManager) GetTLFCryptKeyHistory(
+	ctx context.Context, tlfID TlfID) (TLFCryptKeyHistory, error) {
+	return km.delegate.GetTLFCryptKeyHistory(ctx, tlfID)
+}
+
 // Test that a sync can happen concurrently with a write. This is a
 // regression test for KBFS-558.
 func TestKBFSOpsConcurBlockSyncWrite(t *testing.T) {
@@ -931,7 +1051,7 @@ func TestKBFSOpsConcurWriteDuringSyncMultiBlocks(t *testing.T) {
 	// there should be 7 blocks at this point: the original root block
 	// + 2 modifications (create + write), the top indirect file block
 	// and a modification (write), and its two children blocks.
-	numCleanBlocks := config.BlockCache().(*BlockCacheStandard).cleanTransient.Len()
+	numCleanBlocks := config.BlockCache().(*BlockCacheStandard).numTransientEntries()
 	if numCleanBlocks != 7 {
 		t.Errorf("Unexpected number of cached clean blocks: %d\n",
 			numCleanBlocks)
@@ -1139,6 +1259,8 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 		gomock.Any(), gomock.Any()).Times(3).Return(nil)
 	b.EXPECT().ArchiveBlockReferences(gomock.Any(), gomock.Any(),
 		gomock.Any()).AnyTimes().Return(nil)
+	b.EXPECT().Capabilities(gomock.Any()).AnyTimes().Return(
+		BlockServerCapabilities{}, nil)
 
 	// make blocks small
 	blockSize := int64(5)
@@ -8,7 +8,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -98,6 +102,8 @@ func kbfsOpsInit(t *testing.T, changeMd bool) (mockCtrl *gomock.Controller,
 	c := make(chan error, 1)
 	config.mockMdserv.EXPECT().RegisterForUpdate(gomock.Any(),
 		gomock.Any(), gomock.Any()).AnyTimes().Return(c, nil)
+	config.mockMdserv.EXPECT().CancelRegistration(gomock.Any(),
+		gomock.Any()).AnyTimes()
 
 	// None of these tests depend on time
 	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
@@ -4307,7 +4313,7 @@ func TestSyncDirtyDupBlockSuccess(t *testing.T) {
 }
 
 func putAndCleanAnyBlock(config *ConfigMock, p path) {
-	config.mockBcache.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), TransientEntry).
+	config.mockBcache.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), TransientLocalEntry).
 		Do(func(ptr BlockPointer, tlf TlfID, block Block, lifetime BlockCacheLifetime) {
 			config.mockDirtyBcache.EXPECT().
 				Get(ptrMatcher{BlockPointer{ID: ptr.ID}}, p.Branch).
@@ -5206,3 +5212,1977 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+func TestKBFSOpsReadOnlyReplica(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+
+	// Create a TLF with a file in it.
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetMode(InitReadOnlyReplica)
+	require.False(t, config2.DoBackgroundFlushes())
+
+	// Reads work as usual.
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+
+	// But all modifications fail.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false)
+	require.IsType(t, ReadOnlyBranchError{}, err)
+	err = kbfsOps2.Write(ctx, fileNode2, data, 0)
+	require.IsType(t, ReadOnlyBranchError{}, err)
+	err = kbfsOps2.Truncate(ctx, fileNode2, 0)
+	require.IsType(t, ReadOnlyBranchError{}, err)
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "a")
+	require.IsType(t, ReadOnlyBranchError{}, err)
+
+	// And the replica can't create new TLFs.
+	_, err = GetRootNodeForTest(config2, "alice", true)
+	require.IsType(t, ReadOnlyBranchError{}, err)
+}
+
+func TestKBFSOpsSetFolderPinning(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.Pinned)
+	require.Equal(t, "auto", status.Pinning)
+
+	err = kbfsOps.SetFolderPinning(ctx, fb, PinAlways)
+	require.NoError(t, err)
+
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Pinned)
+	require.Equal(t, "always", status.Pinning)
+	kbfsStatus, _, err := kbfsOps.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/keybase/private/alice"},
+		kbfsStatus.PinnedFolders)
+
+	// Blocks of the folder now go in the pinned partition.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	bcache := config.BlockCache().(*BlockCacheStandard)
+	require.NotZero(t, bcache.cleanPinned.Len())
+}
+
+func TestKBFSOpsSetTlfSyncMode(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "on-demand", status.SyncMode)
+
+	// Start from an empty cache, so the blocks have to be fetched.
+	bcache := NewBlockCacheStandard(config, 100, 1<<20)
+	config.SetBlockCache(bcache)
+
+	err = kbfsOps.SetTlfSyncMode(ctx, fb, SyncFull)
+	require.NoError(t, err)
+	fs := kbfsOps.(*KBFSOpsStandard)
+	err = fs.fullSyncs.Wait(ctx)
+	require.NoError(t, err)
+
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "full", status.SyncMode)
+	require.True(t, status.Pinned)
+
+	// The file's block was fetched into the pinned partition.
+	ops := getOps(config, fb.Tlf)
+	filePtr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+	require.True(t, bcache.cleanPinned.Contains(filePtr.ID))
+	lState := makeFBOLockState()
+	fs.fullSyncLock.Lock()
+	defer fs.fullSyncLock.Unlock()
+	require.Equal(t, ops.getCurrMDRevision(lState),
+		fs.fullySyncedRevs[fb.Tlf])
+}
+
+// bserverCorrupt flips the last bit of every block it returns.
+type bserverCorrupt struct {
+	BlockServer
+}
+
+func (b bserverCorrupt) Get(ctx context.Context, id BlockID, tlfID TlfID,
+	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
+	buf, serverHalf, err := b.BlockServer.Get(ctx, id, tlfID, context)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	buf = append([]byte(nil), buf...)
+	buf[len(buf)-1] ^= 1
+	return buf, serverHalf, nil
+}
+
+func TestKBFSOpsCheckIntegrity(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetIntegrityCheckPeriod(time.Hour)
+
+	// Use the public folder, since the sync mode setting below is
+	// written to the private one, adding blocks to it.
+	rootNode := GetRootNodeOrBust(t, config, "alice", true)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.SetTlfSyncMode(ctx, fb, SyncFull)
+	require.NoError(t, err)
+	fs := kbfsOps.(*KBFSOpsStandard)
+	err = fs.fullSyncs.Wait(ctx)
+	require.NoError(t, err)
+
+	// Intact blocks pass.
+	fs.checkIntegrity(ctx)
+	status, _, err := kbfsOps.Status(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, status.Integrity)
+	require.Equal(t, uint64(2), status.Integrity.BlocksChecked)
+	require.Equal(t, uint64(0), status.Integrity.Anomalies)
+
+	// Blocks that the server corrupts are reported.
+	bserv := config.BlockServer()
+	config.SetBlockServer(bserverCorrupt{bserv})
+	defer config.SetBlockServer(bserv)
+	fs.checkIntegrity(ctx)
+	status, _, err = kbfsOps.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), status.Integrity.BlocksChecked)
+	require.Equal(t, uint64(2), status.Integrity.Anomalies)
+	require.NotEmpty(t, status.Integrity.LastAnomaly)
+	errs := config.Reporter().AllKnownErrors()
+	require.NotEmpty(t, errs)
+	require.IsType(t, IntegrityCheckError{}, errs[len(errs)-1].Error)
+}
+
+func TestKBFSOpsContentDefinedChunking(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockSplitter(newBlockSplitterCDCWithSimple(
+		&BlockSplitterSimple{
+			maxSize: 1024, blockChangeEmbedMaxSize: 8 * 1024}))
+	config.SetContentDefinedChunking(true)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := make([]byte, 32*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	require.NotEqual(t, WriterFlags(0), md.WFlags&MetadataFlagContentChunked)
+
+	// Overwrite part of the middle of the file, which moves some
+	// boundaries around.
+	edit := make([]byte, 3000)
+	rand.New(rand.NewSource(2)).Read(edit)
+	copy(data[10000:], edit)
+	err = kbfsOps.Write(ctx, fileNode, edit, 10000)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(data, buf))
+}
+
+func TestKBFSOpsDeviceRevocationFencesWrites(t *testing.T) {
+	config, uid, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+
+	// Nothing happens while the device is still valid.
+	err = kbfsOps.CheckDeviceRevocation(ctx)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Mark the current device as revoked.
+	key, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	kbd := config.KeybaseDaemon().(*KeybaseDaemonLocal)
+	func() {
+		kbd.lock.Lock()
+		defer kbd.lock.Unlock()
+		user := kbd.localUsers[uid]
+		user.RevokedVerifyingKeys = map[VerifyingKey]keybase1.KeybaseTime{
+			key: {Unix: keybase1.ToTime(config.Clock().Now())},
+		}
+		kbd.localUsers[uid] = user
+	}()
+	err = kbfsOps.CheckDeviceRevocation(ctx)
+	require.NoError(t, err)
+
+	// Writes to existing and new folders all fail, but reads work.
+	err = kbfsOps.Write(ctx, fileNode, []byte{4, 5, 6}, 0)
+	require.IsType(t, DeviceRevokedError{}, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.IsType(t, DeviceRevokedError{}, err)
+	_, err = GetRootNodeForTest(config, "alice", true)
+	require.IsType(t, DeviceRevokedError{}, err)
+	buf := make([]byte, 3)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+}
+
+func TestKBFSOpsLogoutLogin(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	// Logging out flushes the dirty data and sets the caches aside.
+	bcache := config.BlockCache()
+	mdcache := config.MDCache()
+	err = kbfsOps.Logout(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, bcache, config.BlockCache())
+	require.NotEqual(t, mdcache, config.MDCache())
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	// Logging back in as the same user restores the caches.
+	err = kbfsOps.Login(ctx)
+	require.NoError(t, err)
+	require.Equal(t, bcache, config.BlockCache())
+	require.Equal(t, mdcache, config.MDCache())
+	GetRootNodeOrBust(t, config, "alice", false)
+
+	// Caches set aside for a different user are discarded.
+	err = kbfsOps.Logout(ctx)
+	require.NoError(t, err)
+	kbfsOps.(*KBFSOpsStandard).loggedOut.uid = keybase1.UID("other")
+	freshBcache := config.BlockCache()
+	err = kbfsOps.Login(ctx)
+	require.NoError(t, err)
+	require.Equal(t, freshBcache, config.BlockCache())
+	require.Nil(t, kbfsOps.(*KBFSOpsStandard).loggedOut)
+}
+
+func TestKBFSOpsLogoutOffline(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	// While the dirty data can't be flushed, logging out is
+	// refused, and nothing is torn down.
+	bserv := config.BlockServer()
+	config.SetBlockServer(NewBlockServerFaulty(bserv, config))
+	config.SetFaultPolicy(FaultPolicy{Methods: map[string]FaultSpec{
+		"BlockServer": {ErrorRate: 1},
+	}})
+	bcache := config.BlockCache()
+	err = kbfsOps.Logout(ctx)
+	require.IsType(t, UnflushedLogoutError{}, err)
+	require.Equal(t, bcache, config.BlockCache())
+	buf := make([]byte, 3)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	// Once back online, the data is flushed on the next try.
+	config.SetFaultPolicy(FaultPolicy{})
+	config.SetBlockServer(bserv)
+	err = kbfsOps.Logout(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, bcache, config.BlockCache())
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	n, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+}
+
+func TestKBFSOpsLogoutOfflineWriteBack(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "write_back_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.SetWriteBackJournalDir(dir)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	folderBranch := rootNode.GetFolderBranch()
+	err = kbfsOps.SyncFromServerForTesting(ctx, folderBranch)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	// While the dirty data can't be flushed, it's left in the
+	// write-back journal, and the logout goes ahead.
+	bserv := config.BlockServer()
+	config.SetBlockServer(NewBlockServerFaulty(bserv, config))
+	config.SetFaultPolicy(FaultPolicy{Methods: map[string]FaultSpec{
+		"BlockServer": {ErrorRate: 1},
+	}})
+	bcache := config.BlockCache()
+	err = kbfsOps.Logout(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, bcache, config.BlockCache())
+	journalDir := filepath.Join(dir, folderBranch.Tlf.String())
+	require.Equal(t, []string{"0", writeBackSealFile, writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+
+	// Once back online, the journaled data is replayed when the
+	// folder is next opened.
+	config.SetFaultPolicy(FaultPolicy{})
+	config.SetBlockServer(bserv)
+	err = kbfsOps.Login(ctx)
+	require.NoError(t, err)
+	GetRootNodeOrBust(t, config, "alice", false)
+	err = kbfsOps.WaitForWriteBack(ctx, folderBranch)
+	require.NoError(t, err)
+	require.Equal(t, []string{writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+}
+
+func TestKBFSOpsFolderUsage(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	usage, err := kbfsOps.FolderUsage(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), usage.PendingBytes)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	usage, err = kbfsOps.FolderUsage(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), usage.PendingBytes)
+}
+
+func TestKBFSOpsUnsyncedChanges(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+
+	changes, err := kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+
+	err = kbfsOps.Write(ctx, fileB, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	clock.Add(time.Minute)
+	err = kbfsOps.Write(ctx, fileA, []byte{1, 2}, 0)
+	require.NoError(t, err)
+	clock.Add(time.Minute)
+	// Writing again doesn't reset the age.
+	err = kbfsOps.Write(ctx, fileB, []byte{4}, 3)
+	require.NoError(t, err)
+
+	changes, err = kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []UnsyncedChange{
+		{Path: "alice/a", Bytes: 2, Age: time.Minute},
+		{Path: "alice/b", Bytes: 4, Age: 2 * time.Minute},
+	}, changes)
+	change, err := kbfsOps.GetUnsyncedChange(ctx, fileB)
+	require.NoError(t, err)
+	require.Equal(t, &UnsyncedChange{
+		Path: "alice/b", Bytes: 4, Age: 2 * time.Minute}, change)
+
+	err = kbfsOps.Sync(ctx, fileB)
+	require.NoError(t, err)
+	changes, err = kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []UnsyncedChange{
+		{Path: "alice/a", Bytes: 2, Age: time.Minute},
+	}, changes)
+	change, err = kbfsOps.GetUnsyncedChange(ctx, fileB)
+	require.NoError(t, err)
+	require.Nil(t, change)
+
+	err = kbfsOps.Sync(ctx, fileA)
+	require.NoError(t, err)
+	changes, err = kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+}
+
+func TestKBFSOpsDirtyNodesOldestFirst(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	config.SetMaxDirtyAge(time.Minute)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	_, ok := ops.timeUntilStale()
+	require.False(t, ok)
+
+	err = kbfsOps.Write(ctx, fileB, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	clock.Add(40 * time.Second)
+	err = kbfsOps.Write(ctx, fileA, []byte{1, 2}, 0)
+	require.NoError(t, err)
+
+	nodes := ops.getDirtyNodesOldestFirst(lState)
+	require.Len(t, nodes, 2)
+	require.Equal(t, fileB.GetID(), nodes[0].node.GetID())
+	require.Equal(t, fileA.GetID(), nodes[1].node.GetID())
+	d, ok := ops.timeUntilStale()
+	require.True(t, ok)
+	require.Equal(t, 20*time.Second, d)
+
+	// Once b is too old, the next change to go stale is a's.
+	clock.Add(30 * time.Second)
+	d, ok = ops.timeUntilStale()
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, d)
+
+	config.SetMaxDirtyAge(0)
+	_, ok = ops.timeUntilStale()
+	require.False(t, ok)
+
+	err = kbfsOps.Sync(ctx, fileA)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileB)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsFlushPath(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetClock(newTestClockNow())
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "e")
+	require.NoError(t, err)
+	fileX, _, err := kbfsOps.CreateFile(ctx, dirNode, "x", false)
+	require.NoError(t, err)
+	fileY, _, err := kbfsOps.CreateFile(ctx, subdirNode, "y", false)
+	require.NoError(t, err)
+	fileZ, _, err := kbfsOps.CreateFile(ctx, rootNode, "z", false)
+	require.NoError(t, err)
+	for _, file := range []Node{fileX, fileY, fileZ} {
+		err = kbfsOps.Write(ctx, file, []byte{1, 2, 3}, 0)
+		require.NoError(t, err)
+	}
+
+	// Flushing a directory flushes everything under it.
+	err = kbfsOps.FlushPath(ctx, dirNode)
+	require.NoError(t, err)
+	changes, err := kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "alice/z", changes[0].Path)
+
+	err = kbfsOps.FlushPath(ctx, fileZ)
+	require.NoError(t, err)
+	changes, err = kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+}
+
+func TestKBFSOpsFlushAndWait(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileA, []byte{1, 2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileB, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	var progress []FlushProgress
+	err = kbfsOps.FlushAndWait(ctx, func(p FlushProgress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	require.Len(t, progress, 3)
+	require.Equal(t, FlushProgress{Files: 2, Bytes: 5}, progress[0])
+	require.Equal(t, 1, progress[1].Files)
+	require.Equal(t, FlushProgress{}, progress[2])
+
+	changes, err := kbfsOps.UnsyncedChanges(ctx)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+
+	// With nothing left to flush, it returns right away.
+	progress = nil
+	err = kbfsOps.FlushAndWait(ctx, func(p FlushProgress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []FlushProgress{{}}, progress)
+	require.NoError(t, kbfsOps.FlushAndWait(ctx, nil))
+}
+
+func TestKBFSOpsRefreshHeadsOnReconnect(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fb := rootNode2.GetFolderBranch()
+	// Use the folder, so it counts as recently used.
+	_, err := config2.KBFSOps().GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+
+	// Simulate missing updates while disconnected.
+	unpause, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	defer close(unpause)
+	_, _, err = config1.KBFSOps().CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+
+	kbfsOps2 := config2.KBFSOps().(*KBFSOpsStandard)
+	kbfsOps2.PushConnectionStatusChange(MDServiceName, errDisconnected{})
+	require.True(t, kbfsOps2.currentStatus.PushConnectionStatusChange(
+		MDServiceName, nil))
+	require.False(t, kbfsOps2.currentStatus.PushConnectionStatusChange(
+		MDServiceName, nil))
+
+	kbfsOps2.prefetchRecentHeads()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsGetFolderHead(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	head, headChanged, err := kbfsOps.GetFolderHead(
+		ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, "/keybase/private/alice", head.Folder)
+	require.Equal(t, "alice", head.Writer)
+
+	// The proof must be a validly-signed MD matching the head.
+	var rmds RootMetadataSigned
+	err = config.Codec().Decode(head.Proof, &rmds)
+	require.NoError(t, err)
+	require.NoError(t, rmds.VerifyRootMetadata(config.Codec(), config.Crypto()))
+	require.Equal(t, head.Revision, rmds.MD.Revision)
+	mdID, err := config.Crypto().MakeMdID(&rmds.MD)
+	require.NoError(t, err)
+	require.Equal(t, head.MdID, mdID.String())
+
+	select {
+	case <-headChanged:
+		t.Fatalf("Head changed unexpectedly")
+	default:
+	}
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	select {
+	case <-headChanged:
+	default:
+		t.Fatalf("Head change wasn't signaled")
+	}
+	newHead, _, err := kbfsOps.GetFolderHead(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, newHead.Revision > head.Revision)
+	require.NotEqual(t, head.RootBlockID, newHead.RootBlockID)
+}
+
+func TestKBFSOpsSparseFile(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+
+	// Write a little data at the start, and some more far past the
+	// end of the file.
+	head := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, head, 0)
+	require.NoError(t, err)
+	const tailOff = 1 << 20
+	tail := []byte{6, 7, 8}
+	err = kbfsOps.Write(ctx, fileNode, tail, tailOff)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// The gap shouldn't have used up any blocks.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	require.True(t, md.DiskUsage < 128*1024,
+		"Disk usage %d is too big", md.DiskUsage)
+
+	off, err := kbfsOps.SeekHoleOrData(ctx, fileNode, 0, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(head)), off)
+	off, err = kbfsOps.SeekHoleOrData(ctx, fileNode, 100, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), off)
+	off, err = kbfsOps.SeekHoleOrData(ctx, fileNode, 100, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(tailOff), off)
+	off, err = kbfsOps.SeekHoleOrData(ctx, fileNode, tailOff, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(tailOff+len(tail)), off)
+	_, err = kbfsOps.SeekHoleOrData(
+		ctx, fileNode, int64(tailOff+len(tail)), false)
+	require.IsType(t, SeekPastEOFError{}, err)
+
+	// Now write into the middle of the hole, which should get a
+	// block of its own.
+	const midOff = tailOff / 2
+	mid := []byte{9, 10}
+	err = kbfsOps.Write(ctx, fileNode, mid, midOff)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	md = ops.getHead(lState)
+	require.True(t, md.DiskUsage < 128*1024,
+		"Disk usage %d is too big", md.DiskUsage)
+	off, err = kbfsOps.SeekHoleOrData(ctx, fileNode, 100, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(midOff), off)
+	off, err = kbfsOps.SeekHoleOrData(ctx, fileNode, midOff, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(midOff+len(mid)), off)
+
+	// Another device reads zeros in the holes.
+	expected := make([]byte, tailOff+len(tail))
+	copy(expected, head)
+	copy(expected[midOff:], mid)
+	copy(expected[tailOff:], tail)
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(expected)), ei.Size)
+	buf := make([]byte, len(expected))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expected)), n)
+	require.True(t, bytes.Equal(expected, buf))
+}
+
+func TestKBFSOpsPunchHole(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	bsplit, err := NewBlockSplitterSimple(1024, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	oldUsage := ops.getHead(lState).DiskUsage
+
+	err = kbfsOps.PunchHole(ctx, fileNode, 0, 0)
+	require.IsType(t, InvalidRangeError{}, err)
+
+	const holeOff, holeEnd = 1500, 12000
+	err = kbfsOps.PunchHole(ctx, fileNode, holeOff, holeEnd-holeOff)
+	require.NoError(t, err)
+	expected := append([]byte(nil), data...)
+	copy(expected[holeOff:holeEnd], make([]byte, holeEnd-holeOff))
+
+	// The size doesn't change, and the range reads as zeroes.
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(expected, buf))
+
+	// The blocks inside the range are gone.
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	newUsage := ops.getHead(lState).DiskUsage
+	require.True(t, newUsage+8*1024 < oldUsage,
+		"Disk usage only went from %d to %d", oldUsage, newUsage)
+	off, err := kbfsOps.SeekHoleOrData(ctx, fileNode, 0, true)
+	require.NoError(t, err)
+	require.True(t, off > holeOff && off < holeEnd,
+		"Unexpected hole offset %d", off)
+
+	// Punching past the end of the file doesn't extend it.
+	err = kbfsOps.PunchHole(ctx, fileNode, int64(len(data))-10, 100)
+	require.NoError(t, err)
+	copy(expected[len(data)-10:], make([]byte, 10))
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	buf = make([]byte, len(data))
+	n, err = kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(expected, buf))
+}
+
+// Test that shrinking a file to where one of its blocks starts, or
+// to somewhere in a hole, leaves the file the right size.
+func TestKBFSOpsTruncateBetweenBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+
+	// Writing far past the end of the file starts a new block.
+	head := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, head, 0)
+	require.NoError(t, err)
+	const midOff, tailOff = 1 << 19, 1 << 20
+	err = kbfsOps.Write(ctx, fileNode, []byte{6, 7}, midOff)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{8, 9}, tailOff)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	checkSize := func(size int64) {
+		ei, err := kbfsOps.Stat(ctx, fileNode)
+		require.NoError(t, err)
+		require.Equal(t, uint64(size), ei.Size)
+		buf := make([]byte, size+1)
+		n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, size, n)
+		expected := make([]byte, size)
+		copy(expected, head)
+		require.True(t, bytes.Equal(expected, buf[:n]))
+		off, err := kbfsOps.SeekHoleOrData(ctx, fileNode, 0, true)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(head)), off)
+	}
+
+	err = kbfsOps.Truncate(ctx, fileNode, midOff)
+	require.NoError(t, err)
+	checkSize(midOff)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkSize(midOff)
+
+	const holeOff = midOff / 2
+	err = kbfsOps.Truncate(ctx, fileNode, holeOff)
+	require.NoError(t, err)
+	checkSize(holeOff)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	checkSize(holeOff)
+}
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "a", false)
+	require.NoError(t, err)
+
+	names, err := kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, names, 0)
+	_, err = kbfsOps.GetXattr(ctx, fileNode, "user.a")
+	require.IsType(t, NoSuchXattrError{}, err)
+
+	err = kbfsOps.SetXattr(
+		ctx, fileNode, "user.b", []byte{1, 2}, XattrCreateOrReplace)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte{3}, XattrCreateOnly)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte{4}, XattrCreateOnly)
+	require.IsType(t, XattrExistsError{}, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.c", []byte{5}, XattrReplaceOnly)
+	require.IsType(t, NoSuchXattrError{}, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.a", []byte{6}, XattrReplaceOnly)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.d",
+		make([]byte, maxXattrValueBytes+1), XattrCreateOrReplace)
+	require.IsType(t, XattrTooBigError{}, err)
+
+	value, err := kbfsOps.GetXattr(ctx, fileNode, "user.a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{6}, value)
+	names, err = kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.a", "user.b"}, names)
+
+	// The folder and the directory holding the file are marked as
+	// needing newer versions.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	require.NotEqual(t, WriterFlags(0), md.WFlags&MetadataFlagXattrs)
+	de, err := ops.blocks.GetDirtyEntry(ctx, lState, md,
+		ops.nodeCache.PathFromNode(dirNode))
+	require.NoError(t, err)
+	require.Equal(t, DataVer(XattrsDataVer), de.DataVer)
+
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.b")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.b")
+	require.IsType(t, NoSuchXattrError{}, err)
+
+	// Another device sees the remaining attribute, even after the
+	// file has been written.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "a")
+	require.NoError(t, err)
+	names, err = kbfsOps2.ListXattr(ctx, fileNode2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.a"}, names)
+	value, err = kbfsOps2.GetXattr(ctx, fileNode2, "user.a")
+	require.NoError(t, err)
+	require.Equal(t, []byte{6}, value)
+}
+
+func TestKBFSOpsSyncPutsIdenticalBlocksOnce(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+
+	// Many of the blocks of an all-zero file are identical.
+	data := make([]byte, 512*1024)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	de, err := ops.blocks.GetDirtyEntry(ctx, lState, md,
+		ops.nodeCache.PathFromNode(fileNode))
+	require.NoError(t, err)
+	fblock, err := ops.blocks.GetFileBlockForReading(ctx, lState, md,
+		de.BlockPointer, MasterBranch, path{})
+	require.NoError(t, err)
+	require.True(t, fblock.IsInd)
+	ids := make(map[BlockID]bool)
+	for _, iptr := range fblock.IPtrs {
+		ids[iptr.ID] = true
+	}
+	require.True(t, len(ids) < len(fblock.IPtrs),
+		"%d blocks with %d distinct IDs", len(fblock.IPtrs), len(ids))
+
+	// Another device can read all the references.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data)+1)
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(data, buf[:n]))
+}
+
+func TestKBFSOpsFileLocks(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice,bob", false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice,bob", false)
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	write := FileLock{Type: FileLockWrite, Start: 0, End: 9, Owner: 1}
+	err = kbfsOps1.SetFileLock(ctx, fileNode1, write, false)
+	require.NoError(t, err)
+
+	// The other device can lock other bytes, but not the locked ones.
+	other := FileLock{Type: FileLockWrite, Start: 10, End: 19, Owner: 1}
+	err = kbfsOps2.SetFileLock(ctx, fileNode2, other, false)
+	require.NoError(t, err)
+	read := FileLock{Type: FileLockRead, Start: 5, End: 5, Owner: 2}
+	held, conflict, err := kbfsOps2.GetFileLock(ctx, fileNode2, read)
+	require.NoError(t, err)
+	require.True(t, conflict)
+	require.Equal(t, FileLockWrite, held.Type)
+	require.Equal(t, uint64(0), held.Start)
+	require.Equal(t, uint64(9), held.End)
+	err = kbfsOps2.SetFileLock(ctx, fileNode2, read, false)
+	require.IsType(t, FileLockConflictError{}, err)
+
+	// flock(2) locks don't conflict with fcntl(2) locks.
+	flock := read
+	flock.Flock = true
+	err = kbfsOps2.SetFileLock(ctx, fileNode2, flock, false)
+	require.NoError(t, err)
+
+	// A waiting lock is taken once the holder releases its lock,
+	// and sees what the holder wrote.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- kbfsOps2.SetFileLock(ctx, fileNode2, read, true)
+	}()
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	unlock := write
+	unlock.Type = FileLockUnlock
+	err = kbfsOps1.SetFileLock(ctx, fileNode1, unlock, false)
+	require.NoError(t, err)
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	buf := make([]byte, 3)
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	// Now the first device can't take a write lock there.
+	_, conflict, err = kbfsOps1.GetFileLock(ctx, fileNode1, write)
+	require.NoError(t, err)
+	require.True(t, conflict)
+}
+
+func TestKBFSOpsHardLinks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	err = kbfsOps.CreateHardLink(ctx, dirNode, "b", fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.CreateHardLink(ctx, dirNode, "b", fileNode)
+	require.IsType(t, NameExistsError{}, err)
+	err = kbfsOps.CreateHardLink(ctx, rootNode, "c", dirNode)
+	require.IsType(t, NotFileError{}, err)
+
+	// Both names lead to the same file.
+	aNode, aEI, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, bEI, err := kbfsOps.Lookup(ctx, dirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, File, aEI.Type)
+	require.Equal(t, aEI, bEI)
+	require.Equal(t, fileNode.GetID(), aNode.GetID())
+	require.Equal(t, fileNode.GetID(), bNode.GetID())
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Equal(t, bEI, children["b"])
+
+	err = kbfsOps.Write(ctx, bNode, []byte{4}, 3)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bNode)
+	require.NoError(t, err)
+	data = append(data, 4)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, aNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	// Each name is stored as a symlink to the file, and the folder
+	// is marked so that older clients can't write to it.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	require.NotEqual(t, WriterFlags(0), md.WFlags&MetadataFlagHardLinks)
+	de, err := ops.blocks.GetDirtyEntry(ctx, lState, md,
+		ops.nodeCache.PathFromNode(dirNode).ChildPathNoPtr("b"))
+	require.NoError(t, err)
+	require.Equal(t, Sym, de.Type)
+	require.Equal(t, "../"+hardLinksDirName+"/"+de.LinkID, de.SymPath)
+	de, err = ops.statEntry(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), de.Links)
+
+	// A third name, linked through an existing link.
+	err = kbfsOps.CreateHardLink(ctx, rootNode, "c", bNode)
+	require.NoError(t, err)
+	de, err = ops.statEntry(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), de.Links)
+
+	// Removing or replacing names keeps the file until the last
+	// one is gone.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "e", false)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, rootNode, "e", rootNode, "c")
+	require.NoError(t, err)
+	de, err = ops.statEntry(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), de.Links)
+	n, err = kbfsOps.Read(ctx, bNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "b")
+	require.NoError(t, err)
+	linksNode, _, err := kbfsOps.Lookup(ctx, rootNode, hardLinksDirName)
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, linksNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+}
+
+func TestKBFSOpsMoveAcrossFolders(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	privNode := GetRootNodeOrBust(t, config, "alice", false)
+	pubNode := GetRootNodeOrBust(t, config, "alice", true)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, privNode, "d")
+	require.NoError(t, err)
+	aNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", true)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, []byte{4, 5}, 0)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "c", "a")
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bNode)
+	require.NoError(t, err)
+
+	// A failed move removes the partial copy and keeps the
+	// original.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	err = kbfsOps.MoveAcrossFolders(cancelCtx, privNode, "d", pubNode, "e",
+		func(p MoveProgress) {
+			if p.Files == 1 {
+				cancel()
+			}
+		})
+	require.Equal(t, context.Canceled, err)
+	children, err := kbfsOps.GetDirChildren(ctx, pubNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+
+	var progress []MoveProgress
+	err = kbfsOps.MoveAcrossFolders(ctx, privNode, "d", pubNode, "e",
+		func(p MoveProgress) {
+			progress = append(progress, p)
+		})
+	require.NoError(t, err)
+	require.Equal(t, MoveProgress{0, 0, 2, 5}, progress[0])
+	require.Equal(t, MoveProgress{2, 5, 2, 5}, progress[len(progress)-1])
+
+	_, _, err = kbfsOps.Lookup(ctx, privNode, "d")
+	require.IsType(t, NoSuchNameError{}, err)
+	children, err = kbfsOps.GetDirChildren(ctx, pubNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	eNode, _, err := kbfsOps.Lookup(ctx, pubNode, "e")
+	require.NoError(t, err)
+	newBNode, ei, err := kbfsOps.Lookup(ctx, eNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, newBNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 5}, buf[:n])
+	_, ei, err = kbfsOps.Lookup(ctx, eNode, "c")
+	require.NoError(t, err)
+	require.Equal(t, Sym, ei.Type)
+	require.Equal(t, "a", ei.SymPath)
+}
+
+func TestKBFSOpsDeletionPolicy(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+
+	var asked []LargeDeletion
+	guard := NewDeletionGuard(DeletionLimits{Entries: 1}, config.Clock())
+	guard.RegisterConfirmer(func(ctx context.Context, d LargeDeletion) (
+		bool, error) {
+		asked = append(asked, d)
+		return false, nil
+	})
+	config.SetDeletionPolicy(guard)
+
+	kbfsOps := config.KBFSOps()
+	for _, name := range []CanonicalTlfName{"alice", "alice,bob"} {
+		rootNode := GetRootNodeOrBust(t, config, string(name), false)
+		for _, file := range []string{"a", "b", "c"} {
+			_, _, err := kbfsOps.CreateFile(ctx, rootNode, file, false)
+			require.NoError(t, err)
+		}
+		err := kbfsOps.RemoveEntry(ctx, rootNode, "a")
+		require.NoError(t, err)
+		err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+		if name == "alice" {
+			// Private folders aren't guarded.
+			require.NoError(t, err)
+			continue
+		}
+		require.IsType(t, DeletionNotConfirmedError{}, err)
+		err = kbfsOps.Rename(ctx, rootNode, "c", rootNode, "b")
+		require.IsType(t, DeletionNotConfirmedError{}, err)
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+	}
+	require.Equal(t, []LargeDeletion{
+		{"alice,bob", 2, 0}, {"alice,bob", 2, 0}}, asked)
+}
+
+func TestKBFSOpsSplitDirBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	config.maxDirEntriesPerBlock = 4
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(t, config, "alice,bob", false)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	const numEntries = 40
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("f%02d", i), false)
+		require.NoError(t, err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	getLeaves := func() (*DirBlock, []IndirectDirPtr, []BlockInfo) {
+		md := ops.getHead(lState)
+		dirPath := ops.nodeCache.PathFromNode(dirNode)
+		dblock, err := ops.blocks.GetDirBlockForReading(ctx, lState, md,
+			dirPath.tailPointer(), dirPath.Branch, dirPath)
+		require.NoError(t, err)
+		leaves, indirect, err := ops.blocks.GetDirLeafPtrs(
+			ctx, lState, md, dblock, dirPath.Branch)
+		require.NoError(t, err)
+		return dblock, leaves, indirect
+	}
+	dblock, leaves, indirect := getLeaves()
+	require.True(t, dblock.IsInd)
+	require.Len(t, dblock.Children, numEntries)
+	require.True(t, len(leaves) > 4)
+	require.NotEmpty(t, indirect)
+	for _, leaf := range leaves {
+		require.NotZero(t, leaf.Size)
+	}
+
+	// Changing one entry only rewrites the leaf block it's in.
+	file, _, err := kbfsOps.Lookup(ctx, dirNode, "f17")
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.SetEx(ctx, file, true))
+	_, newLeaves, _ := getLeaves()
+	require.Len(t, newLeaves, len(leaves))
+	changed := 0
+	for i := range leaves {
+		if leaves[i].BlockPointer != newLeaves[i].BlockPointer {
+			changed++
+		}
+	}
+	require.Equal(t, 1, changed)
+	// The directory's size still covers all of its blocks.
+	var leavesSize uint64
+	for _, leaf := range newLeaves {
+		leavesSize += leaf.Size
+	}
+	dirEntry, err := kbfsOps.Stat(ctx, dirNode)
+	require.NoError(t, err)
+	require.True(t, dirEntry.Size > leavesSize)
+
+	// Another device reads the directory from the server.
+	config2 := ConfigAsUser(config, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice,bob", false)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	children, err := kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries)
+	require.Equal(t, Exec, children["f17"].Type)
+
+	// Once it's small enough, the directory goes back to one block.
+	for i := 0; i < numEntries-4; i++ {
+		require.NoError(t, kbfsOps2.RemoveEntry(
+			ctx, dirNode2, fmt.Sprintf("f%02d", i)))
+	}
+	require.NoError(t, kbfsOps.SyncFromServerForTesting(
+		ctx, rootNode.GetFolderBranch()))
+	dblock, leaves, _ = getLeaves()
+	require.False(t, dblock.IsInd)
+	require.Empty(t, leaves)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 4)
+}
+
+func TestKBFSOpsDirTooManyEntries(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.maxDirEntries = 2
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false)
+	require.IsType(t, DirTooManyEntriesError{}, err)
+
+	// Moving an entry into a full directory fails too, but renaming
+	// within it is fine.
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "c", false)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "c", rootNode, "c")
+	require.IsType(t, DirTooManyEntriesError{}, err)
+	require.NoError(t, kbfsOps.Rename(ctx, rootNode, "b", rootNode, "d"))
+}
+
+func TestKBFSOpsFreezeAfterAnomaly(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+	config1.SetAnomalyDetector(NewActivityMonitor(
+		ActivityLimits{Deletions: 2}, config1.Clock()))
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice,bob", false)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, name, false)
+		require.NoError(t, err)
+	}
+
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice,bob", false)
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, kbfsOps2.RemoveEntry(ctx, rootNode2, name))
+	}
+
+	// Alice's device stops before bob's third deletion.
+	fb := rootNode1.GetFolderBranch()
+	err := kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.IsType(t, FolderFrozenError{}, err)
+	frozenErr := err.(FolderFrozenError)
+	require.Equal(t, libkb.NormalizedUsername("bob"), frozenErr.Writer)
+	require.Equal(t, 3, frozenErr.Anomaly.Deletions)
+	children, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "e", false)
+	require.IsType(t, FolderFrozenError{}, err)
+	status, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, frozenErr.Error(), status.Frozen)
+	reported := config1.Reporter().AllKnownErrors()
+	require.Equal(t, frozenErr, reported[len(reported)-1].Error)
+
+	require.NoError(t, kbfsOps1.UnfreezeFolder(ctx, fb))
+	children, err = kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "e", false)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps2.SyncFromServerForTesting(ctx, fb))
+}
+
+func TestKBFSOpsArchiveFolder(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice,bob", false)
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0))
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.RemoveEntry(ctx, rootNode1, "b"))
+
+	// The unsynced write to a makes it into the archive.
+	fb := rootNode1.GetFolderBranch()
+	require.NoError(t, kbfsOps1.ArchiveFolder(ctx, fb))
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "c", false)
+	require.IsType(t, FolderArchivedError{}, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{4}, 3)
+	require.IsType(t, FolderArchivedError{}, err)
+	require.IsType(t, FolderArchivedError{},
+		kbfsOps1.ArchiveFolder(ctx, fb))
+	status, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Archived)
+
+	// Other devices can still read the folder, but not write to it.
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice,bob", false)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false)
+	require.IsType(t, FolderArchivedError{}, err)
+}
+
+func TestKBFSOpsFolderQuota(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice,bob", false)
+	fb := rootNode1.GetFolderBranch()
+	status, _, err := kbfsOps1.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	limit := status.DiskUsage + 1024
+	require.NoError(t, kbfsOps1.SetFolderQuota(ctx, fb, limit))
+
+	// The limit is recorded in the MD, for every writer to see.
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	GetRootNodeOrBust(t, config2, "alice,bob", false)
+	status, _, err = config2.KBFSOps().FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, limit, status.QuotaLimit)
+
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode1, make([]byte, 4096), 0))
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.IsType(t, FolderQuotaExceededError{}, err)
+
+	// Once the limit is lifted, the same sync goes through.
+	require.NoError(t, kbfsOps1.SetFolderQuota(ctx, fb, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileNode1))
+
+	// A folder over its limit can't grow, but can still be
+	// cleaned up.
+	require.NoError(t, kbfsOps1.SetFolderQuota(ctx, fb, limit))
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.IsType(t, FolderQuotaExceededError{}, err)
+	require.NoError(t, kbfsOps1.RemoveEntry(ctx, rootNode1, "a"))
+}
+
+func TestKBFSOpsExportImportTLF(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockSplitter(&BlockSplitterSimple{
+		maxSize: 1024, blockChangeEmbedMaxSize: 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	tlfID := rootNode.GetFolderBranch().Tlf
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false)
+	require.NoError(t, err)
+	data := make([]byte, 10*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	require.NoError(t, kbfsOps.Write(ctx, fileNode, data, 0))
+	require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "link", "d/f")
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	require.NoError(t, kbfsOps.ExportTLF(ctx, tlfID, &archive))
+
+	// The archive only fits the folder it came from.
+	otherRootNode := GetRootNodeOrBust(t, config, "alice,bob", false)
+	err = kbfsOps.ImportTLF(ctx, otherRootNode.GetFolderBranch().Tlf,
+		bytes.NewReader(archive.Bytes()))
+	require.IsType(t, InvalidTLFArchiveError{}, err)
+
+	// And only once the folder is empty.
+	err = kbfsOps.ImportTLF(ctx, tlfID, bytes.NewReader(archive.Bytes()))
+	require.IsType(t, FolderNotEmptyError{}, err)
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, rootNode, "link"))
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, dirNode, "f"))
+	require.NoError(t, kbfsOps.RemoveDir(ctx, rootNode, "d"))
+	require.NoError(t, kbfsOps.ImportTLF(ctx, tlfID, &archive))
+
+	// Another device sees the restored files.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, Sym, children["link"].Type)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "f")
+	require.NoError(t, err)
+	got := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, got, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(data, got))
+}
+
+func TestKBFSOpsReadStream(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockSplitter(&BlockSplitterSimple{
+		maxSize: 1024, blockChangeEmbedMaxSize: 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := make([]byte, 10*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	// Leave a hole before some more data.
+	const tailOff = 1 << 20
+	tail := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, tail, tailOff)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Stream the file from another device, whose caches are empty.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	stream, err := kbfsOps2.ReadStream(ctx, fileNode2, 100)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	expected := make([]byte, tailOff+len(tail)-100)
+	copy(expected, data[100:])
+	copy(expected[tailOff-100:], tail)
+	require.True(t, bytes.Equal(expected, got))
+
+	// A stream can be closed before it's done.
+	stream, err = kbfsOps2.ReadStream(ctx, fileNode2, 0)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	n, err := stream.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, data[:n], buf[:n])
+	require.NoError(t, stream.Close())
+	_, err = stream.Read(buf)
+	require.Equal(t, io.ErrClosedPipe, err)
+
+	// Streams past the end of the file are empty.
+	stream, err = kbfsOps2.ReadStream(ctx, fileNode2, tailOff+10)
+	require.NoError(t, err)
+	_, err = stream.Read(buf)
+	require.Equal(t, io.EOF, err)
+
+	_, err = kbfsOps2.ReadStream(ctx, fileNode2, -1)
+	require.IsType(t, InvalidOpError{}, err)
+}
+
+func TestKBFSOpsWriteNoCopy(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetBlockSplitter(&BlockSplitterSimple{
+		maxSize: 1024, blockChangeEmbedMaxSize: 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	data := make([]byte, 2500, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	expected := append([]byte(nil), data...)
+	err = kbfsOps.WriteNoCopy(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	// The dirty blocks should be made of the written buffer.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	getChildren := func() []*FileBlock {
+		ops.blocks.blockLock.RLock(lState)
+		defer ops.blocks.blockLock.RUnlock(lState)
+		fblock, err := ops.blocks.getFileLocked(
+			ctx, lState, md, filePath, blockRead)
+		require.NoError(t, err)
+		require.True(t, fblock.IsInd)
+		var children []*FileBlock
+		for _, iptr := range fblock.IPtrs {
+			child, err := ops.blocks.getFileBlockLocked(
+				ctx, lState, md, iptr.BlockPointer, filePath, blockRead)
+			require.NoError(t, err)
+			children = append(children, child)
+		}
+		return children
+	}
+	children := getChildren()
+	require.Len(t, children, 3)
+	for i, child := range children {
+		require.True(t, &child.Contents[0] == &data[i*1024])
+	}
+
+	// Growing the last block mustn't write into the rest of the
+	// buffer.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 2500)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 3), data[2500:2503])
+	expected = append(expected, 1, 2, 3)
+
+	// Overwriting only part of a block copies as usual.
+	edit := []byte{4, 5, 6}
+	err = kbfsOps.WriteNoCopy(ctx, fileNode, edit, 1024)
+	require.NoError(t, err)
+	copy(expected[1024:], edit)
+	children = getChildren()
+	require.False(t, &children[1].Contents[0] == &edit[0])
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(expected))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(expected)), n)
+	require.True(t, bytes.Equal(expected, buf))
+}
+
+// bserverMaxBlockSize is a BlockServer that reports a max block size
+// to its clients, and rejects blocks that are bigger than it.
+type bserverMaxBlockSize struct {
+	BlockServer
+	maxBlockSize int64
+}
+
+func (b bserverMaxBlockSize) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	if int64(len(buf)) > b.maxBlockSize {
+		return BServerErrorBadRequest{Msg: fmt.Sprintf(
+			"Block of %d bytes is too big", len(buf))}
+	}
+	return b.BlockServer.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+func (b bserverMaxBlockSize) Capabilities(ctx context.Context) (
+	BlockServerCapabilities, error) {
+	return BlockServerCapabilities{MaxBlockSize: b.maxBlockSize}, nil
+}
+
+// Test that dirty blocks written before a block server lowered its
+// max block size are split up to fit, for both direct and indirect
+// files.
+func TestKBFSOpsResplitForServerMaxBlockSize(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	bsplit, err := NewBlockSplitterSimple(8*1024, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	rng := rand.New(rand.NewSource(1))
+	contents := map[string][]byte{
+		"direct":   make([]byte, 6*1024),
+		"indirect": make([]byte, 20*1024),
+	}
+	nodes := make(map[string]Node)
+	for name, data := range contents {
+		rng.Read(data)
+		nodes[name], _, err = kbfsOps.CreateFile(ctx, rootNode, name, false)
+		require.NoError(t, err)
+		require.NoError(t, kbfsOps.Write(ctx, nodes[name], data, 0))
+	}
+
+	// The server starts rejecting blocks that were fine when the
+	// files were written.
+	const maxBlockSize = 2*1024 + blockEncryptionOverhead
+	bserver := config.BlockServer()
+	config.SetBlockServer(bserverMaxBlockSize{bserver, maxBlockSize})
+	for name := range contents {
+		require.NoError(t, kbfsOps.Sync(ctx, nodes[name]), name)
+	}
+	require.True(t,
+		config.BlockSplitter().(*BlockSplitterSimple).maxSize < 2*1024)
+
+	// Read the files back from another device, with empty caches.
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	// The state checker only works against the local server.
+	defer func() {
+		config.SetBlockServer(bserver)
+		config2.SetBlockServer(bserver)
+	}()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	for name, data := range contents {
+		node, _, err := kbfsOps2.Lookup(ctx, rootNode2, name)
+		require.NoError(t, err)
+		buf := make([]byte, len(data)+1)
+		n, err := kbfsOps2.Read(ctx, node, buf, 0)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, buf[:n]), name)
+	}
+}
+
+func TestKBFSOpsTrash(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	require.NoError(t, kbfsOps.SetFolderTrashRetention(ctx, fb, time.Hour))
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false)
+	require.NoError(t, err)
+	data := []byte("hello")
+	require.NoError(t, kbfsOps.Write(ctx, fileNode, data, 0))
+	require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, dirNode, "f"))
+	_, _, err = kbfsOps.Lookup(ctx, dirNode, "f")
+	require.IsType(t, NoSuchNameError{}, err)
+	// Empty directories are deleted right away.
+	require.NoError(t, kbfsOps.RemoveDir(ctx, rootNode, "d"))
+
+	stamp := t0.UTC().Format(trashTimeFormat)
+	entries, err := kbfsOps.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "d/f", entries[0].Path)
+	require.Equal(t, stamp+"/d/f", entries[0].TrashPath)
+	require.True(t, entries[0].Removed.Equal(t0.Truncate(time.Second)))
+	require.Equal(t, File, entries[0].Type)
+	require.Equal(t, uint64(len(data)), entries[0].Size)
+
+	// Restoring recreates the directory.
+	err = kbfsOps.RestoreFromTrash(ctx, fb, "d/f")
+	require.IsType(t, InvalidTrashPathError{}, err)
+	require.NoError(t, kbfsOps.RestoreFromTrash(ctx, fb, stamp+"/d/f"))
+	dirNode, _, err = kbfsOps.Lookup(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err = kbfsOps.Lookup(ctx, dirNode, "f")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	// A file with the same path removed in the same second gets a
+	// finer-grained removal time, and a restore can't overwrite
+	// anything.
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, dirNode, "f"))
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "f", false)
+	require.NoError(t, err)
+	err = kbfsOps.RestoreFromTrash(ctx, fb, stamp+"/d/f")
+	require.IsType(t, NameExistsError{}, err)
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, dirNode, "f"))
+	entries, err = kbfsOps.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, stamp+"/d/f", entries[0].TrashPath)
+	require.Equal(t, t0.UTC().Format(trashTimeFormatNano)+"/d/f",
+		entries[1].TrashPath)
+
+	// Removing from the trash deletes for good.
+	trashNode, _, err := kbfsOps.Lookup(ctx, rootNode, trashDirName)
+	require.NoError(t, err)
+	stampNode, _, err := kbfsOps.Lookup(ctx, trashNode, stamp)
+	require.NoError(t, err)
+	trashDirNode, _, err := kbfsOps.Lookup(ctx, stampNode, "d")
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, trashDirNode, "f"))
+	entries, err = kbfsOps.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// Nothing is purged until the retention period is up.
+	ops := kbfsOps.(*KBFSOpsStandard)
+	ops.purgeTrash(ctx, clock.Now())
+	entries, err = kbfsOps.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	clock.Add(2 * time.Hour)
+	ops.purgeTrash(ctx, clock.Now())
+	entries, err = kbfsOps.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	children, err := kbfsOps.GetDirChildren(ctx, trashNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+
+	require.NoError(t, kbfsOps.EmptyTrash(ctx, fb))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, trashDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+}
+
+// Test that the trash retention of a folder applies to every writer,
+// since it's recorded in the folder's MD.
+func TestKBFSOpsTrashRetentionShared(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+	clock, _ := newTestClockAndTimeNow()
+	config1.SetClock(clock)
+
+	kbfsOps1 := config1.KBFSOps()
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice,bob", false)
+	fb := rootNode1.GetFolderBranch()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps1.SetFolderTrashRetention(ctx, fb, time.Hour))
+	err = kbfsOps1.SetFolderTrashRetention(ctx, fb, -time.Hour)
+	require.Error(t, err)
+
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetClock(clock)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice,bob", false)
+	status, _, err := kbfsOps2.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, time.Hour.String(), status.TrashRetention)
+
+	// bob's removal goes to the trash, even though he never set a
+	// retention himself.
+	require.NoError(t, kbfsOps2.RemoveEntry(ctx, rootNode2, "a"))
+	entries, err := kbfsOps2.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "a", entries[0].Path)
+
+	// Once alice turns the trash off, bob's removals are
+	// immediate, and the next purge empties the trash.
+	require.NoError(t, kbfsOps1.SyncFromServerForTesting(ctx, fb))
+	require.NoError(t, kbfsOps1.SetFolderTrashRetention(ctx, fb, 0))
+	require.NoError(t, kbfsOps2.SyncFromServerForTesting(ctx, fb))
+	require.NoError(t, kbfsOps2.RemoveEntry(ctx, rootNode2, "b"))
+	clock.Add(time.Second)
+	kbfsOps2.(*KBFSOpsStandard).purgeTrash(ctx, clock.Now())
+	entries, err = kbfsOps2.ListTrash(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	status, _, err = kbfsOps2.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "", status.TrashRetention)
+}
@@ -73,7 +73,20 @@ func (k *KBPKIClient) GetCurrentVerifyingKey(ctx context.Context) (
 // Resolve implements the KBPKI interface for KBPKIClient.
 func (k *KBPKIClient) Resolve(ctx context.Context, assertion string) (
 	libkb.NormalizedUsername, keybase1.UID, error) {
-	return k.config.KeybaseDaemon().Resolve(ctx, assertion)
+	cache := k.config.ResolveCache()
+	if cache != nil {
+		if name, uid, ok := cache.Get(assertion); ok {
+			return name, uid, nil
+		}
+	}
+	name, uid, err := k.config.KeybaseDaemon().Resolve(ctx, assertion)
+	if err != nil {
+		return libkb.NormalizedUsername(""), keybase1.UID(""), err
+	}
+	if cache != nil {
+		cache.Put(assertion, name, uid)
+	}
+	return name, uid, nil
 }
 
 // Identify implements the KBPKI interface for KBPKIClient.
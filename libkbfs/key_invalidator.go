@@ -0,0 +1,147 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// KeyRotationStatus describes the rotation of a folder's crypt keys
+// after a device of one of its members was revoked.  It is suitable
+// for encoding directly as JSON.
+type KeyRotationStatus struct {
+	// Folder is the canonical path of the folder.
+	Folder string
+	// RevokedUser is the member whose device was revoked.
+	RevokedUser string
+	// OldKeyGen is the folder's latest key generation when the
+	// revocation was noticed.
+	OldKeyGen KeyGen
+	// NewKeyGen is the folder's latest key generation once the
+	// rotation finished.
+	NewKeyGen KeyGen `json:",omitempty"`
+	// Pending is true until the rotation finishes.
+	Pending bool
+	// Err is the error the rotation failed with, if any.
+	Err string `json:",omitempty"`
+}
+
+// keyRotationTimeout bounds how long the key rotations started by a
+// single change to a user may take altogether.  A folder that isn't
+// rotated by then gets new keys at its next rekey instead.
+const keyRotationTimeout = 5 * time.Minute
+
+type keyRotationsByFolder []KeyRotationStatus
+
+func (r keyRotationsByFolder) Len() int           { return len(r) }
+func (r keyRotationsByFolder) Less(i, j int) bool { return r[i].Folder < r[j].Folder }
+func (r keyRotationsByFolder) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// keyInvalidator keeps track of which devices have been revoked, so
+// that the crypt keys of the folders their users belong to can be
+// rotated as soon as a new revocation is noticed, instead of letting
+// the revoked device keep reading with its cached keys until the
+// next rekey.
+type keyInvalidator struct {
+	lock sync.Mutex
+	// revoked holds the revoked crypt keys seen so far for each
+	// user.
+	revoked map[keybase1.UID]map[CryptPublicKey]bool
+	// rotations holds the latest rotation of each folder.
+	rotations map[TlfID]KeyRotationStatus
+}
+
+func newKeyInvalidator() *keyInvalidator {
+	return &keyInvalidator{
+		revoked:   make(map[keybase1.UID]map[CryptPublicKey]bool),
+		rotations: make(map[TlfID]KeyRotationStatus),
+	}
+}
+
+// isTracking returns whether the revoked keys of the given user have
+// been recorded yet.
+func (ki *keyInvalidator) isTracking(uid keybase1.UID) bool {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	return ki.revoked[uid] != nil
+}
+
+// seedRevokedKeys records the given revoked keys of a user as seen,
+// unless that user's revoked keys are already being tracked.  It's
+// meant for the keys that were revoked before this process started,
+// and that no folder's current keys are encrypted for anymore, so
+// that noticing them for the first time doesn't rotate every folder
+// the user is in.
+func (ki *keyInvalidator) seedRevokedKeys(
+	uid keybase1.UID, keys []CryptPublicKey) {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	if ki.revoked[uid] != nil {
+		return
+	}
+	seen := make(map[CryptPublicKey]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	ki.revoked[uid] = seen
+}
+
+// noteRevokedKeys records the given revoked keys of a user, and
+// returns true if any of them hadn't been seen before.
+func (ki *keyInvalidator) noteRevokedKeys(uid keybase1.UID,
+	keys map[CryptPublicKey]keybase1.KeybaseTime) bool {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	seen := ki.revoked[uid]
+	if seen == nil {
+		seen = make(map[CryptPublicKey]bool)
+		ki.revoked[uid] = seen
+	}
+	foundNew := false
+	for key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			foundNew = true
+		}
+	}
+	return foundNew
+}
+
+func (ki *keyInvalidator) startRotation(id TlfID, status KeyRotationStatus) {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	status.Pending = true
+	ki.rotations[id] = status
+}
+
+func (ki *keyInvalidator) finishRotation(
+	id TlfID, newKeyGen KeyGen, err error) {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	status := ki.rotations[id]
+	status.Pending = false
+	status.NewKeyGen = newKeyGen
+	if err != nil {
+		status.Err = err.Error()
+	}
+	ki.rotations[id] = status
+}
+
+// getRotations returns the latest rotation of each folder, sorted by
+// folder.
+func (ki *keyInvalidator) getRotations() []KeyRotationStatus {
+	ki.lock.Lock()
+	defer ki.lock.Unlock()
+	rotations := make([]KeyRotationStatus, 0, len(ki.rotations))
+	for _, status := range ki.rotations {
+		rotations = append(rotations, status)
+	}
+	sort.Sort(keyRotationsByFolder(rotations))
+	return rotations
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
@@ -101,6 +102,12 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 		return TLFCryptKey{}, err
 	}
 
+	if km.config.Mode() == InitPaperKeyRecovery {
+		// The paper key stands in for the current device, and
+		// there are no other keys to try or to prompt for.
+		flags &^= getTLFCryptKeyAnyDevice | getTLFCryptKeyPromptPaper
+	}
+
 	// Get the encrypted version of this secret key for this device
 	kbpki := km.config.KBPKI()
 	username, uid, err := kbpki.GetCurrentUserInfo(ctx)
@@ -408,6 +415,10 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 		return false, nil, fmt.Errorf("promptPaper set for public TLF %v", md.ID)
 	}
 
+	if km.config.Mode().IsReadOnly() {
+		return false, nil, ReadOnlyBranchError{FolderBranch{md.ID, MasterBranch}}
+	}
+
 	handle := md.GetTlfHandle()
 
 	username, uid, err := km.config.KBPKI().GetCurrentUserInfo(ctx)
@@ -693,3 +704,157 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 
 	return true, &tlfCryptKey, nil
 }
+
+type tlfKeyDevice struct {
+	uid keybase1.UID
+	kid keybase1.KID
+}
+
+type tlfKeyDeviceHistoryList []TLFKeyDeviceHistory
+
+func (l tlfKeyDeviceHistoryList) Len() int {
+	return len(l)
+}
+
+func (l tlfKeyDeviceHistoryList) Less(i, j int) bool {
+	if l[i].AddedRevision != l[j].AddedRevision {
+		return l[i].AddedRevision < l[j].AddedRevision
+	}
+	if l[i].User != l[j].User {
+		return l[i].User < l[j].User
+	}
+	return l[i].Device.String() < l[j].Device.String()
+}
+
+func (l tlfKeyDeviceHistoryList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// GetTLFCryptKeyHistory implements the KeyManager interface for
+// KeyManagerStandard.
+func (km *KeyManagerStandard) GetTLFCryptKeyHistory(ctx context.Context,
+	tlfID TlfID) (history TLFCryptKeyHistory, err error) {
+	km.log.CDebugf(ctx, "GetTLFCryptKeyHistory %s", tlfID)
+	defer func() { km.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	// These MDs have all been verified, so the key bundles in them
+	// are exactly the ones their writers signed.
+	rmds, err := getMergedMDUpdates(ctx, km.config, tlfID,
+		MetadataRevisionInitial)
+	if err != nil {
+		return TLFCryptKeyHistory{}, err
+	}
+	history.ID = tlfID.String()
+	if len(rmds) == 0 {
+		return history, nil
+	}
+	history.Name = string(rmds[len(rmds)-1].GetTlfHandle().GetCanonicalPath())
+
+	names := make(map[keybase1.UID]string)
+	getName := func(uid keybase1.UID) (string, error) {
+		if name, ok := names[uid]; ok {
+			return name, nil
+		}
+		name, err := km.config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			return "", err
+		}
+		names[uid] = string(name)
+		return string(name), nil
+	}
+
+	// For each key generation, the index in its Devices list of each
+	// device that currently has the key generation.
+	var current []map[tlfKeyDevice]int
+	for _, rmd := range rmds {
+		changed := false
+		for i := range rmd.WKeys {
+			if i >= len(history.Generations) {
+				history.Generations = append(history.Generations,
+					TLFKeyGenerationHistory{
+						KeyGen:   KeyGen(FirstValidKeyGen + i),
+						Revision: rmd.Revision,
+					})
+				current = append(current, make(map[tlfKeyDevice]int))
+				changed = true
+			}
+			gen := &history.Generations[i]
+
+			seen := make(map[tlfKeyDevice]bool)
+			addDevices := func(info UserDeviceKeyInfoMap, writer bool) error {
+				for uid, devices := range info {
+					for kid := range devices {
+						d := tlfKeyDevice{uid, kid}
+						seen[d] = true
+						if _, ok := current[i][d]; ok {
+							continue
+						}
+						name, err := getName(uid)
+						if err != nil {
+							return err
+						}
+						current[i][d] = len(gen.Devices)
+						gen.Devices = append(gen.Devices, TLFKeyDeviceHistory{
+							User:          name,
+							Writer:        writer,
+							Device:        kid,
+							AddedRevision: rmd.Revision,
+						})
+						changed = true
+					}
+				}
+				return nil
+			}
+			if err := addDevices(rmd.WKeys[i].WKeys, true); err != nil {
+				return TLFCryptKeyHistory{}, err
+			}
+			if i < len(rmd.RKeys) {
+				err := addDevices(rmd.RKeys[i].RKeys, false)
+				if err != nil {
+					return TLFCryptKeyHistory{}, err
+				}
+			}
+
+			for d, index := range current[i] {
+				if !seen[d] {
+					gen.Devices[index].RemovedRevision = rmd.Revision
+					delete(current[i], d)
+					changed = true
+				}
+			}
+		}
+
+		if !changed {
+			continue
+		}
+		user, err := getName(rmd.LastModifyingUser)
+		if err != nil {
+			return TLFCryptKeyHistory{}, err
+		}
+		history.Rekeys = append(history.Rekeys, TLFRekeySummary{
+			Revision: rmd.Revision,
+			User:     user,
+			KeyGen:   rmd.LatestKeyGeneration(),
+		})
+	}
+
+	for _, gen := range history.Generations {
+		sort.Sort(tlfKeyDeviceHistoryList(gen.Devices))
+	}
+
+	// Verified MDs don't keep the server's timestamps, so look them
+	// up separately.  They're only informational, and so don't need
+	// to be verified.
+	for i, rekey := range history.Rekeys {
+		signed, err := km.config.MDServer().GetRange(ctx, tlfID,
+			NullBranchID, Merged, rekey.Revision, rekey.Revision)
+		if err != nil {
+			return TLFCryptKeyHistory{}, err
+		}
+		if len(signed) == 1 {
+			history.Rekeys[i].Date = signed[0].untrustedServerTimestamp
+		}
+	}
+
+	return history, nil
+}
@@ -610,6 +610,182 @@ func TestKeyManagerRekeyResolveAgainNoChangeSuccessPrivate(t *testing.T) {
 	require.Equal(t, newH.ToBareHandleOrBust(), newBareH)
 }
 
+func TestKBFSOpsRotateKeysAfterRevocation(t *testing.T) {
+	var u1, u2, u3 libkb.NormalizedUsername = "u1", "u2", "u3"
+	config1, _, ctx := kbfsOpsConcurInit(t, u1, u2, u3)
+	defer CheckConfigAndShutdown(t, config1)
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+	_, uid2, err := config1.KBPKI().Resolve(ctx, u2.String())
+	require.NoError(t, err)
+
+	// u1 writes to a folder shared with u2, and one shared with u3.
+	kbfsOps1 := config1.KBFSOps()
+	var handle12 *TlfHandle
+	for _, name := range []string{"u1,u2", "u1,u3"} {
+		rootNode := GetRootNodeOrBust(t, config1, name, false)
+		_, _, err = kbfsOps1.CreateFile(ctx, rootNode, "a", false)
+		require.NoError(t, err)
+		if name == "u1,u2" {
+			handle12 = config1.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(
+				rootNode.GetFolderBranch()).getHead(
+				makeFBOLockState()).GetTlfHandle()
+		}
+	}
+
+	// Nothing has been revoked yet.
+	err = kbfsOps1.RotateKeysAfterRevocation(ctx, uid2)
+	require.NoError(t, err)
+	rotations, err := kbfsOps1.KeyRotations(ctx)
+	require.NoError(t, err)
+	require.Len(t, rotations, 0)
+
+	// u2 replaces their device.
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, 0)
+
+	// Only the folder shared with u2 gets a new key generation.
+	expectedRotations := []KeyRotationStatus{{
+		Folder:      handle12.GetCanonicalPath(),
+		RevokedUser: "u2",
+		OldKeyGen:   FirstValidKeyGen,
+		NewKeyGen:   FirstValidKeyGen + 1,
+	}}
+	err = kbfsOps1.RotateKeysAfterRevocation(ctx, uid2)
+	require.NoError(t, err)
+	rotations, err = kbfsOps1.KeyRotations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expectedRotations, rotations)
+
+	// The same revocation doesn't rotate the keys again.
+	err = kbfsOps1.RotateKeysAfterRevocation(ctx, uid2)
+	require.NoError(t, err)
+	rotations, err = kbfsOps1.KeyRotations(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expectedRotations, rotations)
+
+	// Nor does another process that only learns of it after the
+	// keys were rotated.
+	config1b := ConfigAsUser(config1.(*ConfigLocal), u1)
+	defer CheckConfigAndShutdown(t, config1b)
+	GetRootNodeOrBust(t, config1b, "u1,u2", false)
+	kbfsOps1b := config1b.KBFSOps()
+	err = kbfsOps1b.RotateKeysAfterRevocation(ctx, uid2)
+	require.NoError(t, err)
+	rotations, err = kbfsOps1b.KeyRotations(ctx)
+	require.NoError(t, err)
+	require.Len(t, rotations, 0)
+}
+
+func TestKeyManagerGetTLFCryptKeyHistory(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx := kbfsOpsConcurInit(t, u1, u2)
+	defer CheckConfigAndShutdown(t, config1)
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+	_, uid2, err := config1.KBPKI().Resolve(ctx, u2.String())
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config1, "u1,u2", false)
+	kbfsOps1 := config1.KBFSOps()
+	folderBranch := rootNode.GetFolderBranch()
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+
+	u1Keys, err := config1.KBPKI().GetCryptPublicKeys(ctx, uid1)
+	require.NoError(t, err)
+	u2Keys, err := config1.KBPKI().GetCryptPublicKeys(ctx, uid2)
+	require.NoError(t, err)
+
+	// u2 gets a new device, which gets added to the existing key
+	// generation.
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	u2NewKeys, err := config1.KBPKI().GetCryptPublicKeys(ctx, uid2)
+	require.NoError(t, err)
+	require.Len(t, u2NewKeys, 2)
+	err = kbfsOps1.Rekey(ctx, folderBranch.Tlf)
+	require.NoError(t, err)
+	addHead, _, err := kbfsOps1.GetFolderHead(ctx, folderBranch)
+	require.NoError(t, err)
+
+	// u2's old device gets revoked, so there's a new key generation
+	// without it.
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, 0)
+	err = kbfsOps1.Rekey(ctx, folderBranch.Tlf)
+	require.NoError(t, err)
+	revokeHead, _, err := kbfsOps1.GetFolderHead(ctx, folderBranch)
+	require.NoError(t, err)
+
+	history, err := config1.KeyManager().GetTLFCryptKeyHistory(
+		ctx, folderBranch.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, folderBranch.Tlf.String(), history.ID)
+	require.Equal(t, "/keybase/private/u1,u2", history.Name)
+
+	oldDevice := u2Keys[0].KID()
+	newDevice := u2NewKeys[1].KID()
+	if newDevice == oldDevice {
+		newDevice = u2NewKeys[0].KID()
+	}
+	u1Device := TLFKeyDeviceHistory{
+		User:          "u1",
+		Writer:        true,
+		Device:        u1Keys[0].KID(),
+		AddedRevision: MetadataRevisionInitial,
+	}
+	require.Equal(t, []TLFKeyGenerationHistory{
+		{
+			KeyGen:   FirstValidKeyGen,
+			Revision: MetadataRevisionInitial,
+			Devices: []TLFKeyDeviceHistory{
+				u1Device,
+				{
+					User:            "u2",
+					Writer:          true,
+					Device:          oldDevice,
+					AddedRevision:   MetadataRevisionInitial,
+					RemovedRevision: revokeHead.Revision,
+				},
+				{
+					User:          "u2",
+					Writer:        true,
+					Device:        newDevice,
+					AddedRevision: addHead.Revision,
+				},
+			},
+		},
+		{
+			KeyGen:   FirstValidKeyGen + 1,
+			Revision: revokeHead.Revision,
+			Devices: []TLFKeyDeviceHistory{
+				{
+					User:          "u1",
+					Writer:        true,
+					Device:        u1Keys[0].KID(),
+					AddedRevision: revokeHead.Revision,
+				},
+				{
+					User:          "u2",
+					Writer:        true,
+					Device:        newDevice,
+					AddedRevision: revokeHead.Revision,
+				},
+			},
+		},
+	}, history.Generations)
+
+	require.Len(t, history.Rekeys, 3)
+	for i, rev := range []MetadataRevision{
+		MetadataRevisionInitial, addHead.Revision, revokeHead.Revision} {
+		require.Equal(t, rev, history.Rekeys[i].Revision)
+		require.Equal(t, "u1", history.Rekeys[i].User)
+		require.False(t, history.Rekeys[i].Date.IsZero())
+	}
+	require.Equal(t, KeyGen(FirstValidKeyGen+1), history.Rekeys[2].KeyGen)
+}
+
 func TestKeyManagerRekeyAddAndRevokeDevice(t *testing.T) {
 	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
 	config1, _, ctx := kbfsOpsConcurInit(t, u1, u2)
@@ -10,15 +10,13 @@ import (
 
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 	"golang.org/x/net/context"
 )
 
-// KeyServerLocal puts/gets key server halves in/from a local leveldb instance.
+// KeyServerLocal puts/gets key server halves in/from a local kvStore instance.
 type KeyServerLocal struct {
 	config Config
-	db     *leveldb.DB // TLFCryptKeyServerHalfID -> TLFCryptKeyServerHalf
+	db     kvStore // TLFCryptKeyServerHalfID -> TLFCryptKeyServerHalf
 	log    logger.Logger
 
 	shutdown     *bool
@@ -28,9 +26,11 @@ type KeyServerLocal struct {
 // Test that KeyServerLocal fully implements the KeyServer interface.
 var _ KeyServer = (*KeyServerLocal)(nil)
 
-func newKeyServerLocalWithStorage(config Config, storage storage.Storage) (
+// newKeyServerLocalWithDir constructs a KeyServerLocal that keeps its
+// store in the given directory, or in memory if dirPath is empty.
+func newKeyServerLocalWithDir(config Config, dirPath string) (
 	*KeyServerLocal, error) {
-	db, err := leveldb.Open(storage, leveldbOptions)
+	db, err := openKVStore(config, "KeyServer", dirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -39,20 +39,16 @@ func newKeyServerLocalWithStorage(config Config, storage storage.Storage) (
 	return kops, nil
 }
 
-// NewKeyServerLocal returns a KeyServerLocal with a leveldb instance at the
+// NewKeyServerLocal returns a KeyServerLocal with a kvStore instance at the
 // given file.
 func NewKeyServerLocal(config Config, dbfile string) (*KeyServerLocal, error) {
-	storage, err := storage.OpenFile(dbfile)
-	if err != nil {
-		return nil, err
-	}
-	return newKeyServerLocalWithStorage(config, storage)
+	return newKeyServerLocalWithDir(config, dbfile)
 }
 
-// NewKeyServerMemory returns a KeyServerLocal with an in-memory leveldb
+// NewKeyServerMemory returns a KeyServerLocal with an in-memory kvStore
 // instance.
 func NewKeyServerMemory(config Config) (*KeyServerLocal, error) {
-	return newKeyServerLocalWithStorage(config, storage.NewMemStorage())
+	return newKeyServerLocalWithDir(config, "")
 }
 
 // GetTLFCryptKeyServerHalf implements the KeyServer interface for
@@ -65,7 +61,7 @@ func (ks *KeyServerLocal) GetTLFCryptKeyServerHalf(ctx context.Context,
 		err = errors.New("Key server already shut down")
 	}
 
-	buf, err := ks.db.Get(serverHalfID.ID.Bytes(), nil)
+	buf, err := ks.db.Get(serverHalfID.ID.Bytes())
 	if err != nil {
 		return
 	}
@@ -99,7 +95,7 @@ func (ks *KeyServerLocal) PutTLFCryptKeyServerHalves(ctx context.Context,
 	}
 
 	// batch up the writes such that they're atomic.
-	batch := &leveldb.Batch{}
+	batch := &kvBatch{}
 	crypto := ks.config.Crypto()
 	for uid, deviceMap := range serverKeyHalves {
 		for deviceKID, serverHalf := range deviceMap {
@@ -114,7 +110,7 @@ func (ks *KeyServerLocal) PutTLFCryptKeyServerHalves(ctx context.Context,
 			batch.Put(id.ID.Bytes(), buf)
 		}
 	}
-	return ks.db.Write(batch, nil)
+	return ks.db.Write(batch)
 }
 
 // DeleteTLFCryptKeyServerHalf implements the KeyOps interface for
@@ -130,7 +126,7 @@ func (ks *KeyServerLocal) DeleteTLFCryptKeyServerHalf(ctx context.Context,
 
 	// TODO: verify that the kid is really valid for the given uid
 
-	if err := ks.db.Delete(serverHalfID.ID.Bytes(), nil); err != nil {
+	if err := ks.db.Delete(serverHalfID.ID.Bytes()); err != nil {
 		return err
 	}
 	return nil
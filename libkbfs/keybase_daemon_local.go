@@ -12,9 +12,8 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type localUserMap map[keybase1.UID]LocalUser
@@ -37,7 +36,7 @@ type favoriteStore interface {
 
 type diskFavoriteClient struct {
 	currentUID keybase1.UID
-	favoriteDb *leveldb.DB
+	favoriteDb kvStore
 	codec      Codec
 }
 
@@ -53,15 +52,16 @@ func (c diskFavoriteClient) FavoriteAdd(folder keybase1.Folder) error {
 		return err
 	}
 
-	return c.favoriteDb.Put(c.favkey(folder), enc, nil)
+	return c.favoriteDb.Put(c.favkey(folder), enc)
 }
 
 func (c diskFavoriteClient) FavoriteDelete(folder keybase1.Folder) error {
-	return c.favoriteDb.Delete(c.favkey(folder), nil)
+	return c.favoriteDb.Delete(c.favkey(folder))
 }
 
 func (c diskFavoriteClient) FavoriteList(sessionID int) ([]keybase1.Folder, error) {
-	iter := c.favoriteDb.NewIterator(util.BytesPrefix([]byte(c.currentUID+":")), nil)
+	prefix := []byte(c.currentUID + ":")
+	iter := c.favoriteDb.NewIterator(prefix, kvPrefixLimit(prefix))
 	defer iter.Release()
 	var folders []keybase1.Folder
 	for iter.Next() {
@@ -404,7 +404,9 @@ func (k *KeybaseDaemonLocal) Shutdown() {
 // Any storage (e.g. the favorites) persists to disk.
 func NewKeybaseDaemonDisk(currentUID keybase1.UID, users []LocalUser,
 	favDBFile string, codec Codec) (*KeybaseDaemonLocal, error) {
-	favoriteDb, err := leveldb.OpenFile(favDBFile, leveldbOptions)
+	// There's no config to log with, or to measure the store with.
+	favoriteDb, err := openKVStoreLeveldbFile(
+		"Favorites", favDBFile, logger.NewNull())
 	if err != nil {
 		return nil, err
 	}
@@ -213,7 +213,10 @@ func (k *KeybaseDaemonRPC) LoggedIn(ctx context.Context, name string) error {
 	if k.config != nil {
 		k.config.MDServer().RefreshAuthToken(ctx)
 		k.config.BlockServer().RefreshAuthToken(ctx)
-		k.config.KBFSOps().RefreshCachedFavorites(ctx)
+		if err := k.config.KBFSOps().Login(ctx); err != nil {
+			k.log.CDebugf(ctx, "Couldn't set up state for %s: %v",
+				name, err)
+		}
 	}
 	return nil
 }
@@ -221,6 +224,13 @@ func (k *KeybaseDaemonRPC) LoggedIn(ctx context.Context, name string) error {
 // LoggedOut implements keybase1.NotifySessionInterface.
 func (k *KeybaseDaemonRPC) LoggedOut(ctx context.Context) error {
 	k.log.CDebugf(ctx, "Current session logged out")
+	if k.config != nil {
+		// Tear down the user's state while the cached session
+		// still says who they were.
+		if err := k.config.KBFSOps().Logout(ctx); err != nil {
+			k.log.CDebugf(ctx, "Error tearing down user state: %v", err)
+		}
+	}
 	k.setCachedCurrentSession(SessionInfo{})
 	if k.config != nil {
 		k.config.MDServer().RefreshAuthToken(ctx)
@@ -234,11 +244,45 @@ func (k *KeybaseDaemonRPC) LoggedOut(ctx context.Context) error {
 func (k *KeybaseDaemonRPC) UserChanged(ctx context.Context, uid keybase1.UID) error {
 	k.log.CDebugf(ctx, "User %s changed", uid)
 	k.setCachedUserInfo(uid, UserInfo{})
+	if k.config != nil {
+		if cache := k.config.ResolveCache(); cache != nil {
+			// The user's proofs or memberships may have
+			// changed what their assertions resolve to.
+			cache.InvalidateUser(uid)
+		}
+	}
 
 	if k.getCachedCurrentSession().UID == uid {
 		// Ignore any errors for now, we don't want to block this
 		// notification and it's not worth spawning a goroutine for.
 		k.config.MDServer().CheckForRekeys(context.Background())
+
+		// The change might be the revocation of this device.
+		// This needs to load the user from the daemon, so don't
+		// block the notification on it.
+		go func() {
+			ctx := context.Background()
+			if err := k.config.KBFSOps().CheckDeviceRevocation(
+				ctx); err != nil {
+				k.log.CDebugf(ctx, "Couldn't check for device "+
+					"revocation: %v", err)
+			}
+		}()
+	}
+
+	if k.config != nil {
+		// If one of the user's devices was revoked, the keys of the
+		// folders they share with us need to be rotated.
+		go func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), keyRotationTimeout)
+			defer cancel()
+			if err := k.config.KBFSOps().RotateKeysAfterRevocation(
+				ctx, uid); err != nil {
+				k.log.CDebugf(ctx, "Couldn't rotate keys after a "+
+					"revocation: %v", err)
+			}
+		}()
 	}
 
 	return nil
@@ -287,9 +287,27 @@ func TestKeybaseDaemonUserCache(t *testing.T) {
 		func(ctx context.Context) {
 			errChan <- nil
 		}).Return(errChan)
+	// It should also check whether this device was revoked.
+	revokeCheckChan := make(chan struct{})
+	config.mockKbfs.EXPECT().CheckDeviceRevocation(gomock.Any()).Do(
+		func(ctx context.Context) {
+			close(revokeCheckChan)
+		}).Return(nil)
+	// Any user change should check whether folder keys need to be
+	// rotated after a revocation.
+	rotateChan := make(chan keybase1.UID, 2)
+	config.mockKbfs.EXPECT().RotateKeysAfterRevocation(
+		gomock.Any(), gomock.Any()).Do(
+		func(ctx context.Context, uid keybase1.UID) {
+			rotateChan <- uid
+		}).Return(nil).Times(2)
 	err = c.UserChanged(context.Background(), uid1)
 	<-errChan
-	// This one shouldn't trigger CheckForRekeys; if it does, the mock
-	// controller will catch it during Finish.
+	<-revokeCheckChan
+	assert.Equal(t, uid1, <-rotateChan)
+	// This one shouldn't trigger CheckForRekeys or
+	// CheckDeviceRevocation; if it does, the mock controller will
+	// catch it during Finish.
 	err = c.UserChanged(context.Background(), uid2)
+	assert.Equal(t, uid2, <-rotateChan)
 }
@@ -0,0 +1,250 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// KeyringDevice is one device of a KeyringUser, with the public halves
+// of its keys, as KIDs.
+type KeyringDevice struct {
+	Name           string
+	VerifyingKey   string
+	CryptPublicKey string
+}
+
+// KeyringUser is one user in a Keyring.
+type KeyringUser struct {
+	Name string
+	UID  string
+	// Asserts holds other names the user can be referred to by in
+	// folder names, like "alice@github".  They must be on services
+	// that Keybase assertions support.
+	Asserts []string `json:",omitempty"`
+	Devices []KeyringDevice
+}
+
+// Keyring is a static directory of users and the public keys of their
+// devices, encoded as JSON.  It lets KBFS run against an
+// organization's own identity infrastructure, instead of the Keybase
+// service: the organization generates the keyring from its own user
+// directory, and distributes it to every device, along with each
+// device's KeyringDeviceSecrets.  Users are resolved, and their keys
+// trusted, exactly as listed, so the keyring must come from a trusted
+// source.
+type Keyring struct {
+	Users []KeyringUser
+}
+
+// KeyringDeviceSecrets holds the secret keys of one device listed in
+// a Keyring, as hex, and must be kept private to that device.
+type KeyringDeviceSecrets struct {
+	User            string
+	Device          string
+	SigningKey      string
+	CryptPrivateKey string
+}
+
+// ReadKeyring reads a Keyring from the given JSON file.
+func ReadKeyring(path string) (Keyring, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Keyring{}, err
+	}
+	var keyring Keyring
+	err = json.Unmarshal(buf, &keyring)
+	return keyring, err
+}
+
+// ReadKeyringDeviceSecrets reads a KeyringDeviceSecrets from the
+// given JSON file.
+func ReadKeyringDeviceSecrets(path string) (KeyringDeviceSecrets, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return KeyringDeviceSecrets{}, err
+	}
+	var secrets KeyringDeviceSecrets
+	err = json.Unmarshal(buf, &secrets)
+	return secrets, err
+}
+
+// MakeRandomKeyringUID returns a new random UID for a KeyringUser.
+func MakeRandomKeyringUID() (keybase1.UID, error) {
+	buf := make([]byte, keybase1.UID_LEN)
+	err := cryptoRandRead(buf[:len(buf)-1])
+	if err != nil {
+		return keybase1.UID(""), err
+	}
+	buf[len(buf)-1] = keybase1.UID_SUFFIX
+	return keybase1.UIDFromString(hex.EncodeToString(buf))
+}
+
+// MakeRandomKeyringDevice returns a new device, with random keys, for
+// the given user, and the secrets to install on it.
+func MakeRandomKeyringDevice(user libkb.NormalizedUsername, name string) (
+	KeyringDevice, KeyringDeviceSecrets, error) {
+	var signingSecret SigningKeySecret
+	if err := cryptoRandRead(signingSecret.secret[:]); err != nil {
+		return KeyringDevice{}, KeyringDeviceSecrets{}, err
+	}
+	signingKey, err := makeSigningKey(signingSecret)
+	if err != nil {
+		return KeyringDevice{}, KeyringDeviceSecrets{}, err
+	}
+	var cryptSecret CryptPrivateKeySecret
+	if err := cryptoRandRead(cryptSecret.secret[:]); err != nil {
+		return KeyringDevice{}, KeyringDeviceSecrets{}, err
+	}
+	cryptPrivateKey, err := makeCryptPrivateKey(cryptSecret)
+	if err != nil {
+		return KeyringDevice{}, KeyringDeviceSecrets{}, err
+	}
+	device := KeyringDevice{
+		Name:           name,
+		VerifyingKey:   signingKey.GetVerifyingKey().KID().String(),
+		CryptPublicKey: cryptPrivateKey.getPublicKey().KID().String(),
+	}
+	secrets := KeyringDeviceSecrets{
+		User:            string(user),
+		Device:          name,
+		SigningKey:      hex.EncodeToString(signingSecret.secret[:]),
+		CryptPrivateKey: hex.EncodeToString(cryptSecret.secret[:]),
+	}
+	return device, secrets, nil
+}
+
+// Keys returns the device's secret keys.
+func (s KeyringDeviceSecrets) Keys() (SigningKey, CryptPrivateKey, error) {
+	var signingSecret SigningKeySecret
+	if err := decodeKeyringSecret(
+		s.SigningKey, signingSecret.secret[:]); err != nil {
+		return SigningKey{}, CryptPrivateKey{}, err
+	}
+	signingKey, err := makeSigningKey(signingSecret)
+	if err != nil {
+		return SigningKey{}, CryptPrivateKey{}, err
+	}
+	var cryptSecret CryptPrivateKeySecret
+	if err := decodeKeyringSecret(
+		s.CryptPrivateKey, cryptSecret.secret[:]); err != nil {
+		return SigningKey{}, CryptPrivateKey{}, err
+	}
+	cryptPrivateKey, err := makeCryptPrivateKey(cryptSecret)
+	if err != nil {
+		return SigningKey{}, CryptPrivateKey{}, err
+	}
+	return signingKey, cryptPrivateKey, nil
+}
+
+func decodeKeyringSecret(s string, secret []byte) error {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(buf) != len(secret) {
+		return fmt.Errorf("Secret key has %d bytes instead of %d",
+			len(buf), len(secret))
+	}
+	copy(secret, buf)
+	return nil
+}
+
+// LocalUsers returns the users of the keyring, in the form used by
+// KeybaseDaemonLocal.  If secrets is non-nil, it also returns the UID
+// of the user whose device secrets belongs to, and makes that
+// device's keys that user's current ones.
+func (k Keyring) LocalUsers(secrets *KeyringDeviceSecrets) (
+	users []LocalUser, currentUID keybase1.UID, err error) {
+	var signingKey SigningKey
+	var cryptPrivateKey CryptPrivateKey
+	if secrets != nil {
+		signingKey, cryptPrivateKey, err = secrets.Keys()
+		if err != nil {
+			return nil, keybase1.UID(""), err
+		}
+	}
+
+	names := make(map[libkb.NormalizedUsername]bool)
+	uids := make(map[keybase1.UID]bool)
+	for _, ku := range k.Users {
+		name := libkb.NewNormalizedUsername(ku.Name)
+		uid, err := keybase1.UIDFromString(ku.UID)
+		if err != nil {
+			return nil, keybase1.UID(""), err
+		}
+		if names[name] || uids[uid] {
+			return nil, keybase1.UID(""), fmt.Errorf(
+				"User %s (%s) is in the keyring more than once", name, uid)
+		}
+		names[name] = true
+		uids[uid] = true
+
+		user := LocalUser{
+			UserInfo: UserInfo{
+				Name:     name,
+				UID:      uid,
+				KIDNames: make(map[keybase1.KID]string),
+			},
+			Asserts: ku.Asserts,
+		}
+		for _, kd := range ku.Devices {
+			vkid, err := keybase1.KIDFromStringChecked(kd.VerifyingKey)
+			if err != nil {
+				return nil, keybase1.UID(""), err
+			}
+			ckid, err := keybase1.KIDFromStringChecked(kd.CryptPublicKey)
+			if err != nil {
+				return nil, keybase1.UID(""), err
+			}
+			if secrets != nil &&
+				name == libkb.NewNormalizedUsername(secrets.User) &&
+				kd.Name == secrets.Device {
+				if vkid != signingKey.GetVerifyingKey().KID() ||
+					ckid != cryptPrivateKey.getPublicKey().KID() {
+					return nil, keybase1.UID(""), fmt.Errorf(
+						"The keys of device %s of %s don't match "+
+							"the keyring", kd.Name, name)
+				}
+				user.CurrentVerifyingKeyIndex = len(user.VerifyingKeys)
+				user.CurrentCryptPublicKeyIndex = len(user.CryptPublicKeys)
+				currentUID = uid
+			}
+			user.VerifyingKeys = append(
+				user.VerifyingKeys, MakeVerifyingKey(vkid))
+			user.CryptPublicKeys = append(
+				user.CryptPublicKeys, MakeCryptPublicKey(ckid))
+			user.KIDNames[vkid] = kd.Name
+		}
+		users = append(users, user)
+	}
+	if secrets != nil && currentUID.IsNil() {
+		return nil, keybase1.UID(""), fmt.Errorf(
+			"Device %s of %s isn't in the keyring", secrets.Device,
+			secrets.User)
+	}
+	return users, currentUID, nil
+}
+
+// NewKeybaseDaemonKeyring constructs a KeybaseDaemonLocal that
+// resolves users with the given keyring, logged in as the user whose
+// device secrets are given.  The favorites are kept on disk next to
+// the secrets file.
+func NewKeybaseDaemonKeyring(keyring Keyring, secrets KeyringDeviceSecrets,
+	secretsPath string, codec Codec) (*KeybaseDaemonLocal, error) {
+	users, currentUID, err := keyring.LocalUsers(&secrets)
+	if err != nil {
+		return nil, err
+	}
+	favPath := filepath.Join(filepath.Dir(secretsPath), "kbfs_favs")
+	return NewKeybaseDaemonDisk(currentUID, users, favPath, codec)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeTestKeyringUser(t *testing.T, name string,
+	devices ...string) (KeyringUser, []KeyringDeviceSecrets) {
+	uid, err := MakeRandomKeyringUID()
+	require.NoError(t, err)
+	ku := KeyringUser{Name: name, UID: uid.String()}
+	var secrets []KeyringDeviceSecrets
+	for _, d := range devices {
+		kd, s, err := MakeRandomKeyringDevice(
+			libkb.NewNormalizedUsername(name), d)
+		require.NoError(t, err)
+		ku.Devices = append(ku.Devices, kd)
+		secrets = append(secrets, s)
+	}
+	return ku, secrets
+}
+
+func TestKeyringLocalUsers(t *testing.T) {
+	alice, aliceSecrets := makeTestKeyringUser(t, "alice", "laptop", "phone")
+	alice.Asserts = []string{"alice@github"}
+	bob, _ := makeTestKeyringUser(t, "bob", "desktop")
+	keyring := Keyring{Users: []KeyringUser{alice, bob}}
+
+	users, currentUID, err := keyring.LocalUsers(&aliceSecrets[1])
+	require.NoError(t, err)
+	require.Equal(t, alice.UID, currentUID.String())
+	require.Len(t, users, 2)
+	require.Equal(t, alice.Devices[1].VerifyingKey,
+		users[0].GetCurrentVerifyingKey().KID().String())
+	require.Equal(t, alice.Devices[1].CryptPublicKey,
+		users[0].GetCurrentCryptPublicKey().KID().String())
+	require.Equal(t, "laptop",
+		users[0].KIDNames[users[0].VerifyingKeys[0].KID()])
+
+	// The secrets must match the keyring.
+	wrongSecrets := aliceSecrets[0]
+	wrongSecrets.Device = "phone"
+	_, _, err = keyring.LocalUsers(&wrongSecrets)
+	require.Error(t, err)
+	wrongSecrets.User = "carol"
+	_, _, err = keyring.LocalUsers(&wrongSecrets)
+	require.Error(t, err)
+
+	// Users can't be listed twice.
+	keyring.Users = append(keyring.Users, bob)
+	_, _, err = keyring.LocalUsers(nil)
+	require.Error(t, err)
+}
+
+func TestKeybaseDaemonKeyring(t *testing.T) {
+	alice, aliceSecrets := makeTestKeyringUser(t, "alice", "laptop")
+	alice.Asserts = []string{"alice@github"}
+	bob, _ := makeTestKeyringUser(t, "bob", "desktop")
+	keyring := Keyring{Users: []KeyringUser{alice, bob}}
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "keyring")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	secretsPath := filepath.Join(tempdir, "laptop.json")
+
+	daemon, err := NewKeybaseDaemonKeyring(keyring, aliceSecrets[0],
+		secretsPath, NewCodecMsgpack())
+	require.NoError(t, err)
+	defer daemon.Shutdown()
+
+	ctx := context.Background()
+	session, err := daemon.CurrentSession(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, libkb.NormalizedUsername("alice"), session.Name)
+	require.Equal(t, alice.Devices[0].VerifyingKey,
+		session.VerifyingKey.KID().String())
+
+	name, uid, err := daemon.Resolve(ctx, "alice@github")
+	require.NoError(t, err)
+	require.Equal(t, libkb.NormalizedUsername("alice"), name)
+	require.Equal(t, alice.UID, uid.String())
+
+	info, err := daemon.Identify(ctx, "bob", "")
+	require.NoError(t, err)
+	require.Equal(t, bob.Devices[0].CryptPublicKey,
+		info.CryptPublicKeys[0].KID().String())
+
+	// The device's keys sign and verify like any others.
+	signingKey, _, err := aliceSecrets[0].Keys()
+	require.NoError(t, err)
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	crypto := NewCryptoLocal(config, signingKey, CryptPrivateKey{})
+	sigInfo, err := crypto.Sign(ctx, []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, session.VerifyingKey, sigInfo.VerifyingKey)
+	require.NoError(t, crypto.Verify([]byte("hello"), sigInfo))
+}
@@ -0,0 +1,296 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/client/go/logger"
+)
+
+// errKVStoreNotFound is returned by kvStore.Get for keys that aren't
+// in the store.
+var errKVStoreNotFound = errors.New("Key not found in the store")
+
+// kvStoreCorruptedError is returned when a kvStore's files are
+// corrupted beyond what opening it can recover from.
+type kvStoreCorruptedError struct {
+	name string
+	err  error
+}
+
+// Error implements the error interface for kvStoreCorruptedError.
+func (e kvStoreCorruptedError) Error() string {
+	return fmt.Sprintf("The %s store is corrupted: %v", e.name, e.err)
+}
+
+// kvIterator walks over a range of the entries in a kvStore, in key
+// order.  Next must be called before the first entry is available,
+// and Release once the iterator isn't needed anymore.
+type kvIterator interface {
+	// Next moves to the next entry, and returns false once there
+	// are no more of them, or the iteration failed.
+	Next() bool
+	// Key and Value return the current entry.  The returned slices
+	// are only valid until the next call to Next.
+	Key() []byte
+	Value() []byte
+	// Error returns the error that stopped the iteration, if any.
+	Error() error
+	// Release frees the resources held by the iterator.
+	Release()
+}
+
+// kvBatchOp is a single put or delete in a kvBatch.
+type kvBatchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// kvBatch is a set of puts and deletes to write to a kvStore at once.
+// The zero value is an empty batch.
+type kvBatch struct {
+	ops []kvBatchOp
+}
+
+// Put adds a put of the given key and value to the batch.
+func (b *kvBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, kvBatchOp{key: key, value: value})
+}
+
+// Delete adds a deletion of the given key to the batch.
+func (b *kvBatch) Delete(key []byte) {
+	b.ops = append(b.ops, kvBatchOp{key: key, delete: true})
+}
+
+// kvStore is an ordered, persistent key-value store, used for the
+// local state that is kept on disk, like the data of the local
+// servers and the favorites of the local daemon.  Each use of it
+// gets its own store, so that it can be opened, compacted and
+// recovered on its own.  Stores kept on disk use the database
+// chosen by Config.KVStoreBackend.
+//
+// kvStore implementations must be goroutine-safe.
+type kvStore interface {
+	// Get returns the value of the given key, or
+	// errKVStoreNotFound if there isn't one.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value of the given key.
+	Put(key, value []byte) error
+	// Delete removes the given key, if it's there.
+	Delete(key []byte) error
+	// Write applies all the puts and deletes in the batch
+	// atomically.
+	Write(batch *kvBatch) error
+	// NewIterator returns an iterator over the entries whose keys
+	// are at least start, if it's non-nil, and less than limit, if
+	// it's non-nil.
+	NewIterator(start, limit []byte) kvIterator
+	// Close closes the store.  It must not be used afterwards.
+	Close() error
+}
+
+// kvPrefixLimit returns the smallest key that's greater than all the
+// keys that start with prefix, for iterating over all of them, or
+// nil if there isn't one.
+func kvPrefixLimit(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			limit := make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i]++
+			return limit
+		}
+	}
+	return nil
+}
+
+// KVStoreBackend is the database that kvStores kept on disk use.
+type KVStoreBackend int
+
+const (
+	// KVStoreLeveldb keeps each store in a leveldb instance, which
+	// is fast to write to, but compacts itself in the background
+	// and keeps several files open.
+	KVStoreLeveldb KVStoreBackend = iota
+	// KVStoreBolt keeps each store in a single bolt file, which is
+	// slower to write to, but keeps one file open and needs no
+	// compactions.
+	KVStoreBolt
+)
+
+func (b KVStoreBackend) String() string {
+	switch b {
+	case KVStoreLeveldb:
+		return "leveldb"
+	case KVStoreBolt:
+		return "bolt"
+	default:
+		return fmt.Sprintf("KVStoreBackend(%d)", int(b))
+	}
+}
+
+// ParseKVStoreBackend returns the KVStoreBackend with the given name,
+// as returned by its String method.
+func ParseKVStoreBackend(name string) (KVStoreBackend, error) {
+	for _, b := range []KVStoreBackend{KVStoreLeveldb, KVStoreBolt} {
+		if name == b.String() {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown key-value store backend %q", name)
+}
+
+// kvStoreMigrationBatchSize is how many entries migrateKVStore
+// copies in each write.
+const kvStoreMigrationBatchSize = 1000
+
+// hasKVStoreLeveldb returns whether the given directory holds a
+// leveldb-backed store.  Every leveldb store has a CURRENT file,
+// which names its manifest.
+func hasKVStoreLeveldb(dirPath string) bool {
+	_, err := os.Stat(filepath.Join(dirPath, "CURRENT"))
+	return err == nil
+}
+
+// hasKVStoreBolt returns whether the given directory holds a
+// bolt-backed store.
+func hasKVStoreBolt(dirPath string) bool {
+	_, err := os.Stat(filepath.Join(dirPath, kvStoreBoltFileName))
+	return err == nil
+}
+
+// copyKVStore copies all of the entries of from into to.
+func copyKVStore(from, to kvStore) error {
+	iter := from.NewIterator(nil, nil)
+	defer iter.Release()
+	var batch kvBatch
+	for iter.Next() {
+		batch.Put(append([]byte{}, iter.Key()...),
+			append([]byte{}, iter.Value()...))
+		if len(batch.ops) >= kvStoreMigrationBatchSize {
+			if err := to.Write(&batch); err != nil {
+				return err
+			}
+			batch = kvBatch{}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return to.Write(&batch)
+}
+
+// migrateKVStore moves the store with the given name, kept in the
+// given directory, to the given backend, if it's kept with the
+// other one.  The old store is only removed once all of its entries
+// have been copied, so if the migration is interrupted, it's simply
+// done again the next time the store is opened.
+func migrateKVStore(name, dirPath string, backend KVStoreBackend,
+	log logger.Logger) (err error) {
+	switch backend {
+	case KVStoreBolt:
+		if !hasKVStoreLeveldb(dirPath) {
+			return nil
+		}
+		log.Debug("Migrating the %s store from leveldb to bolt", name)
+		from, err := openKVStoreLeveldbFile(name, dirPath, log)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		to, err := openKVStoreBoltFile(name, dirPath)
+		if err != nil {
+			return err
+		}
+		defer to.Close()
+		if err := copyKVStore(from, to); err != nil {
+			return err
+		}
+		if err := from.Close(); err != nil {
+			return err
+		}
+		// Remove CURRENT first, so that a store that's only
+		// partly removed isn't taken for a leveldb store again.
+		err = os.Remove(filepath.Join(dirPath, "CURRENT"))
+		if err != nil {
+			return err
+		}
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if fi.Name() == kvStoreBoltFileName {
+				continue
+			}
+			err := os.RemoveAll(filepath.Join(dirPath, fi.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case KVStoreLeveldb:
+		if !hasKVStoreBolt(dirPath) {
+			return nil
+		}
+		log.Debug("Migrating the %s store from bolt to leveldb", name)
+		from, err := openKVStoreBoltFile(name, dirPath)
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		to, err := openKVStoreLeveldbFile(name, dirPath, log)
+		if err != nil {
+			return err
+		}
+		defer to.Close()
+		if err := copyKVStore(from, to); err != nil {
+			return err
+		}
+		if err := from.Close(); err != nil {
+			return err
+		}
+		return os.Remove(filepath.Join(dirPath, kvStoreBoltFileName))
+	default:
+		return fmt.Errorf("Unknown key-value store backend %s", backend)
+	}
+}
+
+// openKVStore opens the store with the given name, kept in the given
+// directory with config's KVStoreBackend, or in memory if dirPath is
+// empty.  A store kept with the other backend is migrated first.
+// Its operations are measured if config has a metrics registry.
+func openKVStore(config Config, name, dirPath string) (kvStore, error) {
+	log := config.MakeLogger("")
+	var s kvStore
+	var err error
+	if dirPath == "" {
+		s, err = openKVStoreLeveldbMemory(name, log)
+	} else {
+		backend := config.KVStoreBackend()
+		err = migrateKVStore(name, dirPath, backend, log)
+		if err != nil {
+			return nil, err
+		}
+		if backend == KVStoreBolt {
+			s, err = openKVStoreBoltFile(name, dirPath)
+		} else {
+			s, err = openKVStoreLeveldbFile(name, dirPath, log)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if registry := config.MetricsRegistry(); registry != nil {
+		return newKVStoreMeasured(s, name, registry), nil
+	}
+	return s, nil
+}
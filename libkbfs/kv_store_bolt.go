@@ -0,0 +1,202 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// kvStoreBoltFileName is the name of the file, in a store's
+	// directory, that holds a bolt-backed store.
+	kvStoreBoltFileName = "store.bolt"
+	// kvStoreBoltOpenTimeout is how long opening a bolt-backed
+	// store waits for another process to let go of its file.
+	kvStoreBoltOpenTimeout = time.Second
+	// kvStoreBoltIteratorChunk is how many entries a
+	// kvIteratorBolt reads in each transaction.
+	kvStoreBoltIteratorChunk = 100
+)
+
+// kvStoreBoltBucket is the bucket that holds all of a bolt-backed
+// store's entries.
+var kvStoreBoltBucket = []byte("kv")
+
+// kvStoreBolt implements the kvStore interface with a bolt database,
+// kept in a single file.  Unlike leveldb, bolt reuses the space of
+// deleted and overwritten entries itself, so it needs no
+// compactions, though its file never shrinks.
+type kvStoreBolt struct {
+	name string
+	db   *bolt.DB
+}
+
+var _ kvStore = (*kvStoreBolt)(nil)
+
+// openKVStoreBoltFile opens a bolt-backed kvStore in the given
+// directory.  Bolt has no way of recovering a corrupted file, so if
+// it's corrupted, a kvStoreCorruptedError is returned.
+func openKVStoreBoltFile(name, dirPath string) (*kvStoreBolt, error) {
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dirPath, kvStoreBoltFileName), 0600,
+		&bolt.Options{Timeout: kvStoreBoltOpenTimeout})
+	switch err {
+	case nil:
+	case bolt.ErrInvalid, bolt.ErrChecksum, bolt.ErrVersionMismatch:
+		return nil, kvStoreCorruptedError{name, err}
+	default:
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvStoreBoltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &kvStoreBolt{name: name, db: db}, nil
+}
+
+// Get implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) Get(key []byte) (value []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(kvStoreBoltBucket).Get(key)
+		if v == nil {
+			return errKVStoreNotFound
+		}
+		// v is only valid during the transaction.
+		value = append([]byte{}, v...)
+		return nil
+	})
+	return value, err
+}
+
+// Put implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) Put(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvStoreBoltBucket).Put(key, value)
+	})
+}
+
+// Delete implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) Delete(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvStoreBoltBucket).Delete(key)
+	})
+}
+
+// Write implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) Write(batch *kvBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kvStoreBoltBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = b.Delete(op.key)
+			} else {
+				err = b.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NewIterator implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) NewIterator(start, limit []byte) kvIterator {
+	return &kvIteratorBolt{db: s.db, next: start, limit: limit}
+}
+
+// Close implements the kvStore interface for kvStoreBolt.
+func (s *kvStoreBolt) Close() error {
+	return s.db.Close()
+}
+
+// kvIteratorBolt iterates over a bolt-backed store a chunk of
+// entries at a time, each chunk read in its own transaction.  A
+// bolt write can't go through while a read transaction is open in
+// the same goroutine, so holding one for the whole iteration would
+// deadlock the callers that write as they iterate.
+type kvIteratorBolt struct {
+	db *bolt.DB
+	// next is the key the next chunk starts at, or nil to start
+	// at the first key.
+	next  []byte
+	limit []byte
+	// done is true once the last chunk has been read.
+	done   bool
+	keys   [][]byte
+	values [][]byte
+	i      int
+	err    error
+}
+
+// Next implements the kvIterator interface for kvIteratorBolt.
+func (it *kvIteratorBolt) Next() bool {
+	it.i++
+	if it.i < len(it.keys) {
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	it.keys, it.values, it.i = nil, nil, 0
+	it.err = it.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(kvStoreBoltBucket).Cursor()
+		var k, v []byte
+		if it.next == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(it.next)
+		}
+		for ; k != nil && len(it.keys) < kvStoreBoltIteratorChunk; k, v =
+			c.Next() {
+			if it.limit != nil && bytes.Compare(k, it.limit) >= 0 {
+				k = nil
+				break
+			}
+			it.keys = append(it.keys, append([]byte{}, k...))
+			it.values = append(it.values, append([]byte{}, v...))
+		}
+		if k == nil {
+			it.done = true
+		} else {
+			it.next = append([]byte{}, k...)
+		}
+		return nil
+	})
+	return it.err == nil && len(it.keys) > 0
+}
+
+// Key implements the kvIterator interface for kvIteratorBolt.
+func (it *kvIteratorBolt) Key() []byte {
+	return it.keys[it.i]
+}
+
+// Value implements the kvIterator interface for kvIteratorBolt.
+func (it *kvIteratorBolt) Value() []byte {
+	return it.values[it.i]
+}
+
+// Error implements the kvIterator interface for kvIteratorBolt.
+func (it *kvIteratorBolt) Error() error {
+	return it.err
+}
+
+// Release implements the kvIterator interface for kvIteratorBolt.
+func (it *kvIteratorBolt) Release() {
+	it.keys, it.values = nil, nil
+	it.done = true
+}
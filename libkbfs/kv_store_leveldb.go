@@ -0,0 +1,168 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var leveldbOptions = &opt.Options{
+	Compression: opt.NoCompression,
+	// Default max open file descriptors (ulimit -n) is 256 on OS
+	// X, and >=1024 on (most?) Linux machines. So set to a low
+	// number since we have multiple leveldb instances.
+	OpenFilesCacheCapacity: 10,
+}
+
+// kvStoreCompactionInterval is how often stores kept on disk are
+// compacted in full, to reclaim the space of deleted and overwritten
+// entries that leveldb's own compactions haven't gotten to yet.
+const kvStoreCompactionInterval = 6 * time.Hour
+
+// kvStoreLeveldb implements the kvStore interface with a leveldb
+// instance.
+type kvStoreLeveldb struct {
+	name string
+	db   *leveldb.DB
+	log  logger.Logger
+	// stor is closed along with db, if it's non-nil.
+	stor storage.Storage
+
+	closeOnce sync.Once
+	// stopCompactions, if non-nil, is closed to stop the periodic
+	// compactions.
+	stopCompactions chan struct{}
+}
+
+var _ kvStore = (*kvStoreLeveldb)(nil)
+
+// openKVStoreLeveldb opens a leveldb-backed kvStore with the given
+// storage.  If the store's files are corrupted, it tries to recover
+// as much of the data as it can, and returns a kvStoreCorruptedError
+// if it can't.
+func openKVStoreLeveldb(name string, stor storage.Storage,
+	log logger.Logger) (*kvStoreLeveldb, error) {
+	db, err := leveldb.Open(stor, leveldbOptions)
+	if lerrors.IsCorrupted(err) {
+		log.Warning("Recovering the corrupted %s store: %v", name, err)
+		db, err = leveldb.Recover(stor, leveldbOptions)
+		if lerrors.IsCorrupted(err) {
+			return nil, kvStoreCorruptedError{name, err}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kvStoreLeveldb{name: name, db: db, log: log}, nil
+}
+
+// openKVStoreLeveldbFile opens a leveldb-backed kvStore in the given
+// directory, like openKVStoreLeveldb, and compacts it every
+// kvStoreCompactionInterval until it's closed.
+func openKVStoreLeveldbFile(name, dirPath string,
+	log logger.Logger) (*kvStoreLeveldb, error) {
+	stor, err := storage.OpenFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openKVStoreLeveldb(name, stor, log)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	s.stor = stor
+	s.stopCompactions = make(chan struct{})
+	go s.compactPeriodically(kvStoreCompactionInterval)
+	return s, nil
+}
+
+// openKVStoreLeveldbMemory opens a leveldb-backed kvStore that keeps
+// its data in memory.
+func openKVStoreLeveldbMemory(name string,
+	log logger.Logger) (*kvStoreLeveldb, error) {
+	return openKVStoreLeveldb(name, storage.NewMemStorage(), log)
+}
+
+func (s *kvStoreLeveldb) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.compact(); err != nil {
+				s.log.Warning("Couldn't compact the %s store: %v",
+					s.name, err)
+			}
+		case <-s.stopCompactions:
+			return
+		}
+	}
+}
+
+// compact compacts all the data in the store.
+func (s *kvStoreLeveldb) compact() error {
+	return s.db.CompactRange(util.Range{})
+}
+
+// Get implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errKVStoreNotFound
+	}
+	return value, err
+}
+
+// Put implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) Put(key, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+// Delete implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) Delete(key []byte) error {
+	return s.db.Delete(key, nil)
+}
+
+// Write implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) Write(batch *kvBatch) error {
+	var b leveldb.Batch
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return s.db.Write(&b, nil)
+}
+
+// NewIterator implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) NewIterator(start, limit []byte) kvIterator {
+	return s.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+}
+
+// Close implements the kvStore interface for kvStoreLeveldb.
+func (s *kvStoreLeveldb) Close() (err error) {
+	s.closeOnce.Do(func() {
+		if s.stopCompactions != nil {
+			close(s.stopCompactions)
+		}
+		err = s.db.Close()
+		if s.stor != nil {
+			if closeErr := s.stor.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
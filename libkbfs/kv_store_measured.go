@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import metrics "github.com/rcrowley/go-metrics"
+
+// kvStoreMeasured delegates to another kvStore but also keeps track
+// of stats, under names that start with "KVStore." and the name of
+// the store.
+type kvStoreMeasured struct {
+	delegate     kvStore
+	getTimer     metrics.Timer
+	putTimer     metrics.Timer
+	deleteTimer  metrics.Timer
+	writeTimer   metrics.Timer
+	errorCounter metrics.Counter
+}
+
+var _ kvStore = kvStoreMeasured{}
+
+// newKVStoreMeasured creates and returns a new kvStoreMeasured
+// instance with the given delegate, store name and registry.
+func newKVStoreMeasured(
+	delegate kvStore, name string, r metrics.Registry) kvStoreMeasured {
+	prefix := "KVStore." + name + "."
+	return kvStoreMeasured{
+		delegate:     delegate,
+		getTimer:     metrics.GetOrRegisterTimer(prefix+"Get", r),
+		putTimer:     metrics.GetOrRegisterTimer(prefix+"Put", r),
+		deleteTimer:  metrics.GetOrRegisterTimer(prefix+"Delete", r),
+		writeTimer:   metrics.GetOrRegisterTimer(prefix+"Write", r),
+		errorCounter: metrics.GetOrRegisterCounter(prefix+"Errors", r),
+	}
+}
+
+// countErr counts any error returned by the delegate, other than
+// missing keys.
+func (s kvStoreMeasured) countErr(err error) {
+	if err != nil && err != errKVStoreNotFound {
+		s.errorCounter.Inc(1)
+	}
+}
+
+// Get implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) Get(key []byte) (value []byte, err error) {
+	s.getTimer.Time(func() {
+		value, err = s.delegate.Get(key)
+	})
+	s.countErr(err)
+	return value, err
+}
+
+// Put implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) Put(key, value []byte) (err error) {
+	s.putTimer.Time(func() {
+		err = s.delegate.Put(key, value)
+	})
+	s.countErr(err)
+	return err
+}
+
+// Delete implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) Delete(key []byte) (err error) {
+	s.deleteTimer.Time(func() {
+		err = s.delegate.Delete(key)
+	})
+	s.countErr(err)
+	return err
+}
+
+// Write implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) Write(batch *kvBatch) (err error) {
+	s.writeTimer.Time(func() {
+		err = s.delegate.Write(batch)
+	})
+	s.countErr(err)
+	return err
+}
+
+// NewIterator implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) NewIterator(start, limit []byte) kvIterator {
+	return s.delegate.NewIterator(start, limit)
+}
+
+// Close implements the kvStore interface for kvStoreMeasured.
+func (s kvStoreMeasured) Close() error {
+	return s.delegate.Close()
+}
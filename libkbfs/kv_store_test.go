@@ -0,0 +1,175 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVPrefixLimit(t *testing.T) {
+	require.Equal(t, []byte("ab"), kvPrefixLimit([]byte("aa")))
+	require.Equal(t, []byte{'b'}, kvPrefixLimit([]byte{'a', 0xff}))
+	require.Nil(t, kvPrefixLimit([]byte{0xff, 0xff}))
+	require.Nil(t, kvPrefixLimit(nil))
+}
+
+// testKVStore checks the basic operations of the given empty store.
+func testKVStore(t *testing.T, s kvStore) {
+	_, err := s.Get([]byte("a"))
+	require.Equal(t, errKVStoreNotFound, err)
+	require.NoError(t, s.Put([]byte("a"), []byte("1")))
+	value, err := s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+
+	var batch kvBatch
+	batch.Put([]byte("b:1"), []byte("2"))
+	batch.Put([]byte("b:2"), []byte("3"))
+	batch.Put([]byte("c"), []byte("4"))
+	batch.Delete([]byte("a"))
+	require.NoError(t, s.Write(&batch))
+	_, err = s.Get([]byte("a"))
+	require.Equal(t, errKVStoreNotFound, err)
+
+	prefix := []byte("b:")
+	iter := s.NewIterator(prefix, kvPrefixLimit(prefix))
+	var values []string
+	for iter.Next() {
+		values = append(values, string(iter.Value()))
+	}
+	require.NoError(t, iter.Error())
+	iter.Release()
+	require.Equal(t, []string{"2", "3"}, values)
+
+	require.NoError(t, s.Delete([]byte("c")))
+	_, err = s.Get([]byte("c"))
+	require.Equal(t, errKVStoreNotFound, err)
+}
+
+func TestKVStoreLeveldb(t *testing.T) {
+	s, err := openKVStoreLeveldbMemory("test", logger.NewNull())
+	require.NoError(t, err)
+	defer s.Close()
+	testKVStore(t, s)
+	require.NoError(t, s.compact())
+}
+
+func TestKVStoreBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv_store_bolt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := openKVStoreBoltFile("test", dir)
+	require.NoError(t, err)
+	defer s.Close()
+	testKVStore(t, s)
+
+	// Iterating over more than one chunk of entries, while writing
+	// to the store, sees each entry once.
+	n := 3*kvStoreBoltIteratorChunk + 1
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("d:%04d", i))
+		require.NoError(t, s.Put(key, []byte{byte(i)}))
+	}
+	prefix := []byte("d:")
+	iter := s.NewIterator(prefix, kvPrefixLimit(prefix))
+	count := 0
+	for iter.Next() {
+		require.Equal(t, fmt.Sprintf("d:%04d", count), string(iter.Key()))
+		require.NoError(t, s.Delete(iter.Key()))
+		count++
+	}
+	require.NoError(t, iter.Error())
+	iter.Release()
+	require.Equal(t, n, count)
+}
+
+// Test that a store kept with one backend is migrated to the other
+// when it's opened with it, and back.
+func TestKVStoreMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv_store_migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	n := kvStoreMigrationBatchSize + 1
+	s, err := openKVStore(config, "test", dir)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		require.NoError(t, s.Put(key, []byte{byte(i)}))
+	}
+	require.NoError(t, s.Close())
+
+	check := func() {
+		s, err := openKVStore(config, "test", dir)
+		require.NoError(t, err)
+		defer s.Close()
+		for i := 0; i < n; i++ {
+			value, err := s.Get([]byte(fmt.Sprintf("%04d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(i)}, value)
+		}
+	}
+
+	config.SetKVStoreBackend(KVStoreBolt)
+	check()
+	require.True(t, hasKVStoreBolt(dir))
+	require.False(t, hasKVStoreLeveldb(dir))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	config.SetKVStoreBackend(KVStoreLeveldb)
+	check()
+	require.False(t, hasKVStoreBolt(dir))
+	require.True(t, hasKVStoreLeveldb(dir))
+}
+
+func TestParseKVStoreBackend(t *testing.T) {
+	for _, b := range []KVStoreBackend{KVStoreLeveldb, KVStoreBolt} {
+		parsed, err := ParseKVStoreBackend(b.String())
+		require.NoError(t, err)
+		require.Equal(t, b, parsed)
+	}
+	_, err := ParseKVStoreBackend("sqlite")
+	require.Error(t, err)
+}
+
+// Test that a store whose manifest is corrupted is recovered when
+// it's opened.
+func TestKVStoreLeveldbRecoverCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv_store_leveldb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log := logger.NewNull()
+	s, err := openKVStoreLeveldbFile("test", dir, log)
+	require.NoError(t, err)
+	require.NoError(t, s.Put([]byte("a"), []byte("1")))
+	require.NoError(t, s.compact())
+	require.NoError(t, s.Close())
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, "CURRENT"))
+	require.NoError(t, err)
+	manifest := filepath.Join(dir, strings.TrimSpace(string(current)))
+	require.NoError(t, ioutil.WriteFile(manifest, []byte("garbage"), 0600))
+
+	s, err = openKVStoreLeveldbFile("test", dir, log)
+	require.NoError(t, err)
+	defer s.Close()
+	value, err := s.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+}
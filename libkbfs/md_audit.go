@@ -0,0 +1,298 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+
+	merkle "github.com/keybase/go-merkle-tree"
+	"golang.org/x/net/context"
+)
+
+const (
+	// merkleTreeChildren is the number of children of each
+	// interior node of the KBFS Merkle tree.
+	merkleTreeChildren = 256
+	// merkleTreeLeafSize is the most folders a single leaf node of
+	// the KBFS Merkle tree holds.
+	merkleTreeLeafSize = 512
+)
+
+// makeMerkleTreeConfig returns the shape of the KBFS Merkle tree,
+// which maps folder IDs to encoded (and, for private folders,
+// encrypted) MerkleLeafs.
+func makeMerkleTreeConfig() merkle.Config {
+	return merkle.NewConfig(merkle.SHA512Hasher{}, merkleTreeChildren,
+		merkleTreeLeafSize, MerkleLeaf{})
+}
+
+// TLFMerkleProof proves what a folder's leaf in the KBFS Merkle tree
+// is, as of a given root.  The root itself has to come from
+// somewhere other than the MD server, e.g. from the root that
+// Keybase publishes and signs, and the caller is responsible for
+// checking its signature.
+type TLFMerkleProof struct {
+	Root MerkleRoot
+	// Nodes are the encoded tree nodes on the path from Root.Hash
+	// down to the leaf node holding the folder.  Any other nodes
+	// are ignored.
+	Nodes [][]byte
+}
+
+// merkleProofEngine is a read-only merkle.StorageEngine holding only
+// the nodes of a TLFMerkleProof, indexed by their hashes.
+type merkleProofEngine struct {
+	root  merkle.Hash
+	nodes map[string][]byte
+}
+
+var _ merkle.StorageEngine = merkleProofEngine{}
+
+var errMerkleProofReadOnly = errors.New("Merkle proofs are read-only")
+
+// StoreNode implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) StoreNode(merkle.Hash, []byte) error {
+	return errMerkleProofReadOnly
+}
+
+// CommitRoot implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) CommitRoot(merkle.Hash, merkle.Hash,
+	merkle.TxInfo) error {
+	return errMerkleProofReadOnly
+}
+
+// LookupNode implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) LookupNode(h merkle.Hash) ([]byte, error) {
+	return e.nodes[string(h)], nil
+}
+
+// LookupRoot implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) LookupRoot() (merkle.Hash, error) {
+	return e.root, nil
+}
+
+// findLeaf returns the encoded leaf of the given folder, checking
+// every node on the way down from the root against its hash.
+func (p TLFMerkleProof) findLeaf(id TlfID) ([]byte, error) {
+	var hasher merkle.SHA512Hasher
+	eng := merkleProofEngine{
+		root:  p.Root.Hash,
+		nodes: make(map[string][]byte, len(p.Nodes)),
+	}
+	for _, node := range p.Nodes {
+		eng.nodes[string(hasher.Hash(node))] = node
+	}
+	val, _, err := merkle.NewTree(eng, makeMerkleTreeConfig()).Find(
+		merkle.Hash(id.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	buf, ok := val.([]byte)
+	if !ok || len(buf) == 0 {
+		return nil, fmt.Errorf("Folder %s has no leaf in Merkle root %d",
+			id, p.Root.SeqNo)
+	}
+	return buf, nil
+}
+
+// decodeMerkleLeaf decodes the Merkle leaf buf of md's folder,
+// decrypting it with the folder's private key if it's a private
+// folder.
+func decodeMerkleLeaf(codec Codec, crypto cryptoPure, root MerkleRoot,
+	md *RootMetadata, buf []byte) (MerkleLeaf, error) {
+	if md.ID.IsPublic() {
+		var leaf MerkleLeaf
+		err := codec.Decode(buf, &leaf)
+		return leaf, err
+	}
+	if root.EPubKey == nil || root.Nonce == nil {
+		return MerkleLeaf{}, fmt.Errorf("Merkle root %d can't decrypt "+
+			"the leaves of private folders", root.SeqNo)
+	}
+	var encryptedLeaf EncryptedMerkleLeaf
+	err := codec.Decode(buf, &encryptedLeaf)
+	if err != nil {
+		return MerkleLeaf{}, err
+	}
+	leaf, err := crypto.DecryptMerkleLeaf(encryptedLeaf,
+		md.data.TLFPrivateKey, root.Nonce, *root.EPubKey)
+	if err != nil {
+		return MerkleLeaf{}, err
+	}
+	return *leaf, nil
+}
+
+// verifyTLFHistory checks that the merged history the MD server
+// serves for head's folder is consistent with both proof and head:
+// the revision in the folder's Merkle leaf, and head itself if it's
+// merged, must both be in the unbroken chain of revisions leading up
+// to the server's current merged head.  It returns an
+// MDServerEquivocationError if the server has rolled the folder
+// back, or forked its history.  It returns the server's merged head
+// revision otherwise.
+func verifyTLFHistory(ctx context.Context, config Config,
+	head *RootMetadata, proof TLFMerkleProof) (MetadataRevision, error) {
+	codec := config.Codec()
+	crypto := config.Crypto()
+	id := head.ID
+	equivocation := func(rev MetadataRevision, format string,
+		args ...interface{}) error {
+		return MDServerEquivocationError{
+			id, rev, fmt.Sprintf(format, args...)}
+	}
+
+	buf, err := proof.findLeaf(id)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	leaf, err := decodeMerkleLeaf(codec, crypto, proof.Root, head, buf)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+
+	// Every revision that has to be checked, mapped to the function
+	// that checks it.
+	checks := map[MetadataRevision]func(*RootMetadataSigned) error{
+		leaf.Revision: func(rmds *RootMetadataSigned) error {
+			hash, err := crypto.MakeMerkleHash(rmds)
+			if err != nil {
+				return err
+			}
+			if hash != leaf.Hash {
+				return equivocation(leaf.Revision, "the MD server's "+
+					"revision has Merkle hash %s, but Merkle root %d "+
+					"has %s", hash, proof.Root.SeqNo, leaf.Hash)
+			}
+			return nil
+		},
+	}
+	start := leaf.Revision
+	if head.MergedStatus() == Merged {
+		headID, err := head.MetadataID(config)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		headCheck := func(rmds *RootMetadataSigned) error {
+			mdID, err := crypto.MakeMdID(&rmds.MD)
+			if err != nil {
+				return err
+			}
+			if mdID != headID {
+				return equivocation(head.Revision, "the MD server's "+
+					"revision is MD %s, but this device has %s",
+					mdID, headID)
+			}
+			return nil
+		}
+		if leafCheck, ok := checks[head.Revision]; ok {
+			checks[head.Revision] = func(rmds *RootMetadataSigned) error {
+				if err := leafCheck(rmds); err != nil {
+					return err
+				}
+				return headCheck(rmds)
+			}
+		} else {
+			checks[head.Revision] = headCheck
+		}
+		if head.Revision < start {
+			start = head.Revision
+		}
+	}
+
+	mdserv := config.MDServer()
+	serverHead, err := mdserv.GetForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if serverHead == nil {
+		return MetadataRevisionUninitialized, equivocation(start,
+			"the MD server has no merged history")
+	}
+	end := serverHead.MD.Revision
+	for rev := range checks {
+		if rev > end {
+			return MetadataRevisionUninitialized, equivocation(rev,
+				"the MD server's merged head is revision %d", end)
+		}
+	}
+	serverHeadID, err := crypto.MakeMdID(&serverHead.MD)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+
+	var prev *RootMetadataSigned
+	for rangeStart := start; rangeStart <= end; {
+		rangeEnd := rangeStart + maxMDsAtATime - 1
+		if rangeEnd > end {
+			rangeEnd = end
+		}
+		rmdses, err := mdserv.GetRange(
+			ctx, id, NullBranchID, Merged, rangeStart, rangeEnd)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		if len(rmdses) == 0 || rmdses[0].MD.Revision != rangeStart {
+			if prev == nil {
+				status, err := mdserv.GetHistoryStatus(ctx, id)
+				if err != nil {
+					return MetadataRevisionUninitialized, err
+				}
+				if status.PrunedThrough >= rangeStart {
+					return MetadataRevisionUninitialized, fmt.Errorf(
+						"Can't verify the history of %s, because the MD "+
+							"server has pruned revision %d", id, rangeStart)
+				}
+			}
+			return MetadataRevisionUninitialized, equivocation(rangeStart,
+				"the MD server is missing the revision")
+		}
+		for _, rmds := range rmdses {
+			rev := rmds.MD.Revision
+			err := verifyMDSignatures(codec, crypto, rmds)
+			if err != nil {
+				return MetadataRevisionUninitialized, err
+			}
+			if prev != nil {
+				if rev != prev.MD.Revision+1 {
+					return MetadataRevisionUninitialized, equivocation(rev,
+						"the MD server's revision follows revision %d",
+						prev.MD.Revision)
+				}
+				prevID, err := crypto.MakeMdID(&prev.MD)
+				if err != nil {
+					return MetadataRevisionUninitialized, err
+				}
+				if rmds.MD.PrevRoot != prevID {
+					return MetadataRevisionUninitialized, equivocation(rev,
+						"the MD server's revision points back to MD %s "+
+							"instead of %s", rmds.MD.PrevRoot, prevID)
+				}
+			}
+			if check, ok := checks[rev]; ok {
+				if err := check(rmds); err != nil {
+					return MetadataRevisionUninitialized, err
+				}
+			}
+			prev = rmds
+		}
+		rangeStart = prev.MD.Revision + 1
+	}
+
+	prevID, err := crypto.MakeMdID(&prev.MD)
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if prev.MD.Revision != end || prevID != serverHeadID {
+		return MetadataRevisionUninitialized, equivocation(end,
+			"the MD server's merged head is MD %s, but its history "+
+				"leads to MD %s", serverHeadID, prevID)
+	}
+	return end, nil
+}
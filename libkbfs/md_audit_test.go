@@ -0,0 +1,161 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/stretchr/testify/require"
+)
+
+// merkleTestEngine is an in-memory merkle.StorageEngine that can hand
+// out all of its nodes as a proof.
+type merkleTestEngine struct {
+	*merkle.MemEngine
+	nodes [][]byte
+}
+
+func (e *merkleTestEngine) StoreNode(h merkle.Hash, b []byte) error {
+	e.nodes = append(e.nodes, b)
+	return e.MemEngine.StoreNode(h, b)
+}
+
+// makeTestTLFMerkleProof returns a proof that the given folder has
+// the leaf for rmds, in a tree with a few other folders.  The leaf is
+// encrypted with pubKey, unless the folder is public.
+func makeTestTLFMerkleProof(t *testing.T, config Config,
+	rmds *RootMetadataSigned, rev MetadataRevision,
+	pubKey TLFPublicKey) TLFMerkleProof {
+	crypto := config.Crypto()
+	codec := config.Codec()
+	hash, err := crypto.MakeMerkleHash(rmds)
+	require.NoError(t, err)
+	leaf := MerkleLeaf{Revision: rev, Hash: hash}
+
+	root := MerkleRoot{Version: MerkleRootVersion, SeqNo: 1}
+	var leafBuf []byte
+	if rmds.MD.ID.IsPublic() {
+		leafBuf, err = codec.Encode(leaf)
+		require.NoError(t, err)
+	} else {
+		_, _, ePubKey, ePrivKey, _, err := crypto.MakeRandomTLFKeys()
+		require.NoError(t, err)
+		var nonce [24]byte
+		nonce[0] = 1
+		encryptedLeaf, err := crypto.EncryptMerkleLeaf(
+			leaf, pubKey, &nonce, ePrivKey)
+		require.NoError(t, err)
+		leafBuf, err = codec.Encode(encryptedLeaf)
+		require.NoError(t, err)
+		root.EPubKey = &ePubKey
+		root.Nonce = &nonce
+	}
+
+	eng := &merkleTestEngine{MemEngine: merkle.NewMemEngine()}
+	tree := merkle.NewTree(eng, makeMerkleTreeConfig())
+	for i := byte(1); i <= 3; i++ {
+		err := tree.Upsert(merkle.KeyValuePair{
+			Key:   FakeTlfID(i, false).Bytes(),
+			Value: []byte{i},
+		}, nil)
+		require.NoError(t, err)
+	}
+	err = tree.Upsert(merkle.KeyValuePair{
+		Key:   rmds.MD.ID.Bytes(),
+		Value: leafBuf,
+	}, nil)
+	require.NoError(t, err)
+	root.Hash, err = eng.LookupRoot()
+	require.NoError(t, err)
+	return TLFMerkleProof{Root: root, Nodes: eng.nodes}
+}
+
+func TestVerifyTLFHistory(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice,bob", false)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	mkdir := func(name string) {
+		_, _, err := kbfsOps.CreateDir(ctx, rootNode, name)
+		require.NoError(t, err)
+	}
+	mkdir("a")
+
+	rmds, err := config.MDServer().GetForTLF(
+		ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	pubKey := rmds.MD.WKeys[len(rmds.MD.WKeys)-1].TLFPublicKey
+	proof := makeTestTLFMerkleProof(
+		t, config, rmds, rmds.MD.Revision, pubKey)
+
+	rev, err := kbfsOps.VerifyTLFHistory(ctx, fb, proof)
+	require.NoError(t, err)
+	require.Equal(t, rmds.MD.Revision, rev)
+
+	// The published revision stays in the history as it grows.
+	mkdir("b")
+	mkdir("c")
+	rev, err = kbfsOps.VerifyTLFHistory(ctx, fb, proof)
+	require.NoError(t, err)
+	require.Equal(t, rmds.MD.Revision+2, rev)
+
+	// A proof that doesn't lead back to its root fails, but isn't
+	// blamed on the server.
+	badProof := proof
+	badProof.Nodes = badProof.Nodes[:0]
+	_, err = kbfsOps.VerifyTLFHistory(ctx, fb, badProof)
+	require.Error(t, err)
+	_, isEquivocation := err.(MDServerEquivocationError)
+	require.False(t, isEquivocation)
+
+	sub := config.EventBus().Subscribe(10, EventMDServerEquivocated)
+	defer sub.Unsubscribe()
+	checkEquivocation := func(proof TLFMerkleProof,
+		rev MetadataRevision) {
+		_, err := kbfsOps.VerifyTLFHistory(ctx, fb, proof)
+		require.IsType(t, MDServerEquivocationError{}, err)
+		require.Equal(t, rev, err.(MDServerEquivocationError).Revision)
+		e := <-sub.C
+		require.Equal(t, fb, e.FolderBranch)
+		require.Equal(t, rev, e.Revision)
+		require.Equal(t, err, e.Err)
+		errs := config.Reporter().AllKnownErrors()
+		require.Equal(t, err, errs[len(errs)-1].Error)
+	}
+
+	// A root that saw a different MD for one of the server's
+	// revisions means the server forked the history.
+	forkProof := makeTestTLFMerkleProof(
+		t, config, rmds, rmds.MD.Revision+1, pubKey)
+	checkEquivocation(forkProof, rmds.MD.Revision+1)
+
+	// A root that saw a revision the server no longer has means
+	// the server rolled the folder back.
+	rollbackProof := makeTestTLFMerkleProof(
+		t, config, rmds, rmds.MD.Revision+5, pubKey)
+	checkEquivocation(rollbackProof, rmds.MD.Revision+5)
+}
+
+func TestVerifyTLFHistoryPublic(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", true)
+	fb := rootNode.GetFolderBranch()
+	_, _, err := config.KBFSOps().CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	rmds, err := config.MDServer().GetForTLF(
+		ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	proof := makeTestTLFMerkleProof(
+		t, config, rmds, rmds.MD.Revision, TLFPublicKey{})
+	rev, err := config.KBFSOps().VerifyTLFHistory(ctx, fb, proof)
+	require.NoError(t, err)
+	require.Equal(t, rmds.MD.Revision, rev)
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+)
+
+// MDChainEntry describes one merged revision of a folder in an
+// MDChain.  Every field but Ops is derived from SignedMD, so that
+// VerifyMDChain can check it.
+type MDChainEntry struct {
+	Revision MetadataRevision
+	// MdID is the ID of this revision's MD, and PrevRoot that of
+	// the revision before it.
+	MdID     string
+	PrevRoot string
+	// Writer is the UID of the user who last changed the folder's
+	// contents as of this revision, and WriterKID the key that
+	// signed those changes.  SignerKID is the key that signed the
+	// MD as a whole, which differs from WriterKID e.g. when a
+	// reader rekeyed the folder.
+	Writer    string
+	WriterKID string
+	SignerKID string
+	// KeyBundleDigest is a hash of the folder's writer and reader
+	// key bundles as of this revision.  It's empty for public
+	// folders.
+	KeyBundleDigest string `json:",omitempty"`
+	DiskUsage       uint64
+	// Ops summarizes the changes made in this revision.  They come
+	// from the encrypted part of the MD, and so can't be checked
+	// without the folder's keys.
+	Ops []string `json:",omitempty"`
+	// SignedMD is the encoded, signed MD object exactly as stored
+	// on the MD server.
+	SignedMD []byte
+}
+
+// MDChain is the whole merged MD history of a folder, in revision
+// order, suitable for encoding directly as JSON.  Exporting the same
+// history always gives the same MDChain, so that auditors can
+// compare copies of it, and VerifyMDChain checks it without needing
+// anything from a running KBFS client.
+type MDChain struct {
+	// Folder is the canonical path of the folder as of its latest
+	// revision.
+	Folder  string
+	TlfID   string
+	Entries []MDChainEntry
+}
+
+// keyBundleDigest returns a hash of md's key bundles, or "" if it has
+// none.
+func keyBundleDigest(codec Codec, md *RootMetadata) (string, error) {
+	if md.ID.IsPublic() {
+		return "", nil
+	}
+	buf, err := codec.Encode([]interface{}{md.WKeys, md.RKeys})
+	if err != nil {
+		return "", err
+	}
+	hash, err := DefaultHash(buf)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// makeMDChainEntry returns the entry for rmds, without any Ops.
+func makeMDChainEntry(codec Codec, crypto cryptoPure,
+	rmds *RootMetadataSigned) (MDChainEntry, error) {
+	mdID, err := crypto.MakeMdID(&rmds.MD)
+	if err != nil {
+		return MDChainEntry{}, err
+	}
+	digest, err := keyBundleDigest(codec, &rmds.MD)
+	if err != nil {
+		return MDChainEntry{}, err
+	}
+	signedMD, err := codec.Encode(rmds)
+	if err != nil {
+		return MDChainEntry{}, err
+	}
+	return MDChainEntry{
+		Revision:        rmds.MD.Revision,
+		MdID:            mdID.String(),
+		PrevRoot:        rmds.MD.PrevRoot.String(),
+		Writer:          rmds.MD.LastModifyingWriter.String(),
+		WriterKID:       rmds.MD.writerKID().String(),
+		SignerKID:       rmds.SigInfo.VerifyingKey.KID().String(),
+		KeyBundleDigest: digest,
+		DiskUsage:       rmds.MD.DiskUsage,
+		SignedMD:        signedMD,
+	}, nil
+}
+
+// verifyMDSignatures checks both of the signatures on rmds.
+func verifyMDSignatures(codec Codec, crypto cryptoPure,
+	rmds *RootMetadataSigned) error {
+	buf, err := codec.Encode(rmds.MD.WriterMetadata)
+	if err != nil {
+		return err
+	}
+	err = crypto.Verify(buf, rmds.MD.WriterMetadataSigInfo)
+	if err != nil {
+		return err
+	}
+	buf, err = codec.Encode(rmds.MD)
+	if err != nil {
+		return err
+	}
+	return crypto.Verify(buf, rmds.SigInfo)
+}
+
+// exportMDChain builds the MDChain of the given folder, using the
+// already-processed merged MDs rmds, starting with the initial
+// revision, for the op summaries.
+func exportMDChain(ctx context.Context, config Config,
+	rmds []*RootMetadata) (MDChain, error) {
+	if len(rmds) == 0 {
+		return MDChain{}, nil
+	}
+	head := rmds[len(rmds)-1]
+	chain := MDChain{
+		Folder:  head.GetTlfHandle().GetCanonicalPath(),
+		TlfID:   head.ID.String(),
+		Entries: make([]MDChainEntry, 0, len(rmds)),
+	}
+	codec := config.Codec()
+	crypto := config.Crypto()
+	for start := 0; start < len(rmds); start += maxMDsAtATime {
+		end := start + maxMDsAtATime
+		if end > len(rmds) {
+			end = len(rmds)
+		}
+		signed, err := config.MDServer().GetRange(ctx, head.ID, NullBranchID,
+			Merged, rmds[start].Revision, rmds[end-1].Revision)
+		if err != nil {
+			return MDChain{}, err
+		}
+		if len(signed) != end-start {
+			return MDChain{}, fmt.Errorf("Expected %d MDs for revisions "+
+				"%d-%d of %s, got %d", end-start, rmds[start].Revision,
+				rmds[end-1].Revision, head.ID, len(signed))
+		}
+		for i, s := range signed {
+			rmd := rmds[start+i]
+			err := verifyMDSignatures(codec, crypto, s)
+			if err != nil {
+				return MDChain{}, err
+			}
+			entry, err := makeMDChainEntry(codec, crypto, s)
+			if err != nil {
+				return MDChain{}, err
+			}
+			mdID, err := rmd.MetadataID(config)
+			if err != nil {
+				return MDChain{}, err
+			}
+			if entry.MdID != mdID.String() {
+				return MDChain{}, fmt.Errorf("MD server returned MD %s for "+
+					"revision %d of %s, expected %s", entry.MdID,
+					rmd.Revision, rmd.ID, mdID)
+			}
+			for _, op := range rmd.data.Changes.Ops {
+				entry.Ops = append(entry.Ops, op.String())
+			}
+			chain.Entries = append(chain.Entries, entry)
+		}
+	}
+	return chain, nil
+}
+
+// VerifyMDChain checks that every entry of chain is validly signed
+// and matches its SignedMD, and that the entries form an unbroken
+// history of the folder, starting with its initial revision.  It
+// returns an MDChainVerificationError for the first problem found.
+// The caller must check that the keys that signed the entries
+// belonged to the entries' writers when they were made, e.g. with
+// the writers' Keybase sigchains.
+func VerifyMDChain(codec Codec, crypto cryptoPure, chain MDChain) error {
+	var prev *RootMetadataSigned
+	for _, entry := range chain.Entries {
+		fail := func(format string, args ...interface{}) error {
+			return MDChainVerificationError{
+				entry.Revision, fmt.Sprintf(format, args...)}
+		}
+
+		var rmds RootMetadataSigned
+		err := codec.Decode(entry.SignedMD, &rmds)
+		if err != nil {
+			return fail("can't decode the signed MD: %v", err)
+		}
+		err = verifyMDSignatures(codec, crypto, &rmds)
+		if err != nil {
+			return fail("bad signature: %v", err)
+		}
+		expected, err := makeMDChainEntry(codec, crypto, &rmds)
+		if err != nil {
+			return fail("%v", err)
+		}
+		expected.Ops = entry.Ops
+		expected.SignedMD = entry.SignedMD
+		if !reflect.DeepEqual(expected, entry) {
+			return fail("doesn't match its signed MD")
+		}
+		if rmds.MD.ID.String() != chain.TlfID {
+			return fail("belongs to folder %s", rmds.MD.ID)
+		}
+		if rmds.MD.MergedStatus() != Merged {
+			return fail("is unmerged")
+		}
+
+		if prev == nil {
+			if rmds.MD.Revision != MetadataRevisionInitial {
+				return fail("the history doesn't start at revision %d",
+					MetadataRevisionInitial)
+			}
+			prev = &rmds
+			continue
+		}
+		if prev.MD.IsFinal() {
+			return fail("follows final revision %d", prev.MD.Revision)
+		}
+		if rmds.MD.Revision != prev.MD.Revision+1 {
+			return fail("follows revision %d", prev.MD.Revision)
+		}
+		prevID, err := crypto.MakeMdID(&prev.MD)
+		if err != nil {
+			return fail("%v", err)
+		}
+		if rmds.MD.PrevRoot != prevID {
+			return fail("points back to MD %s instead of %s",
+				rmds.MD.PrevRoot, prevID)
+		}
+		expectedUsage := prev.MD.DiskUsage
+		if !rmds.MD.IsWriterMetadataCopiedSet() {
+			expectedUsage += rmds.MD.RefBytes - rmds.MD.UnrefBytes
+		}
+		if rmds.MD.DiskUsage != expectedUsage {
+			return fail("has disk usage %d instead of %d",
+				rmds.MD.DiskUsage, expectedUsage)
+		}
+		prev = &rmds
+	}
+	return nil
+}
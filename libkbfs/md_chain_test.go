@@ -0,0 +1,79 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDChainExportAndVerify(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice,bob", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	fb := rootNode.GetFolderBranch()
+	chain, err := kbfsOps.ExportMDChain(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "/keybase/private/alice,bob", chain.Folder)
+	require.Equal(t, fb.Tlf.String(), chain.TlfID)
+	require.Len(t, chain.Entries, 4)
+	require.Equal(t, []string{"create a (FILE)"}, chain.Entries[1].Ops)
+
+	// The export is deterministic, and survives a trip through JSON.
+	chain2, err := kbfsOps.ExportMDChain(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, chain, chain2)
+	buf, err := json.Marshal(chain)
+	require.NoError(t, err)
+	var decoded MDChain
+	require.NoError(t, json.Unmarshal(buf, &decoded))
+
+	// Verification only needs a codec and the pure crypto functions.
+	codec := NewCodecMsgpack()
+	crypto := MakeCryptoCommon(codec, logger.NewNull())
+	require.NoError(t, VerifyMDChain(codec, crypto, decoded))
+
+	tamper := func(f func(chain *MDChain)) error {
+		var c MDChain
+		require.NoError(t, json.Unmarshal(buf, &c))
+		f(&c)
+		return VerifyMDChain(codec, crypto, c)
+	}
+	err = tamper(func(c *MDChain) {
+		c.Entries[2].Writer = c.Entries[0].Writer + "x"
+	})
+	require.Equal(t, MDChainVerificationError{
+		chain.Entries[2].Revision, "doesn't match its signed MD"}, err)
+	err = tamper(func(c *MDChain) {
+		c.Entries = append(c.Entries[:1], c.Entries[2:]...)
+	})
+	require.IsType(t, MDChainVerificationError{}, err)
+	err = tamper(func(c *MDChain) {
+		c.Entries = c.Entries[1:]
+	})
+	require.IsType(t, MDChainVerificationError{}, err)
+	err = tamper(func(c *MDChain) {
+		c.Entries[1].SignedMD[len(c.Entries[1].SignedMD)/2] ^= 1
+	})
+	require.IsType(t, MDChainVerificationError{}, err)
+	err = tamper(func(c *MDChain) {
+		c.TlfID = FakeTlfID(1, false).String()
+	})
+	require.IsType(t, MDChainVerificationError{}, err)
+}
@@ -39,6 +39,10 @@ const (
 	// StatusCodeMDServerErrorConflictFolderMapping is the error code for a folder handle to folder ID
 	// mapping conflict error.
 	StatusCodeMDServerErrorConflictFolderMapping = 2810
+	// StatusCodeMDServerErrorArchived is the error code to indicate
+	// the folder has been archived, so it can't have any new
+	// revisions.
+	StatusCodeMDServerErrorArchived = 2811
 )
 
 // MDServerError is a generic server-side error.
@@ -267,6 +271,23 @@ func (e MDServerErrorConflictFolderMapping) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// MDServerErrorArchived is returned when the client tries to put a
+// new revision of a folder that has been archived.
+type MDServerErrorArchived struct{}
+
+// Error implements the Error interface for MDServerErrorArchived.
+func (e MDServerErrorArchived) Error() string {
+	return "Archived"
+}
+
+// ToStatus implements the ExportableError interface for MDServerErrorArchived.
+func (e MDServerErrorArchived) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorArchived
+	s.Name = "ARCHIVED"
+	s.Desc = e.Error()
+	return
+}
+
 // MDServerErrorUnwrapper is an implementation of rpc.ErrorUnwrapper
 // for errors coming from the MDServer.
 type MDServerErrorUnwrapper struct{}
@@ -323,6 +344,9 @@ func (eu MDServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, d
 	case StatusCodeMDServerErrorConflictFolderMapping:
 		appError = MDServerErrorConflictFolderMapping{Desc: s.Desc}
 		break
+	case StatusCodeMDServerErrorArchived:
+		appError = MDServerErrorArchived{}
+		break
 	default:
 		ase := libkb.AppStatusError{
 			Code:   s.Code,
@@ -0,0 +1,247 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// MDServerFaulty delegates to another MDServer instance, but first
+// injects the latencies and failures asked for by the config's
+// FaultPolicy, for tests and soak runs.
+type MDServerFaulty struct {
+	delegate MDServer
+	faults   *faultInjector
+}
+
+var _ MDServer = MDServerFaulty{}
+
+// NewMDServerFaulty creates and returns a new MDServerFaulty instance
+// with the given delegate and config.
+func NewMDServerFaulty(delegate MDServer, config Config) MDServerFaulty {
+	return MDServerFaulty{delegate, newFaultInjector(config)}
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) RefreshAuthToken(ctx context.Context) {
+	m.delegate.RefreshAuthToken(ctx)
+}
+
+// GetForHandle implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, rmds *RootMetadataSigned, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetForHandle", func() (err error) {
+		tlfID, rmds, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+		return err
+	})
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+	return tlfID, rmds, nil
+}
+
+// GetForTLF implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (
+	rmds *RootMetadataSigned, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetForTLF", func() (err error) {
+		rmds, err = m.delegate.GetForTLF(ctx, id, bid, mStatus)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rmds, nil
+}
+
+// GetRange implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetRange", func() (err error) {
+		rmdses, err = m.delegate.GetRange(
+			ctx, id, bid, mStatus, start, stop)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rmdses, nil
+}
+
+// Put implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) Put(ctx context.Context,
+	rmds *RootMetadataSigned) error {
+	return m.faults.inject(ctx, "MDServer.Put", func() error {
+		return m.delegate.Put(ctx, rmds)
+	})
+}
+
+// PruneBranch implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) PruneBranch(ctx context.Context, id TlfID,
+	bid BranchID) error {
+	return m.faults.inject(ctx, "MDServer.PruneBranch", func() error {
+		return m.delegate.PruneBranch(ctx, id, bid)
+	})
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (c <-chan error, err error) {
+	err = m.faults.inject(ctx, "MDServer.RegisterForUpdate",
+		func() (err error) {
+			c, err = m.delegate.RegisterForUpdate(ctx, id, currHead)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CancelRegistration implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) CancelRegistration(ctx context.Context, id TlfID) {
+	m.delegate.CancelRegistration(ctx, id)
+}
+
+// CheckForRekeys implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) CheckForRekeys(ctx context.Context) <-chan error {
+	return m.delegate.CheckForRekeys(ctx)
+}
+
+// GetRekeyHints implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) GetRekeyHints(ctx context.Context) (
+	ids []TlfID, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetRekeyHints", func() (err error) {
+		ids, err = m.delegate.GetRekeyHints(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// TruncateLock implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) TruncateLock(ctx context.Context, id TlfID) (
+	locked bool, err error) {
+	err = m.faults.inject(ctx, "MDServer.TruncateLock", func() (err error) {
+		locked, err = m.delegate.TruncateLock(ctx, id)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+// TruncateUnlock implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) TruncateUnlock(ctx context.Context, id TlfID) (
+	unlocked bool, err error) {
+	err = m.faults.inject(ctx, "MDServer.TruncateUnlock",
+		func() (err error) {
+			unlocked, err = m.delegate.TruncateUnlock(ctx, id)
+			return err
+		})
+	if err != nil {
+		return false, err
+	}
+	return unlocked, nil
+}
+
+// SetCheckpoint implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) SetCheckpoint(ctx context.Context, id TlfID,
+	rev MetadataRevision) error {
+	return m.faults.inject(ctx, "MDServer.SetCheckpoint", func() error {
+		return m.delegate.SetCheckpoint(ctx, id, rev)
+	})
+}
+
+// GetHistoryStatus implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) GetHistoryStatus(ctx context.Context, id TlfID) (
+	status MDHistoryStatus, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetHistoryStatus",
+		func() (err error) {
+			status, err = m.delegate.GetHistoryStatus(ctx, id)
+			return err
+		})
+	if err != nil {
+		return MDHistoryStatus{}, err
+	}
+	return status, nil
+}
+
+// GetFileLock implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) GetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (held FileLock, ok bool, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetFileLock", func() (err error) {
+		held, ok, err = m.delegate.GetFileLock(ctx, id, file, lock)
+		return err
+	})
+	if err != nil {
+		return FileLock{}, false, err
+	}
+	return held, ok, nil
+}
+
+// SetFileLock implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) SetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (ok bool, err error) {
+	err = m.faults.inject(ctx, "MDServer.SetFileLock", func() (err error) {
+		ok, err = m.delegate.SetFileLock(ctx, id, file, lock)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) DisableRekeyUpdatesForTesting() {
+	m.delegate.DisableRekeyUpdatesForTesting()
+}
+
+// Shutdown implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) Shutdown() {
+	m.delegate.Shutdown()
+}
+
+// IsConnected implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) IsConnected() bool {
+	return m.delegate.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerFaulty.
+func (m MDServerFaulty) GetLatestHandleForTLF(ctx context.Context,
+	id TlfID) (h BareTlfHandle, err error) {
+	err = m.faults.inject(ctx, "MDServer.GetLatestHandleForTLF",
+		func() (err error) {
+			h, err = m.delegate.GetLatestHandleForTLF(ctx, id)
+			return err
+		})
+	if err != nil {
+		return BareTlfHandle{}, err
+	}
+	return h, nil
+}
+
+// Capabilities implements the MDServer interface for MDServerFaulty.
+func (m MDServerFaulty) Capabilities(ctx context.Context) (
+	caps MDServerCapabilities, err error) {
+	err = m.faults.inject(ctx, "MDServer.Capabilities", func() (err error) {
+		caps, err = m.delegate.Capabilities(ctx)
+		return err
+	})
+	if err != nil {
+		return MDServerCapabilities{}, err
+	}
+	return caps, nil
+}
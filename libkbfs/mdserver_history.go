@@ -0,0 +1,48 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+)
+
+// MDHistoryStatus describes how much of a folder's merged history an
+// MD server still keeps.
+type MDHistoryStatus struct {
+	// Checkpoint is the latest revision marked by the folder's
+	// clients through MDServer.SetCheckpoint, or
+	// MetadataRevisionUninitialized if none has been.
+	Checkpoint MetadataRevision
+	// PrunedThrough is the latest revision that the server has
+	// deleted, along with every revision before it, or
+	// MetadataRevisionUninitialized if it hasn't deleted any.
+	PrunedThrough MetadataRevision
+}
+
+func mdHistoryStatusFromRPC(h metadataHistory) MDHistoryStatus {
+	return MDHistoryStatus{
+		Checkpoint:    MetadataRevision(h.Checkpoint),
+		PrunedThrough: MetadataRevision(h.PrunedThrough),
+	}
+}
+
+// MDRetentionPolicy says which of a folder's merged revisions an MD
+// server must keep, even once they're before the folder's
+// checkpoint.  The zero value keeps every revision.
+type MDRetentionPolicy struct {
+	// Revisions is the number of the latest revisions that are
+	// always kept, or 0 to not keep revisions based on their
+	// number.
+	Revisions int
+	// Age is how old a revision must be before it can be pruned,
+	// or 0 to not keep revisions based on their age.
+	Age time.Duration
+}
+
+// prunes returns whether the policy allows any revisions to be
+// pruned.
+func (p MDRetentionPolicy) prunes() bool {
+	return p.Revisions > 0 || p.Age > 0
+}
@@ -15,9 +15,6 @@ import (
 
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/context"
 )
 
@@ -26,16 +23,25 @@ type mdBlockLocal struct {
 	Timestamp time.Time
 }
 
-// MDServerLocal just stores blocks in local leveldb instances.
+// mdHistoryLocal is how MDServerLocal records the pruning of a
+// folder's merged history.
+type mdHistoryLocal struct {
+	Checkpoint    MetadataRevision
+	PrunedThrough MetadataRevision
+}
+
+// MDServerLocal just stores blocks in local kvStore instances.
 type MDServerLocal struct {
-	config   Config
-	handleDb *leveldb.DB // folder handle                  -> folderId
-	mdDb     *leveldb.DB // folderId+[branchId]+[revision] -> mdBlockLocal
-	branchDb *leveldb.DB // folderId+deviceKID             -> branchId
-	log      logger.Logger
+	config    Config
+	handleDb  kvStore // folder handle                  -> folderId
+	mdDb      kvStore // folderId+[branchId]+[revision] -> mdBlockLocal
+	branchDb  kvStore // folderId+deviceKID             -> branchId
+	historyDb kvStore // folderId                       -> mdHistoryLocal
+	log       logger.Logger
 
 	locksMutex *sync.Mutex
-	locksDb    *leveldb.DB // folderId -> deviceKID
+	locksDb    kvStore // folderId              -> deviceKID
+	fileLocks  *fileLockTable
 
 	// mutex protects observers and sessionHeads
 	mutex *sync.Mutex
@@ -45,71 +51,71 @@ type MDServerLocal struct {
 	// instance gets the Put() call.
 	observers    map[TlfID]map[*MDServerLocal]chan<- error
 	sessionHeads map[TlfID]*MDServerLocal
+	// retention is protected by mutex too, and shared the same way.
+	retention *MDRetentionPolicy
 
 	shutdown     *bool
 	shutdownLock *sync.RWMutex
 }
 
-func newMDServerLocalWithStorage(config Config, handleStorage, mdStorage,
-	branchStorage, lockStorage storage.Storage) (*MDServerLocal, error) {
-	handleDb, err := leveldb.Open(handleStorage, leveldbOptions)
+// newMDServerLocalWithDirs constructs a new MDServerLocal object
+// that keeps each of its stores in the given directory, or in memory
+// if the directory is empty.
+func newMDServerLocalWithDirs(config Config, handleDbfile, mdDbfile,
+	branchDbfile, historyDbfile, locksDbfile string) (
+	*MDServerLocal, error) {
+	handleDb, err := openKVStore(config, "MDServerHandles", handleDbfile)
+	if err != nil {
+		return nil, err
+	}
+	mdDb, err := openKVStore(config, "MDServerMD", mdDbfile)
 	if err != nil {
+		handleDb.Close()
 		return nil, err
 	}
-	mdDb, err := leveldb.Open(mdStorage, leveldbOptions)
+	branchDb, err := openKVStore(config, "MDServerBranches", branchDbfile)
 	if err != nil {
+		handleDb.Close()
+		mdDb.Close()
 		return nil, err
 	}
-	branchDb, err := leveldb.Open(branchStorage, leveldbOptions)
+	historyDb, err := openKVStore(config, "MDServerHistory", historyDbfile)
 	if err != nil {
+		handleDb.Close()
+		mdDb.Close()
+		branchDb.Close()
 		return nil, err
 	}
-	locksDb, err := leveldb.Open(lockStorage, leveldbOptions)
+	locksDb, err := openKVStore(config, "MDServerLocks", locksDbfile)
 	if err != nil {
+		handleDb.Close()
+		mdDb.Close()
+		branchDb.Close()
+		historyDb.Close()
 		return nil, err
 	}
 	log := config.MakeLogger("")
-	mdserv := &MDServerLocal{config, handleDb, mdDb, branchDb, log,
-		&sync.Mutex{}, locksDb, &sync.Mutex{},
+	mdserv := &MDServerLocal{config, handleDb, mdDb, branchDb, historyDb,
+		log, &sync.Mutex{}, locksDb, newFileLockTable(), &sync.Mutex{},
 		make(map[TlfID]map[*MDServerLocal]chan<- error),
-		make(map[TlfID]*MDServerLocal), new(bool), &sync.RWMutex{}}
+		make(map[TlfID]*MDServerLocal), &MDRetentionPolicy{}, new(bool),
+		&sync.RWMutex{}}
 	return mdserv, nil
 }
 
 // NewMDServerLocal constructs a new MDServerLocal object that stores
 // data in the directories specified as parameters to this function.
 func NewMDServerLocal(config Config, handleDbfile string, mdDbfile string,
-	branchDbfile string) (*MDServerLocal, error) {
-
-	handleStorage, err := storage.OpenFile(handleDbfile)
-	if err != nil {
-		return nil, err
-	}
-
-	mdStorage, err := storage.OpenFile(mdDbfile)
-	if err != nil {
-		return nil, err
-	}
-
-	branchStorage, err := storage.OpenFile(branchDbfile)
-	if err != nil {
-		return nil, err
-	}
-
-	// Always use memory for the lock storage, so it gets wiped after
-	// a restart.
-	lockStorage := storage.NewMemStorage()
-
-	return newMDServerLocalWithStorage(config, handleStorage, mdStorage,
-		branchStorage, lockStorage)
+	branchDbfile string, historyDbfile string, locksDbfile string) (
+	*MDServerLocal, error) {
+	return newMDServerLocalWithDirs(config, handleDbfile, mdDbfile,
+		branchDbfile, historyDbfile, locksDbfile)
 }
 
 // NewMDServerMemory constructs a new MDServerLocal object that stores
 // all data in-memory.
 func NewMDServerMemory(config Config) (*MDServerLocal, error) {
-	return newMDServerLocalWithStorage(config,
-		storage.NewMemStorage(), storage.NewMemStorage(),
-		storage.NewMemStorage(), storage.NewMemStorage())
+	return newMDServerLocalWithDirs(config, "", "", "", "", "")
 }
 
 // Helper to aid in enforcement that only specified public keys can access TLF metdata.
@@ -172,8 +178,8 @@ func (md *MDServerLocal) GetForHandle(ctx context.Context, handle BareTlfHandle,
 		return id, nil, err
 	}
 
-	buf, err := md.handleDb.Get(handleBytes, nil)
-	if err != nil && err != leveldb.ErrNotFound {
+	buf, err := md.handleDb.Get(handleBytes)
+	if err != nil && err != errKVStoreNotFound {
 		return id, nil, MDServerError{err}
 	}
 	if err == nil {
@@ -201,7 +207,7 @@ func (md *MDServerLocal) GetForHandle(ctx context.Context, handle BareTlfHandle,
 		return id, nil, MDServerError{err}
 	}
 
-	err = md.handleDb.Put(handleBytes, id.Bytes(), nil)
+	err = md.handleDb.Put(handleBytes, id.Bytes())
 	if err != nil {
 		return id, nil, MDServerError{err}
 	}
@@ -265,9 +271,9 @@ func (md *MDServerLocal) getHeadForTLF(ctx context.Context, id TlfID,
 	if err != nil {
 		return
 	}
-	buf, err := md.mdDb.Get(key[:], nil)
+	buf, err := md.mdDb.Get(key[:])
 	if err != nil {
-		if err == leveldb.ErrNotFound {
+		if err == errKVStoreNotFound {
 			rmds, err = nil, nil
 			return
 		}
@@ -383,9 +389,16 @@ func (md *MDServerLocal) GetRange(ctx context.Context, id TlfID,
 		return rmdses, MDServerError{err}
 	}
 
-	iter := md.mdDb.NewIterator(&util.Range{Start: startKey, Limit: stopKey}, nil)
+	iter := md.mdDb.NewIterator(startKey, stopKey)
 	defer iter.Release()
 	for iter.Next() {
+		// The keys of the revisions of a folder's unmerged
+		// branches, and of the heads of its branches, can sort
+		// between those of its merged revisions, depending on
+		// the branch ID, but they're always longer.
+		if len(iter.Key()) != len(startKey) {
+			continue
+		}
 		buf := iter.Value()
 		rmds, err := md.rmdsFromBlockBytes(buf)
 		if err != nil {
@@ -444,6 +457,16 @@ func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) erro
 	var recordBranchID bool
 
 	if mStatus == Unmerged && head == nil {
+		// Each device can only have one unmerged branch per
+		// folder at a time, until it's pruned.
+		currBID, err := md.getBranchID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if currBID != NullBranchID {
+			return MDServerErrorBadRequest{Reason: "Invalid branch ID"}
+		}
+
 		// currHead for unmerged history might be on the main branch
 		prevRev := rmds.MD.Revision - 1
 		rmdses, err := md.GetRange(ctx, id, NullBranchID, Merged, prevRev, prevRev)
@@ -461,6 +484,9 @@ func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) erro
 
 	// Consistency checks
 	if head != nil {
+		if head.MD.IsArchived() {
+			return MDServerErrorArchived{}
+		}
 		err := head.MD.CheckValidSuccessor(md.config, &rmds.MD)
 		switch err := err.(type) {
 		case nil:
@@ -499,7 +525,7 @@ func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) erro
 		if err != nil {
 			return MDServerError{err}
 		}
-		err = md.branchDb.Put(branchKey, buf, nil)
+		err = md.branchDb.Put(branchKey, buf)
 		if err != nil {
 			return MDServerError{err}
 		}
@@ -512,7 +538,7 @@ func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) erro
 	}
 
 	// Wrap writes in a batch
-	batch := new(leveldb.Batch)
+	batch := new(kvBatch)
 
 	// Add an entry with the revision key.
 	revKey, err := md.getMDKey(id, rmds.MD.Revision, rmds.MD.BID, mStatus)
@@ -530,11 +556,20 @@ func (md *MDServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) erro
 	batch.Put(headKey, buf)
 
 	// Write the batch.
-	err = md.mdDb.Write(batch, nil)
+	err = md.mdDb.Write(batch)
 	if err != nil {
 		return MDServerError{err}
 	}
 
+	if mStatus == Merged {
+		// The put has already succeeded, so just log failures to
+		// prune; the next put will try again.
+		if err := md.pruneHistoryLocked(ctx, id); err != nil {
+			md.log.CWarningf(ctx, "Couldn't prune the history of %s: %v",
+				id, err)
+		}
+	}
+
 	if mStatus == Merged &&
 		// Don't send notifies if it's just a rekey (the real mdserver
 		// sends a "folder needs rekey" notification in this case).
@@ -583,7 +618,7 @@ func (md *MDServerLocal) PruneBranch(ctx context.Context, id TlfID, bid BranchID
 	if err != nil {
 		return MDServerError{err}
 	}
-	err = md.branchDb.Delete(branchKey, nil)
+	err = md.branchDb.Delete(branchKey)
 	if err != nil {
 		return MDServerError{err}
 	}
@@ -596,8 +631,8 @@ func (md *MDServerLocal) getBranchID(ctx context.Context, id TlfID) (BranchID, e
 	if err != nil {
 		return NullBranchID, MDServerError{err}
 	}
-	buf, err := md.branchDb.Get(branchKey, nil)
-	if err == leveldb.ErrNotFound {
+	buf, err := md.branchDb.Get(branchKey)
+	if err == errKVStoreNotFound {
 		return NullBranchID, nil
 	}
 	if err != nil {
@@ -611,6 +646,254 @@ func (md *MDServerLocal) getBranchID(ctx context.Context, id TlfID) (BranchID, e
 	return bid, nil
 }
 
+// SetRetentionPolicy sets which merged revisions this server keeps,
+// even once they're before their folder's checkpoint.  It applies to
+// every copy of this server.
+func (md *MDServerLocal) SetRetentionPolicy(policy MDRetentionPolicy) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	*md.retention = policy
+}
+
+func (md *MDServerLocal) getHistoryLocked(id TlfID) (mdHistoryLocal, error) {
+	buf, err := md.historyDb.Get(id.Bytes())
+	if err == errKVStoreNotFound {
+		return mdHistoryLocal{}, nil
+	} else if err != nil {
+		return mdHistoryLocal{}, err
+	}
+	var history mdHistoryLocal
+	err = md.config.Codec().Decode(buf, &history)
+	if err != nil {
+		return mdHistoryLocal{}, err
+	}
+	return history, nil
+}
+
+func (md *MDServerLocal) putHistoryLocked(id TlfID,
+	history mdHistoryLocal) error {
+	buf, err := md.config.Codec().Encode(history)
+	if err != nil {
+		return err
+	}
+	return md.historyDb.Put(id.Bytes(), buf)
+}
+
+// getBranchPointsLocked returns the merged revision that each of the
+// given folder's unmerged branches is based on.
+func (md *MDServerLocal) getBranchPointsLocked(id TlfID) (
+	[]MetadataRevision, error) {
+	prefix := id.Bytes()
+	iter := md.branchDb.NewIterator(prefix, kvPrefixLimit(prefix))
+	defer iter.Release()
+	var points []MetadataRevision
+	for iter.Next() {
+		var bid BranchID
+		err := md.config.Codec().Decode(iter.Value(), &bid)
+		if err != nil {
+			return nil, err
+		}
+		headKey, err := md.getMDKey(
+			id, MetadataRevisionUninitialized, bid, Unmerged)
+		if err != nil {
+			return nil, err
+		}
+		// The first key after the branch's head key is that of
+		// its first revision.
+		revIter := md.mdDb.NewIterator(headKey, kvPrefixLimit(headKey))
+		for revIter.Next() {
+			key := revIter.Key()
+			if len(key) == len(headKey) {
+				continue
+			}
+			rev := MetadataRevision(
+				binary.BigEndian.Uint64(key[len(headKey):]))
+			points = append(points, rev-1)
+			break
+		}
+		err = revIter.Error()
+		revIter.Release()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// pruneHistoryLocked deletes the merged revisions of the given folder
+// that are before its checkpoint, except for those that the
+// retention policy keeps, and those that an unmerged branch may
+// still need to resolve its conflicts.  md.mutex must be held.
+func (md *MDServerLocal) pruneHistoryLocked(ctx context.Context,
+	id TlfID) error {
+	policy := *md.retention
+	if !policy.prunes() {
+		return nil
+	}
+	history, err := md.getHistoryLocked(id)
+	if err != nil {
+		return err
+	}
+	head, err := md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return nil
+	}
+
+	// Only the revisions before end may be pruned.
+	end := history.Checkpoint
+	if policy.Revisions > 0 {
+		keep := head.MD.Revision - MetadataRevision(policy.Revisions) + 1
+		if keep < end {
+			end = keep
+		}
+	}
+	points, err := md.getBranchPointsLocked(id)
+	if err != nil {
+		return err
+	}
+	for _, point := range points {
+		if point < end {
+			end = point
+		}
+	}
+	if end <= history.PrunedThrough+1 {
+		return nil
+	}
+
+	startKey, err := md.getMDKey(
+		id, history.PrunedThrough+1, NullBranchID, Merged)
+	if err != nil {
+		return err
+	}
+	endKey, err := md.getMDKey(id, end, NullBranchID, Merged)
+	if err != nil {
+		return err
+	}
+	cutoff := md.config.Clock().Now().Add(-policy.Age)
+	batch := new(kvBatch)
+	prunedThrough := history.PrunedThrough
+	iter := md.mdDb.NewIterator(startKey, endKey)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) != len(startKey) {
+			// Not a merged revision; see GetRange.
+			continue
+		}
+		if policy.Age > 0 {
+			block := new(mdBlockLocal)
+			err := md.config.Codec().Decode(iter.Value(), block)
+			if err != nil {
+				return err
+			}
+			if block.Timestamp.After(cutoff) {
+				// The later revisions are even newer.
+				break
+			}
+		}
+		prunedThrough = MetadataRevision(
+			binary.BigEndian.Uint64(key[len(id.Bytes()):]))
+		batch.Delete(append([]byte(nil), key...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if prunedThrough == history.PrunedThrough {
+		return nil
+	}
+
+	err = md.mdDb.Write(batch)
+	if err != nil {
+		return err
+	}
+	md.log.CDebugf(ctx, "Pruned the history of %s through revision %d",
+		id, prunedThrough)
+	history.PrunedThrough = prunedThrough
+	return md.putHistoryLocked(id, history)
+}
+
+// SetCheckpoint implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) SetCheckpoint(ctx context.Context, id TlfID,
+	rev MetadataRevision) error {
+	md.shutdownLock.RLock()
+	defer md.shutdownLock.RUnlock()
+	if *md.shutdown {
+		return errors.New("MD server already shut down")
+	}
+
+	ok, err := md.isWriter(ctx, id)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if !ok {
+		return MDServerErrorUnauthorized{}
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	head, err := md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if head == nil || rev > head.MD.Revision {
+		return MDServerErrorBadRequest{Reason: "Invalid checkpoint revision"}
+	}
+	history, err := md.getHistoryLocked(id)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if rev <= history.Checkpoint {
+		return nil
+	}
+	history.Checkpoint = rev
+	err = md.putHistoryLocked(id, history)
+	if err != nil {
+		return MDServerError{err}
+	}
+	err = md.pruneHistoryLocked(ctx, id)
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
+
+// GetHistoryStatus implements the MDServer interface for
+// MDServerLocal.
+func (md *MDServerLocal) GetHistoryStatus(ctx context.Context, id TlfID) (
+	MDHistoryStatus, error) {
+	md.shutdownLock.RLock()
+	defer md.shutdownLock.RUnlock()
+	if *md.shutdown {
+		return MDHistoryStatus{}, errors.New("MD server already shut down")
+	}
+
+	ok, err := md.isReader(ctx, id)
+	if err != nil {
+		return MDHistoryStatus{}, MDServerError{err}
+	}
+	if !ok {
+		return MDHistoryStatus{}, MDServerErrorUnauthorized{}
+	}
+
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	history, err := md.getHistoryLocked(id)
+	if err != nil {
+		return MDHistoryStatus{}, MDServerError{err}
+	}
+	return MDHistoryStatus{
+		Checkpoint:    history.Checkpoint,
+		PrunedThrough: history.PrunedThrough,
+	}, nil
+}
+
 // RegisterForUpdate implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) RegisterForUpdate(ctx context.Context, id TlfID,
 	currHead MetadataRevision) (<-chan error, error) {
@@ -659,6 +942,18 @@ func (md *MDServerLocal) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, nil
 }
 
+// CancelRegistration implements the MDServer interface for
+// MDServerLocal.
+func (md *MDServerLocal) CancelRegistration(_ context.Context, id TlfID) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	delete(md.observers[id], md)
+	if len(md.observers[id]) == 0 {
+		delete(md.observers, id)
+	}
+}
+
 func getTruncateLockKey(id TlfID) ([]byte, error) {
 	buf := &bytes.Buffer{}
 	// add folder id
@@ -683,9 +978,30 @@ func (md *MDServerLocal) getCurrentDeviceKIDBytes(ctx context.Context) (
 	return buf.Bytes(), nil
 }
 
+// checkTruncateLockPerms checks that the current user can write to
+// the given folder, and so can truncate its history.
+func (md *MDServerLocal) checkTruncateLockPerms(ctx context.Context,
+	id TlfID) error {
+	if md.isShutdown() {
+		return errors.New("MD server already shut down")
+	}
+	ok, err := md.isWriter(ctx, id)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if !ok {
+		return MDServerErrorUnauthorized{}
+	}
+	return nil
+}
+
 // TruncateLock implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
+	if err := md.checkTruncateLockPerms(ctx, id); err != nil {
+		return false, err
+	}
+
 	md.locksMutex.Lock()
 	defer md.locksMutex.Unlock()
 
@@ -699,9 +1015,9 @@ func (md *MDServerLocal) TruncateLock(ctx context.Context, id TlfID) (
 		return false, err
 	}
 
-	lockBytes, err := md.locksDb.Get(key, nil)
-	if err == leveldb.ErrNotFound {
-		if err := md.locksDb.Put(key, myKID, nil); err != nil {
+	lockBytes, err := md.locksDb.Get(key)
+	if err == errKVStoreNotFound {
+		if err := md.locksDb.Put(key, myKID); err != nil {
 			return false, err
 		}
 		return true, nil
@@ -719,6 +1035,10 @@ func (md *MDServerLocal) TruncateLock(ctx context.Context, id TlfID) (
 // TruncateUnlock implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) TruncateUnlock(ctx context.Context, id TlfID) (
 	bool, error) {
+	if err := md.checkTruncateLockPerms(ctx, id); err != nil {
+		return false, err
+	}
+
 	md.locksMutex.Lock()
 	defer md.locksMutex.Unlock()
 
@@ -732,14 +1052,14 @@ func (md *MDServerLocal) TruncateUnlock(ctx context.Context, id TlfID) (
 		return false, err
 	}
 
-	lockBytes, err := md.locksDb.Get(key, nil)
-	if err == leveldb.ErrNotFound {
+	lockBytes, err := md.locksDb.Get(key)
+	if err == errKVStoreNotFound {
 		// Already unlocked
 		return true, nil
 	} else if err != nil {
 		return false, err
 	} else if bytes.Equal(lockBytes, myKID) {
-		if err := md.locksDb.Delete(key, nil); err != nil {
+		if err := md.locksDb.Delete(key); err != nil {
 			return false, err
 		}
 		return true, nil
@@ -749,6 +1069,45 @@ func (md *MDServerLocal) TruncateUnlock(ctx context.Context, id TlfID) (
 	return false, MDServerErrorLocked{}
 }
 
+// GetFileLock implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) GetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (FileLock, bool, error) {
+	deviceKID, err := md.checkFileLockPerms(ctx, id)
+	if err != nil {
+		return FileLock{}, false, err
+	}
+	held, conflict := md.fileLocks.get(id, file, deviceKID, lock)
+	return held, conflict, nil
+}
+
+// SetFileLock implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) SetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (bool, error) {
+	deviceKID, err := md.checkFileLockPerms(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return md.fileLocks.set(id, file, deviceKID, lock), nil
+}
+
+// checkFileLockPerms checks that the current user can read the given
+// folder, and returns the current device, which holds any file locks
+// it takes.
+func (md *MDServerLocal) checkFileLockPerms(ctx context.Context,
+	id TlfID) (keybase1.KID, error) {
+	if md.isShutdown() {
+		return keybase1.KID(""), errors.New("MD server already shut down")
+	}
+	ok, err := md.isReader(ctx, id)
+	if err != nil {
+		return keybase1.KID(""), MDServerError{err}
+	}
+	if !ok {
+		return keybase1.KID(""), MDServerErrorUnauthorized{}
+	}
+	return md.getCurrentDeviceKID(ctx)
+}
+
 // Shutdown implements the MDServer interface for MDServerLocal.
 func (md *MDServerLocal) Shutdown() {
 	md.shutdownLock.Lock()
@@ -767,6 +1126,9 @@ func (md *MDServerLocal) Shutdown() {
 	if md.branchDb != nil {
 		md.branchDb.Close()
 	}
+	if md.historyDb != nil {
+		md.historyDb.Close()
+	}
 	if md.locksDb != nil {
 		md.locksDb.Close()
 	}
@@ -786,8 +1148,9 @@ func (md *MDServerLocal) copy(config Config) *MDServerLocal {
 	// purpose, so that the MD server that gets a Put will notify all
 	// observers correctly no matter where they got on the list.
 	log := config.MakeLogger("")
-	return &MDServerLocal{config, md.handleDb, md.mdDb, md.branchDb, log,
-		md.locksMutex, md.locksDb, md.mutex, md.observers, md.sessionHeads,
+	return &MDServerLocal{config, md.handleDb, md.mdDb, md.branchDb,
+		md.historyDb, log, md.locksMutex, md.locksDb, md.fileLocks, md.mutex,
+		md.observers, md.sessionHeads, md.retention,
 		md.shutdown, md.shutdownLock}
 }
 
@@ -812,6 +1175,93 @@ func (md *MDServerLocal) CheckForRekeys(ctx context.Context) <-chan error {
 	return c
 }
 
+// GetRekeyHints implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) GetRekeyHints(ctx context.Context) (
+	[]TlfID, error) {
+	md.shutdownLock.RLock()
+	defer md.shutdownLock.RUnlock()
+	if *md.shutdown {
+		return nil, errors.New("MD server already shut down")
+	}
+
+	_, user, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []TlfID
+	seen := make(map[TlfID]bool)
+	iter := md.handleDb.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var id TlfID
+		err := id.UnmarshalBinary(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		rmds, err := md.getHeadForTLF(ctx, id, NullBranchID, Merged)
+		if err != nil {
+			return nil, err
+		}
+		if rmds == nil || len(rmds.MD.WKeys) == 0 {
+			continue
+		}
+		h, err := rmds.MD.MakeBareTlfHandle()
+		if err != nil {
+			return nil, err
+		}
+		if h.IsPublic() || !h.IsWriter(user) {
+			continue
+		}
+		needsRekey, err := md.hasUnkeyedDevices(ctx, h, &rmds.MD)
+		if err != nil {
+			return nil, err
+		}
+		if needsRekey {
+			ids = append(ids, id)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// hasUnkeyedDevices returns true if any member of the given folder
+// has a device that isn't in the folder's latest key generation.
+func (md *MDServerLocal) hasUnkeyedDevices(ctx context.Context,
+	h BareTlfHandle, rmd *RootMetadata) (bool, error) {
+	i := len(rmd.WKeys) - 1
+	check := func(uids []keybase1.UID, info UserDeviceKeyInfoMap) (
+		bool, error) {
+		for _, uid := range uids {
+			keys, err := md.config.KBPKI().GetCryptPublicKeys(ctx, uid)
+			if err != nil {
+				return false, err
+			}
+			for _, key := range keys {
+				if _, ok := info[uid][key.KID()]; !ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	unkeyed, err := check(h.Writers, rmd.WKeys[i].WKeys)
+	if err != nil || unkeyed {
+		return unkeyed, err
+	}
+	if i >= len(rmd.RKeys) {
+		return false, nil
+	}
+	return check(h.Readers, rmd.RKeys[i].RKeys)
+}
+
 func (md *MDServerLocal) addNewAssertionForTest(uid keybase1.UID,
 	newAssertion keybase1.SocialAssertion) error {
 	md.shutdownLock.RLock()
@@ -843,7 +1293,7 @@ func (md *MDServerLocal) addNewAssertionForTest(uid keybase1.UID,
 			return err
 		}
 		id := iter.Value()
-		if err := md.handleDb.Put(newHandleBytes, id, nil); err != nil {
+		if err := md.handleDb.Put(newHandleBytes, id); err != nil {
 			return err
 		}
 	}
@@ -875,3 +1325,9 @@ func (md *MDServerLocal) GetLatestHandleForTLF(_ context.Context, id TlfID) (
 	}
 	return handle, nil
 }
+
+// Capabilities implements the MDServer interface for MDServerLocal.
+func (md *MDServerLocal) Capabilities(ctx context.Context) (
+	MDServerCapabilities, error) {
+	return MDServerCapabilities{Subscriptions: true}, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// MDServerMeasured delegates to another MDServer instance but also
+// keeps track of stats.
+type MDServerMeasured struct {
+	delegate           MDServer
+	getForHandleTimer  metrics.Timer
+	getForTLFTimer     metrics.Timer
+	getRangeTimer      metrics.Timer
+	putTimer           metrics.Timer
+	pruneBranchTimer   metrics.Timer
+	registerForUpdates metrics.Timer
+	errorCounter       metrics.Counter
+}
+
+var _ MDServer = MDServerMeasured{}
+
+// NewMDServerMeasured creates and returns a new MDServerMeasured
+// instance with the given delegate and registry.
+func NewMDServerMeasured(delegate MDServer, r metrics.Registry) MDServerMeasured {
+	getForHandleTimer := metrics.GetOrRegisterTimer("MDServer.GetForHandle", r)
+	getForTLFTimer := metrics.GetOrRegisterTimer("MDServer.GetForTLF", r)
+	getRangeTimer := metrics.GetOrRegisterTimer("MDServer.GetRange", r)
+	putTimer := metrics.GetOrRegisterTimer("MDServer.Put", r)
+	pruneBranchTimer := metrics.GetOrRegisterTimer("MDServer.PruneBranch", r)
+	registerForUpdates := metrics.GetOrRegisterTimer("MDServer.RegisterForUpdate", r)
+	errorCounter := metrics.GetOrRegisterCounter("MDServer.Errors", r)
+	return MDServerMeasured{
+		delegate:           delegate,
+		getForHandleTimer:  getForHandleTimer,
+		getForTLFTimer:     getForTLFTimer,
+		getRangeTimer:      getRangeTimer,
+		putTimer:           putTimer,
+		pruneBranchTimer:   pruneBranchTimer,
+		registerForUpdates: registerForUpdates,
+		errorCounter:       errorCounter,
+	}
+}
+
+// countErr counts any error returned by the delegate.
+func (m MDServerMeasured) countErr(err error) {
+	if err != nil {
+		m.errorCounter.Inc(1)
+	}
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) RefreshAuthToken(ctx context.Context) {
+	m.delegate.RefreshAuthToken(ctx)
+}
+
+// GetForHandle implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, rmds *RootMetadataSigned, err error) {
+	m.getForHandleTimer.Time(func() {
+		tlfID, rmds, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+	})
+	m.countErr(err)
+	return tlfID, rmds, err
+}
+
+// GetForTLF implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (
+	rmds *RootMetadataSigned, err error) {
+	m.getForTLFTimer.Time(func() {
+		rmds, err = m.delegate.GetForTLF(ctx, id, bid, mStatus)
+	})
+	m.countErr(err)
+	return rmds, err
+}
+
+// GetRange implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, err error) {
+	m.getRangeTimer.Time(func() {
+		rmdses, err = m.delegate.GetRange(
+			ctx, id, bid, mStatus, start, stop)
+	})
+	m.countErr(err)
+	return rmdses, err
+}
+
+// Put implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) Put(ctx context.Context,
+	rmds *RootMetadataSigned) (err error) {
+	m.putTimer.Time(func() {
+		err = m.delegate.Put(ctx, rmds)
+	})
+	m.countErr(err)
+	return err
+}
+
+// PruneBranch implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) PruneBranch(ctx context.Context, id TlfID,
+	bid BranchID) (err error) {
+	m.pruneBranchTimer.Time(func() {
+		err = m.delegate.PruneBranch(ctx, id, bid)
+	})
+	m.countErr(err)
+	return err
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (c <-chan error, err error) {
+	m.registerForUpdates.Time(func() {
+		c, err = m.delegate.RegisterForUpdate(ctx, id, currHead)
+	})
+	m.countErr(err)
+	return c, err
+}
+
+// CancelRegistration implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) CancelRegistration(ctx context.Context, id TlfID) {
+	m.delegate.CancelRegistration(ctx, id)
+}
+
+// CheckForRekeys implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) CheckForRekeys(ctx context.Context) <-chan error {
+	return m.delegate.CheckForRekeys(ctx)
+}
+
+// GetRekeyHints implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) GetRekeyHints(ctx context.Context) (
+	[]TlfID, error) {
+	return m.delegate.GetRekeyHints(ctx)
+}
+
+// TruncateLock implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) TruncateLock(ctx context.Context, id TlfID) (
+	bool, error) {
+	return m.delegate.TruncateLock(ctx, id)
+}
+
+// TruncateUnlock implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) TruncateUnlock(ctx context.Context, id TlfID) (
+	bool, error) {
+	return m.delegate.TruncateUnlock(ctx, id)
+}
+
+// SetCheckpoint implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) SetCheckpoint(ctx context.Context, id TlfID,
+	rev MetadataRevision) error {
+	return m.delegate.SetCheckpoint(ctx, id, rev)
+}
+
+// GetHistoryStatus implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) GetHistoryStatus(ctx context.Context, id TlfID) (
+	MDHistoryStatus, error) {
+	return m.delegate.GetHistoryStatus(ctx, id)
+}
+
+// GetFileLock implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) GetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (FileLock, bool, error) {
+	return m.delegate.GetFileLock(ctx, id, file, lock)
+}
+
+// SetFileLock implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) SetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (bool, error) {
+	return m.delegate.SetFileLock(ctx, id, file, lock)
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) DisableRekeyUpdatesForTesting() {
+	m.delegate.DisableRekeyUpdatesForTesting()
+}
+
+// Shutdown implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) Shutdown() {
+	m.delegate.Shutdown()
+}
+
+// IsConnected implements the MDServer interface for MDServerMeasured.
+func (m MDServerMeasured) IsConnected() bool {
+	return m.delegate.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) GetLatestHandleForTLF(ctx context.Context,
+	id TlfID) (BareTlfHandle, error) {
+	return m.delegate.GetLatestHandleForTLF(ctx, id)
+}
+
+// Capabilities implements the MDServer interface for
+// MDServerMeasured.
+func (m MDServerMeasured) Capabilities(ctx context.Context) (
+	MDServerCapabilities, error) {
+	return m.delegate.Capabilities(ctx)
+}
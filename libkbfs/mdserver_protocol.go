@@ -0,0 +1,113 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// This file has the metadata server RPCs that aren't in the vendored
+// keybase1 protocol yet.  Once the protocol is regenerated with
+// them, these types should be replaced by the keybase1 ones.
+
+type metadataCapabilities struct {
+	Subscriptions bool `codec:"subscriptions" json:"subscriptions"`
+}
+
+type fileLockRPC struct {
+	Type  int   `codec:"type" json:"type"`
+	Start int64 `codec:"start" json:"start"`
+	End   int64 `codec:"end" json:"end"`
+	Flock bool  `codec:"flock" json:"flock"`
+	Owner int64 `codec:"owner" json:"owner"`
+	Pid   int   `codec:"pid" json:"pid"`
+}
+
+type fileLockResponse struct {
+	Conflict bool        `codec:"conflict" json:"conflict"`
+	Lock     fileLockRPC `codec:"lock" json:"lock"`
+}
+
+type metadataHistory struct {
+	Checkpoint    int64 `codec:"checkpoint" json:"checkpoint"`
+	PrunedThrough int64 `codec:"prunedThrough" json:"prunedThrough"`
+}
+
+type getRekeyHintsArg struct {
+}
+
+type getMetadataCapabilitiesArg struct {
+}
+
+type getFileLockArg struct {
+	FolderID string      `codec:"folderID" json:"folderID"`
+	File     string      `codec:"file" json:"file"`
+	Lock     fileLockRPC `codec:"lock" json:"lock"`
+}
+
+type setFileLockArg struct {
+	FolderID string      `codec:"folderID" json:"folderID"`
+	File     string      `codec:"file" json:"file"`
+	Lock     fileLockRPC `codec:"lock" json:"lock"`
+}
+
+type setCheckpointArg struct {
+	FolderID string `codec:"folderID" json:"folderID"`
+	Revision int64  `codec:"revision" json:"revision"`
+}
+
+type getMetadataHistoryArg struct {
+	FolderID string `codec:"folderID" json:"folderID"`
+}
+
+// metadataClient is a keybase1.MetadataClient that also has the
+// metadata server RPCs defined in this file.
+type metadataClient struct {
+	keybase1.MetadataClient
+}
+
+func (c metadataClient) GetRekeyHints(ctx context.Context) (
+	res []string, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.metadata.getRekeyHints",
+		[]interface{}{getRekeyHintsArg{}}, &res)
+	return
+}
+
+func (c metadataClient) GetMetadataCapabilities(ctx context.Context) (
+	res metadataCapabilities, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.metadata.getMetadataCapabilities",
+		[]interface{}{getMetadataCapabilitiesArg{}}, &res)
+	return
+}
+
+func (c metadataClient) GetFileLock(ctx context.Context,
+	arg getFileLockArg) (res fileLockResponse, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.metadata.getFileLock",
+		[]interface{}{arg}, &res)
+	return
+}
+
+func (c metadataClient) SetFileLock(ctx context.Context,
+	arg setFileLockArg) (res bool, err error) {
+	err = c.Cli.Call(ctx, "keybase.1.metadata.setFileLock",
+		[]interface{}{arg}, &res)
+	return
+}
+
+func (c metadataClient) SetCheckpoint(ctx context.Context,
+	arg setCheckpointArg) (err error) {
+	err = c.Cli.Call(ctx, "keybase.1.metadata.setCheckpoint",
+		[]interface{}{arg}, nil)
+	return
+}
+
+func (c metadataClient) GetMetadataHistory(ctx context.Context,
+	folderID string) (res metadataHistory, err error) {
+	arg := getMetadataHistoryArg{FolderID: folderID}
+	err = c.Cli.Call(ctx, "keybase.1.metadata.getMetadataHistory",
+		[]interface{}{arg}, &res)
+	return
+}
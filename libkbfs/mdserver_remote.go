@@ -25,6 +25,9 @@ const (
 	// waits between runs.  The timer gets reset to this period after
 	// every incoming FolderNeedsRekey RPC.
 	MdServerBackgroundRekeyPeriod = 1 * time.Hour
+	// MdServerRekeyHintPeriod is how often the client asks the
+	// server which folders it has flagged as needing a rekey.
+	MdServerRekeyHintPeriod = 5 * time.Minute
 	// MdServerDefaultPingIntervalSeconds is the default interval on which the
 	// client should contact the MD Server
 	MdServerDefaultPingIntervalSeconds = 10
@@ -34,7 +37,7 @@ const (
 type MDServerRemote struct {
 	config       Config
 	conn         *rpc.Connection
-	client       keybase1.MetadataClient
+	client       metadataClient
 	log          logger.Logger
 	authToken    *AuthToken
 	squelchRekey bool
@@ -48,8 +51,14 @@ type MDServerRemote struct {
 	tickerCancel context.CancelFunc
 	tickerMu     sync.Mutex // protects the ticker cancel function
 
-	rekeyCancel context.CancelFunc
-	rekeyTimer  *time.Timer
+	rekeyCancel     context.CancelFunc
+	rekeyTimer      *time.Timer
+	rekeyHintTicker *time.Ticker
+
+	// localFileLocks holds the file locks taken while connected to
+	// an older server that doesn't keep them, so that they're at
+	// least honored on this device.
+	localFileLocks *fileLockTable
 }
 
 // Test that MDServerRemote fully implements the MDServer interface.
@@ -67,10 +76,12 @@ var _ rpc.ConnectionHandler = (*MDServerRemote)(nil)
 // NewMDServerRemote returns a new instance of MDServerRemote.
 func NewMDServerRemote(config Config, srvAddr string, ctx Context) *MDServerRemote {
 	mdServer := &MDServerRemote{
-		config:     config,
-		observers:  make(map[TlfID]chan<- error),
-		log:        config.MakeLogger(""),
-		rekeyTimer: time.NewTimer(MdServerBackgroundRekeyPeriod),
+		config:          config,
+		observers:       make(map[TlfID]chan<- error),
+		log:             config.MakeLogger(""),
+		rekeyTimer:      time.NewTimer(MdServerBackgroundRekeyPeriod),
+		rekeyHintTicker: time.NewTicker(MdServerRekeyHintPeriod),
+		localFileLocks:  newFileLockTable(),
 	}
 	mdServer.authToken = NewAuthToken(config,
 		MdServerTokenServer, MdServerTokenExpireIn,
@@ -80,7 +91,9 @@ func NewMDServerRemote(config Config, srvAddr string, ctx Context) *MDServerRemo
 		ctx.NewRPCLogFactory(), libkb.WrapError,
 		config.MakeLogger(""), LogTagsFromContext)
 	mdServer.conn = conn
-	mdServer.client = keybase1.MetadataClient{Cli: conn.GetClient()}
+	mdServer.client = metadataClient{keybase1.MetadataClient{Cli: rpcRetryClient{
+		rpcDeadlineClient{conn.GetClient(), config}, config,
+		newRPCRetryState(config, MDServiceName)}}}
 
 	// Check for rekey opportunities periodically.
 	rekeyCtx, rekeyCancel := context.WithCancel(context.Background())
@@ -200,7 +213,7 @@ func (md *MDServerRemote) resetAuth(ctx context.Context, c keybase1.MetadataClie
 func (md *MDServerRemote) RefreshAuthToken(ctx context.Context) {
 	md.log.Debug("MDServerRemote: Refreshing auth token...")
 
-	_, err := md.resetAuth(ctx, md.client)
+	_, err := md.resetAuth(ctx, md.client.MetadataClient)
 	switch err.(type) {
 	case nil:
 		md.log.Debug("MDServerRemote: auth token refreshed")
@@ -291,8 +304,9 @@ func (md *MDServerRemote) OnDisconnected(ctx context.Context,
 
 // ShouldRetry implements the ConnectionHandler interface.
 func (md *MDServerRemote) ShouldRetry(name string, err error) bool {
-	_, shouldThrottle := err.(MDServerErrorThrottle)
-	return shouldThrottle
+	// Failed calls are retried by rpcRetryClient instead, following
+	// the configured RetryPolicy.
+	return false
 }
 
 // ShouldRetryOnConnect implements the ConnectionHandler interface.
@@ -349,6 +363,14 @@ func (md *MDServerRemote) get(ctx context.Context, id TlfID,
 	if err != nil {
 		return id, nil, err
 	}
+	size := 0
+	for _, block := range response.MdBlocks {
+		size += len(block.Block)
+	}
+	err = waitToReceive(ctx, md.config, size)
+	if err != nil {
+		return id, nil, err
+	}
 
 	// response
 	id, err = ParseTlfID(response.FolderID)
@@ -422,6 +444,10 @@ func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned) err
 	if err != nil {
 		return err
 	}
+	err = waitToSend(ctx, md.config, len(rmdsBytes))
+	if err != nil {
+		return err
+	}
 
 	// put request
 	arg := keybase1.PutMetadataArg{
@@ -550,6 +576,17 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, err
 }
 
+// CancelRegistration implements the MDServer interface for
+// MDServerRemote.
+func (md *MDServerRemote) CancelRegistration(
+	_ context.Context, id TlfID) {
+	md.observerMu.Lock()
+	defer md.observerMu.Unlock()
+	// The server may still send an update for this folder, which
+	// MetadataUpdate will just ignore.
+	delete(md.observers, id)
+}
+
 // TruncateLock implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
@@ -562,6 +599,88 @@ func (md *MDServerRemote) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.client.TruncateUnlock(ctx, id.String())
 }
 
+func fileLockToRPC(lock FileLock) fileLockRPC {
+	return fileLockRPC{
+		Type:  int(lock.Type),
+		Start: int64(lock.Start),
+		End:   int64(lock.End),
+		Flock: lock.Flock,
+		Owner: int64(lock.Owner),
+		Pid:   int(lock.PID),
+	}
+}
+
+func fileLockFromRPC(lock fileLockRPC) FileLock {
+	return FileLock{
+		Type:  FileLockType(lock.Type),
+		Start: uint64(lock.Start),
+		End:   uint64(lock.End),
+		Flock: lock.Flock,
+		Owner: uint64(lock.Owner),
+		PID:   uint32(lock.Pid),
+	}
+}
+
+// GetFileLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (FileLock, bool, error) {
+	res, err := md.client.GetFileLock(ctx, getFileLockArg{
+		FolderID: id.String(),
+		File:     file,
+		Lock:     fileLockToRPC(lock),
+	})
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		held, conflict := md.localFileLocks.get(id, file, "", lock)
+		return held, conflict, nil
+	} else if err != nil {
+		return FileLock{}, false, err
+	}
+	return fileLockFromRPC(res.Lock), res.Conflict, nil
+}
+
+// SetFileLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) SetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (bool, error) {
+	ok, err := md.client.SetFileLock(ctx, setFileLockArg{
+		FolderID: id.String(),
+		File:     file,
+		Lock:     fileLockToRPC(lock),
+	})
+	if _, notFound := err.(rpc.MethodNotFoundError); notFound {
+		// Older servers don't keep file locks.
+		return md.localFileLocks.set(id, file, "", lock), nil
+	}
+	return ok, err
+}
+
+// SetCheckpoint implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) SetCheckpoint(ctx context.Context, id TlfID,
+	rev MetadataRevision) error {
+	err := md.client.SetCheckpoint(ctx, setCheckpointArg{
+		FolderID: id.String(),
+		Revision: rev.Number(),
+	})
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		// Older servers keep every revision anyway.
+		return nil
+	}
+	return err
+}
+
+// GetHistoryStatus implements the MDServer interface for
+// MDServerRemote.
+func (md *MDServerRemote) GetHistoryStatus(ctx context.Context, id TlfID) (
+	MDHistoryStatus, error) {
+	history, err := md.client.GetMetadataHistory(ctx, id.String())
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		// Older servers never prune anything.
+		return MDHistoryStatus{}, nil
+	} else if err != nil {
+		return MDHistoryStatus{}, err
+	}
+	return mdHistoryStatusFromRPC(history), nil
+}
+
 // GetLatestHandleForTLF implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	BareTlfHandle, error) {
@@ -576,6 +695,20 @@ func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	return handle, nil
 }
 
+// Capabilities implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) Capabilities(ctx context.Context) (
+	MDServerCapabilities, error) {
+	caps, err := md.client.GetMetadataCapabilities(ctx)
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		// Older servers can't report their capabilities, but
+		// all of them notify registered clients of updates.
+		return MDServerCapabilities{Subscriptions: true}, nil
+	} else if err != nil {
+		return MDServerCapabilities{}, err
+	}
+	return mdServerCapabilitiesFromRPC(caps), nil
+}
+
 // CheckForRekeys implements the MDServer interface.
 func (md *MDServerRemote) CheckForRekeys(ctx context.Context) <-chan error {
 	// Wait 5 seconds before asking for rekeys, because the server
@@ -593,7 +726,7 @@ func (md *MDServerRemote) CheckForRekeys(ctx context.Context) <-chan error {
 			c <- ctx.Err()
 		default:
 		}
-		if err := md.getFoldersForRekey(ctx, md.client); err != nil {
+		if err := md.getFoldersForRekey(ctx, md.client.MetadataClient); err != nil {
 			md.log.CDebugf(ctx, "getFoldersForRekey failed during "+
 				"CheckForRekeys: %v", err)
 			c <- err
@@ -615,6 +748,27 @@ func (md *MDServerRemote) getFoldersForRekey(ctx context.Context,
 	return client.GetFoldersForRekey(ctx, cryptKey.kid)
 }
 
+// GetRekeyHints implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetRekeyHints(ctx context.Context) (
+	[]TlfID, error) {
+	hints, err := md.client.GetRekeyHints(ctx)
+	if _, ok := err.(rpc.MethodNotFoundError); ok {
+		// Older servers don't flag folders for rekey.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := make([]TlfID, 0, len(hints))
+	for _, hint := range hints {
+		id, err := ParseTlfID(hint)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 // Shutdown implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) Shutdown() {
 	// close the connection
@@ -729,6 +883,7 @@ func (md *MDServerRemote) DisableRekeyUpdatesForTesting() {
 	// This doesn't need a lock for testing.
 	md.squelchRekey = true
 	md.rekeyTimer.Stop()
+	md.rekeyHintTicker.Stop()
 }
 
 // CtxMDSRTagKey is the type used for unique context tags within MDServerRemote
@@ -756,12 +911,27 @@ func (md *MDServerRemote) backgroundRekeyChecker(ctx context.Context) {
 			// Assign an ID to this rekey check so we can track it.
 			newCtx := ctxWithRandomID(ctx, CtxMDSRIDKey, CtxMDSROpID, md.log)
 			md.log.CDebugf(newCtx, "Checking for rekey folders")
-			if err := md.getFoldersForRekey(newCtx, md.client); err != nil {
+			if err := md.getFoldersForRekey(newCtx, md.client.MetadataClient); err != nil {
 				md.log.CWarningf(newCtx, "MDServerRemote: getFoldersForRekey "+
 					"failed with %v", err)
 			}
 			md.rekeyTimer.Reset(MdServerBackgroundRekeyPeriod)
+		case <-md.rekeyHintTicker.C:
+			if !md.conn.IsConnected() {
+				continue
+			}
+
+			newCtx := ctxWithRandomID(ctx, CtxMDSRIDKey, CtxMDSROpID, md.log)
+			n, err := enqueueRekeyHints(newCtx, md, md.config.RekeyQueue())
+			if err != nil {
+				md.log.CWarningf(newCtx, "MDServerRemote: getting rekey "+
+					"hints failed with %v", err)
+			} else if n > 0 {
+				md.log.CDebugf(newCtx, "Queued %d folders flagged by the "+
+					"server for rekey", n)
+			}
 		case <-ctx.Done():
+			md.rekeyHintTicker.Stop()
 			return
 		}
 	}
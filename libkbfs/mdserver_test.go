@@ -7,7 +7,12 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol"
 
@@ -250,3 +255,345 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// putMDForTest puts a new revision of the given folder, on the given
+// branch, and returns its ID.
+func putMDForTest(t *testing.T, config Config, id TlfID, h BareTlfHandle,
+	rev MetadataRevision, prevRoot MdID, bid BranchID) MdID {
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmds.MD.SerializedPrivateMetadata = make([]byte, 1)
+	rmds.MD.SerializedPrivateMetadata[0] = 0x1
+	rmds.MD.Revision = rev
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.clearCachedMetadataIDForTest()
+	rmds.MD.PrevRoot = prevRoot
+	if bid != NullBranchID {
+		rmds.MD.WFlags |= MetadataFlagUnmerged
+		rmds.MD.BID = bid
+	}
+	err = config.MDServer().Put(context.Background(), rmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdID, err := rmds.MD.MetadataID(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mdID
+}
+
+// Test that merged range queries never return unmerged revisions,
+// and that each device can only have one branch at a time.
+func TestMDServerLocalBranches(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prevRoot, branchRoot MdID
+	for i := MetadataRevision(1); i <= 5; i++ {
+		prevRoot = putMDForTest(t, config, id, h, i, prevRoot, NullBranchID)
+		if i == 2 {
+			branchRoot = prevRoot
+		}
+	}
+
+	// Make the keys of the branch's revisions sort between those
+	// of the merged revisions.
+	var bid BranchID
+	bid.id[7] = 2
+	bid.id[8] = 1
+	prevRoot = branchRoot
+	for i := MetadataRevision(3); i <= 6; i++ {
+		prevRoot = putMDForTest(t, config, id, h, i, prevRoot, bid)
+	}
+
+	rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rmdses) != 5 {
+		t.Fatalf("expected 5 MD blocks, got: %d", len(rmdses))
+	}
+	for i, rmds := range rmdses {
+		if rmds.MD.BID != NullBranchID {
+			t.Fatalf("Got unmerged revision %d", rmds.MD.Revision)
+		}
+		if rmds.MD.Revision != MetadataRevision(i+1) {
+			t.Fatalf("expected revision %d, got: %d", i+1, rmds.MD.Revision)
+		}
+	}
+
+	// A second branch can't be started until the first is pruned.
+	bid2, err := config.Crypto().MakeRandomBranchID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmds.MD.SerializedPrivateMetadata = make([]byte, 1)
+	rmds.MD.Revision = MetadataRevision(3)
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.PrevRoot = branchRoot
+	rmds.MD.WFlags |= MetadataFlagUnmerged
+	rmds.MD.BID = bid2
+	err = mdServer.Put(ctx, rmds)
+	if _, ok := err.(MDServerErrorBadRequest); !ok {
+		t.Fatalf("Expected MDServerErrorBadRequest got: %v", err)
+	}
+
+	err = mdServer.PruneBranch(ctx, id, bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putMDForTest(t, config, id, h, 3, branchRoot, bid2)
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Unmerged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head == nil || head.MD.BID != bid2 {
+		t.Fatalf("Unexpected unmerged head %v", head)
+	}
+}
+
+// Test that a local MD server's truncate locks survive a restart.
+func TestMDServerLocalTruncateLockPersists(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir(os.TempDir(), "mdserver_local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newServer := func() *MDServerLocal {
+		mdServer, err := NewMDServerLocal(config,
+			filepath.Join(dir, "handles"), filepath.Join(dir, "md"),
+			filepath.Join(dir, "branches"), filepath.Join(dir, "history"),
+			filepath.Join(dir, "locks"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mdServer
+	}
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdServer := newServer()
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := mdServer.TruncateLock(ctx, id)
+	if err != nil || !locked {
+		t.Fatalf("Couldn't lock: %t, %v", locked, err)
+	}
+	mdServer.Shutdown()
+
+	mdServer = newServer()
+	defer mdServer.Shutdown()
+	AddDeviceForLocalUserOrBust(t, config, uid)
+	SwitchDeviceForLocalUserOrBust(t, config, 1)
+	_, err = mdServer.TruncateLock(ctx, id)
+	if _, ok := err.(MDServerErrorLocked); !ok {
+		t.Fatalf("Expected MDServerErrorLocked got: %v", err)
+	}
+
+	SwitchDeviceForLocalUserOrBust(t, config, 0)
+	unlocked, err := mdServer.TruncateUnlock(ctx, id)
+	if err != nil || !unlocked {
+		t.Fatalf("Couldn't unlock: %t, %v", unlocked, err)
+	}
+}
+
+// Test that the local MD server prunes merged history before the
+// checkpoint, except for what the retention policy and unmerged
+// branches keep.
+func TestMDServerLocalPruneHistory(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	mdServer, ok := config.MDServer().(*MDServerLocal)
+	if !ok {
+		t.Skip("Not a local MD server")
+	}
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prevRoot, branchRoot MdID
+	for i := MetadataRevision(1); i <= 10; i++ {
+		prevRoot = putMDForTest(t, config, id, h, i, prevRoot, NullBranchID)
+		if i == 4 {
+			branchRoot = prevRoot
+		}
+	}
+	bid, err := config.Crypto().MakeRandomBranchID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putMDForTest(t, config, id, h, 5, branchRoot, bid)
+
+	checkHistory := func(checkpoint, prunedThrough MetadataRevision,
+		revs ...MetadataRevision) {
+		status, err := mdServer.GetHistoryStatus(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := MDHistoryStatus{checkpoint, prunedThrough}
+		if status != expected {
+			t.Fatalf("Got history status %+v, expected %+v",
+				status, expected)
+		}
+		rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged,
+			1, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotRevs []MetadataRevision
+		for _, rmds := range rmdses {
+			gotRevs = append(gotRevs, rmds.MD.Revision)
+		}
+		if !reflect.DeepEqual(gotRevs, revs) {
+			t.Fatalf("Got revisions %v, expected %v", gotRevs, revs)
+		}
+	}
+
+	// Nothing is pruned without a retention policy.
+	err = mdServer.SetCheckpoint(ctx, id, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(8, MetadataRevisionUninitialized,
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	// The branch keeps its branch point, and everything after it.
+	mdServer.SetRetentionPolicy(MDRetentionPolicy{Revisions: 3})
+	err = mdServer.SetCheckpoint(ctx, id, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(9, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	// Once the branch is gone, the policy keeps the latest three
+	// revisions.
+	err = mdServer.PruneBranch(ctx, id, bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevRoot = putMDForTest(t, config, id, h, 11, prevRoot, NullBranchID)
+	checkHistory(9, 8, 9, 10, 11)
+
+	// Checkpoints only move forward, and never past the head.
+	err = mdServer.SetCheckpoint(ctx, id, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(9, 8, 9, 10, 11)
+	err = mdServer.SetCheckpoint(ctx, id, 12)
+	if _, ok := err.(MDServerErrorBadRequest); !ok {
+		t.Fatalf("Expected MDServerErrorBadRequest got: %v", err)
+	}
+
+	// The policy also keeps revisions that are too new.
+	mdServer.SetRetentionPolicy(MDRetentionPolicy{Age: time.Hour})
+	clock.Add(2 * time.Hour)
+	prevRoot = putMDForTest(t, config, id, h, 12, prevRoot, NullBranchID)
+	putMDForTest(t, config, id, h, 13, prevRoot, NullBranchID)
+	err = mdServer.SetCheckpoint(ctx, id, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(13, 11, 12, 13)
+}
+
+// Test that an archived folder can't get any new revisions.
+func TestMDServerLocalArchived(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevRoot := putMDForTest(t, config, id, h, 1, MdID{}, NullBranchID)
+
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmds.MD.SerializedPrivateMetadata = []byte{0x1}
+	rmds.MD.Revision = 2
+	rmds.MD.PrevRoot = prevRoot
+	rmds.MD.WFlags |= MetadataFlagArchived
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.clearCachedMetadataIDForTest()
+	if err := mdServer.Put(ctx, rmds); err != nil {
+		t.Fatal(err)
+	}
+	archivedRoot, err := rmds.MD.MetadataID(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rmds, err = NewRootMetadataSignedForTest(id, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmds.MD.SerializedPrivateMetadata = []byte{0x1}
+	rmds.MD.Revision = 3
+	rmds.MD.PrevRoot = archivedRoot
+	FakeInitialRekey(&rmds.MD, h)
+	rmds.MD.clearCachedMetadataIDForTest()
+	err = mdServer.Put(ctx, rmds)
+	if _, ok := err.(MDServerErrorArchived); !ok {
+		t.Fatalf("Expected MDServerErrorArchived, got %v", err)
+	}
+}
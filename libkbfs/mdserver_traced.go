@@ -0,0 +1,176 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// MDServerTraced delegates to another MDServer instance but also
+// records a tracing span for each round trip, if the config has a
+// SpanExporter.
+type MDServerTraced struct {
+	delegate MDServer
+	config   Config
+}
+
+var _ MDServer = MDServerTraced{}
+
+// NewMDServerTraced creates and returns a new MDServerTraced
+// instance with the given delegate and config.
+func NewMDServerTraced(delegate MDServer, config Config) MDServerTraced {
+	return MDServerTraced{delegate, config}
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) RefreshAuthToken(ctx context.Context) {
+	m.delegate.RefreshAuthToken(ctx)
+}
+
+// GetForHandle implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, rmds *RootMetadataSigned, err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.GetForHandle")
+	defer func() { span.finish(err) }()
+	return m.delegate.GetForHandle(ctx, handle, mStatus)
+}
+
+// GetForTLF implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (
+	rmds *RootMetadataSigned, err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.GetForTLF")
+	defer func() { span.finish(err) }()
+	span.setTag("tlf", id.String())
+	return m.delegate.GetForTLF(ctx, id, bid, mStatus)
+}
+
+// GetRange implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	rmdses []*RootMetadataSigned, err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.GetRange")
+	defer func() { span.finish(err) }()
+	span.setTag("tlf", id.String())
+	span.setTag("start", start.String())
+	span.setTag("stop", stop.String())
+	return m.delegate.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+// Put implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) Put(ctx context.Context,
+	rmds *RootMetadataSigned) (err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.Put")
+	defer func() { span.finish(err) }()
+	span.setTag("tlf", rmds.MD.ID.String())
+	span.setTag("revision", rmds.MD.Revision.String())
+	return m.delegate.Put(ctx, rmds)
+}
+
+// PruneBranch implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) PruneBranch(ctx context.Context, id TlfID,
+	bid BranchID) (err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.PruneBranch")
+	defer func() { span.finish(err) }()
+	span.setTag("tlf", id.String())
+	return m.delegate.PruneBranch(ctx, id, bid)
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (<-chan error, error) {
+	return m.delegate.RegisterForUpdate(ctx, id, currHead)
+}
+
+// CancelRegistration implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) CancelRegistration(ctx context.Context, id TlfID) {
+	m.delegate.CancelRegistration(ctx, id)
+}
+
+// CheckForRekeys implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) CheckForRekeys(ctx context.Context) <-chan error {
+	return m.delegate.CheckForRekeys(ctx)
+}
+
+// GetRekeyHints implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) GetRekeyHints(ctx context.Context) (
+	ids []TlfID, err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.GetRekeyHints")
+	defer func() { span.finish(err) }()
+	return m.delegate.GetRekeyHints(ctx)
+}
+
+// TruncateLock implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) TruncateLock(ctx context.Context, id TlfID) (
+	bool, error) {
+	return m.delegate.TruncateLock(ctx, id)
+}
+
+// TruncateUnlock implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) TruncateUnlock(ctx context.Context, id TlfID) (
+	bool, error) {
+	return m.delegate.TruncateUnlock(ctx, id)
+}
+
+// SetCheckpoint implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) SetCheckpoint(ctx context.Context, id TlfID,
+	rev MetadataRevision) error {
+	return m.delegate.SetCheckpoint(ctx, id, rev)
+}
+
+// GetHistoryStatus implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) GetHistoryStatus(ctx context.Context, id TlfID) (
+	MDHistoryStatus, error) {
+	return m.delegate.GetHistoryStatus(ctx, id)
+}
+
+// GetFileLock implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) GetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (FileLock, bool, error) {
+	return m.delegate.GetFileLock(ctx, id, file, lock)
+}
+
+// SetFileLock implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) SetFileLock(ctx context.Context, id TlfID,
+	file string, lock FileLock) (bool, error) {
+	return m.delegate.SetFileLock(ctx, id, file, lock)
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) DisableRekeyUpdatesForTesting() {
+	m.delegate.DisableRekeyUpdatesForTesting()
+}
+
+// Shutdown implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) Shutdown() {
+	m.delegate.Shutdown()
+}
+
+// IsConnected implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) IsConnected() bool {
+	return m.delegate.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerTraced.
+func (m MDServerTraced) GetLatestHandleForTLF(ctx context.Context,
+	id TlfID) (h BareTlfHandle, err error) {
+	ctx, span := startTraceSpan(
+		ctx, m.config, "MDServer.GetLatestHandleForTLF")
+	defer func() { span.finish(err) }()
+	return m.delegate.GetLatestHandleForTLF(ctx, id)
+}
+
+// Capabilities implements the MDServer interface for MDServerTraced.
+func (m MDServerTraced) Capabilities(ctx context.Context) (
+	caps MDServerCapabilities, err error) {
+	ctx, span := startTraceSpan(ctx, m.config, "MDServer.Capabilities")
+	defer func() { span.finish(err) }()
+	return m.delegate.Capabilities(ctx)
+}
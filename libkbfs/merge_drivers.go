@@ -0,0 +1,230 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// MergeDriverXattr is the extended attribute that names the merge
+// driver to use for a file, overriding the one registered for its
+// extension.
+const MergeDriverXattr = "user.kbfs.merge-driver"
+
+// MergeDrivers is a MergeStrategy that lets applications register
+// their own mergers (drivers) for the files they own, like JSON state
+// files or calendars.  A file is merged by the driver named by its
+// MergeDriverXattr attribute if it has one, or else by the driver
+// registered for its extension; files with neither are merged by the
+// fallback strategy, if any.
+type MergeDrivers struct {
+	fallback MergeStrategy
+
+	lock    sync.RWMutex
+	drivers map[string]MergeStrategy
+	exts    map[string]string
+}
+
+var _ MergeStrategy = (*MergeDrivers)(nil)
+
+// NewMergeDrivers returns a MergeDrivers with no drivers, which merges
+// all files with the given fallback strategy.  fallback may be nil, in
+// which case files without a driver always keep a conflicted copy.
+func NewMergeDrivers(fallback MergeStrategy) *MergeDrivers {
+	return &MergeDrivers{
+		fallback: fallback,
+		drivers:  make(map[string]MergeStrategy),
+		exts:     make(map[string]string),
+	}
+}
+
+// Register makes driver merge the files with any of the given
+// extensions (e.g., ".json"), and the files whose MergeDriverXattr
+// is name.  It replaces any driver already registered under name, or
+// for those extensions.
+func (md *MergeDrivers) Register(name string, driver MergeStrategy,
+	exts ...string) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.drivers[name] = driver
+	for _, ext := range exts {
+		md.exts[strings.ToLower(ext)] = name
+	}
+}
+
+// Unregister removes the driver registered under name, and its
+// extensions.
+func (md *MergeDrivers) Unregister(name string) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	delete(md.drivers, name)
+	for ext, driverName := range md.exts {
+		if driverName == name {
+			delete(md.exts, ext)
+		}
+	}
+}
+
+// driverFor returns the strategy that should merge the given file.
+func (md *MergeDrivers) driverFor(name string,
+	xattrs map[string][]byte) (MergeStrategy, string) {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	if driverName, ok := xattrs[MergeDriverXattr]; ok {
+		if driver, ok := md.drivers[string(driverName)]; ok {
+			return driver, string(driverName)
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if driverName, ok := md.exts[ext]; ok {
+		return md.drivers[driverName], driverName
+	}
+	return md.fallback, ""
+}
+
+// Merge implements the MergeStrategy interface for MergeDrivers.
+func (md *MergeDrivers) Merge(ctx context.Context, name string,
+	xattrs map[string][]byte, base, merged, unmerged []byte) (
+	[]byte, bool, error) {
+	driver, driverName := md.driverFor(name, xattrs)
+	if driver == nil {
+		return nil, false, nil
+	}
+	result, ok, err := driver.Merge(ctx, name, xattrs, base, merged,
+		unmerged)
+	if err != nil && driverName != "" {
+		return nil, false, fmt.Errorf("Merge driver %s failed: %v",
+			driverName, err)
+	}
+	return result, ok, err
+}
+
+// CommandMergeDriver is a MergeStrategy that runs an external
+// command, like a git merge driver.  Each version of the file is
+// written to a temporary file, and any "%O", "%A" and "%B" in Args
+// are replaced by the names of the files holding the common
+// ancestor, the merged version and the unmerged version,
+// respectively.  If the command exits successfully, it must have left
+// the result in the "%A" file; otherwise both copies are kept.
+type CommandMergeDriver struct {
+	Command string
+	Args    []string
+}
+
+var _ MergeStrategy = CommandMergeDriver{}
+
+// Merge implements the MergeStrategy interface for CommandMergeDriver.
+func (c CommandMergeDriver) Merge(ctx context.Context, name string,
+	_ map[string][]byte, base, merged, unmerged []byte) (
+	[]byte, bool, error) {
+	dir, err := ioutil.TempDir("", "kbfs_merge")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"%O": filepath.Join(dir, "base"),
+		"%A": filepath.Join(dir, "merged"),
+		"%B": filepath.Join(dir, "unmerged"),
+	}
+	contents := map[string][]byte{"%O": base, "%A": merged, "%B": unmerged}
+	for key, file := range files {
+		if err := ioutil.WriteFile(file, contents[key], 0600); err != nil {
+			return nil, false, err
+		}
+	}
+
+	args := make([]string, 0, len(c.Args))
+	for _, arg := range c.Args {
+		for key, file := range files {
+			arg = strings.Replace(arg, key, file, -1)
+		}
+		args = append(args, arg)
+	}
+	cmd := exec.Command(c.Command, args...)
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		return nil, false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if _, ok := err.(*exec.ExitError); ok {
+			// The command couldn't merge the versions.
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return nil, false, ctx.Err()
+	}
+
+	result, err := ioutil.ReadFile(files["%A"])
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// MergeDriverFlag is for specifying command merge drivers with the
+// flag package, each as "name[:.ext,...]=command [args...]".
+type MergeDriverFlag struct {
+	v *[]string
+}
+
+// String for flag interface.
+func (mf MergeDriverFlag) String() string {
+	if mf.v == nil {
+		return ""
+	}
+	return strings.Join(*mf.v, " ")
+}
+
+// Set for flag interface.
+func (mf MergeDriverFlag) Set(raw string) error {
+	if _, _, _, err := parseMergeDriver(raw); err != nil {
+		return err
+	}
+	*mf.v = append(*mf.v, raw)
+	return nil
+}
+
+// parseMergeDriver parses a merge driver specified as
+// "name[:.ext,...]=command [args...]".
+func parseMergeDriver(spec string) (
+	name string, exts []string, driver CommandMergeDriver, err error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return "", nil, CommandMergeDriver{}, fmt.Errorf(
+			"Invalid merge driver %q, supported syntax is "+
+				"name[:.ext,...]=command [args...]", spec)
+	}
+	name = spec[:i]
+	if j := strings.Index(name, ":"); j >= 0 {
+		exts = strings.Split(name[j+1:], ",")
+		name = name[:j]
+	}
+	command := strings.Fields(spec[i+1:])
+	if name == "" || len(command) == 0 {
+		return "", nil, CommandMergeDriver{}, fmt.Errorf(
+			"Invalid merge driver %q, supported syntax is "+
+				"name[:.ext,...]=command [args...]", spec)
+	}
+	return name, exts, CommandMergeDriver{command[0], command[1:]}, nil
+}
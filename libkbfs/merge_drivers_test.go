@@ -0,0 +1,95 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// constMergeStrategy merges any file into its own name.
+type constMergeStrategy string
+
+func (s constMergeStrategy) Merge(ctx context.Context, name string,
+	_ map[string][]byte, base, merged, unmerged []byte) (
+	[]byte, bool, error) {
+	return []byte(s), true, nil
+}
+
+func TestMergeDrivers(t *testing.T) {
+	ctx := context.Background()
+	drivers := NewMergeDrivers(constMergeStrategy("fallback"))
+	drivers.Register("json", constMergeStrategy("json"), ".json", ".JS")
+	drivers.Register("cal", constMergeStrategy("cal"))
+
+	tests := []struct {
+		name   string
+		xattrs map[string][]byte
+		result string
+	}{
+		{"a.json", nil, "json"},
+		{"a.Json", nil, "json"},
+		{"a.js", nil, "json"},
+		{"a.txt", nil, "fallback"},
+		{"a.txt", map[string][]byte{MergeDriverXattr: []byte("cal")}, "cal"},
+		{"a.json", map[string][]byte{MergeDriverXattr: []byte("cal")}, "cal"},
+		{"a.json", map[string][]byte{MergeDriverXattr: []byte("none")},
+			"json"},
+	}
+	for _, test := range tests {
+		result, ok, err := drivers.Merge(
+			ctx, test.name, test.xattrs, nil, nil, nil)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, test.result, string(result), test.name)
+	}
+
+	drivers.Unregister("json")
+	result, ok, err := drivers.Merge(ctx, "a.json", nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "fallback", string(result))
+
+	// Without a fallback, files without a driver aren't merged.
+	drivers = NewMergeDrivers(nil)
+	_, ok, err = drivers.Merge(ctx, "a.json", nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestCommandMergeDriver(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No shell")
+	}
+	ctx := context.Background()
+
+	name, exts, driver, err := parseMergeDriver("m:.a,.b=merge3 %A %O %B")
+	require.NoError(t, err)
+	require.Equal(t, "m", name)
+	require.Equal(t, []string{".a", ".b"}, exts)
+	require.Equal(t, CommandMergeDriver{"merge3",
+		[]string{"%A", "%O", "%B"}}, driver)
+
+	driver = CommandMergeDriver{"sh", []string{"-c", "cat %O %B >> %A"}}
+	result, ok, err := driver.Merge(ctx, "f", nil, []byte("base\n"),
+		[]byte("merged\n"), []byte("unmerged\n"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "merged\nbase\nunmerged\n", string(result))
+
+	// A failing command keeps both copies.
+	driver = CommandMergeDriver{"sh", []string{"-c", "exit 1"}}
+	_, ok, err = driver.Merge(ctx, "f", nil, nil, nil, nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, _, _, err = parseMergeDriver("cat")
+	require.Error(t, err)
+	_, _, _, err = parseMergeDriver("=cat")
+	require.Error(t, err)
+}
@@ -10,6 +10,7 @@ import (
 	protocol "github.com/keybase/client/go/protocol"
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
+	io "io"
 	reflect "reflect"
 	time "time"
 )
@@ -206,6 +207,17 @@ func (_mr *_MockKBFSOpsRecorder) GetFavorites(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFavorites", arg0)
 }
 
+func (_m *MockKBFSOps) GetFavoritesWithMetadata(ctx context.Context) ([]FavoriteInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetFavoritesWithMetadata", ctx)
+	ret0, _ := ret[0].([]FavoriteInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFavoritesWithMetadata(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFavoritesWithMetadata", arg0)
+}
+
 func (_m *MockKBFSOps) RefreshCachedFavorites(ctx context.Context) {
 	_m.ctrl.Call(_m, "RefreshCachedFavorites", ctx)
 }
@@ -315,6 +327,16 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CreateHardLink(ctx context.Context, dir Node, name string, target Node) error {
+	ret := _m.ctrl.Call(_m, "CreateHardLink", ctx, dir, name, target)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateHardLink(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateHardLink", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -345,6 +367,16 @@ func (_mr *_MockKBFSOpsRecorder) Rename(arg0, arg1, arg2, arg3, arg4 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rename", arg0, arg1, arg2, arg3, arg4)
 }
 
+func (_m *MockKBFSOps) MoveAcrossFolders(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string, progress func(MoveProgress)) error {
+	ret := _m.ctrl.Call(_m, "MoveAcrossFolders", ctx, oldParent, oldName, newParent, newName, progress)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) MoveAcrossFolders(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MoveAcrossFolders", arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
 func (_m *MockKBFSOps) Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
 	ret := _m.ctrl.Call(_m, "Read", ctx, file, dest, off)
 	ret0, _ := ret[0].(int64)
@@ -356,6 +388,28 @@ func (_mr *_MockKBFSOpsRecorder) Read(arg0, arg1, arg2, arg3 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Read", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) ReadStream(ctx context.Context, file Node, off int64) (io.ReadCloser, error) {
+	ret := _m.ctrl.Call(_m, "ReadStream", ctx, file, off)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ReadStream(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadStream", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SeekHoleOrData(ctx context.Context, file Node, off int64, hole bool) (int64, error) {
+	ret := _m.ctrl.Call(_m, "SeekHoleOrData", ctx, file, off, hole)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) SeekHoleOrData(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SeekHoleOrData", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Write(ctx context.Context, file Node, data []byte, off int64) error {
 	ret := _m.ctrl.Call(_m, "Write", ctx, file, data, off)
 	ret0, _ := ret[0].(error)
@@ -366,6 +420,16 @@ func (_mr *_MockKBFSOpsRecorder) Write(arg0, arg1, arg2, arg3 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) WriteNoCopy(ctx context.Context, file Node, data []byte, off int64) error {
+	ret := _m.ctrl.Call(_m, "WriteNoCopy", ctx, file, data, off)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) WriteNoCopy(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteNoCopy", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Truncate(ctx context.Context, file Node, size uint64) error {
 	ret := _m.ctrl.Call(_m, "Truncate", ctx, file, size)
 	ret0, _ := ret[0].(error)
@@ -376,6 +440,16 @@ func (_mr *_MockKBFSOpsRecorder) Truncate(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Truncate", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) PunchHole(ctx context.Context, file Node, off int64, length int64) error {
+	ret := _m.ctrl.Call(_m, "PunchHole", ctx, file, off, length)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) PunchHole(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PunchHole", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := _m.ctrl.Call(_m, "SetEx", ctx, file, ex)
 	ret0, _ := ret[0].(error)
@@ -396,6 +470,70 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) GetXattr(ctx context.Context, node Node, name string) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattr", ctx, node, name)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListXattr(ctx context.Context, node Node) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "ListXattr", ctx, node)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListXattr(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListXattr", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte, mode XattrSetMode) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value, mode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetFileLock(ctx context.Context, file Node, lock FileLock) (FileLock, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetFileLock", ctx, file, lock)
+	ret0, _ := ret[0].(FileLock)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFileLock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileLock", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetFileLock(ctx context.Context, file Node, lock FileLock, wait bool) error {
+	ret := _m.ctrl.Call(_m, "SetFileLock", ctx, file, lock, wait)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetFileLock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFileLock", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -430,6 +568,231 @@ func (_mr *_MockKBFSOpsRecorder) Status(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status", arg0)
 }
 
+func (_m *MockKBFSOps) FolderUsage(ctx context.Context, folderBranch FolderBranch) (FolderUsage, error) {
+	ret := _m.ctrl.Call(_m, "FolderUsage", ctx, folderBranch)
+	ret0, _ := ret[0].(FolderUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) FolderUsage(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FolderUsage", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetFolderPinning(ctx context.Context, folderBranch FolderBranch, pinning FolderPinning) error {
+	ret := _m.ctrl.Call(_m, "SetFolderPinning", ctx, folderBranch, pinning)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetFolderPinning(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFolderPinning", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetTlfSyncMode(ctx context.Context, folderBranch FolderBranch, mode TlfSyncMode) error {
+	ret := _m.ctrl.Call(_m, "SetTlfSyncMode", ctx, folderBranch, mode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetTlfSyncMode(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTlfSyncMode", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetBandwidthSchedule(ctx context.Context, schedule BandwidthSchedule) error {
+	ret := _m.ctrl.Call(_m, "SetBandwidthSchedule", ctx, schedule)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetBandwidthSchedule(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBandwidthSchedule", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) UnfreezeFolder(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "UnfreezeFolder", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnfreezeFolder(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnfreezeFolder", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ArchiveFolder(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ArchiveFolder", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ArchiveFolder(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ArchiveFolder", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetFolderQuota(ctx context.Context, folderBranch FolderBranch, limit uint64) error {
+	ret := _m.ctrl.Call(_m, "SetFolderQuota", ctx, folderBranch, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetFolderQuota(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFolderQuota", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetFolderTrashRetention(ctx context.Context, folderBranch FolderBranch, retention time.Duration) error {
+	ret := _m.ctrl.Call(_m, "SetFolderTrashRetention", ctx, folderBranch, retention)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetFolderTrashRetention(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFolderTrashRetention", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListTrash(ctx context.Context, folderBranch FolderBranch) ([]TrashEntry, error) {
+	ret := _m.ctrl.Call(_m, "ListTrash", ctx, folderBranch)
+	ret0, _ := ret[0].([]TrashEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListTrash(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListTrash", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RestoreFromTrash(ctx context.Context, folderBranch FolderBranch, trashPath string) error {
+	ret := _m.ctrl.Call(_m, "RestoreFromTrash", ctx, folderBranch, trashPath)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RestoreFromTrash(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RestoreFromTrash", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) EmptyTrash(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "EmptyTrash", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) EmptyTrash(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EmptyTrash", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ExportTLF(ctx context.Context, tlfID TlfID, w io.Writer) error {
+	ret := _m.ctrl.Call(_m, "ExportTLF", ctx, tlfID, w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ExportTLF(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ExportTLF", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ImportTLF(ctx context.Context, tlfID TlfID, r io.Reader) error {
+	ret := _m.ctrl.Call(_m, "ImportTLF", ctx, tlfID, r)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ImportTLF(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ImportTLF", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) UnsyncedChanges(ctx context.Context) ([]UnsyncedChange, error) {
+	ret := _m.ctrl.Call(_m, "UnsyncedChanges", ctx)
+	ret0, _ := ret[0].([]UnsyncedChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnsyncedChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnsyncedChanges", arg0)
+}
+
+func (_m *MockKBFSOps) GetUnsyncedChange(ctx context.Context, file Node) (*UnsyncedChange, error) {
+	ret := _m.ctrl.Call(_m, "GetUnsyncedChange", ctx, file)
+	ret0, _ := ret[0].(*UnsyncedChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetUnsyncedChange(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUnsyncedChange", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) FlushPath(ctx context.Context, node Node) error {
+	ret := _m.ctrl.Call(_m, "FlushPath", ctx, node)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) FlushPath(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FlushPath", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) FlushAndWait(ctx context.Context, progress func(FlushProgress)) error {
+	ret := _m.ctrl.Call(_m, "FlushAndWait", ctx, progress)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) FlushAndWait(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FlushAndWait", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) WaitForWriteBack(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "WaitForWriteBack", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) WaitForWriteBack(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WaitForWriteBack", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) PreviewConflictResolution(ctx context.Context, tlfID TlfID) (ConflictResolutionPreview, error) {
+	ret := _m.ctrl.Call(_m, "PreviewConflictResolution", ctx, tlfID)
+	ret0, _ := ret[0].(ConflictResolutionPreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) PreviewConflictResolution(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PreviewConflictResolution", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) CheckDeviceRevocation(_param0 context.Context) error {
+	ret := _m.ctrl.Call(_m, "CheckDeviceRevocation", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) CheckDeviceRevocation(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckDeviceRevocation", arg0)
+}
+
+func (_m *MockKBFSOps) Logout(_param0 context.Context) error {
+	ret := _m.ctrl.Call(_m, "Logout", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Logout(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Logout", arg0)
+}
+
+func (_m *MockKBFSOps) Login(_param0 context.Context) error {
+	ret := _m.ctrl.Call(_m, "Login", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Login(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Login", arg0)
+}
+
 func (_m *MockKBFSOps) UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "UnstageForTesting", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -450,6 +813,27 @@ func (_mr *_MockKBFSOpsRecorder) Rekey(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rekey", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) RotateKeysAfterRevocation(ctx context.Context, uid protocol.UID) error {
+	ret := _m.ctrl.Call(_m, "RotateKeysAfterRevocation", ctx, uid)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RotateKeysAfterRevocation(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RotateKeysAfterRevocation", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) KeyRotations(ctx context.Context) ([]KeyRotationStatus, error) {
+	ret := _m.ctrl.Call(_m, "KeyRotations", ctx)
+	ret0, _ := ret[0].([]KeyRotationStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) KeyRotations(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "KeyRotations", arg0)
+}
+
 func (_m *MockKBFSOps) SyncFromServerForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "SyncFromServerForTesting", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -471,6 +855,51 @@ func (_mr *_MockKBFSOpsRecorder) GetUpdateHistory(arg0, arg1 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUpdateHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) ExportMDChain(ctx context.Context, folderBranch FolderBranch) (MDChain, error) {
+	ret := _m.ctrl.Call(_m, "ExportMDChain", ctx, folderBranch)
+	ret0, _ := ret[0].(MDChain)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ExportMDChain(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ExportMDChain", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) VerifyTLFHistory(ctx context.Context, folderBranch FolderBranch, proof TLFMerkleProof) (MetadataRevision, error) {
+	ret := _m.ctrl.Call(_m, "VerifyTLFHistory", ctx, folderBranch, proof)
+	ret0, _ := ret[0].(MetadataRevision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) VerifyTLFHistory(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyTLFHistory", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetFolderHead(ctx context.Context, folderBranch FolderBranch) (FolderHead, <-chan StatusUpdate, error) {
+	ret := _m.ctrl.Call(_m, "GetFolderHead", ctx, folderBranch)
+	ret0, _ := ret[0].(FolderHead)
+	ret1, _ := ret[1].(<-chan StatusUpdate)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFolderHead(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFolderHead", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) MakeContentManifest(ctx context.Context, dir Node) (ContentManifest, error) {
+	ret := _m.ctrl.Call(_m, "MakeContentManifest", ctx, dir)
+	ret0, _ := ret[0].(ContentManifest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) MakeContentManifest(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MakeContentManifest", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -489,6 +918,14 @@ func (_mr *_MockKBFSOpsRecorder) PushConnectionStatusChange(arg0, arg1 interface
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PushConnectionStatusChange", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) PushRetryStatusChange(_param0 string, _param1 RetryStatus) {
+	_m.ctrl.Call(_m, "PushRetryStatusChange", _param0, _param1)
+}
+
+func (_mr *_MockKBFSOpsRecorder) PushRetryStatusChange(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PushRetryStatusChange", arg0, arg1)
+}
+
 // Mock of KeybaseDaemon interface
 type MockKeybaseDaemon struct {
 	ctrl     *gomock.Controller
@@ -937,9 +1374,20 @@ func (_mr *_MockKeyManagerRecorder) Rekey(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rekey", arg0, arg1, arg2)
 }
 
-// Mock of Reporter interface
-type MockReporter struct {
-	ctrl     *gomock.Controller
+func (_m *MockKeyManager) GetTLFCryptKeyHistory(ctx context.Context, tlfID TlfID) (TLFCryptKeyHistory, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFCryptKeyHistory", ctx, tlfID)
+	ret0, _ := ret[0].(TLFCryptKeyHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKeyManagerRecorder) GetTLFCryptKeyHistory(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFCryptKeyHistory", arg0, arg1)
+}
+
+// Mock of Reporter interface
+type MockReporter struct {
+	ctrl     *gomock.Controller
 	recorder *_MockReporterRecorder
 }
 
@@ -992,6 +1440,89 @@ func (_mr *_MockReporterRecorder) Shutdown() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
 }
 
+// Mock of EventBus interface
+type MockEventBus struct {
+	ctrl     *gomock.Controller
+	recorder *_MockEventBusRecorder
+}
+
+// Recorder for MockEventBus (not exported)
+type _MockEventBusRecorder struct {
+	mock *MockEventBus
+}
+
+func NewMockEventBus(ctrl *gomock.Controller) *MockEventBus {
+	mock := &MockEventBus{ctrl: ctrl}
+	mock.recorder = &_MockEventBusRecorder{mock}
+	return mock
+}
+
+func (_m *MockEventBus) EXPECT() *_MockEventBusRecorder {
+	return _m.recorder
+}
+
+func (_m *MockEventBus) Publish(e Event) {
+	_m.ctrl.Call(_m, "Publish", e)
+}
+
+func (_mr *_MockEventBusRecorder) Publish(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Publish", arg0)
+}
+
+func (_m *MockEventBus) Subscribe(bufSize int, kinds ...EventKind) *EventSubscription {
+	_s := []interface{}{bufSize}
+	for _, _x := range kinds {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "Subscribe", _s...)
+	ret0, _ := ret[0].(*EventSubscription)
+	return ret0
+}
+
+func (_mr *_MockEventBusRecorder) Subscribe(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0}, arg1...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Subscribe", _s...)
+}
+
+// Mock of MetricsExporter interface
+type MockMetricsExporter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockMetricsExporterRecorder
+}
+
+// Recorder for MockMetricsExporter (not exported)
+type _MockMetricsExporterRecorder struct {
+	mock *MockMetricsExporter
+}
+
+func NewMockMetricsExporter(ctrl *gomock.Controller) *MockMetricsExporter {
+	mock := &MockMetricsExporter{ctrl: ctrl}
+	mock.recorder = &_MockMetricsExporterRecorder{mock}
+	return mock
+}
+
+func (_m *MockMetricsExporter) EXPECT() *_MockMetricsExporterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockMetricsExporter) Addr() string {
+	ret := _m.ctrl.Call(_m, "Addr")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockMetricsExporterRecorder) Addr() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Addr")
+}
+
+func (_m *MockMetricsExporter) Shutdown() {
+	_m.ctrl.Call(_m, "Shutdown")
+}
+
+func (_mr *_MockMetricsExporterRecorder) Shutdown() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown")
+}
+
 // Mock of MDCache interface
 type MockMDCache struct {
 	ctrl     *gomock.Controller
@@ -1159,6 +1690,38 @@ func (_mr *_MockBlockCacheRecorder) DeleteKnownPtr(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteKnownPtr", arg0, arg1)
 }
 
+func (_m *MockBlockCache) SetPinnedTlfs(tlfs map[TlfID]bool, pinnedBytesCapacity uint64) {
+	_m.ctrl.Call(_m, "SetPinnedTlfs", tlfs, pinnedBytesCapacity)
+}
+
+func (_mr *_MockBlockCacheRecorder) SetPinnedTlfs(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPinnedTlfs", arg0, arg1)
+}
+
+func (_m *MockBlockCache) SetCacheLimits(transientCapacity int, cleanBytesCapacity uint64) {
+	_m.ctrl.Call(_m, "SetCacheLimits", transientCapacity, cleanBytesCapacity)
+}
+
+func (_mr *_MockBlockCacheRecorder) SetCacheLimits(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetCacheLimits", arg0, arg1)
+}
+
+func (_m *MockBlockCache) PinBlock(ptr BlockPointer, tlf TlfID) {
+	_m.ctrl.Call(_m, "PinBlock", ptr, tlf)
+}
+
+func (_mr *_MockBlockCacheRecorder) PinBlock(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PinBlock", arg0, arg1)
+}
+
+func (_m *MockBlockCache) UnpinBlock(ptr BlockPointer) {
+	_m.ctrl.Call(_m, "UnpinBlock", ptr)
+}
+
+func (_mr *_MockBlockCacheRecorder) UnpinBlock(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnpinBlock", arg0)
+}
+
 // Mock of DirtyBlockCache interface
 type MockDirtyBlockCache struct {
 	ctrl     *gomock.Controller
@@ -1221,15 +1784,15 @@ func (_mr *_MockDirtyBlockCacheRecorder) IsDirty(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsDirty", arg0, arg1)
 }
 
-func (_m *MockDirtyBlockCache) RequestPermissionToDirty(ctx context.Context, estimatedDirtyBytes int64) (DirtyPermChan, error) {
-	ret := _m.ctrl.Call(_m, "RequestPermissionToDirty", ctx, estimatedDirtyBytes)
+func (_m *MockDirtyBlockCache) RequestPermissionToDirty(ctx context.Context, writer NodeID, estimatedDirtyBytes int64) (DirtyPermChan, error) {
+	ret := _m.ctrl.Call(_m, "RequestPermissionToDirty", ctx, writer, estimatedDirtyBytes)
 	ret0, _ := ret[0].(DirtyPermChan)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-func (_mr *_MockDirtyBlockCacheRecorder) RequestPermissionToDirty(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "RequestPermissionToDirty", arg0, arg1)
+func (_mr *_MockDirtyBlockCacheRecorder) RequestPermissionToDirty(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RequestPermissionToDirty", arg0, arg1, arg2)
 }
 
 func (_m *MockDirtyBlockCache) UpdateUnsyncedBytes(newUnsyncedBytes int64, wasSyncing bool) {
@@ -2306,6 +2869,14 @@ func (_mr *_MockMDServerRecorder) RegisterForUpdate(arg0, arg1, arg2 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForUpdate", arg0, arg1, arg2)
 }
 
+func (_m *MockMDServer) CancelRegistration(_param0 context.Context, _param1 TlfID) {
+	_m.ctrl.Call(_m, "CancelRegistration", _param0, _param1)
+}
+
+func (_mr *_MockMDServerRecorder) CancelRegistration(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CancelRegistration", arg0, arg1)
+}
+
 func (_m *MockMDServer) CheckForRekeys(ctx context.Context) <-chan error {
 	ret := _m.ctrl.Call(_m, "CheckForRekeys", ctx)
 	ret0, _ := ret[0].(<-chan error)
@@ -2316,6 +2887,17 @@ func (_mr *_MockMDServerRecorder) CheckForRekeys(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckForRekeys", arg0)
 }
 
+func (_m *MockMDServer) GetRekeyHints(ctx context.Context) ([]TlfID, error) {
+	ret := _m.ctrl.Call(_m, "GetRekeyHints", ctx)
+	ret0, _ := ret[0].([]TlfID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetRekeyHints(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRekeyHints", arg0)
+}
+
 func (_m *MockMDServer) TruncateLock(ctx context.Context, id TlfID) (bool, error) {
 	ret := _m.ctrl.Call(_m, "TruncateLock", ctx, id)
 	ret0, _ := ret[0].(bool)
@@ -2338,6 +2920,50 @@ func (_mr *_MockMDServerRecorder) TruncateUnlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TruncateUnlock", arg0, arg1)
 }
 
+func (_m *MockMDServer) SetCheckpoint(ctx context.Context, id TlfID, rev MetadataRevision) error {
+	ret := _m.ctrl.Call(_m, "SetCheckpoint", ctx, id, rev)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMDServerRecorder) SetCheckpoint(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetCheckpoint", arg0, arg1, arg2)
+}
+
+func (_m *MockMDServer) GetHistoryStatus(ctx context.Context, id TlfID) (MDHistoryStatus, error) {
+	ret := _m.ctrl.Call(_m, "GetHistoryStatus", ctx, id)
+	ret0, _ := ret[0].(MDHistoryStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetHistoryStatus(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetHistoryStatus", arg0, arg1)
+}
+
+func (_m *MockMDServer) GetFileLock(ctx context.Context, id TlfID, file string, lock FileLock) (FileLock, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetFileLock", ctx, id, file, lock)
+	ret0, _ := ret[0].(FileLock)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) GetFileLock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileLock", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockMDServer) SetFileLock(ctx context.Context, id TlfID, file string, lock FileLock) (bool, error) {
+	ret := _m.ctrl.Call(_m, "SetFileLock", ctx, id, file, lock)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) SetFileLock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFileLock", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockMDServer) DisableRekeyUpdatesForTesting() {
 	_m.ctrl.Call(_m, "DisableRekeyUpdatesForTesting")
 }
@@ -2375,6 +3001,17 @@ func (_mr *_MockMDServerRecorder) GetLatestHandleForTLF(arg0, arg1 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetLatestHandleForTLF", arg0, arg1)
 }
 
+func (_m *MockMDServer) Capabilities(ctx context.Context) (MDServerCapabilities, error) {
+	ret := _m.ctrl.Call(_m, "Capabilities", ctx)
+	ret0, _ := ret[0].(MDServerCapabilities)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) Capabilities(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Capabilities", arg0)
+}
+
 // Mock of BlockServer interface
 type MockBlockServer struct {
 	ctrl     *gomock.Controller
@@ -2416,6 +3053,17 @@ func (_mr *_MockBlockServerRecorder) Get(arg0, arg1, arg2, arg3 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockBlockServer) GetKey(ctx context.Context, id BlockID, tlfID TlfID, context BlockContext) (BlockCryptKeyServerHalf, error) {
+	ret := _m.ctrl.Call(_m, "GetKey", ctx, id, tlfID, context)
+	ret0, _ := ret[0].(BlockCryptKeyServerHalf)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBlockServerRecorder) GetKey(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKey", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockBlockServer) Put(ctx context.Context, id BlockID, tlfID TlfID, context BlockContext, buf []byte, serverHalf BlockCryptKeyServerHalf) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, id, tlfID, context, buf, serverHalf)
 	ret0, _ := ret[0].(error)
@@ -2476,6 +3124,39 @@ func (_mr *_MockBlockServerRecorder) GetUserQuotaInfo(arg0 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
 }
 
+func (_m *MockBlockServer) GetTLFQuotaInfo(ctx context.Context, tlfID TlfID) (*UsageStat, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFQuotaInfo", ctx, tlfID)
+	ret0, _ := ret[0].(*UsageStat)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBlockServerRecorder) GetTLFQuotaInfo(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFQuotaInfo", arg0, arg1)
+}
+
+func (_m *MockBlockServer) GetQuotaPoolInfo(ctx context.Context, tlfID TlfID) (*QuotaPoolInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetQuotaPoolInfo", ctx, tlfID)
+	ret0, _ := ret[0].(*QuotaPoolInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBlockServerRecorder) GetQuotaPoolInfo(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetQuotaPoolInfo", arg0, arg1)
+}
+
+func (_m *MockBlockServer) Capabilities(ctx context.Context) (BlockServerCapabilities, error) {
+	ret := _m.ctrl.Call(_m, "Capabilities", ctx)
+	ret0, _ := ret[0].(BlockServerCapabilities)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBlockServerRecorder) Capabilities(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Capabilities", arg0)
+}
+
 // Mock of blockServerLocal interface
 type MockblockServerLocal struct {
 	ctrl     *gomock.Controller
@@ -2577,6 +3258,28 @@ func (_mr *_MockblockServerLocalRecorder) GetUserQuotaInfo(arg0 interface{}) *go
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
 }
 
+func (_m *MockblockServerLocal) GetTLFQuotaInfo(ctx context.Context, tlfID TlfID) (*UsageStat, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFQuotaInfo", ctx, tlfID)
+	ret0, _ := ret[0].(*UsageStat)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockblockServerLocalRecorder) GetTLFQuotaInfo(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFQuotaInfo", arg0, arg1)
+}
+
+func (_m *MockblockServerLocal) GetQuotaPoolInfo(ctx context.Context, tlfID TlfID) (*QuotaPoolInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetQuotaPoolInfo", ctx, tlfID)
+	ret0, _ := ret[0].(*QuotaPoolInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockblockServerLocalRecorder) GetQuotaPoolInfo(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetQuotaPoolInfo", arg0, arg1)
+}
+
 func (_m *MockblockServerLocal) getAll(tlfID TlfID) (map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error) {
 	ret := _m.ctrl.Call(_m, "getAll", tlfID)
 	ret0, _ := ret[0].(map[BlockID]map[BlockRefNonce]blockRefLocalStatus)
@@ -2785,6 +3488,17 @@ func (_mr *_MockNotifierRecorder) UnregisterFromChanges(arg0, arg1 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnregisterFromChanges", arg0, arg1)
 }
 
+func (_m *MockNotifier) WatchChanges(tlfIDs []TlfID) (*ChangeSubscription, error) {
+	ret := _m.ctrl.Call(_m, "WatchChanges", tlfIDs)
+	ret0, _ := ret[0].(*ChangeSubscription)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockNotifierRecorder) WatchChanges(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WatchChanges", arg0)
+}
+
 // Mock of Clock interface
 type MockClock struct {
 	ctrl     *gomock.Controller
@@ -2940,6 +3654,24 @@ func (_mr *_MockConfigRecorder) SetReporter(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetReporter", arg0)
 }
 
+func (_m *MockConfig) EventBus() EventBus {
+	ret := _m.ctrl.Call(_m, "EventBus")
+	ret0, _ := ret[0].(EventBus)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) EventBus() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EventBus")
+}
+
+func (_m *MockConfig) SetEventBus(_param0 EventBus) {
+	_m.ctrl.Call(_m, "SetEventBus", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetEventBus(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetEventBus", arg0)
+}
+
 func (_m *MockConfig) MDCache() MDCache {
 	ret := _m.ctrl.Call(_m, "MDCache")
 	ret0, _ := ret[0].(MDCache)
@@ -3246,6 +3978,60 @@ func (_mr *_MockConfigRecorder) SetConflictRenamer(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictRenamer", arg0)
 }
 
+func (_m *MockConfig) MergeStrategy() MergeStrategy {
+	ret := _m.ctrl.Call(_m, "MergeStrategy")
+	ret0, _ := ret[0].(MergeStrategy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MergeStrategy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MergeStrategy")
+}
+
+func (_m *MockConfig) SetMergeStrategy(_param0 MergeStrategy) {
+	_m.ctrl.Call(_m, "SetMergeStrategy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMergeStrategy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMergeStrategy", arg0)
+}
+
+func (_m *MockConfig) DeletionPolicy() DeletionPolicy {
+	ret := _m.ctrl.Call(_m, "DeletionPolicy")
+	ret0, _ := ret[0].(DeletionPolicy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DeletionPolicy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeletionPolicy")
+}
+
+func (_m *MockConfig) SetDeletionPolicy(_param0 DeletionPolicy) {
+	_m.ctrl.Call(_m, "SetDeletionPolicy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDeletionPolicy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDeletionPolicy", arg0)
+}
+
+func (_m *MockConfig) AnomalyDetector() AnomalyDetector {
+	ret := _m.ctrl.Call(_m, "AnomalyDetector")
+	ret0, _ := ret[0].(AnomalyDetector)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) AnomalyDetector() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AnomalyDetector")
+}
+
+func (_m *MockConfig) SetAnomalyDetector(_param0 AnomalyDetector) {
+	_m.ctrl.Call(_m, "SetAnomalyDetector", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetAnomalyDetector(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetAnomalyDetector", arg0)
+}
+
 func (_m *MockConfig) MetadataVersion() MetadataVer {
 	ret := _m.ctrl.Call(_m, "MetadataVersion")
 	ret0, _ := ret[0].(MetadataVer)
@@ -3324,6 +4110,26 @@ func (_mr *_MockConfigRecorder) MaxDirBytes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBytes")
 }
 
+func (_m *MockConfig) MaxDirEntries() int {
+	ret := _m.ctrl.Call(_m, "MaxDirEntries")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirEntries() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirEntries")
+}
+
+func (_m *MockConfig) MaxDirEntriesPerBlock() int {
+	ret := _m.ctrl.Call(_m, "MaxDirEntriesPerBlock")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirEntriesPerBlock() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirEntriesPerBlock")
+}
+
 func (_m *MockConfig) DoBackgroundFlushes() bool {
 	ret := _m.ctrl.Call(_m, "DoBackgroundFlushes")
 	ret0, _ := ret[0].(bool)
@@ -3334,6 +4140,60 @@ func (_mr *_MockConfigRecorder) DoBackgroundFlushes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoBackgroundFlushes")
 }
 
+func (_m *MockConfig) MaxDirtyAge() time.Duration {
+	ret := _m.ctrl.Call(_m, "MaxDirtyAge")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxDirtyAge() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirtyAge")
+}
+
+func (_m *MockConfig) SetMaxDirtyAge(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetMaxDirtyAge", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxDirtyAge(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxDirtyAge", arg0)
+}
+
+func (_m *MockConfig) IntegrityCheckPeriod() time.Duration {
+	ret := _m.ctrl.Call(_m, "IntegrityCheckPeriod")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) IntegrityCheckPeriod() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IntegrityCheckPeriod")
+}
+
+func (_m *MockConfig) SetIntegrityCheckPeriod(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetIntegrityCheckPeriod", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetIntegrityCheckPeriod(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetIntegrityCheckPeriod", arg0)
+}
+
+func (_m *MockConfig) WriteCoalesceWindow() time.Duration {
+	ret := _m.ctrl.Call(_m, "WriteCoalesceWindow")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) WriteCoalesceWindow() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteCoalesceWindow")
+}
+
+func (_m *MockConfig) SetWriteCoalesceWindow(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetWriteCoalesceWindow", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetWriteCoalesceWindow(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetWriteCoalesceWindow", arg0)
+}
+
 func (_m *MockConfig) RekeyWithPromptWaitTime() time.Duration {
 	ret := _m.ctrl.Call(_m, "RekeyWithPromptWaitTime")
 	ret0, _ := ret[0].(time.Duration)
@@ -3408,6 +4268,78 @@ func (_mr *_MockConfigRecorder) SetMetricsRegistry(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMetricsRegistry", arg0)
 }
 
+func (_m *MockConfig) MetricsExporter() MetricsExporter {
+	ret := _m.ctrl.Call(_m, "MetricsExporter")
+	ret0, _ := ret[0].(MetricsExporter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MetricsExporter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MetricsExporter")
+}
+
+func (_m *MockConfig) SetMetricsExporter(_param0 MetricsExporter) {
+	_m.ctrl.Call(_m, "SetMetricsExporter", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMetricsExporter(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMetricsExporter", arg0)
+}
+
+func (_m *MockConfig) SpanExporter() SpanExporter {
+	ret := _m.ctrl.Call(_m, "SpanExporter")
+	ret0, _ := ret[0].(SpanExporter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SpanExporter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SpanExporter")
+}
+
+func (_m *MockConfig) SetSpanExporter(_param0 SpanExporter) {
+	_m.ctrl.Call(_m, "SetSpanExporter", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetSpanExporter(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSpanExporter", arg0)
+}
+
+func (_m *MockConfig) ChangeFeed() ChangeFeed {
+	ret := _m.ctrl.Call(_m, "ChangeFeed")
+	ret0, _ := ret[0].(ChangeFeed)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ChangeFeed() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ChangeFeed")
+}
+
+func (_m *MockConfig) SetChangeFeed(_param0 ChangeFeed) {
+	_m.ctrl.Call(_m, "SetChangeFeed", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetChangeFeed(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetChangeFeed", arg0)
+}
+
+func (_m *MockConfig) ResolveCache() ResolveCache {
+	ret := _m.ctrl.Call(_m, "ResolveCache")
+	ret0, _ := ret[0].(ResolveCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ResolveCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveCache")
+}
+
+func (_m *MockConfig) SetResolveCache(_param0 ResolveCache) {
+	_m.ctrl.Call(_m, "SetResolveCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetResolveCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetResolveCache", arg0)
+}
+
 func (_m *MockConfig) TLFValidDuration() time.Duration {
 	ret := _m.ctrl.Call(_m, "TLFValidDuration")
 	ret0, _ := ret[0].(time.Duration)
@@ -3426,6 +4358,312 @@ func (_mr *_MockConfigRecorder) SetTLFValidDuration(arg0 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTLFValidDuration", arg0)
 }
 
+func (_m *MockConfig) Mode() InitMode {
+	ret := _m.ctrl.Call(_m, "Mode")
+	ret0, _ := ret[0].(InitMode)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Mode() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Mode")
+}
+
+func (_m *MockConfig) SetMode(_param0 InitMode) {
+	_m.ctrl.Call(_m, "SetMode", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMode(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMode", arg0)
+}
+
+func (_m *MockConfig) WriteBackJournalDir() string {
+	ret := _m.ctrl.Call(_m, "WriteBackJournalDir")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) WriteBackJournalDir() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteBackJournalDir")
+}
+
+func (_m *MockConfig) SetWriteBackJournalDir(_param0 string) {
+	_m.ctrl.Call(_m, "SetWriteBackJournalDir", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetWriteBackJournalDir(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetWriteBackJournalDir", arg0)
+}
+
+func (_m *MockConfig) WriteBackJournalLimits() WriteBackJournalLimits {
+	ret := _m.ctrl.Call(_m, "WriteBackJournalLimits")
+	ret0, _ := ret[0].(WriteBackJournalLimits)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) WriteBackJournalLimits() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteBackJournalLimits")
+}
+
+func (_m *MockConfig) SetWriteBackJournalLimits(_param0 WriteBackJournalLimits) {
+	_m.ctrl.Call(_m, "SetWriteBackJournalLimits", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetWriteBackJournalLimits(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetWriteBackJournalLimits", arg0)
+}
+
+func (_m *MockConfig) BlockPutWorkers() int {
+	ret := _m.ctrl.Call(_m, "BlockPutWorkers")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockPutWorkers() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockPutWorkers")
+}
+
+func (_m *MockConfig) SetBlockPutWorkers(_param0 int) {
+	_m.ctrl.Call(_m, "SetBlockPutWorkers", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockPutWorkers(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockPutWorkers", arg0)
+}
+
+func (_m *MockConfig) BlockPutsPerHost() int {
+	ret := _m.ctrl.Call(_m, "BlockPutsPerHost")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockPutsPerHost() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockPutsPerHost")
+}
+
+func (_m *MockConfig) SetBlockPutsPerHost(_param0 int) {
+	_m.ctrl.Call(_m, "SetBlockPutsPerHost", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockPutsPerHost(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockPutsPerHost", arg0)
+}
+
+func (_m *MockConfig) MDWritesPerMinute() int {
+	ret := _m.ctrl.Call(_m, "MDWritesPerMinute")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MDWritesPerMinute() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDWritesPerMinute")
+}
+
+func (_m *MockConfig) SetMDWritesPerMinute(_param0 int) {
+	_m.ctrl.Call(_m, "SetMDWritesPerMinute", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMDWritesPerMinute(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMDWritesPerMinute", arg0)
+}
+
+func (_m *MockConfig) BlockGetsPerFolder() int {
+	ret := _m.ctrl.Call(_m, "BlockGetsPerFolder")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockGetsPerFolder() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockGetsPerFolder")
+}
+
+func (_m *MockConfig) SetBlockGetsPerFolder(_param0 int) {
+	_m.ctrl.Call(_m, "SetBlockGetsPerFolder", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockGetsPerFolder(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockGetsPerFolder", arg0)
+}
+
+func (_m *MockConfig) BlockTransportEncodings() []BlockTransportEncoding {
+	ret := _m.ctrl.Call(_m, "BlockTransportEncodings")
+	ret0, _ := ret[0].([]BlockTransportEncoding)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockTransportEncodings() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockTransportEncodings")
+}
+
+func (_m *MockConfig) SetBlockTransportEncodings(_param0 []BlockTransportEncoding) {
+	_m.ctrl.Call(_m, "SetBlockTransportEncodings", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockTransportEncodings(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockTransportEncodings", arg0)
+}
+
+func (_m *MockConfig) RPCDeadlinePolicy() RPCDeadlinePolicy {
+	ret := _m.ctrl.Call(_m, "RPCDeadlinePolicy")
+	ret0, _ := ret[0].(RPCDeadlinePolicy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) RPCDeadlinePolicy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RPCDeadlinePolicy")
+}
+
+func (_m *MockConfig) SetRPCDeadlinePolicy(policy RPCDeadlinePolicy) {
+	_m.ctrl.Call(_m, "SetRPCDeadlinePolicy", policy)
+}
+
+func (_mr *_MockConfigRecorder) SetRPCDeadlinePolicy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRPCDeadlinePolicy", arg0)
+}
+
+func (_m *MockConfig) RetryPolicy() RetryPolicy {
+	ret := _m.ctrl.Call(_m, "RetryPolicy")
+	ret0, _ := ret[0].(RetryPolicy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) RetryPolicy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RetryPolicy")
+}
+
+func (_m *MockConfig) SetRetryPolicy(_param0 RetryPolicy) {
+	_m.ctrl.Call(_m, "SetRetryPolicy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetRetryPolicy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRetryPolicy", arg0)
+}
+
+func (_m *MockConfig) FaultPolicy() FaultPolicy {
+	ret := _m.ctrl.Call(_m, "FaultPolicy")
+	ret0, _ := ret[0].(FaultPolicy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) FaultPolicy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FaultPolicy")
+}
+
+func (_m *MockConfig) SetFaultPolicy(_param0 FaultPolicy) {
+	_m.ctrl.Call(_m, "SetFaultPolicy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetFaultPolicy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetFaultPolicy", arg0)
+}
+
+func (_m *MockConfig) BandwidthScheduler() BandwidthScheduler {
+	ret := _m.ctrl.Call(_m, "BandwidthScheduler")
+	ret0, _ := ret[0].(BandwidthScheduler)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BandwidthScheduler() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BandwidthScheduler")
+}
+
+func (_m *MockConfig) SetBandwidthScheduler(_param0 BandwidthScheduler) {
+	_m.ctrl.Call(_m, "SetBandwidthScheduler", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBandwidthScheduler(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBandwidthScheduler", arg0)
+}
+
+func (_m *MockConfig) ContentDefinedChunking() bool {
+	ret := _m.ctrl.Call(_m, "ContentDefinedChunking")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ContentDefinedChunking() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ContentDefinedChunking")
+}
+
+func (_m *MockConfig) SetContentDefinedChunking(_param0 bool) {
+	_m.ctrl.Call(_m, "SetContentDefinedChunking", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetContentDefinedChunking(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetContentDefinedChunking", arg0)
+}
+
+func (_m *MockConfig) KVStoreBackend() KVStoreBackend {
+	ret := _m.ctrl.Call(_m, "KVStoreBackend")
+	ret0, _ := ret[0].(KVStoreBackend)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) KVStoreBackend() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "KVStoreBackend")
+}
+
+func (_m *MockConfig) SetKVStoreBackend(_param0 KVStoreBackend) {
+	_m.ctrl.Call(_m, "SetKVStoreBackend", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetKVStoreBackend(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetKVStoreBackend", arg0)
+}
+
+func (_m *MockConfig) BlockCacheAdmission() bool {
+	ret := _m.ctrl.Call(_m, "BlockCacheAdmission")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCacheAdmission() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCacheAdmission")
+}
+
+func (_m *MockConfig) SetBlockCacheAdmission(_param0 bool) {
+	_m.ctrl.Call(_m, "SetBlockCacheAdmission", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCacheAdmission(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCacheAdmission", arg0)
+}
+
+func (_m *MockConfig) BlockCacheAutoSize() bool {
+	ret := _m.ctrl.Call(_m, "BlockCacheAutoSize")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCacheAutoSize() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCacheAutoSize")
+}
+
+func (_m *MockConfig) SetBlockCacheAutoSize(_param0 bool) {
+	_m.ctrl.Call(_m, "SetBlockCacheAutoSize", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCacheAutoSize(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCacheAutoSize", arg0)
+}
+
+func (_m *MockConfig) PerFileWriteFairness() bool {
+	ret := _m.ctrl.Call(_m, "PerFileWriteFairness")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) PerFileWriteFairness() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PerFileWriteFairness")
+}
+
+func (_m *MockConfig) SetPerFileWriteFairness(_param0 bool) {
+	_m.ctrl.Call(_m, "SetPerFileWriteFairness", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetPerFileWriteFairness(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPerFileWriteFairness", arg0)
+}
+
 func (_m *MockConfig) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -3587,6 +4825,65 @@ func (_mr *_MockcrActionRecorder) String() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "String")
 }
 
+// Mock of BandwidthScheduler interface
+type MockBandwidthScheduler struct {
+	ctrl     *gomock.Controller
+	recorder *_MockBandwidthSchedulerRecorder
+}
+
+// Recorder for MockBandwidthScheduler (not exported)
+type _MockBandwidthSchedulerRecorder struct {
+	mock *MockBandwidthScheduler
+}
+
+func NewMockBandwidthScheduler(ctrl *gomock.Controller) *MockBandwidthScheduler {
+	mock := &MockBandwidthScheduler{ctrl: ctrl}
+	mock.recorder = &_MockBandwidthSchedulerRecorder{mock}
+	return mock
+}
+
+func (_m *MockBandwidthScheduler) EXPECT() *_MockBandwidthSchedulerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockBandwidthScheduler) Schedule() BandwidthSchedule {
+	ret := _m.ctrl.Call(_m, "Schedule")
+	ret0, _ := ret[0].(BandwidthSchedule)
+	return ret0
+}
+
+func (_mr *_MockBandwidthSchedulerRecorder) Schedule() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Schedule")
+}
+
+func (_m *MockBandwidthScheduler) SetSchedule(_param0 BandwidthSchedule) {
+	_m.ctrl.Call(_m, "SetSchedule", _param0)
+}
+
+func (_mr *_MockBandwidthSchedulerRecorder) SetSchedule(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSchedule", arg0)
+}
+
+func (_m *MockBandwidthScheduler) WaitToSend(_param0 context.Context, _param1 int) error {
+	ret := _m.ctrl.Call(_m, "WaitToSend", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBandwidthSchedulerRecorder) WaitToSend(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WaitToSend", arg0, arg1)
+}
+
+func (_m *MockBandwidthScheduler) WaitToReceive(_param0 context.Context, _param1 int) error {
+	ret := _m.ctrl.Call(_m, "WaitToReceive", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBandwidthSchedulerRecorder) WaitToReceive(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WaitToReceive", arg0, arg1)
+}
+
 // Mock of RekeyQueue interface
 type MockRekeyQueue struct {
 	ctrl     *gomock.Controller
@@ -3655,3 +4952,31 @@ func (_m *MockRekeyQueue) Wait(ctx context.Context) error {
 func (_mr *_MockRekeyQueueRecorder) Wait(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Wait", arg0)
 }
+
+func (_m *MockRekeyQueue) Status() RekeyQueueStatus {
+	ret := _m.ctrl.Call(_m, "Status")
+	ret0, _ := ret[0].(RekeyQueueStatus)
+	return ret0
+}
+
+func (_mr *_MockRekeyQueueRecorder) Status() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status")
+}
+
+func (_m *MockRekeyQueue) Prioritize(id TlfID) bool {
+	ret := _m.ctrl.Call(_m, "Prioritize", id)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockRekeyQueueRecorder) Prioritize(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Prioritize", arg0)
+}
+
+func (_m *MockRekeyQueue) SetMinRekeyInterval(interval time.Duration) {
+	_m.ctrl.Call(_m, "SetMinRekeyInterval", interval)
+}
+
+func (_mr *_MockRekeyQueueRecorder) SetMinRekeyInterval(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMinRekeyInterval", arg0)
+}
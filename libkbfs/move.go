@@ -0,0 +1,271 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// moveCopyChunkBytes is how much file data MoveAcrossFolders copies
+// with each read and write.
+const moveCopyChunkBytes = 512 * 1024
+
+// MoveProgress reports how far KBFSOps.MoveAcrossFolders has gotten
+// copying the moved entry into its new folder.
+type MoveProgress struct {
+	// Files and Bytes are how many files, and how many bytes of
+	// file data, have been copied so far.
+	Files int
+	Bytes int64
+	// TotalFiles and TotalBytes are how many files, and how many
+	// bytes, there are to copy in all.
+	TotalFiles int
+	TotalBytes int64
+}
+
+// makeMoveTempName returns a name under which to build the copy of a
+// moved entry, before it replaces the new name.
+func makeMoveTempName() (string, error) {
+	buf := make([]byte, 4)
+	if err := cryptoRandRead(buf); err != nil {
+		return "", err
+	}
+	return ".moving-" + hex.EncodeToString(buf), nil
+}
+
+// sortedChildren returns the names of the children of dir, sorted.
+func (fs *KBFSOpsStandard) sortedChildren(ctx context.Context, dir Node) (
+	[]string, error) {
+	children, err := fs.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// measureTree adds the files and bytes under the given entry to the
+// totals in p.
+func (fs *KBFSOpsStandard) measureTree(ctx context.Context, node Node,
+	ei EntryInfo, p *MoveProgress) error {
+	switch ei.Type {
+	case File, Exec:
+		p.TotalFiles++
+		p.TotalBytes += int64(ei.Size)
+	case Dir:
+		names, err := fs.sortedChildren(ctx, node)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			child, childEI, err := fs.Lookup(ctx, node, name)
+			if err != nil {
+				return err
+			}
+			if err := fs.measureTree(ctx, child, childEI, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents and attributes of from into to.
+func (fs *KBFSOpsStandard) copyFile(ctx context.Context, from Node,
+	ei EntryInfo, to Node, p *MoveProgress, report func()) error {
+	buf := make([]byte, moveCopyChunkBytes)
+	for off := int64(0); ; {
+		n, err := fs.Read(ctx, from, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err := fs.Write(ctx, to, buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+		p.Bytes += n
+		report()
+	}
+
+	names, err := fs.ListXattr(ctx, from)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := fs.GetXattr(ctx, from, name)
+		if err != nil {
+			return err
+		}
+		err = fs.SetXattr(ctx, to, name, value, XattrCreateOrReplace)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := fs.Sync(ctx, to); err != nil {
+		return err
+	}
+	mtime := time.Unix(0, ei.Mtime)
+	return fs.SetMtime(ctx, to, &mtime)
+}
+
+// copyTree copies the given entry, and everything under it, to the
+// given name in toDir.
+func (fs *KBFSOpsStandard) copyTree(ctx context.Context, from Node,
+	ei EntryInfo, toDir Node, toName string, p *MoveProgress,
+	report func()) error {
+	switch ei.Type {
+	case Sym:
+		_, err := fs.CreateLink(ctx, toDir, toName, ei.SymPath)
+		return err
+	case File, Exec:
+		to, _, err := fs.CreateFile(ctx, toDir, toName, ei.Type == Exec)
+		if err != nil {
+			return err
+		}
+		if err := fs.copyFile(ctx, from, ei, to, p, report); err != nil {
+			return err
+		}
+		p.Files++
+		report()
+		return nil
+	case Dir:
+		to, _, err := fs.CreateDir(ctx, toDir, toName)
+		if err != nil {
+			return err
+		}
+		names, err := fs.sortedChildren(ctx, from)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			child, childEI, err := fs.Lookup(ctx, from, name)
+			if err != nil {
+				return err
+			}
+			err = fs.copyTree(ctx, child, childEI, to, name, p, report)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return InvalidPathError{}
+	}
+}
+
+// removeTree removes the given entry of dir, and everything under it.
+func (fs *KBFSOpsStandard) removeTree(ctx context.Context, dir Node,
+	name string) error {
+	node, ei, err := fs.Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type != Dir {
+		return fs.RemoveEntry(ctx, dir, name)
+	}
+	names, err := fs.sortedChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for _, child := range names {
+		if err := fs.removeTree(ctx, node, child); err != nil {
+			return err
+		}
+	}
+	return fs.RemoveDir(ctx, dir, name)
+}
+
+// MoveAcrossFolders implements the KBFSOps interface for
+// KBFSOpsStandard.  Every file is read back and written again in
+// the new folder, so all of its data is re-encrypted and re-uploaded
+// there: blocks are encrypted with the keys of the folder they
+// belong to, and their references are tracked per folder by the
+// block server, so the new folder can't just reference the old
+// folder's blocks.
+func (fs *KBFSOpsStandard) MoveAcrossFolders(
+	ctx context.Context, oldParent Node, oldName string, newParent Node,
+	newName string, progress func(MoveProgress)) (err error) {
+	fs.log.CDebugf(ctx, "MoveAcrossFolders %p/%s -> %p/%s",
+		oldParent.GetID(), oldName, newParent.GetID(), newName)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if oldParent.GetFolderBranch() == newParent.GetFolderBranch() {
+		return fs.Rename(ctx, oldParent, oldName, newParent, newName)
+	}
+
+	from, ei, err := fs.Lookup(ctx, oldParent, oldName)
+	if err != nil {
+		return err
+	}
+	if _, newEI, err := fs.Lookup(ctx, newParent, newName); err == nil {
+		if newEI.Type == Dir {
+			return NotFileError{}
+		}
+	} else if _, ok := err.(NoSuchNameError); !ok {
+		return err
+	}
+
+	var p MoveProgress
+	if err := fs.measureTree(ctx, from, ei, &p); err != nil {
+		return err
+	}
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	report()
+
+	// Build the copy under a temporary name, and only swap it in
+	// once it's complete, so that a failed move leaves the new
+	// folder as it was.
+	tempName, err := makeMoveTempName()
+	if err != nil {
+		return err
+	}
+	copied := false
+	defer func() {
+		if err == nil || copied {
+			return
+		}
+		// The caller's context may be what failed, so clean up
+		// with a fresh one, but don't let it hang forever.
+		rmCtx, cancel := context.WithTimeout(
+			context.Background(), backgroundTaskTimeout)
+		defer cancel()
+		if rmErr := fs.removeTree(rmCtx, newParent,
+			tempName); rmErr != nil {
+			if _, ok := rmErr.(NoSuchNameError); !ok {
+				fs.log.CWarningf(ctx, "Couldn't remove partial copy %s: %v",
+					tempName, rmErr)
+			}
+		}
+	}()
+	err = fs.copyTree(ctx, from, ei, newParent, tempName, &p, report)
+	if err != nil {
+		return err
+	}
+	err = fs.Rename(ctx, newParent, tempName, newParent, newName)
+	if err != nil {
+		return err
+	}
+	copied = true
+
+	// The move is done once the copy is in place; if the original
+	// can't be removed, both stay around and nothing is lost.
+	return fs.removeTree(ctx, oldParent, oldName)
+}
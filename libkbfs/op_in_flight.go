@@ -0,0 +1,141 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// InFlightOp describes a KBFSOps operation that hasn't returned yet.
+type InFlightOp struct {
+	// Op is the kind of operation, with the same names as the
+	// latencies in status, like "Read" or "Sync".
+	Op string
+	// Path is the path of the file or directory the operation is
+	// on, starting with the name of its top-level folder.  For a
+	// lookup, it's the path of the name being looked up.
+	Path string
+	// Start is when the operation started.
+	Start time.Time
+	// Bytes is how many bytes the operation has fetched from or
+	// put to the block server so far.
+	Bytes int64
+}
+
+// inFlightOpsByStart sorts InFlightOps from the oldest to the newest.
+type inFlightOpsByStart []InFlightOp
+
+func (s inFlightOpsByStart) Len() int           { return len(s) }
+func (s inFlightOpsByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+func (s inFlightOpsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// inFlightOp is an operation registered with an inFlightOpTracker.
+// A nil *inFlightOp ignores the bytes added to it.
+type inFlightOp struct {
+	op    string
+	node  Node
+	name  string
+	start time.Time
+	// bytes must be accessed atomically.
+	bytes int64
+}
+
+// addBytes records that n more bytes were moved to or from the block
+// server on behalf of the operation.
+func (op *inFlightOp) addBytes(n int64) {
+	if op == nil {
+		return
+	}
+	atomic.AddInt64(&op.bytes, n)
+}
+
+type ctxInFlightOpKeyType int
+
+const ctxInFlightOpKey ctxInFlightOpKeyType = iota
+
+// inFlightOpFromContext returns the operation that ctx was made for
+// by inFlightOpTracker.begin, or nil if there isn't one.
+func inFlightOpFromContext(ctx context.Context) *inFlightOp {
+	op, _ := ctx.Value(ctxInFlightOpKey).(*inFlightOp)
+	return op
+}
+
+// inFlightOpTracker keeps track of the operations currently running
+// on a folder.
+type inFlightOpTracker struct {
+	config    Config
+	nodeCache NodeCache
+
+	lock sync.Mutex
+	ops  map[*inFlightOp]bool
+}
+
+func newInFlightOpTracker(
+	config Config, nodeCache NodeCache) *inFlightOpTracker {
+	return &inFlightOpTracker{
+		config:    config,
+		nodeCache: nodeCache,
+		ops:       make(map[*inFlightOp]bool),
+	}
+}
+
+// begin registers an operation of the given kind on node, or on the
+// given name in node if name is non-empty.  It returns a context
+// carrying the operation, for the block fetches and puts made on its
+// behalf to add their bytes to, and the operation itself, which must
+// be passed to end once the operation returns.
+func (ift *inFlightOpTracker) begin(ctx context.Context, op string,
+	node Node, name string) (context.Context, *inFlightOp) {
+	ifo := &inFlightOp{
+		op:    op,
+		node:  node,
+		name:  name,
+		start: ift.config.Clock().Now(),
+	}
+	ift.lock.Lock()
+	defer ift.lock.Unlock()
+	ift.ops[ifo] = true
+	return context.WithValue(ctx, ctxInFlightOpKey, ifo), ifo
+}
+
+// end unregisters an operation registered by begin.
+func (ift *inFlightOpTracker) end(ifo *inFlightOp) {
+	ift.lock.Lock()
+	defer ift.lock.Unlock()
+	delete(ift.ops, ifo)
+}
+
+// getOps returns the operations currently running, oldest first, or
+// nil if there aren't any.
+func (ift *inFlightOpTracker) getOps() []InFlightOp {
+	ift.lock.Lock()
+	defer ift.lock.Unlock()
+	if len(ift.ops) == 0 {
+		return nil
+	}
+	ops := make([]InFlightOp, 0, len(ift.ops))
+	for ifo := range ift.ops {
+		var p string
+		if ifo.node != nil {
+			p = ift.nodeCache.PathFromNode(ifo.node).String()
+			if ifo.name != "" {
+				p += "/" + ifo.name
+			}
+		}
+		ops = append(ops, InFlightOp{
+			Op:    ifo.op,
+			Path:  p,
+			Start: ifo.start,
+			Bytes: atomic.LoadInt64(&ifo.bytes),
+		})
+	}
+	sort.Sort(inFlightOpsByStart(ops))
+	return ops
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestInFlightOpTracker(t *testing.T) {
+	config := &ConfigLocal{}
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	id := FakeTlfID(1, false)
+	nodeCache := newNodeCacheStandard(FolderBranch{id, MasterBranch})
+	rootPtr := BlockPointer{ID: fakeBlockID(1)}
+	root, err := nodeCache.GetOrCreate(rootPtr, "alice", nil)
+	require.NoError(t, err)
+	file, err := nodeCache.GetOrCreate(
+		BlockPointer{ID: fakeBlockID(2)}, "a", root)
+	require.NoError(t, err)
+
+	ift := newInFlightOpTracker(config, nodeCache)
+	require.Nil(t, ift.getOps())
+
+	start := clock.Now()
+	ctx, syncOp := ift.begin(context.Background(), opLatencySync, file, "")
+	require.Equal(t, syncOp, inFlightOpFromContext(ctx))
+	inFlightOpFromContext(ctx).addBytes(100)
+	inFlightOpFromContext(ctx).addBytes(20)
+	clock.Add(time.Second)
+	_, lookup := ift.begin(
+		context.Background(), opLatencyLookup, root, "b")
+	require.Equal(t, []InFlightOp{
+		{Op: opLatencySync, Path: "alice/a", Start: start, Bytes: 120},
+		{Op: opLatencyLookup, Path: "alice/b", Start: start.Add(time.Second)},
+	}, ift.getOps())
+
+	ift.end(syncOp)
+	ift.end(lookup)
+	require.Nil(t, ift.getOps())
+
+	// Contexts without an operation ignore bytes.
+	require.Nil(t, inFlightOpFromContext(context.Background()))
+	inFlightOpFromContext(context.Background()).addBytes(1)
+}
+
+// bserverStallPut is a BlockServer whose first Put waits until
+// unstall is closed, after closing started.
+type bserverStallPut struct {
+	BlockServer
+	once    *sync.Once
+	started chan struct{}
+	unstall chan struct{}
+}
+
+func (b bserverStallPut) Put(ctx context.Context, id BlockID,
+	tlfID TlfID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.unstall
+	})
+	return b.BlockServer.Put(ctx, id, tlfID, context, buf, serverHalf)
+}
+
+func TestInFlightOpsInStatus(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	bserver := config.BlockServer()
+	defer config.SetBlockServer(bserver)
+	stall := bserverStallPut{
+		BlockServer: bserver,
+		once:        &sync.Once{},
+		started:     make(chan struct{}),
+		unstall:     make(chan struct{}),
+	}
+	config.SetBlockServer(stall)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- kbfsOps.Sync(ctx, fileNode)
+	}()
+	select {
+	case <-stall.started:
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.InFlightOps, 1)
+	require.Equal(t, opLatencySync, status.InFlightOps[0].Op)
+	require.Equal(t, "alice/a", status.InFlightOps[0].Path)
+
+	kbfsStatus, _, err := kbfsOps.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, status.InFlightOps, kbfsStatus.InFlightOps)
+
+	close(stall.unstall)
+	require.NoError(t, <-errChan)
+
+	status, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Nil(t, status.InFlightOps)
+}
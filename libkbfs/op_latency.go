@@ -0,0 +1,93 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Names of the operations whose latencies are reported in status.
+const (
+	opLatencyRead    = "Read"
+	opLatencyWrite   = "Write"
+	opLatencySync    = "Sync"
+	opLatencyLookup  = "Lookup"
+	opLatencyMDFetch = "MDFetch"
+)
+
+const (
+	// opLatencySampleSize and opLatencySampleAlpha configure the
+	// exponentially-decaying samples behind the latency
+	// percentiles, so that they mostly reflect the last five
+	// minutes or so (the same parameters go-metrics timers use).
+	opLatencySampleSize  = 1028
+	opLatencySampleAlpha = 0.015
+)
+
+// OpLatencyStats summarizes how long one kind of operation has been
+// taking recently.
+type OpLatencyStats struct {
+	// Count is the total number of operations so far.
+	Count int64
+	// P50, P95 and P99 are percentiles of recent latencies.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// opLatencyTracker keeps rolling latency histograms for each kind of
+// operation on a folder.
+type opLatencyTracker struct {
+	config Config
+
+	lock       sync.Mutex
+	histograms map[string]metrics.Histogram
+}
+
+func newOpLatencyTracker(config Config) *opLatencyTracker {
+	return &opLatencyTracker{
+		config:     config,
+		histograms: make(map[string]metrics.Histogram),
+	}
+}
+
+// record notes that an operation of the given kind, started at the
+// given time, has just finished.
+func (olt *opLatencyTracker) record(op string, start time.Time) {
+	latency := olt.config.Clock().Now().Sub(start)
+	olt.lock.Lock()
+	defer olt.lock.Unlock()
+	h, ok := olt.histograms[op]
+	if !ok {
+		h = metrics.NewHistogram(metrics.NewExpDecaySample(
+			opLatencySampleSize, opLatencySampleAlpha))
+		olt.histograms[op] = h
+	}
+	h.Update(int64(latency))
+}
+
+// stats returns the latency stats of every kind of operation that
+// has been recorded, or nil if there haven't been any.
+func (olt *opLatencyTracker) stats() map[string]OpLatencyStats {
+	olt.lock.Lock()
+	defer olt.lock.Unlock()
+	if len(olt.histograms) == 0 {
+		return nil
+	}
+	stats := make(map[string]OpLatencyStats, len(olt.histograms))
+	for op, h := range olt.histograms {
+		ps := h.Percentiles([]float64{0.5, 0.95, 0.99})
+		stats[op] = OpLatencyStats{
+			Count: h.Count(),
+			P50:   time.Duration(ps[0]),
+			P95:   time.Duration(ps[1]),
+			P99:   time.Duration(ps[2]),
+		}
+	}
+	return stats
+}
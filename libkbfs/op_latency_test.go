@@ -0,0 +1,73 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpLatencyTrackerStats(t *testing.T) {
+	config := &ConfigLocal{}
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	olt := newOpLatencyTracker(config)
+	require.Nil(t, olt.stats())
+
+	for i := 1; i <= 100; i++ {
+		start := clock.Now()
+		clock.Add(time.Duration(i) * time.Millisecond)
+		olt.record(opLatencyRead, start)
+	}
+	start := clock.Now()
+	clock.Add(time.Second)
+	olt.record(opLatencyMDFetch, start)
+
+	stats := olt.stats()
+	require.Len(t, stats, 2)
+	read := stats[opLatencyRead]
+	require.Equal(t, int64(100), read.Count)
+	require.InDelta(t, float64(50500*time.Microsecond), float64(read.P50),
+		float64(time.Microsecond))
+	require.InDelta(t, float64(95950*time.Microsecond), float64(read.P95),
+		float64(time.Microsecond))
+	require.InDelta(t, float64(99990*time.Microsecond), float64(read.P99),
+		float64(time.Microsecond))
+	require.Equal(t, OpLatencyStats{
+		Count: 1,
+		P50:   time.Second,
+		P95:   time.Second,
+		P99:   time.Second,
+	}, stats[opLatencyMDFetch])
+}
+
+func TestOpLatenciesInStatus(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	for _, op := range []string{opLatencyWrite, opLatencySync, opLatencyLookup} {
+		require.Equal(t, int64(1), status.Latencies[op].Count, op)
+	}
+
+	kbfsStatus, _, err := kbfsOps.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, status.Latencies,
+		kbfsStatus.FolderLatencies["/keybase/private/alice"])
+}
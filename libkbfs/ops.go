@@ -16,6 +16,7 @@ import (
 type op interface {
 	AddRefBlock(ptr BlockPointer)
 	AddUnrefBlock(ptr BlockPointer)
+	DelRefBlock(ptr BlockPointer)
 	AddUpdate(oldPtr BlockPointer, newPtr BlockPointer)
 	SizeExceptUpdates() uint64
 	AllUpdates() []blockUpdate
@@ -99,6 +100,17 @@ func (oc *OpCommon) AddUnrefBlock(ptr BlockPointer) {
 	oc.UnrefBlocks = append(oc.UnrefBlocks, ptr)
 }
 
+// DelRefBlock removes the first reference of the given block from
+// the list of newly-referenced blocks for this op.
+func (oc *OpCommon) DelRefBlock(ptr BlockPointer) {
+	for i, ref := range oc.RefBlocks {
+		if ptr == ref {
+			oc.RefBlocks = append(oc.RefBlocks[:i], oc.RefBlocks[i+1:]...)
+			break
+		}
+	}
+}
+
 // AddUpdate adds a mapping from an old block to the new version of
 // that block, for this op.
 func (oc *OpCommon) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
@@ -649,6 +661,8 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
+	linksAttr
 )
 
 func (ac attrChange) String() string {
@@ -659,6 +673,10 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
+	case linksAttr:
+		return "links"
 	}
 	return "<invalid attrChange>"
 }
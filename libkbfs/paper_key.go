@@ -0,0 +1,148 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+)
+
+// PaperKey holds the signing and crypt keys derived from a user's
+// paper key phrase.
+type PaperKey struct {
+	signingKey      SigningKey
+	cryptPrivateKey CryptPrivateKey
+}
+
+// MakePaperKey derives the keys of the paper key with the given
+// phrase, the same way they were derived when the paper key was made.
+func MakePaperKey(phrase string) (PaperKey, error) {
+	p := libkb.NewPaperKeyPhrase(phrase)
+	if invalid := p.InvalidWords(); len(invalid) > 0 {
+		return PaperKey{}, InvalidPaperKeyError{
+			"unknown words: " + strings.Join(invalid, ", ")}
+	}
+	version, err := p.Version()
+	if err != nil {
+		return PaperKey{}, InvalidPaperKeyError{err.Error()}
+	}
+	if version != libkb.PaperKeyVersion {
+		return PaperKey{}, InvalidPaperKeyError{"unsupported version"}
+	}
+
+	seed, err := scrypt.Key(p.Bytes(), nil, libkb.PaperKeyScryptCost,
+		libkb.PaperKeyScryptR, libkb.PaperKeyScryptP,
+		libkb.PaperKeyScryptKeylen)
+	if err != nil {
+		return PaperKey{}, err
+	}
+
+	var signingSecret SigningKeySecret
+	copy(signingSecret.secret[:], seed[:SigningKeySecretSize])
+	signingKey, err := makeSigningKey(signingSecret)
+	if err != nil {
+		return PaperKey{}, err
+	}
+	var cryptSecret CryptPrivateKeySecret
+	copy(cryptSecret.secret[:],
+		seed[SigningKeySecretSize:SigningKeySecretSize+CryptPrivateKeySecretSize])
+	cryptPrivateKey, err := makeCryptPrivateKey(cryptSecret)
+	if err != nil {
+		return PaperKey{}, err
+	}
+	return PaperKey{signingKey, cryptPrivateKey}, nil
+}
+
+// GetVerifyingKey returns the public half of the paper key's signing
+// key.
+func (k PaperKey) GetVerifyingKey() VerifyingKey {
+	return k.signingKey.GetVerifyingKey()
+}
+
+// GetCryptPublicKey returns the public half of the paper key's crypt
+// key.
+func (k PaperKey) GetCryptPublicKey() CryptPublicKey {
+	return k.cryptPrivateKey.getPublicKey()
+}
+
+// NewCryptoPaperKey returns a Crypto that signs and decrypts with the
+// given paper key, without needing a provisioned device.
+func NewCryptoPaperKey(config Config, key PaperKey) *CryptoLocal {
+	return NewCryptoLocal(config, key.signingKey, key.cryptPrivateKey)
+}
+
+// paperKeyKBPKI reports the owner of a paper key as the current
+// user, and the paper key as the current device, for when there is
+// no logged-in session to ask.
+type paperKeyKBPKI struct {
+	KBPKI
+	clock    Clock
+	username libkb.NormalizedUsername
+	key      PaperKey
+
+	lock sync.Mutex
+	uid  keybase1.UID
+}
+
+var _ KBPKI = (*paperKeyKBPKI)(nil)
+
+func newPaperKeyKBPKI(kbpki KBPKI, clock Clock,
+	username libkb.NormalizedUsername, key PaperKey) *paperKeyKBPKI {
+	return &paperKeyKBPKI{
+		KBPKI:    kbpki,
+		clock:    clock,
+		username: username,
+		key:      key,
+	}
+}
+
+// GetCurrentToken implements the KBPKI interface for paperKeyKBPKI.
+func (k *paperKeyKBPKI) GetCurrentToken(ctx context.Context) (string, error) {
+	// There's no session, and so no token.
+	return "", nil
+}
+
+// GetCurrentUserInfo implements the KBPKI interface for paperKeyKBPKI.
+func (k *paperKeyKBPKI) GetCurrentUserInfo(ctx context.Context) (
+	libkb.NormalizedUsername, keybase1.UID, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.uid.Exists() {
+		return k.username, k.uid, nil
+	}
+
+	_, uid, err := k.KBPKI.Resolve(ctx, string(k.username))
+	if err != nil {
+		return libkb.NormalizedUsername(""), keybase1.UID(""), err
+	}
+	// Make sure the paper key really belongs to this user, and
+	// hasn't been revoked, before acting as them.
+	err = k.KBPKI.HasVerifyingKey(
+		ctx, uid, k.key.GetVerifyingKey(), k.clock.Now())
+	if err != nil {
+		return libkb.NormalizedUsername(""), keybase1.UID(""), err
+	}
+	k.uid = uid
+	return k.username, k.uid, nil
+}
+
+// GetCurrentCryptPublicKey implements the KBPKI interface for
+// paperKeyKBPKI.
+func (k *paperKeyKBPKI) GetCurrentCryptPublicKey(ctx context.Context) (
+	CryptPublicKey, error) {
+	return k.key.GetCryptPublicKey(), nil
+}
+
+// GetCurrentVerifyingKey implements the KBPKI interface for
+// paperKeyKBPKI.
+func (k *paperKeyKBPKI) GetCurrentVerifyingKey(ctx context.Context) (
+	VerifyingKey, error) {
+	return k.key.GetVerifyingKey(), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakePaperKey(t *testing.T) {
+	phrase, err := libkb.MakePaperKeyPhrase(libkb.PaperKeyVersion)
+	require.NoError(t, err)
+
+	key1, err := MakePaperKey(phrase.String())
+	require.NoError(t, err)
+	key2, err := MakePaperKey(phrase.String())
+	require.NoError(t, err)
+	require.Equal(t, key1.GetVerifyingKey(), key2.GetVerifyingKey())
+	require.Equal(t, key1.GetCryptPublicKey(), key2.GetCryptPublicKey())
+
+	_, err = MakePaperKey("not a paper key")
+	require.IsType(t, InvalidPaperKeyError{}, err)
+}
+
+func TestPaperKeyRecoveryRead(t *testing.T) {
+	config1, uid, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+
+	phrase, err := libkb.MakePaperKeyPhrase(libkb.PaperKeyVersion)
+	require.NoError(t, err)
+	paperKey, err := MakePaperKey(phrase.String())
+	require.NoError(t, err)
+	kbd := config1.KeybaseDaemon().(*KeybaseDaemonLocal)
+	_, err = kbd.addDeviceForTesting(uid, func(libkb.NormalizedUsername, int) (
+		CryptPublicKey, VerifyingKey) {
+		return paperKey.GetCryptPublicKey(), paperKey.GetVerifyingKey()
+	})
+	require.NoError(t, err)
+
+	// Write a file, and rekey so that the paper key can read it.
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	err = kbfsOps1.Rekey(ctx, rootNode1.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetMode(InitPaperKeyRecovery)
+	config2.SetKBPKI(newPaperKeyKBPKI(
+		config2.KBPKI(), config2.Clock(), "alice", paperKey))
+	config2.SetCrypto(NewCryptoPaperKey(config2, paperKey))
+
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, []byte{1, 2, 3}, buf)
+
+	// Nothing can be written.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false)
+	require.IsType(t, ReadOnlyBranchError{}, err)
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/metricsutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// prometheusMetricPrefix is prepended to the name of every exported
+// metric.
+const prometheusMetricPrefix = "kbfs"
+
+// PrometheusExporter serves the metrics registry of a Config over
+// HTTP, at /metrics, in the Prometheus text format.
+type PrometheusExporter struct {
+	config   Config
+	log      logger.Logger
+	listener net.Listener
+
+	unsyncedDirtyBytes metrics.Gauge
+	totalDirtyBytes    metrics.Gauge
+	syncBufferBytes    metrics.Gauge
+}
+
+var _ MetricsExporter = (*PrometheusExporter)(nil)
+
+// NewPrometheusExporter starts serving the metrics registry of the
+// given config on the given address (e.g., "127.0.0.1:9188").  The
+// config must have a non-nil metrics registry.
+func NewPrometheusExporter(config Config, addr string) (
+	*PrometheusExporter, error) {
+	registry := config.MetricsRegistry()
+	if registry == nil {
+		return nil, errors.New("Prometheus exporter needs a metrics registry")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &PrometheusExporter{
+		config:   config,
+		log:      config.MakeLogger(""),
+		listener: listener,
+		unsyncedDirtyBytes: metrics.GetOrRegisterGauge(
+			"DirtyBlockCache.UnsyncedBytes", registry),
+		totalDirtyBytes: metrics.GetOrRegisterGauge(
+			"DirtyBlockCache.TotalBytes", registry),
+		syncBufferBytes: metrics.GetOrRegisterGauge(
+			"DirtyBlockCache.SyncBufferBytes", registry),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.serveMetrics)
+	go func() {
+		// Serve only returns once the listener is closed.
+		err := http.Serve(listener, mux)
+		e.log.CDebugf(nil, "Metrics exporter on %s stopped: %v",
+			e.Addr(), err)
+	}()
+	return e, nil
+}
+
+// updateGauges refreshes the gauges that are sampled, rather than
+// updated by the code they describe.
+func (e *PrometheusExporter) updateGauges() {
+	dbc, ok := e.config.DirtyBlockCache().(*DirtyBlockCacheStandard)
+	if !ok {
+		return
+	}
+	unsynced, total, syncBufferSize := dbc.getBytes()
+	e.unsyncedDirtyBytes.Update(unsynced)
+	e.totalDirtyBytes.Update(total)
+	e.syncBufferBytes.Update(syncBufferSize)
+}
+
+func (e *PrometheusExporter) serveMetrics(
+	w http.ResponseWriter, r *http.Request) {
+	e.updateGauges()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsutil.WritePrometheus(
+		e.config.MetricsRegistry(), prometheusMetricPrefix, w)
+}
+
+// Addr implements the MetricsExporter interface for
+// PrometheusExporter.
+func (e *PrometheusExporter) Addr() string {
+	return e.listener.Addr().String()
+}
+
+// Shutdown implements the MetricsExporter interface for
+// PrometheusExporter.
+func (e *PrometheusExporter) Shutdown() {
+	e.listener.Close()
+}
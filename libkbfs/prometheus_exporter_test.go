@@ -0,0 +1,48 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	if config.MetricsRegistry() == nil {
+		config.SetMetricsRegistry(metrics.NewRegistry())
+	}
+	// Register the block cache metrics with the registry.
+	config.ResetCaches()
+
+	exporter, err := NewPrometheusExporter(config, "127.0.0.1:0")
+	require.NoError(t, err)
+	config.SetMetricsExporter(exporter)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	resp, err := http.Get("http://" + exporter.Addr() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Contains(t, string(body), "# TYPE kbfs_BlockCache_Hits counter")
+	require.Contains(t, string(body), "kbfs_DirtyBlockCache_TotalBytes 0\n")
+	require.Contains(t, string(body), "kbfs_KBFSOps_Sync_seconds_count 1\n")
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+)
+
+// QuotaPool is a set of folders, like the folders of a team, whose
+// blocks count against one shared quota instead of the personal
+// quotas of the users who write them.  A list of them, encoded as
+// JSON, configures the pools of a BlockServerDisk.
+type QuotaPool struct {
+	Name string
+	// Limit is the number of bytes the pool's folders may store in
+	// total.  Zero means no limit.
+	Limit int64
+	// Folders holds the IDs of the pool's folders.
+	Folders []string
+}
+
+// ReadQuotaPools reads a list of QuotaPools from the given JSON file.
+func ReadQuotaPools(path string) ([]QuotaPool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pools []QuotaPool
+	err = json.Unmarshal(buf, &pools)
+	return pools, err
+}
+
+// QuotaPoolInfo contains the quota usage of a QuotaPool.
+type QuotaPoolInfo struct {
+	Name    string
+	Folders map[string]*UsageStat
+	// Members breaks the pool's usage down by the users who
+	// uploaded the blocks.
+	Members map[keybase1.UID]*UsageStat
+	Total   *UsageStat
+	Limit   int64
+}
+
+// NewQuotaPoolInfo returns a newly constructed QuotaPoolInfo.
+func NewQuotaPoolInfo(name string, limit int64) *QuotaPoolInfo {
+	return &QuotaPoolInfo{
+		Name:    name,
+		Folders: make(map[string]*UsageStat),
+		Members: make(map[keybase1.UID]*UsageStat),
+		Total:   NewUsageStat(),
+		Limit:   limit,
+	}
+}
+
+// AccumFolder adds the usage of one of the pool's folders, broken
+// down by uploader, to the QuotaPoolInfo.
+func (p *QuotaPoolInfo) AccumFolder(
+	folder string, usage map[keybase1.UID]*UsageStat) {
+	add := func(a, b int64) int64 { return a + b }
+	if _, ok := p.Folders[folder]; !ok {
+		p.Folders[folder] = NewUsageStat()
+	}
+	for uid, u := range usage {
+		if _, ok := p.Members[uid]; !ok {
+			p.Members[uid] = NewUsageStat()
+		}
+		p.Members[uid].Accum(u, add)
+		p.Folders[folder].Accum(u, add)
+		p.Total.Accum(u, add)
+	}
+}
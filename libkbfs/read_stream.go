@@ -0,0 +1,94 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// readStreamAhead is how many blocks' worth of data a file read
+// stream fetches ahead of its reader.
+const readStreamAhead = 2
+
+type readStreamChunk struct {
+	data []byte
+	err  error
+}
+
+// fileReadStream is the io.ReadCloser returned by
+// KBFSOps.ReadStream.  A background goroutine fetches the file one
+// child block at a time, a few blocks ahead of the reader, and hands
+// over each block's data as soon as it's been fetched and decrypted,
+// so a large read never waits for all of its blocks at once.
+type fileReadStream struct {
+	cancel context.CancelFunc
+	chunks <-chan readStreamChunk
+
+	cur []byte
+	err error
+}
+
+var _ io.ReadCloser = (*fileReadStream)(nil)
+
+// newFileReadStream returns a stream that starts with first, and then
+// reads the rest of the file from off on with readAt, which returns
+// the data starting at a given offset, and no data at the end of the
+// file.
+func newFileReadStream(ctx context.Context, first []byte, off int64,
+	readAt func(ctx context.Context, off int64) ([]byte, error)) *fileReadStream {
+	ctx, cancel := context.WithCancel(ctx)
+	chunks := make(chan readStreamChunk, readStreamAhead)
+	go func() {
+		defer close(chunks)
+		for {
+			data, err := readAt(ctx, off)
+			if err == nil && len(data) == 0 {
+				return
+			}
+			select {
+			case chunks <- readStreamChunk{data, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+			off += int64(len(data))
+		}
+	}()
+	return &fileReadStream{cancel: cancel, chunks: chunks, cur: first}
+}
+
+// Read implements the io.Reader interface for fileReadStream.
+func (s *fileReadStream) Read(p []byte) (int, error) {
+	for len(s.cur) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		chunk, ok := <-s.chunks
+		if !ok {
+			s.err = io.EOF
+		} else if chunk.err != nil {
+			s.err = chunk.err
+		} else {
+			s.cur = chunk.data
+		}
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+// Close implements the io.Closer interface for fileReadStream.
+func (s *fileReadStream) Close() error {
+	s.cancel()
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+	}
+	s.cur = nil
+	return nil
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -15,14 +16,36 @@ type rekeyQueueEntry struct {
 	ch chan error
 }
 
+// RekeyQueueStatus describes the progress of a RekeyQueue.  It is
+// suitable for encoding directly as JSON.
+type RekeyQueueStatus struct {
+	// InProgress is the ID of the folder being rekeyed right now,
+	// if any.
+	InProgress string `json:",omitempty"`
+	// Pending lists the IDs of the folders waiting to be rekeyed,
+	// in the order they'll be rekeyed.
+	Pending []string
+	// Done is how many rekeys have finished, successfully or not,
+	// since the queue was last cleared.
+	Done int
+	// Errors maps the ID of each folder whose last rekey failed to
+	// the error it failed with.
+	Errors map[string]string `json:",omitempty"`
+}
+
 // RekeyQueueStandard implements the RekeyQueue interface.
 type RekeyQueueStandard struct {
-	config    Config
-	queueMu   sync.RWMutex // protects all of the below
-	queue     []rekeyQueueEntry
-	hasWorkCh chan struct{}
-	cancel    context.CancelFunc
-	wg        RepeatedWaitGroup
+	config      Config
+	queueMu     sync.RWMutex // protects all of the below
+	queue       []rekeyQueueEntry
+	hasWorkCh   chan struct{}
+	cancel      context.CancelFunc
+	wg          RepeatedWaitGroup
+	inProgress  TlfID
+	done        int
+	errors      map[TlfID]error
+	minInterval time.Duration
+	lastStart   time.Time
 }
 
 // Test that RekeyQueueStandard fully implements the RekeyQueue interface.
@@ -100,6 +123,8 @@ func (rkq *RekeyQueueStandard) Clear() {
 			channels = append(channels, e.ch)
 		}
 		rkq.queue = make([]rekeyQueueEntry, 0)
+		rkq.done = 0
+		rkq.errors = nil
 		return channels
 	}()
 	for _, c := range channels {
@@ -113,6 +138,93 @@ func (rkq *RekeyQueueStandard) Wait(ctx context.Context) error {
 	return rkq.wg.Wait(ctx)
 }
 
+// Status implements the RekeyQueue interface for RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Status() RekeyQueueStatus {
+	rkq.queueMu.RLock()
+	defer rkq.queueMu.RUnlock()
+	status := RekeyQueueStatus{
+		Pending: make([]string, 0, len(rkq.queue)),
+		Done:    rkq.done,
+	}
+	for i, e := range rkq.queue {
+		if i == 0 && e.id == rkq.inProgress {
+			status.InProgress = e.id.String()
+			continue
+		}
+		status.Pending = append(status.Pending, e.id.String())
+	}
+	if len(rkq.errors) > 0 {
+		status.Errors = make(map[string]string, len(rkq.errors))
+		for id, err := range rkq.errors {
+			status.Errors[id.String()] = err.Error()
+		}
+	}
+	return status
+}
+
+// Prioritize implements the RekeyQueue interface for
+// RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) Prioritize(id TlfID) bool {
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	// Don't move anything ahead of the rekey in progress, which is
+	// still at the front of the queue.
+	front := 0
+	if len(rkq.queue) > 0 && rkq.queue[0].id == rkq.inProgress {
+		front = 1
+	}
+	for i := front; i < len(rkq.queue); i++ {
+		if rkq.queue[i].id != id {
+			continue
+		}
+		e := rkq.queue[i]
+		copy(rkq.queue[front+1:i+1], rkq.queue[front:i])
+		rkq.queue[front] = e
+		return true
+	}
+	// A folder that's already being rekeyed can't go any faster.
+	return front == 1 && rkq.queue[0].id == id
+}
+
+// SetMinRekeyInterval implements the RekeyQueue interface for
+// RekeyQueueStandard.
+func (rkq *RekeyQueueStandard) SetMinRekeyInterval(interval time.Duration) {
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	rkq.minInterval = interval
+}
+
+// start marks the given folder as being rekeyed, and returns how long
+// to wait first to respect the minimum rekey interval.
+func (rkq *RekeyQueueStandard) start(id TlfID) time.Duration {
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	rkq.inProgress = id
+	now := rkq.config.Clock().Now()
+	wait := rkq.lastStart.Add(rkq.minInterval).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	rkq.lastStart = now.Add(wait)
+	return wait
+}
+
+// finish records the result of rekeying the given folder.
+func (rkq *RekeyQueueStandard) finish(id TlfID, err error) {
+	rkq.queueMu.Lock()
+	defer rkq.queueMu.Unlock()
+	rkq.inProgress = NullTlfID
+	rkq.done++
+	if err != nil {
+		if rkq.errors == nil {
+			rkq.errors = make(map[TlfID]error)
+		}
+		rkq.errors[id] = err
+	} else {
+		delete(rkq.errors, id)
+	}
+}
+
 // CtxRekeyTagKey is the type used for unique context tags within an
 // enqueued Rekey.
 type CtxRekeyTagKey int
@@ -139,10 +251,17 @@ func (rkq *RekeyQueueStandard) processRekeys(ctx context.Context, hasWorkCh chan
 				}
 				func() {
 					defer rkq.wg.Done()
+					if wait := rkq.start(id); wait > 0 {
+						select {
+						case <-time.After(wait):
+						case <-ctx.Done():
+						}
+					}
 					// Assign an ID to this rekey operation so we can track it.
 					newCtx := ctxWithRandomID(ctx, CtxRekeyIDKey,
 						CtxRekeyOpID, nil)
 					err := rkq.config.KBFSOps().Rekey(newCtx, id)
+					rkq.finish(id, err)
 					if ch := rkq.dequeue(); ch != nil {
 						ch <- err
 						close(ch)
@@ -179,3 +298,23 @@ func (rkq *RekeyQueueStandard) dequeue() chan<- error {
 	rkq.queue = rkq.queue[1:]
 	return ch
 }
+
+// enqueueRekeyHints queues the folders that the given MD server has
+// flagged as needing a rekey, unless they're already queued.  It
+// returns how many folders it queued.
+func enqueueRekeyHints(ctx context.Context, mdserver MDServer,
+	rkq RekeyQueue) (int, error) {
+	ids, err := mdserver.GetRekeyHints(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		if rkq.IsRekeyPending(id) {
+			continue
+		}
+		rkq.Enqueue(id)
+		n++
+	}
+	return n, nil
+}
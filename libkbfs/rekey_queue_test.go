@@ -5,9 +5,13 @@
 package libkbfs
 
 import (
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
 	"golang.org/x/net/context"
 )
@@ -100,3 +104,177 @@ func TestRekeyQueueBasic(t *testing.T) {
 		_ = GetRootNodeOrBust(t, config2Dev2, name, false)
 	}
 }
+
+func TestRekeyQueuePrioritizeAndStatus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := NewConfigMock(mockCtrl, NewSafeTestReporter(t))
+	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
+	rkq := NewRekeyQueueStandard(config)
+	defer rkq.Clear()
+
+	id1 := FakeTlfID(1, false)
+	id2 := FakeTlfID(2, false)
+	id3 := FakeTlfID(3, false)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	expectedErr := errors.New("rekey failed")
+	gomock.InOrder(
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id1).Do(
+			func(ctx context.Context, id TlfID) {
+				started <- struct{}{}
+				<-release
+			}).Return(nil),
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id3).Return(
+			expectedErr),
+		config.mockKbfs.EXPECT().Rekey(gomock.Any(), id2).Return(nil),
+	)
+
+	c1 := rkq.Enqueue(id1)
+	<-started
+	c2 := rkq.Enqueue(id2)
+	c3 := rkq.Enqueue(id3)
+	status := rkq.Status()
+	expectedStatus := RekeyQueueStatus{
+		InProgress: id1.String(),
+		Pending:    []string{id2.String(), id3.String()},
+	}
+	if !reflect.DeepEqual(status, expectedStatus) {
+		t.Fatalf("Unexpected status: %v vs %v", status, expectedStatus)
+	}
+
+	if !rkq.Prioritize(id3) {
+		t.Errorf("Couldn't prioritize a pending folder")
+	}
+	if !rkq.Prioritize(id1) {
+		t.Errorf("Couldn't prioritize the folder in progress")
+	}
+	if rkq.Prioritize(FakeTlfID(4, false)) {
+		t.Errorf("Prioritized a folder that isn't queued")
+	}
+	status = rkq.Status()
+	expectedStatus.Pending = []string{id3.String(), id2.String()}
+	if !reflect.DeepEqual(status, expectedStatus) {
+		t.Fatalf("Unexpected status: %v vs %v", status, expectedStatus)
+	}
+
+	close(release)
+	if err := <-c1; err != nil {
+		t.Errorf("Unexpected rekey error: %v", err)
+	}
+	if err := <-c3; err != expectedErr {
+		t.Errorf("Unexpected rekey error: %v", err)
+	}
+	if err := <-c2; err != nil {
+		t.Errorf("Unexpected rekey error: %v", err)
+	}
+	if err := rkq.Wait(context.Background()); err != nil {
+		t.Fatalf("Couldn't wait for rekeys: %v", err)
+	}
+	status = rkq.Status()
+	expectedStatus = RekeyQueueStatus{
+		Pending: []string{},
+		Done:    3,
+		Errors:  map[string]string{id3.String(): expectedErr.Error()},
+	}
+	if !reflect.DeepEqual(status, expectedStatus) {
+		t.Fatalf("Unexpected status: %v vs %v", status, expectedStatus)
+	}
+}
+
+func TestRekeyQueueMinInterval(t *testing.T) {
+	config := NewConfigLocal()
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	rkq := NewRekeyQueueStandard(config)
+
+	if wait := rkq.start(FakeTlfID(1, false)); wait != 0 {
+		t.Errorf("Unexpected wait without a minimum interval: %s", wait)
+	}
+	rkq.SetMinRekeyInterval(time.Minute)
+	clock.Add(10 * time.Second)
+	if wait := rkq.start(FakeTlfID(2, false)); wait != 50*time.Second {
+		t.Errorf("Unexpected wait: %s", wait)
+	}
+	// The next rekey is spaced out from when the previous one
+	// will really start.
+	if wait := rkq.start(FakeTlfID(3, false)); wait != 110*time.Second {
+		t.Errorf("Unexpected wait: %s", wait)
+	}
+	clock.Add(10 * time.Minute)
+	if wait := rkq.start(FakeTlfID(4, false)); wait != 0 {
+		t.Errorf("Unexpected wait after a long pause: %s", wait)
+	}
+}
+
+func TestRekeyQueueEnqueueRekeyHints(t *testing.T) {
+	var u1, u2, u3 libkb.NormalizedUsername = "u1", "u2", "u3"
+	config1, _, ctx := kbfsOpsConcurInit(t, u1, u2, u3)
+	defer CheckConfigAndShutdown(t, config1)
+	_, uid2, err := config1.KBPKI().Resolve(ctx, u2.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// u1 writes to a folder shared with u2, one u2 can only read,
+	// one shared with u3, and a public one.
+	kbfsOps1 := config1.KBFSOps()
+	ids := make(map[string]TlfID)
+	for _, name := range []string{"u1,u2", "u1#u2", "u1,u3"} {
+		rootNode := GetRootNodeOrBust(t, config1, name, false)
+		_, _, err = kbfsOps1.CreateFile(ctx, rootNode, "a", false)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %v", err)
+		}
+		ids[name] = rootNode.GetFolderBranch().Tlf
+	}
+	rootNode := GetRootNodeOrBust(t, config1, "u1,u2", true)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode, "a", false)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	hints, err := config1.MDServer().GetRekeyHints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 0 {
+		t.Fatalf("Unexpected rekey hints before any new devices: %v", hints)
+	}
+
+	// u2 gets a new device, so the server flags every private
+	// folder with u2 in it.
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	hints, err = config1.MDServer().GetRekeyHints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[TlfID]bool{ids["u1,u2"]: true, ids["u1#u2"]: true}
+	got := make(map[TlfID]bool)
+	for _, id := range hints {
+		got[id] = true
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("Expected rekey hints %v, got %v", expected, got)
+	}
+
+	n, err := enqueueRekeyHints(ctx, config1.MDServer(), config1.RekeyQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 queued rekeys, got %d", n)
+	}
+	if err := config1.RekeyQueue().Wait(ctx); err != nil {
+		t.Fatalf("Couldn't wait on rekey: %v", err)
+	}
+
+	// The rekeys cleared the flags.
+	hints, err = config1.MDServer().GetRekeyHints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 0 {
+		t.Fatalf("Unexpected rekey hints after rekeying: %v", hints)
+	}
+}
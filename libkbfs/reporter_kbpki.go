@@ -15,12 +15,13 @@ import (
 
 const (
 	// error param keys
-	errorParamTlf       = "tlf"
-	errorParamMode      = "mode"
-	errorParamFeature   = "feature"
-	errorParamUsername  = "username"
-	errorParamExternal  = "external"
-	errorParamRekeySelf = "rekeyself"
+	errorParamTlf           = "tlf"
+	errorParamMode          = "mode"
+	errorParamFeature       = "feature"
+	errorParamUsername      = "username"
+	errorParamExternal      = "external"
+	errorParamRekeySelf     = "rekeyself"
+	errorParamDeviceRevoked = "devicerevoked"
 
 	// error operation modes
 	errorModeRead  = "read"
@@ -90,6 +91,9 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 		code = keybase1.FSErrorType_ACCESS_DENIED
 	case WriteAccessError:
 		code = keybase1.FSErrorType_ACCESS_DENIED
+	case DeviceRevokedError:
+		code = keybase1.FSErrorType_ACCESS_DENIED
+		params[errorParamDeviceRevoked] = "true"
 	case NoSuchUserError:
 		if !noErrorNames[e.Input] {
 			code = keybase1.FSErrorType_USER_NOT_FOUND
@@ -118,7 +122,7 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 	case FileTooBigError:
 		code = keybase1.FSErrorType_NOT_IMPLEMENTED
 		params[errorParamFeature] = errorFeatureFileLimit
-	case DirTooBigError:
+	case DirTooBigError, DirTooManyEntriesError:
 		code = keybase1.FSErrorType_NOT_IMPLEMENTED
 		params[errorParamFeature] = errorFeatureDirLimit
 	case NewMetadataVersionError:
@@ -0,0 +1,179 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/keybase/go-codec/codec"
+)
+
+const (
+	// resolveCacheAssertionPrefix prefixes the keys mapping each
+	// assertion to the resolveCacheEntry it resolved to.
+	resolveCacheAssertionPrefix = "a:"
+	// resolveCacheUserPrefix prefixes the keys of the index from
+	// each user to the assertions that resolved to them, as
+	// "u:UID:assertion".
+	resolveCacheUserPrefix = "u:"
+)
+
+// resolveCacheEntry is what's stored for each resolved assertion.
+type resolveCacheEntry struct {
+	Name libkb.NormalizedUsername
+	UID  keybase1.UID
+	// Time is when the assertion was resolved, in Unix
+	// nanoseconds.
+	Time int64
+
+	codec.UnknownFieldSetHandler
+}
+
+// ResolveCacheStandard is a ResolveCache kept in a kvStore, either on
+// disk, so that it lasts across restarts, or in memory.
+type ResolveCacheStandard struct {
+	config Config
+	log    logger.Logger
+	ttl    time.Duration
+	db     kvStore
+}
+
+var _ ResolveCache = (*ResolveCacheStandard)(nil)
+
+// NewResolveCacheStandard returns a new ResolveCacheStandard that
+// keeps its entries in the given directory, or in memory if dirPath
+// is empty, and trusts them for the given TTL.
+func NewResolveCacheStandard(config Config, dirPath string,
+	ttl time.Duration) (*ResolveCacheStandard, error) {
+	db, err := openKVStore(config, "ResolveCache", dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return &ResolveCacheStandard{
+		config: config,
+		log:    config.MakeLogger(""),
+		ttl:    ttl,
+		db:     db,
+	}, nil
+}
+
+func resolveCacheAssertionKey(assertion string) []byte {
+	return []byte(resolveCacheAssertionPrefix + assertion)
+}
+
+func resolveCacheUserKeyPrefix(uid keybase1.UID) []byte {
+	return []byte(resolveCacheUserPrefix + uid.String() + ":")
+}
+
+func resolveCacheUserKey(uid keybase1.UID, assertion string) []byte {
+	return append(resolveCacheUserKeyPrefix(uid), assertion...)
+}
+
+// getEntry returns the entry of the given assertion, if there is one.
+func (c *ResolveCacheStandard) getEntry(assertion string) (
+	resolveCacheEntry, bool) {
+	buf, err := c.db.Get(resolveCacheAssertionKey(assertion))
+	if err == errKVStoreNotFound {
+		return resolveCacheEntry{}, false
+	} else if err != nil {
+		c.log.Debug("Couldn't get the resolution of %s: %v", assertion, err)
+		return resolveCacheEntry{}, false
+	}
+	var entry resolveCacheEntry
+	if err := c.config.Codec().Decode(buf, &entry); err != nil {
+		c.log.Debug("Couldn't decode the resolution of %s: %v",
+			assertion, err)
+		return resolveCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// deleteEntry removes the given assertion's entry, resolved to the
+// given user.
+func (c *ResolveCacheStandard) deleteEntry(assertion string,
+	uid keybase1.UID) {
+	var batch kvBatch
+	batch.Delete(resolveCacheAssertionKey(assertion))
+	batch.Delete(resolveCacheUserKey(uid, assertion))
+	if err := c.db.Write(&batch); err != nil {
+		c.log.Debug("Couldn't forget the resolution of %s: %v",
+			assertion, err)
+	}
+}
+
+// Get implements the ResolveCache interface for ResolveCacheStandard.
+func (c *ResolveCacheStandard) Get(assertion string) (
+	libkb.NormalizedUsername, keybase1.UID, bool) {
+	entry, ok := c.getEntry(assertion)
+	if !ok {
+		return libkb.NormalizedUsername(""), keybase1.UID(""), false
+	}
+	resolved := time.Unix(0, entry.Time)
+	if c.config.Clock().Now().Sub(resolved) > c.ttl {
+		c.deleteEntry(assertion, entry.UID)
+		return libkb.NormalizedUsername(""), keybase1.UID(""), false
+	}
+	return entry.Name, entry.UID, true
+}
+
+// Put implements the ResolveCache interface for ResolveCacheStandard.
+func (c *ResolveCacheStandard) Put(assertion string,
+	name libkb.NormalizedUsername, uid keybase1.UID) {
+	buf, err := c.config.Codec().Encode(resolveCacheEntry{
+		Name: name,
+		UID:  uid,
+		Time: c.config.Clock().Now().UnixNano(),
+	})
+	if err != nil {
+		c.log.Debug("Couldn't encode the resolution of %s: %v",
+			assertion, err)
+		return
+	}
+
+	var batch kvBatch
+	if old, ok := c.getEntry(assertion); ok && old.UID != uid {
+		batch.Delete(resolveCacheUserKey(old.UID, assertion))
+	}
+	batch.Put(resolveCacheAssertionKey(assertion), buf)
+	batch.Put(resolveCacheUserKey(uid, assertion), nil)
+	if err := c.db.Write(&batch); err != nil {
+		c.log.Debug("Couldn't cache the resolution of %s: %v",
+			assertion, err)
+	}
+}
+
+// InvalidateUser implements the ResolveCache interface for
+// ResolveCacheStandard.
+func (c *ResolveCacheStandard) InvalidateUser(uid keybase1.UID) {
+	prefix := resolveCacheUserKeyPrefix(uid)
+	iter := c.db.NewIterator(prefix, kvPrefixLimit(prefix))
+	var batch kvBatch
+	for iter.Next() {
+		key := append([]byte(nil), iter.Key()...)
+		assertion := string(key[len(prefix):])
+		batch.Delete(key)
+		batch.Delete(resolveCacheAssertionKey(assertion))
+	}
+	err := iter.Error()
+	iter.Release()
+	if err != nil {
+		c.log.Debug("Couldn't find the resolutions to %s: %v", uid, err)
+		return
+	}
+	if err := c.db.Write(&batch); err != nil {
+		c.log.Debug("Couldn't forget the resolutions to %s: %v", uid, err)
+	}
+}
+
+// Shutdown implements the ResolveCache interface for
+// ResolveCacheStandard.
+func (c *ResolveCacheStandard) Shutdown() {
+	if err := c.db.Close(); err != nil {
+		c.log.Debug("Couldn't close the resolve cache: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCacheExpiry(t *testing.T) {
+	config := NewConfigLocal()
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	cache, err := NewResolveCacheStandard(config, "", time.Hour)
+	require.NoError(t, err)
+	defer cache.Shutdown()
+
+	_, _, ok := cache.Get("alice@twitter")
+	require.False(t, ok)
+
+	uid := keybase1.MakeTestUID(1)
+	cache.Put("alice@twitter", "alice", uid)
+	name, gotUID, ok := cache.Get("alice@twitter")
+	require.True(t, ok)
+	require.Equal(t, libkb.NormalizedUsername("alice"), name)
+	require.Equal(t, uid, gotUID)
+
+	clock.Add(2 * time.Hour)
+	_, _, ok = cache.Get("alice@twitter")
+	require.False(t, ok)
+}
+
+func TestResolveCacheInvalidateUser(t *testing.T) {
+	config := NewConfigLocal()
+	config.SetClock(newTestClockNow())
+	cache, err := NewResolveCacheStandard(config, "", time.Hour)
+	require.NoError(t, err)
+	defer cache.Shutdown()
+
+	alice := keybase1.MakeTestUID(1)
+	bob := keybase1.MakeTestUID(2)
+	cache.Put("alice", "alice", alice)
+	cache.Put("alice@twitter", "alice", alice)
+	cache.Put("bob", "bob", bob)
+	// This assertion now resolves to bob, so invalidating alice
+	// shouldn't touch it.
+	cache.Put("carol@github", "alice", alice)
+	cache.Put("carol@github", "bob", bob)
+
+	cache.InvalidateUser(alice)
+	_, _, ok := cache.Get("alice")
+	require.False(t, ok)
+	_, _, ok = cache.Get("alice@twitter")
+	require.False(t, ok)
+	_, _, ok = cache.Get("bob")
+	require.True(t, ok)
+	_, uid, ok := cache.Get("carol@github")
+	require.True(t, ok)
+	require.Equal(t, bob, uid)
+}
+
+func TestResolveCachePersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolve_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := NewConfigLocal()
+	config.SetClock(newTestClockNow())
+	cache, err := NewResolveCacheStandard(config, dir, time.Hour)
+	require.NoError(t, err)
+	uid := keybase1.MakeTestUID(1)
+	cache.Put("alice@twitter", "alice", uid)
+	cache.Shutdown()
+
+	cache, err = NewResolveCacheStandard(config, dir, time.Hour)
+	require.NoError(t, err)
+	defer cache.Shutdown()
+	_, gotUID, ok := cache.Get("alice@twitter")
+	require.True(t, ok)
+	require.Equal(t, uid, gotUID)
+}
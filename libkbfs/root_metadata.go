@@ -53,6 +53,21 @@ type WriterFlags byte
 // Possible flags set in the WriterFlags bitfield.
 const (
 	MetadataFlagUnmerged WriterFlags = 1 << iota
+	// MetadataFlagContentChunked marks folders whose files may have
+	// been split into blocks by content-defined chunking.  Once set,
+	// it stays set in all successors.
+	MetadataFlagContentChunked
+	// MetadataFlagXattrs marks folders where extended attributes
+	// have been set on some entry.  Once set, it stays set in all
+	// successors.
+	MetadataFlagXattrs
+	// MetadataFlagArchived marks the last revision of a folder that
+	// has been archived.  The MD server rejects any successor to
+	// it, so the folder can never be changed again.
+	MetadataFlagArchived
+	// MetadataFlagHardLinks marks folders where some file has been
+	// given a hard link.  Once set, it stays set in all successors.
+	MetadataFlagHardLinks
 )
 
 // MetadataRevision is the type for the revision number.
@@ -118,6 +133,13 @@ type WriterMetadata struct {
 // WriterMetadata comments as to why this type is needed.)
 type WriterMetadataExtra struct {
 	UnresolvedWriters []keybase1.SocialAssertion `codec:"uw,omitempty"`
+	// QuotaLimit, if non-zero, is the most bytes the folder's
+	// writers let it use, as counted by DiskUsage.
+	QuotaLimit uint64 `codec:"ql,omitempty"`
+	// TrashRetention, if non-zero, is how long entries removed
+	// from the folder stay in its trash, from which they can be
+	// restored, before they're deleted for good.
+	TrashRetention time.Duration `codec:"tr,omitempty"`
 	codec.UnknownFieldSetHandler
 }
 
@@ -261,6 +283,12 @@ func (md *RootMetadata) IsFinal() bool {
 	return md.Flags&MetadataFlagFinal != 0
 }
 
+// IsArchived returns true if the folder was archived as of this
+// revision, so that it can have no successors.
+func (md *RootMetadata) IsArchived() bool {
+	return md.WFlags&MetadataFlagArchived != 0
+}
+
 // IsWriter returns whether or not the user+device is an authorized writer.
 func (md *RootMetadata) IsWriter(user keybase1.UID, deviceKID keybase1.KID) bool {
 	if md.ID.IsPublic() {
@@ -377,6 +405,9 @@ func (md *RootMetadata) MakeSuccessor(config Config, isWriter bool) (*RootMetada
 	if md.IsFinal() {
 		return nil, MetadataIsFinalError{}
 	}
+	if md.IsArchived() {
+		return nil, MetadataIsArchivedError{}
+	}
 	newMd, err := md.deepCopy(config.Codec(), true)
 	if err != nil {
 		return nil, err
@@ -409,10 +440,14 @@ func (md *RootMetadata) MakeSuccessor(config Config, isWriter bool) (*RootMetada
 // successor to the current one, and returns an error otherwise.
 func (md *RootMetadata) CheckValidSuccessor(
 	config Config, nextMd *RootMetadata) error {
-	// (1) Verify current metadata is non-final.
+	// (1) Verify current metadata is non-final, and the folder
+	// isn't archived.
 	if md.IsFinal() {
 		return MetadataIsFinalError{}
 	}
+	if md.IsArchived() {
+		return MetadataIsArchivedError{}
+	}
 
 	// (2) Check TLF ID.
 	if nextMd.ID != md.ID {
@@ -533,8 +568,21 @@ func (md *RootMetadata) GetTLFEphemeralPublicKey(
 				user, currentCryptPublicKey.kid}
 	}
 
+	// The index comes from the server, so make sure it's in range.
 	if info.EPubKeyIndex < 0 {
-		return rkb.TLFReaderEphemeralPublicKeys[-1-info.EPubKeyIndex], nil
+		i := -1 - info.EPubKeyIndex
+		if i >= len(rkb.TLFReaderEphemeralPublicKeys) {
+			return TLFEphemeralPublicKey{},
+				TLFEphemeralPublicKeyIndexError{
+					user, currentCryptPublicKey.kid,
+					info.EPubKeyIndex}
+		}
+		return rkb.TLFReaderEphemeralPublicKeys[i], nil
+	}
+	if info.EPubKeyIndex >= len(wkb.TLFEphemeralPublicKeys) {
+		return TLFEphemeralPublicKey{},
+			TLFEphemeralPublicKeyIndexError{
+				user, currentCryptPublicKey.kid, info.EPubKeyIndex}
 	}
 	return wkb.TLFEphemeralPublicKeys[info.EPubKeyIndex], nil
 }
@@ -728,7 +776,7 @@ func (md *RootMetadata) writerKID() keybase1.KID {
 
 // VerifyWriterMetadata verifies md's WriterMetadata against md's
 // WriterMetadataSigInfo, assuming the verifying key there is valid.
-func (md *RootMetadata) VerifyWriterMetadata(codec Codec, crypto Crypto) error {
+func (md *RootMetadata) VerifyWriterMetadata(codec Codec, crypto cryptoPure) error {
 	// We have to re-marshal the WriterMetadata, since it's
 	// embedded.
 	buf, err := codec.Encode(md.WriterMetadata)
@@ -829,7 +877,7 @@ func (rmds *RootMetadataSigned) IsInitialized() bool {
 
 // VerifyRootMetadata verifies rmd's MD against rmd's SigInfo,
 // assuming the verifying key there is valid.
-func (rmds *RootMetadataSigned) VerifyRootMetadata(codec Codec, crypto Crypto) error {
+func (rmds *RootMetadataSigned) VerifyRootMetadata(codec Codec, crypto cryptoPure) error {
 	// Re-marshal the whole RootMetadata. This is not avoidable
 	// without support from ugorji/codec.
 	buf, err := codec.Encode(rmds.MD)
@@ -854,6 +902,18 @@ func (rmds *RootMetadataSigned) MerkleHash(config Config) (MerkleHash, error) {
 // Version returns the metadata version of this MD block, depending on
 // which features it uses.
 func (rmds *RootMetadataSigned) Version() MetadataVer {
+	// Folders that use content-defined chunking, extended
+	// attributes, archiving, a quota, a trash or hard links can
+	// only be written by clients that know to keep chunking, how
+	// to resolve conflicts over attributes, not to write to
+	// archived folders, to stay under the quota, to move removed
+	// entries to the trash, and to keep the link counts up to date,
+	// respectively.
+	if rmds.MD.Extra.QuotaLimit > 0 || rmds.MD.Extra.TrashRetention > 0 ||
+		rmds.MD.WFlags&(MetadataFlagArchived|MetadataFlagXattrs|
+			MetadataFlagContentChunked|MetadataFlagHardLinks) != 0 {
+		return FolderFeaturesMetadataVer
+	}
 	// Only folders with unresolved assertions orconflict info get the
 	// new version.
 	if len(rmds.MD.Extra.UnresolvedWriters) > 0 ||
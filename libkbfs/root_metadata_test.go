@@ -9,6 +9,7 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol"
@@ -356,6 +357,8 @@ func makeFakeWriterMetadataFuture(t *testing.T) writerMetadataFuture {
 				// fields are added, effectively checking at compile time
 				// whether new fields have been added
 				[]keybase1.SocialAssertion{sa},
+				1024,
+				time.Hour,
 				codec.UnknownFieldSetHandler{},
 			},
 			makeExtraOrBust("WriterMetadata", t),
@@ -527,7 +530,7 @@ func TestRootMetadataVersion(t *testing.T) {
 	h := parseTlfHandleOrBust(t, config, "alice,bob@twitter", false)
 	rmd := newRootMetadataOrBust(t, id, h)
 	rmds := RootMetadataSigned{MD: *rmd}
-	if g, e := rmds.Version(), config.MetadataVersion(); g != e {
+	if g, e := rmds.Version(), MetadataVer(InitialExtraMetadataVer); g != e {
 		t.Errorf("MD with unresolved users got wrong version %d, expected %d",
 			g, e)
 	}
@@ -567,6 +570,25 @@ func TestRootMetadataVersion(t *testing.T) {
 		t.Errorf("MD without unresolved users got wrong version %d, "+
 			"expected %d", g, e)
 	}
+
+	// Folders using any of the newer features each need the
+	// newer version.
+	for _, flag := range []WriterFlags{MetadataFlagContentChunked,
+		MetadataFlagXattrs, MetadataFlagArchived, MetadataFlagHardLinks} {
+		rmd2.WFlags |= flag
+		rmds4 := RootMetadataSigned{MD: *rmd2}
+		if g, e := rmds4.Version(),
+			MetadataVer(FolderFeaturesMetadataVer); g != e {
+			t.Errorf("MD with flag %d got wrong version %d, expected %d",
+				flag, g, e)
+		}
+		rmd2.WFlags &^= flag
+	}
+	rmd2.Extra.QuotaLimit = 1024
+	rmds5 := RootMetadataSigned{MD: *rmd2}
+	if g, e := rmds5.Version(), config.MetadataVersion(); g != e {
+		t.Errorf("MD with a quota got wrong version %d, expected %d", g, e)
+	}
 }
 
 func TestMakeRekeyReadError(t *testing.T) {
@@ -0,0 +1,201 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/keybase/go-framed-msgpack-rpc"
+	"golang.org/x/net/context"
+)
+
+// RPCTimeoutTagName is the RPC tag that tells a server how many
+// milliseconds the client will wait for the result of a call.  It's
+// relative rather than an absolute deadline so that clock skew
+// between the client and server doesn't matter.
+const RPCTimeoutTagName = "timeout_ms"
+
+// RPCOperationClass groups remote server operations that should get
+// the same default deadline.
+type RPCOperationClass int
+
+const (
+	// RPCOperationOther is any operation not in another class,
+	// e.g. authentication and pings.
+	RPCOperationOther RPCOperationClass = iota
+	// RPCOperationBlockRead is a block fetch.
+	RPCOperationBlockRead
+	// RPCOperationBlockWrite is a block upload.
+	RPCOperationBlockWrite
+	// RPCOperationBlockReference is a change to a block's references.
+	RPCOperationBlockReference
+	// RPCOperationMDRead is a metadata or key fetch.
+	RPCOperationMDRead
+	// RPCOperationMDWrite is a metadata or key update.
+	RPCOperationMDWrite
+)
+
+func (c RPCOperationClass) String() string {
+	switch c {
+	case RPCOperationOther:
+		return "other"
+	case RPCOperationBlockRead:
+		return "blockRead"
+	case RPCOperationBlockWrite:
+		return "blockWrite"
+	case RPCOperationBlockReference:
+		return "blockReference"
+	case RPCOperationMDRead:
+		return "mdRead"
+	case RPCOperationMDWrite:
+		return "mdWrite"
+	default:
+		return "unknown"
+	}
+}
+
+var rpcOperationClasses = map[string]RPCOperationClass{
+	"keybase.1.block.getBlock":                  RPCOperationBlockRead,
+	"keybase.1.block.getBlockEncoded":           RPCOperationBlockRead,
+	"keybase.1.block.putBlock":                  RPCOperationBlockWrite,
+	"keybase.1.block.putBlockChunk":             RPCOperationBlockWrite,
+	"keybase.1.block.putBlockEncoded":           RPCOperationBlockWrite,
+	"keybase.1.block.getBlockUploadOffset":      RPCOperationBlockWrite,
+	"keybase.1.block.addReference":              RPCOperationBlockReference,
+	"keybase.1.block.delReference":              RPCOperationBlockReference,
+	"keybase.1.block.delReferenceWithCount":     RPCOperationBlockReference,
+	"keybase.1.block.archiveReference":          RPCOperationBlockReference,
+	"keybase.1.block.archiveReferenceWithCount": RPCOperationBlockReference,
+	"keybase.1.metadata.getMetadata":            RPCOperationMDRead,
+	"keybase.1.metadata.getFolderHandle":        RPCOperationMDRead,
+	"keybase.1.metadata.getLatestFolderHandle":  RPCOperationMDRead,
+	"keybase.1.metadata.getFoldersForRekey":     RPCOperationMDRead,
+	"keybase.1.metadata.getKey":                 RPCOperationMDRead,
+	"keybase.1.metadata.putMetadata":            RPCOperationMDWrite,
+	"keybase.1.metadata.pruneBranch":            RPCOperationMDWrite,
+	"keybase.1.metadata.putKeys":                RPCOperationMDWrite,
+	"keybase.1.metadata.deleteKey":              RPCOperationMDWrite,
+	"keybase.1.metadata.truncateLock":           RPCOperationMDWrite,
+	"keybase.1.metadata.truncateUnlock":         RPCOperationMDWrite,
+}
+
+// GetRPCOperationClass returns the class of the given RPC method.
+func GetRPCOperationClass(method string) RPCOperationClass {
+	return rpcOperationClasses[method]
+}
+
+// RPCDeadlinePolicy gives the default time to wait for each class of
+// remote server operation, for calls whose context has no deadline
+// of its own.  Classes that aren't listed have no default deadline.
+type RPCDeadlinePolicy map[RPCOperationClass]time.Duration
+
+// DefaultRPCDeadlinePolicy returns the default deadlines for remote
+// server operations.  They're generous, and just keep a stuck server
+// from hanging a call forever.
+func DefaultRPCDeadlinePolicy() RPCDeadlinePolicy {
+	return RPCDeadlinePolicy{
+		RPCOperationBlockRead:      2 * time.Minute,
+		RPCOperationBlockWrite:     5 * time.Minute,
+		RPCOperationBlockReference: 2 * time.Minute,
+		RPCOperationMDRead:         2 * time.Minute,
+		RPCOperationMDWrite:        2 * time.Minute,
+	}
+}
+
+// rpcDeadlineClient wraps a GenericClient, applying the configured
+// default deadline to each call that doesn't have one, and passing
+// the deadline along to the server.
+type rpcDeadlineClient struct {
+	client rpc.GenericClient
+	config Config
+}
+
+var _ rpc.GenericClient = rpcDeadlineClient{}
+
+func (c rpcDeadlineClient) withDeadline(ctx context.Context,
+	method string) (context.Context, context.CancelFunc) {
+	cancel := func() {}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := c.config.RPCDeadlinePolicy()[GetRPCOperationClass(method)]
+		if timeout <= 0 {
+			return ctx, cancel
+		}
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		deadline, _ = ctx.Deadline()
+	}
+
+	timeout := deadline.Sub(time.Now())
+	if timeout < 0 {
+		timeout = 0
+	}
+	// Copy the existing tags, rather than adding to them in
+	// place, since they may be shared with other calls.
+	tags := rpc.CtxRpcTags{
+		RPCTimeoutTagName: int64(timeout / time.Millisecond),
+	}
+	if currTags, ok := rpc.RpcTagsFromContext(ctx); ok {
+		for k, v := range currTags {
+			if k != RPCTimeoutTagName {
+				tags[k] = v
+			}
+		}
+	}
+	return context.WithValue(ctx, rpc.CtxRpcTagsKey, tags), cancel
+}
+
+// Call implements the rpc.GenericClient interface for
+// rpcDeadlineClient.
+func (c rpcDeadlineClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) error {
+	ctx, cancel := c.withDeadline(ctx, method)
+	defer cancel()
+	return c.client.Call(ctx, method, arg, res)
+}
+
+// Notify implements the rpc.GenericClient interface for
+// rpcDeadlineClient.  Notifications don't wait for a result, and so
+// have no deadline.
+func (c rpcDeadlineClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	return c.client.Notify(ctx, method, arg)
+}
+
+// RPCDeadlineFromContext applies the deadline a client sent along
+// with an RPC, if any, to the context the server handles it with, so
+// that the server can abandon work the client has stopped waiting
+// for.
+func RPCDeadlineFromContext(ctx context.Context) (
+	context.Context, context.CancelFunc) {
+	tags, ok := rpc.RpcTagsFromContext(ctx)
+	if !ok {
+		return ctx, func() {}
+	}
+	var ms int64
+	// Integers may come back from msgpack with any width.
+	switch t := tags[RPCTimeoutTagName].(type) {
+	case int64:
+		ms = t
+	case int:
+		ms = int64(t)
+	case int32:
+		ms = int64(t)
+	case int16:
+		ms = int64(t)
+	case int8:
+		ms = int64(t)
+	case uint64:
+		ms = int64(t)
+	case uint32:
+		ms = int64(t)
+	case uint16:
+		ms = int64(t)
+	case uint8:
+		ms = int64(t)
+	default:
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/go-framed-msgpack-rpc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type ctxRecordingClient struct {
+	lastCtx context.Context
+}
+
+func (c *ctxRecordingClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) error {
+	c.lastCtx = ctx
+	return nil
+}
+
+func (c *ctxRecordingClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	c.lastCtx = ctx
+	return nil
+}
+
+// serverContext returns the context a server would see for a call
+// made with the given client context.
+func serverContext(ctx context.Context) context.Context {
+	tags, ok := rpc.RpcTagsFromContext(ctx)
+	if !ok {
+		return context.Background()
+	}
+	return rpc.AddRpcTagsToContext(context.Background(), tags)
+}
+
+func TestRPCDeadlineClientDefaultDeadline(t *testing.T) {
+	config := &ConfigLocal{}
+	config.SetRPCDeadlinePolicy(RPCDeadlinePolicy{
+		RPCOperationBlockRead: 1 * time.Minute,
+	})
+	recorder := &ctxRecordingClient{}
+	client := rpcDeadlineClient{recorder, config}
+
+	start := time.Now()
+	err := client.Call(
+		context.Background(), "keybase.1.block.getBlock", nil, nil)
+	require.NoError(t, err)
+	deadline, ok := recorder.lastCtx.Deadline()
+	require.True(t, ok)
+	require.True(t, deadline.After(start.Add(59*time.Second)))
+	require.True(t, !deadline.After(time.Now().Add(1*time.Minute)))
+	// The call is over, so its deadline has been canceled.
+	require.Equal(t, context.Canceled, recorder.lastCtx.Err())
+
+	serverCtx, cancel := RPCDeadlineFromContext(
+		serverContext(recorder.lastCtx))
+	defer cancel()
+	serverDeadline, ok := serverCtx.Deadline()
+	require.True(t, ok)
+	require.True(t, serverDeadline.After(start.Add(59*time.Second)))
+	require.True(t, !serverDeadline.After(time.Now().Add(1*time.Minute)))
+
+	// Operations without a default get no deadline.
+	err = client.Call(
+		context.Background(), "keybase.1.metadata.ping", nil, nil)
+	require.NoError(t, err)
+	_, ok = recorder.lastCtx.Deadline()
+	require.False(t, ok)
+	serverCtx, cancel = RPCDeadlineFromContext(
+		serverContext(recorder.lastCtx))
+	defer cancel()
+	_, ok = serverCtx.Deadline()
+	require.False(t, ok)
+}
+
+func TestRPCDeadlineClientExistingDeadline(t *testing.T) {
+	config := &ConfigLocal{}
+	config.SetRPCDeadlinePolicy(DefaultRPCDeadlinePolicy())
+	recorder := &ctxRecordingClient{}
+	client := rpcDeadlineClient{recorder, config}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	origTags := rpc.CtxRpcTags{"tag": "value"}
+	ctx = rpc.AddRpcTagsToContext(ctx, origTags)
+	expectedDeadline, _ := ctx.Deadline()
+
+	err := client.Call(ctx, "keybase.1.metadata.putMetadata", nil, nil)
+	require.NoError(t, err)
+	deadline, ok := recorder.lastCtx.Deadline()
+	require.True(t, ok)
+	require.Equal(t, expectedDeadline, deadline)
+
+	tags, ok := rpc.RpcTagsFromContext(recorder.lastCtx)
+	require.True(t, ok)
+	require.Equal(t, "value", tags["tag"])
+	ms, ok := tags[RPCTimeoutTagName].(int64)
+	require.True(t, ok)
+	require.True(t, ms > 9000 && ms <= 10000)
+	// The caller's tags are left alone.
+	require.Equal(t, rpc.CtxRpcTags{"tag": "value"}, origTags)
+}
+
+func TestRPCDeadlineFromContextIntegerWidths(t *testing.T) {
+	for _, v := range []interface{}{
+		int8(100), uint8(100), int16(100), uint32(100), uint64(100)} {
+		ctx := rpc.AddRpcTagsToContext(context.Background(),
+			rpc.CtxRpcTags{RPCTimeoutTagName: v})
+		start := time.Now()
+		ctx, cancel := RPCDeadlineFromContext(ctx)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		require.True(t, ok)
+		require.True(t, !deadline.After(time.Now().Add(100*time.Millisecond)))
+		require.True(t, !deadline.Before(start.Add(100*time.Millisecond)))
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-framed-msgpack-rpc"
+	"golang.org/x/net/context"
+)
+
+// BServiceName is the service name used in ConnectionStatus and
+// RetryStatus for the block server.
+const BServiceName = "block-server"
+
+const (
+	retryMaxAttemptsDefault = 10
+	retryBackoffDefault     = 500 * time.Millisecond
+	retryMaxBackoffDefault  = time.Minute
+	retryJitterDefault      = 0.5
+	// retryBackoffMultiplier is how much longer each backoff is
+	// than the one before.
+	retryBackoffMultiplier = 1.5
+)
+
+// RetryPolicy says which failed calls to the remote servers are
+// retried, and how often.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a call is made, including the
+	// first.  Zero or one means calls aren't retried.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry.
+	// Each following wait is longer, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction, from 0 to 1, by which each wait is
+	// randomly lengthened or shortened, so that clients don't all
+	// retry at once.
+	Jitter float64
+	// ShouldRetry says whether a call to the given RPC method that
+	// failed with the given error may be retried.  If nil,
+	// IsRetryableRPCError is used.
+	ShouldRetry func(method string, err error) bool
+}
+
+// DefaultRetryPolicy returns the default RetryPolicy, which retries
+// calls that the servers throttled for up to a few minutes.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    retryMaxAttemptsDefault,
+		InitialBackoff: retryBackoffDefault,
+		MaxBackoff:     retryMaxBackoffDefault,
+		Jitter:         retryJitterDefault,
+	}
+}
+
+// IsRetryableRPCError returns true if a call to the given RPC method
+// that failed with the given error can safely be made again: that is,
+// if the server throttled it.  Batch reference changes are never
+// retried here, since BlockServerRemote retries only their
+// unfinished parts itself.
+func IsRetryableRPCError(method string, err error) bool {
+	switch method {
+	case "keybase.1.block.delReferenceWithCount",
+		"keybase.1.block.archiveReferenceWithCount",
+		"keybase.1.block.archiveReference":
+		return false
+	}
+	switch e := err.(type) {
+	case BServerErrorThrottle, MDServerErrorThrottle:
+		return true
+	case BServerErrorOverQuota:
+		return e.Throttled
+	}
+	return false
+}
+
+func (p RetryPolicy) shouldRetry(method string, err error) bool {
+	if p.ShouldRetry != nil {
+		return p.ShouldRetry(method, err)
+	}
+	return IsRetryableRPCError(method, err)
+}
+
+// backoff returns how long to wait before the retry following the
+// given number of attempts, without jitter.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempts && backoff < float64(p.MaxBackoff); i++ {
+		backoff *= retryBackoffMultiplier
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	return time.Duration(backoff)
+}
+
+// jitteredBackoff returns backoff(attempts), randomly lengthened or
+// shortened by up to Jitter of it.
+func (p RetryPolicy) jitteredBackoff(attempts int) time.Duration {
+	backoff := float64(p.backoff(attempts))
+	return time.Duration(backoff * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// RetryStatus describes the retried calls to one remote server.
+type RetryStatus struct {
+	// Retrying is the number of calls waiting to be retried, or
+	// being retried, right now.
+	Retrying int
+	// Retries is the number of retries made so far.
+	Retries uint64
+	// GaveUp is the number of calls that failed with a retryable
+	// error after using up all their attempts.
+	GaveUp uint64
+	// LastMethod and LastError are the most recently retried call,
+	// and the error that made it retry, at LastRetry.
+	LastMethod string
+	LastError  string
+	LastRetry  time.Time
+}
+
+// rpcRetryState keeps the RetryStatus of one remote server, and
+// pushes it to KBFSOps whenever it changes.
+type rpcRetryState struct {
+	config  Config
+	service string
+
+	lock   sync.Mutex
+	status RetryStatus
+}
+
+func newRPCRetryState(config Config, service string) *rpcRetryState {
+	return &rpcRetryState{config: config, service: service}
+}
+
+func (s *rpcRetryState) update(f func(status *RetryStatus)) {
+	s.lock.Lock()
+	f(&s.status)
+	status := s.status
+	s.lock.Unlock()
+	if kbfsOps := s.config.KBFSOps(); kbfsOps != nil {
+		kbfsOps.PushRetryStatusChange(s.service, status)
+	}
+}
+
+// rpcRetryClient wraps a GenericClient, retrying the calls that fail
+// as the configured RetryPolicy allows.
+type rpcRetryClient struct {
+	client rpc.GenericClient
+	config Config
+	state  *rpcRetryState
+}
+
+var _ rpc.GenericClient = rpcRetryClient{}
+
+// Call implements the rpc.GenericClient interface for
+// rpcRetryClient.
+func (c rpcRetryClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) (err error) {
+	policy := c.config.RetryPolicy()
+	for attempts := 1; ; attempts++ {
+		err = c.client.Call(ctx, method, arg, res)
+		if err == nil || !policy.shouldRetry(method, err) {
+			break
+		}
+		if attempts >= policy.MaxAttempts {
+			if attempts > 1 {
+				c.state.update(func(status *RetryStatus) {
+					status.GaveUp++
+				})
+			}
+			break
+		}
+		if attempts == 1 {
+			c.state.update(func(status *RetryStatus) {
+				status.Retrying++
+			})
+			defer c.state.update(func(status *RetryStatus) {
+				status.Retrying--
+			})
+		}
+		c.state.update(func(status *RetryStatus) {
+			status.Retries++
+			status.LastMethod = method
+			status.LastError = err.Error()
+			status.LastRetry = c.config.Clock().Now()
+		})
+		select {
+		case <-time.After(policy.jitteredBackoff(attempts)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+	return err
+}
+
+// Notify implements the rpc.GenericClient interface for
+// rpcRetryClient.  Notifications get no reply, so they can't fail
+// in a way that can be retried.
+func (c rpcRetryClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	return c.client.Notify(ctx, method, arg)
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// failingRPCClient fails each call with the next of its errors, and
+// succeeds once it runs out.
+type failingRPCClient struct {
+	errs  []error
+	calls int
+}
+
+func (c *failingRPCClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) error {
+	c.calls++
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func (c *failingRPCClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	return nil
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+		Jitter:         0.5,
+	}
+	require.Equal(t, time.Second, p.backoff(1))
+	require.Equal(t, 1500*time.Millisecond, p.backoff(2))
+	require.Equal(t, 2250*time.Millisecond, p.backoff(3))
+	require.Equal(t, 3*time.Second, p.backoff(4))
+	require.Equal(t, 3*time.Second, p.backoff(100))
+	for i := 0; i < 100; i++ {
+		backoff := p.jitteredBackoff(2)
+		require.True(t, backoff >= 750*time.Millisecond, "%s", backoff)
+		require.True(t, backoff <= 2250*time.Millisecond, "%s", backoff)
+	}
+}
+
+func TestIsRetryableRPCError(t *testing.T) {
+	const put = "keybase.1.block.putBlock"
+	require.True(t, IsRetryableRPCError(put, BServerErrorThrottle{}))
+	require.True(t, IsRetryableRPCError(
+		"keybase.1.metadata.putMetadata", MDServerErrorThrottle{}))
+	require.True(t, IsRetryableRPCError(
+		put, BServerErrorOverQuota{Throttled: true}))
+	require.False(t, IsRetryableRPCError(put, BServerErrorOverQuota{}))
+	require.False(t, IsRetryableRPCError(put, BServerErrorNoPermission{}))
+	require.False(t, IsRetryableRPCError(
+		"keybase.1.block.delReferenceWithCount", BServerErrorThrottle{}))
+}
+
+func TestRPCRetryClient(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+	config.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	const method = "keybase.1.block.putBlock"
+
+	// Throttled calls are retried until they succeed.
+	fc := &failingRPCClient{
+		errs: []error{BServerErrorThrottle{}, BServerErrorThrottle{}},
+	}
+	c := rpcRetryClient{fc, config, newRPCRetryState(config, BServiceName)}
+	err := c.Call(ctx, method, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, fc.calls)
+
+	status, _, err := config.KBFSOps().Status(ctx)
+	require.NoError(t, err)
+	retries := status.RetryStatus[BServiceName]
+	require.Equal(t, 0, retries.Retrying)
+	require.Equal(t, uint64(2), retries.Retries)
+	require.Equal(t, uint64(0), retries.GaveUp)
+	require.Equal(t, method, retries.LastMethod)
+	require.Equal(t, BServerErrorThrottle{}.Error(), retries.LastError)
+
+	// Other errors aren't retried.
+	errOther := errors.New("other")
+	fc.errs = []error{errOther}
+	fc.calls = 0
+	err = c.Call(ctx, method, nil, nil)
+	require.Equal(t, errOther, err)
+	require.Equal(t, 1, fc.calls)
+
+	// Calls give up after the max number of attempts.
+	fc.errs = []error{BServerErrorThrottle{}, BServerErrorThrottle{},
+		BServerErrorThrottle{}}
+	fc.calls = 0
+	err = c.Call(ctx, method, nil, nil)
+	require.IsType(t, BServerErrorThrottle{}, err)
+	require.Equal(t, 3, fc.calls)
+	status, _, err = config.KBFSOps().Status(ctx)
+	require.NoError(t, err)
+	retries = status.RetryStatus[BServiceName]
+	require.Equal(t, uint64(4), retries.Retries)
+	require.Equal(t, uint64(1), retries.GaveUp)
+
+	// A policy can classify errors itself.
+	policy := config.RetryPolicy()
+	policy.ShouldRetry = func(method string, err error) bool {
+		return err == errOther
+	}
+	config.SetRetryPolicy(policy)
+	fc.errs = []error{errOther}
+	fc.calls = 0
+	err = c.Call(ctx, method, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, fc.calls)
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// BlockServerCapabilities describes the optional features supported
+// by a block server, so that clients can use them when they're
+// available instead of assuming them.
+type BlockServerCapabilities struct {
+	// BatchPuts is whether the server accepts several blocks in a
+	// single put request.
+	BatchPuts bool
+	// MaxBlockSize is the size in bytes of the largest block the
+	// server accepts, or 0 if the server doesn't say.
+	MaxBlockSize int64
+	// Encodings are the names of the block transport encodings,
+	// like compressed ones, that the server supports.  Every
+	// server supports the raw encoding, whether or not it's
+	// listed.
+	Encodings []string
+}
+
+// SupportsEncoding returns whether the server supports the block
+// transport encoding with the given name.
+func (c BlockServerCapabilities) SupportsEncoding(name string) bool {
+	if name == RawBlockTransportEncodingName {
+		return true
+	}
+	for _, e := range c.Encodings {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func blockServerCapabilitiesFromRPC(
+	caps blockCapabilities) BlockServerCapabilities {
+	return BlockServerCapabilities{
+		BatchPuts:    caps.BatchPuts,
+		MaxBlockSize: caps.MaxBlockSize,
+		Encodings:    caps.Encodings,
+	}
+}
+
+// MDServerCapabilities describes the optional features supported by
+// an MD server.
+type MDServerCapabilities struct {
+	// Subscriptions is whether the server notifies clients
+	// registered through RegisterForUpdate of new revisions.
+	// Clients of servers without it have to poll for updates.
+	Subscriptions bool
+}
+
+func mdServerCapabilitiesFromRPC(
+	caps metadataCapabilities) MDServerCapabilities {
+	return MDServerCapabilities{
+		Subscriptions: caps.Subscriptions,
+	}
+}
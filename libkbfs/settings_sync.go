@@ -0,0 +1,392 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+	"golang.org/x/net/context"
+)
+
+const (
+	// settingsDirName is the directory, at the root of the user's
+	// own private folder, that holds the settings file.  Like the
+	// other KBFS directories, nothing in it is ever trashed.
+	settingsDirName = ".kbfs_settings"
+	// settingsFileName is the name of the file, in settingsDirName,
+	// that holds the user's KBFS settings.
+	settingsFileName = "settings"
+	// settingsSyncPeriod is how often to check for settings changed
+	// on other devices.  The settings file is only read again if the
+	// user's private folder has changed since the last sync.
+	settingsSyncPeriod = 10 * time.Minute
+	// settingsPinningPrefix prefixes the keys of the per-folder
+	// pinning settings; the rest of the key is the TLF ID.
+	settingsPinningPrefix = "pin/"
+	// settingsSyncModePrefix prefixes the keys of the per-folder
+	// sync mode settings; the rest of the key is the TLF ID.
+	settingsSyncModePrefix = "sync/"
+	// settingsBandwidthScheduleKey is the key of the bandwidth
+	// schedule setting, which applies to all folders.
+	settingsBandwidthScheduleKey = "bandwidth"
+)
+
+// userSetting is the value of a single setting, along with the time
+// it was last changed on any device.
+type userSetting struct {
+	Value []byte `codec:"v"`
+	Mtime int64  `codec:"m"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// newerThan returns whether s should win over other when merging.
+// Ties are broken by value, so that all devices agree on the result.
+func (s userSetting) newerThan(other userSetting) bool {
+	if s.Mtime != other.Mtime {
+		return s.Mtime > other.Mtime
+	}
+	return bytes.Compare(s.Value, other.Value) > 0
+}
+
+// userSettings is the full set of a user's settings, as stored in
+// the settings file.  Each setting is merged independently, so
+// devices that change different settings at the same time never
+// lose each other's changes.
+type userSettings struct {
+	Settings map[string]userSetting `codec:"s"`
+
+	codec.UnknownFieldSetHandler
+}
+
+func (s userSettings) deepCopy() userSettings {
+	c := userSettings{Settings: make(map[string]userSetting)}
+	for k, v := range s.Settings {
+		c.Settings[k] = v
+	}
+	return c
+}
+
+// merge folds other into s, keeping the newer value of each
+// setting, and returns whether s changed.
+func (s *userSettings) merge(other userSettings) bool {
+	if s.Settings == nil {
+		s.Settings = make(map[string]userSetting)
+	}
+	changed := false
+	for k, v := range other.Settings {
+		if curr, ok := s.Settings[k]; !ok || v.newerThan(curr) {
+			s.Settings[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// tlfSettings returns the encoded values of all the per-folder
+// settings whose keys start with the given prefix, by TLF ID.
+func (s userSettings) tlfSettings(prefix string) map[TlfID][]byte {
+	values := make(map[TlfID][]byte)
+	for k, v := range s.Settings {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		tlfID, err := ParseTlfID(k[len(prefix):])
+		if err != nil {
+			continue
+		}
+		values[tlfID] = v.Value
+	}
+	return values
+}
+
+// folderPinnings decodes all the per-folder pinning settings.
+// Settings that can't be decoded (e.g., ones written by a newer
+// client) are skipped.
+func (s userSettings) folderPinnings(
+	c Codec) map[TlfID]FolderPinning {
+	pinnings := make(map[TlfID]FolderPinning)
+	for tlfID, buf := range s.tlfSettings(settingsPinningPrefix) {
+		var pinning FolderPinning
+		if err := c.Decode(buf, &pinning); err != nil {
+			continue
+		}
+		pinnings[tlfID] = pinning
+	}
+	return pinnings
+}
+
+// tlfSyncModes decodes all the per-folder sync mode settings,
+// skipping any that can't be decoded.
+func (s userSettings) tlfSyncModes(c Codec) map[TlfID]TlfSyncMode {
+	modes := make(map[TlfID]TlfSyncMode)
+	for tlfID, buf := range s.tlfSettings(settingsSyncModePrefix) {
+		var mode TlfSyncMode
+		if err := c.Decode(buf, &mode); err != nil {
+			continue
+		}
+		modes[tlfID] = mode
+	}
+	return modes
+}
+
+// bandwidthSchedule decodes the bandwidth schedule setting, and
+// returns false if it isn't set or can't be decoded.
+func (s userSettings) bandwidthSchedule(
+	c Codec) (BandwidthSchedule, bool) {
+	v, ok := s.Settings[settingsBandwidthScheduleKey]
+	if !ok {
+		return nil, false
+	}
+	var str string
+	if err := c.Decode(v.Value, &str); err != nil {
+		return nil, false
+	}
+	schedule, err := ParseBandwidthSchedule(str)
+	if err != nil {
+		return nil, false
+	}
+	return schedule, true
+}
+
+// settingsSyncer keeps this device's copy of the user's settings in
+// sync with the settings file in the user's private folder, so that
+// the settings roam across all the user's devices.  If two devices
+// write the file concurrently, conflict resolution leaves a renamed
+// copy of one of them behind; the next sync merges that copy back
+// in and removes it.
+type settingsSyncer struct {
+	config  Config
+	kbfsOps *KBFSOpsStandard
+
+	// syncLock makes sure only one sync runs at a time, and
+	// protects everything below it up to lock.
+	syncLock sync.Mutex
+	// root is the root node of the user's private folder, fetched
+	// on the first sync.
+	root Node
+	// syncedRev is the revision of the private folder as of the
+	// last successful sync, or MetadataRevisionUninitialized.
+	syncedRev MetadataRevision
+
+	lock  sync.Mutex
+	local userSettings
+	// dirty is whether any local settings have changed since the
+	// last sync started.
+	dirty bool
+}
+
+func newSettingsSyncer(
+	config Config, kbfsOps *KBFSOpsStandard) *settingsSyncer {
+	return &settingsSyncer{
+		config:    config,
+		kbfsOps:   kbfsOps,
+		syncedRev: MetadataRevisionUninitialized,
+		local:     userSettings{Settings: make(map[string]userSetting)},
+	}
+}
+
+// set changes the value of a setting locally.  The change is written
+// out on the next sync.
+func (ss *settingsSyncer) set(key string, value interface{}) error {
+	buf, err := ss.config.Codec().Encode(value)
+	if err != nil {
+		return err
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.local.Settings[key] = userSetting{
+		Value: buf,
+		Mtime: ss.config.Clock().Now().UnixNano(),
+	}
+	ss.dirty = true
+	return nil
+}
+
+// reset forgets all local settings, along with the private folder
+// they were synced with, e.g. when the user logs out.
+func (ss *settingsSyncer) reset() {
+	func() {
+		ss.syncLock.Lock()
+		defer ss.syncLock.Unlock()
+		ss.root = nil
+		ss.syncedRev = MetadataRevisionUninitialized
+	}()
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.local = userSettings{Settings: make(map[string]userSetting)}
+	ss.dirty = false
+}
+
+// getRoot returns the root node of the user's private folder,
+// fetching it if this is the first sync since the user logged in.
+func (ss *settingsSyncer) getRoot(ctx context.Context) (Node, error) {
+	if ss.root != nil {
+		return ss.root, nil
+	}
+	kbpki := ss.config.KBPKI()
+	username, _, err := kbpki.GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h, err := ParseTlfHandle(ctx, kbpki, string(username), false)
+	if err != nil {
+		return nil, err
+	}
+	root, _, err := ss.kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	ss.root = root
+	return root, nil
+}
+
+func (ss *settingsSyncer) readSettingsFile(ctx context.Context,
+	dir Node, name string) (Node, userSettings, error) {
+	node, ei, err := ss.kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return nil, userSettings{}, err
+	}
+	buf := make([]byte, ei.Size)
+	n, err := ss.kbfsOps.Read(ctx, node, buf, 0)
+	if err != nil {
+		return nil, userSettings{}, err
+	}
+	var s userSettings
+	if err := ss.config.Codec().Decode(buf[:n], &s); err != nil {
+		return nil, userSettings{}, err
+	}
+	return node, s, nil
+}
+
+// sync merges the local settings with the ones in the settings file
+// (and any conflicted copies of it), writes the result back if
+// anything changed, and returns it.  If neither the local settings
+// nor the private folder have changed since the last sync, the
+// settings file isn't read again.
+func (ss *settingsSyncer) sync(ctx context.Context) (userSettings, error) {
+	ss.syncLock.Lock()
+	defer ss.syncLock.Unlock()
+
+	root, err := ss.getRoot(ctx)
+	if err != nil {
+		return userSettings{}, err
+	}
+	// Read the revision before the settings file, so that any
+	// change made after this point gets picked up by the next
+	// sync.
+	lState := makeFBOLockState()
+	rev := ss.kbfsOps.getOpsByNode(ctx, root).getCurrMDRevision(lState)
+
+	ss.lock.Lock()
+	// Any set that happens after this copy goes out with the next
+	// sync.
+	local := ss.local.deepCopy()
+	dirty := ss.dirty
+	ss.dirty = false
+	ss.lock.Unlock()
+	if !dirty && rev != MetadataRevisionUninitialized &&
+		rev == ss.syncedRev {
+		return local, nil
+	}
+
+	merged, err := ss.syncWithFile(ctx, root, local)
+	if err != nil {
+		// Make sure the next sync tries again.
+		ss.syncedRev = MetadataRevisionUninitialized
+		return userSettings{}, err
+	}
+	ss.syncedRev = rev
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.local.merge(merged)
+	return merged, nil
+}
+
+// syncWithFile merges the given local settings with the ones in the
+// settings file under root, writes the result back if anything
+// changed, and returns it.
+func (ss *settingsSyncer) syncWithFile(ctx context.Context, root Node,
+	merged userSettings) (userSettings, error) {
+	dir, _, err := ss.kbfsOps.Lookup(ctx, root, settingsDirName)
+	var children map[string]EntryInfo
+	switch err.(type) {
+	case nil:
+		children, err = ss.kbfsOps.GetDirChildren(ctx, dir)
+		if err != nil {
+			return userSettings{}, err
+		}
+	case NoSuchNameError:
+		// Nothing has been written yet.
+		dir = nil
+	default:
+		return userSettings{}, err
+	}
+
+	var file Node
+	var stored userSettings
+	var conflicted []string
+	for name := range children {
+		switch {
+		case name == settingsFileName:
+			file, stored, err = ss.readSettingsFile(ctx, dir, name)
+			if err != nil {
+				return userSettings{}, err
+			}
+			merged.merge(stored)
+		case strings.HasPrefix(name, settingsFileName+".conflicted"):
+			_, s, err := ss.readSettingsFile(ctx, dir, name)
+			if err != nil {
+				return userSettings{}, err
+			}
+			merged.merge(s)
+			conflicted = append(conflicted, name)
+		}
+	}
+
+	// This is false if there's nothing to write yet, so users who
+	// never change any settings don't get a settings file.
+	if stored.merge(merged) {
+		buf, err := ss.config.Codec().Encode(merged)
+		if err != nil {
+			return userSettings{}, err
+		}
+		if dir == nil {
+			dir, err = ss.kbfsOps.getOpsByNode(ctx, root).
+				getOrCreateSettingsDir(ctx)
+			if err != nil {
+				return userSettings{}, err
+			}
+		}
+		if file == nil {
+			file, _, err = ss.kbfsOps.CreateFile(
+				ctx, dir, settingsFileName, false)
+		} else {
+			err = ss.kbfsOps.Truncate(ctx, file, 0)
+		}
+		if err != nil {
+			return userSettings{}, err
+		}
+		if err := ss.kbfsOps.Write(ctx, file, buf, 0); err != nil {
+			return userSettings{}, err
+		}
+		if err := ss.kbfsOps.Sync(ctx, file); err != nil {
+			return userSettings{}, err
+		}
+	}
+	// Only remove the conflicted copies once their contents are
+	// safely in the main file.
+	for _, name := range conflicted {
+		if err := ss.kbfsOps.RemoveEntry(ctx, dir, name); err != nil {
+			return userSettings{}, err
+		}
+	}
+	return merged, nil
+}
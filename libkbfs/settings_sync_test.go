@@ -0,0 +1,164 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodeSettingOrBust(t *testing.T, c Codec, v interface{}) []byte {
+	buf, err := c.Encode(v)
+	require.NoError(t, err)
+	return buf
+}
+
+func TestUserSettingsMerge(t *testing.T) {
+	s := userSettings{Settings: map[string]userSetting{
+		"a": {Value: []byte{1}, Mtime: 2},
+		"b": {Value: []byte{1}, Mtime: 2},
+	}}
+	other := userSettings{Settings: map[string]userSetting{
+		"a": {Value: []byte{2}, Mtime: 1},
+		"b": {Value: []byte{2}, Mtime: 3},
+		"c": {Value: []byte{2}, Mtime: 1},
+	}}
+
+	require.True(t, s.merge(other))
+	require.Equal(t, []byte{1}, s.Settings["a"].Value)
+	require.Equal(t, []byte{2}, s.Settings["b"].Value)
+	require.Equal(t, []byte{2}, s.Settings["c"].Value)
+
+	// Merging again changes nothing.
+	require.False(t, s.merge(other))
+
+	// Ties are broken the same way no matter the merge order.
+	tie := userSettings{Settings: map[string]userSetting{
+		"a": {Value: []byte{0}, Mtime: 2},
+	}}
+	require.False(t, s.merge(tie))
+	require.True(t, tie.merge(s))
+	require.Equal(t, []byte{1}, tie.Settings["a"].Value)
+}
+
+func TestSettingsSyncAcrossDevices(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	fb := rootNode1.GetFolderBranch()
+	err := config1.KBFSOps().SetFolderPinning(ctx, fb, PinAlways)
+	require.NoError(t, err)
+
+	// The settings file is written to the settings directory of
+	// the user's private folder.
+	settingsDir, _, err := config1.KBFSOps().Lookup(
+		ctx, rootNode1, settingsDirName)
+	require.NoError(t, err)
+	children, err := config1.KBFSOps().GetDirChildren(ctx, settingsDir)
+	require.NoError(t, err)
+	require.Contains(t, children, settingsFileName)
+
+	// The other device picks up the pinning on its next sync.
+	GetRootNodeOrBust(t, config2, "alice", false)
+	status, _, err := config2.KBFSOps().FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "auto", status.Pinning)
+	err = config2.KBFSOps().(*KBFSOpsStandard).syncSettings(ctx)
+	require.NoError(t, err)
+	status, _, err = config2.KBFSOps().FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "always", status.Pinning)
+}
+
+func TestSettingsSyncMergesConflictedCopies(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	kbfsOps := config.KBFSOps()
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	err := kbfsOps.SetFolderPinning(
+		ctx, rootNode.GetFolderBranch(), PinNever)
+	require.NoError(t, err)
+
+	// Simulate conflict resolution leaving behind a copy written by
+	// another device, with the pinning of another folder.
+	publicRootNode := GetRootNodeOrBust(t, config, "alice", true)
+	publicFB := publicRootNode.GetFolderBranch()
+	other := userSettings{Settings: map[string]userSetting{
+		settingsPinningPrefix + publicFB.Tlf.String(): {
+			Value: encodeSettingOrBust(t, config.Codec(), PinAlways),
+			Mtime: config.Clock().Now().UnixNano(),
+		},
+	}}
+	name := WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+		config.Clock().Now(), "alice", "other", settingsFileName)
+	settingsDir, _, err := kbfsOps.Lookup(ctx, rootNode, settingsDirName)
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, settingsDir, name, false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(
+		ctx, fileNode, encodeSettingOrBust(t, config.Codec(), other), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	err = kbfsOps.(*KBFSOpsStandard).syncSettings(ctx)
+	require.NoError(t, err)
+
+	children, err := kbfsOps.GetDirChildren(ctx, settingsDir)
+	require.NoError(t, err)
+	require.Contains(t, children, settingsFileName)
+	require.NotContains(t, children, name)
+
+	status, _, err := kbfsOps.FolderStatus(ctx, publicFB)
+	require.NoError(t, err)
+	require.Equal(t, "always", status.Pinning)
+	status, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, "never", status.Pinning)
+}
+
+func TestSettingsSyncBandwidthSchedule(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "alice", false)
+	fb := rootNode1.GetFolderBranch()
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	kbfsOps2 := config2.KBFSOps().(*KBFSOpsStandard)
+	err := kbfsOps2.syncSettings(ctx)
+	require.NoError(t, err)
+	require.Len(t, config2.BandwidthScheduler().Schedule(), 0)
+
+	schedule, err := ParseBandwidthSchedule("09:00-17:00 up=1m down=2m")
+	require.NoError(t, err)
+	err = config1.KBFSOps().SetBandwidthSchedule(ctx, schedule)
+	require.NoError(t, err)
+	require.Equal(t, schedule, config1.BandwidthScheduler().Schedule())
+
+	// The other device only reads the settings file again once it
+	// has seen the private folder change.
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.syncSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, schedule, config2.BandwidthScheduler().Schedule())
+	require.Equal(t, rootNode2, kbfsOps2.settings.root)
+
+	// With nothing changed, the next sync doesn't touch the folder.
+	rev := kbfsOps2.getOpsByNode(ctx, rootNode2).getCurrMDRevision(
+		makeFBOLockState())
+	err = kbfsOps2.syncSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, rev, kbfsOps2.settings.syncedRev)
+	require.Equal(t, rev, kbfsOps2.getOpsByNode(ctx, rootNode2).
+		getCurrMDRevision(makeFBOLockState()))
+}
@@ -67,6 +67,20 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
+	// If the directory is split across several blocks, count those
+	// too.
+	leaves, indirect, err := ops.blocks.GetDirLeafPtrs(
+		ctx, lState, md, dblock, dir.Branch)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		blockSizes[leaf.BlockPointer] = leaf.EncodedSize
+	}
+	for _, info := range indirect {
+		blockSizes[info.BlockPointer] = info.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
 		if de.Type == Sym {
 			continue
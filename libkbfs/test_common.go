@@ -78,7 +78,8 @@ func MakeTestConfigOrBust(t logger.TestLogBackend,
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 
-	config.SetBlockSplitter(&BlockSplitterSimple{64 * 1024, 8 * 1024})
+	config.SetBlockSplitter(&BlockSplitterSimple{
+		maxSize: 64 * 1024, blockChangeEmbedMaxSize: 8 * 1024})
 	config.SetKeyManager(NewKeyManagerStandard(config))
 	config.SetMDOps(NewMDOpsStandard(config))
 
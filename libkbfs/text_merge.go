@@ -0,0 +1,200 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// maxTextMergeCells bounds the size of the table used to line up the
+// lines of two versions of a file (the product of their line
+// counts), so that merging huge files can't use too much memory.
+const maxTextMergeCells = 16 * 1024 * 1024
+
+// maxTextMergeBytes is the largest version of a file that
+// TextMergeStrategy will try to merge.  Bigger files are rarely
+// hand-edited text, so both copies are kept instead.  This is
+// tighter than crMaxMergeBytes, which applies to every
+// MergeStrategy, including merge drivers for non-text formats.
+const maxTextMergeBytes = 1024 * 1024
+
+// TextMergeStrategy is a MergeStrategy that does a three-way,
+// line-by-line merge of text files, like diff3.  Changes to
+// different lines of the file are combined; if both versions change
+// the same lines differently, or any version doesn't look like text,
+// the merge fails and both copies are kept.  Only files up to
+// maxTextMergeBytes are merged.
+//
+// Nothing uses TextMergeStrategy unless it's asked for (see
+// InitParams.MergeTextConflicts).  A line merge that succeeds can
+// still leave a file that's wrong for its format, such as JSON
+// with a missing comma, or a config file with two related settings
+// changed independently, and unlike a conflicted copy nothing tells
+// the user to look at it.
+type TextMergeStrategy struct{}
+
+var _ MergeStrategy = TextMergeStrategy{}
+
+// looksLikeText guesses whether data is the contents of a text file:
+// it must be valid UTF-8 without any NUL bytes.
+func looksLikeText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// splitLines splits data into lines, each keeping its trailing
+// newline, if any.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// matchLines finds a longest common subsequence of the lines in base
+// and other, and returns, for each line of base, the index of the
+// line in other it matches, or -1 if it doesn't match any.  ok is
+// false if the inputs are too big to compare.
+func matchLines(base, other []string) (matches []int, ok bool) {
+	n, m := len(base), len(other)
+	if n*m > maxTextMergeCells {
+		return nil, false
+	}
+	// lcs[i][j] is the length of the longest common subsequence of
+	// base[i:] and other[j:].
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case base[i] == other[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	matches = make([]int, n)
+	i, j := 0, 0
+	for i < n {
+		switch {
+		case j < m && base[i] == other[j]:
+			matches[i] = j
+			i++
+			j++
+		case j < m && lcs[i][j+1] > lcs[i+1][j]:
+			j++
+		default:
+			matches[i] = -1
+			i++
+		}
+	}
+	return matches, true
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLines does a three-way merge of the lines of ours and theirs,
+// which were both derived from base.  It walks through the lines of
+// base that are unchanged in both versions, and looks at each of the
+// regions between them: if only one version changed a region, that
+// change wins, and if both changed it differently, the merge fails.
+func mergeLines(base, ours, theirs []string) ([]string, bool) {
+	matchOurs, ok := matchLines(base, ours)
+	if !ok {
+		return nil, false
+	}
+	matchTheirs, ok := matchLines(base, theirs)
+	if !ok {
+		return nil, false
+	}
+
+	var result []string
+	b, o, t := 0, 0, 0
+	for b < len(base) || o < len(ours) || t < len(theirs) {
+		// Copy over lines that are unchanged in both versions.
+		n := 0
+		for b+n < len(base) && matchOurs[b+n] == o+n &&
+			matchTheirs[b+n] == t+n {
+			n++
+		}
+		if n > 0 {
+			result = append(result, base[b:b+n]...)
+			b, o, t = b+n, o+n, t+n
+			continue
+		}
+
+		// Find the next line that both versions kept, and look at
+		// the changes up to it.
+		nextB, nextO, nextT := len(base), len(ours), len(theirs)
+		for i := b; i < len(base); i++ {
+			if matchOurs[i] >= 0 && matchTheirs[i] >= 0 {
+				nextB, nextO, nextT = i, matchOurs[i], matchTheirs[i]
+				break
+			}
+		}
+		baseChunk := base[b:nextB]
+		oursChunk := ours[o:nextO]
+		theirsChunk := theirs[t:nextT]
+		switch {
+		case equalLines(oursChunk, baseChunk):
+			result = append(result, theirsChunk...)
+		case equalLines(theirsChunk, baseChunk),
+			equalLines(oursChunk, theirsChunk):
+			result = append(result, oursChunk...)
+		default:
+			return nil, false
+		}
+		b, o, t = nextB, nextO, nextT
+	}
+	return result, true
+}
+
+// Merge implements the MergeStrategy interface for TextMergeStrategy.
+func (TextMergeStrategy) Merge(ctx context.Context, name string,
+	_ map[string][]byte, base, merged, unmerged []byte) (
+	[]byte, bool, error) {
+	if len(base) > maxTextMergeBytes || len(merged) > maxTextMergeBytes ||
+		len(unmerged) > maxTextMergeBytes {
+		return nil, false, nil
+	}
+	if !looksLikeText(base) || !looksLikeText(merged) ||
+		!looksLikeText(unmerged) {
+		return nil, false, nil
+	}
+	lines, ok := mergeLines(
+		splitLines(base), splitLines(merged), splitLines(unmerged))
+	if !ok {
+		return nil, false, nil
+	}
+	var result bytes.Buffer
+	for _, line := range lines {
+		result.WriteString(line)
+	}
+	return result.Bytes(), true, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestTextMergeStrategy(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name             string
+		merged, unmerged string
+		result           string
+		ok               bool
+	}{
+		{"disjoint", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n",
+			true},
+		{"one side", base, "a\nb\nC\nd\ne\n", "a\nb\nC\nd\ne\n", true},
+		{"same change", "a\nX\nc\nd\ne\n", "a\nX\nc\nd\ne\n",
+			"a\nX\nc\nd\ne\n", true},
+		{"insert and delete", "a\nb\nb2\nc\nd\ne\n", "a\nb\nc\ne\n",
+			"a\nb\nb2\nc\ne\n", true},
+		{"append without newline", "a\nb\nc\nd\ne\nf", "Z\nb\nc\nd\ne\n",
+			"Z\nb\nc\nd\ne\nf", true},
+		{"overlap", "a\nB\nc\nd\ne\n", "a\nb2\nc\nd\ne\n", "", false},
+		{"both append", base + "x\n", base + "y\n", "", false},
+		{"binary", "a\nb\x00\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "", false},
+	}
+	for _, test := range tests {
+		result, ok, err := TextMergeStrategy{}.Merge(context.Background(),
+			"f", nil, []byte(base), []byte(test.merged), []byte(test.unmerged))
+		if err != nil {
+			t.Fatalf("%s: Merge failed: %v", test.name, err)
+		}
+		if ok != test.ok {
+			t.Errorf("%s: Expected ok=%t, got %t", test.name, test.ok, ok)
+		} else if ok && string(result) != test.result {
+			t.Errorf("%s: Expected %q, got %q", test.name, test.result,
+				result)
+		}
+	}
+}
+
+func TestTextMergeStrategyTooBig(t *testing.T) {
+	line := "0123456789abcdef\n"
+	base := strings.Repeat(line, maxTextMergeBytes/len(line)+1)
+	merged := "A\n" + base
+	unmerged := base + "Z\n"
+	_, ok, err := TextMergeStrategy{}.Merge(context.Background(),
+		"f", nil, []byte(base), []byte(merged), []byte(unmerged))
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if ok {
+		t.Errorf("Merged a file bigger than %d bytes", maxTextMergeBytes)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A TLF archive, as written by KBFSOps.ExportTLF, is tlfArchiveMagic
+// followed by a series of records, each of which is a 4-byte
+// big-endian length and then that many bytes of an encoded struct.
+// The first record is a tlfArchiveHeader, and every other record is
+// a tlfArchiveBlock.  The blocks come in post-order, i.e. each block
+// comes after all of the blocks it points to, so that the root
+// directory block is the last one.
+const tlfArchiveMagic = "KBFSTLF\n"
+
+// tlfArchiveVersion is the version of the TLF archive format
+// written by this code.
+const tlfArchiveVersion = 1
+
+// maxTLFArchiveRecordSize bounds the size of a single archive record,
+// so that a corrupt archive can't make the importer allocate too much
+// memory.
+const maxTLFArchiveRecordSize = 64 << 20
+
+// tlfArchiveHeader is the first record of a TLF archive.
+type tlfArchiveHeader struct {
+	Version int   `codec:"v"`
+	TlfID   TlfID `codec:"t"`
+	// MD is the encoded RootMetadataSigned of the exported
+	// revision, as the MD server returned it.
+	MD []byte `codec:"m"`
+}
+
+// tlfArchiveBlock is a block of a TLF archive, still encrypted, along
+// with what's needed to decrypt it given the folder's keys.
+type tlfArchiveBlock struct {
+	Ptr        BlockPointer            `codec:"p"`
+	IsDir      bool                    `codec:"d,omitempty"`
+	ServerHalf BlockCryptKeyServerHalf `codec:"s"`
+	Buf        []byte                  `codec:"b"`
+}
+
+func writeTLFArchiveRecord(w io.Writer, codec Codec, v interface{}) error {
+	buf, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(buf)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readTLFArchiveRecord decodes the next record of a TLF archive into
+// v.  It returns io.EOF if the archive ends cleanly before the
+// record.
+func readTLFArchiveRecord(r io.Reader, codec Codec, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return InvalidTLFArchiveError{err.Error()}
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxTLFArchiveRecordSize {
+		return InvalidTLFArchiveError{
+			fmt.Sprintf("record of %d bytes is too big", n)}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return InvalidTLFArchiveError{err.Error()}
+	}
+	if err := codec.Decode(buf, v); err != nil {
+		return InvalidTLFArchiveError{err.Error()}
+	}
+	return nil
+}
+
+// forEachTLFArchiveChild calls f for every pointer in the given
+// block to another block, in a fixed order, along with whether it's a
+// directory block, and replaces the pointer's BlockInfo with the
+// one f returns.
+func forEachTLFArchiveChild(block Block,
+	f func(info BlockInfo, isDir bool) (BlockInfo, error)) error {
+	switch b := block.(type) {
+	case *DirBlock:
+		for i, iptr := range b.IPtrs {
+			info, err := f(iptr.BlockInfo, true)
+			if err != nil {
+				return err
+			}
+			b.IPtrs[i].BlockInfo = info
+		}
+		names := make([]string, 0, len(b.Children))
+		for name := range b.Children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			de := b.Children[name]
+			if de.Type == Sym {
+				continue
+			}
+			info, err := f(de.BlockInfo, de.Type == Dir)
+			if err != nil {
+				return err
+			}
+			de.BlockInfo = info
+			b.Children[name] = de
+		}
+	case *FileBlock:
+		for i, iptr := range b.IPtrs {
+			info, err := f(iptr.BlockInfo, false)
+			if err != nil {
+				return err
+			}
+			b.IPtrs[i].BlockInfo = info
+		}
+	}
+	return nil
+}
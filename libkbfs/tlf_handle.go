@@ -128,6 +128,13 @@ func (h TlfHandle) UnresolvedReaders() []keybase1.SocialAssertion {
 	return unresolvedReaders
 }
 
+// IsShared returns whether the top-level folder represented by this
+// TlfHandle has more than one member, resolved or not.
+func (h TlfHandle) IsShared() bool {
+	return len(h.resolvedWriters)+len(h.unresolvedWriters)+
+		len(h.resolvedReaders)+len(h.unresolvedReaders) > 1
+}
+
 // ConflictInfo returns the handle's conflict info, if any.
 func (h TlfHandle) ConflictInfo() *TlfHandleExtension {
 	if h.conflictInfo == nil {
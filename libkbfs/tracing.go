@@ -0,0 +1,130 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TraceSpan describes one finished, timed step of an operation.  All
+// the spans started (directly or indirectly) from the same root span
+// share a TraceID, and each one but the root names the span it was
+// started under with ParentID.
+type TraceSpan struct {
+	TraceID  uint64
+	SpanID   uint64
+	ParentID uint64
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	// Tags holds any extra details about the step, like the block
+	// ID being fetched.
+	Tags map[string]string
+	// Err is the error the step failed with, if any.
+	Err error
+}
+
+type ctxTraceSpanKeyType int
+
+const ctxTraceSpanKey ctxTraceSpanKeyType = iota
+
+// traceSpan is a span that hasn't finished yet.  A nil *traceSpan
+// means tracing is off, and all its methods do nothing.
+type traceSpan struct {
+	exporter SpanExporter
+	clock    Clock
+
+	lock sync.Mutex
+	span TraceSpan
+	done bool
+}
+
+func makeTraceID() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// IDs only need to be unique enough to tell traces
+		// apart, so fall back to the time.
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// startTraceSpan starts a new span with the given name, as a child of
+// the span in ctx if there is one.  The returned context carries the
+// new span, so that spans started from it become its children.  If
+// the config has no SpanExporter, this returns the given ctx and a
+// nil span.
+func startTraceSpan(ctx context.Context, config Config, name string) (
+	context.Context, *traceSpan) {
+	exporter := config.SpanExporter()
+	if exporter == nil {
+		return ctx, nil
+	}
+	s := &traceSpan{
+		exporter: exporter,
+		clock:    config.Clock(),
+		span: TraceSpan{
+			SpanID: makeTraceID(),
+			Name:   name,
+			Start:  config.Clock().Now(),
+		},
+	}
+	if parent, ok := ctx.Value(ctxTraceSpanKey).(*traceSpan); ok {
+		s.span.TraceID = parent.span.TraceID
+		s.span.ParentID = parent.span.SpanID
+	} else {
+		s.span.TraceID = makeTraceID()
+	}
+	return context.WithValue(ctx, ctxTraceSpanKey, s), s
+}
+
+// setTag records an extra detail about the span.
+func (s *traceSpan) setTag(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.span.Tags == nil {
+		s.span.Tags = make(map[string]string)
+	}
+	s.span.Tags[key] = value
+}
+
+// finish ends the span, with the given error if it failed, and hands
+// it to the exporter.  Only the first call has any effect.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	s.done = true
+	s.span.Duration = s.clock.Now().Sub(s.span.Start)
+	s.span.Err = err
+	span := s.span
+	s.lock.Unlock()
+	s.exporter.ExportSpan(span)
+}
+
+// TraceIDsFromContext returns the trace ID and span ID of the span
+// carried in ctx, if any, so that they can be passed along to other
+// processes.
+func TraceIDsFromContext(ctx context.Context) (
+	traceID, spanID uint64, ok bool) {
+	s, ok := ctx.Value(ctxTraceSpanKey).(*traceSpan)
+	if !ok {
+		return 0, 0, false
+	}
+	return s.span.TraceID, s.span.SpanID, true
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testSpanExporter struct {
+	lock  sync.Mutex
+	spans []TraceSpan
+}
+
+func (e *testSpanExporter) ExportSpan(span TraceSpan) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *testSpanExporter) getSpans() []TraceSpan {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]TraceSpan(nil), e.spans...)
+}
+
+func TestTraceSpanNesting(t *testing.T) {
+	config := NewConfigLocal()
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	// Without an exporter, nothing is traced.
+	ctx, span := startTraceSpan(context.Background(), config, "off")
+	require.Nil(t, span)
+	span.setTag("a", "b")
+	span.finish(nil)
+	_, _, ok := TraceIDsFromContext(ctx)
+	require.False(t, ok)
+
+	exporter := &testSpanExporter{}
+	config.SetSpanExporter(exporter)
+	ctx, parent := startTraceSpan(context.Background(), config, "parent")
+	_, child := startTraceSpan(ctx, config, "child")
+	child.setTag("block", "1")
+	clock.Add(2)
+	expectedErr := errors.New("fail")
+	child.finish(expectedErr)
+	child.finish(nil)
+	parent.finish(nil)
+
+	traceID, spanID, ok := TraceIDsFromContext(ctx)
+	require.True(t, ok)
+	spans := exporter.getSpans()
+	require.Len(t, spans, 2)
+	require.Equal(t, TraceSpan{
+		TraceID:  traceID,
+		SpanID:   spans[0].SpanID,
+		ParentID: spanID,
+		Name:     "child",
+		Start:    now,
+		Duration: 2,
+		Tags:     map[string]string{"block": "1"},
+		Err:      expectedErr,
+	}, spans[0])
+	require.Equal(t, "parent", spans[1].Name)
+	require.Equal(t, traceID, spans[1].TraceID)
+	require.Equal(t, spanID, spans[1].SpanID)
+	require.Equal(t, uint64(0), spans[1].ParentID)
+}
+
+func TestTraceSpansAcrossLayers(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	exporter := &testSpanExporter{}
+	config.SetSpanExporter(exporter)
+	bserv := config.BlockServer()
+	config.SetBlockServer(NewBlockServerTraced(bserv, config))
+	defer config.SetBlockServer(bserv)
+	mdserv := config.MDServer()
+	config.SetMDServer(NewMDServerTraced(mdserv, config))
+	defer config.SetMDServer(mdserv)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	spans := exporter.getSpans()
+	byName := make(map[string]TraceSpan)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	sync, ok := byName["KBFSOps.Sync"]
+	require.True(t, ok)
+	require.Equal(t, uint64(0), sync.ParentID)
+	for _, name := range []string{
+		"Crypto.EncryptBlock", "BlockServer.Put", "MDServer.Put"} {
+		span, ok := byName[name]
+		require.True(t, ok, "No span for %s", name)
+		require.Equal(t, sync.TraceID, span.TraceID)
+		require.Equal(t, sync.SpanID, span.ParentID)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"time"
+)
+
+// trashDirName is the directory, at the root of each folder, that
+// holds removed entries until the trash retention period is up.  A
+// removed entry moves to <trashDirName>/<removal time>/<original
+// path>, so everything removed in the same second shares a
+// directory, and it can be restored to where it came from.
+const trashDirName = ".kbfs_trash"
+
+// trashTimeFormat is the format of the removal time directories in
+// the trash.  It sorts in time order, and has no colons since not
+// every platform allows them in file names.
+const trashTimeFormat = "2006-01-02T15-04-05Z"
+
+// trashTimeFormatNano is used instead of trashTimeFormat when an
+// entry with the same path was already trashed in the same second.
+// Either one parses with trashTimeFormat.
+const trashTimeFormatNano = "2006-01-02T15-04-05.000000000Z"
+
+// trashPurgePeriod is how often each loaded folder's trash is
+// checked for entries that have been there longer than the
+// retention period.
+const trashPurgePeriod = time.Hour
+
+// TrashEntry describes an entry in the trash of a folder.
+type TrashEntry struct {
+	// Path is where the entry was, relative to the root of the
+	// folder.
+	Path string
+	// TrashPath is where the entry is now, relative to the trash
+	// directory.  It's what KBFSOps.RestoreFromTrash takes.
+	TrashPath string
+	// Removed is when the entry was removed.
+	Removed time.Time
+	Type    EntryType
+	Size    uint64
+}
+
+// parseTrashPath splits a path relative to the trash directory into
+// the name of its removal time directory and the original path
+// components.  It returns InvalidTrashPathError if the path can't
+// have come from a removal.
+func parseTrashPath(trashPath string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(trashPath, "/"), "/")
+	if len(parts) < 2 {
+		return "", nil, InvalidTrashPathError{trashPath}
+	}
+	if _, err := time.Parse(trashTimeFormat, parts[0]); err != nil {
+		return "", nil, InvalidTrashPathError{trashPath}
+	}
+	for _, part := range parts[1:] {
+		if part == "" || part == "." || part == ".." {
+			return "", nil, InvalidTrashPathError{trashPath}
+		}
+	}
+	// Nothing is ever trashed out of the KBFS directories
+	// themselves, so nothing should be restored into them.
+	if parts[1] == trashDirName || parts[1] == hardLinksDirName ||
+		parts[1] == settingsDirName {
+		return "", nil, InvalidTrashPathError{trashPath}
+	}
+	return parts[0], parts[1:], nil
+}
+
+// isTrashable returns whether the entries of the given directory go
+// to the trash when they're removed, rather than being deleted right
+// away.  Entries removed from the trash itself, or from the hard
+// links or settings directories, are always deleted.
+func isTrashable(dir path) bool {
+	if len(dir.path) < 2 {
+		return true
+	}
+	top := dir.path[1].Name
+	return top != trashDirName && top != hardLinksDirName &&
+		top != settingsDirName
+}
+
+type trashEntriesByRemoval []TrashEntry
+
+func (t trashEntriesByRemoval) Len() int {
+	return len(t)
+}
+
+func (t trashEntriesByRemoval) Less(i, j int) bool {
+	if !t[i].Removed.Equal(t[j].Removed) {
+		return t[i].Removed.Before(t[j].Removed)
+	}
+	return t[i].Path < t[j].Path
+}
+
+func (t trashEntriesByRemoval) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
@@ -0,0 +1,669 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// writeBackOp is a single write, truncate or hole punch of a file
+// that hasn't been synced to the servers yet.  A hole punch covers
+// Size bytes starting at Off.
+type writeBackOp struct {
+	Truncate  bool
+	PunchHole bool   `codec:",omitempty"`
+	Off       int64  `codec:",omitempty"`
+	Data      []byte `codec:",omitempty"`
+	Size      uint64 `codec:",omitempty"`
+}
+
+// writeBackEntry is the on-disk form of the journaled writes of a
+// single file.
+type writeBackEntry struct {
+	// Path is the names of the file and its parent directories,
+	// starting below the folder root, as of the last time the file
+	// was journaled.
+	Path []string
+	Ops  []writeBackOp
+}
+
+// writeBackFile tracks the unsynced writes of one open file.
+type writeBackFile struct {
+	node Node
+	// name is the file's entry in the journal directory.
+	name string
+	path []string
+	ops  []writeBackOp
+	// journaled is the number of ops, from the start, that are in
+	// the on-disk entry.
+	journaled int
+}
+
+// writeBackUsage tracks how much disk the write-back journals of all
+// folders take up together, for WriteBackJournalLimits.TotalBytes.
+type writeBackUsage struct {
+	lock  sync.Mutex
+	bytes uint64
+}
+
+func (u *writeBackUsage) add(delta int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.bytes = uint64(int64(u.bytes) + delta)
+}
+
+func (u *writeBackUsage) get() uint64 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.bytes
+}
+
+// writeBackJournal keeps every write and truncate made to the files
+// of a single folder-branch until they've been synced to the
+// servers.  When a file is synced in write-back mode, its
+// outstanding writes are first persisted to a flat file in a
+// directory on disk, so that the sync to the servers can finish in
+// the background without the data being lost if the process dies.
+//
+// The directory layout looks like:
+//
+// dir/version
+// dir/seal
+// dir/0
+// dir/1
+// ...
+//
+// Each numbered file holds an encoded writeBackEntry.  Entries found
+// in the directory on startup are left over from a previous run, and
+// need to be replayed.  The version file holds the format version of
+// the entries, so that a process never replays entries written by a
+// newer one, e.g. after a downgrade.  The seal file is written on
+// a clean shutdown, and holds the hash of every entry, so that the
+// next process (usually an upgraded one) can check that it's
+// adopting exactly what was left behind.  The seal is removed as
+// soon as the journal changes again.  Alongside the journals of all
+// folders, a clean shutdown also leaves the block cache for the next
+// process; see writeBlockCacheHandoff.
+type writeBackJournal struct {
+	codec Codec
+	dir   string
+	usage *writeBackUsage
+
+	lock     sync.Mutex
+	nextName uint64
+	files    map[NodeID]*writeBackFile
+	// leftovers are the names of entries left over from a previous
+	// run, in the order they were created.
+	leftovers []string
+	// sealed is whether the seal file is on disk.
+	sealed bool
+	// sizes holds the size of every entry on disk that's waiting
+	// to be synced or replayed, and bytes is their sum.
+	sizes map[string]uint64
+	bytes uint64
+}
+
+// writeBackSeal is the on-disk form of a sealed journal.
+type writeBackSeal struct {
+	// Entries maps the name of every entry to the hash of its
+	// contents.
+	Entries map[string]Hash
+}
+
+const (
+	// writeBackJournalVersion is the current format version of
+	// the entries in a write-back journal.  Version 2 added hole
+	// punches.
+	writeBackJournalVersion = 2
+	writeBackVersionFile    = "version"
+	writeBackSealFile       = "seal"
+)
+
+// writeBackJournalVersionError is returned when a write-back journal
+// was written by a newer version of KBFS than this one.
+type writeBackJournalVersionError struct {
+	dir     string
+	version int
+}
+
+func (e writeBackJournalVersionError) Error() string {
+	return fmt.Sprintf("write-back journal %s has version %d, "+
+		"but only versions up to %d are supported",
+		e.dir, e.version, writeBackJournalVersion)
+}
+
+// unrecoverableWriteBackSuffix is added to the names of leftover
+// entries whose files can no longer be found, so that they aren't
+// replayed again but remain on disk for the user to recover.
+const unrecoverableWriteBackSuffix = ".unrecoverable"
+
+// corruptWriteBackSuffix is added to the names of leftover entries
+// that don't match the seal of the previous run, so that they aren't
+// replayed but remain on disk for inspection.
+const corruptWriteBackSuffix = ".corrupt"
+
+// checkWriteBackVersion makes sure the entries in dir can be read
+// by this version of KBFS, and records the current version if dir
+// doesn't have one yet, or has an older one.
+func checkWriteBackVersion(dir string) error {
+	versionPath := filepath.Join(dir, writeBackVersionFile)
+	buf, err := ioutil.ReadFile(versionPath)
+	if os.IsNotExist(err) {
+		// A new journal, or one from before the journal had a
+		// version, whose format is the same as version 1.
+		return ioutil.WriteFile(versionPath,
+			[]byte(strconv.Itoa(writeBackJournalVersion)), 0600)
+	} else if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(string(buf))
+	if err != nil {
+		return err
+	}
+	if version > writeBackJournalVersion {
+		return writeBackJournalVersionError{dir, version}
+	} else if version < writeBackJournalVersion {
+		// Older entries can still be read, but new ones may not
+		// be readable by older versions.
+		return ioutil.WriteFile(versionPath,
+			[]byte(strconv.Itoa(writeBackJournalVersion)), 0600)
+	}
+	return nil
+}
+
+// makeWriteBackJournal returns a new writeBackJournal for the given
+// directory, noting any entries left over from a previous run.  If
+// the previous run sealed the journal, any entry that doesn't match
+// the seal is set aside instead.  The journal's disk usage counts
+// towards usage, if it's non-nil, until release is called.
+func makeWriteBackJournal(codec Codec, dir string, usage *writeBackUsage) (
+	*writeBackJournal, error) {
+	if usage == nil {
+		usage = &writeBackUsage{}
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = checkWriteBackVersion(dir)
+	if err != nil {
+		return nil, err
+	}
+	seal, err := readWriteBackSeal(codec, dir)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []uint64
+	sizes := make(map[string]uint64)
+	for _, fi := range fileInfos {
+		n, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil {
+			// Temporary or unrecoverable entries.
+			continue
+		}
+		if seal != nil {
+			ok, err := checkWriteBackSeal(dir, fi.Name(), seal)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				err := os.Rename(filepath.Join(dir, fi.Name()),
+					filepath.Join(dir, fi.Name()+corruptWriteBackSuffix))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		names = append(names, n)
+		sizes[fi.Name()] = uint64(fi.Size())
+	}
+	sort.Sort(uint64Slice(names))
+
+	j := &writeBackJournal{
+		codec: codec,
+		dir:   dir,
+		usage: usage,
+		files: make(map[NodeID]*writeBackFile),
+		sizes: make(map[string]uint64),
+	}
+	for name, size := range sizes {
+		j.setSizeLocked(name, size)
+	}
+	for _, n := range names {
+		j.leftovers = append(j.leftovers, strconv.FormatUint(n, 10))
+		j.nextName = n + 1
+	}
+	// The leftovers now belong to this run.
+	err = os.Remove(filepath.Join(dir, writeBackSealFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return j, nil
+}
+
+// readWriteBackSeal returns the seal in dir, or nil if the journal
+// wasn't sealed, e.g. because the previous run crashed.  Entries are
+// always written atomically, so those of an unsealed journal can
+// still be replayed.
+func readWriteBackSeal(codec Codec, dir string) (*writeBackSeal, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, writeBackSealFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var seal writeBackSeal
+	err = codec.Decode(buf, &seal)
+	if err != nil {
+		return nil, err
+	}
+	return &seal, nil
+}
+
+// checkWriteBackSeal returns whether the entry with the given name
+// in dir is the one recorded in seal.
+func checkWriteBackSeal(dir, name string, seal *writeBackSeal) (
+	bool, error) {
+	expected, ok := seal.Entries[name]
+	if !ok {
+		return false, nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return false, err
+	}
+	h, err := DefaultHash(buf)
+	if err != nil {
+		return false, err
+	}
+	return h == expected, nil
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (j *writeBackJournal) entryPath(name string) string {
+	return filepath.Join(j.dir, name)
+}
+
+func (j *writeBackJournal) readEntry(name string) (writeBackEntry, error) {
+	buf, err := ioutil.ReadFile(j.entryPath(name))
+	if err != nil {
+		return writeBackEntry{}, err
+	}
+	var e writeBackEntry
+	err = j.codec.Decode(buf, &e)
+	if err != nil {
+		return writeBackEntry{}, err
+	}
+	return e, nil
+}
+
+// setSizeLocked records the new size of the entry with the given
+// name, or that it's gone if size is 0.
+func (j *writeBackJournal) setSizeLocked(name string, size uint64) {
+	old := j.sizes[name]
+	if size == 0 {
+		delete(j.sizes, name)
+	} else {
+		j.sizes[name] = size
+	}
+	j.bytes = j.bytes - old + size
+	j.usage.add(int64(size) - int64(old))
+}
+
+// release stops counting the journal's entries towards the usage of
+// all journals, once the journal won't be used again by this process.
+func (j *writeBackJournal) release() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.usage.add(-int64(j.bytes))
+	j.bytes = 0
+	j.sizes = make(map[string]uint64)
+}
+
+// writeEntry durably replaces the entry with the given name, by
+// writing and flushing a temporary file and renaming it into place.
+func (j *writeBackJournal) writeEntry(name string, e writeBackEntry) error {
+	buf, err := j.codec.Encode(e)
+	if err != nil {
+		return err
+	}
+	return j.writeEntryBuf(name, buf)
+}
+
+// writeEntryBuf is like writeEntry, for an already-encoded entry.
+func (j *writeBackJournal) writeEntryBuf(name string, buf []byte) error {
+	tmpPath := j.entryPath(name) + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, j.entryPath(name))
+	if err != nil {
+		return err
+	}
+	j.setSizeLocked(name, uint64(len(buf)))
+	return nil
+}
+
+// unsealLocked removes the seal, if any, before the journal is
+// changed.
+func (j *writeBackJournal) unsealLocked() error {
+	if !j.sealed {
+		return nil
+	}
+	err := os.Remove(j.entryPath(writeBackSealFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	j.sealed = false
+	return nil
+}
+
+// seal records the hash of every entry on disk, so that the next
+// process to open the journal can check them before replaying them.
+// It should be called once nothing else will be journaled by this
+// process.
+func (j *writeBackJournal) seal() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	seal := writeBackSeal{Entries: make(map[string]Hash)}
+	for _, fi := range fileInfos {
+		if _, err := strconv.ParseUint(fi.Name(), 10, 64); err != nil {
+			continue
+		}
+		buf, err := ioutil.ReadFile(j.entryPath(fi.Name()))
+		if err != nil {
+			return err
+		}
+		h, err := DefaultHash(buf)
+		if err != nil {
+			return err
+		}
+		seal.Entries[fi.Name()] = h
+	}
+	buf, err := j.codec.Encode(seal)
+	if err != nil {
+		return err
+	}
+	sealPath := j.entryPath(writeBackSealFile)
+	err = ioutil.WriteFile(sealPath+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(sealPath+".tmp", sealPath)
+	if err != nil {
+		return err
+	}
+	j.sealed = true
+	return nil
+}
+
+func (j *writeBackJournal) removeEntry(name string) error {
+	err := os.Remove(j.entryPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	j.setSizeLocked(name, 0)
+	return nil
+}
+
+func (j *writeBackJournal) recordLocked(node Node, op writeBackOp) {
+	f, ok := j.files[node.GetID()]
+	if !ok {
+		f = &writeBackFile{node: node}
+		j.files[node.GetID()] = f
+	}
+	f.ops = append(f.ops, op)
+}
+
+// recordWrite notes a write to the given file.  It must only be
+// called once the write has been applied to the file's dirty blocks.
+func (j *writeBackJournal) recordWrite(node Node, data []byte, off int64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	// The caller may reuse data.
+	dataCopy := make([]byte, len(data))
+	copy(dataCopy, data)
+	j.recordLocked(node, writeBackOp{Off: off, Data: dataCopy})
+}
+
+// recordTruncate notes a truncate of the given file.  It must only
+// be called once the truncate has been applied to the file's dirty
+// blocks.
+func (j *writeBackJournal) recordTruncate(node Node, size uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.recordLocked(node, writeBackOp{Truncate: true, Size: size})
+}
+
+// recordPunchHole notes a hole punched in the given file.  It must
+// only be called once the hole has been punched in the file's dirty
+// blocks.
+func (j *writeBackJournal) recordPunchHole(
+	node Node, off, length int64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.recordLocked(node, writeBackOp{
+		PunchHole: true, Off: off, Size: uint64(length)})
+}
+
+// pendingOps returns how many writes and truncates of the given file
+// are waiting to be synced to the servers.
+func (j *writeBackJournal) pendingOps(node Node) int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f, ok := j.files[node.GetID()]
+	if !ok {
+		return 0
+	}
+	return len(f.ops)
+}
+
+// journal persists all of the given file's unsynced writes to disk,
+// under the given path.  If that would take this journal, or all the
+// journals together, over the given limits, it returns a
+// WriteBackJournalFullError and leaves the journal as it was.
+func (j *writeBackJournal) journal(node Node, path []string,
+	limits WriteBackJournalLimits) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f, ok := j.files[node.GetID()]
+	if !ok || len(f.ops) == 0 {
+		return nil
+	}
+	buf, err := j.codec.Encode(writeBackEntry{Path: path, Ops: f.ops})
+	if err != nil {
+		return err
+	}
+	name := f.name
+	if name == "" {
+		name = strconv.FormatUint(j.nextName, 10)
+	}
+	growth := int64(len(buf)) - int64(j.sizes[name])
+	if growth > 0 {
+		if limits.PerFolderBytes > 0 &&
+			j.bytes+uint64(growth) > limits.PerFolderBytes {
+			return WriteBackJournalFullError{limits.PerFolderBytes, false}
+		}
+		if limits.TotalBytes > 0 &&
+			j.usage.get()+uint64(growth) > limits.TotalBytes {
+			return WriteBackJournalFullError{limits.TotalBytes, true}
+		}
+	}
+	if err := j.unsealLocked(); err != nil {
+		return err
+	}
+	err = j.writeEntryBuf(name, buf)
+	if err != nil {
+		return err
+	}
+	if f.name == "" {
+		f.name = name
+		j.nextName++
+	}
+	f.path = path
+	f.journaled = len(f.ops)
+	return nil
+}
+
+// synced forgets the first n writes and truncates of the given file,
+// now that they're on the servers.
+func (j *writeBackJournal) synced(node Node, n int) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f, ok := j.files[node.GetID()]
+	if !ok || n == 0 {
+		return nil
+	}
+	if err := j.unsealLocked(); err != nil {
+		return err
+	}
+	if n > len(f.ops) {
+		n = len(f.ops)
+	}
+	f.ops = f.ops[n:]
+	if f.journaled > n {
+		f.journaled -= n
+		return j.writeEntry(f.name, writeBackEntry{
+			Path: f.path,
+			Ops:  f.ops[:f.journaled],
+		})
+	}
+	f.journaled = 0
+	if f.name != "" {
+		if err := j.removeEntry(f.name); err != nil {
+			return err
+		}
+		f.name = ""
+	}
+	if len(f.ops) == 0 {
+		delete(j.files, node.GetID())
+	}
+	return nil
+}
+
+// journaledNodes returns every file with journaled writes that
+// aren't on the servers yet.
+func (j *writeBackJournal) journaledNodes() []Node {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var nodes []Node
+	for _, f := range j.files {
+		if f.journaled > 0 {
+			nodes = append(nodes, f.node)
+		}
+	}
+	return nodes
+}
+
+// unjournaledNodes returns every file with writes that are neither
+// on the servers nor persisted in the journal yet.
+func (j *writeBackJournal) unjournaledNodes() []Node {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var nodes []Node
+	for _, f := range j.files {
+		if len(f.ops) > f.journaled {
+			nodes = append(nodes, f.node)
+		}
+	}
+	return nodes
+}
+
+// getLeftovers returns the names of the entries left over from a
+// previous run that haven't been replayed yet.
+func (j *writeBackJournal) getLeftovers() []string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append([]string(nil), j.leftovers...)
+}
+
+// status returns the current state of the journal, as found on
+// disk.
+func (j *writeBackJournal) status() (WriteBackStatus, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return WriteBackStatus{}, err
+	}
+	s := WriteBackStatus{Leftovers: len(j.leftovers), Bytes: j.bytes}
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+			s.Entries++
+		} else if strings.HasSuffix(name, unrecoverableWriteBackSuffix) ||
+			strings.HasSuffix(name, corruptWriteBackSuffix) {
+			s.SetAside++
+		}
+	}
+	return s, nil
+}
+
+// replayed removes the given leftover entry, once its writes have
+// been applied again and journaled under a new name.  If
+// unrecoverable is true, the entry is kept on disk under a name that
+// won't be replayed.
+func (j *writeBackJournal) replayed(name string, unrecoverable bool) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	err := j.unsealLocked()
+	if err != nil {
+		return err
+	}
+	if unrecoverable {
+		// Set-aside entries stay on disk until the user deals
+		// with them, so they don't count towards the limits.
+		err = os.Rename(j.entryPath(name),
+			j.entryPath(name+unrecoverableWriteBackSuffix))
+		if err == nil {
+			j.setSizeLocked(name, 0)
+		}
+	} else {
+		err = j.removeEntry(name)
+	}
+	if err != nil {
+		return err
+	}
+	for i, l := range j.leftovers {
+		if l == name {
+			j.leftovers = append(j.leftovers[:i], j.leftovers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func readWriteBackDir(t *testing.T, dir string) []string {
+	fileInfos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range fileInfos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+// Test that in write-back mode, Sync returns before the file's data
+// has been uploaded, and that WaitForWriteBack waits for it.
+func TestWriteBackSyncReturnsBeforeUpload(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config1)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "write_back_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config1.SetWriteBackJournalDir(dir)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "test_user", false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+
+	// Stall the uploads from the background write-back, which
+	// doesn't have a stall key in its context.
+	onPutStalledCh := make(chan struct{}, 1)
+	putUnstallCh := make(chan struct{})
+	stallKey := "requestName"
+	ctx = context.WithValue(ctx, stallKey, "user")
+	config1.SetBlockOps(&stallingBlockOps{
+		stallOpName: "Put",
+		stallKey:    stallKey,
+		stallMap: map[interface{}]staller{
+			nil: staller{
+				stalled: onPutStalledCh,
+				unstall: putUnstallCh,
+			},
+		},
+		internalDelegate: config1.BlockOps(),
+	})
+
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileNode1, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	<-onPutStalledCh
+
+	folderBranch := rootNode1.GetFolderBranch()
+	journalDir := filepath.Join(dir, folderBranch.Tlf.String())
+	require.Equal(t, []string{"0", writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+
+	// Another device can't see the data yet.
+	config2 := ConfigAsUser(config1, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), ei.Size)
+
+	close(putUnstallCh)
+	err = kbfsOps1.WaitForWriteBack(ctx, folderBranch)
+	require.NoError(t, err)
+	require.Equal(t, []string{writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, folderBranch)
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+}
+
+// Test that writes left in the write-back journal by a previous run
+// are replayed and uploaded, and that ones for files that no longer
+// exist are set aside.
+func TestWriteBackReplayLeftovers(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config1)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "test_user", false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, dirNode1, "f", false)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "write_back_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	folderBranch := rootNode1.GetFolderBranch()
+	journalDir := filepath.Join(dir, folderBranch.Tlf.String())
+	j, err := makeWriteBackJournal(config1.Codec(), journalDir, nil)
+	require.NoError(t, err)
+	err = j.writeEntry("0", writeBackEntry{
+		Path: []string{"d", "f"},
+		Ops: []writeBackOp{
+			{Off: 0, Data: []byte{1, 2, 3, 4, 5}},
+			{Truncate: true, Size: 3},
+		},
+	})
+	require.NoError(t, err)
+	err = j.writeEntry("1", writeBackEntry{
+		Path: []string{"gone"},
+		Ops:  []writeBackOp{{Off: 0, Data: []byte{6}}},
+	})
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config1, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetWriteBackJournalDir(dir)
+	GetRootNodeOrBust(t, config2, "test_user", false)
+	err = config2.KBFSOps().WaitForWriteBack(ctx, folderBranch)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1" + unrecoverableWriteBackSuffix,
+		writeBackVersionFile}, readWriteBackDir(t, journalDir))
+	status, _, err := config2.KBFSOps().FolderStatus(ctx, folderBranch)
+	require.NoError(t, err)
+	require.Equal(t, &WriteBackStatus{SetAside: 1}, status.WriteBack)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, folderBranch)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	n, err := kbfsOps1.Read(ctx, fileNode1, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, buf[:n])
+}
+
+// Test that a sealed journal is adopted by the next run only if its
+// entries match the seal, and that a journal from a newer version
+// isn't adopted at all.
+func TestWriteBackSealedHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "write_back_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codec := NewCodecMsgpack()
+	j, err := makeWriteBackJournal(codec, dir, nil)
+	require.NoError(t, err)
+	for _, name := range []string{"0", "1", "2"} {
+		err = j.writeEntry(name, writeBackEntry{
+			Path: []string{"f" + name},
+			Ops:  []writeBackOp{{Off: 0, Data: []byte(name)}},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, j.seal())
+	require.Equal(t, []string{"0", "1", "2", writeBackSealFile,
+		writeBackVersionFile}, readWriteBackDir(t, dir))
+
+	// Change one entry and add another behind the seal's back.
+	err = j.writeEntry("1", writeBackEntry{Path: []string{"other"}})
+	require.NoError(t, err)
+	err = j.writeEntry("3", writeBackEntry{Path: []string{"f3"}})
+	require.NoError(t, err)
+
+	j, err = makeWriteBackJournal(codec, dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "2"}, j.getLeftovers())
+	require.Equal(t, uint64(3), j.nextName)
+	require.Equal(t, []string{"0", "1" + corruptWriteBackSuffix, "2",
+		"3" + corruptWriteBackSuffix, writeBackVersionFile},
+		readWriteBackDir(t, dir))
+	e, err := j.readEntry("2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"f2"}, e.Path)
+
+	newer := writeBackJournalVersion + 1
+	err = ioutil.WriteFile(filepath.Join(dir, writeBackVersionFile),
+		[]byte(strconv.Itoa(newer)), 0600)
+	require.NoError(t, err)
+	_, err = makeWriteBackJournal(codec, dir, nil)
+	require.Equal(t, writeBackJournalVersionError{dir, newer}, err)
+}
+
+// Test that syncs write through to the servers while the write-back
+// journal is over one of its limits, and that the user is told.
+func TestWriteBackJournalLimits(t *testing.T) {
+	config1, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config1)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "write_back_journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config1.SetWriteBackJournalDir(dir)
+	config1.SetWriteBackJournalLimits(WriteBackJournalLimits{
+		PerFolderBytes: 1})
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "test_user", false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	folderBranch := rootNode1.GetFolderBranch()
+	journalDir := filepath.Join(dir, folderBranch.Tlf.String())
+	require.Equal(t, []string{writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+	errs := config1.Reporter().AllKnownErrors()
+	require.NotEmpty(t, errs)
+	require.Equal(t, WriteBackJournalFullError{1, false},
+		errs[len(errs)-1].Error)
+
+	// Another device sees the data without waiting for the
+	// write-back.
+	config2 := ConfigAsUser(config1, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, buf[:n])
+
+	// The total limit applies to the journals of all folders.
+	config1.SetWriteBackJournalLimits(WriteBackJournalLimits{TotalBytes: 1})
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{4}, 3)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	require.Equal(t, []string{writeBackVersionFile},
+		readWriteBackDir(t, journalDir))
+
+	// Once there's room, syncs are journaled again.
+	config1.SetWriteBackJournalLimits(WriteBackJournalLimits{})
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{5}, 4)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	err = kbfsOps1.WaitForWriteBack(ctx, folderBranch)
+	require.NoError(t, err)
+	status, _, err := kbfsOps1.FolderStatus(ctx, folderBranch)
+	require.NoError(t, err)
+	require.Equal(t, &WriteBackStatus{}, status.WriteBack)
+}
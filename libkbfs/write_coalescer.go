@@ -0,0 +1,181 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// writeCoalesceMaxWriteBytes is the largest write that's held
+	// back to be coalesced with the writes after it.
+	writeCoalesceMaxWriteBytes = 4 * 1024
+	// writeCoalesceMaxBytes is the most bytes held back for one
+	// file.
+	writeCoalesceMaxBytes = 64 * 1024
+)
+
+// coalescedWrite is a run of sequential writes to one file that
+// haven't been applied yet.
+type coalescedWrite struct {
+	file Node
+	off  int64
+	data []byte
+}
+
+// coalescedWriteErr is the error from applying a file's held-back
+// writes.
+type coalescedWriteErr struct {
+	file Node
+	err  error
+}
+
+// writeApplier applies a write to a file's blocks.
+type writeApplier func(ctx context.Context, file Node, data []byte,
+	off int64, noCopy bool) error
+
+// writeCoalescer holds back small sequential writes to the files of
+// one folder, such as the appends of a log or a database, and
+// applies each file's run of them as a single write once the
+// configured window has passed, so that every few bytes written
+// don't dirty and re-encode blocks all over again.  Any operation
+// that could observe a file's contents must call flush first.
+//
+// A held-back write has already been acknowledged, so if it can't be
+// applied, the error is kept against its file, and returned by the
+// next write to that file or by the next sync that covers it, the
+// way a deferred write error would be.
+//
+// Writes are applied with the coalescer's lock held, so that they
+// stay in order.  Folder writes are serialized by the block lock
+// anyway; but background syncs must never wait on the coalescer,
+// since a held-back write may be waiting for them to make room in
+// the dirty block cache.
+type writeCoalescer struct {
+	config Config
+	apply  writeApplier
+	// background runs the given function with a context that's
+	// canceled on shutdown.
+	background func(fn func(ctx context.Context) error) error
+
+	lock    sync.Mutex
+	pending map[NodeID]*coalescedWrite
+	timer   *time.Timer
+	// failed holds the first error from applying each file's
+	// held-back writes, until it's taken by takeErrs or by the
+	// next write to the file.
+	failed map[NodeID]coalescedWriteErr
+}
+
+func newWriteCoalescer(config Config, apply writeApplier,
+	background func(fn func(ctx context.Context) error) error) *writeCoalescer {
+	return &writeCoalescer{
+		config:     config,
+		apply:      apply,
+		background: background,
+		pending:    make(map[NodeID]*coalescedWrite),
+		failed:     make(map[NodeID]coalescedWriteErr),
+	}
+}
+
+// write applies the given write to the given file, or holds it back
+// to be coalesced with the next ones.
+func (wc *writeCoalescer) write(ctx context.Context, file Node,
+	data []byte, off int64, noCopy bool) error {
+	window := wc.config.WriteCoalesceWindow()
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	id := file.GetID()
+	if f, ok := wc.failed[id]; ok {
+		delete(wc.failed, id)
+		return f.err
+	}
+	p := wc.pending[id]
+	// Writes that don't copy their data can't be held back, since
+	// the caller may reuse the buffer as soon as they return.
+	coalesce := window > 0 && !noCopy &&
+		len(data) <= writeCoalesceMaxWriteBytes
+	if coalesce && p != nil && p.off+int64(len(p.data)) == off &&
+		len(p.data)+len(data) <= writeCoalesceMaxBytes {
+		p.data = append(p.data, data...)
+		return nil
+	}
+
+	if p != nil {
+		delete(wc.pending, id)
+		if err := wc.apply(ctx, p.file, p.data, p.off, true); err != nil {
+			return err
+		}
+	}
+	if !coalesce {
+		return wc.apply(ctx, file, data, off, noCopy)
+	}
+	wc.pending[id] = &coalescedWrite{
+		file: file,
+		off:  off,
+		data: append(make([]byte, 0, len(data)), data...),
+	}
+	if wc.timer == nil {
+		wc.timer = time.AfterFunc(window, wc.flushInBackground)
+	}
+	return nil
+}
+
+// flushLocked applies all the held-back writes, and keeps any error
+// against the file it belongs to.
+func (wc *writeCoalescer) flushLocked(ctx context.Context) {
+	if wc.timer != nil {
+		wc.timer.Stop()
+		wc.timer = nil
+	}
+	for id, p := range wc.pending {
+		delete(wc.pending, id)
+		err := wc.apply(ctx, p.file, p.data, p.off, true)
+		if _, ok := wc.failed[id]; err != nil && !ok {
+			wc.failed[id] = coalescedWriteErr{p.file, err}
+		}
+	}
+}
+
+// flush applies all the held-back writes.  Errors from applying them
+// are kept against their files, for takeErrs; flush itself only
+// fails if ctx is done.
+func (wc *writeCoalescer) flush(ctx context.Context) error {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	wc.flushLocked(ctx)
+	return ctx.Err()
+}
+
+// takeErrs returns the first error kept from applying the held-back
+// writes of any file for which include returns true, and forgets the
+// errors of all those files.
+func (wc *writeCoalescer) takeErrs(include func(file Node) bool) error {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	var firstErr error
+	for id, f := range wc.failed {
+		if !include(f.file) {
+			continue
+		}
+		delete(wc.failed, id)
+		if firstErr == nil {
+			firstErr = f.err
+		}
+	}
+	return firstErr
+}
+
+func (wc *writeCoalescer) flushInBackground() {
+	_ = wc.background(func(ctx context.Context) error {
+		wc.lock.Lock()
+		defer wc.lock.Unlock()
+		wc.flushLocked(ctx)
+		return nil
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type appliedWrite struct {
+	file   Node
+	data   string
+	off    int64
+	noCopy bool
+}
+
+func TestWriteCoalescer(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetWriteCoalesceWindow(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	a, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	b, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+
+	var applied []appliedWrite
+	wc := newWriteCoalescer(config,
+		func(ctx context.Context, file Node, data []byte, off int64,
+			noCopy bool) error {
+			applied = append(applied,
+				appliedWrite{file, string(data), off, noCopy})
+			return nil
+		},
+		func(fn func(ctx context.Context) error) error {
+			return fn(context.Background())
+		})
+
+	// Sequential small writes to each file are held back, even
+	// when the caller reuses its buffer.
+	buf := []byte("ab")
+	require.NoError(t, wc.write(ctx, a, buf, 0, false))
+	copy(buf, "cd")
+	require.NoError(t, wc.write(ctx, a, buf, 2, false))
+	require.NoError(t, wc.write(ctx, b, []byte("xy"), 10, false))
+	require.Len(t, applied, 0)
+
+	// A write elsewhere in the file applies the held-back ones
+	// first.
+	require.NoError(t, wc.write(ctx, a, []byte("e"), 0, false))
+	require.Equal(t, []appliedWrite{{a, "abcd", 0, true}}, applied)
+	applied = nil
+
+	// Big writes and writes that don't copy aren't held back.
+	big := make([]byte, writeCoalesceMaxWriteBytes+1)
+	require.NoError(t, wc.write(ctx, b, big, 12, false))
+	require.NoError(t, wc.write(ctx, b, []byte("z"), 0, true))
+	require.Equal(t, []appliedWrite{
+		{b, "xy", 10, true},
+		{b, string(big), 12, false},
+		{b, "z", 0, true},
+	}, applied)
+	applied = nil
+
+	require.NoError(t, wc.flush(ctx))
+	require.Equal(t, []appliedWrite{{a, "e", 0, true}}, applied)
+	applied = nil
+	require.NoError(t, wc.flush(ctx))
+	require.Len(t, applied, 0)
+
+	// An error applying a file's held-back writes is only reported
+	// for that file, by its next write.
+	errApply := errors.New("can't apply")
+	wc.apply = func(ctx context.Context, file Node, data []byte, off int64,
+		noCopy bool) error {
+		if file == a {
+			return errApply
+		}
+		return nil
+	}
+	require.NoError(t, wc.write(ctx, a, []byte("g"), 0, false))
+	require.NoError(t, wc.write(ctx, b, []byte("h"), 0, false))
+	require.NoError(t, wc.flush(ctx))
+	require.NoError(t, wc.takeErrs(func(n Node) bool { return n == b }))
+	require.Equal(t, errApply, wc.write(ctx, a, []byte("i"), 0, true))
+	require.NoError(t, wc.takeErrs(func(Node) bool { return true }))
+
+	// Held-back writes are applied in the background once the
+	// window is over.
+	config.SetWriteCoalesceWindow(time.Millisecond)
+	done := make(chan struct{})
+	wc.apply = func(ctx context.Context, file Node, data []byte, off int64,
+		noCopy bool) error {
+		close(done)
+		return nil
+	}
+	require.NoError(t, wc.write(ctx, a, []byte("f"), 0, false))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Held-back write wasn't applied")
+	}
+}
+
+func TestWriteCoalescingVisibleToReads(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetWriteCoalesceWindow(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	off := int64(0)
+	for _, s := range []string{"log ", "line ", "one"} {
+		err = kbfsOps.Write(ctx, fileNode, []byte(s), off)
+		require.NoError(t, err)
+		off += int64(len(s))
+	}
+
+	// Every operation that looks at the file sees the writes.
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(off), ei.Size)
+	buf := make([]byte, off)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "log line one", string(buf[:n]))
+
+	err = kbfsOps.Write(ctx, fileNode, []byte("!"), off)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf = make([]byte, off+1)
+	n, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "log line one!", string(buf[:n]))
+}
+
+func TestWriteCoalescingFlushAndWait(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetWriteCoalesceWindow(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("held back"), 0)
+	require.NoError(t, err)
+
+	// Flushing everything includes the held-back writes.
+	require.NoError(t, kbfsOps.FlushAndWait(ctx, nil))
+
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "alice", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 9)
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "held back", string(buf[:n]))
+}
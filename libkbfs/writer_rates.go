@@ -0,0 +1,140 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+const (
+	// writerRateWindow is how far back writerRateTracker counts
+	// each writer's updates to a folder.
+	writerRateWindow = 5 * time.Minute
+	// mdWriteBurst is how many MD writes a folder-branch can make
+	// back-to-back before mdWriteLimiter starts spacing them out.
+	mdWriteBurst = 10
+)
+
+// mdWriteLimiter spaces out this device's MD writes to one shared
+// folder, so that a device writing constantly (like a build bot)
+// leaves room in the folder's MD history for the other writers,
+// instead of making them lose every race for the next revision and
+// fall back to conflict resolution.  Short bursts are let through
+// right away.
+type mdWriteLimiter struct {
+	clock    Clock
+	interval time.Duration
+
+	lock sync.Mutex
+	// next is when the next write would be due if writes were
+	// spaced exactly interval apart.
+	next time.Time
+}
+
+// newMDWriteLimiter returns an mdWriteLimiter allowing perMinute
+// writes a minute, or nil if perMinute isn't positive.
+func newMDWriteLimiter(clock Clock, perMinute int) *mdWriteLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &mdWriteLimiter{
+		clock:    clock,
+		interval: time.Minute / time.Duration(perMinute),
+	}
+}
+
+// reserve claims a slot for one more write, and returns how long the
+// caller must wait before making it.
+func (l *mdWriteLimiter) reserve() time.Duration {
+	now := l.clock.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	var delay time.Duration
+	if ahead := l.next.Sub(now) -
+		time.Duration(mdWriteBurst-1)*l.interval; ahead > 0 {
+		delay = ahead
+	}
+	l.next = l.next.Add(l.interval)
+	return delay
+}
+
+// wait blocks until the caller may make its next write.
+func (l *mdWriteLimiter) wait(ctx context.Context) error {
+	delay := l.reserve()
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writerRateTracker counts the recent updates each writer has made to
+// one folder, whether from this device or others.
+type writerRateTracker struct {
+	clock Clock
+
+	lock    sync.Mutex
+	updates map[keybase1.UID][]time.Time
+}
+
+func newWriterRateTracker(clock Clock) *writerRateTracker {
+	return &writerRateTracker{
+		clock:   clock,
+		updates: make(map[keybase1.UID][]time.Time),
+	}
+}
+
+// forgetOldLocked forgets the updates from before the window ending
+// at now.
+func (wrt *writerRateTracker) forgetOldLocked(now time.Time) {
+	for writer, times := range wrt.updates {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= writerRateWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(wrt.updates, writer)
+		} else {
+			wrt.updates[writer] = times[i:]
+		}
+	}
+}
+
+// record notes that the given writer has just updated the folder.
+func (wrt *writerRateTracker) record(writer keybase1.UID) {
+	now := wrt.clock.Now()
+	wrt.lock.Lock()
+	defer wrt.lock.Unlock()
+	wrt.forgetOldLocked(now)
+	wrt.updates[writer] = append(wrt.updates[writer], now)
+}
+
+// rates returns how many updates a minute each writer has made to
+// the folder recently, or nil if there haven't been any.
+func (wrt *writerRateTracker) rates() map[keybase1.UID]float64 {
+	now := wrt.clock.Now()
+	wrt.lock.Lock()
+	defer wrt.lock.Unlock()
+	wrt.forgetOldLocked(now)
+	if len(wrt.updates) == 0 {
+		return nil
+	}
+	rates := make(map[keybase1.UID]float64, len(wrt.updates))
+	for writer, times := range wrt.updates {
+		rates[writer] = float64(len(times)) / writerRateWindow.Minutes()
+	}
+	return rates
+}
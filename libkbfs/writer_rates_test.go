@@ -0,0 +1,61 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDWriteLimiter(t *testing.T) {
+	require.Nil(t, newMDWriteLimiter(newTestClockNow(), 0))
+
+	clock := newTestClockNow()
+	l := newMDWriteLimiter(clock, 60)
+
+	// A burst goes through right away.
+	for i := 0; i < mdWriteBurst; i++ {
+		require.Equal(t, time.Duration(0), l.reserve())
+	}
+	// Then writes are spaced out.
+	require.Equal(t, time.Second, l.reserve())
+	require.Equal(t, 2*time.Second, l.reserve())
+
+	// Time passing frees up slots again.
+	clock.Add(2 * time.Second)
+	require.Equal(t, time.Second, l.reserve())
+	clock.Add(time.Minute)
+	for i := 0; i < mdWriteBurst; i++ {
+		require.Equal(t, time.Duration(0), l.reserve())
+	}
+}
+
+func TestWriterRateTracker(t *testing.T) {
+	clock := newTestClockNow()
+	wrt := newWriterRateTracker(clock)
+	require.Nil(t, wrt.rates())
+
+	bot := keybase1.MakeTestUID(1)
+	human := keybase1.MakeTestUID(2)
+	for i := 0; i < 50; i++ {
+		wrt.record(bot)
+	}
+	wrt.record(human)
+	require.Equal(t, map[keybase1.UID]float64{bot: 10, human: 0.2},
+		wrt.rates())
+
+	// Only the last few minutes count.
+	clock.Add(writerRateWindow - time.Minute)
+	wrt.record(human)
+	require.Equal(t, map[keybase1.UID]float64{bot: 10, human: 0.4},
+		wrt.rates())
+	clock.Add(time.Minute)
+	require.Equal(t, map[keybase1.UID]float64{human: 0.2}, wrt.rates())
+	clock.Add(writerRateWindow)
+	require.Nil(t, wrt.rates())
+}
@@ -0,0 +1,310 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// Packet types of version 3 of the SFTP protocol
+// (draft-ietf-secsh-filexfer-02), the one OpenSSH speaks.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Flags saying which attributes are present.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+// Flags for opening files.
+const (
+	fxfRead   = 0x00000001
+	fxfWrite  = 0x00000002
+	fxfAppend = 0x00000004
+	fxfCreat  = 0x00000008
+	fxfTrunc  = 0x00000010
+	fxfExcl   = 0x00000020
+)
+
+// File type bits of the permissions attribute, as in st_mode.
+const (
+	modeDir     = 0040000
+	modeRegular = 0100000
+	modeSymlink = 0120000
+)
+
+const (
+	// protocolVersion is the version of the protocol served.
+	protocolVersion = 3
+	// maxPacketLength is the longest packet a client may send.
+	// It's what OpenSSH allows, so clients don't send longer ones.
+	maxPacketLength = 256 * 1024
+	// maxReadLength is the most data returned by one read.
+	maxReadLength = maxPacketLength - 1024
+)
+
+var errBadMessage = errors.New("Malformed SFTP packet")
+
+// packetReader decodes the fields of a packet.  The first error is
+// kept, and every later field reads as zero.
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.buf) < n {
+		r.err = errBadMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *packetReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *packetReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// bytes returns a string field, without copying it.
+func (r *packetReader) bytes() []byte {
+	n := r.uint32()
+	if n > maxPacketLength {
+		r.err = errBadMessage
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *packetReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *packetReader) attrs() fileAttrs {
+	var a fileAttrs
+	a.flags = r.uint32()
+	if a.flags&attrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = r.uint32()
+		a.gid = r.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perms = r.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = r.uint32()
+		a.mtime = r.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		// No extended attributes are supported; skip them.
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.bytes()
+			r.bytes()
+		}
+	}
+	return a
+}
+
+// packetWriter encodes the fields of a packet.
+type packetWriter struct {
+	buf []byte
+}
+
+func (w *packetWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *packetWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *packetWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *packetWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *packetWriter) attrs(a fileAttrs) {
+	w.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		w.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		w.uint32(a.uid)
+		w.uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		w.uint32(a.perms)
+	}
+	if a.flags&attrACModTime != 0 {
+		w.uint32(a.atime)
+		w.uint32(a.mtime)
+	}
+}
+
+// readPacket reads the next packet, returning its type and the rest
+// of its contents.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n == 0 || n > maxPacketLength {
+		return 0, nil, errBadMessage
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+func writePacket(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = typ
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// fileAttrs are the attributes of a file, as sent in packets.  Only
+// the ones whose bits are set in flags are present.
+type fileAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perms uint32
+	atime uint32
+	mtime uint32
+}
+
+// attrsFromEntryInfo returns the attributes of an entry.  Since
+// KBFS has no owners, they're left out, and clients show the files
+// as their own.
+func attrsFromEntryInfo(ei libkbfs.EntryInfo) fileAttrs {
+	a := fileAttrs{
+		flags: attrSize | attrPermissions | attrACModTime,
+		size:  ei.Size,
+		mtime: uint32(ei.Mtime / int64(time.Second)),
+	}
+	switch ei.Type {
+	case libkbfs.Dir:
+		a.perms = modeDir | 0700
+	case libkbfs.Sym:
+		a.perms = modeSymlink | 0777
+	case libkbfs.Exec:
+		a.perms = modeRegular | 0700
+	default:
+		a.perms = modeRegular | 0600
+	}
+	a.atime = a.mtime
+	return a
+}
+
+// dirAttrs returns the attributes of a directory that isn't a KBFS
+// entry, like /private.
+func dirAttrs(mtime time.Time) fileAttrs {
+	return fileAttrs{
+		flags: attrPermissions | attrACModTime,
+		perms: modeDir | 0500,
+		atime: uint32(mtime.Unix()),
+		mtime: uint32(mtime.Unix()),
+	}
+}
+
+// longName returns the "ls -l" style line for an entry, which some
+// clients show as is.
+func longName(name string, a fileAttrs) string {
+	mode := os.FileMode(a.perms & 0777)
+	switch a.perms &^ 07777 {
+	case modeDir:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	}
+	mtime := time.Unix(int64(a.mtime), 0)
+	dateFormat := "Jan _2 15:04"
+	if time.Since(mtime) > 180*24*time.Hour {
+		dateFormat = "Jan _2  2006"
+	}
+	return fmt.Sprintf("%s 1 keybase keybase %8d %s %s",
+		mode, a.size, mtime.Format(dateFormat), name)
+}
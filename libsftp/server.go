@@ -0,0 +1,331 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// CtxSFTPTagKey is the type used for unique context tags within
+// libsftp.
+type CtxSFTPTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxSFTPTagKey = iota
+)
+
+// CtxOpID is the display name for the unique operation SFTP ID tag.
+const CtxOpID = "SFTPID"
+
+// maxSymlinkHops is how many symlinks are followed while resolving
+// one path.
+const maxSymlinkHops = 10
+
+// Server serves the folders of a KBFS instance over SFTP (version
+// 3, as spoken by OpenSSH), so that scp, rsync and sshfs can work
+// with KBFS without a kernel file system driver.  The tree is the
+// same as a mount's: /private and /public, holding the top-level
+// folders by name.
+//
+// The server only speaks the SFTP protocol itself; it leaves the
+// SSH transport, and so authentication, to whatever connects it to
+// the client.  It can be run as an sshd subsystem, with ServeConn
+// over standard input and output, or serve connections from the
+// same machine, like sshfs's "directport" ones, with Serve.
+type Server struct {
+	config    libkbfs.Config
+	log       logger.Logger
+	startTime time.Time
+}
+
+// NewServer returns a Server for the folders of the given config.
+func NewServer(config libkbfs.Config) *Server {
+	return &Server{
+		config:    config,
+		log:       config.MakeLogger("SFTP"),
+		startTime: config.Clock().Now(),
+	}
+}
+
+// Serve serves each connection accepted by the given listener as
+// one SFTP session, until the listener is closed.  Anyone who can
+// connect can read and write all of the user's folders, so the
+// listener should only accept connections from the same machine.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := s.ServeConn(conn)
+			s.log.CDebugf(nil, "SFTP session from %s ended: %v",
+				conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// ServeConn serves one SFTP session over the given stream, until
+// the client closes it.  It returns nil if the session ended
+// cleanly.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	ss := &session{
+		s:       s,
+		w:       rw,
+		handles: make(map[string]*handle),
+	}
+	defer ss.closeAll()
+	for {
+		typ, payload, err := readPacket(rw)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := ss.handlePacket(typ, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) withContext(ctx context.Context) context.Context {
+	logTags := make(logger.CtxLogTags)
+	logTags[CtxIDKey] = CtxOpID
+	ctx = logger.NewContextWithLogTags(ctx, logTags)
+	id, err := libkbfs.MakeRandomRequestID()
+	if err != nil {
+		s.log.Errorf("Couldn't make request ID: %v", err)
+	} else {
+		ctx = context.WithValue(ctx, CtxIDKey, id)
+	}
+	return ctx
+}
+
+// entry is something at a path served by a Server: the root, one of
+// the two folder lists, a top-level folder, or an entry in one.
+// node is set for top-level folders and everything in them, except
+// for symlinks that weren't followed.
+type entry struct {
+	path  string
+	names []string
+	ei    libkbfs.EntryInfo
+	node  libkbfs.Node
+}
+
+func (e *entry) isDir() bool {
+	return len(e.names) < 2 || e.ei.Type == libkbfs.Dir
+}
+
+func splitPath(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+func isPublicList(name string) (public bool, ok bool) {
+	switch name {
+	case "private":
+		return false, true
+	case "public":
+		return true, true
+	}
+	return false, false
+}
+
+// cleanPath returns the absolute, clean version of a path sent by a
+// client.  Relative paths are relative to the root.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (s *Server) getRootNode(ctx context.Context, name string,
+	public bool) (libkbfs.Node, libkbfs.EntryInfo, error) {
+	th, err := libkbfs.ParseTlfHandle(ctx, s.config.KBPKI(), name, public)
+	if nonCanon, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		th, err = libkbfs.ParseTlfHandle(
+			ctx, s.config.KBPKI(), nonCanon.NameToTry, public)
+	}
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
+	return s.config.KBFSOps().GetOrCreateRootNode(
+		ctx, th, libkbfs.MasterBranch)
+}
+
+// resolve looks up the entry at the given clean path.  Symlinks
+// along the way are followed, as long as they stay within their
+// top-level folder; a symlink at the end is only followed if follow
+// is true.
+func (s *Server) resolve(ctx context.Context, p string, follow bool) (
+	*entry, error) {
+	return s.resolveWithHops(ctx, p, follow, 0)
+}
+
+func (s *Server) resolveWithHops(ctx context.Context, p string,
+	follow bool, hops int) (*entry, error) {
+	names := splitPath(p)
+	e := &entry{path: p, names: names}
+	if len(names) == 0 {
+		return e, nil
+	}
+	public, ok := isPublicList(names[0])
+	if !ok {
+		return nil, libkbfs.NoSuchNameError{Name: names[0]}
+	}
+	if len(names) == 1 {
+		return e, nil
+	}
+
+	node, ei, err := s.getRootNode(ctx, names[1], public)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := s.config.KBFSOps()
+	for i, name := range names[2:] {
+		node, ei, err = kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			return nil, err
+		}
+		last := i+3 == len(names)
+		if ei.Type != libkbfs.Sym || (last && !follow) {
+			continue
+		}
+		tlfPath := "/" + strings.Join(names[:2], "/")
+		target := path.Join("/"+strings.Join(names[:i+2], "/"), ei.SymPath)
+		if path.IsAbs(ei.SymPath) || hops >= maxSymlinkHops ||
+			(target != tlfPath && !strings.HasPrefix(target, tlfPath+"/")) {
+			return nil, libkbfs.NoSuchNameError{Name: name}
+		}
+		target = path.Join(append([]string{target}, names[i+3:]...)...)
+		targetEntry, err := s.resolveWithHops(ctx, target, follow, hops+1)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the path the client asked for.
+		targetEntry.path = p
+		targetEntry.names = names
+		return targetEntry, nil
+	}
+	e.ei = ei
+	e.node = node
+	return e, nil
+}
+
+// resolveParent looks up the directory that holds, or would hold,
+// the entry at the given clean path, and returns its node along with
+// the name of the entry.  The directory must be in a top-level
+// folder.
+func (s *Server) resolveParent(ctx context.Context, p string) (
+	libkbfs.Node, string, error) {
+	names := splitPath(p)
+	if len(names) < 3 {
+		return nil, "", libkbfs.WriteAccessError{}
+	}
+	parent, err := s.resolve(ctx, path.Dir(p), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.isDir() || parent.node == nil {
+		return nil, "", libkbfs.NoSuchNameError{Name: path.Dir(p)}
+	}
+	return parent.node, names[len(names)-1], nil
+}
+
+// attrs returns the attributes of e.
+func (s *Server) attrs(e *entry) fileAttrs {
+	if e.node == nil && len(e.names) < 2 {
+		return dirAttrs(s.startTime)
+	}
+	return attrsFromEntryInfo(e.ei)
+}
+
+// nameEntry is one entry of a directory listing.
+type nameEntry struct {
+	name  string
+	attrs fileAttrs
+}
+
+// list returns the entries in the directory e, sorted by name.
+func (s *Server) list(ctx context.Context, e *entry) ([]nameEntry, error) {
+	switch len(e.names) {
+	case 0:
+		a := dirAttrs(s.startTime)
+		return []nameEntry{{"private", a}, {"public", a}}, nil
+	case 1:
+		public, _ := isPublicList(e.names[0])
+		favs, err := s.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, fav := range favs {
+			if fav.Public == public {
+				names = append(names, fav.Name)
+			}
+		}
+		sort.Strings(names)
+		entries := make([]nameEntry, 0, len(names))
+		for _, name := range names {
+			entries = append(entries, nameEntry{name, dirAttrs(s.startTime)})
+		}
+		return entries, nil
+	}
+
+	children, err := s.config.KBFSOps().GetDirChildren(ctx, e.node)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]nameEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries,
+			nameEntry{name, attrsFromEntryInfo(children[name])})
+	}
+	return entries, nil
+}
+
+// rename moves the entry at oldPath to newPath, replacing anything
+// already there if overwrite is true.
+func (s *Server) rename(ctx context.Context, oldPath, newPath string,
+	overwrite bool) error {
+	oldParent, oldName, err := s.resolveParent(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	newParent, newName, err := s.resolveParent(ctx, newPath)
+	if err != nil {
+		return err
+	}
+	kbfsOps := s.config.KBFSOps()
+	if !overwrite {
+		_, _, err := kbfsOps.Lookup(ctx, newParent, newName)
+		if err == nil {
+			return libkbfs.NameExistsError{Name: newName}
+		} else if _, ok := err.(libkbfs.NoSuchNameError); !ok {
+			return err
+		}
+	}
+	if oldParent.GetFolderBranch() == newParent.GetFolderBranch() {
+		return kbfsOps.Rename(ctx, oldParent, oldName, newParent, newName)
+	}
+	return kbfsOps.MoveAcrossFolders(
+		ctx, oldParent, oldName, newParent, newName, nil)
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks just enough SFTP to drive a Server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint32
+}
+
+// request sends a request with the given fields after its ID, and
+// returns the type and the rest of the response.
+func (c *testClient) request(typ byte, fields func(*packetWriter)) (
+	byte, *packetReader) {
+	c.id++
+	var pw packetWriter
+	pw.uint32(c.id)
+	fields(&pw)
+	require.NoError(c.t, writePacket(c.conn, typ, pw.buf))
+	respType, payload, err := readPacket(c.conn)
+	require.NoError(c.t, err)
+	r := &packetReader{buf: payload}
+	require.Equal(c.t, c.id, r.uint32())
+	return respType, r
+}
+
+func (c *testClient) requireOK(typ byte, r *packetReader) {
+	require.Equal(c.t, uint32(fxOK), c.status(typ, r))
+}
+
+// status returns the status code of a response.
+func (c *testClient) status(typ byte, r *packetReader) uint32 {
+	require.Equal(c.t, byte(fxpStatus), typ)
+	return r.uint32()
+}
+
+func (c *testClient) pathRequest(typ byte, p string) (byte, *packetReader) {
+	return c.request(typ, func(pw *packetWriter) { pw.string(p) })
+}
+
+func (c *testClient) open(p string, pflags uint32) string {
+	typ, r := c.request(fxpOpen, func(pw *packetWriter) {
+		pw.string(p)
+		pw.uint32(pflags)
+		pw.attrs(fileAttrs{})
+	})
+	require.Equal(c.t, byte(fxpHandle), typ)
+	return r.string()
+}
+
+func (c *testClient) stat(p string) fileAttrs {
+	typ, r := c.pathRequest(fxpStat, p)
+	require.Equal(c.t, byte(fxpAttrs), typ)
+	return r.attrs()
+}
+
+func (c *testClient) names(typ byte, r *packetReader) []string {
+	require.Equal(c.t, byte(fxpName), typ)
+	var names []string
+	for n := r.uint32(); n > 0; n-- {
+		names = append(names, r.string())
+		r.string()
+		r.attrs()
+	}
+	require.NoError(c.t, r.err)
+	return names
+}
+
+func TestServerSession(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(config).ServeConn(serverConn)
+	}()
+	c := &testClient{t: t, conn: clientConn}
+
+	require.NoError(t, writePacket(clientConn, fxpInit,
+		[]byte{0, 0, 0, protocolVersion}))
+	typ, payload, err := readPacket(clientConn)
+	require.NoError(t, err)
+	require.Equal(t, byte(fxpVersion), typ)
+	require.Equal(t, uint32(protocolVersion),
+		(&packetReader{buf: payload}).uint32())
+
+	require.Equal(t, []string{"/"}, c.names(c.pathRequest(fxpRealpath, ".")))
+
+	// Write a file, and read it back.
+	h := c.open("/private/alice/a", fxfWrite|fxfCreat|fxfTrunc)
+	c.requireOK(c.request(fxpWrite, func(pw *packetWriter) {
+		pw.string(h)
+		pw.uint64(0)
+		pw.string("hello")
+	}))
+	c.requireOK(c.pathRequest(fxpClose, h))
+	h = c.open("/private/alice/a", fxfRead)
+	typ, r := c.request(fxpRead, func(pw *packetWriter) {
+		pw.string(h)
+		pw.uint64(1)
+		pw.uint32(100)
+	})
+	require.Equal(t, byte(fxpData), typ)
+	require.Equal(t, "ello", r.string())
+	typ, r = c.request(fxpRead, func(pw *packetWriter) {
+		pw.string(h)
+		pw.uint64(5)
+		pw.uint32(100)
+	})
+	require.Equal(t, uint32(fxEOF), c.status(typ, r))
+	c.requireOK(c.pathRequest(fxpClose, h))
+
+	a := c.stat("/private/alice/a")
+	require.Equal(t, uint64(5), a.size)
+	require.Equal(t, uint32(modeRegular|0600), a.perms)
+	c.requireOK(c.request(fxpSetstat, func(pw *packetWriter) {
+		pw.string("/private/alice/a")
+		pw.attrs(fileAttrs{flags: attrPermissions, perms: 0755})
+	}))
+	require.Equal(t, uint32(modeRegular|0700),
+		c.stat("/private/alice/a").perms)
+
+	// Directories, renames and symlinks.
+	c.requireOK(c.request(fxpMkdir, func(pw *packetWriter) {
+		pw.string("/private/alice/d")
+		pw.attrs(fileAttrs{})
+	}))
+	c.requireOK(c.request(fxpRename, func(pw *packetWriter) {
+		pw.string("/private/alice/a")
+		pw.string("/private/alice/d/b")
+	}))
+	h = c.open("/private/alice/c", fxfWrite|fxfCreat)
+	c.requireOK(c.pathRequest(fxpClose, h))
+	typ, r = c.request(fxpRename, func(pw *packetWriter) {
+		pw.string("/private/alice/c")
+		pw.string("/private/alice/d/b")
+	})
+	require.Equal(t, uint32(fxFailure), c.status(typ, r))
+	c.requireOK(c.request(fxpExtended, func(pw *packetWriter) {
+		pw.string("posix-rename@openssh.com")
+		pw.string("/private/alice/c")
+		pw.string("/private/alice/d/b")
+	}))
+	require.Equal(t, uint64(0), c.stat("/private/alice/d/b").size)
+
+	c.requireOK(c.request(fxpSymlink, func(pw *packetWriter) {
+		pw.string("d")
+		pw.string("/private/alice/link")
+	}))
+	require.Equal(t, []string{"d"},
+		c.names(c.pathRequest(fxpReadlink, "/private/alice/link")))
+	typ, r = c.pathRequest(fxpLstat, "/private/alice/link")
+	require.Equal(t, byte(fxpAttrs), typ)
+	require.Equal(t, uint32(modeSymlink|0777), r.attrs().perms)
+	require.Equal(t, uint32(modeDir|0700),
+		c.stat("/private/alice/link").perms)
+
+	typ, r = c.pathRequest(fxpOpendir, "/private/alice")
+	require.Equal(t, byte(fxpHandle), typ)
+	h = r.string()
+	require.Equal(t, []string{"d", "link"},
+		c.names(c.pathRequest(fxpReaddir, h)))
+	require.Equal(t, uint32(fxEOF), c.status(c.pathRequest(fxpReaddir, h)))
+	c.requireOK(c.pathRequest(fxpClose, h))
+
+	typ, r = c.pathRequest(fxpOpendir, "/private")
+	require.Equal(t, byte(fxpHandle), typ)
+	h = r.string()
+	require.Contains(t, c.names(c.pathRequest(fxpReaddir, h)), "alice")
+	c.requireOK(c.pathRequest(fxpClose, h))
+
+	c.requireOK(c.pathRequest(fxpRemove, "/private/alice/d/b"))
+	c.requireOK(c.pathRequest(fxpRmdir, "/private/alice/d"))
+	require.Equal(t, uint32(fxNoSuchFile),
+		c.status(c.pathRequest(fxpStat, "/private/alice/d")))
+	require.Equal(t, uint32(fxNoSuchFile),
+		c.status(c.pathRequest(fxpStat, "/nowhere")))
+	require.Equal(t, uint32(fxOpUnsupported),
+		c.status(c.pathRequest(99, "/")))
+
+	require.NoError(t, clientConn.Close())
+	require.NoError(t, <-done)
+}
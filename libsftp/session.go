@@ -0,0 +1,551 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// readdirBatch is how many entries are returned by each read of a
+// directory.
+const readdirBatch = 100
+
+var errIsDir = errors.New("Is a directory")
+
+// handle is an open file or directory in a session.
+type handle struct {
+	path string
+	node libkbfs.Node
+	// For directories, the entries not yet returned, once the
+	// directory has been listed.
+	isDir   bool
+	listed  bool
+	entries []nameEntry
+	// For files, whether writes go to the end of the file, and
+	// whether there have been any since the last sync.
+	appendMode bool
+	dirty      bool
+}
+
+// session is one client's conversation with a Server.  Requests are
+// handled one at a time, in the order they arrive.
+type session struct {
+	s          *Server
+	w          io.Writer
+	handles    map[string]*handle
+	nextHandle uint64
+}
+
+// errorStatus returns the status code for the given error.
+func errorStatus(err error) uint32 {
+	switch err.(type) {
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError:
+		return fxNoSuchFile
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.DisallowedPrefixError, libkbfs.FolderFrozenError,
+		libkbfs.FolderArchivedError:
+		return fxPermissionDenied
+	}
+	return fxFailure
+}
+
+func (ss *session) send(typ byte, pw *packetWriter) error {
+	return writePacket(ss.w, typ, pw.buf)
+}
+
+func (ss *session) sendStatus(id uint32, code uint32, msg string) error {
+	var pw packetWriter
+	pw.uint32(id)
+	pw.uint32(code)
+	pw.string(msg)
+	pw.string("")
+	return ss.send(fxpStatus, &pw)
+}
+
+func (ss *session) sendError(ctx context.Context, id uint32, err error) error {
+	ss.s.log.CDebugf(ctx, "Request failed: %v", err)
+	return ss.sendStatus(id, errorStatus(err), err.Error())
+}
+
+// sendResult sends OK, or the status for err if it isn't nil.
+func (ss *session) sendResult(ctx context.Context, id uint32,
+	err error) error {
+	if err != nil {
+		return ss.sendError(ctx, id, err)
+	}
+	return ss.sendStatus(id, fxOK, "")
+}
+
+func (ss *session) sendNames(id uint32, names []nameEntry) error {
+	var pw packetWriter
+	pw.uint32(id)
+	pw.uint32(uint32(len(names)))
+	for _, n := range names {
+		pw.string(n.name)
+		pw.string(longName(n.name, n.attrs))
+		pw.attrs(n.attrs)
+	}
+	return ss.send(fxpName, &pw)
+}
+
+func (ss *session) sendAttrs(id uint32, a fileAttrs) error {
+	var pw packetWriter
+	pw.uint32(id)
+	pw.attrs(a)
+	return ss.send(fxpAttrs, &pw)
+}
+
+func (ss *session) addHandle(h *handle) string {
+	ss.nextHandle++
+	name := strconv.FormatUint(ss.nextHandle, 10)
+	ss.handles[name] = h
+	return name
+}
+
+func (ss *session) sendHandle(id uint32, h *handle) error {
+	var pw packetWriter
+	pw.uint32(id)
+	pw.string(ss.addHandle(h))
+	return ss.send(fxpHandle, &pw)
+}
+
+// closeAll syncs any files left open when the session ends.
+func (ss *session) closeAll() {
+	ctx := ss.s.withContext(context.Background())
+	for name, h := range ss.handles {
+		if h.dirty {
+			err := ss.s.config.KBFSOps().Sync(ctx, h.node)
+			if err != nil {
+				ss.s.log.CWarningf(ctx, "Couldn't sync %s: %v", h.path, err)
+			}
+		}
+		delete(ss.handles, name)
+	}
+}
+
+// handlePacket handles one packet from the client.  It only returns
+// an error if the session can't go on.
+func (ss *session) handlePacket(typ byte, payload []byte) error {
+	r := &packetReader{buf: payload}
+	if typ == fxpInit {
+		// The client's version doesn't matter; it has to accept
+		// version 3 anyway.
+		var pw packetWriter
+		pw.uint32(protocolVersion)
+		pw.string("posix-rename@openssh.com")
+		pw.string("1")
+		pw.string("fsync@openssh.com")
+		pw.string("1")
+		return ss.send(fxpVersion, &pw)
+	}
+
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	ctx := ss.s.withContext(context.Background())
+	ss.s.log.CDebugf(ctx, "Request %d of type %d", id, typ)
+	err := ss.handleRequest(ctx, typ, id, r)
+	if err == errBadMessage {
+		return ss.sendStatus(id, fxBadMessage, err.Error())
+	}
+	return err
+}
+
+func (ss *session) handleRequest(ctx context.Context, typ byte, id uint32,
+	r *packetReader) error {
+	kbfsOps := ss.s.config.KBFSOps()
+	switch typ {
+	case fxpOpen:
+		p := cleanPath(r.string())
+		pflags := r.uint32()
+		r.attrs()
+		if r.err != nil {
+			return r.err
+		}
+		h, err := ss.open(ctx, p, pflags)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		return ss.sendHandle(id, h)
+
+	case fxpOpendir:
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		e, err := ss.s.resolve(ctx, p, true)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		if !e.isDir() {
+			return ss.sendStatus(id, fxFailure, "Not a directory")
+		}
+		return ss.sendHandle(id, &handle{path: p, node: e.node, isDir: true})
+
+	case fxpClose:
+		name := r.string()
+		if r.err != nil {
+			return r.err
+		}
+		h, ok := ss.handles[name]
+		if !ok {
+			return ss.sendStatus(id, fxFailure, "No such handle")
+		}
+		delete(ss.handles, name)
+		var err error
+		if h.dirty {
+			err = kbfsOps.Sync(ctx, h.node)
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpRead:
+		h := ss.fileHandle(r.string())
+		off := r.uint64()
+		length := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if h == nil {
+			return ss.sendStatus(id, fxFailure, "No such file handle")
+		}
+		if length > maxReadLength {
+			length = maxReadLength
+		}
+		buf := make([]byte, length)
+		n, err := kbfsOps.Read(ctx, h.node, buf, int64(off))
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		if n == 0 && length > 0 {
+			return ss.sendStatus(id, fxEOF, "End of file")
+		}
+		var pw packetWriter
+		pw.uint32(id)
+		pw.bytes(buf[:n])
+		return ss.send(fxpData, &pw)
+
+	case fxpWrite:
+		h := ss.fileHandle(r.string())
+		off := r.uint64()
+		data := r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+		if h == nil {
+			return ss.sendStatus(id, fxFailure, "No such file handle")
+		}
+		if h.appendMode {
+			ei, err := kbfsOps.Stat(ctx, h.node)
+			if err != nil {
+				return ss.sendError(ctx, id, err)
+			}
+			off = ei.Size
+		}
+		err := kbfsOps.Write(ctx, h.node, data, int64(off))
+		if err == nil {
+			h.dirty = true
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpStat, fxpLstat:
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		e, err := ss.s.resolve(ctx, p, typ == fxpStat)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		return ss.sendAttrs(id, ss.s.attrs(e))
+
+	case fxpFstat:
+		name := r.string()
+		if r.err != nil {
+			return r.err
+		}
+		h, ok := ss.handles[name]
+		if !ok {
+			return ss.sendStatus(id, fxFailure, "No such handle")
+		}
+		if h.node == nil {
+			return ss.sendAttrs(id, dirAttrs(ss.s.startTime))
+		}
+		ei, err := kbfsOps.Stat(ctx, h.node)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		return ss.sendAttrs(id, attrsFromEntryInfo(ei))
+
+	case fxpSetstat:
+		p := cleanPath(r.string())
+		a := r.attrs()
+		if r.err != nil {
+			return r.err
+		}
+		e, err := ss.s.resolve(ctx, p, true)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		err = ss.setAttrs(ctx, e.node, a)
+		if err == nil && a.flags&attrSize != 0 {
+			// There's no handle to sync the new size on close.
+			err = kbfsOps.Sync(ctx, e.node)
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpFsetstat:
+		name := r.string()
+		a := r.attrs()
+		if r.err != nil {
+			return r.err
+		}
+		h, ok := ss.handles[name]
+		if !ok {
+			return ss.sendStatus(id, fxFailure, "No such handle")
+		}
+		err := ss.setAttrs(ctx, h.node, a)
+		if err == nil && a.flags&attrSize != 0 {
+			h.dirty = true
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpReaddir:
+		name := r.string()
+		if r.err != nil {
+			return r.err
+		}
+		h, ok := ss.handles[name]
+		if !ok || !h.isDir {
+			return ss.sendStatus(id, fxFailure, "No such directory handle")
+		}
+		if !h.listed {
+			e, err := ss.s.resolve(ctx, h.path, true)
+			if err != nil {
+				return ss.sendError(ctx, id, err)
+			}
+			h.entries, err = ss.s.list(ctx, e)
+			if err != nil {
+				return ss.sendError(ctx, id, err)
+			}
+			h.listed = true
+		}
+		if len(h.entries) == 0 {
+			return ss.sendStatus(id, fxEOF, "End of directory")
+		}
+		n := len(h.entries)
+		if n > readdirBatch {
+			n = readdirBatch
+		}
+		batch := h.entries[:n]
+		h.entries = h.entries[n:]
+		return ss.sendNames(id, batch)
+
+	case fxpRemove, fxpRmdir:
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		parent, name, err := ss.s.resolveParent(ctx, p)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		if typ == fxpRmdir {
+			err = kbfsOps.RemoveDir(ctx, parent, name)
+		} else {
+			err = kbfsOps.RemoveEntry(ctx, parent, name)
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpMkdir:
+		p := cleanPath(r.string())
+		r.attrs()
+		if r.err != nil {
+			return r.err
+		}
+		parent, name, err := ss.s.resolveParent(ctx, p)
+		if err == nil {
+			_, _, err = kbfsOps.CreateDir(ctx, parent, name)
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpRealpath:
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		// The path doesn't have to exist, so don't look it up.
+		return ss.sendNames(id, []nameEntry{{name: p}})
+
+	case fxpRename:
+		oldPath := cleanPath(r.string())
+		newPath := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		return ss.sendResult(ctx, id,
+			ss.s.rename(ctx, oldPath, newPath, false))
+
+	case fxpReadlink:
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		e, err := ss.s.resolve(ctx, p, false)
+		if err != nil {
+			return ss.sendError(ctx, id, err)
+		}
+		if e.ei.Type != libkbfs.Sym {
+			return ss.sendStatus(id, fxFailure, "Not a symlink")
+		}
+		return ss.sendNames(id, []nameEntry{{name: e.ei.SymPath}})
+
+	case fxpSymlink:
+		// OpenSSH, which everyone follows, sends the target before
+		// the path of the new link, in the opposite order from the
+		// draft.
+		target := r.string()
+		p := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		parent, name, err := ss.s.resolveParent(ctx, p)
+		if err == nil {
+			_, err = kbfsOps.CreateLink(ctx, parent, name, target)
+		}
+		return ss.sendResult(ctx, id, err)
+
+	case fxpExtended:
+		return ss.handleExtended(ctx, id, r)
+	}
+
+	return ss.sendStatus(id, fxOpUnsupported, "Unsupported request")
+}
+
+func (ss *session) handleExtended(ctx context.Context, id uint32,
+	r *packetReader) error {
+	switch r.string() {
+	case "posix-rename@openssh.com":
+		oldPath := cleanPath(r.string())
+		newPath := cleanPath(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		return ss.sendResult(ctx, id,
+			ss.s.rename(ctx, oldPath, newPath, true))
+
+	case "fsync@openssh.com":
+		h := ss.fileHandle(r.string())
+		if r.err != nil {
+			return r.err
+		}
+		if h == nil {
+			return ss.sendStatus(id, fxFailure, "No such file handle")
+		}
+		err := ss.s.config.KBFSOps().Sync(ctx, h.node)
+		if err == nil {
+			h.dirty = false
+		}
+		return ss.sendResult(ctx, id, err)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return ss.sendStatus(id, fxOpUnsupported, "Unsupported extension")
+}
+
+// fileHandle returns the open file with the given handle, or nil if
+// there isn't one.
+func (ss *session) fileHandle(name string) *handle {
+	h, ok := ss.handles[name]
+	if !ok || h.isDir {
+		return nil
+	}
+	return h
+}
+
+// open opens the file at p, creating or truncating it as the given
+// flags say.
+func (ss *session) open(ctx context.Context, p string, pflags uint32) (
+	*handle, error) {
+	kbfsOps := ss.s.config.KBFSOps()
+	e, err := ss.s.resolve(ctx, p, true)
+	var node libkbfs.Node
+	switch err.(type) {
+	case nil:
+		if pflags&fxfCreat != 0 && pflags&fxfExcl != 0 {
+			return nil, libkbfs.NameExistsError{Name: p}
+		}
+		if e.isDir() {
+			return nil, errIsDir
+		}
+		node = e.node
+	case libkbfs.NoSuchNameError:
+		if pflags&fxfCreat == 0 {
+			return nil, err
+		}
+		parent, name, err := ss.s.resolveParent(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		node, _, err = kbfsOps.CreateFile(ctx, parent, name, false)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	h := &handle{path: p, node: node, appendMode: pflags&fxfAppend != 0}
+	if pflags&fxfTrunc != 0 && pflags&fxfWrite != 0 {
+		if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+			return nil, err
+		}
+		h.dirty = true
+	}
+	return h, nil
+}
+
+// setAttrs applies the attributes a client set on an entry.  Owners
+// and access times can't be changed in KBFS, so they're ignored, as
+// are all permission bits but the owner's execute bit on files.
+func (ss *session) setAttrs(ctx context.Context, node libkbfs.Node,
+	a fileAttrs) error {
+	if node == nil {
+		return libkbfs.WriteAccessError{}
+	}
+	kbfsOps := ss.s.config.KBFSOps()
+	if a.flags&attrSize != 0 {
+		if err := kbfsOps.Truncate(ctx, node, a.size); err != nil {
+			return err
+		}
+	}
+	if a.flags&attrPermissions != 0 {
+		ei, err := kbfsOps.Stat(ctx, node)
+		if err != nil {
+			return err
+		}
+		ex := a.perms&0100 != 0
+		if ei.Type != libkbfs.Dir && (ei.Type == libkbfs.Exec) != ex {
+			if err := kbfsOps.SetEx(ctx, node, ex); err != nil {
+				return err
+			}
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		mtime := time.Unix(int64(a.mtime), 0)
+		if err := kbfsOps.SetMtime(ctx, node, &mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,675 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// CtxWebDAVTagKey is the type used for unique context tags within
+// libwebdav.
+type CtxWebDAVTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxWebDAVTagKey = iota
+)
+
+// CtxOpID is the display name for the unique operation WebDAV ID tag.
+const CtxOpID = "DAVID"
+
+const (
+	// maxSymlinkHops is how many symlinks are followed while
+	// resolving one path.
+	maxSymlinkHops = 10
+	// putChunkSize is how much of a PUT body is written at once.
+	putChunkSize = 512 * 1024
+)
+
+// Handler serves the folders of a KBFS instance over WebDAV (RFC
+// 4918, class 2), so that KBFS can be mounted with the WebDAV client
+// built into most operating systems, where FUSE and Dokan aren't
+// available.  The tree is the same as a mount's: /private and
+// /public, holding the top-level folders by name.
+//
+// Locks on files are also taken as KBFS file locks, so that they're
+// seen by other devices.  ETags change with every update to an
+// entry's metadata, and PUTs with a Content-Range header write just
+// that range.
+type Handler struct {
+	config    libkbfs.Config
+	log       logger.Logger
+	prefix    string
+	locks     *lockSystem
+	startTime time.Time
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns a Handler serving the folders of the given
+// config under the given URL path prefix (e.g., "/dav", or "" to
+// serve them at the root).  Anyone who can reach the handler can
+// read and write the user's private folders, so the prefix should
+// be hard to guess if the address it's served on isn't private.
+func NewHandler(config libkbfs.Config, prefix string) *Handler {
+	log := config.MakeLogger("DAV")
+	return &Handler{
+		config:    config,
+		log:       log,
+		prefix:    strings.TrimSuffix(prefix, "/"),
+		locks:     newLockSystem(config.KBFSOps(), log),
+		startTime: config.Clock().Now(),
+	}
+}
+
+func (h *Handler) withContext(ctx context.Context) context.Context {
+	logTags := make(logger.CtxLogTags)
+	logTags[CtxIDKey] = CtxOpID
+	ctx = logger.NewContextWithLogTags(ctx, logTags)
+	id, err := libkbfs.MakeRandomRequestID()
+	if err != nil {
+		h.log.Errorf("Couldn't make request ID: %v", err)
+	} else {
+		ctx = context.WithValue(ctx, CtxIDKey, id)
+	}
+	return ctx
+}
+
+// davPath returns the cleaned path of a resource within the tree
+// served by h, given the path of its URL.
+func (h *Handler) davPath(urlPath string) (string, bool) {
+	if urlPath != h.prefix && !strings.HasPrefix(urlPath, h.prefix+"/") {
+		return "", false
+	}
+	return path.Clean("/" + strings.TrimPrefix(urlPath, h.prefix)), true
+}
+
+// href returns the escaped URL path of the resource at p.
+func (h *Handler) href(p string, dir bool) string {
+	if dir && p != "/" {
+		p += "/"
+	}
+	return (&url.URL{Path: h.prefix + p}).EscapedPath()
+}
+
+// ServeHTTP implements the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := h.withContext(r.Context())
+	h.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+	p, ok := h.davPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var status int
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		status, err = h.serveOptions(w, r)
+	case "GET", "HEAD":
+		status, err = h.serveGet(ctx, w, r, p)
+	case "PUT":
+		status, err = h.servePut(ctx, w, r, p)
+	case "DELETE":
+		status, err = h.serveDelete(ctx, w, r, p)
+	case "MKCOL":
+		status, err = h.serveMkcol(ctx, w, r, p)
+	case "COPY", "MOVE":
+		status, err = h.serveCopyMove(ctx, w, r, p)
+	case "PROPFIND":
+		status, err = h.servePropfind(ctx, w, r, p)
+	case "PROPPATCH":
+		status, err = h.servePropPatch(ctx, w, r, p)
+	case "LOCK":
+		status, err = h.serveLock(ctx, w, r, p)
+	case "UNLOCK":
+		status, err = h.serveUnlock(ctx, w, r, p)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		h.log.CDebugf(ctx, "%s %s failed: %v", r.Method, p, err)
+		status = errorStatus(err)
+	}
+	if status != 0 {
+		http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			status)
+	}
+}
+
+// errorStatus returns the HTTP status for the given error.
+func errorStatus(err error) int {
+	if err == errLocked {
+		return http.StatusLocked
+	}
+	switch err.(type) {
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.DisallowedPrefixError, libkbfs.FolderFrozenError,
+		libkbfs.FolderArchivedError, libkbfs.DeletionNotConfirmedError:
+		return http.StatusForbidden
+	case libkbfs.NameExistsError, libkbfs.DirNotEmptyError:
+		return http.StatusConflict
+	case libkbfs.NameTooLongError, libkbfs.EmptyNameError:
+		return http.StatusBadRequest
+	case libkbfs.FileTooBigError:
+		return http.StatusRequestEntityTooLarge
+	case libkbfs.FolderQuotaExceededError:
+		return http.StatusInsufficientStorage
+	case libkbfs.FileLockConflictError:
+		return http.StatusLocked
+	}
+	return http.StatusInternalServerError
+}
+
+// resource is something at a path served by a Handler: the root,
+// one of the two folder lists, a top-level folder, or an entry in
+// one.
+type resource struct {
+	path  string
+	names []string
+	dir   bool
+	// entry is true, and ei is set, for top-level folders and
+	// everything in them, except for top-level folders only listed
+	// among the others, and not yet looked up.  node is also set
+	// for resources that have been looked up, rather than listed.
+	entry bool
+	ei    libkbfs.EntryInfo
+	node  libkbfs.Node
+}
+
+func splitPath(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+func isPublicList(name string) (public bool, ok bool) {
+	switch name {
+	case "private":
+		return false, true
+	case "public":
+		return true, true
+	}
+	return false, false
+}
+
+func (h *Handler) getRootNode(ctx context.Context, name string,
+	public bool) (libkbfs.Node, libkbfs.EntryInfo, error) {
+	th, err := libkbfs.ParseTlfHandle(ctx, h.config.KBPKI(), name, public)
+	if nonCanon, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		th, err = libkbfs.ParseTlfHandle(
+			ctx, h.config.KBPKI(), nonCanon.NameToTry, public)
+	}
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
+	return h.config.KBFSOps().GetOrCreateRootNode(
+		ctx, th, libkbfs.MasterBranch)
+}
+
+// resolve looks up the resource at the given path, following
+// symlinks, as long as they stay within their top-level folder.
+func (h *Handler) resolve(ctx context.Context, p string) (*resource, error) {
+	return h.resolveWithHops(ctx, p, 0)
+}
+
+func (h *Handler) resolveWithHops(ctx context.Context, p string,
+	hops int) (*resource, error) {
+	names := splitPath(p)
+	res := &resource{path: p, names: names, dir: true}
+	if len(names) == 0 {
+		return res, nil
+	}
+	public, ok := isPublicList(names[0])
+	if !ok {
+		return nil, libkbfs.NoSuchNameError{Name: names[0]}
+	}
+	if len(names) == 1 {
+		return res, nil
+	}
+
+	node, ei, err := h.getRootNode(ctx, names[1], public)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := h.config.KBFSOps()
+	for i, name := range names[2:] {
+		node, ei, err = kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			return nil, err
+		}
+		if ei.Type != libkbfs.Sym {
+			continue
+		}
+		tlfPath := "/" + strings.Join(names[:2], "/")
+		target := path.Join("/"+strings.Join(names[:i+2], "/"), ei.SymPath)
+		if path.IsAbs(ei.SymPath) || hops >= maxSymlinkHops ||
+			(target != tlfPath && !isUnder(target, tlfPath)) {
+			return nil, libkbfs.NoSuchNameError{Name: name}
+		}
+		target = path.Join(append([]string{target}, names[i+3:]...)...)
+		targetRes, err := h.resolveWithHops(ctx, target, hops+1)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the path the client asked for.
+		targetRes.path = p
+		targetRes.names = names
+		return targetRes, nil
+	}
+	res.entry = true
+	res.ei = ei
+	res.node = node
+	res.dir = ei.Type == libkbfs.Dir
+	return res, nil
+}
+
+// resolveParent looks up the directory that holds, or would hold,
+// the entry at the given path, and returns it along with the name
+// of the entry.  The directory must be in a top-level folder.
+func (h *Handler) resolveParent(ctx context.Context, p string) (
+	*resource, string, error) {
+	names := splitPath(p)
+	if len(names) < 3 {
+		return nil, "", libkbfs.WriteAccessError{}
+	}
+	parent, err := h.resolve(ctx, path.Dir(p))
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.dir || parent.node == nil {
+		return nil, "", libkbfs.NoSuchNameError{Name: path.Dir(p)}
+	}
+	return parent, names[len(names)-1], nil
+}
+
+// etag returns the ETag of an entry, which changes with every update
+// to its metadata.
+func etag(ei libkbfs.EntryInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, ei.Ctime, ei.Size)
+}
+
+func (h *Handler) serveOptions(
+	w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, "+
+		"COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+	w.WriteHeader(http.StatusOK)
+	return 0, nil
+}
+
+func (h *Handler) serveGet(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	res, err := h.resolve(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	if res.dir {
+		return http.StatusMethodNotAllowed, nil
+	}
+	w.Header().Set("ETag", etag(res.ei))
+	f := libfs.NewFileReadSeeker(
+		ctx, h.config.KBFSOps(), res.node, int64(res.ei.Size))
+	defer f.Close()
+	http.ServeContent(w, r, path.Base(p), time.Unix(0, res.ei.Mtime), f)
+	return 0, nil
+}
+
+// checkConditions checks the If-Match and If-None-Match headers of a
+// request that changes the resource at p, which is res, or nil if
+// nothing is there yet.
+func checkConditions(r *http.Request, res *resource) int {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if res == nil || (im != "*" && !strings.Contains(im, etag(res.ei))) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && res != nil {
+		if inm == "*" || strings.Contains(inm, etag(res.ei)) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	return 0
+}
+
+// parseContentRange parses the Content-Range header of a PUT that
+// writes part of a file, like "bytes 100-199/1000", and returns the
+// offset of the first byte.
+func parseContentRange(s string) (int64, error) {
+	var start, end int64
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/", &start, &end); err != nil {
+		return 0, fmt.Errorf("Bad Content-Range %q: %v", s, err)
+	}
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("Bad Content-Range %q", s)
+	}
+	return start, nil
+}
+
+func (h *Handler) servePut(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	parent, name, err := h.resolveParent(ctx, p)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return http.StatusConflict, nil
+	} else if err != nil {
+		return 0, err
+	}
+	err = h.locks.confirm(
+		submittedTokens(r.Header.Get("If")), false, p)
+	if err != nil {
+		return 0, err
+	}
+
+	partial := false
+	var off int64
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		off, err = parseContentRange(cr)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		partial = true
+	}
+
+	kbfsOps := h.config.KBFSOps()
+	res, err := h.resolve(ctx, p)
+	var node libkbfs.Node
+	created := false
+	switch err.(type) {
+	case nil:
+		if res.dir {
+			return http.StatusMethodNotAllowed, nil
+		}
+		if status := checkConditions(r, res); status != 0 {
+			return status, nil
+		}
+		node = res.node
+		if !partial {
+			if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+				return 0, err
+			}
+		}
+	case libkbfs.NoSuchNameError:
+		if status := checkConditions(r, nil); status != 0 {
+			return status, nil
+		}
+		node, _, err = kbfsOps.CreateFile(ctx, parent.node, name, false)
+		if err != nil {
+			return 0, err
+		}
+		created = true
+	default:
+		return 0, err
+	}
+
+	buf := make([]byte, putChunkSize)
+	for {
+		n, readErr := io.ReadFull(r.Body, buf)
+		if n > 0 {
+			if err := kbfsOps.Write(ctx, node, buf[:n], off); err != nil {
+				return 0, err
+			}
+			off += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return 0, readErr
+		}
+	}
+	if err := kbfsOps.Sync(ctx, node); err != nil {
+		return 0, err
+	}
+
+	if ei, err := kbfsOps.Stat(ctx, node); err == nil {
+		w.Header().Set("ETag", etag(ei))
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return 0, nil
+}
+
+// removeAll removes the entry with the given name from dir, along
+// with everything under it.
+func (h *Handler) removeAll(ctx context.Context, dir libkbfs.Node,
+	name string) error {
+	kbfsOps := h.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return kbfsOps.RemoveEntry(ctx, dir, name)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for child := range children {
+		if err := h.removeAll(ctx, node, child); err != nil {
+			return err
+		}
+	}
+	return kbfsOps.RemoveDir(ctx, dir, name)
+}
+
+func (h *Handler) serveDelete(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	parent, name, err := h.resolveParent(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	err = h.locks.confirm(submittedTokens(r.Header.Get("If")), true, p)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.removeAll(ctx, parent.node, name); err != nil {
+		return 0, err
+	}
+	h.locks.removeUnder(ctx, p)
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
+
+func (h *Handler) serveMkcol(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	parent, name, err := h.resolveParent(ctx, p)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return http.StatusConflict, nil
+	} else if err != nil {
+		return 0, err
+	}
+	err = h.locks.confirm(submittedTokens(r.Header.Get("If")), false, p)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = h.config.KBFSOps().CreateDir(ctx, parent.node, name)
+	if _, ok := err.(libkbfs.NameExistsError); ok {
+		return http.StatusMethodNotAllowed, nil
+	} else if err != nil {
+		return 0, err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+// copyFile copies the contents of the file src into dst, which
+// should be empty.
+func (h *Handler) copyFile(ctx context.Context, src libkbfs.Node,
+	dst libkbfs.Node) error {
+	kbfsOps := h.config.KBFSOps()
+	buf := make([]byte, putChunkSize)
+	var off int64
+	for {
+		n, err := kbfsOps.Read(ctx, src, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err := kbfsOps.Write(ctx, dst, buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return kbfsOps.Sync(ctx, dst)
+}
+
+// copyEntry copies src, with the given entry info, into dstDir as
+// name; if it's a directory and recursive is true, everything under
+// it is copied as well.
+func (h *Handler) copyEntry(ctx context.Context, src libkbfs.Node,
+	ei libkbfs.EntryInfo, dstDir libkbfs.Node, name string,
+	recursive bool) error {
+	kbfsOps := h.config.KBFSOps()
+	switch ei.Type {
+	case libkbfs.Sym:
+		_, err := kbfsOps.CreateLink(ctx, dstDir, name, ei.SymPath)
+		return err
+	case libkbfs.File, libkbfs.Exec:
+		dst, _, err := kbfsOps.CreateFile(
+			ctx, dstDir, name, ei.Type == libkbfs.Exec)
+		if err != nil {
+			return err
+		}
+		return h.copyFile(ctx, src, dst)
+	}
+
+	dst, _, err := kbfsOps.CreateDir(ctx, dstDir, name)
+	if err != nil || !recursive {
+		return err
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, src)
+	if err != nil {
+		return err
+	}
+	for child, childEI := range children {
+		var childNode libkbfs.Node
+		if childEI.Type != libkbfs.Sym {
+			childNode, _, err = kbfsOps.Lookup(ctx, src, child)
+			if err != nil {
+				return err
+			}
+		}
+		err := h.copyEntry(ctx, childNode, childEI, dst, child, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) serveCopyMove(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	move := r.Method == "MOVE"
+	destURL, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destURL.Path == "" {
+		return http.StatusBadRequest, nil
+	}
+	dest, ok := h.davPath(destURL.Path)
+	if !ok {
+		return http.StatusBadGateway, nil
+	}
+	if dest == p || isUnder(dest, p) {
+		return http.StatusForbidden, nil
+	}
+	recursive := true
+	if !move && r.Header.Get("Depth") == "0" {
+		recursive = false
+	}
+
+	srcParent, srcName, err := h.resolveParent(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	kbfsOps := h.config.KBFSOps()
+	srcNode, srcEI, err := kbfsOps.Lookup(ctx, srcParent.node, srcName)
+	if err != nil {
+		return 0, err
+	}
+	destParent, destName, err := h.resolveParent(ctx, dest)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		return http.StatusConflict, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	tokens := submittedTokens(r.Header.Get("If"))
+	if move {
+		err = h.locks.confirm(tokens, true, p, dest)
+	} else {
+		err = h.locks.confirm(tokens, true, dest)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Replace anything at the destination, unless the client
+	// asked not to.
+	existed := false
+	_, _, err = kbfsOps.Lookup(ctx, destParent.node, destName)
+	switch err.(type) {
+	case nil:
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		}
+		if err := h.removeAll(ctx, destParent.node, destName); err != nil {
+			return 0, err
+		}
+		h.locks.removeUnder(ctx, dest)
+		existed = true
+	case libkbfs.NoSuchNameError:
+	default:
+		return 0, err
+	}
+
+	if !move {
+		err = h.copyEntry(
+			ctx, srcNode, srcEI, destParent.node, destName, recursive)
+	} else if srcParent.node.GetFolderBranch() ==
+		destParent.node.GetFolderBranch() {
+		err = kbfsOps.Rename(
+			ctx, srcParent.node, srcName, destParent.node, destName)
+	} else {
+		err = kbfsOps.MoveAcrossFolders(ctx, srcParent.node, srcName,
+			destParent.node, destName, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if move {
+		h.locks.removeUnder(ctx, p)
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return 0, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type davClient struct {
+	t    *testing.T
+	base string
+}
+
+func (c davClient) do(method, p string, header http.Header, body string) (
+	*http.Response, string) {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.base+p, r)
+	require.NoError(c.t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+	return resp, string(respBody)
+}
+
+func makeTestServer(t *testing.T) (libkbfs.Config, davClient, func()) {
+	config := libkbfs.MakeTestConfigOrBust(t, "alice", "bob")
+	s := httptest.NewServer(NewHandler(config, "/dav"))
+	return config, davClient{t, s.URL + "/dav"}, func() {
+		s.Close()
+		libkbfs.CheckConfigAndShutdown(t, config)
+	}
+}
+
+func TestHandlerReadWrite(t *testing.T) {
+	_, c, shutdown := makeTestServer(t)
+	defer shutdown()
+	dir := "/private/alice/"
+
+	resp, _ := c.do("PUT", dir+"a%20b.txt", nil, "hello world")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.NotEqual(t, "", etag)
+
+	resp, body := c.do("GET", dir+"a%20b.txt", nil, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", body)
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// A partial write only changes the given range.
+	resp, _ = c.do("PUT", dir+"a%20b.txt", http.Header{
+		"Content-Range": {"bytes 6-10/11"},
+		"If-Match":      {etag},
+	}, "WORLD")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	newETag := resp.Header.Get("ETag")
+	require.NotEqual(t, etag, newETag)
+	_, body = c.do("GET", dir+"a%20b.txt", nil, "")
+	require.Equal(t, "hello WORLD", body)
+
+	// Writes based on an old version are refused.
+	resp, _ = c.do("PUT", dir+"a%20b.txt", http.Header{
+		"If-Match": {etag},
+	}, "stale")
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _ = c.do("MKCOL", dir+"d", nil, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = c.do("MKCOL", dir+"missing/d", nil, "")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, body = c.do("PROPFIND", dir, http.Header{"Depth": {"1"}}, "")
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	require.True(t, strings.Contains(body,
+		"<D:href>/dav/private/alice/a%20b.txt</D:href>"), body)
+	require.True(t, strings.Contains(body,
+		"<D:href>/dav/private/alice/d/</D:href>"), body)
+	require.True(t, strings.Contains(body,
+		"<D:getcontentlength>11</D:getcontentlength>"), body)
+
+	resp, body = c.do("PROPFIND", dir+"a%20b.txt", http.Header{
+		"Depth": {"0"},
+	}, `<?xml version="1.0"?><propfind xmlns="DAV:"><prop>`+
+		`<getcontentlength/><x:foo xmlns:x="urn:x"/></prop></propfind>`)
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	require.True(t, strings.Contains(body,
+		"<D:getcontentlength>11</D:getcontentlength>"), body)
+	require.True(t, strings.Contains(body, "HTTP/1.1 404 Not Found"), body)
+	require.False(t, strings.Contains(body, "getetag"), body)
+
+	resp, _ = c.do("COPY", dir+"a%20b.txt", http.Header{
+		"Destination": {c.base + dir + "d/c.txt"},
+	}, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = c.do("MOVE", dir+"d", http.Header{
+		"Destination": {c.base + dir + "e"},
+	}, "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_, body = c.do("GET", dir+"e/c.txt", nil, "")
+	require.Equal(t, "hello WORLD", body)
+
+	resp, _ = c.do("DELETE", dir+"e", nil, "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = c.do("GET", dir+"e/c.txt", nil, "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+var lockTokenRegexp = regexp.MustCompile(`<D:href>(opaquelocktoken:[^<]*)`)
+
+func TestHandlerLock(t *testing.T) {
+	_, c, shutdown := makeTestServer(t)
+	defer shutdown()
+	p := "/private/alice/locked"
+
+	// Locking a missing file creates it.
+	resp, body := c.do("LOCK", p, http.Header{"Timeout": {"Second-60"}},
+		`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:">`+
+			`<D:lockscope><D:exclusive/></D:lockscope>`+
+			`<D:locktype><D:write/></D:locktype>`+
+			`<D:owner><D:href>me</D:href></D:owner></D:lockinfo>`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	m := lockTokenRegexp.FindStringSubmatch(body)
+	require.NotNil(t, m, body)
+	token := m[1]
+	require.Equal(t, "<"+token+">", resp.Header.Get("Lock-Token"))
+	require.True(t, strings.Contains(body, "<D:exclusive/>"), body)
+	require.True(t, strings.Contains(body, "<D:timeout>Second-60</D:timeout>"),
+		body)
+
+	resp, _ = c.do("PUT", p, nil, "x")
+	require.Equal(t, http.StatusLocked, resp.StatusCode)
+	resp, _ = c.do("PUT", p, http.Header{"If": {"(<" + token + ">)"}}, "x")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, body = c.do("PROPFIND", p, http.Header{"Depth": {"0"}}, "")
+	require.True(t, strings.Contains(body, token), body)
+
+	resp, _ = c.do("UNLOCK", p, http.Header{
+		"Lock-Token": {"<opaquelocktoken:bogus>"}}, "")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = c.do("UNLOCK", p, http.Header{"Lock-Token": {"<" + token + ">"}},
+		"")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = c.do("PUT", p, nil, "y")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestHandlerPropPatchMtime(t *testing.T) {
+	config, c, shutdown := makeTestServer(t)
+	defer shutdown()
+	p := "/private/alice/f"
+
+	resp, _ := c.do("PUT", p, nil, "x")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, body := c.do("PROPPATCH", p, nil,
+		`<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" `+
+			`xmlns:Z="urn:schemas-microsoft-com:"><D:set><D:prop>`+
+			`<Z:Win32LastModifiedTime>Wed, 04 May 2016 12:00:00 GMT`+
+			`</Z:Win32LastModifiedTime></D:prop></D:set></D:propertyupdate>`)
+	require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	require.True(t, strings.Contains(body, "Win32LastModifiedTime"), body)
+
+	rootNode := libkbfs.GetRootNodeOrBust(t, config, "alice", false)
+	_, ei, err := config.KBFSOps().Lookup(
+		context.Background(), rootNode, "f")
+	require.NoError(t, err)
+	require.Equal(t, int64(1462363200), ei.Mtime/1e9)
+}
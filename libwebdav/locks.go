@@ -0,0 +1,428 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultLockTimeout is how long a lock lasts if the client
+	// doesn't ask for a timeout.
+	defaultLockTimeout = 10 * time.Minute
+	// maxLockTimeout is the longest a lock lasts without being
+	// refreshed, even if the client asks for longer.
+	maxLockTimeout = 24 * time.Hour
+)
+
+// errLocked is returned when a resource is locked by a lock whose
+// token the client didn't submit.
+var errLocked = errors.New("Resource is locked")
+
+// davLock is a WebDAV write lock on a resource, and on everything
+// under it if it has infinite depth.
+type davLock struct {
+	token     string
+	path      string
+	infinite  bool
+	exclusive bool
+	// owner is the inner XML of the owner element the client sent,
+	// which is handed back as is.
+	owner   string
+	timeout time.Duration
+	timer   *time.Timer
+
+	// If node is non-nil, the lock is on a file, and is also held
+	// as a KBFS file lock, with fileOwner as the owner, so that
+	// other devices see it.
+	node      libkbfs.Node
+	fileOwner uint64
+}
+
+// covers returns true if the lock applies to the given path.
+func (l *davLock) covers(p string) bool {
+	return l.path == p || (l.infinite && isUnder(p, l.path))
+}
+
+// isUnder returns true if p is strictly under dir.
+func isUnder(p, dir string) bool {
+	if dir == "/" {
+		return p != "/"
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// lockSystem keeps track of the WebDAV locks held on a Handler's
+// resources.  Locks only last as long as the process, but locks on
+// files are also taken as KBFS file locks, which keep processes on
+// other devices from locking the same files.
+type lockSystem struct {
+	kbfsOps libkbfs.KBFSOps
+	log     logger.Logger
+
+	lock    sync.Mutex
+	byToken map[string]*davLock
+}
+
+func newLockSystem(kbfsOps libkbfs.KBFSOps, log logger.Logger) *lockSystem {
+	return &lockSystem{
+		kbfsOps: kbfsOps,
+		log:     log,
+		byToken: make(map[string]*davLock),
+	}
+}
+
+func makeLockToken() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	// Make it a version 4 (random) UUID.
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x",
+		buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
+
+// create takes a new lock on the given path, which is a file if node
+// is non-nil.
+func (ls *lockSystem) create(ctx context.Context, p string, infinite bool,
+	exclusive bool, owner string, timeout time.Duration,
+	node libkbfs.Node) (*davLock, error) {
+	token, err := makeLockToken()
+	if err != nil {
+		return nil, err
+	}
+	l := &davLock{
+		token:     token,
+		path:      p,
+		infinite:  infinite,
+		exclusive: exclusive,
+		owner:     owner,
+		timeout:   timeout,
+	}
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	for _, other := range ls.byToken {
+		overlaps := other.covers(p) || (infinite && isUnder(other.path, p))
+		if overlaps && (exclusive || other.exclusive) {
+			return nil, errLocked
+		}
+	}
+
+	if node != nil {
+		var ownerBuf [8]byte
+		if _, err := rand.Read(ownerBuf[:]); err != nil {
+			return nil, err
+		}
+		l.node = node
+		l.fileOwner = binary.BigEndian.Uint64(ownerBuf[:])
+		lockType := libkbfs.FileLockRead
+		if exclusive {
+			lockType = libkbfs.FileLockWrite
+		}
+		err := ls.kbfsOps.SetFileLock(ctx, node, libkbfs.FileLock{
+			Type:  lockType,
+			Start: 0,
+			End:   math.MaxUint64,
+			Flock: true,
+			Owner: l.fileOwner,
+		}, false)
+		if _, ok := err.(libkbfs.FileLockConflictError); ok {
+			return nil, errLocked
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	l.timer = time.AfterFunc(timeout, func() { ls.expire(token) })
+	ls.byToken[token] = l
+	return l, nil
+}
+
+// refresh restarts the timeout of the lock with the given token, if
+// it covers the given path.
+func (ls *lockSystem) refresh(token string, p string,
+	timeout time.Duration) (*davLock, bool) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	l, ok := ls.byToken[token]
+	if !ok || !l.covers(p) {
+		return nil, false
+	}
+	l.timeout = timeout
+	l.timer.Reset(timeout)
+	return l, true
+}
+
+// releaseLocked removes the given lock.  The caller must release the
+// KBFS file lock, if it has a node, with releaseFileLock.
+func (ls *lockSystem) releaseLocked(l *davLock) {
+	l.timer.Stop()
+	delete(ls.byToken, l.token)
+}
+
+func (ls *lockSystem) releaseFileLock(ctx context.Context, l *davLock) {
+	if l.node == nil {
+		return
+	}
+	err := ls.kbfsOps.SetFileLock(ctx, l.node, libkbfs.FileLock{
+		Type:  libkbfs.FileLockUnlock,
+		Start: 0,
+		End:   math.MaxUint64,
+		Flock: true,
+		Owner: l.fileOwner,
+	}, false)
+	if err != nil {
+		ls.log.CDebugf(ctx, "Couldn't release the file lock of %s: %v",
+			l.path, err)
+	}
+}
+
+// unlock releases the lock with the given token, if it covers the
+// given path.
+func (ls *lockSystem) unlock(ctx context.Context, token string,
+	p string) bool {
+	ls.lock.Lock()
+	l, ok := ls.byToken[token]
+	if !ok || !l.covers(p) {
+		ls.lock.Unlock()
+		return false
+	}
+	ls.releaseLocked(l)
+	ls.lock.Unlock()
+	ls.releaseFileLock(ctx, l)
+	return true
+}
+
+func (ls *lockSystem) expire(token string) {
+	ls.lock.Lock()
+	l, ok := ls.byToken[token]
+	if !ok {
+		ls.lock.Unlock()
+		return
+	}
+	ls.releaseLocked(l)
+	ls.lock.Unlock()
+	ls.log.CDebugf(nil, "Lock on %s expired", l.path)
+	ls.releaseFileLock(context.Background(), l)
+}
+
+// removeUnder releases all the locks on p and anything under it,
+// once the resources there are gone.
+func (ls *lockSystem) removeUnder(ctx context.Context, p string) {
+	var removed []*davLock
+	ls.lock.Lock()
+	for _, l := range ls.byToken {
+		if l.path == p || isUnder(l.path, p) {
+			ls.releaseLocked(l)
+			removed = append(removed, l)
+		}
+	}
+	ls.lock.Unlock()
+	for _, l := range removed {
+		ls.releaseFileLock(ctx, l)
+	}
+}
+
+// confirm returns errLocked if any of the given paths is covered by
+// a lock whose token isn't in tokens.  If recursive is true, locks on
+// anything under the paths count too, for operations like DELETE
+// that affect whole trees.
+func (ls *lockSystem) confirm(tokens map[string]bool, recursive bool,
+	paths ...string) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	for _, l := range ls.byToken {
+		if tokens[l.token] {
+			continue
+		}
+		for _, p := range paths {
+			if l.covers(p) || (recursive && isUnder(l.path, p)) {
+				return errLocked
+			}
+		}
+	}
+	return nil
+}
+
+// active returns the locks that cover the given path.
+func (ls *lockSystem) active(p string) []davLock {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	var locks []davLock
+	for _, l := range ls.byToken {
+		if l.covers(p) {
+			locks = append(locks, *l)
+		}
+	}
+	return locks
+}
+
+var ifHeaderTokenRegexp = regexp.MustCompile(`<(opaquelocktoken:[^>]*)>`)
+
+// submittedTokens returns the lock tokens in the given If header.
+// Any token the client submits counts as proof that it holds the
+// lock; the other conditions an If header can express aren't
+// checked.
+func submittedTokens(ifHeader string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, m := range ifHeaderTokenRegexp.FindAllStringSubmatch(
+		ifHeader, -1) {
+		tokens[m[1]] = true
+	}
+	return tokens
+}
+
+// parseTimeout parses the value of a Timeout header, like
+// "Second-3600" or "Infinite, Second-4100000000".
+func parseTimeout(s string) time.Duration {
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "Infinite" {
+			return maxLockTimeout
+		}
+		if !strings.HasPrefix(t, "Second-") {
+			continue
+		}
+		var secs uint64
+		if _, err := fmt.Sscanf(t, "Second-%d", &secs); err != nil {
+			continue
+		}
+		if secs == 0 {
+			break
+		}
+		if secs > uint64(maxLockTimeout/time.Second) {
+			return maxLockTimeout
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return defaultLockTimeout
+}
+
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     *struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+func (h *Handler) writeLockDiscovery(w http.ResponseWriter, l *davLock,
+	status int) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xmlHeader+`<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+
+		h.activeLockXML(*l)+`</D:lockdiscovery></D:prop>`)
+}
+
+// serveLock takes a new lock, or refreshes an existing one if the
+// request has no body.  Locking a path where nothing exists yet
+// creates an empty file there.
+func (h *Handler) serveLock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	var info lockInfo
+	err := xml.NewDecoder(r.Body).Decode(&info)
+	if err == io.EOF {
+		// A refresh of the lock whose token is in the If header.
+		for token := range submittedTokens(r.Header.Get("If")) {
+			if l, ok := h.locks.refresh(token, p, timeout); ok {
+				h.writeLockDiscovery(w, l, http.StatusOK)
+				return 0, nil
+			}
+		}
+		return http.StatusPreconditionFailed, nil
+	} else if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	if info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil) {
+		return http.StatusBadRequest, nil
+	}
+
+	infinite := true
+	switch r.Header.Get("Depth") {
+	case "0":
+		infinite = false
+	case "", "infinity":
+	default:
+		return http.StatusBadRequest, nil
+	}
+
+	status := http.StatusOK
+	res, err := h.resolve(ctx, p)
+	if _, ok := err.(libkbfs.NoSuchNameError); ok {
+		parent, name, err := h.resolveParent(ctx, p)
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return http.StatusConflict, nil
+		} else if err != nil {
+			return 0, err
+		}
+		err = h.locks.confirm(submittedTokens(r.Header.Get("If")), false, p)
+		if err != nil {
+			return 0, err
+		}
+		node, ei, err := h.config.KBFSOps().CreateFile(
+			ctx, parent.node, name, false)
+		if err != nil {
+			return 0, err
+		}
+		res = &resource{path: p, names: splitPath(p), entry: true, ei: ei,
+			node: node}
+		status = http.StatusCreated
+	} else if err != nil {
+		return 0, err
+	}
+
+	var node libkbfs.Node
+	if !res.dir {
+		node = res.node
+	}
+	owner := ""
+	if info.Owner != nil {
+		owner = info.Owner.InnerXML
+	}
+	l, err := h.locks.create(ctx, p, infinite && res.dir,
+		info.Exclusive != nil, owner, timeout, node)
+	if err != nil {
+		return 0, err
+	}
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	h.writeLockDiscovery(w, l, status)
+	return 0, nil
+}
+
+func (h *Handler) serveUnlock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	token := strings.TrimSuffix(
+		strings.TrimPrefix(r.Header.Get("Lock-Token"), "<"), ">")
+	if token == "" {
+		return http.StatusBadRequest, nil
+	}
+	if !h.locks.unlock(ctx, token, p) {
+		return http.StatusConflict, nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
@@ -0,0 +1,366 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const davNamespace = "DAV:"
+
+// msNamespace holds the properties Windows uses for file times.
+const msNamespace = "urn:schemas-microsoft-com:"
+
+const xmlHeader = `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	// This can only fail if buf fails to write.
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// anyElem matches any XML element, and records its name and text.
+type anyElem struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []anyElem `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type propertyUpdate struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Props []anyElem `xml:",any"`
+	} `xml:"DAV: set>prop"`
+	Remove []struct {
+		Props []anyElem `xml:",any"`
+	} `xml:"DAV: remove>prop"`
+}
+
+// prop is a property of a resource, with its value as XML.
+type prop struct {
+	name  xml.Name
+	value string
+}
+
+// elem returns the property as an XML element.
+func (p prop) elem() string {
+	if p.name.Space == davNamespace {
+		return fmt.Sprintf("<D:%s>%s</D:%s>",
+			p.name.Local, p.value, p.name.Local)
+	}
+	return fmt.Sprintf(`<x:%s xmlns:x="%s">%s</x:%s>`, p.name.Local,
+		xmlEscape(p.name.Space), p.value, p.name.Local)
+}
+
+const supportedLockXML = "<D:lockentry><D:lockscope><D:exclusive/>" +
+	"</D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+	"<D:lockentry><D:lockscope><D:shared/></D:lockscope>" +
+	"<D:locktype><D:write/></D:locktype></D:lockentry>"
+
+// activeLockXML returns the activelock element describing l.
+func (h *Handler) activeLockXML(l davLock) string {
+	scope := "<D:shared/>"
+	if l.exclusive {
+		scope = "<D:exclusive/>"
+	}
+	depth := "0"
+	if l.infinite {
+		depth = "infinity"
+	}
+	owner := ""
+	if l.owner != "" {
+		owner = "<D:owner>" + l.owner + "</D:owner>"
+	}
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype>"+
+		"<D:lockscope>%s</D:lockscope><D:depth>%s</D:depth>%s"+
+		"<D:timeout>Second-%d</D:timeout>"+
+		"<D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		scope, depth, owner, int64(l.timeout/time.Second),
+		xmlEscape(l.token), xmlEscape(h.href(l.path, false)))
+}
+
+// props returns the live properties of res.  Resources that aren't
+// entries, like the folder lists, get the server's start time.
+func (h *Handler) props(res *resource) []prop {
+	davProp := func(name, value string) prop {
+		return prop{xml.Name{Space: davNamespace, Local: name}, value}
+	}
+	mtime := h.startTime
+	if res.entry {
+		mtime = time.Unix(0, res.ei.Mtime)
+	}
+	displayName := ""
+	if len(res.names) > 0 {
+		displayName = res.names[len(res.names)-1]
+	}
+	resourceType := ""
+	if res.dir {
+		resourceType = "<D:collection/>"
+	}
+	var lockXML bytes.Buffer
+	for _, l := range h.locks.active(res.path) {
+		lockXML.WriteString(h.activeLockXML(l))
+	}
+
+	props := []prop{
+		davProp("resourcetype", resourceType),
+		davProp("displayname", xmlEscape(displayName)),
+		davProp("creationdate", mtime.UTC().Format(time.RFC3339)),
+		davProp("getlastmodified", mtime.UTC().Format(http.TimeFormat)),
+		davProp("supportedlock", supportedLockXML),
+		davProp("lockdiscovery", lockXML.String()),
+	}
+	if res.entry {
+		props = append(props, davProp("getetag", xmlEscape(etag(res.ei))))
+	}
+	if !res.dir {
+		contentType := mime.TypeByExtension(path.Ext(res.path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		props = append(props,
+			davProp("getcontentlength",
+				strconv.FormatUint(res.ei.Size, 10)),
+			davProp("getcontenttype", xmlEscape(contentType)))
+	}
+	return props
+}
+
+// propstatXML returns a propstat element holding the given
+// properties, with the given status.
+func propstatXML(props []prop, status int) string {
+	var buf bytes.Buffer
+	buf.WriteString("<D:propstat><D:prop>")
+	for _, p := range props {
+		buf.WriteString(p.elem())
+	}
+	fmt.Fprintf(&buf, "</D:prop><D:status>HTTP/1.1 %d %s</D:status>"+
+		"</D:propstat>", status, http.StatusText(status))
+	return buf.String()
+}
+
+// responseXML returns a response element for the resource with the
+// given href, holding the given propstat elements.
+func responseXML(href string, propstats ...string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<D:response><D:href>%s</D:href>", xmlEscape(href))
+	for _, ps := range propstats {
+		buf.WriteString(ps)
+	}
+	buf.WriteString("</D:response>")
+	return buf.String()
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xmlHeader+`<D:multistatus xmlns:D="DAV:">`)
+	for _, r := range responses {
+		io.WriteString(w, r)
+	}
+	io.WriteString(w, "</D:multistatus>")
+}
+
+// children returns the resources in the collection res.
+func (h *Handler) children(ctx context.Context, res *resource) (
+	[]*resource, error) {
+	child := func(name string) *resource {
+		p := path.Join(res.path, name)
+		return &resource{path: p, names: splitPath(p), dir: true}
+	}
+	var children []*resource
+	switch len(res.names) {
+	case 0:
+		return []*resource{child("private"), child("public")}, nil
+	case 1:
+		public, _ := isPublicList(res.names[0])
+		favs, err := h.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public == public {
+				children = append(children, child(fav.Name))
+			}
+		}
+		return children, nil
+	}
+
+	entries, err := h.config.KBFSOps().GetDirChildren(ctx, res.node)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := child(name)
+		ei := entries[name]
+		if ei.Type == libkbfs.Sym {
+			// List the target instead, if it's reachable.
+			c, err = h.resolve(ctx, c.path)
+			if err != nil {
+				h.log.CDebugf(ctx, "Skipping symlink %s: %v",
+					path.Join(res.path, name), err)
+				continue
+			}
+		} else {
+			c.entry = true
+			c.ei = ei
+			c.dir = ei.Type == libkbfs.Dir
+		}
+		children = append(children, c)
+	}
+	return children, nil
+}
+
+func (h *Handler) servePropfind(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xmlHeader+`<D:error xmlns:D="DAV:">`+
+			`<D:propfind-finite-depth/></D:error>`)
+		return 0, nil
+	}
+
+	var req propfindRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err == io.EOF {
+		req.AllProp = &struct{}{}
+	} else if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	res, err := h.resolve(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	resources := []*resource{res}
+	if depth == "1" && res.dir {
+		children, err := h.children(ctx, res)
+		if err != nil {
+			return 0, err
+		}
+		resources = append(resources, children...)
+	}
+
+	responses := make([]string, 0, len(resources))
+	for _, res := range resources {
+		props := h.props(res)
+		href := h.href(res.path, res.dir)
+		switch {
+		case req.PropName != nil:
+			for i := range props {
+				props[i].value = ""
+			}
+			responses = append(responses,
+				responseXML(href, propstatXML(props, http.StatusOK)))
+		case req.Prop != nil:
+			byName := make(map[xml.Name]prop, len(props))
+			for _, p := range props {
+				byName[p.name] = p
+			}
+			var found, missing []prop
+			for _, elem := range req.Prop.Names {
+				if p, ok := byName[elem.XMLName]; ok {
+					found = append(found, p)
+				} else {
+					missing = append(missing, prop{name: elem.XMLName})
+				}
+			}
+			var propstats []string
+			if len(found) > 0 {
+				propstats = append(propstats,
+					propstatXML(found, http.StatusOK))
+			}
+			if len(missing) > 0 {
+				propstats = append(propstats,
+					propstatXML(missing, http.StatusNotFound))
+			}
+			responses = append(responses, responseXML(href, propstats...))
+		default:
+			responses = append(responses,
+				responseXML(href, propstatXML(props, http.StatusOK)))
+		}
+	}
+	writeMultistatus(w, responses)
+	return 0, nil
+}
+
+// servePropPatch lets clients set the modification time of an entry,
+// with DAV:getlastmodified or Windows' Win32LastModifiedTime.  Other
+// properties can't be stored, but are reported as set anyway, since
+// some clients refuse to write files otherwise.
+func (h *Handler) servePropPatch(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) (int, error) {
+	var update propertyUpdate
+	if err := xml.NewDecoder(r.Body).Decode(&update); err != nil {
+		return http.StatusBadRequest, nil
+	}
+	res, err := h.resolve(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	err = h.locks.confirm(submittedTokens(r.Header.Get("If")), false, p)
+	if err != nil {
+		return 0, err
+	}
+
+	var props []prop
+	for _, set := range update.Set {
+		for _, elem := range set.Props {
+			props = append(props, prop{name: elem.XMLName})
+			isMtime := elem.XMLName == xml.Name{
+				Space: davNamespace, Local: "getlastmodified"} ||
+				elem.XMLName == xml.Name{
+					Space: msNamespace, Local: "Win32LastModifiedTime"}
+			if !isMtime || res.node == nil {
+				continue
+			}
+			mtime, err := http.ParseTime(elem.Value)
+			if err != nil {
+				return http.StatusBadRequest, nil
+			}
+			err = h.config.KBFSOps().SetMtime(ctx, res.node, &mtime)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, remove := range update.Remove {
+		for _, elem := range remove.Props {
+			props = append(props, prop{name: elem.XMLName})
+		}
+	}
+	writeMultistatus(w, []string{responseXML(h.href(res.path, res.dir),
+		propstatXML(props, http.StatusOK))})
+	return 0, nil
+}
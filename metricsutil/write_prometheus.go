@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// prometheusQuantiles are the quantiles reported for timers and
+// histograms.
+var prometheusQuantiles = []float64{0.5, 0.9, 0.99}
+
+// PrometheusName turns the given metric name into a valid
+// Prometheus metric name, prepended with prefix and an underscore.
+// Any characters not allowed by Prometheus (like the dots in
+// "BlockServer.Get") are replaced with underscores.
+func PrometheusName(prefix, name string) string {
+	buf := []byte(prefix + "_" + name)
+	for i, c := range buf {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '_' || c == ':') {
+			buf[i] = '_'
+		}
+	}
+	return string(buf)
+}
+
+func writePrometheusSummary(w io.Writer, name string,
+	count int64, sum float64, ps []float64, scale float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range prometheusQuantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", name, q, ps[i]/scale)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n", name, sum/scale)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// WritePrometheus writes the metrics in the given registry to the
+// given io.Writer, in the Prometheus text exposition format.  Each
+// metric name is passed through PrometheusName with the given
+// prefix.  Counters and meters are written as counters, gauges as
+// gauges, and timers (in seconds) and histograms as summaries.
+// Healthchecks are skipped.
+func WritePrometheus(r metrics.Registry, prefix string, w io.Writer) {
+	var namedMetrics namedMetricSlice
+	r.Each(func(name string, i interface{}) {
+		namedMetrics = append(namedMetrics, namedMetric{name, i})
+	})
+
+	sort.Sort(namedMetrics)
+	for _, namedMetric := range namedMetrics {
+		name := PrometheusName(prefix, namedMetric.name)
+		switch metric := namedMetric.m.(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			fmt.Fprintf(w, "%s %d\n", name, metric.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(w, "%s %d\n", name, metric.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			fmt.Fprintf(w, "%s %g\n", name, metric.Value())
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			writePrometheusSummary(w, name, h.Count(), float64(h.Sum()),
+				h.Percentiles(prometheusQuantiles), 1)
+		case metrics.Meter:
+			m := metric.Snapshot()
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			fmt.Fprintf(w, "%s %d\n", name, m.Count())
+		case metrics.Timer:
+			t := metric.Snapshot()
+			writePrometheusSummary(w, name+"_seconds", t.Count(),
+				float64(t.Sum()), t.Percentiles(prometheusQuantiles),
+				float64(time.Second))
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package metricsutil
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusName(t *testing.T) {
+	require.Equal(t, "kbfs_BlockServer_Get",
+		PrometheusName("kbfs", "BlockServer.Get"))
+	require.Equal(t, "kbfs_a_b_c", PrometheusName("kbfs", "a-b c"))
+}
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("BlockCache.Hits", r).Inc(3)
+	metrics.GetOrRegisterGauge("DirtyBlockCache.TotalBytes", r).Update(10)
+	timer := metrics.NewTimer()
+	r.Register("KBFSOps.Sync", timer)
+	timer.Update(2 * time.Second)
+	timer.Update(2 * time.Second)
+
+	var buf bytes.Buffer
+	WritePrometheus(r, "kbfs", &buf)
+	require.Equal(t, `# TYPE kbfs_BlockCache_Hits counter
+kbfs_BlockCache_Hits 3
+# TYPE kbfs_DirtyBlockCache_TotalBytes gauge
+kbfs_DirtyBlockCache_TotalBytes 10
+# TYPE kbfs_KBFSOps_Sync_seconds summary
+kbfs_KBFSOps_Sync_seconds{quantile="0.5"} 2
+kbfs_KBFSOps_Sync_seconds{quantile="0.9"} 2
+kbfs_KBFSOps_Sync_seconds{quantile="0.99"} 2
+kbfs_KBFSOps_Sync_seconds_sum 4
+kbfs_KBFSOps_Sync_seconds_count 2
+`, buf.String())
+}
@@ -34,6 +34,9 @@ type opt struct {
 	expectedCanonicalTlfName string
 	tlfIsPublic              bool
 	users                    map[libkb.NormalizedUsername]User
+	numDevices               int
+	devices                  map[libkb.NormalizedUsername][]User
+	partitionedRoots         map[User]Node
 	t                        *testing.T
 	initDone                 bool
 	engine                   Engine
@@ -54,6 +57,11 @@ func test(t *testing.T, actions ...optionOp) {
 }
 
 func (o *opt) close() {
+	for _, devices := range o.devices {
+		for _, device := range devices[1:] {
+			o.expectSuccess("Shutdown", o.engine.Shutdown(device))
+		}
+	}
 	for _, user := range o.users {
 		o.expectSuccess("Shutdown", o.engine.Shutdown(user))
 	}
@@ -67,6 +75,16 @@ func (o *opt) runInitOnce() {
 	o.clock.Set(time.Unix(0, 0))
 	o.users = o.engine.InitTest(o.t, o.blockSize, o.blockChangeSize,
 		o.usernames, o.clock)
+	o.devices = make(map[libkb.NormalizedUsername][]User)
+	o.partitionedRoots = make(map[User]Node)
+	for name, user := range o.users {
+		o.devices[name] = []User{user}
+		for i := 1; i < o.numDevices; i++ {
+			device, err := o.engine.AddDevice(user)
+			o.expectSuccess("AddDevice", err)
+			o.devices[name] = append(o.devices[name], device)
+		}
+	}
 	o.initDone = true
 }
 
@@ -114,6 +132,15 @@ func blockChangeSize(n int64) optionOp {
 	}
 }
 
+// devices runs n instances of each user's device side by side, all
+// sharing the same servers and clock.  Use asDevice to pick the
+// instance that runs a set of operations.
+func devices(n int) optionOp {
+	return func(o *opt) {
+		o.numDevices = n
+	}
+}
+
 func skip(implementation, reason string) optionOp {
 	return func(c *opt) {
 		if c.engine.Name() == implementation {
@@ -254,15 +281,33 @@ func as(user username, fops ...fileOp) optionOp {
 	return func(o *opt) {
 		o.t.Log("as", user)
 		o.runInitOnce()
-		ctx := &ctx{
-			opt:  o,
-			user: o.users[libkb.NewNormalizedUsername(string(user))],
-		}
+		o.runFileOps(o.users[libkb.NewNormalizedUsername(string(user))], fops)
+	}
+}
 
-		for _, fop := range fops {
-			desc, err := runFileOp(ctx, fop)
-			ctx.expectSuccess(desc, err)
+// asDevice is like as, but runs the operations on the i'th instance
+// of the user's device, as set up by devices().
+func asDevice(user username, i int, fops ...fileOp) optionOp {
+	return func(o *opt) {
+		o.t.Log("as", user, "device", i)
+		o.runInitOnce()
+		devices := o.devices[libkb.NewNormalizedUsername(string(user))]
+		if i >= len(devices) {
+			o.failf("No device %d for user %s", i, user)
 		}
+		o.runFileOps(devices[i], fops)
+	}
+}
+
+func (o *opt) runFileOps(user User, fops []fileOp) {
+	ctx := &ctx{
+		opt:  o,
+		user: user,
+	}
+
+	for _, fop := range fops {
+		desc, err := runFileOp(ctx, fop)
+		ctx.expectSuccess(desc, err)
 	}
 }
 
@@ -270,6 +315,12 @@ func as(user username, fops ...fileOp) optionOp {
 // not called directly.
 func initRoot() fileOp {
 	return fileOp{func(c *ctx) error {
+		if root, ok := c.partitionedRoots[c.user]; ok {
+			// A partitioned instance can't look up its TLF
+			// on the server, so keep using the root it had.
+			c.rootNode = root
+			return nil
+		}
 		if !c.noSyncInit {
 			// Do this before GetRootDir so that we pick
 			// up any TLF name changes.
@@ -472,6 +523,40 @@ func reenableUpdates() fileOp {
 	}, IsInit}
 }
 
+// partition cuts the current user instance off from the servers.
+// Updates made by other instances in the meantime aren't seen until
+// heal is called, and until then the instance keeps using the TLF
+// root it had when it was partitioned.
+func partition() fileOp {
+	return fileOp{func(c *ctx) error {
+		if c.rootNode == nil {
+			err := initRoot().operation(c)
+			if err != nil {
+				return err
+			}
+		}
+		err := c.engine.SetPartitioned(c.user, true)
+		if err != nil {
+			return err
+		}
+		c.partitionedRoots[c.user] = c.rootNode
+		return nil
+	}, IsInit}
+}
+
+// heal reconnects a partitioned user instance, and catches it up with
+// the server.
+func heal() fileOp {
+	return fileOp{func(c *ctx) error {
+		err := c.engine.SetPartitioned(c.user, false)
+		if err != nil {
+			return err
+		}
+		delete(c.partitionedRoots, c.user)
+		return c.engine.SyncFromServerForTesting(c.user, c.tlfName, c.tlfIsPublic)
+	}, IsInit}
+}
+
 func forceQuotaReclamation() fileOp {
 	return fileOp{func(c *ctx) error {
 		err := c.engine.ForceQuotaReclamation(c.user, c.tlfName, c.tlfIsPublic)
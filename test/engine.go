@@ -109,6 +109,14 @@ type Engine interface {
 	AddNewAssertion(u User, oldAssertion, newAssertion string) (err error)
 	// Rekey rekeys the given TLF under the given user.
 	Rekey(u User, tlfName string, isPublic bool) (err error)
+	// AddDevice returns a new user instance for the same user and
+	// device as the given one, sharing the same servers and clock,
+	// so that tests can run several writers side by side.
+	AddDevice(u User) (User, error)
+	// SetPartitioned cuts the given user instance off from the
+	// servers, or reconnects it, based on the given bool.  Other
+	// instances sharing the same servers are unaffected.
+	SetPartitioned(u User, partitioned bool) (err error)
 	// Shutdown is called by the test harness when it is done with the
 	// given user.
 	Shutdown(u User) error
@@ -29,6 +29,7 @@ type fsEngine struct {
 	name       string
 	t          *testing.T
 	createUser func(t *testing.T, ith int, config *libkbfs.ConfigLocal) User
+	numUsers   int
 }
 type fsNode struct {
 	path string
@@ -39,6 +40,7 @@ type fsUser struct {
 	config *libkbfs.ConfigLocal
 	cancel func()
 	close  func()
+	heal   func()
 }
 
 // Perform Init for the engine
@@ -283,10 +285,44 @@ func (*fsEngine) Rekey(user User, tlfName string, isPublic bool) error {
 		[]byte("x"), 0644)
 }
 
+// AddDevice is called by the test harness to mount another instance
+// of the given user and device.
+func (e *fsEngine) AddDevice(user User) (User, error) {
+	u := user.(*fsUser)
+	if u.heal != nil {
+		return nil, errPartitioned
+	}
+	name, _, err := u.config.KBPKI().GetCurrentUserInfo(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c := libkbfs.ConfigAsUser(u.config, name)
+	e.numUsers++
+	return e.createUser(e.t, e.numUsers-1, c), nil
+}
+
+// SetPartitioned is called by the test harness to cut the given user
+// instance off from the servers, or to reconnect it.
+func (*fsEngine) SetPartitioned(user User, partitioned bool) (err error) {
+	u := user.(*fsUser)
+	switch {
+	case partitioned && u.heal == nil:
+		u.heal = partitionConfig(u.config)
+	case !partitioned && u.heal != nil:
+		u.heal()
+		u.heal = nil
+	}
+	return nil
+}
+
 // Shutdown is called by the test harness when it is done with the
 // given user.
 func (*fsEngine) Shutdown(user User) error {
 	u := user.(*fsUser)
+	if u.heal != nil {
+		u.heal()
+		u.heal = nil
+	}
 	u.cancel()
 	u.close()
 	return u.config.Shutdown()
@@ -393,6 +429,7 @@ func (e *fsEngine) InitTest(t *testing.T, blockSize int64,
 	for i, name := range users {
 		res[name] = e.createUser(t, i, cfgs[i])
 	}
+	e.numUsers = len(users)
 
 	return res
 }
@@ -21,6 +21,8 @@ type LibKBFS struct {
 	refs map[libkbfs.Config]map[libkbfs.Node]bool
 	// channels used to re-enable updates if disabled
 	updateChannels map[libkbfs.Config]map[libkbfs.FolderBranch]chan<- struct{}
+	// functions used to heal partitioned user instances
+	partitions map[libkbfs.Config]func()
 	// test object, mostly for logging
 	t *testing.T
 }
@@ -39,6 +41,7 @@ func (k *LibKBFS) Init() {
 	k.refs = make(map[libkbfs.Config]map[libkbfs.Node]bool)
 	k.updateChannels =
 		make(map[libkbfs.Config]map[libkbfs.FolderBranch]chan<- struct{})
+	k.partitions = make(map[libkbfs.Config]func())
 }
 
 // InitTest implements the Engine interface.
@@ -441,9 +444,44 @@ func (k *LibKBFS) Rekey(u User, tlfName string, isPublic bool) error {
 		context.Background(), dir.GetFolderBranch().Tlf)
 }
 
+// AddDevice implements the Engine interface.
+func (k *LibKBFS) AddDevice(u User) (User, error) {
+	config := u.(*libkbfs.ConfigLocal)
+	if _, ok := k.partitions[config]; ok {
+		return nil, errPartitioned
+	}
+
+	name, _, err := config.KBPKI().GetCurrentUserInfo(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c := libkbfs.ConfigAsUser(config, name)
+	k.refs[c] = make(map[libkbfs.Node]bool)
+	k.updateChannels[c] = make(map[libkbfs.FolderBranch]chan<- struct{})
+	return c, nil
+}
+
+// SetPartitioned implements the Engine interface.
+func (k *LibKBFS) SetPartitioned(u User, partitioned bool) error {
+	config := u.(*libkbfs.ConfigLocal)
+	heal, ok := k.partitions[config]
+	switch {
+	case partitioned && !ok:
+		k.partitions[config] = partitionConfig(config)
+	case !partitioned && ok:
+		heal()
+		delete(k.partitions, config)
+	}
+	return nil
+}
+
 // Shutdown implements the Engine interface.
 func (k *LibKBFS) Shutdown(u User) error {
 	config := u.(*libkbfs.ConfigLocal)
+	if heal, ok := k.partitions[config]; ok {
+		heal()
+		delete(k.partitions, config)
+	}
 	// drop references
 	k.refs[config] = make(map[libkbfs.Node]bool)
 	delete(k.refs, config)
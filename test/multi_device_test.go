@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These tests run several instances of the same user's device side by
+// side.
+
+package test
+
+import (
+	"testing"
+)
+
+// A partitioned device keeps serving what it has, and catches up once
+// the partition heals.
+func TestMultiDevicePartitionHeal(t *testing.T) {
+	test(t,
+		users("alice"),
+		devices(2),
+		asDevice(alice, 0,
+			mkfile("a", "hello"),
+		),
+		asDevice(alice, 1,
+			read("a", "hello"),
+			partition(),
+		),
+		asDevice(alice, 0,
+			write("a", "world"),
+			mkfile("b", "new"),
+		),
+		asDevice(alice, 1, noSync(),
+			read("a", "hello"),
+			notExists("b"),
+		),
+		asDevice(alice, 1, noSync(),
+			heal(),
+			read("a", "world"),
+			read("b", "new"),
+		),
+	)
+}
+
+// Two devices of the same user writing at once get their changes
+// merged by conflict resolution.
+func TestMultiDeviceSimultaneousWrites(t *testing.T) {
+	test(t,
+		users("alice"),
+		devices(2),
+		asDevice(alice, 0,
+			mkfile("a/b", "hello"),
+		),
+		asDevice(alice, 1,
+			disableUpdates(),
+		),
+		asDevice(alice, 0,
+			mkfile("a/c", "world"),
+		),
+		asDevice(alice, 1, noSync(),
+			mkfile("a/d", "uh oh"),
+			reenableUpdates(),
+			lsdir("a/", m{"b": "FILE", "c": "FILE", "d": "FILE"}),
+		),
+		asDevice(alice, 0,
+			lsdir("a/", m{"b": "FILE", "c": "FILE", "d": "FILE"}),
+			read("a/d", "uh oh"),
+		),
+	)
+}
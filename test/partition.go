@@ -0,0 +1,186 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"errors"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// errPartitioned is returned by every server call made by a user
+// instance that's been cut off from the servers.
+var errPartitioned = errors.New("Network partitioned for testing")
+
+// partitionedMDServer fails every call that would reach the MD
+// server.  Registrations made before the partition stay in place,
+// but any update they announce can't be fetched until the partition
+// heals.
+type partitionedMDServer struct {
+	libkbfs.MDServer
+}
+
+func (md partitionedMDServer) GetForHandle(ctx context.Context,
+	handle libkbfs.BareTlfHandle, mStatus libkbfs.MergeStatus) (
+	libkbfs.TlfID, *libkbfs.RootMetadataSigned, error) {
+	return libkbfs.NullTlfID, nil, errPartitioned
+}
+
+func (md partitionedMDServer) GetForTLF(ctx context.Context,
+	id libkbfs.TlfID, bid libkbfs.BranchID, mStatus libkbfs.MergeStatus) (
+	*libkbfs.RootMetadataSigned, error) {
+	return nil, errPartitioned
+}
+
+func (md partitionedMDServer) GetRange(ctx context.Context,
+	id libkbfs.TlfID, bid libkbfs.BranchID, mStatus libkbfs.MergeStatus,
+	start, stop libkbfs.MetadataRevision) (
+	[]*libkbfs.RootMetadataSigned, error) {
+	return nil, errPartitioned
+}
+
+func (md partitionedMDServer) Put(ctx context.Context,
+	rmds *libkbfs.RootMetadataSigned) error {
+	return errPartitioned
+}
+
+func (md partitionedMDServer) PruneBranch(ctx context.Context,
+	id libkbfs.TlfID, bid libkbfs.BranchID) error {
+	return errPartitioned
+}
+
+func (md partitionedMDServer) RegisterForUpdate(ctx context.Context,
+	id libkbfs.TlfID, currHead libkbfs.MetadataRevision) (
+	<-chan error, error) {
+	return nil, errPartitioned
+}
+
+func (md partitionedMDServer) GetRekeyHints(ctx context.Context) (
+	[]libkbfs.TlfID, error) {
+	return nil, errPartitioned
+}
+
+func (md partitionedMDServer) TruncateLock(ctx context.Context,
+	id libkbfs.TlfID) (bool, error) {
+	return false, errPartitioned
+}
+
+func (md partitionedMDServer) TruncateUnlock(ctx context.Context,
+	id libkbfs.TlfID) (bool, error) {
+	return false, errPartitioned
+}
+
+func (md partitionedMDServer) SetCheckpoint(ctx context.Context,
+	id libkbfs.TlfID, rev libkbfs.MetadataRevision) error {
+	return errPartitioned
+}
+
+func (md partitionedMDServer) GetHistoryStatus(ctx context.Context,
+	id libkbfs.TlfID) (libkbfs.MDHistoryStatus, error) {
+	return libkbfs.MDHistoryStatus{}, errPartitioned
+}
+
+func (md partitionedMDServer) GetFileLock(ctx context.Context,
+	id libkbfs.TlfID, file string, lock libkbfs.FileLock) (
+	libkbfs.FileLock, bool, error) {
+	return libkbfs.FileLock{}, false, errPartitioned
+}
+
+func (md partitionedMDServer) SetFileLock(ctx context.Context,
+	id libkbfs.TlfID, file string, lock libkbfs.FileLock) (bool, error) {
+	return false, errPartitioned
+}
+
+func (md partitionedMDServer) IsConnected() bool {
+	return false
+}
+
+func (md partitionedMDServer) GetLatestHandleForTLF(ctx context.Context,
+	id libkbfs.TlfID) (libkbfs.BareTlfHandle, error) {
+	return libkbfs.BareTlfHandle{}, errPartitioned
+}
+
+func (md partitionedMDServer) Capabilities(ctx context.Context) (
+	libkbfs.MDServerCapabilities, error) {
+	return libkbfs.MDServerCapabilities{}, errPartitioned
+}
+
+// partitionedBlockServer fails every call that would reach the block
+// server.
+type partitionedBlockServer struct {
+	libkbfs.BlockServer
+}
+
+func (b partitionedBlockServer) Get(ctx context.Context,
+	id libkbfs.BlockID, tlfID libkbfs.TlfID, context libkbfs.BlockContext) (
+	[]byte, libkbfs.BlockCryptKeyServerHalf, error) {
+	return nil, libkbfs.BlockCryptKeyServerHalf{}, errPartitioned
+}
+
+func (b partitionedBlockServer) GetKey(ctx context.Context,
+	id libkbfs.BlockID, tlfID libkbfs.TlfID,
+	context libkbfs.BlockContext) (libkbfs.BlockCryptKeyServerHalf, error) {
+	return libkbfs.BlockCryptKeyServerHalf{}, errPartitioned
+}
+
+func (b partitionedBlockServer) Put(ctx context.Context,
+	id libkbfs.BlockID, tlfID libkbfs.TlfID, context libkbfs.BlockContext,
+	buf []byte, serverHalf libkbfs.BlockCryptKeyServerHalf) error {
+	return errPartitioned
+}
+
+func (b partitionedBlockServer) AddBlockReference(ctx context.Context,
+	id libkbfs.BlockID, tlfID libkbfs.TlfID,
+	context libkbfs.BlockContext) error {
+	return errPartitioned
+}
+
+func (b partitionedBlockServer) RemoveBlockReference(ctx context.Context,
+	tlfID libkbfs.TlfID,
+	contexts map[libkbfs.BlockID][]libkbfs.BlockContext) (
+	map[libkbfs.BlockID]int, error) {
+	return nil, errPartitioned
+}
+
+func (b partitionedBlockServer) ArchiveBlockReferences(ctx context.Context,
+	tlfID libkbfs.TlfID,
+	contexts map[libkbfs.BlockID][]libkbfs.BlockContext) error {
+	return errPartitioned
+}
+
+func (b partitionedBlockServer) GetUserQuotaInfo(ctx context.Context) (
+	*libkbfs.UserQuotaInfo, error) {
+	return nil, errPartitioned
+}
+
+func (b partitionedBlockServer) GetTLFQuotaInfo(ctx context.Context,
+	tlfID libkbfs.TlfID) (*libkbfs.UsageStat, error) {
+	return nil, errPartitioned
+}
+
+func (b partitionedBlockServer) GetQuotaPoolInfo(ctx context.Context,
+	tlfID libkbfs.TlfID) (*libkbfs.QuotaPoolInfo, error) {
+	return nil, errPartitioned
+}
+
+func (b partitionedBlockServer) Capabilities(ctx context.Context) (
+	libkbfs.BlockServerCapabilities, error) {
+	return libkbfs.BlockServerCapabilities{}, errPartitioned
+}
+
+// partitionConfig cuts the given user instance off from the MD and
+// block servers, while the other instances sharing them carry on.
+// It returns a function that heals the partition.
+func partitionConfig(config *libkbfs.ConfigLocal) (heal func()) {
+	mdServer := config.MDServer()
+	bServer := config.BlockServer()
+	config.SetMDServer(partitionedMDServer{mdServer})
+	config.SetBlockServer(partitionedBlockServer{bServer})
+	return func() {
+		config.SetMDServer(mdServer)
+		config.SetBlockServer(bServer)
+	}
+}
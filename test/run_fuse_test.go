@@ -9,10 +9,10 @@ package test
 import (
 	"testing"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fs/fstestutil"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/fuse"
+	"github.com/keybase/kbfs/fuse/fs"
+	"github.com/keybase/kbfs/fuse/fs/fstestutil"
 	"github.com/keybase/kbfs/libfuse"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
@@ -36,7 +36,7 @@ func createUserFuse(t *testing.T, ith int, config *libkbfs.ConfigLocal) User {
 		debugLog.Debug("%s", msg)
 	}
 
-	filesys := libfuse.NewFS(config, nil, false)
+	filesys := libfuse.NewFS(config, nil, false, libfuse.DefaultMountOptions())
 	fn := func(mnt *fstestutil.Mount) fs.FS {
 		filesys.SetFuseConn(mnt.Server, mnt.Conn)
 		return filesys